@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"networking/internal/logger"
+	"networking/pkg/link"
+	"networking/pkg/stack"
+)
+
+const usage = `usage: httpd [flags]
+
+Serves HTTP over this project's user-space stack, attached to a TUN or TAP device (needs root). Give the kernel's
+side an address first, then curl the stack:
+  ip tuntap add dev tun0 mode tun && ip addr add 10.0.0.1/24 dev tun0 && ip link set tun0 up
+  httpd --tun tun0 --addr 10.0.0.2/24 --port 8080 --dir ./public
+  curl http://10.0.0.2:8080/
+
+Flags:
+`
+
+var logLevels = map[string]logger.LogLevels{
+	"debug":   logger.DEBUG,
+	"info":    logger.INFO,
+	"warning": logger.WARNING,
+	"error":   logger.ERROR,
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:]); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "httpd:", err)
+		}
+
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string) error {
+	flags := flag.NewFlagSet("httpd", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+
+	device := flags.String("tun", "tun0", "the TUN/TAP device to attach the stack to")
+	deviceType := flags.String("link", "tun", `"tun" for an IP link or "tap" for an Ethernet link`)
+	address := flags.String("addr", "10.0.0.2/24", "the stack's own address on the device")
+	gateway := flags.String("gateway", "", "default gateway, for clients beyond the device's subnet")
+	port := flags.Uint("port", 8080, "port to serve on")
+	dir := flags.String("dir", "", "directory to serve files from; without it, every request gets a greeting")
+	logLevel := flags.String("log-level", "warning", "debug, info, warning or error")
+	rulesFile := flags.String("rules", "", "packet filter rule file, to simulate blocked ports")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *port == 0 || *port > 0xFFFF {
+		return fmt.Errorf("--port must be between 1 and 65535")
+	}
+
+	level, ok := logLevels[strings.ToLower(*logLevel)]
+	if !ok {
+		return fmt.Errorf("unknown log level %q", *logLevel)
+	}
+
+	prefix, err := netip.ParsePrefix(*address)
+	if err != nil {
+		return fmt.Errorf("invalid --addr: %w", err)
+	}
+
+	var gatewayAddr netip.Addr
+	if *gateway != "" {
+		if gatewayAddr, err = netip.ParseAddr(*gateway); err != nil {
+			return fmt.Errorf("invalid --gateway: %w", err)
+		}
+	}
+
+	var rules []byte
+	if *rulesFile != "" {
+		if rules, err = os.ReadFile(*rulesFile); err != nil {
+			return fmt.Errorf("invalid --rules: %w", err)
+		}
+	}
+
+	var l *link.Device
+
+	switch *deviceType {
+	case "tun":
+		l, err = link.NewTUN(*device)
+	case "tap":
+		l, err = link.NewTAP(*device)
+	default:
+		err = fmt.Errorf("unknown link type %q", *deviceType)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	module := "httpd"
+	ctx = logger.NewLoggerWithOptions(logger.Options{Module: &module, MinLevel: level}).WithLogger(ctx)
+
+	// On a TAP link, IPv6 comes up by itself from the routers on the bridge
+	s := stack.New(ctx, stack.Options{IPv6Autoconf: true})
+	defer func() {
+		_ = s.Close()
+	}()
+
+	if _, err := s.AddInterface(l.Name(), l, prefix); err != nil {
+		_ = l.Close()
+		return err
+	}
+
+	if err := s.LoadFilterRules(bytes.NewReader(rules)); err != nil {
+		return fmt.Errorf("invalid --rules: %w", err)
+	}
+
+	if gatewayAddr.IsValid() {
+		if err := s.AddRoute(stack.Route{Destination: netip.PrefixFrom(netip.IPv4Unspecified(), 0), Gateway: gatewayAddr}); err != nil {
+			return err
+		}
+	}
+
+	listener, err := s.ListenTCP(netip.AddrPortFrom(netip.IPv4Unspecified(), uint16(*port)))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "serving http://%s:%d/ via %s\n", prefix.Addr(), *port, l.Name())
+
+	return serve(ctx, listener, newHandler(*dir))
+}
+
+// newHandler serves dir, or greets whoever asks if there is no dir
+func newHandler(dir string) http.Handler {
+	if dir != "" {
+		return http.FileServer(http.Dir(dir))
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "Hello from a user-space TCP/IP stack, %s\n", r.RemoteAddr)
+	})
+}
+
+// serve runs an HTTP server on listener until ctx is cancelled, then gives requests in progress a moment to finish
+func serve(ctx context.Context, listener net.Listener, handler http.Handler) error {
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	if err := <-done; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
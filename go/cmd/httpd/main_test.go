@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/link"
+	"networking/pkg/stack"
+)
+
+// newStackClient starts serve for handler on one stack, and returns an HTTP client that dials it from another
+func newStackClient(t *testing.T, handler http.Handler) *http.Client {
+	t.Helper()
+
+	linkA, linkB := link.NewPipe(link.IP, 1500)
+	client := stack.New(context.Background(), stack.Options{})
+	server := stack.New(context.Background(), stack.Options{})
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	_, err := client.AddInterface("a0", linkA, netip.MustParsePrefix("10.0.0.1/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	_, err = server.AddInterface("b0", linkB, netip.MustParsePrefix("10.0.0.2/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	listener, err := server.ListenTCP(netip.AddrPortFrom(netip.IPv4Unspecified(), 8080))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- serve(ctx, listener, handler)
+	}()
+
+	t.Cleanup(func() {
+		cancel()
+		testhelpers.FailTestIfErrorIsPresent(t, <-done)
+	})
+
+	return &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+				remote, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return nil, err
+				}
+
+				return client.DialTCP(ctx, netip.AddrPort{}, remote)
+			},
+		},
+	}
+}
+
+func get(t *testing.T, client *http.Client, url string) string {
+	t.Helper()
+
+	response, err := client.Get(url)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(response.Body)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return string(body)
+}
+
+func Test_Serve_Greeting(t *testing.T) {
+	client := newStackClient(t, newHandler(""))
+
+	if body := get(t, client, "http://10.0.0.2:8080/"); !strings.HasPrefix(body, "Hello from a user-space TCP/IP stack, 10.0.0.1:") {
+		t.Errorf("unexpected greeting %q", body)
+	}
+}
+
+func Test_Serve_Directory(t *testing.T) {
+	dir := t.TempDir()
+	content := strings.Repeat("served over the stack\n", 5000)
+
+	err := os.WriteFile(filepath.Join(dir, "index.txt"), []byte(content), 0o600)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	client := newStackClient(t, newHandler(dir))
+
+	if body := get(t, client, "http://10.0.0.2:8080/index.txt"); body != content {
+		t.Errorf("expected the %d byte file, got %d bytes", len(content), len(body))
+	}
+}
+
+func Test_Run_RejectsBadPort(t *testing.T) {
+	err := run(context.Background(), []string{"--port", "0"})
+
+	if err == nil || err.Error() != "--port must be between 1 and 65535" {
+		t.Errorf("expected a port error, got %v", err)
+	}
+}
+
+func Test_Run_RejectsBadGateway(t *testing.T) {
+	err := run(context.Background(), []string{"--gateway", "not-an-address"})
+
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid --gateway") {
+		t.Errorf("expected a gateway error, got %v", err)
+	}
+}
+
+func Test_Run_RejectsMissingRules(t *testing.T) {
+	err := run(context.Background(), []string{"--rules", filepath.Join(t.TempDir(), "missing.rules")})
+
+	if err == nil || !strings.HasPrefix(err.Error(), "invalid --rules") {
+		t.Errorf("expected a rules error, got %v", err)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// Largest payload that fits in a single IPv4 UDP datagram
+const maxDatagramLength = 65507
+
+func newFlagSet(name string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet("udp "+name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	return flags
+}
+
+func runSend(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := newFlagSet("send", stderr)
+	transport := &transportFlags{stderr: stderr}
+	transport.register(flags)
+	to := flags.String("to", "", "host:port to send to")
+	wait := flags.Duration("wait", 0, "after sending, print any replies received within this long")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *to == "" {
+		return fmt.Errorf("--to is required")
+	}
+
+	destination, err := net.ResolveUDPAddr("udp4", *to)
+	if err != nil {
+		return err
+	}
+
+	conn, cleanup, err := transport.open(ctx, 0)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := sendLines(conn, destination, stdin); err != nil {
+		return err
+	}
+
+	if *wait <= 0 {
+		return nil
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(*wait))
+
+	return printDatagrams(ctx, conn, stdout)
+}
+
+// sendLines sends every line of input, newline included like netcat does, as its own datagram
+func sendLines(conn net.PacketConn, destination net.Addr, input io.Reader) error {
+	reader := bufio.NewReaderSize(input, maxDatagramLength)
+
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			if _, writeErr := conn.WriteTo(line, destination); writeErr != nil {
+				return writeErr
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+
+		// A line longer than a datagram is sent in datagram-sized pieces
+		if err != nil && !errors.Is(err, bufio.ErrBufferFull) {
+			return err
+		}
+	}
+}
+
+func runListen(ctx context.Context, args []string, stdout, stderr io.Writer) error {
+	flags := newFlagSet("listen", stderr)
+	transport := &transportFlags{stderr: stderr}
+	transport.register(flags)
+	port := flags.Uint("port", 0, "port to listen on")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *port == 0 || *port > 0xFFFF {
+		return fmt.Errorf("--port must be between 1 and 65535")
+	}
+
+	conn, cleanup, err := transport.open(ctx, uint16(*port))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	fmt.Fprintf(stderr, "listening on %s via %s\n", conn.LocalAddr(), transport.transport)
+
+	return printDatagrams(ctx, conn, stdout)
+}
+
+func runEcho(ctx context.Context, args []string, stderr io.Writer) error {
+	flags := newFlagSet("echo", stderr)
+	transport := &transportFlags{stderr: stderr}
+	transport.register(flags)
+	port := flags.Uint("port", 7, "port to echo on")
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if *port == 0 || *port > 0xFFFF {
+		return fmt.Errorf("--port must be between 1 and 65535")
+	}
+
+	conn, cleanup, err := transport.open(ctx, uint16(*port))
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	fmt.Fprintf(stderr, "echoing on %s via %s\n", conn.LocalAddr(), transport.transport)
+
+	return echoDatagrams(ctx, conn)
+}
+
+// printDatagrams prints every datagram until ctx is cancelled or the read deadline passes
+func printDatagrams(ctx context.Context, conn net.PacketConn, out io.Writer) error {
+	return readDatagrams(ctx, conn, func(from net.Addr, data []byte) error {
+		_, err := fmt.Fprintf(out, "%s (%d bytes): %q\n", from, len(data), data)
+		return err
+	})
+}
+
+func echoDatagrams(ctx context.Context, conn net.PacketConn) error {
+	return readDatagrams(ctx, conn, func(from net.Addr, data []byte) error {
+		_, err := conn.WriteTo(data, from)
+		return err
+	})
+}
+
+func readDatagrams(ctx context.Context, conn net.PacketConn, handle func(from net.Addr, data []byte) error) error {
+	// Moving the read deadline wakes a blocked read on both transports
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	buffer := make([]byte, maxDatagramLength)
+
+	for {
+		n, from, err := conn.ReadFrom(buffer)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if err := handle(from, buffer[:n]); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/link"
+	"networking/pkg/stack"
+)
+
+// newStackConns returns two sockets on stacks joined by an in-process link
+func newStackConns(t *testing.T) (net.PacketConn, net.PacketConn) {
+	t.Helper()
+
+	linkA, linkB := link.NewPipe(link.Ethernet, 1500)
+	a := stack.New(context.Background(), stack.Options{})
+	b := stack.New(context.Background(), stack.Options{})
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+
+	_, err := a.AddInterface("a0", linkA, netip.MustParsePrefix("10.0.0.1/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	_, err = b.AddInterface("b0", linkB, netip.MustParsePrefix("10.0.0.2/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	connA, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	connB, err := b.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return connA, connB
+}
+
+func newOSConns(t *testing.T) (net.PacketConn, net.PacketConn) {
+	t.Helper()
+
+	client, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	server, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+
+	return client, server
+}
+
+func testEcho(t *testing.T, client, server net.PacketConn) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- echoDatagrams(ctx, server)
+	}()
+
+	err := sendLines(client, server.LocalAddr(), strings.NewReader("one\ntwo\nno newline"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	var out bytes.Buffer
+	_ = client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	err = printDatagrams(context.Background(), client, &out)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	cancel()
+	testhelpers.FailTestIfErrorIsPresent(t, <-done)
+
+	expected := []string{`(4 bytes): "one\n"`, `(4 bytes): "two\n"`, `(10 bytes): "no newline"`}
+	for _, line := range expected {
+		if !strings.Contains(out.String(), server.LocalAddr().String()+" "+line) {
+			t.Errorf("expected output to contain %q, got:\n%s", line, out.String())
+		}
+	}
+}
+
+func Test_Echo_OSTransport(t *testing.T) {
+	client, server := newOSConns(t)
+	testEcho(t, client, server)
+}
+
+func Test_Echo_StackTransport(t *testing.T) {
+	client, server := newStackConns(t)
+
+	// The stack's socket is bound to the wildcard address, so send to the address it is reachable on
+	testEcho(t, client, &boundTo{PacketConn: server, addr: &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7}})
+}
+
+func Test_Echo_StackReflectsEmptyDatagrams(t *testing.T) {
+	client, server := newStackConns(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- echoDatagrams(ctx, server)
+	}()
+
+	_, err := client.WriteTo(nil, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 7})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := client.ReadFrom(make([]byte, maxDatagramLength))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	cancel()
+	testhelpers.FailTestIfErrorIsPresent(t, <-done)
+
+	if n != 0 {
+		t.Errorf("expected an empty datagram back, got %d bytes", n)
+	}
+}
+
+func Test_Run_UnknownCommand(t *testing.T) {
+	var stderr bytes.Buffer
+	err := run(context.Background(), []string{"frobnicate"}, nil, nil, &stderr)
+
+	if err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("expected unknown command error, got %v", err)
+	}
+
+	if !strings.HasPrefix(stderr.String(), "usage: udp <command> [flags]") {
+		t.Errorf("expected the usage on stderr, got:\n%s", stderr.String())
+	}
+}
+
+func Test_Run_SendRequiresDestination(t *testing.T) {
+	err := run(context.Background(), []string{"send"}, strings.NewReader(""), nil, io.Discard)
+
+	if err == nil || err.Error() != "--to is required" {
+		t.Errorf("expected missing --to error, got %v", err)
+	}
+}
+
+func Test_Run_SendPrintsReplies(t *testing.T) {
+	_, server := newOSConns(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+
+	go func() {
+		done <- echoDatagrams(ctx, server)
+	}()
+
+	var stdout bytes.Buffer
+	args := []string{"send", "--to", server.LocalAddr().String(), "--wait", "500ms"}
+	err := run(context.Background(), args, strings.NewReader("ping\n"), &stdout, io.Discard)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	cancel()
+	testhelpers.FailTestIfErrorIsPresent(t, <-done)
+
+	if expected := server.LocalAddr().String() + ` (5 bytes): "ping\n"`; !strings.Contains(stdout.String(), expected) {
+		t.Errorf("expected stdout to contain %q, got:\n%s", expected, stdout.String())
+	}
+}
+
+// boundTo reports a specific local address for a socket bound to the wildcard address
+type boundTo struct {
+	net.PacketConn
+	addr net.Addr
+}
+
+func (b *boundTo) LocalAddr() net.Addr {
+	return b.addr
+}
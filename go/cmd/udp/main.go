@@ -1,7 +1,66 @@
 package main
 
-import "networking/pkg/udp"
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+const usage = `usage: udp <command> [flags]
+
+A netcat-style UDP tool that runs over either the OS's sockets or this project's user-space stack.
+
+Commands:
+  send    --to host:port          send each line read from stdin as a datagram
+  listen  --port N                print every datagram received, with where it came from
+  echo    --port N                send every datagram received back to where it came from
+
+Run "udp <command> -h" for the flags of each command.
+
+With --transport stack, the stack runs on a TUN device (needs root). Give the kernel's side an address first:
+  ip tuntap add dev tun0 mode tun && ip addr add 10.0.0.1/24 dev tun0 && ip link set tun0 up
+  udp listen --transport stack --tun tun0 --addr 10.0.0.2/24 --port 4000
+  echo hello | udp send --to 10.0.0.2:4000
+`
 
 func main() {
-	udp.Hello()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "udp:", err)
+		}
+
+		os.Exit(1)
+	}
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return flag.ErrHelp
+	}
+
+	command, args := args[0], args[1:]
+
+	switch command {
+	case "send":
+		return runSend(ctx, args, stdin, stdout, stderr)
+	case "listen":
+		return runListen(ctx, args, stdout, stderr)
+	case "echo":
+		return runEcho(ctx, args, stderr)
+	case "help", "-h", "--help":
+		fmt.Fprint(stderr, usage)
+		return nil
+	default:
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("unknown command %q", command)
+	}
 }
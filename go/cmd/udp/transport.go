@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+
+	"networking/internal/logger"
+	"networking/pkg/link"
+	"networking/pkg/metrics"
+	"networking/pkg/stack"
+)
+
+// transportFlags are shared by every command, and decide whether datagrams go through the OS or our stack
+type transportFlags struct {
+	transport   string
+	device      string
+	deviceType  string
+	address     string
+	metricsAddr string
+	logLevel    string
+
+	// Where problems found after the socket is open are reported
+	stderr io.Writer
+}
+
+func (f *transportFlags) register(flags *flag.FlagSet) {
+	flags.StringVar(&f.transport, "transport", "os", `"os" for the kernel's sockets, "stack" for the user-space stack`)
+	flags.StringVar(&f.device, "tun", "tun0", "stack only: the TUN/TAP device to attach the stack to")
+	flags.StringVar(&f.deviceType, "link", "tun", `stack only: "tun" for an IP link or "tap" for an Ethernet link`)
+	flags.StringVar(&f.address, "addr", "10.0.0.2/24", "stack only: the stack's own address on the device")
+	flags.StringVar(&f.metricsAddr, "metrics", "", "stack only: serve the stack's counters at http://<addr>/metrics from the host")
+	flags.StringVar(&f.logLevel, "log-level", "warning", "debug, info, warning or error")
+}
+
+var logLevels = map[string]logger.LogLevels{
+	"debug":   logger.DEBUG,
+	"info":    logger.INFO,
+	"warning": logger.WARNING,
+	"error":   logger.ERROR,
+}
+
+// open returns a UDP socket bound to port (0 for any) on the chosen transport, and a function that tears it down
+func (f *transportFlags) open(ctx context.Context, port uint16) (net.PacketConn, func(), error) {
+	level, ok := logLevels[strings.ToLower(f.logLevel)]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown log level %q", f.logLevel)
+	}
+
+	module := "udp"
+	ctx = logger.NewLoggerWithOptions(logger.Options{Module: &module, MinLevel: level}).WithLogger(ctx)
+
+	switch f.transport {
+	case "os":
+		conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return conn, func() { _ = conn.Close() }, nil
+	case "stack":
+		return f.openStack(ctx, port)
+	default:
+		return nil, nil, fmt.Errorf("unknown transport %q", f.transport)
+	}
+}
+
+func (f *transportFlags) openStack(ctx context.Context, port uint16) (net.PacketConn, func(), error) {
+	address, err := netip.ParsePrefix(f.address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid --addr: %w", err)
+	}
+
+	var device *link.Device
+
+	switch f.deviceType {
+	case "tun":
+		device, err = link.NewTUN(f.device)
+	case "tap":
+		device, err = link.NewTAP(f.device)
+	default:
+		err = fmt.Errorf("unknown link type %q", f.deviceType)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// On a TAP link, IPv6 comes up by itself from the routers on the bridge
+	s := stack.New(ctx, stack.Options{IPv6Autoconf: true})
+
+	if _, err := s.AddInterface(device.Name(), device, address); err != nil {
+		_ = device.Close()
+		return nil, nil, err
+	}
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), port))
+	if err != nil {
+		_ = s.Close()
+		return nil, nil, err
+	}
+
+	cleanup := func() {
+		_ = conn.Close()
+		_ = s.Close()
+	}
+
+	if f.metricsAddr != "" {
+		listener, err := net.Listen("tcp", f.metricsAddr)
+		if err != nil {
+			cleanup()
+			return nil, nil, fmt.Errorf("metrics listener: %w", err)
+		}
+
+		go func() {
+			if err := metrics.Serve(listener, s.Metrics()); err != nil && !errors.Is(err, net.ErrClosed) {
+				fmt.Fprintln(f.stderr, "udp: metrics:", err)
+			}
+		}()
+
+		stackCleanup := cleanup
+		cleanup = func() {
+			_ = listener.Close()
+			stackCleanup()
+		}
+	}
+
+	return conn, cleanup, nil
+}
@@ -37,3 +37,11 @@ func AreByteArraysEqual(a, b []byte) bool {
 
 	return true
 }
+
+func Uint32ToByteArray(value uint32) []byte {
+	return []byte{byte(value >> 24), byte(value >> 16), byte(value >> 8), byte(value)}
+}
+
+func ByteArrayToUint32(data []byte) uint32 {
+	return uint32(data[0])<<24 | uint32(data[1])<<16 | uint32(data[2])<<8 | uint32(data[3])
+}
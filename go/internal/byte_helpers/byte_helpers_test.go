@@ -94,3 +94,25 @@ func Test_AreByteArraysEqual_UnequalArrays(t *testing.T) {
 		t.Errorf("AreByteArraysEqual(%v, %v) = %v; want %v", input1, input2, actual, expected)
 	}
 }
+
+func Test_Uint32ToByteArray_HappyPath(t *testing.T) {
+	expected := []byte{0x1A, 0x2B, 0x3C, 0x4D}
+
+	input := uint32(0x1A2B3C4D)
+	actual := Uint32ToByteArray(input)
+
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("Uint32ToByteArray(%d) = %v; want %v", input, actual, expected)
+	}
+}
+
+func Test_ByteArrayToUint32_HappyPath(t *testing.T) {
+	expected := uint32(0x1A2B3C4D)
+
+	input := []byte{0x1A, 0x2B, 0x3C, 0x4D}
+	actual := ByteArrayToUint32(input)
+
+	if actual != expected {
+		t.Errorf("ByteArrayToUint32(%v) = %d; want %d", input, actual, expected)
+	}
+}
@@ -2,60 +2,85 @@ package bytehelpers
 
 const maxUnsignedShort = 0xFFFF
 
-func CreateOnesComplementChecksum(data []byte) uint16 {
+// Sum is a running, unfolded RFC 1071 one's complement sum.
+// The zero value is an empty sum, so partial sums can be built up across several
+// buffers (pseudo-header, header, payload) and finalized once at the end:
+//
+//	checksum := bytehelpers.Sum{}.Add(pseudoHeader).Add(header).Add(payload).Finalize()
+type Sum struct {
+	// 64 bits gives us room for any realistic packet before we need to fold the carries back in
+	total uint64
+	// Set when the data added so far had an odd length, meaning the next byte is the low byte of a word
+	odd bool
+}
+
+// Add returns a new Sum with data added to it, treating data as a sequence of big-endian 16-bit words.
+// Splitting data across several calls to Add gives the same result as adding it in one go,
+// even when a split falls in the middle of a word.
+func (s Sum) Add(data []byte) Sum {
 	if len(data) == 0 {
-		return maxUnsignedShort
+		return s
 	}
 
-	if len(data) == 1 {
-		return ^uint16(data[0])
+	if s.odd {
+		// The previous buffer ended halfway through a word, so this byte completes it
+		s.total += uint64(data[0])
+		s.odd = false
+		data = data[1:]
 	}
 
-	sum := getSumOfData(data)
-	complement := ^(sum)
-
-	return complement
-}
-
-func getSumOfData(data []byte) uint16 {
-	// We make this uint32 to avoid overflow when adding carried over bits
-	sum := uint32(0)
+	for len(data) >= 2 {
+		s.total += uint64(data[0])<<8 | uint64(data[1])
+		data = data[2:]
+	}
 
-	for i := 0; i < len(data)-1; i += 2 {
-		first := uint16(data[i]) << 8
-		second := uint16(data[i+1])
-		currentWord := first | second
+	if len(data) == 1 {
+		// The odd byte is treated as the high byte of a 16-bit word, with the low byte being zero
+		s.total += uint64(data[0]) << 8
+		s.odd = true
+	}
 
-		carriedSum := carryAroundAdd(uint16(sum), currentWord)
+	return s
+}
 
-		sum = uint32(carriedSum)
-	}
+// AddUint16 returns a new Sum with a single 16-bit word added to it.
+// Must not be called while the sum is halfway through a word.
+func (s Sum) AddUint16(value uint16) Sum {
+	s.total += uint64(value)
 
-	if len(data)%2 == 1 {
-		end := len(data) - 1
-		currentWord := uint16(data[end])
+	return s
+}
 
-		// The odd byte is treated as the high byte of a 16-bit word, with the low byte being zero
-		carriedSum := carryAroundAdd(uint16(sum), currentWord<<8)
+// Fold returns the 16-bit one's complement sum, with all carries wrapped back around into the low bits
+func (s Sum) Fold() uint16 {
+	total := s.total
 
-		sum = uint32(carriedSum)
+	for total > maxUnsignedShort {
+		total = (total & maxUnsignedShort) + (total >> 16)
 	}
 
-	return uint16(sum)
+	return uint16(total)
 }
 
-func carryAroundAdd(a, b uint16) uint16 {
-	result := uint32(a) + uint32(b)
-
-	if result > maxUnsignedShort {
-		// This gets us the last bit_s_ that overflowed - we re removing 16 bits out of the _32_ bits of `result`
-		carry := result >> 16
+// Finalize returns the one's complement of the folded sum, which is the value written into a checksum field
+func (s Sum) Finalize() uint16 {
+	return ^s.Fold()
+}
 
-		// This is required because we convert to uint32 above! It makes it so we ignore anything above 16 bits
-		result = (result & maxUnsignedShort)
+// CreateOnesComplementChecksum computes the RFC 1071 Internet checksum of data
+func CreateOnesComplementChecksum(data []byte) uint16 {
+	return Sum{}.Add(data).Finalize()
+}
 
-		result += carry
-	}
+// IsOnesComplementChecksumValid checks data that already contains its checksum field.
+// Summing a correctly checksummed buffer, checksum included, always folds to 0xFFFF.
+func IsOnesComplementChecksumValid(data []byte) bool {
+	return Sum{}.Add(data).Fold() == maxUnsignedShort
+}
 
-	return uint16(result)
+// UpdateChecksum returns checksum adjusted for one 16-bit word of the data changing from before to after, without
+// summing the data again. This is equation 3 of RFC 1624, HC' = ~(~HC + ~m + m'), which unlike RFC 1141's
+// HC' = HC + m - m' never gives 0xFFFF, a checksum recomputing it could not come to.
+func UpdateChecksum(checksum, before, after uint16) uint16 {
+	return ^Sum{}.AddUint16(^checksum).AddUint16(^before).AddUint16(after).Fold()
 }
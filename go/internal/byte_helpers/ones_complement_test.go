@@ -1,6 +1,7 @@
 package bytehelpers
 
 import (
+	"encoding/hex"
 	"testing"
 )
 
@@ -27,7 +28,8 @@ func Test_CreateOnesComplementChecksum_EmptyInput(t *testing.T) {
 }
 
 func Test_CreateOnesComplementChecksum_SingleByteInput(t *testing.T) {
-	expected := uint16(65280)
+	// A lone byte is the high byte of a zero-padded word: ^0xFF00
+	expected := uint16(0x00FF)
 	input := []byte{255}
 
 	actual := CreateOnesComplementChecksum(input)
@@ -69,3 +71,152 @@ func Test_CreateOnesComplementChecksum_MaxByteValues(t *testing.T) {
 		t.Errorf("expected %v, got %v", expected, actual)
 	}
 }
+
+/**
+* RFC 1071 and captured packet vectors
+ */
+
+func Test_CreateOnesComplementChecksum_RFC1071Example(t *testing.T) {
+	// RFC 1071 section 3: the words 0001 f203 f4f5 f6f7 sum to 0xddf2
+	input := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+
+	actualSum := Sum{}.Add(input).Fold()
+	if actualSum != 0xddf2 {
+		t.Errorf("expected sum %#04x, got %#04x", 0xddf2, actualSum)
+	}
+
+	actual := CreateOnesComplementChecksum(input)
+	if actual != 0x220d {
+		t.Errorf("expected %#04x, got %#04x", 0x220d, actual)
+	}
+}
+
+func Test_CreateOnesComplementChecksum_RFC1071ByteOrderIndependence(t *testing.T) {
+	// RFC 1071 section 2(B): summing byte-swapped words gives the byte-swapped sum
+	input := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	swapped := []byte{0x01, 0x00, 0x03, 0xf2, 0xf5, 0xf4, 0xf7, 0xf6}
+
+	expected := Sum{}.Add(input).Fold()
+	actual := Sum{}.Add(swapped).Fold()
+
+	if actual != expected>>8|expected<<8 {
+		t.Errorf("expected %#04x, got %#04x", expected>>8|expected<<8, actual)
+	}
+}
+
+// Captured from the Linux loopback interface with an AF_PACKET socket.
+// The first is the IPv4 header of a UDP datagram sent to 127.0.0.1:40001, the second the
+// ICMP port unreachable the kernel sent back because nothing was listening on that port.
+const (
+	linuxIPv4Header          = "4500002c56a940004011e6157f0000017f000001"
+	linuxICMPPortUnreachable = "0303ad11000000004500002c56a940004011e6157f0000017f0000019c409c410018fe2b68656c6c6f2066726f6d206c696e7578"
+)
+
+func Test_CreateOnesComplementChecksum_LinuxIPv4Header(t *testing.T) {
+	input, _ := hex.DecodeString(linuxIPv4Header)
+	expected := ByteArrayToUint16(input[10:12])
+
+	if !IsOnesComplementChecksumValid(input) {
+		t.Errorf("expected captured header to have a valid checksum")
+	}
+
+	// Zero the checksum field and recompute it
+	input[10], input[11] = 0, 0
+	actual := CreateOnesComplementChecksum(input)
+
+	if actual != expected {
+		t.Errorf("expected %#04x, got %#04x", expected, actual)
+	}
+}
+
+func Test_CreateOnesComplementChecksum_LinuxICMPMessage(t *testing.T) {
+	input, _ := hex.DecodeString(linuxICMPPortUnreachable)
+	expected := ByteArrayToUint16(input[2:4])
+
+	if !IsOnesComplementChecksumValid(input) {
+		t.Errorf("expected captured ICMP message to have a valid checksum")
+	}
+
+	input[2], input[3] = 0, 0
+	actual := CreateOnesComplementChecksum(input)
+
+	if actual != expected {
+		t.Errorf("expected %#04x, got %#04x", expected, actual)
+	}
+}
+
+func Test_IsOnesComplementChecksumValid_CorruptedData(t *testing.T) {
+	input, _ := hex.DecodeString(linuxIPv4Header)
+	input[8] ^= 0x01 // Flip a bit in the TTL
+
+	if IsOnesComplementChecksumValid(input) {
+		t.Errorf("expected corrupted header to fail checksum validation")
+	}
+}
+
+/**
+* Partial sums
+ */
+
+func Test_Sum_SplitAtOddOffset(t *testing.T) {
+	input, _ := hex.DecodeString(linuxICMPPortUnreachable)
+	expected := CreateOnesComplementChecksum(input)
+
+	for split := 0; split <= len(input); split++ {
+		actual := Sum{}.Add(input[:split]).Add(input[split:]).Finalize()
+
+		if actual != expected {
+			t.Errorf("split at %d: expected %#04x, got %#04x", split, expected, actual)
+		}
+	}
+}
+
+func Test_Sum_AddUint16MatchesAdd(t *testing.T) {
+	expected := Sum{}.Add([]byte{0x7f, 0x00, 0x00, 0x01, 0x00, 0x11}).Finalize()
+	actual := Sum{}.Add([]byte{0x7f, 0x00, 0x00, 0x01}).AddUint16(0x0011).Finalize()
+
+	if actual != expected {
+		t.Errorf("expected %#04x, got %#04x", expected, actual)
+	}
+}
+
+func Test_Sum_FoldHandlesManyCarries(t *testing.T) {
+	// Enough 0xFFFF words to overflow 32 bits many times over
+	input := make([]byte, 1<<18)
+	for i := range input {
+		input[i] = 0xFF
+	}
+
+	actual := Sum{}.Add(input).Fold()
+
+	if actual != 0xFFFF {
+		t.Errorf("expected %#04x, got %#04x", 0xFFFF, actual)
+	}
+}
+
+func Test_UpdateChecksum_MatchesRecomputing(t *testing.T) {
+	input, _ := hex.DecodeString(linuxIPv4Header)
+
+	// Count the TTL all the way down, as a chain of routers would
+	for ttl := int(input[8]); ttl > 0; ttl-- {
+		before := ByteArrayToUint16(input[8:10])
+		input[8]--
+		after := ByteArrayToUint16(input[8:10])
+
+		updated := UpdateChecksum(ByteArrayToUint16(input[10:12]), before, after)
+		copy(input[10:12], Uint16ToByteArray(updated))
+
+		if !IsOnesComplementChecksumValid(input) {
+			t.Fatalf("expected the updated checksum to verify at TTL %d, got %#04x", input[8], updated)
+		}
+	}
+}
+
+func Test_UpdateChecksum_NeverGivesNegativeZero(t *testing.T) {
+	// RFC 1624 section 3's example, where the RFC 1141 update gets 0xFFFF
+	actual := UpdateChecksum(0xDD2F, 0x5555, 0x3285)
+
+	if actual != 0x0000 {
+		t.Errorf("expected %#04x, got %#04x", 0x0000, actual)
+	}
+}
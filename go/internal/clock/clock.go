@@ -0,0 +1,118 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock is where the stack gets the time from, so tests can replace it with one they control
+type Clock interface {
+	Now() time.Time
+	// Tick calls f every interval until stop is called
+	Tick(interval time.Duration, f func()) (stop func())
+}
+
+// Real is the wall clock
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// Tick calls f from a goroutine of its own
+func (Real) Tick(interval time.Duration, f func()) func() {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				f()
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+		})
+	}
+}
+
+// Fake is a clock that only moves when told to. Ticks fire synchronously from Advance, in time order.
+type Fake struct {
+	mu      sync.Mutex
+	now     time.Time
+	tickers map[*fakeTicker]struct{}
+}
+
+type fakeTicker struct {
+	interval time.Duration
+	next     time.Time
+	f        func()
+}
+
+func NewFake(start time.Time) *Fake {
+	return &Fake{
+		now:     start,
+		tickers: map[*fakeTicker]struct{}{},
+	}
+}
+
+func (c *Fake) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *Fake) Tick(interval time.Duration, f func()) func() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ticker := &fakeTicker{interval: interval, next: c.now.Add(interval), f: f}
+	c.tickers[ticker] = struct{}{}
+
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+
+		delete(c.tickers, ticker)
+	}
+}
+
+// Advance moves the clock forward by d, firing every tick that falls due on the way
+func (c *Fake) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+
+	for {
+		var due *fakeTicker
+		for ticker := range c.tickers {
+			if !ticker.next.After(target) && (due == nil || ticker.next.Before(due.next)) {
+				due = ticker
+			}
+		}
+
+		if due == nil {
+			break
+		}
+
+		c.now = due.next
+		due.next = due.next.Add(due.interval)
+
+		// The tick may well read the clock, so it runs unlocked
+		c.mu.Unlock()
+		due.f()
+		c.mu.Lock()
+	}
+
+	c.now = target
+	c.mu.Unlock()
+}
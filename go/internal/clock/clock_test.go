@@ -0,0 +1,66 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func Test_Fake_AdvanceMovesNow(t *testing.T) {
+	c := NewFake(start)
+
+	c.Advance(90 * time.Second)
+
+	if actual := c.Now(); !actual.Equal(start.Add(90 * time.Second)) {
+		t.Errorf("expected %s, got %s", start.Add(90*time.Second), actual)
+	}
+}
+
+func Test_Fake_TicksFireInOrderWithTheClockAtTheTick(t *testing.T) {
+	c := NewFake(start)
+	fired := []time.Duration{}
+
+	c.Tick(30*time.Millisecond, func() { fired = append(fired, c.Now().Sub(start)) })
+	c.Tick(50*time.Millisecond, func() { fired = append(fired, -c.Now().Sub(start)) })
+
+	c.Advance(100 * time.Millisecond)
+
+	expected := []time.Duration{30 * time.Millisecond, -50 * time.Millisecond, 60 * time.Millisecond, 90 * time.Millisecond, -100 * time.Millisecond}
+	if len(fired) != len(expected) {
+		t.Fatalf("expected ticks %v, got %v", expected, fired)
+	}
+
+	for i := range expected {
+		if fired[i] != expected[i] {
+			t.Errorf("expected ticks %v, got %v", expected, fired)
+		}
+	}
+}
+
+func Test_Fake_StoppedTickerDoesNotFire(t *testing.T) {
+	c := NewFake(start)
+	count := 0
+
+	stop := c.Tick(time.Second, func() { count++ })
+	c.Advance(2 * time.Second)
+	stop()
+	c.Advance(2 * time.Second)
+
+	if count != 2 {
+		t.Errorf("expected 2 ticks before stopping, got %d", count)
+	}
+}
+
+func Test_Real_Ticks(t *testing.T) {
+	ticks := make(chan struct{}, 10)
+
+	stop := Real{}.Tick(time.Millisecond, func() { ticks <- struct{}{} })
+	defer stop()
+
+	select {
+	case <-ticks:
+	case <-time.After(time.Second):
+		t.Errorf("expected the real clock to tick")
+	}
+}
@@ -2,49 +2,148 @@ package logger
 
 import (
 	"context"
-	"fmt"
-	"time"
+	"io"
+	"log/slog"
+	"os"
 )
 
 type LoggerInterface interface {
-	Info(message string) string
-	Warn(message string) string
-	Error(message string) string
+	Debug(message string, fields ...any) string
+	Info(message string, fields ...any) string
+	Warn(message string, fields ...any) string
+	Error(message string, fields ...any) string
+	// With returns a logger that adds the given key/value fields to every message it logs
+	With(fields ...any) LoggerInterface
 }
 
 type Logger struct {
 	Module   *string
 	MinLevel LogLevels
+	slogger  *slog.Logger
 }
 
 type LogLevels int
 
 const (
-	INFO = iota
+	DEBUG LogLevels = iota - 1
+	INFO
 	WARNING
 	ERROR
 )
 
+// Formats the logger can write in when no custom handler is given
+type Format int
+
+const (
+	TextFormat Format = iota
+	JSONFormat
+)
+
 type contextKey string
 
 const loggerContextKey contextKey = "logger"
 
 var loggingLevels = map[LogLevels]string{
+	DEBUG:   "DEBUG",
 	INFO:    "INFO",
 	WARNING: "WARNING",
 	ERROR:   "ERROR",
 }
 
+var slogLevels = map[LogLevels]slog.Level{
+	DEBUG:   slog.LevelDebug,
+	INFO:    slog.LevelInfo,
+	WARNING: slog.LevelWarn,
+	ERROR:   slog.LevelError,
+}
+
+// Options configures where and how a Logger writes
+type Options struct {
+	Module   *string
+	MinLevel LogLevels
+	Format   Format
+	// Every message is written to each of these. Defaults to stderr so logs never mix with a command's output
+	Writers []io.Writer
+	// Handler replaces Format and Writers entirely, for sinks that are not a plain io.Writer.
+	// MinLevel is still applied before the handler sees a message.
+	Handler slog.Handler
+}
+
 func NewLogger(module *string, minLevelToLog LogLevels) *Logger {
+	return NewLoggerWithOptions(Options{
+		Module:   module,
+		MinLevel: minLevelToLog,
+	})
+}
+
+func NewLoggerWithOptions(options Options) *Logger {
+	handler := options.Handler
+	if handler == nil {
+		handler = newHandler(options)
+	}
+
+	slogger := slog.New(handler)
+	if options.Module != nil {
+		slogger = slogger.With("module", *options.Module)
+	}
+
 	return &Logger{
-		Module: module,
+		Module:   options.Module,
+		MinLevel: options.MinLevel,
+		slogger:  slogger,
+	}
+}
+
+func newHandler(options Options) slog.Handler {
+	var writer io.Writer = os.Stderr
+	if len(options.Writers) == 1 {
+		writer = options.Writers[0]
+	} else if len(options.Writers) > 1 {
+		writer = io.MultiWriter(options.Writers...)
+	}
+
+	handlerOptions := &slog.HandlerOptions{
+		// Filtering happens in log so custom handlers get the same behaviour, so let everything through here
+		Level:       slog.LevelDebug,
+		ReplaceAttr: replaceLevelNames,
+	}
+
+	if options.Format == JSONFormat {
+		return slog.NewJSONHandler(writer, handlerOptions)
+	}
+
+	return slog.NewTextHandler(writer, handlerOptions)
+}
+
+// replaceLevelNames keeps the level names this package has always printed, e.g. WARNING rather than slog's WARN
+func replaceLevelNames(groups []string, attr slog.Attr) slog.Attr {
+	if len(groups) > 0 || attr.Key != slog.LevelKey {
+		return attr
+	}
+
+	level, ok := attr.Value.Any().(slog.Level)
+	if !ok {
+		return attr
+	}
+
+	for ourLevel, slogLevel := range slogLevels {
+		if slogLevel == level {
+			return slog.String(slog.LevelKey, loggingLevels[ourLevel])
+		}
 	}
+
+	return attr
 }
 
 func (l *Logger) WithLogger(ctx context.Context) context.Context {
 	return context.WithValue(ctx, loggerContextKey, l)
 }
 
+// WithLogger adds any LoggerInterface to a context, e.g. one returned from With
+func WithLogger(ctx context.Context, logger LoggerInterface) context.Context {
+	return context.WithValue(ctx, loggerContextKey, logger)
+}
+
 func GetLoggerFromContext(ctx context.Context, defaultModuleIfMissing *string) LoggerInterface {
 	retrievedLogger := ctx.Value(loggerContextKey)
 
@@ -60,33 +159,37 @@ func GetLoggerFromContext(ctx context.Context, defaultModuleIfMissing *string) L
 	return NewLogger(defaultModuleIfMissing, INFO)
 }
 
-func (l *Logger) log(level LogLevels, message string) string {
+// log returns the message that was logged, or an empty string if it was filtered out by level
+func (l *Logger) log(level LogLevels, message string, fields ...any) string {
 	if level < l.MinLevel {
 		return ""
 	}
 
-	prefix := loggingLevels[level] + " "
-	if l.Module != nil {
-		prefix = *l.Module + ": "
-	}
-
-	now := time.Now()
+	l.slogger.Log(context.Background(), slogLevels[level], message, fields...)
 
-	messageToLog := prefix + message + "\n[" + now.Format("2006-01-02 15:04:05") + "]"
+	return message
+}
 
-	fmt.Println(messageToLog)
+func (l *Logger) With(fields ...any) LoggerInterface {
+	return &Logger{
+		Module:   l.Module,
+		MinLevel: l.MinLevel,
+		slogger:  l.slogger.With(fields...),
+	}
+}
 
-	return messageToLog
+func (l *Logger) Debug(message string, fields ...any) string {
+	return l.log(DEBUG, message, fields...)
 }
 
-func (l *Logger) Info(message string) string {
-	return l.log(INFO, message)
+func (l *Logger) Info(message string, fields ...any) string {
+	return l.log(INFO, message, fields...)
 }
 
-func (l *Logger) Warn(message string) string {
-	return l.log(WARNING, message)
+func (l *Logger) Warn(message string, fields ...any) string {
+	return l.log(WARNING, message, fields...)
 }
 
-func (l *Logger) Error(message string) string {
-	return l.log(ERROR, message)
+func (l *Logger) Error(message string, fields ...any) string {
+	return l.log(ERROR, message, fields...)
 }
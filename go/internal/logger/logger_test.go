@@ -0,0 +1,143 @@
+package logger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func Test_NewLogger_FiltersBelowMinLevel(t *testing.T) {
+	var out bytes.Buffer
+	l := NewLoggerWithOptions(Options{MinLevel: WARNING, Writers: []io.Writer{&out}})
+
+	if logged := l.Info("dropped"); logged != "" {
+		t.Errorf("expected info message to be filtered, got %q", logged)
+	}
+
+	if logged := l.Warn("kept"); logged != "kept" {
+		t.Errorf("expected warning to be logged, got %q", logged)
+	}
+
+	if strings.Contains(out.String(), "dropped") || !strings.Contains(out.String(), "kept") {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
+
+func Test_NewLogger_MinLevelFromConstructor(t *testing.T) {
+	l := NewLogger(nil, ERROR)
+
+	if l.MinLevel != ERROR {
+		t.Errorf("expected min level %d, got %d", ERROR, l.MinLevel)
+	}
+}
+
+func Test_NewLogger_DebugIsOffByDefault(t *testing.T) {
+	var out bytes.Buffer
+	l := NewLoggerWithOptions(Options{Writers: []io.Writer{&out}})
+
+	l.Debug("hidden")
+
+	if out.Len() != 0 {
+		t.Errorf("expected no output, got %s", out.String())
+	}
+}
+
+func Test_NewLogger_JSONWithFields(t *testing.T) {
+	var out bytes.Buffer
+	module := "udp"
+	l := NewLoggerWithOptions(Options{Module: &module, Format: JSONFormat, Writers: []io.Writer{&out}})
+
+	l.Warn("Source port is set to 0", "src_port", 0, "dst_port", 80, "len", 12)
+
+	var entry map[string]any
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("expected JSON output, got %s: %v", out.String(), err)
+	}
+
+	expected := map[string]any{
+		"level":    "WARNING",
+		"msg":      "Source port is set to 0",
+		"module":   "udp",
+		"src_port": float64(0),
+		"dst_port": float64(80),
+		"len":      float64(12),
+	}
+
+	for key, value := range expected {
+		if entry[key] != value {
+			t.Errorf("expected %s=%v, got %v", key, value, entry[key])
+		}
+	}
+}
+
+func Test_NewLogger_TextKeepsLevelAndModuleSeparate(t *testing.T) {
+	var out bytes.Buffer
+	module := "udp"
+	l := NewLoggerWithOptions(Options{Module: &module, Writers: []io.Writer{&out}})
+
+	l.Error("bad datagram")
+
+	if !strings.Contains(out.String(), "level=ERROR") || !strings.Contains(out.String(), "module=udp") {
+		t.Errorf("expected level and module in output, got %s", out.String())
+	}
+}
+
+func Test_NewLogger_WritesToEveryWriter(t *testing.T) {
+	var first, second bytes.Buffer
+	l := NewLoggerWithOptions(Options{Writers: []io.Writer{&first, &second}})
+
+	l.Info("hello")
+
+	if !strings.Contains(first.String(), "hello") || !strings.Contains(second.String(), "hello") {
+		t.Errorf("expected both writers to receive the message, got %q and %q", first.String(), second.String())
+	}
+}
+
+func Test_NewLogger_CustomHandler(t *testing.T) {
+	var out bytes.Buffer
+	l := NewLoggerWithOptions(Options{
+		MinLevel: WARNING,
+		Handler:  slog.NewJSONHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}),
+	})
+
+	l.Info("filtered before the handler")
+	l.Error("reaches the handler")
+
+	if strings.Contains(out.String(), "filtered") || !strings.Contains(out.String(), "reaches the handler") {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
+
+func Test_With_AddsFieldsToEveryMessage(t *testing.T) {
+	var out bytes.Buffer
+	l := NewLoggerWithOptions(Options{Writers: []io.Writer{&out}}).With("dst_port", 53)
+
+	l.Info("first")
+	l.Info("second")
+
+	if strings.Count(out.String(), "dst_port=53") != 2 {
+		t.Errorf("expected field on both messages, got %s", out.String())
+	}
+}
+
+func Test_GetLoggerFromContext_ReturnsStoredLogger(t *testing.T) {
+	mock := NewMockLogger()
+	ctx := WithLogger(context.Background(), mock.With("src_port", 1))
+
+	GetLoggerFromContext(ctx, nil).Info("from context")
+
+	entry, ok := mock.FindEntry("from context")
+	if !ok || entry.Fields["src_port"] != 1 {
+		t.Errorf("expected entry with src_port field, got %+v", entry)
+	}
+}
+
+func Test_GetLoggerFromContext_FallsBackToDefault(t *testing.T) {
+	if _, ok := GetLoggerFromContext(context.Background(), nil).(*Logger); !ok {
+		t.Errorf("expected a default *Logger when the context has none")
+	}
+}
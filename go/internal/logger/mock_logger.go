@@ -12,6 +12,20 @@ type MockLogger struct {
 	Warnings []string
 	Errors   []string
 	Infos    []string
+	Debugs   []string
+	// Every captured call in order, along with its fields
+	Entries []MockEntry
+
+	// Loggers made by With record into the logger they came from, so a test only ever inspects the root
+	root   *MockLogger
+	fields []any
+}
+
+// MockEntry is a single captured log call
+type MockEntry struct {
+	Level   LogLevels
+	Message string
+	Fields  map[string]any
 }
 
 // NewMockLogger creates a new mock logger for testing
@@ -20,6 +34,8 @@ func NewMockLogger() *MockLogger {
 		Warnings: []string{},
 		Errors:   []string{},
 		Infos:    []string{},
+		Debugs:   []string{},
+		Entries:  []MockEntry{},
 	}
 }
 
@@ -33,28 +49,78 @@ func (m *MockLogger) WithLogger(ctx context.Context) context.Context {
 	return context.WithValue(ctx, loggerContextKey, m)
 }
 
-// Warn captures warning messages
-func (m *MockLogger) Warn(msg string) string {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.Warnings = append(m.Warnings, msg)
+// With returns a logger that records into this one, adding fields to every entry
+func (m *MockLogger) With(fields ...any) LoggerInterface {
+	return &MockLogger{
+		root:   m.getRoot(),
+		fields: append(slices.Clone(m.fields), fields...),
+	}
+}
+
+func (m *MockLogger) getRoot() *MockLogger {
+	if m.root != nil {
+		return m.root
+	}
+
+	return m
+}
+
+func (m *MockLogger) record(level LogLevels, msg string, fields []any) string {
+	root := m.getRoot()
+	root.mu.Lock()
+	defer root.mu.Unlock()
+
+	switch level {
+	case DEBUG:
+		root.Debugs = append(root.Debugs, msg)
+	case INFO:
+		root.Infos = append(root.Infos, msg)
+	case WARNING:
+		root.Warnings = append(root.Warnings, msg)
+	case ERROR:
+		root.Errors = append(root.Errors, msg)
+	}
+
+	root.Entries = append(root.Entries, MockEntry{
+		Level:   level,
+		Message: msg,
+		Fields:  fieldsToMap(append(slices.Clone(m.fields), fields...)),
+	})
+
 	return msg
 }
 
+// fieldsToMap pairs up key/value fields the same way slog does, ignoring a trailing key with no value
+func fieldsToMap(fields []any) map[string]any {
+	result := map[string]any{}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		if key, ok := fields[i].(string); ok {
+			result[key] = fields[i+1]
+		}
+	}
+
+	return result
+}
+
+// Debug captures debug messages
+func (m *MockLogger) Debug(msg string, fields ...any) string {
+	return m.record(DEBUG, msg, fields)
+}
+
+// Warn captures warning messages
+func (m *MockLogger) Warn(msg string, fields ...any) string {
+	return m.record(WARNING, msg, fields)
+}
+
 // Error captures error messages
-func (m *MockLogger) Error(msg string) string {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.Errors = append(m.Errors, msg)
-	return msg
+func (m *MockLogger) Error(msg string, fields ...any) string {
+	return m.record(ERROR, msg, fields)
 }
 
 // Info captures info messages
-func (m *MockLogger) Info(msg string) string {
-	m.mu.Lock()
-	defer m.mu.Unlock()
-	m.Infos = append(m.Infos, msg)
-	return msg
+func (m *MockLogger) Info(msg string, fields ...any) string {
+	return m.record(INFO, msg, fields)
 }
 
 // Reset clears all captured log messages
@@ -64,6 +130,22 @@ func (m *MockLogger) Reset() {
 	m.Warnings = []string{}
 	m.Errors = []string{}
 	m.Infos = []string{}
+	m.Debugs = []string{}
+	m.Entries = []MockEntry{}
+}
+
+// FindEntry returns the first captured entry with the given message
+func (m *MockLogger) FindEntry(msg string) (MockEntry, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, entry := range m.Entries {
+		if entry.Message == msg {
+			return entry, true
+		}
+	}
+
+	return MockEntry{}, false
 }
 
 // HasWarning checks if a specific warning message was logged
@@ -0,0 +1,71 @@
+package trace
+
+import "sync"
+
+// Recorder receives every finished trace
+type Recorder interface {
+	Record(trace *Trace)
+}
+
+// RingRecorder keeps the most recent traces in memory so a vanished packet can be looked up after the fact
+type RingRecorder struct {
+	mu     sync.Mutex
+	traces []*Trace
+	next   int
+	full   bool
+}
+
+func NewRingRecorder(size int) *RingRecorder {
+	if size < 1 {
+		size = 1
+	}
+
+	return &RingRecorder{
+		traces: make([]*Trace, size),
+	}
+}
+
+func (r *RingRecorder) Record(trace *Trace) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.traces[r.next] = trace
+	r.next = (r.next + 1) % len(r.traces)
+
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Lookup finds a recorded trace by its ID
+func (r *RingRecorder) Lookup(id ID) (*Trace, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, trace := range r.traces {
+		if trace != nil && trace.ID == id {
+			return trace, true
+		}
+	}
+
+	return nil, false
+}
+
+// Recent returns the recorded traces, oldest first
+func (r *RingRecorder) Recent() []*Trace {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		recent := make([]*Trace, r.next)
+		copy(recent, r.traces[:r.next])
+
+		return recent
+	}
+
+	recent := make([]*Trace, 0, len(r.traces))
+	recent = append(recent, r.traces[r.next:]...)
+	recent = append(recent, r.traces[:r.next]...)
+
+	return recent
+}
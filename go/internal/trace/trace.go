@@ -0,0 +1,227 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"networking/internal/logger"
+)
+
+// ID identifies a single packet as it moves through the stack
+type ID [8]byte
+
+func NewID() ID {
+	var id ID
+	// crypto/rand.Read never returns an error
+	_, _ = rand.Read(id[:])
+
+	return id
+}
+
+func (id ID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// Decision is what a layer chose to do with a packet
+type Decision string
+
+const (
+	Received       Decision = "received"
+	Sent           Decision = "sent"
+	Delivered      Decision = "delivered"
+	Queued         Decision = "queued"
+	Dropped        Decision = "dropped"
+	ChecksumFailed Decision = "checksum_failed"
+	Malformed      Decision = "malformed"
+)
+
+// Event is a single decision made about a packet by one layer
+type Event struct {
+	Time     time.Time
+	Layer    string
+	Decision Decision
+	Reason   string
+	Fields   map[string]any
+}
+
+// Trace collects everything that happened to one packet
+type Trace struct {
+	ID    ID
+	Start time.Time
+
+	mu       sync.Mutex
+	events   []Event
+	spans    []*Span
+	recorder Recorder
+}
+
+// Span is the time a packet spent in one layer. Spans nest, so an IP span is the child of an Ethernet span
+type Span struct {
+	Trace  *Trace
+	Layer  string
+	Parent *Span
+	Start  time.Time
+	End    time.Time
+
+	// The logger from before any span was started, so nested spans replace the layer field rather than repeat it
+	baseLogger logger.LoggerInterface
+}
+
+type contextKey string
+
+const (
+	traceContextKey contextKey = "trace"
+	spanContextKey  contextKey = "span"
+)
+
+// Start begins a new trace, typically when a frame is read off a link.
+// The returned context carries the trace and a logger that adds trace_id to every message,
+// so any code that gets its logger from the context is tied back to the packet automatically.
+// recorder may be nil, in which case the trace is only visible through the logs.
+func Start(ctx context.Context, recorder Recorder) (context.Context, *Trace) {
+	trace := &Trace{
+		ID:       NewID(),
+		Start:    time.Now(),
+		recorder: recorder,
+	}
+
+	ctx = context.WithValue(ctx, traceContextKey, trace)
+	ctx = logger.WithLogger(ctx, logger.GetLoggerFromContext(ctx, nil).With("trace_id", trace.ID.String()))
+
+	return ctx, trace
+}
+
+// FromContext returns the trace carried by ctx, or nil if there is none
+func FromContext(ctx context.Context) *Trace {
+	trace, _ := ctx.Value(traceContextKey).(*Trace)
+
+	return trace
+}
+
+// StartSpan marks the packet entering a layer. Works without a trace too, so protocol code
+// does not need to care whether the caller is tracing or not.
+func StartSpan(ctx context.Context, layer string) (context.Context, *Span) {
+	span := &Span{
+		Trace: FromContext(ctx),
+		Layer: layer,
+		Start: time.Now(),
+	}
+
+	if parent, ok := ctx.Value(spanContextKey).(*Span); ok {
+		span.Parent = parent
+		span.baseLogger = parent.baseLogger
+	} else {
+		span.baseLogger = logger.GetLoggerFromContext(ctx, nil)
+	}
+
+	if span.Trace != nil {
+		span.Trace.mu.Lock()
+		span.Trace.spans = append(span.Trace.spans, span)
+		span.Trace.mu.Unlock()
+	}
+
+	ctx = context.WithValue(ctx, spanContextKey, span)
+	ctx = logger.WithLogger(ctx, span.baseLogger.With("layer", layer))
+
+	return ctx, span
+}
+
+func (s *Span) Finish() {
+	if s.Trace == nil {
+		s.End = time.Now()
+		return
+	}
+
+	s.Trace.mu.Lock()
+	defer s.Trace.mu.Unlock()
+	s.End = time.Now()
+}
+
+// Annotate records a decision about the packet in ctx against the current layer and logs it.
+// Drops and failures are logged at info so they show up with the default level; everything else is debug.
+func Annotate(ctx context.Context, decision Decision, reason string, fields ...any) {
+	layer := ""
+	if span, ok := ctx.Value(spanContextKey).(*Span); ok {
+		layer = span.Layer
+	}
+
+	if trace := FromContext(ctx); trace != nil {
+		trace.mu.Lock()
+		trace.events = append(trace.events, Event{
+			Time:     time.Now(),
+			Layer:    layer,
+			Decision: decision,
+			Reason:   reason,
+			Fields:   fieldsToMap(fields),
+		})
+		trace.mu.Unlock()
+	}
+
+	logFields := append([]any{"decision", string(decision)}, fields...)
+	log := logger.GetLoggerFromContext(ctx, nil)
+
+	switch decision {
+	case Dropped, ChecksumFailed, Malformed:
+		log.Info(reason, logFields...)
+	default:
+		log.Debug(reason, logFields...)
+	}
+}
+
+// Finish hands the trace to its recorder. Annotations made after this are still kept on the trace.
+func (t *Trace) Finish() {
+	if t.recorder != nil {
+		t.recorder.Record(t)
+	}
+}
+
+// Events returns a copy of every decision made so far, in order
+func (t *Trace) Events() []Event {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	events := make([]Event, len(t.events))
+	copy(events, t.events)
+
+	return events
+}
+
+// Spans returns a copy of every layer the packet has entered so far, in order
+func (t *Trace) Spans() []Span {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	spans := make([]Span, len(t.spans))
+	for i, span := range t.spans {
+		spans[i] = *span
+	}
+
+	return spans
+}
+
+// LastDecision returns the final decision made about the packet, which is usually why it vanished
+func (t *Trace) LastDecision() (Event, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.events) == 0 {
+		return Event{}, false
+	}
+
+	return t.events[len(t.events)-1], true
+}
+
+func fieldsToMap(fields []any) map[string]any {
+	result := map[string]any{}
+
+	for i := 0; i+1 < len(fields); i += 2 {
+		if key, ok := fields[i].(string); ok {
+			result[key] = fields[i+1]
+		}
+	}
+
+	return result
+}
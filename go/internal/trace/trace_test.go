@@ -0,0 +1,111 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"networking/internal/logger"
+)
+
+func Test_Start_AddsTraceIDToLogs(t *testing.T) {
+	mock := logger.NewMockLogger()
+	ctx, tr := Start(mock.WithLogger(context.Background()), nil)
+
+	logger.GetLoggerFromContext(ctx, nil).Warn("checksum looked odd")
+
+	entry, ok := mock.FindEntry("checksum looked odd")
+	if !ok || entry.Fields["trace_id"] != tr.ID.String() {
+		t.Errorf("expected trace_id %s on log entry, got %+v", tr.ID, entry)
+	}
+}
+
+func Test_Annotate_RecordsDecisionAgainstLayer(t *testing.T) {
+	ctx, tr := Start(logger.NewMockLogger().WithLogger(context.Background()), nil)
+
+	ctx, ipSpan := StartSpan(ctx, "ipv4")
+	ctx, udpSpan := StartSpan(ctx, "udp")
+	Annotate(ctx, Dropped, "no listener on port", "dst_port", uint16(53))
+	udpSpan.Finish()
+	ipSpan.Finish()
+
+	event, ok := tr.LastDecision()
+	if !ok {
+		t.Fatalf("expected a decision to be recorded")
+	}
+
+	if event.Layer != "udp" || event.Decision != Dropped || event.Fields["dst_port"] != uint16(53) {
+		t.Errorf("unexpected event: %+v", event)
+	}
+
+	spans := tr.Spans()
+	if len(spans) != 2 || spans[1].Parent != ipSpan || spans[1].End.IsZero() {
+		t.Errorf("expected udp span nested in ipv4 span and finished, got %+v", spans)
+	}
+}
+
+func Test_Annotate_LogsDropsAtInfo(t *testing.T) {
+	mock := logger.NewMockLogger()
+	ctx, _ := Start(mock.WithLogger(context.Background()), nil)
+	ctx, _ = StartSpan(ctx, "udp")
+
+	Annotate(ctx, Dropped, "no listener on port")
+	Annotate(ctx, Delivered, "datagram queued on socket")
+
+	dropped, _ := mock.FindEntry("no listener on port")
+	delivered, _ := mock.FindEntry("datagram queued on socket")
+
+	if dropped.Level != logger.INFO || delivered.Level != logger.DEBUG {
+		t.Errorf("expected drop at info and delivery at debug, got %d and %d", dropped.Level, delivered.Level)
+	}
+
+	if dropped.Fields["layer"] != "udp" || dropped.Fields["decision"] != "dropped" {
+		t.Errorf("expected layer and decision fields, got %+v", dropped.Fields)
+	}
+}
+
+func Test_Annotate_WithoutTraceOnlyLogs(t *testing.T) {
+	mock := logger.NewMockLogger()
+
+	Annotate(mock.WithLogger(context.Background()), Dropped, "untraced")
+
+	if !mock.HasInfo("untraced") {
+		t.Errorf("expected annotation to be logged without a trace")
+	}
+}
+
+func Test_RingRecorder_KeepsMostRecent(t *testing.T) {
+	recorder := NewRingRecorder(2)
+	ids := []ID{}
+
+	for range 3 {
+		_, tr := Start(context.Background(), recorder)
+		tr.Finish()
+		ids = append(ids, tr.ID)
+	}
+
+	if _, ok := recorder.Lookup(ids[0]); ok {
+		t.Errorf("expected oldest trace to be evicted")
+	}
+
+	recent := recorder.Recent()
+	if len(recent) != 2 || recent[0].ID != ids[1] || recent[1].ID != ids[2] {
+		t.Errorf("expected the two newest traces oldest first, got %v", recent)
+	}
+}
+
+func Test_StartSpan_NestedSpansReplaceLayer(t *testing.T) {
+	var out bytes.Buffer
+	ctx := logger.NewLoggerWithOptions(logger.Options{Writers: []io.Writer{&out}}).WithLogger(context.Background())
+
+	ctx, _ = Start(ctx, nil)
+	ctx, _ = StartSpan(ctx, "ipv4")
+	ctx, _ = StartSpan(ctx, "udp")
+	logger.GetLoggerFromContext(ctx, nil).Info("nested")
+
+	if strings.Count(out.String(), "layer=") != 1 || !strings.Contains(out.String(), "layer=udp") || !strings.Contains(out.String(), "trace_id=") {
+		t.Errorf("expected a single layer=udp field and the trace_id, got %s", out.String())
+	}
+}
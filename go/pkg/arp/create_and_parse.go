@@ -0,0 +1,107 @@
+package arp
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/logger"
+	"networking/pkg/ethernet"
+)
+
+// Only Ethernet hardware addresses with IPv4 protocol addresses are supported (RFC 826)
+const (
+	PacketLength = 28
+
+	hardwareTypeEthernet uint16 = 1
+	hardwareLength       uint8  = 6
+	protocolLength       uint8  = 4
+)
+
+const (
+	OperationRequest uint16 = 1
+	OperationReply   uint16 = 2
+)
+
+// Packet represents an ARP packet for IPv4 over Ethernet
+type Packet struct {
+	Operation uint16
+	SenderMAC ethernet.MAC
+	SenderIP  netip.Addr
+	TargetMAC ethernet.MAC
+	TargetIP  netip.Addr
+}
+
+// CreatePacket Function to create a raw ARP packet from the Packet struct
+func (p *Packet) CreatePacket(ctx context.Context) ([]byte, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if p.Operation != OperationRequest && p.Operation != OperationReply {
+		err := fmt.Errorf("invalid ARP operation: %d", p.Operation)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	if !p.SenderIP.Is4() || !p.TargetIP.Is4() {
+		err := fmt.Errorf("ARP addresses must be IPv4: sender %s, target %s", p.SenderIP, p.TargetIP)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	senderIP := p.SenderIP.As4()
+	targetIP := p.TargetIP.As4()
+
+	return bytehelpers.ConcatenateByteArrays(
+		bytehelpers.Uint16ToByteArray(hardwareTypeEthernet),
+		bytehelpers.Uint16ToByteArray(ethernet.EtherTypeIPv4),
+		[]byte{hardwareLength, protocolLength},
+		bytehelpers.Uint16ToByteArray(p.Operation),
+		p.SenderMAC[:],
+		senderIP[:],
+		p.TargetMAC[:],
+		targetIP[:],
+	), nil
+}
+
+// ParseRawPacket Function to parse a raw ARP packet into a Packet struct
+func ParseRawPacket(ctx context.Context, data []byte) (*Packet, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if len(data) < PacketLength {
+		err := fmt.Errorf("invalid ARP packet length: %d", len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	hardwareType := bytehelpers.ByteArrayToUint16(data[0:2])
+	protocolType := bytehelpers.ByteArrayToUint16(data[2:4])
+
+	if hardwareType != hardwareTypeEthernet || protocolType != ethernet.EtherTypeIPv4 ||
+		data[4] != hardwareLength || data[5] != protocolLength {
+		err := fmt.Errorf("unsupported ARP hardware/protocol: %d/%#04x", hardwareType, protocolType)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	packet := &Packet{
+		Operation: bytehelpers.ByteArrayToUint16(data[6:8]),
+		SenderIP:  netip.AddrFrom4([4]byte(data[14:18])),
+		TargetIP:  netip.AddrFrom4([4]byte(data[24:28])),
+	}
+	copy(packet.SenderMAC[:], data[8:14])
+	copy(packet.TargetMAC[:], data[18:24])
+
+	if packet.Operation != OperationRequest && packet.Operation != OperationReply {
+		err := fmt.Errorf("invalid ARP operation: %d", packet.Operation)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	return packet, nil
+}
@@ -0,0 +1,60 @@
+package arp
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/ethernet"
+)
+
+func Test_Create_Then_Parse_Consistency(t *testing.T) {
+	original := Packet{
+		Operation: OperationRequest,
+		SenderMAC: ethernet.MAC{0x02, 0, 0, 0, 0, 1},
+		SenderIP:  netip.MustParseAddr("10.0.0.1"),
+		TargetIP:  netip.MustParseAddr("10.0.0.2"),
+	}
+
+	raw, err := original.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(raw) != PacketLength {
+		t.Errorf("Expected %d bytes, got %d", PacketLength, len(raw))
+	}
+
+	parsed, err := ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if *parsed != original {
+		t.Errorf("Parsed packet does not match.\nExpected: %+v\nActual: %+v", original, *parsed)
+	}
+}
+
+func Test_Parse_UnsupportedHardware(t *testing.T) {
+	expected := "unsupported ARP hardware/protocol: 6/0x0800"
+	input := make([]byte, PacketLength)
+	copy(input, []byte{0x00, 0x06, 0x08, 0x00, 6, 4, 0, 1})
+
+	_, err := ParseRawPacket(context.TODO(), input)
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', but got '%v'", expected, err)
+	}
+}
+
+func Test_Create_InvalidOperation(t *testing.T) {
+	expected := "invalid ARP operation: 3"
+	packet := Packet{
+		Operation: 3,
+		SenderIP:  netip.MustParseAddr("10.0.0.1"),
+		TargetIP:  netip.MustParseAddr("10.0.0.2"),
+	}
+
+	_, err := packet.CreatePacket(context.TODO())
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', but got '%v'", expected, err)
+	}
+}
@@ -0,0 +1,107 @@
+package ethernet
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/logger"
+)
+
+const (
+	HeaderLength = 14
+	// Frames shorter than this (not counting the FCS) are padded with zeroes
+	MinimumFrameLength = 60
+)
+
+// EtherTypes the stack understands
+const (
+	EtherTypeIPv4 uint16 = 0x0800
+	EtherTypeARP  uint16 = 0x0806
+	EtherTypeIPv6 uint16 = 0x86DD
+)
+
+// MAC is a 48-bit IEEE 802 hardware address
+type MAC [6]byte
+
+var BroadcastMAC = MAC{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+func (m MAC) String() string {
+	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", m[0], m[1], m[2], m[3], m[4], m[5])
+}
+
+// IsMulticast checks the I/G bit, which is also set on the broadcast address
+func (m MAC) IsMulticast() bool {
+	return m[0]&0x01 == 0x01
+}
+
+// IPv6MulticastMAC returns the MAC frames for an IPv6 multicast group go to: 33:33 and the group's last four bytes
+// (RFC 2464 7)
+func IPv6MulticastMAC(group netip.Addr) MAC {
+	address := group.As16()
+
+	return MAC{0x33, 0x33, address[12], address[13], address[14], address[15]}
+}
+
+// Frame represents an Ethernet II frame, without the preamble or FCS which the link handles for us
+type Frame struct {
+	Destination MAC
+	Source      MAC
+	EtherType   uint16
+	Payload     []byte
+}
+
+// CreateFrame Function to create a raw Ethernet frame from the Frame struct, padded to the minimum frame length
+func (f *Frame) CreateFrame(ctx context.Context) ([]byte, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if f.EtherType < 0x0600 {
+		err := fmt.Errorf("invalid EtherType value: %#04x", f.EtherType)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	frame := bytehelpers.ConcatenateByteArrays(
+		f.Destination[:],
+		f.Source[:],
+		bytehelpers.Uint16ToByteArray(f.EtherType),
+		f.Payload,
+	)
+
+	if len(frame) < MinimumFrameLength {
+		frame = append(frame, make([]byte, MinimumFrameLength-len(frame))...)
+	}
+
+	return frame, nil
+}
+
+// ParseRawFrame Function to parse a raw Ethernet frame into a Frame struct.
+// Any padding stays on the payload, so upper layers must use their own length fields.
+func ParseRawFrame(ctx context.Context, data []byte) (*Frame, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if len(data) < HeaderLength {
+		err := fmt.Errorf("invalid Ethernet frame length: %d", len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	frame := &Frame{
+		EtherType: bytehelpers.ByteArrayToUint16(data[12:14]),
+		Payload:   data[HeaderLength:],
+	}
+	copy(frame.Destination[:], data[0:6])
+	copy(frame.Source[:], data[6:12])
+
+	if frame.EtherType < 0x0600 {
+		err := fmt.Errorf("invalid EtherType value: %#04x", frame.EtherType)
+		logger.Error(err.Error(), "src_mac", frame.Source.String())
+
+		return nil, err
+	}
+
+	return frame, nil
+}
@@ -0,0 +1,93 @@
+package ethernet
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	testhelpers "networking/internal/test_helpers"
+)
+
+func Test_Create_PadsShortFrames(t *testing.T) {
+	frame := Frame{
+		Destination: BroadcastMAC,
+		Source:      MAC{0x02, 0, 0, 0, 0, 1},
+		EtherType:   EtherTypeARP,
+		Payload:     []byte{1, 2, 3},
+	}
+
+	actual, err := frame.CreateFrame(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(actual) != MinimumFrameLength {
+		t.Errorf("Expected frame padded to %d bytes, got %d", MinimumFrameLength, len(actual))
+	}
+
+	if actual[12] != 0x08 || actual[13] != 0x06 || actual[14] != 1 {
+		t.Errorf("Unexpected frame bytes: %x", actual)
+	}
+}
+
+func Test_Create_Then_Parse_Consistency(t *testing.T) {
+	original := Frame{
+		Destination: MAC{0x02, 0, 0, 0, 0, 2},
+		Source:      MAC{0x02, 0, 0, 0, 0, 1},
+		EtherType:   EtherTypeIPv4,
+		Payload:     make([]byte, 100),
+	}
+
+	raw, err := original.CreateFrame(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRawFrame(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if parsed.Destination != original.Destination || parsed.Source != original.Source || parsed.EtherType != original.EtherType {
+		t.Errorf("Parsed frame does not match.\nExpected: %+v\nActual: %+v", original, parsed)
+	}
+
+	if len(parsed.Payload) != 100 {
+		t.Errorf("Expected 100 byte payload, got %d", len(parsed.Payload))
+	}
+}
+
+func Test_Parse_TooShort(t *testing.T) {
+	expected := "invalid Ethernet frame length: 10"
+
+	_, err := ParseRawFrame(context.TODO(), make([]byte, 10))
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', but got '%v'", expected, err)
+	}
+}
+
+func Test_Parse_LengthFieldInsteadOfEtherType(t *testing.T) {
+	expected := "invalid EtherType value: 0x05dc"
+	input := make([]byte, 60)
+	input[12], input[13] = 0x05, 0xDC // 802.3 length field of 1500
+
+	_, err := ParseRawFrame(context.TODO(), input)
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', but got '%v'", expected, err)
+	}
+}
+
+func Test_MAC_String(t *testing.T) {
+	expected := "02:fc:00:00:00:01"
+	actual := MAC{0x02, 0xFC, 0, 0, 0, 1}.String()
+
+	if actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
+
+func Test_IPv6MulticastMAC(t *testing.T) {
+	expected := MAC{0x33, 0x33, 0xff, 0x28, 0x9c, 0x5a}
+
+	actual := IPv6MulticastMAC(netip.MustParseAddr("ff02::1:ff28:9c5a"))
+
+	if actual != expected || !actual.IsMulticast() {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
@@ -0,0 +1,139 @@
+package icmp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/logger"
+)
+
+const HeaderLength = 8
+
+// Message types (RFC 792)
+const (
+	TypeEchoReply              uint8 = 0
+	TypeDestinationUnreachable uint8 = 3
+	TypeRedirect               uint8 = 5
+	TypeEchoRequest            uint8 = 8
+	TypeTimeExceeded           uint8 = 11
+)
+
+// Destination unreachable codes
+const (
+	CodeNetUnreachable      uint8 = 0
+	CodeHostUnreachable     uint8 = 1
+	CodeProtocolUnreachable uint8 = 2
+	CodePortUnreachable     uint8 = 3
+	CodeFragmentationNeeded uint8 = 4
+	// CodeAdministrativelyProhibited is for packets a filter turned away (RFC 1812 5.2.7.1)
+	CodeAdministrativelyProhibited uint8 = 13
+)
+
+// Redirect codes
+const (
+	CodeRedirectNetwork uint8 = 0
+	CodeRedirectHost    uint8 = 1
+)
+
+// Time exceeded codes
+const (
+	CodeTTLExceeded                uint8 = 0
+	CodeFragmentReassemblyExceeded uint8 = 1
+)
+
+// ErrInvalidChecksum is returned by ParseRawMessage, wrapped, when the checksum does not verify
+var ErrInvalidChecksum = errors.New("invalid ICMP checksum")
+
+// Message represents an ICMP message. RestOfHeader is the type-specific second word of the header,
+// e.g. the identifier and sequence number of an echo.
+type Message struct {
+	Type         uint8
+	Code         uint8
+	Checksum     uint16
+	RestOfHeader [4]byte
+	Data         []byte
+}
+
+// IsError checks if the message reports an error, which must never be answered with another error (RFC 1122)
+func (m *Message) IsError() bool {
+	return m.Type == TypeDestinationUnreachable || m.Type == TypeRedirect || m.Type == TypeTimeExceeded
+}
+
+// Identifier returns the echo identifier from an echo request or reply
+func (m *Message) Identifier() uint16 {
+	return bytehelpers.ByteArrayToUint16(m.RestOfHeader[0:2])
+}
+
+// SequenceNumber returns the echo sequence number from an echo request or reply
+func (m *Message) SequenceNumber() uint16 {
+	return bytehelpers.ByteArrayToUint16(m.RestOfHeader[2:4])
+}
+
+// Gateway returns the address a redirect says to send to instead
+func (m *Message) Gateway() netip.Addr {
+	return netip.AddrFrom4(m.RestOfHeader)
+}
+
+// NextHopMTU returns the MTU a fragmentation needed message says the packet has to fit in (RFC 1191), or zero from
+// a router too old to say
+func (m *Message) NextHopMTU() uint16 {
+	return bytehelpers.ByteArrayToUint16(m.RestOfHeader[2:4])
+}
+
+// NewEcho Helper function to create an echo request or reply
+func NewEcho(messageType uint8, identifier, sequenceNumber uint16, data []byte) *Message {
+	message := &Message{
+		Type: messageType,
+		Data: data,
+	}
+	copy(message.RestOfHeader[0:2], bytehelpers.Uint16ToByteArray(identifier))
+	copy(message.RestOfHeader[2:4], bytehelpers.Uint16ToByteArray(sequenceNumber))
+
+	return message
+}
+
+// CreateMessage Function to create a raw ICMP message from the Message struct. Checksum is written back to the struct.
+func (m *Message) CreateMessage(ctx context.Context) ([]byte, error) {
+	raw := bytehelpers.ConcatenateByteArrays(
+		[]byte{m.Type, m.Code, 0, 0},
+		m.RestOfHeader[:],
+		m.Data,
+	)
+
+	m.Checksum = bytehelpers.CreateOnesComplementChecksum(raw)
+	copy(raw[2:4], bytehelpers.Uint16ToByteArray(m.Checksum))
+
+	return raw, nil
+}
+
+// ParseRawMessage Function to parse a raw ICMP message into a Message struct
+func ParseRawMessage(ctx context.Context, data []byte) (*Message, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if len(data) < HeaderLength {
+		err := fmt.Errorf("invalid ICMP message length: %d", len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	message := &Message{
+		Type:         data[0],
+		Code:         data[1],
+		Checksum:     bytehelpers.ByteArrayToUint16(data[2:4]),
+		RestOfHeader: [4]byte(data[4:8]),
+		Data:         data[HeaderLength:],
+	}
+
+	if !bytehelpers.IsOnesComplementChecksumValid(data) {
+		err := fmt.Errorf("%w: %#04x", ErrInvalidChecksum, message.Checksum)
+		logger.Error(err.Error(), "icmp_type", message.Type, "icmp_code", message.Code)
+
+		return nil, err
+	}
+
+	return message, nil
+}
@@ -0,0 +1,68 @@
+package icmp
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	testhelpers "networking/internal/test_helpers"
+)
+
+// A port unreachable sent by the Linux kernel, captured on the loopback interface
+const linuxPortUnreachable = "0303ad11000000004500002c56a940004011e6157f0000017f0000019c409c410018fe2b68656c6c6f2066726f6d206c696e7578"
+
+func Test_Parse_LinuxPortUnreachable(t *testing.T) {
+	input, _ := hex.DecodeString(linuxPortUnreachable)
+
+	actual, err := ParseRawMessage(context.TODO(), input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if actual.Type != TypeDestinationUnreachable || actual.Code != CodePortUnreachable || !actual.IsError() {
+		t.Errorf("Unexpected message: %+v", actual)
+	}
+
+	// The quoted datagram starts with the original IPv4 header
+	if len(actual.Data) != 44 || actual.Data[0] != 0x45 {
+		t.Errorf("Expected the original datagram to be quoted, got %x", actual.Data)
+	}
+}
+
+func Test_Parse_BadChecksum(t *testing.T) {
+	input, _ := hex.DecodeString(linuxPortUnreachable)
+	input[1] = CodeHostUnreachable
+
+	_, err := ParseRawMessage(context.TODO(), input)
+
+	if !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("Expected ErrInvalidChecksum, got %v", err)
+	}
+}
+
+func Test_Parse_TooShort(t *testing.T) {
+	expected := "invalid ICMP message length: 4"
+
+	_, err := ParseRawMessage(context.TODO(), []byte{8, 0, 0, 0})
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', but got '%v'", expected, err)
+	}
+}
+
+func Test_Create_Then_Parse_Echo(t *testing.T) {
+	original := NewEcho(TypeEchoRequest, 0x1234, 7, []byte("abcdefgh"))
+
+	raw, err := original.CreateMessage(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRawMessage(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if parsed.Identifier() != 0x1234 || parsed.SequenceNumber() != 7 || string(parsed.Data) != "abcdefgh" || parsed.IsError() {
+		t.Errorf("Round trip mismatch: %+v", parsed)
+	}
+
+	if parsed.Checksum != original.Checksum {
+		t.Errorf("Expected checksum %#04x to be written back, got %#04x", parsed.Checksum, original.Checksum)
+	}
+}
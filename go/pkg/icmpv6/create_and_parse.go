@@ -0,0 +1,169 @@
+package icmpv6
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/logger"
+	"networking/pkg/ipv6"
+)
+
+const HeaderLength = 8
+
+// Message types (RFC 4443, RFC 4861). Errors have the high bit clear.
+const (
+	TypeDestinationUnreachable uint8 = 1
+	TypePacketTooBig           uint8 = 2
+	TypeTimeExceeded           uint8 = 3
+	TypeParameterProblem       uint8 = 4
+	TypeEchoRequest            uint8 = 128
+	TypeEchoReply              uint8 = 129
+	TypeRouterSolicitation     uint8 = 133
+	TypeRouterAdvertisement    uint8 = 134
+	TypeNeighborSolicitation   uint8 = 135
+	TypeNeighborAdvertisement  uint8 = 136
+	TypeRedirect               uint8 = 137
+)
+
+// Destination unreachable codes
+const (
+	CodeNoRoute                    uint8 = 0
+	CodeAdministrativelyProhibited uint8 = 1
+	CodeBeyondScope                uint8 = 2
+	CodeAddressUnreachable         uint8 = 3
+	CodePortUnreachable            uint8 = 4
+)
+
+// Time exceeded codes
+const (
+	CodeHopLimitExceeded           uint8 = 0
+	CodeFragmentReassemblyExceeded uint8 = 1
+)
+
+// Parameter problem codes
+const (
+	CodeErroneousHeaderField   uint8 = 0
+	CodeUnrecognizedNextHeader uint8 = 1
+	CodeUnrecognizedOption     uint8 = 2
+)
+
+// RFC 4443 2.4 (c): an error carries as much of the packet in error as fits without going over the minimum MTU
+const MaxErrorQuote = ipv6.MinMTU - ipv6.HeaderLength - HeaderLength
+
+// ErrInvalidChecksum is returned by ParseRawMessage, wrapped, when the checksum does not verify
+var ErrInvalidChecksum = errors.New("invalid ICMPv6 checksum")
+
+// Message represents an ICMPv6 message. RestOfHeader is the type-specific second word of the header,
+// e.g. the identifier and sequence number of an echo, or the MTU of a packet too big.
+type Message struct {
+	Type         uint8
+	Code         uint8
+	Checksum     uint16
+	RestOfHeader [4]byte
+	Data         []byte
+}
+
+// IsError checks if the message reports an error, which must never be answered with another error (RFC 4443 2.4)
+func (m *Message) IsError() bool {
+	return m.Type < 128
+}
+
+// Identifier returns the echo identifier from an echo request or reply
+func (m *Message) Identifier() uint16 {
+	return bytehelpers.ByteArrayToUint16(m.RestOfHeader[0:2])
+}
+
+// SequenceNumber returns the echo sequence number from an echo request or reply
+func (m *Message) SequenceNumber() uint16 {
+	return bytehelpers.ByteArrayToUint16(m.RestOfHeader[2:4])
+}
+
+// MTU returns the MTU of the next hop a packet too big message says the packet has to fit in
+func (m *Message) MTU() uint32 {
+	return bytehelpers.ByteArrayToUint32(m.RestOfHeader[:])
+}
+
+// Pointer returns the offset into the quoted packet of the field a parameter problem is about
+func (m *Message) Pointer() uint32 {
+	return bytehelpers.ByteArrayToUint32(m.RestOfHeader[:])
+}
+
+// NewEcho Helper function to create an echo request or reply
+func NewEcho(messageType uint8, identifier, sequenceNumber uint16, data []byte) *Message {
+	message := &Message{
+		Type: messageType,
+		Data: data,
+	}
+	copy(message.RestOfHeader[0:2], bytehelpers.Uint16ToByteArray(identifier))
+	copy(message.RestOfHeader[2:4], bytehelpers.Uint16ToByteArray(sequenceNumber))
+
+	return message
+}
+
+// NewError Helper function to create an error message. Value is the MTU of a packet too big, the pointer of a
+// parameter problem, and unused otherwise. The quote of the packet in error goes in Data.
+func NewError(messageType, code uint8, value uint32) *Message {
+	message := &Message{
+		Type: messageType,
+		Code: code,
+	}
+	copy(message.RestOfHeader[:], bytehelpers.Uint32ToByteArray(value))
+
+	return message
+}
+
+// CreateMessage Function to create a raw ICMPv6 message from the Message struct. Unlike ICMP for IPv4, the
+// checksum covers the IPv6 pseudo-header, so it needs the addresses the message is sent between.
+// Checksum is written back to the struct.
+func (m *Message) CreateMessage(ctx context.Context, source, destination netip.Addr) ([]byte, error) {
+	if !source.Is6() || !destination.Is6() {
+		err := fmt.Errorf("ICMPv6 addresses must be IPv6: source %s, destination %s", source, destination)
+		logger.GetLoggerFromContext(ctx, nil).Error(err.Error())
+
+		return nil, err
+	}
+
+	raw := bytehelpers.ConcatenateByteArrays(
+		[]byte{m.Type, m.Code, 0, 0},
+		m.RestOfHeader[:],
+		m.Data,
+	)
+
+	m.Checksum = ipv6.PseudoHeaderSum(source, destination, ipv6.NextHeaderICMPv6, len(raw)).Add(raw).Finalize()
+	copy(raw[2:4], bytehelpers.Uint16ToByteArray(m.Checksum))
+
+	return raw, nil
+}
+
+// ParseRawMessage Function to parse a raw ICMPv6 message into a Message struct, checking it against the
+// addresses it was sent between
+func ParseRawMessage(ctx context.Context, source, destination netip.Addr, data []byte) (*Message, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if len(data) < HeaderLength {
+		err := fmt.Errorf("invalid ICMPv6 message length: %d", len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	message := &Message{
+		Type:         data[0],
+		Code:         data[1],
+		Checksum:     bytehelpers.ByteArrayToUint16(data[2:4]),
+		RestOfHeader: [4]byte(data[4:8]),
+		Data:         data[HeaderLength:],
+	}
+
+	if ipv6.PseudoHeaderSum(source, destination, ipv6.NextHeaderICMPv6, len(data)).Add(data).Fold() != 0xFFFF {
+		err := fmt.Errorf("%w: %#04x", ErrInvalidChecksum, message.Checksum)
+		logger.Error(err.Error(), "icmp_type", message.Type, "icmp_code", message.Code)
+
+		return nil, err
+	}
+
+	return message, nil
+}
@@ -0,0 +1,83 @@
+package icmpv6
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+)
+
+// An echo request from fe80::1 to fe80::2, with its checksum worked out by hand
+const echoRequest = "800091ae1234000170696e67"
+
+var (
+	linkLocalA = netip.MustParseAddr("fe80::1")
+	linkLocalB = netip.MustParseAddr("fe80::2")
+)
+
+func Test_Parse_EchoRequest(t *testing.T) {
+	input, _ := hex.DecodeString(echoRequest)
+
+	actual, err := ParseRawMessage(context.TODO(), linkLocalA, linkLocalB, input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if actual.Type != TypeEchoRequest || actual.IsError() || actual.Identifier() != 0x1234 || actual.SequenceNumber() != 1 {
+		t.Errorf("Unexpected message: %+v", actual)
+	}
+
+	if string(actual.Data) != "ping" {
+		t.Errorf("Expected the echo data, got %q", actual.Data)
+	}
+}
+
+func Test_Parse_ChecksumCoversAddresses(t *testing.T) {
+	lctx := logger.PrepTest()
+	input, _ := hex.DecodeString(echoRequest)
+
+	_, err := ParseRawMessage(*lctx, linkLocalA, netip.MustParseAddr("fe80::3"), input)
+
+	if !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("Expected ErrInvalidChecksum for the wrong destination, got %v", err)
+	}
+}
+
+func Test_Create_MatchesHandWorkedChecksum(t *testing.T) {
+	message := NewEcho(TypeEchoRequest, 0x1234, 1, []byte("ping"))
+
+	raw, err := message.CreateMessage(context.TODO(), linkLocalA, linkLocalB)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if hex.EncodeToString(raw) != echoRequest || message.Checksum != 0x91ae {
+		t.Errorf("Expected %s, got %x", echoRequest, raw)
+	}
+}
+
+func Test_Create_RejectsIPv4Addresses(t *testing.T) {
+	lctx := logger.PrepTest()
+	message := NewEcho(TypeEchoRequest, 1, 1, nil)
+
+	if _, err := message.CreateMessage(*lctx, netip.MustParseAddr("10.0.0.1"), linkLocalB); err == nil {
+		t.Errorf("Expected an error for an IPv4 source")
+	}
+}
+
+func Test_NewError_CarriesValue(t *testing.T) {
+	tooBig := NewError(TypePacketTooBig, 0, 1280)
+	problem := NewError(TypeParameterProblem, CodeUnrecognizedNextHeader, 40)
+
+	if !tooBig.IsError() || tooBig.MTU() != 1280 || problem.Pointer() != 40 {
+		t.Errorf("Unexpected errors: %+v %+v", tooBig, problem)
+	}
+}
+
+func Test_Parse_TooShort(t *testing.T) {
+	lctx := logger.PrepTest()
+
+	if _, err := ParseRawMessage(*lctx, linkLocalA, linkLocalB, []byte{128, 0, 0}); err == nil {
+		t.Errorf("Expected an error for a 3 byte message")
+	}
+}
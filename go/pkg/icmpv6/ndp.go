@@ -0,0 +1,386 @@
+package icmpv6
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/byte_helpers"
+	"networking/pkg/ethernet"
+)
+
+// NDPOptionType is the first byte of every Neighbor Discovery option (RFC 4861 4.6)
+type NDPOptionType uint8
+
+const (
+	NDPOptionSourceLinkLayerAddress NDPOptionType = 1
+	NDPOptionTargetLinkLayerAddress NDPOptionType = 2
+	NDPOptionPrefixInformation      NDPOptionType = 3
+	NDPOptionRedirectedHeader       NDPOptionType = 4
+	NDPOptionMTU                    NDPOptionType = 5
+)
+
+// InfiniteLifetime is the all ones lifetime that never runs out
+const InfiniteLifetime uint32 = 0xFFFFFFFF
+
+// Lengths of the fixed parts of each message after the ICMPv6 header, and of the options we understand
+const (
+	targetLength                   = 16
+	routerAdvertisementTimesLength = 8
+	linkLayerAddressOptionLength   = 8
+	prefixInformationOptionLength  = 32
+	mtuOptionLength                = 8
+)
+
+var ErrInvalidNDPMessage = errors.New("invalid Neighbor Discovery message")
+
+// PrefixInformation is a prefix a router advertises, and what hosts may do with it (RFC 4861 4.6.2).
+// Lifetimes are in seconds.
+type PrefixInformation struct {
+	Prefix            netip.Prefix
+	OnLink            bool
+	Autonomous        bool
+	ValidLifetime     uint32
+	PreferredLifetime uint32
+}
+
+// NDPOption is a single decoded Neighbor Discovery option. Only the fields for its Type are set.
+type NDPOption struct {
+	Type NDPOptionType
+
+	LinkLayerAddress  ethernet.MAC
+	PrefixInformation PrefixInformation
+	MTU               uint32
+
+	// The bytes after the type and length of a redirected header or an option type we do not understand
+	Data []byte
+}
+
+func NewLinkLayerAddressOption(optionType NDPOptionType, mac ethernet.MAC) NDPOption {
+	return NDPOption{Type: optionType, LinkLayerAddress: mac}
+}
+
+func NewPrefixInformationOption(information PrefixInformation) NDPOption {
+	return NDPOption{Type: NDPOptionPrefixInformation, PrefixInformation: information}
+}
+
+func NewMTUOption(mtu uint32) NDPOption {
+	return NDPOption{Type: NDPOptionMTU, MTU: mtu}
+}
+
+// LinkLayerAddress returns the address from the first option of optionType, the source or target link-layer address
+func LinkLayerAddress(options []NDPOption, optionType NDPOptionType) (ethernet.MAC, bool) {
+	for _, option := range options {
+		if option.Type == optionType {
+			return option.LinkLayerAddress, true
+		}
+	}
+
+	return ethernet.MAC{}, false
+}
+
+// NeighborSolicitation asks for Target's link-layer address, or checks it is still reachable (RFC 4861 4.3)
+type NeighborSolicitation struct {
+	Target  netip.Addr
+	Options []NDPOption
+}
+
+// NeighborAdvertisement answers a solicitation, or announces a change of link-layer address (RFC 4861 4.4)
+type NeighborAdvertisement struct {
+	Router    bool
+	Solicited bool
+	Override  bool
+	Target    netip.Addr
+	Options   []NDPOption
+}
+
+// RouterSolicitation asks routers to advertise straight away (RFC 4861 4.1)
+type RouterSolicitation struct {
+	Options []NDPOption
+}
+
+// RouterAdvertisement is what a router says about itself and the link (RFC 4861 4.2). RouterLifetime is in seconds,
+// ReachableTime and RetransTimer in milliseconds, and zero in any of them means unspecified.
+type RouterAdvertisement struct {
+	CurHopLimit    uint8
+	Managed        bool
+	Other          bool
+	RouterLifetime uint16
+	ReachableTime  uint32
+	RetransTimer   uint32
+	Options        []NDPOption
+}
+
+// Message Function to create the ICMPv6 message for a neighbor solicitation
+func (n *NeighborSolicitation) Message() (*Message, error) {
+	options, err := encodeNDPOptions(n.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	target := n.Target.As16()
+
+	return &Message{Type: TypeNeighborSolicitation, Data: bytehelpers.ConcatenateByteArrays(target[:], options)}, nil
+}
+
+// Message Function to create the ICMPv6 message for a neighbor advertisement
+func (n *NeighborAdvertisement) Message() (*Message, error) {
+	options, err := encodeNDPOptions(n.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	target := n.Target.As16()
+	message := &Message{Type: TypeNeighborAdvertisement, Data: bytehelpers.ConcatenateByteArrays(target[:], options)}
+	message.RestOfHeader[0] = flagBits(n.Router, n.Solicited, n.Override)
+
+	return message, nil
+}
+
+// Message Function to create the ICMPv6 message for a router solicitation
+func (r *RouterSolicitation) Message() (*Message, error) {
+	options, err := encodeNDPOptions(r.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{Type: TypeRouterSolicitation, Data: options}, nil
+}
+
+// Message Function to create the ICMPv6 message for a router advertisement
+func (r *RouterAdvertisement) Message() (*Message, error) {
+	options, err := encodeNDPOptions(r.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	message := &Message{
+		Type: TypeRouterAdvertisement,
+		Data: bytehelpers.ConcatenateByteArrays(
+			bytehelpers.Uint32ToByteArray(r.ReachableTime),
+			bytehelpers.Uint32ToByteArray(r.RetransTimer),
+			options,
+		),
+	}
+	message.RestOfHeader[0] = r.CurHopLimit
+	message.RestOfHeader[1] = flagBits(r.Managed, r.Other)
+	copy(message.RestOfHeader[2:4], bytehelpers.Uint16ToByteArray(r.RouterLifetime))
+
+	return message, nil
+}
+
+// ParseNeighborSolicitation Function to decode a neighbor solicitation from its ICMPv6 message
+func ParseNeighborSolicitation(m *Message) (*NeighborSolicitation, error) {
+	if err := checkNDPMessage(m, TypeNeighborSolicitation, targetLength); err != nil {
+		return nil, err
+	}
+
+	options, err := decodeNDPOptions(m.Data[targetLength:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &NeighborSolicitation{Target: netip.AddrFrom16([16]byte(m.Data[:targetLength])), Options: options}, nil
+}
+
+// ParseNeighborAdvertisement Function to decode a neighbor advertisement from its ICMPv6 message
+func ParseNeighborAdvertisement(m *Message) (*NeighborAdvertisement, error) {
+	if err := checkNDPMessage(m, TypeNeighborAdvertisement, targetLength); err != nil {
+		return nil, err
+	}
+
+	options, err := decodeNDPOptions(m.Data[targetLength:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &NeighborAdvertisement{
+		Router:    m.RestOfHeader[0]&0x80 != 0,
+		Solicited: m.RestOfHeader[0]&0x40 != 0,
+		Override:  m.RestOfHeader[0]&0x20 != 0,
+		Target:    netip.AddrFrom16([16]byte(m.Data[:targetLength])),
+		Options:   options,
+	}, nil
+}
+
+// ParseRouterSolicitation Function to decode a router solicitation from its ICMPv6 message
+func ParseRouterSolicitation(m *Message) (*RouterSolicitation, error) {
+	if err := checkNDPMessage(m, TypeRouterSolicitation, 0); err != nil {
+		return nil, err
+	}
+
+	options, err := decodeNDPOptions(m.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RouterSolicitation{Options: options}, nil
+}
+
+// ParseRouterAdvertisement Function to decode a router advertisement from its ICMPv6 message
+func ParseRouterAdvertisement(m *Message) (*RouterAdvertisement, error) {
+	if err := checkNDPMessage(m, TypeRouterAdvertisement, routerAdvertisementTimesLength); err != nil {
+		return nil, err
+	}
+
+	options, err := decodeNDPOptions(m.Data[routerAdvertisementTimesLength:])
+	if err != nil {
+		return nil, err
+	}
+
+	return &RouterAdvertisement{
+		CurHopLimit:    m.RestOfHeader[0],
+		Managed:        m.RestOfHeader[1]&0x80 != 0,
+		Other:          m.RestOfHeader[1]&0x40 != 0,
+		RouterLifetime: bytehelpers.ByteArrayToUint16(m.RestOfHeader[2:4]),
+		ReachableTime:  bytehelpers.ByteArrayToUint32(m.Data[0:4]),
+		RetransTimer:   bytehelpers.ByteArrayToUint32(m.Data[4:8]),
+		Options:        options,
+	}, nil
+}
+
+// checkNDPMessage applies the checks every Neighbor Discovery message gets before anything else (RFC 4861 6.1, 7.1)
+func checkNDPMessage(m *Message, messageType uint8, fixedLength int) error {
+	switch {
+	case m.Type != messageType:
+		return fmt.Errorf("%w: type %d, expected %d", ErrInvalidNDPMessage, m.Type, messageType)
+	case m.Code != 0:
+		return fmt.Errorf("%w: code %d", ErrInvalidNDPMessage, m.Code)
+	case len(m.Data) < fixedLength:
+		return fmt.Errorf("%w: %d bytes", ErrInvalidNDPMessage, HeaderLength+len(m.Data))
+	}
+
+	return nil
+}
+
+// flagBits packs flags into the top bits of a byte, the first flag highest
+func flagBits(flags ...bool) byte {
+	var bits byte
+
+	for i, flag := range flags {
+		if flag {
+			bits |= 0x80 >> i
+		}
+	}
+
+	return bits
+}
+
+// encode appends the option's wire form to buffer
+func (o *NDPOption) encode(buffer []byte) ([]byte, error) {
+	switch o.Type {
+	case NDPOptionSourceLinkLayerAddress, NDPOptionTargetLinkLayerAddress:
+		buffer = append(buffer, byte(o.Type), linkLayerAddressOptionLength/8)
+		return append(buffer, o.LinkLayerAddress[:]...), nil
+	case NDPOptionPrefixInformation:
+		information := o.PrefixInformation
+		prefix := information.Prefix.Masked().Addr().As16()
+
+		if !information.Prefix.Addr().Is6() {
+			return nil, fmt.Errorf("%w: prefix information for %s", ErrInvalidNDPMessage, information.Prefix)
+		}
+
+		buffer = append(buffer, byte(o.Type), prefixInformationOptionLength/8, byte(information.Prefix.Bits()), flagBits(information.OnLink, information.Autonomous))
+		buffer = append(buffer, bytehelpers.Uint32ToByteArray(information.ValidLifetime)...)
+		buffer = append(buffer, bytehelpers.Uint32ToByteArray(information.PreferredLifetime)...)
+		buffer = append(buffer, 0, 0, 0, 0)
+		return append(buffer, prefix[:]...), nil
+	case NDPOptionMTU:
+		buffer = append(buffer, byte(o.Type), mtuOptionLength/8, 0, 0)
+		return append(buffer, bytehelpers.Uint32ToByteArray(o.MTU)...), nil
+	default:
+		length := 2 + len(o.Data)
+		if length%8 != 0 || length > 0xFF*8 {
+			return nil, fmt.Errorf("%w: option %d with %d bytes of data", ErrInvalidNDPMessage, o.Type, len(o.Data))
+		}
+
+		buffer = append(buffer, byte(o.Type), byte(length/8))
+		return append(buffer, o.Data...), nil
+	}
+}
+
+func encodeNDPOptions(options []NDPOption) ([]byte, error) {
+	buffer := []byte{}
+
+	for i := range options {
+		var err error
+		if buffer, err = options[i].encode(buffer); err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer, nil
+}
+
+// decodeNDPOptions parses the options after a message's fixed part. Options of types we do not understand are kept
+// with their data, as the receiver has to skip them (RFC 4861 4.6).
+func decodeNDPOptions(data []byte) ([]NDPOption, error) {
+	options := []NDPOption{}
+
+	for offset := 0; offset < len(data); {
+		if offset+2 > len(data) {
+			return nil, fmt.Errorf("%w: truncated option at offset %d", ErrInvalidNDPMessage, offset)
+		}
+
+		optionType := NDPOptionType(data[offset])
+		length := int(data[offset+1]) * 8
+
+		// A length of zero would have us loop forever, so the whole message is discarded
+		if length == 0 || offset+length > len(data) {
+			return nil, fmt.Errorf("%w: option %d at offset %d has length %d", ErrInvalidNDPMessage, optionType, offset, length)
+		}
+
+		option, err := decodeNDPOption(optionType, data[offset:offset+length])
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, option)
+		offset += length
+	}
+
+	return options, nil
+}
+
+func decodeNDPOption(optionType NDPOptionType, data []byte) (NDPOption, error) {
+	option := NDPOption{Type: optionType}
+	wrongLength := func(expected int) error {
+		return fmt.Errorf("%w: option %d has length %d, expected %d", ErrInvalidNDPMessage, optionType, len(data), expected)
+	}
+
+	switch optionType {
+	case NDPOptionSourceLinkLayerAddress, NDPOptionTargetLinkLayerAddress:
+		// Only Ethernet addresses, which fit in the smallest option (RFC 2464 8)
+		if len(data) != linkLayerAddressOptionLength {
+			return option, wrongLength(linkLayerAddressOptionLength)
+		}
+
+		option.LinkLayerAddress = ethernet.MAC(data[2:8])
+	case NDPOptionPrefixInformation:
+		if len(data) != prefixInformationOptionLength {
+			return option, wrongLength(prefixInformationOptionLength)
+		}
+
+		if data[2] > 128 {
+			return option, fmt.Errorf("%w: prefix length %d", ErrInvalidNDPMessage, data[2])
+		}
+
+		option.PrefixInformation = PrefixInformation{
+			Prefix:            netip.PrefixFrom(netip.AddrFrom16([16]byte(data[16:32])), int(data[2])).Masked(),
+			OnLink:            data[3]&0x80 != 0,
+			Autonomous:        data[3]&0x40 != 0,
+			ValidLifetime:     bytehelpers.ByteArrayToUint32(data[4:8]),
+			PreferredLifetime: bytehelpers.ByteArrayToUint32(data[8:12]),
+		}
+	case NDPOptionMTU:
+		if len(data) != mtuOptionLength {
+			return option, wrongLength(mtuOptionLength)
+		}
+
+		option.MTU = bytehelpers.ByteArrayToUint32(data[4:8])
+	default:
+		option.Data = data[2:]
+	}
+
+	return option, nil
+}
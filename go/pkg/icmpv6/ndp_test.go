@@ -0,0 +1,127 @@
+package icmpv6
+
+import (
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/ethernet"
+)
+
+var mac = ethernet.MAC{0x02, 0x00, 0x5e, 0x10, 0x20, 0x30}
+
+func Test_NeighborSolicitation_RoundTrip(t *testing.T) {
+	original := &NeighborSolicitation{
+		Target:  linkLocalB,
+		Options: []NDPOption{NewLinkLayerAddressOption(NDPOptionSourceLinkLayerAddress, mac)},
+	}
+
+	message, err := original.Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if message.Type != TypeNeighborSolicitation || len(message.Data) != 24 {
+		t.Errorf("Unexpected message: %+v", message)
+	}
+
+	parsed, err := ParseNeighborSolicitation(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !reflect.DeepEqual(parsed, original) {
+		t.Errorf("Expected %+v, got %+v", original, parsed)
+	}
+
+	if address, ok := LinkLayerAddress(parsed.Options, NDPOptionSourceLinkLayerAddress); !ok || address != mac {
+		t.Errorf("Expected the source link-layer address, got %s", address)
+	}
+}
+
+func Test_NeighborAdvertisement_Flags(t *testing.T) {
+	original := &NeighborAdvertisement{
+		Solicited: true,
+		Override:  true,
+		Target:    linkLocalA,
+		Options:   []NDPOption{NewLinkLayerAddressOption(NDPOptionTargetLinkLayerAddress, mac)},
+	}
+
+	message, err := original.Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if message.RestOfHeader[0] != 0x60 {
+		t.Errorf("Expected S and O set, got %#02x", message.RestOfHeader[0])
+	}
+
+	parsed, err := ParseNeighborAdvertisement(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !reflect.DeepEqual(parsed, original) {
+		t.Errorf("Expected %+v, got %+v", original, parsed)
+	}
+}
+
+func Test_RouterAdvertisement_RoundTrip(t *testing.T) {
+	original := &RouterAdvertisement{
+		CurHopLimit:    64,
+		Other:          true,
+		RouterLifetime: 1800,
+		ReachableTime:  30000,
+		RetransTimer:   1000,
+		Options: []NDPOption{
+			NewLinkLayerAddressOption(NDPOptionSourceLinkLayerAddress, mac),
+			NewMTUOption(1492),
+			NewPrefixInformationOption(PrefixInformation{
+				Prefix:            netip.MustParsePrefix("2001:db8:1::/64"),
+				OnLink:            true,
+				Autonomous:        true,
+				ValidLifetime:     InfiniteLifetime,
+				PreferredLifetime: 604800,
+			}),
+			{Type: 24, Data: make([]byte, 14)},
+		},
+	}
+
+	message, err := original.Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRouterAdvertisement(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !reflect.DeepEqual(parsed, original) {
+		t.Errorf("Expected %+v, got %+v", original, parsed)
+	}
+}
+
+func Test_RouterSolicitation_RoundTrip(t *testing.T) {
+	original := &RouterSolicitation{Options: []NDPOption{}}
+
+	message, err := original.Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRouterSolicitation(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !reflect.DeepEqual(parsed, original) || len(message.Data) != 0 {
+		t.Errorf("Expected an empty solicitation, got %+v", parsed)
+	}
+}
+
+func Test_ParseNDP_Mistakes(t *testing.T) {
+	solicitation, err := (&NeighborSolicitation{Target: linkLocalB}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	cases := map[string]*Message{
+		"wrong code":       {Type: TypeNeighborSolicitation, Code: 1, Data: solicitation.Data},
+		"short":            {Type: TypeNeighborSolicitation, Data: solicitation.Data[:15]},
+		"zero length":      {Type: TypeNeighborSolicitation, Data: append(append([]byte{}, solicitation.Data...), 1, 0, 0, 0, 0, 0, 0, 0)},
+		"overrun":          {Type: TypeNeighborSolicitation, Data: append(append([]byte{}, solicitation.Data...), 1, 2, 0, 0, 0, 0, 0, 0)},
+		"wrong mac length": {Type: TypeNeighborSolicitation, Data: append(append([]byte{}, solicitation.Data...), 1, 2, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0)},
+		"wrong type":       {Type: TypeNeighborAdvertisement, Data: solicitation.Data},
+	}
+
+	for name, message := range cases {
+		if _, err := ParseNeighborSolicitation(message); !errors.Is(err, ErrInvalidNDPMessage) {
+			t.Errorf("%s: expected ErrInvalidNDPMessage, got %v", name, err)
+		}
+	}
+}
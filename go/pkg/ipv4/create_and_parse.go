@@ -0,0 +1,190 @@
+package ipv4
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/logger"
+)
+
+const (
+	Version         = 4
+	MinHeaderLength = 20
+	MaxHeaderLength = 60
+	DefaultTTL      = 64
+)
+
+// Protocol numbers carried in the IPv4 protocol field
+const (
+	ProtocolICMP uint8 = 1
+	ProtocolTCP  uint8 = 6
+	ProtocolUDP  uint8 = 17
+)
+
+// Flags live in the top three bits of the fragment offset word
+const (
+	FlagMoreFragments uint8 = 0x1
+	FlagDontFragment  uint8 = 0x2
+)
+
+// ErrInvalidChecksum is returned by ParseRawPacket, wrapped, when the header checksum does not verify
+var ErrInvalidChecksum = errors.New("invalid IPv4 header checksum")
+
+// Packet represents an IPv4 datagram (RFC 791)
+type Packet struct {
+	TOS            uint8
+	TotalLength    uint16
+	Identification uint16
+	Flags          uint8
+	FragmentOffset uint16 // In units of 8 bytes
+	TTL            uint8
+	Protocol       uint8
+	Checksum       uint16
+	Source         netip.Addr
+	Destination    netip.Addr
+	Options        []byte
+	Payload        []byte
+}
+
+// HeaderLength returns the header length in bytes, including options padded to a 4 byte boundary
+func (p *Packet) HeaderLength() int {
+	return MinHeaderLength + (len(p.Options)+3)/4*4
+}
+
+// IsFragment checks if this packet is only part of a larger datagram
+func (p *Packet) IsFragment() bool {
+	return p.Flags&FlagMoreFragments != 0 || p.FragmentOffset != 0
+}
+
+// CreatePacket Function to create a raw IPv4 datagram from the Packet struct.
+// TotalLength and Checksum are computed here and written back to the struct.
+func (p *Packet) CreatePacket(ctx context.Context) ([]byte, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil).With(
+		"src_ip", p.Source.String(),
+		"dst_ip", p.Destination.String(),
+		"proto", p.Protocol,
+	)
+
+	if !p.Source.Is4() || !p.Destination.Is4() {
+		err := fmt.Errorf("IPv4 packet addresses must be IPv4: source %s, destination %s", p.Source, p.Destination)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	headerLength := p.HeaderLength()
+	if headerLength > MaxHeaderLength {
+		err := fmt.Errorf("invalid IPv4 options length: %d", len(p.Options))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	totalLength := headerLength + len(p.Payload)
+	if totalLength > 0xFFFF {
+		err := fmt.Errorf("IPv4 packet too large: %d", totalLength)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	if p.FragmentOffset > 0x1FFF {
+		err := fmt.Errorf("invalid IPv4 fragment offset: %d", p.FragmentOffset)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	p.TotalLength = uint16(totalLength)
+
+	header := make([]byte, headerLength)
+	header[0] = Version<<4 | uint8(headerLength/4)
+	header[1] = p.TOS
+	copy(header[2:4], bytehelpers.Uint16ToByteArray(p.TotalLength))
+	copy(header[4:6], bytehelpers.Uint16ToByteArray(p.Identification))
+	copy(header[6:8], bytehelpers.Uint16ToByteArray(uint16(p.Flags)<<13|p.FragmentOffset))
+	header[8] = p.TTL
+	header[9] = p.Protocol
+	source := p.Source.As4()
+	destination := p.Destination.As4()
+	copy(header[12:16], source[:])
+	copy(header[16:20], destination[:])
+	copy(header[20:], p.Options)
+
+	p.Checksum = bytehelpers.CreateOnesComplementChecksum(header)
+	copy(header[10:12], bytehelpers.Uint16ToByteArray(p.Checksum))
+
+	return bytehelpers.ConcatenateByteArrays(header, p.Payload), nil
+}
+
+// ParseRawPacket Function to parse a raw IPv4 datagram into a Packet struct.
+// Bytes past the total length (e.g. Ethernet padding) are ignored.
+func ParseRawPacket(ctx context.Context, data []byte) (*Packet, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if len(data) < MinHeaderLength {
+		err := fmt.Errorf("invalid IPv4 packet length: %d", len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	version := data[0] >> 4
+	if version != Version {
+		err := fmt.Errorf("invalid IP version: %d", version)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	headerLength := int(data[0]&0x0F) * 4
+	totalLength := int(bytehelpers.ByteArrayToUint16(data[2:4]))
+
+	if headerLength < MinHeaderLength || headerLength > totalLength || totalLength > len(data) {
+		err := fmt.Errorf("invalid IPv4 lengths: header %d, total %d, actual %d", headerLength, totalLength, len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	flagsAndOffset := bytehelpers.ByteArrayToUint16(data[6:8])
+
+	packet := &Packet{
+		TOS:            data[1],
+		TotalLength:    uint16(totalLength),
+		Identification: bytehelpers.ByteArrayToUint16(data[4:6]),
+		Flags:          uint8(flagsAndOffset >> 13),
+		FragmentOffset: flagsAndOffset & 0x1FFF,
+		TTL:            data[8],
+		Protocol:       data[9],
+		Checksum:       bytehelpers.ByteArrayToUint16(data[10:12]),
+		Source:         netip.AddrFrom4([4]byte(data[12:16])),
+		Destination:    netip.AddrFrom4([4]byte(data[16:20])),
+		Options:        data[MinHeaderLength:headerLength],
+		Payload:        data[headerLength:totalLength],
+	}
+
+	if !bytehelpers.IsOnesComplementChecksumValid(data[:headerLength]) {
+		err := fmt.Errorf("%w: %#04x", ErrInvalidChecksum, packet.Checksum)
+		logger.Error(err.Error(), "src_ip", packet.Source.String(), "dst_ip", packet.Destination.String())
+
+		return nil, err
+	}
+
+	return packet, nil
+}
+
+// PseudoHeaderSum returns the partial checksum of the IPv4 pseudo-header used by UDP and TCP (RFC 768, RFC 9293)
+func PseudoHeaderSum(source, destination netip.Addr, protocol uint8, length int) bytehelpers.Sum {
+	sourceBytes := source.As4()
+	destinationBytes := destination.As4()
+
+	return bytehelpers.Sum{}.
+		Add(sourceBytes[:]).
+		Add(destinationBytes[:]).
+		AddUint16(uint16(protocol)).
+		AddUint16(uint16(length))
+}
@@ -0,0 +1,141 @@
+package ipv4
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"testing"
+
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+)
+
+// A UDP datagram captured from the Linux loopback interface
+const linuxUDPPacket = "4500002c56a940004011e6157f0000017f0000019c409c410018fe2b68656c6c6f2066726f6d206c696e7578"
+
+func Test_Parse_LinuxCapture(t *testing.T) {
+	input, _ := hex.DecodeString(linuxUDPPacket)
+
+	actual, err := ParseRawPacket(context.TODO(), input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	loopback := netip.MustParseAddr("127.0.0.1")
+	if actual.Source != loopback || actual.Destination != loopback {
+		t.Errorf("Expected loopback addresses, got %s -> %s", actual.Source, actual.Destination)
+	}
+
+	if actual.Protocol != ProtocolUDP || actual.TTL != 64 || actual.Flags != FlagDontFragment || actual.Identification != 0x56a9 {
+		t.Errorf("Unexpected header fields: %+v", actual)
+	}
+
+	if len(actual.Payload) != 24 || actual.IsFragment() {
+		t.Errorf("Expected a 24 byte unfragmented payload, got %d bytes", len(actual.Payload))
+	}
+}
+
+func Test_Parse_IgnoresTrailingPadding(t *testing.T) {
+	input, _ := hex.DecodeString(linuxUDPPacket)
+	input = append(input, 0, 0, 0, 0)
+
+	actual, err := ParseRawPacket(context.TODO(), input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(actual.Payload) != 24 {
+		t.Errorf("Expected padding to be trimmed, got %d byte payload", len(actual.Payload))
+	}
+}
+
+func Test_Parse_BadChecksum(t *testing.T) {
+	lctx := logger.PrepTest()
+	input, _ := hex.DecodeString(linuxUDPPacket)
+	input[8] = 63 // Change the TTL without fixing the checksum
+
+	_, err := ParseRawPacket(*lctx, input)
+
+	if !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("Expected ErrInvalidChecksum, got %v", err)
+	}
+}
+
+func Test_Parse_WrongVersion(t *testing.T) {
+	expected := "invalid IP version: 6"
+	input, _ := hex.DecodeString(linuxUDPPacket)
+	input[0] = 0x65
+
+	_, err := ParseRawPacket(context.TODO(), input)
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', but got '%v'", expected, err)
+	}
+}
+
+func Test_Parse_TruncatedPacket(t *testing.T) {
+	expected := "invalid IPv4 lengths: header 20, total 44, actual 30"
+	input, _ := hex.DecodeString(linuxUDPPacket)
+
+	_, err := ParseRawPacket(context.TODO(), input[:30])
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', but got '%v'", expected, err)
+	}
+}
+
+func Test_Create_MatchesLinuxCapture(t *testing.T) {
+	expected, _ := hex.DecodeString(linuxUDPPacket)
+
+	packet := Packet{
+		Identification: 0x56a9,
+		Flags:          FlagDontFragment,
+		TTL:            64,
+		Protocol:       ProtocolUDP,
+		Source:         netip.MustParseAddr("127.0.0.1"),
+		Destination:    netip.MustParseAddr("127.0.0.1"),
+		Payload:        expected[20:],
+	}
+
+	actual, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if hex.EncodeToString(actual) != linuxUDPPacket {
+		t.Errorf("Created packet does not match capture.\nExpected: %s\nActual:   %s", linuxUDPPacket, hex.EncodeToString(actual))
+	}
+
+	if packet.Checksum != 0xe615 || packet.TotalLength != 44 {
+		t.Errorf("Expected checksum and length to be written back, got %#04x and %d", packet.Checksum, packet.TotalLength)
+	}
+}
+
+func Test_Create_Then_Parse_WithOptions(t *testing.T) {
+	original := Packet{
+		TTL:         1,
+		Protocol:    ProtocolICMP,
+		Source:      netip.MustParseAddr("10.0.0.1"),
+		Destination: netip.MustParseAddr("10.0.0.2"),
+		Options:     []byte{0x94, 0x04, 0x00, 0x00}, // Router Alert
+		Payload:     []byte("ping"),
+	}
+
+	raw, err := original.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if parsed.HeaderLength() != 24 || string(parsed.Options) != string(original.Options) || string(parsed.Payload) != "ping" {
+		t.Errorf("Round trip mismatch: %+v", parsed)
+	}
+}
+
+func Test_Create_IPv6Address(t *testing.T) {
+	packet := Packet{
+		Source:      netip.MustParseAddr("::1"),
+		Destination: netip.MustParseAddr("127.0.0.1"),
+	}
+
+	_, err := packet.CreatePacket(context.TODO())
+
+	if err == nil {
+		t.Errorf("Expected an error for an IPv6 source address")
+	}
+}
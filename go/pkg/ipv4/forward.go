@@ -0,0 +1,115 @@
+package ipv4
+
+import (
+	"errors"
+	"fmt"
+
+	"networking/internal/byte_helpers"
+)
+
+// Option types that are a single byte, with no length, and the flag in an option type that says it goes in every
+// fragment (RFC 791)
+const (
+	optionEndOfList   uint8 = 0
+	optionNoOperation uint8 = 1
+	optionCopiedFlag  uint8 = 0x80
+)
+
+// Fragment offsets count in blocks of this many bytes
+const fragmentBlockBytes = 8
+
+// ErrFragmentationNeeded is returned by Fragment, wrapped, for a packet that is too large but has DF set
+var ErrFragmentationNeeded = errors.New("fragmentation needed but DF set")
+
+// DecrementTTL lowers the TTL of a raw packet by one in place, updating the header checksum incrementally
+// (RFC 1624) rather than summing the header again. The TTL must not already be zero.
+func DecrementTTL(raw []byte) {
+	before := bytehelpers.ByteArrayToUint16(raw[8:10])
+	raw[8]--
+	after := bytehelpers.ByteArrayToUint16(raw[8:10])
+
+	checksum := bytehelpers.UpdateChecksum(bytehelpers.ByteArrayToUint16(raw[10:12]), before, after)
+	copy(raw[10:12], bytehelpers.Uint16ToByteArray(checksum))
+}
+
+// Fragment splits the packet into fragments of at most mtu bytes each (RFC 791 3.2). Every fragment keeps the
+// identification, and the first keeps every option, but the rest only keep the options with the copied flag set.
+// A packet that already fits comes back on its own. Fragmenting a fragment works too, with the last piece keeping
+// its more fragments flag.
+func (p *Packet) Fragment(mtu int) ([]*Packet, error) {
+	if p.HeaderLength()+len(p.Payload) <= mtu {
+		return []*Packet{p}, nil
+	}
+
+	if p.Flags&FlagDontFragment != 0 {
+		return nil, fmt.Errorf("%w: %d bytes, MTU %d", ErrFragmentationNeeded, p.HeaderLength()+len(p.Payload), mtu)
+	}
+
+	copied, err := copiedOptions(p.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	var fragments []*Packet
+
+	options := p.Options
+	offset := int(p.FragmentOffset) * fragmentBlockBytes
+	payload := p.Payload
+
+	for len(payload) > 0 {
+		fragment := *p
+		fragment.Options = options
+
+		// Every fragment but the last has to carry a whole number of 8 byte blocks
+		room := (mtu - fragment.HeaderLength()) / fragmentBlockBytes * fragmentBlockBytes
+		if room <= 0 {
+			return nil, fmt.Errorf("MTU too small to fragment into: %d", mtu)
+		}
+
+		size := min(room, len(payload))
+		fragment.Payload = payload[:size]
+		fragment.FragmentOffset = uint16(offset / fragmentBlockBytes)
+
+		if size < len(payload) {
+			fragment.Flags |= FlagMoreFragments
+		}
+
+		fragments = append(fragments, &fragment)
+
+		options = copied
+		offset += size
+		payload = payload[size:]
+	}
+
+	return fragments, nil
+}
+
+// copiedOptions picks out the options that go in every fragment, not just the first
+func copiedOptions(options []byte) ([]byte, error) {
+	var copied []byte
+
+	for i := 0; i < len(options); {
+		optionType := options[i]
+
+		switch optionType {
+		case optionEndOfList:
+			return copied, nil
+		case optionNoOperation:
+			i++
+			continue
+		}
+
+		if i+1 >= len(options) || options[i+1] < 2 || i+int(options[i+1]) > len(options) {
+			return nil, fmt.Errorf("invalid IPv4 option %d at offset %d", optionType, i)
+		}
+
+		length := int(options[i+1])
+		if optionType&optionCopiedFlag != 0 {
+			copied = append(copied, options[i:i+length]...)
+		}
+
+		i += length
+	}
+
+	return copied, nil
+}
@@ -0,0 +1,146 @@
+package ipv4
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"testing"
+
+	testhelpers "networking/internal/test_helpers"
+)
+
+func Test_DecrementTTL_KeepsTheChecksumValid(t *testing.T) {
+	raw, _ := hex.DecodeString(linuxUDPPacket)
+
+	DecrementTTL(raw)
+
+	packet, err := ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet.TTL != 63 {
+		t.Errorf("expected TTL 63, got %d", packet.TTL)
+	}
+}
+
+func newLargePacket(payloadLength int) *Packet {
+	payload := make([]byte, payloadLength)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	return &Packet{
+		Identification: 0x1234,
+		TTL:            DefaultTTL,
+		Protocol:       ProtocolUDP,
+		Source:         netip.MustParseAddr("10.0.0.1"),
+		Destination:    netip.MustParseAddr("10.0.1.1"),
+		Payload:        payload,
+	}
+}
+
+func Test_Fragment_SplitsOn8ByteBoundaries(t *testing.T) {
+	packet := newLargePacket(1000)
+
+	fragments, err := packet.Fragment(300)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	// 280 bytes is the most a 300 byte fragment can carry that is a multiple of 8
+	expectedLengths := []int{280, 280, 280, 160}
+	if len(fragments) != len(expectedLengths) {
+		t.Fatalf("expected %d fragments, got %d", len(expectedLengths), len(fragments))
+	}
+
+	var reassembled []byte
+
+	for i, fragment := range fragments {
+		raw, err := fragment.CreatePacket(context.TODO())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		parsed, err := ParseRawPacket(context.TODO(), raw)
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		moreFragments := i < len(fragments)-1
+		if len(parsed.Payload) != expectedLengths[i] || int(parsed.FragmentOffset)*8 != len(reassembled) ||
+			(parsed.Flags&FlagMoreFragments != 0) != moreFragments || parsed.Identification != 0x1234 {
+			t.Errorf("fragment %d: unexpected length %d, offset %d, flags %d or ID %#04x",
+				i, len(parsed.Payload), parsed.FragmentOffset, parsed.Flags, parsed.Identification)
+		}
+
+		reassembled = append(reassembled, parsed.Payload...)
+	}
+
+	if !bytes.Equal(reassembled, packet.Payload) {
+		t.Errorf("expected the fragments to put back together into the original payload")
+	}
+}
+
+func Test_Fragment_OnlyCopiesOptionsWithTheCopiedFlag(t *testing.T) {
+	packet := newLargePacket(200)
+	// Record Route (not copied), a NOP, then Router Alert (copied)
+	packet.Options = []byte{0x07, 0x07, 0x04, 0, 0, 0, 0, 0x01, 0x94, 0x04, 0x00, 0x00}
+
+	fragments, err := packet.Fragment(120)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !bytes.Equal(fragments[0].Options, packet.Options) {
+		t.Errorf("expected the first fragment to keep every option, got %x", fragments[0].Options)
+	}
+
+	for _, fragment := range fragments[1:] {
+		if !bytes.Equal(fragment.Options, []byte{0x94, 0x04, 0x00, 0x00}) {
+			t.Errorf("expected later fragments to only have Router Alert, got %x", fragment.Options)
+		}
+	}
+}
+
+func Test_Fragment_AFragmentKeepsItsPlace(t *testing.T) {
+	packet := newLargePacket(400)
+	packet.Flags = FlagMoreFragments
+	packet.FragmentOffset = 100
+
+	fragments, err := packet.Fragment(220)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	// Two pieces of 200 bytes, which is 25 blocks
+	if len(fragments) != 2 || fragments[0].FragmentOffset != 100 || fragments[1].FragmentOffset != 125 ||
+		fragments[1].Flags&FlagMoreFragments == 0 {
+		t.Errorf("expected pieces at offsets 100 and 125, the last still with more fragments, got %d fragments", len(fragments))
+	}
+}
+
+func Test_Fragment_PacketThatFits(t *testing.T) {
+	packet := newLargePacket(100)
+	packet.Flags = FlagDontFragment
+
+	fragments, err := packet.Fragment(120)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(fragments) != 1 || fragments[0] != packet {
+		t.Errorf("expected the packet back on its own, got %d fragments", len(fragments))
+	}
+}
+
+func Test_Fragment_DontFragment(t *testing.T) {
+	packet := newLargePacket(1000)
+	packet.Flags = FlagDontFragment
+
+	if _, err := packet.Fragment(576); !errors.Is(err, ErrFragmentationNeeded) {
+		t.Errorf("expected ErrFragmentationNeeded, got %v", err)
+	}
+}
+
+func Test_Fragment_BadOptionsAndTinyMTU(t *testing.T) {
+	packet := newLargePacket(100)
+	packet.Options = []byte{0x83, 0x09, 0, 0}
+
+	if _, err := packet.Fragment(68); err == nil {
+		t.Errorf("expected an option running past the end to be rejected")
+	}
+
+	packet.Options = nil
+	if _, err := packet.Fragment(24); err == nil {
+		t.Errorf("expected an MTU with no room for data to be rejected")
+	}
+}
@@ -0,0 +1,113 @@
+package ipv6
+
+import (
+	"net/netip"
+)
+
+// AddressType is the kind of address by its prefix (RFC 4291 2.4)
+type AddressType uint8
+
+const (
+	AddressUnspecified AddressType = iota
+	AddressLoopback
+	AddressMulticast
+	AddressLinkLocal
+	// AddressUniqueLocal is fc00::/7 (RFC 4193): global in scope, but not routed on the internet
+	AddressUniqueLocal
+	AddressGlobal
+	// AddressIPv4Mapped is ::ffff:0:0/96, which stands for an IPv4 address and never goes on the wire
+	AddressIPv4Mapped
+)
+
+var addressTypeNames = [...]string{
+	AddressUnspecified: "unspecified",
+	AddressLoopback:    "loopback",
+	AddressMulticast:   "multicast",
+	AddressLinkLocal:   "link-local",
+	AddressUniqueLocal: "unique-local",
+	AddressGlobal:      "global",
+	AddressIPv4Mapped:  "ipv4-mapped",
+}
+
+func (t AddressType) String() string {
+	if int(t) < len(addressTypeNames) {
+		return addressTypeNames[t]
+	}
+
+	return "unknown"
+}
+
+// Multicast scopes, from the low four bits of the second byte of a multicast address (RFC 7346)
+const (
+	ScopeInterfaceLocal    uint8 = 0x1
+	ScopeLinkLocal         uint8 = 0x2
+	ScopeRealmLocal        uint8 = 0x3
+	ScopeAdminLocal        uint8 = 0x4
+	ScopeSiteLocal         uint8 = 0x5
+	ScopeOrganizationLocal uint8 = 0x8
+	ScopeGlobal            uint8 = 0xE
+)
+
+// Well known link-local multicast groups (RFC 4291 2.7.1)
+var (
+	AllNodes   = netip.MustParseAddr("ff02::1")
+	AllRouters = netip.MustParseAddr("ff02::2")
+)
+
+var (
+	linkLocalPrefix   = netip.MustParsePrefix("fe80::/10")
+	uniqueLocalPrefix = netip.MustParsePrefix("fc00::/7")
+	solicitedNodeBase = netip.MustParseAddr("ff02::1:ff00:0")
+)
+
+// TypeOfAddress returns the kind of address addr is. Every unicast address that is not one of the special prefixes
+// is global (RFC 4291 2.4).
+func TypeOfAddress(addr netip.Addr) AddressType {
+	switch {
+	case addr.IsUnspecified():
+		return AddressUnspecified
+	case addr.IsLoopback():
+		return AddressLoopback
+	case addr.Is4In6():
+		return AddressIPv4Mapped
+	case addr.IsMulticast():
+		return AddressMulticast
+	case linkLocalPrefix.Contains(addr):
+		return AddressLinkLocal
+	case uniqueLocalPrefix.Contains(addr):
+		return AddressUniqueLocal
+	default:
+		return AddressGlobal
+	}
+}
+
+// IsLinkLocal checks if addr is a link-local unicast address
+func IsLinkLocal(addr netip.Addr) bool {
+	return TypeOfAddress(addr) == AddressLinkLocal
+}
+
+// IsGlobal checks if addr is a unicast address that is valid beyond the link, unique local ones included
+func IsGlobal(addr netip.Addr) bool {
+	addressType := TypeOfAddress(addr)
+
+	return addressType == AddressGlobal || addressType == AddressUniqueLocal
+}
+
+// MulticastScope returns the scope of a multicast address, or zero if addr is not one
+func MulticastScope(addr netip.Addr) uint8 {
+	if !addr.Is6() || !addr.IsMulticast() {
+		return 0
+	}
+
+	return addr.As16()[1] & 0x0F
+}
+
+// SolicitedNodeMulticast returns the group that neighbour solicitations for addr are sent to: ff02::1:ff00:0/104
+// with the low 24 bits of addr (RFC 4291 2.7.1)
+func SolicitedNodeMulticast(addr netip.Addr) netip.Addr {
+	group := solicitedNodeBase.As16()
+	bytes := addr.As16()
+	copy(group[13:], bytes[13:])
+
+	return netip.AddrFrom16(group)
+}
@@ -0,0 +1,59 @@
+package ipv6
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func Test_TypeOfAddress(t *testing.T) {
+	cases := map[string]AddressType{
+		"::":               AddressUnspecified,
+		"::1":              AddressLoopback,
+		"ff02::1":          AddressMulticast,
+		"ff0e::101":        AddressMulticast,
+		"fe80::1":          AddressLinkLocal,
+		"febf:ffff::1":     AddressLinkLocal,
+		"fd12:3456::1":     AddressUniqueLocal,
+		"2001:db8::1":      AddressGlobal,
+		"fec0::1":          AddressGlobal,
+		"::ffff:192.0.2.1": AddressIPv4Mapped,
+	}
+
+	for address, expected := range cases {
+		if actual := TypeOfAddress(netip.MustParseAddr(address)); actual != expected {
+			t.Errorf("%s: expected %s, got %s", address, expected, actual)
+		}
+	}
+}
+
+func Test_IsLinkLocalAndIsGlobal(t *testing.T) {
+	if !IsLinkLocal(netip.MustParseAddr("fe80::1")) || IsLinkLocal(netip.MustParseAddr("ff02::1")) {
+		t.Errorf("Expected only the unicast address to be link-local")
+	}
+
+	if !IsGlobal(netip.MustParseAddr("2001:db8::1")) || !IsGlobal(netip.MustParseAddr("fd00::1")) || IsGlobal(netip.MustParseAddr("fe80::1")) {
+		t.Errorf("Expected global and unique local addresses to be global, and no others")
+	}
+}
+
+func Test_MulticastScope(t *testing.T) {
+	if scope := MulticastScope(AllNodes); scope != ScopeLinkLocal {
+		t.Errorf("Expected link-local scope for all nodes, got %d", scope)
+	}
+
+	if scope := MulticastScope(netip.MustParseAddr("ff0e::101")); scope != ScopeGlobal {
+		t.Errorf("Expected global scope, got %d", scope)
+	}
+
+	if scope := MulticastScope(netip.MustParseAddr("2001:db8::1")); scope != 0 {
+		t.Errorf("Expected no scope for a unicast address, got %d", scope)
+	}
+}
+
+func Test_SolicitedNodeMulticast(t *testing.T) {
+	expected := netip.MustParseAddr("ff02::1:ff28:9c5a")
+
+	if actual := SolicitedNodeMulticast(netip.MustParseAddr("fe80::2aa:ff:fe28:9c5a")); actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
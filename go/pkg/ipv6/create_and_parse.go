@@ -0,0 +1,182 @@
+package ipv6
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/logger"
+)
+
+const (
+	Version         = 6
+	HeaderLength    = 40
+	DefaultHopLimit = 64
+	// MinMTU is the smallest MTU any link carrying IPv6 may have (RFC 8200 5)
+	MinMTU = 1280
+)
+
+// Values of the next header field, for extension headers and the upper-layer protocols we carry
+const (
+	NextHeaderHopByHop           uint8 = 0
+	NextHeaderTCP                uint8 = 6
+	NextHeaderUDP                uint8 = 17
+	NextHeaderRouting            uint8 = 43
+	NextHeaderFragment           uint8 = 44
+	NextHeaderICMPv6             uint8 = 58
+	NextHeaderNoNext             uint8 = 59
+	NextHeaderDestinationOptions uint8 = 60
+)
+
+// Packet represents an IPv6 packet (RFC 8200). NextHeader is the type of the first header after the fixed one, which
+// is an extension header if there are any; Protocol is the upper-layer protocol at the end of the chain.
+type Packet struct {
+	TrafficClass     uint8
+	FlowLabel        uint32 // 20 bits
+	PayloadLength    uint16 // Extension headers included
+	NextHeader       uint8
+	HopLimit         uint8
+	Source           netip.Addr
+	Destination      netip.Addr
+	ExtensionHeaders []ExtensionHeader
+	Protocol         uint8
+	Payload          []byte
+}
+
+// FragmentHeader returns the packet's fragment header, or nil if it has none
+func (p *Packet) FragmentHeader() *ExtensionHeader {
+	for i := range p.ExtensionHeaders {
+		if p.ExtensionHeaders[i].Type == NextHeaderFragment {
+			return &p.ExtensionHeaders[i]
+		}
+	}
+
+	return nil
+}
+
+// CreatePacket Function to create a raw IPv6 packet from the Packet struct. Each extension header is chained to
+// the one after it and the last to Protocol. NextHeader and PayloadLength are computed here and written back to the struct.
+func (p *Packet) CreatePacket(ctx context.Context) ([]byte, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil).With(
+		"src_ip", p.Source.String(),
+		"dst_ip", p.Destination.String(),
+		"proto", p.Protocol,
+	)
+
+	if !p.Source.Is6() || !p.Destination.Is6() {
+		err := fmt.Errorf("IPv6 packet addresses must be IPv6: source %s, destination %s", p.Source, p.Destination)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	if p.FlowLabel > 0xFFFFF {
+		err := fmt.Errorf("invalid IPv6 flow label: %#x", p.FlowLabel)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	extensionHeaders, err := encodeExtensionHeaders(p.ExtensionHeaders, p.Protocol)
+	if err != nil {
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	payloadLength := len(extensionHeaders) + len(p.Payload)
+	if payloadLength > 0xFFFF {
+		err := fmt.Errorf("IPv6 payload too large: %d", payloadLength)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	p.NextHeader = p.Protocol
+	if len(p.ExtensionHeaders) > 0 {
+		p.NextHeader = p.ExtensionHeaders[0].Type
+	}
+
+	p.PayloadLength = uint16(payloadLength)
+
+	header := make([]byte, HeaderLength)
+	copy(header[0:4], bytehelpers.Uint32ToByteArray(uint32(Version)<<28|uint32(p.TrafficClass)<<20|p.FlowLabel))
+	copy(header[4:6], bytehelpers.Uint16ToByteArray(p.PayloadLength))
+	header[6] = p.NextHeader
+	header[7] = p.HopLimit
+	source := p.Source.As16()
+	destination := p.Destination.As16()
+	copy(header[8:24], source[:])
+	copy(header[24:40], destination[:])
+
+	return bytehelpers.ConcatenateByteArrays(header, extensionHeaders, p.Payload), nil
+}
+
+// ParseRawPacket Function to parse a raw IPv6 packet into a Packet struct, following the extension header chain to
+// the upper-layer protocol. The chain stops at a fragment header with a non-zero offset, since what follows it is
+// the middle of someone else's payload. Bytes past the payload length (e.g. Ethernet padding) are ignored.
+func ParseRawPacket(ctx context.Context, data []byte) (*Packet, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if len(data) < HeaderLength {
+		err := fmt.Errorf("invalid IPv6 packet length: %d", len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	version := data[0] >> 4
+	if version != Version {
+		err := fmt.Errorf("invalid IP version: %d", version)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	payloadLength := int(bytehelpers.ByteArrayToUint16(data[4:6]))
+	if HeaderLength+payloadLength > len(data) {
+		err := fmt.Errorf("invalid IPv6 lengths: payload %d, actual %d", payloadLength, len(data)-HeaderLength)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	versionClassAndLabel := bytehelpers.ByteArrayToUint32(data[0:4])
+
+	packet := &Packet{
+		TrafficClass:  uint8(versionClassAndLabel >> 20),
+		FlowLabel:     versionClassAndLabel & 0xFFFFF,
+		PayloadLength: uint16(payloadLength),
+		NextHeader:    data[6],
+		HopLimit:      data[7],
+		Source:        netip.AddrFrom16([16]byte(data[8:24])),
+		Destination:   netip.AddrFrom16([16]byte(data[24:40])),
+	}
+
+	headers, protocol, offset, err := decodeExtensionHeaders(data[:HeaderLength+payloadLength], packet.NextHeader)
+	if err != nil {
+		logger.Error(err.Error(), "src_ip", packet.Source.String(), "dst_ip", packet.Destination.String())
+
+		return nil, err
+	}
+
+	packet.ExtensionHeaders = headers
+	packet.Protocol = protocol
+	packet.Payload = data[offset : HeaderLength+payloadLength]
+
+	return packet, nil
+}
+
+// PseudoHeaderSum returns the partial checksum of the IPv6 pseudo-header used by UDP, TCP and ICMPv6 (RFC 8200 8.1).
+// Length is the upper-layer length, without any extension headers in front of it.
+func PseudoHeaderSum(source, destination netip.Addr, nextHeader uint8, length int) bytehelpers.Sum {
+	sourceBytes := source.As16()
+	destinationBytes := destination.As16()
+
+	return bytehelpers.Sum{}.
+		Add(sourceBytes[:]).
+		Add(destinationBytes[:]).
+		Add(bytehelpers.Uint32ToByteArray(uint32(length))).
+		AddUint16(uint16(nextHeader))
+}
@@ -0,0 +1,272 @@
+package ipv6
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+)
+
+// A UDP datagram from ::1 to ::1 with flow label 0x12345, with its checksum worked out by hand
+const loopbackUDPPacket = "600123450018114000000000000000000000000000000001000000000000000000000000000000019c409c410018ae1568656c6c6f2066726f6d206c696e7578"
+
+func Test_Parse_FixedHeader(t *testing.T) {
+	input, _ := hex.DecodeString(loopbackUDPPacket)
+
+	actual, err := ParseRawPacket(context.TODO(), input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if actual.Source != netip.IPv6Loopback() || actual.Destination != netip.IPv6Loopback() {
+		t.Errorf("Expected loopback addresses, got %s -> %s", actual.Source, actual.Destination)
+	}
+
+	if actual.FlowLabel != 0x12345 || actual.TrafficClass != 0 || actual.HopLimit != 64 || actual.PayloadLength != 24 {
+		t.Errorf("Unexpected header fields: %+v", actual)
+	}
+
+	if actual.NextHeader != NextHeaderUDP || actual.Protocol != NextHeaderUDP || len(actual.ExtensionHeaders) != 0 {
+		t.Errorf("Expected UDP with no extension headers, got %d after %d headers", actual.Protocol, len(actual.ExtensionHeaders))
+	}
+
+	if len(actual.Payload) != 24 {
+		t.Errorf("Expected a 24 byte payload, got %d bytes", len(actual.Payload))
+	}
+}
+
+func Test_Parse_IgnoresTrailingPadding(t *testing.T) {
+	input, _ := hex.DecodeString(loopbackUDPPacket)
+	input = append(input, 0, 0, 0, 0)
+
+	actual, err := ParseRawPacket(context.TODO(), input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(actual.Payload) != 24 {
+		t.Errorf("Expected padding to be trimmed, got %d byte payload", len(actual.Payload))
+	}
+}
+
+func Test_Parse_Truncated(t *testing.T) {
+	lctx := logger.PrepTest()
+	input, _ := hex.DecodeString(loopbackUDPPacket)
+
+	if _, err := ParseRawPacket(*lctx, input[:len(input)-1]); err == nil {
+		t.Errorf("Expected an error for a payload shorter than the payload length")
+	}
+
+	if _, err := ParseRawPacket(*lctx, input[:HeaderLength-1]); err == nil {
+		t.Errorf("Expected an error for a short fixed header")
+	}
+}
+
+func Test_Parse_WrongVersion(t *testing.T) {
+	lctx := logger.PrepTest()
+	input, _ := hex.DecodeString(loopbackUDPPacket)
+	input[0] = 0x40
+
+	if _, err := ParseRawPacket(*lctx, input); err == nil {
+		t.Errorf("Expected an error for version 4")
+	}
+}
+
+func Test_PseudoHeaderSum_VerifiesUDP(t *testing.T) {
+	input, _ := hex.DecodeString(loopbackUDPPacket)
+	packet, err := ParseRawPacket(context.TODO(), input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sum := PseudoHeaderSum(packet.Source, packet.Destination, NextHeaderUDP, len(packet.Payload)).Add(packet.Payload)
+	if sum.Fold() != 0xFFFF {
+		t.Errorf("Expected the UDP checksum to verify, got sum %#04x", sum.Fold())
+	}
+}
+
+func Test_CreateAndParse_ExtensionHeaderChain(t *testing.T) {
+	original := Packet{
+		TrafficClass: 0xb8,
+		FlowLabel:    0xabcde,
+		HopLimit:     DefaultHopLimit,
+		Source:       netip.MustParseAddr("2001:db8::1"),
+		Destination:  netip.MustParseAddr("2001:db8::2"),
+		ExtensionHeaders: []ExtensionHeader{
+			NewHopByHopHeader(Option{Type: OptionRouterAlert, Data: []byte{0, 0}}),
+			NewDestinationOptionsHeader(Option{Type: 0x1e, Data: []byte{1, 2, 3, 4, 5}}),
+			NewRoutingHeader(4, 1, make([]byte, 20)),
+			NewFragmentHeader(0, true, 0xdeadbeef),
+		},
+		Protocol: NextHeaderUDP,
+		Payload:  []byte("hello through the chain"),
+	}
+
+	raw, err := original.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if original.NextHeader != NextHeaderHopByHop || int(original.PayloadLength) != len(raw)-HeaderLength {
+		t.Errorf("Expected next header and payload length written back, got %d and %d", original.NextHeader, original.PayloadLength)
+	}
+
+	parsed, err := ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !reflect.DeepEqual(*parsed, original) {
+		t.Errorf("Expected %+v, got %+v", original, *parsed)
+	}
+
+	if fragment := parsed.FragmentHeader(); fragment == nil || fragment.Identification != 0xdeadbeef || !fragment.MoreFragments {
+		t.Errorf("Expected the fragment header, got %+v", fragment)
+	}
+}
+
+func Test_Create_PadsOptionsToEightBytes(t *testing.T) {
+	for _, dataLength := range []int{0, 1, 2, 3, 4, 5, 6, 10} {
+		packet := Packet{
+			Source:           netip.IPv6Loopback(),
+			Destination:      netip.IPv6Loopback(),
+			ExtensionHeaders: []ExtensionHeader{NewDestinationOptionsHeader(Option{Type: 0x1e, Data: make([]byte, dataLength)})},
+			Protocol:         NextHeaderNoNext,
+		}
+
+		raw, err := packet.CreatePacket(context.TODO())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		if (len(raw)-HeaderLength)%8 != 0 || int(raw[HeaderLength+1]+1)*8 != len(raw)-HeaderLength {
+			t.Errorf("Option data of %d bytes: header of %d bytes says length %d", dataLength, len(raw)-HeaderLength, raw[HeaderLength+1])
+		}
+
+		parsed, err := ParseRawPacket(context.TODO(), raw)
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		if options := parsed.ExtensionHeaders[0].Options; len(options) != 1 || len(options[0].Data) != dataLength {
+			t.Errorf("Option data of %d bytes: expected padding dropped, got %+v", dataLength, options)
+		}
+	}
+}
+
+func Test_Create_RejectsBadRoutingLength(t *testing.T) {
+	lctx := logger.PrepTest()
+	packet := Packet{
+		Source:           netip.IPv6Loopback(),
+		Destination:      netip.IPv6Loopback(),
+		ExtensionHeaders: []ExtensionHeader{NewRoutingHeader(4, 0, make([]byte, 3))},
+		Protocol:         NextHeaderNoNext,
+	}
+
+	if _, err := packet.CreatePacket(*lctx); !errors.Is(err, ErrInvalidExtensionHeader) {
+		t.Errorf("Expected ErrInvalidExtensionHeader, got %v", err)
+	}
+}
+
+func Test_Create_RejectsIPv4Addresses(t *testing.T) {
+	lctx := logger.PrepTest()
+	packet := Packet{Source: netip.MustParseAddr("10.0.0.1"), Destination: netip.IPv6Loopback()}
+
+	if _, err := packet.CreatePacket(*lctx); err == nil {
+		t.Errorf("Expected an error for an IPv4 source")
+	}
+}
+
+func Test_Parse_StopsAtLaterFragment(t *testing.T) {
+	packet := Packet{
+		Source:      netip.IPv6Loopback(),
+		Destination: netip.IPv6Loopback(),
+		ExtensionHeaders: []ExtensionHeader{
+			NewFragmentHeader(185, false, 7),
+		},
+		Protocol: NextHeaderDestinationOptions,
+		// Looks like a destination options header, but is really the middle of the payload
+		Payload: []byte{17, 200, 0, 0, 0, 0, 0, 0},
+	}
+
+	raw, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(parsed.ExtensionHeaders) != 1 || parsed.Protocol != NextHeaderDestinationOptions || len(parsed.Payload) != 8 {
+		t.Errorf("Expected the chain to stop at the fragment header, got %+v", parsed)
+	}
+}
+
+func Test_Parse_HopByHopMustBeFirst(t *testing.T) {
+	lctx := logger.PrepTest()
+	packet := Packet{
+		Source:      netip.IPv6Loopback(),
+		Destination: netip.IPv6Loopback(),
+		ExtensionHeaders: []ExtensionHeader{
+			NewDestinationOptionsHeader(),
+			NewHopByHopHeader(),
+		},
+		Protocol: NextHeaderNoNext,
+	}
+
+	raw, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = ParseRawPacket(*lctx, raw)
+
+	var headerError *ExtensionHeaderError
+	if !errors.As(err, &headerError) || headerError.Type != NextHeaderHopByHop || headerError.Offset != HeaderLength {
+		t.Errorf("Expected an error pointing at the destination options next header, got %v", err)
+	}
+}
+
+func Test_Parse_ExtensionHeaderOverrun(t *testing.T) {
+	lctx := logger.PrepTest()
+	packet := Packet{
+		Source:           netip.IPv6Loopback(),
+		Destination:      netip.IPv6Loopback(),
+		ExtensionHeaders: []ExtensionHeader{NewHopByHopHeader(Option{Type: OptionRouterAlert, Data: []byte{0, 0}})},
+		Protocol:         NextHeaderNoNext,
+	}
+
+	raw, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	longHeader := append([]byte{}, raw...)
+	longHeader[HeaderLength+1] = 1
+
+	if _, err := ParseRawPacket(*lctx, longHeader); !errors.Is(err, ErrInvalidExtensionHeader) {
+		t.Errorf("Expected ErrInvalidExtensionHeader for a header past the end, got %v", err)
+	}
+
+	longOption := append([]byte{}, raw...)
+	longOption[HeaderLength+3] = 5
+
+	var headerError *ExtensionHeaderError
+	if _, err := ParseRawPacket(*lctx, longOption); !errors.As(err, &headerError) || headerError.Offset != HeaderLength+2 {
+		t.Errorf("Expected an error pointing at the option, got %v", err)
+	}
+}
+
+func Test_Option_UnrecognizedAction(t *testing.T) {
+	cases := map[uint8]OptionAction{
+		0x1e: OptionSkip,
+		0x5e: OptionDiscard,
+		0x9e: OptionDiscardAndReport,
+		0xde: OptionDiscardAndReportUnlessMulticast,
+	}
+
+	for optionType, expected := range cases {
+		if actual := (Option{Type: optionType}).UnrecognizedAction(); actual != expected {
+			t.Errorf("Option type %#x: expected %d, got %d", optionType, expected, actual)
+		}
+	}
+}
+
+func Test_PseudoHeaderSum_UsesUpperLayerLength(t *testing.T) {
+	source := netip.MustParseAddr("2001:db8::1")
+	destination := netip.MustParseAddr("2001:db8::2")
+	sourceBytes := source.As16()
+	destinationBytes := destination.As16()
+
+	pseudoHeader := bytehelpers.ConcatenateByteArrays(sourceBytes[:], destinationBytes[:], []byte{0, 1, 0, 0, 0, 0, 0, NextHeaderICMPv6})
+
+	if PseudoHeaderSum(source, destination, NextHeaderICMPv6, 0x10000).Fold() != (bytehelpers.Sum{}).Add(pseudoHeader).Fold() {
+		t.Errorf("Expected the length as a 32 bit word")
+	}
+}
@@ -0,0 +1,296 @@
+package ipv6
+
+import (
+	"errors"
+	"fmt"
+
+	"networking/internal/byte_helpers"
+)
+
+// Option types carried in Hop-by-Hop and Destination Options headers
+const (
+	OptionPad1        uint8 = 0 // RFC 8200 4.2
+	OptionPadN        uint8 = 1 // RFC 8200 4.2
+	OptionRouterAlert uint8 = 5 // RFC 2711
+)
+
+// OptionAction is what a node that does not recognise an option must do with the packet, taken from the top two
+// bits of the option type (RFC 8200 4.2)
+type OptionAction uint8
+
+const (
+	OptionSkip OptionAction = iota
+	OptionDiscard
+	OptionDiscardAndReport
+	// OptionDiscardAndReportUnlessMulticast reports only if the destination was not a multicast address
+	OptionDiscardAndReportUnlessMulticast
+)
+
+const (
+	fragmentHeaderLength = 8
+	// Routing headers are at least their next header, length, routing type and segments left bytes, padded to 8
+	minRoutingHeaderLength = 8
+)
+
+var ErrInvalidExtensionHeader = errors.New("invalid IPv6 extension header")
+
+// ExtensionHeaderError says which extension header could not be decoded and why. Offset is from the start of the
+// packet and points at the byte in error, so it can be used as a Parameter Problem pointer. It unwraps to
+// ErrInvalidExtensionHeader.
+type ExtensionHeaderError struct {
+	Type   uint8
+	Offset int
+	Reason string
+}
+
+func (e *ExtensionHeaderError) Error() string {
+	return fmt.Sprintf("%s: type %d at offset %d: %s", ErrInvalidExtensionHeader, e.Type, e.Offset, e.Reason)
+}
+
+func (e *ExtensionHeaderError) Unwrap() error {
+	return ErrInvalidExtensionHeader
+}
+
+// Option is a single option from a Hop-by-Hop or Destination Options header. Pad1 and PadN are dropped when
+// decoding and added back as needed when encoding.
+type Option struct {
+	Type uint8
+	Data []byte
+}
+
+// UnrecognizedAction returns what to do with the packet if the option type is not understood
+func (o Option) UnrecognizedAction() OptionAction {
+	return OptionAction(o.Type >> 6)
+}
+
+// ExtensionHeader is a single decoded extension header. Only the fields for its Type are set.
+// The next header byte is not kept: it is the type of whatever follows in the chain.
+type ExtensionHeader struct {
+	Type uint8
+
+	// Hop-by-Hop and Destination Options
+	Options []Option
+
+	// Routing
+	RoutingType  uint8
+	SegmentsLeft uint8
+	RoutingData  []byte // Everything after the segments left byte
+
+	// Fragment
+	FragmentOffset uint16 // In units of 8 bytes
+	MoreFragments  bool
+	Identification uint32
+}
+
+func NewHopByHopHeader(options ...Option) ExtensionHeader {
+	return ExtensionHeader{Type: NextHeaderHopByHop, Options: options}
+}
+
+func NewDestinationOptionsHeader(options ...Option) ExtensionHeader {
+	return ExtensionHeader{Type: NextHeaderDestinationOptions, Options: options}
+}
+
+func NewRoutingHeader(routingType, segmentsLeft uint8, data []byte) ExtensionHeader {
+	return ExtensionHeader{Type: NextHeaderRouting, RoutingType: routingType, SegmentsLeft: segmentsLeft, RoutingData: data}
+}
+
+func NewFragmentHeader(offset uint16, moreFragments bool, identification uint32) ExtensionHeader {
+	return ExtensionHeader{Type: NextHeaderFragment, FragmentOffset: offset, MoreFragments: moreFragments, Identification: identification}
+}
+
+// IsExtensionHeader checks if a next header value names one of the extension headers we can walk past
+func IsExtensionHeader(nextHeader uint8) bool {
+	switch nextHeader {
+	case NextHeaderHopByHop, NextHeaderRouting, NextHeaderFragment, NextHeaderDestinationOptions:
+		return true
+	default:
+		return false
+	}
+}
+
+// encode appends the header's wire form to buffer, with nextHeader as its first byte
+func (h *ExtensionHeader) encode(buffer []byte, nextHeader uint8) ([]byte, error) {
+	start := len(buffer)
+
+	switch h.Type {
+	case NextHeaderHopByHop, NextHeaderDestinationOptions:
+		buffer = append(buffer, nextHeader, 0)
+
+		for _, option := range h.Options {
+			if len(option.Data) > 0xFF {
+				return nil, &ExtensionHeaderError{Type: h.Type, Offset: len(buffer), Reason: fmt.Sprintf("option %d too long", option.Type)}
+			}
+
+			buffer = append(buffer, option.Type, byte(len(option.Data)))
+			buffer = append(buffer, option.Data...)
+		}
+
+		buffer = appendPadding(buffer, (8-(len(buffer)-start)%8)%8)
+	case NextHeaderRouting:
+		buffer = append(buffer, nextHeader, 0, h.RoutingType, h.SegmentsLeft)
+		buffer = append(buffer, h.RoutingData...)
+
+		if (len(buffer)-start)%8 != 0 {
+			return nil, &ExtensionHeaderError{Type: h.Type, Offset: start, Reason: fmt.Sprintf("%d bytes of routing data is not a multiple of 8 bytes in all", len(h.RoutingData))}
+		}
+	case NextHeaderFragment:
+		if h.FragmentOffset > 0x1FFF {
+			return nil, &ExtensionHeaderError{Type: h.Type, Offset: start, Reason: fmt.Sprintf("fragment offset %d", h.FragmentOffset)}
+		}
+
+		offsetAndFlag := h.FragmentOffset << 3
+		if h.MoreFragments {
+			offsetAndFlag |= 1
+		}
+
+		buffer = append(buffer, nextHeader, 0)
+		buffer = append(buffer, bytehelpers.Uint16ToByteArray(offsetAndFlag)...)
+		return append(buffer, bytehelpers.Uint32ToByteArray(h.Identification)...), nil
+	default:
+		return nil, &ExtensionHeaderError{Type: h.Type, Offset: start, Reason: "not an extension header"}
+	}
+
+	length := len(buffer) - start
+	if length > (0xFF+1)*8 {
+		return nil, &ExtensionHeaderError{Type: h.Type, Offset: start, Reason: fmt.Sprintf("%d bytes long", length)}
+	}
+
+	buffer[start+1] = byte(length/8 - 1)
+
+	return buffer, nil
+}
+
+// appendPadding appends Pad1 for a single byte or PadN for more
+func appendPadding(buffer []byte, n int) []byte {
+	switch n {
+	case 0:
+		return buffer
+	case 1:
+		return append(buffer, OptionPad1)
+	default:
+		buffer = append(buffer, OptionPadN, byte(n-2))
+		return append(buffer, make([]byte, n-2)...)
+	}
+}
+
+// encodeExtensionHeaders chains the headers together, the last one pointing at protocol
+func encodeExtensionHeaders(headers []ExtensionHeader, protocol uint8) ([]byte, error) {
+	buffer := []byte{}
+
+	for i := range headers {
+		nextHeader := protocol
+		if i+1 < len(headers) {
+			nextHeader = headers[i+1].Type
+		}
+
+		var err error
+		if buffer, err = headers[i].encode(buffer, nextHeader); err != nil {
+			return nil, err
+		}
+	}
+
+	return buffer, nil
+}
+
+// decodeExtensionHeaders walks the chain starting after the fixed header of packet. It returns the headers, the
+// protocol of what follows them and where that starts.
+func decodeExtensionHeaders(packet []byte, nextHeader uint8) ([]ExtensionHeader, uint8, int, error) {
+	headers := []ExtensionHeader{}
+	offset := HeaderLength
+	// Where the next header value naming the current header is, for pointing at a misplaced one
+	nextHeaderOffset := 6
+
+	for IsExtensionHeader(nextHeader) {
+		// RFC 8200 4.1: Hop-by-Hop is only allowed straight after the fixed header
+		if nextHeader == NextHeaderHopByHop && offset != HeaderLength {
+			return nil, 0, 0, &ExtensionHeaderError{Type: nextHeader, Offset: nextHeaderOffset, Reason: "hop-by-hop options not first"}
+		}
+
+		if offset+2 > len(packet) {
+			return nil, 0, 0, &ExtensionHeaderError{Type: nextHeader, Offset: offset, Reason: "truncated"}
+		}
+
+		length := fragmentHeaderLength
+		if nextHeader != NextHeaderFragment {
+			length = (int(packet[offset+1]) + 1) * 8
+		}
+
+		if offset+length > len(packet) {
+			return nil, 0, 0, &ExtensionHeaderError{Type: nextHeader, Offset: offset + 1, Reason: fmt.Sprintf("length %d past the end of the packet", length)}
+		}
+
+		header, err := decodeExtensionHeader(nextHeader, packet[offset:offset+length], offset)
+		if err != nil {
+			return nil, 0, 0, err
+		}
+
+		headers = append(headers, header)
+		nextHeaderOffset = offset
+		nextHeader = packet[offset]
+		offset += length
+
+		// Past a later fragment's header is the middle of the original payload, not more headers
+		if header.Type == NextHeaderFragment && header.FragmentOffset != 0 {
+			break
+		}
+	}
+
+	return headers, nextHeader, offset, nil
+}
+
+// decodeExtensionHeader decodes one header, next header byte included. Offset is where it starts in the packet.
+func decodeExtensionHeader(headerType uint8, data []byte, offset int) (ExtensionHeader, error) {
+	header := ExtensionHeader{Type: headerType}
+
+	switch headerType {
+	case NextHeaderHopByHop, NextHeaderDestinationOptions:
+		options, err := decodeOptions(headerType, data[2:], offset+2)
+		if err != nil {
+			return header, err
+		}
+
+		header.Options = options
+	case NextHeaderRouting:
+		if len(data) < minRoutingHeaderLength {
+			return header, &ExtensionHeaderError{Type: headerType, Offset: offset, Reason: "truncated"}
+		}
+
+		header.RoutingType = data[2]
+		header.SegmentsLeft = data[3]
+		header.RoutingData = data[4:]
+	case NextHeaderFragment:
+		offsetAndFlag := bytehelpers.ByteArrayToUint16(data[2:4])
+		header.FragmentOffset = offsetAndFlag >> 3
+		header.MoreFragments = offsetAndFlag&1 != 0
+		header.Identification = bytehelpers.ByteArrayToUint32(data[4:8])
+	}
+
+	return header, nil
+}
+
+// decodeOptions parses the type-length-value options of a Hop-by-Hop or Destination Options header
+func decodeOptions(headerType uint8, data []byte, offset int) ([]Option, error) {
+	options := []Option{}
+
+	for i := 0; i < len(data); {
+		optionType := data[i]
+
+		if optionType == OptionPad1 {
+			i++
+			continue
+		}
+
+		if i+2 > len(data) || i+2+int(data[i+1]) > len(data) {
+			return nil, &ExtensionHeaderError{Type: headerType, Offset: offset + i, Reason: fmt.Sprintf("option %d overruns the header", optionType)}
+		}
+
+		value := data[i+2 : i+2+int(data[i+1])]
+		if optionType != OptionPadN {
+			options = append(options, Option{Type: optionType, Data: value})
+		}
+
+		i += 2 + len(value)
+	}
+
+	return options, nil
+}
@@ -0,0 +1,83 @@
+package ipv6
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Fragment offsets count in blocks of this many bytes
+const fragmentBlockBytes = 8
+
+// ErrAlreadyFragmented is returned by Fragment, wrapped, for a packet that already has a fragment header
+var ErrAlreadyFragmented = errors.New("IPv6 packet already fragmented")
+
+// Fragment splits the packet into fragments of at most mtu bytes each, behind fragment headers carrying
+// identification (RFC 8200 4.5). The Hop-by-Hop and Routing headers that nodes on the way need are repeated in every
+// fragment, and the extension headers after them go in the first fragment along with the start of the payload.
+// A packet that already fits comes back on its own, without a fragment header: atomic fragments only help
+// attackers (RFC 8021).
+func (p *Packet) Fragment(mtu int, identification uint32) ([]*Packet, error) {
+	if p.FragmentHeader() != nil {
+		return nil, fmt.Errorf("%w: identification %#x", ErrAlreadyFragmented, p.FragmentHeader().Identification)
+	}
+
+	split := unfragmentableHeaders(p.ExtensionHeaders)
+
+	unfragmentable, err := encodeExtensionHeaders(p.ExtensionHeaders[:split], NextHeaderFragment)
+	if err != nil {
+		return nil, err
+	}
+
+	fragmentable, err := encodeExtensionHeaders(p.ExtensionHeaders[split:], p.Protocol)
+	if err != nil {
+		return nil, err
+	}
+
+	fragmentable = append(fragmentable, p.Payload...)
+
+	if HeaderLength+len(unfragmentable)+len(fragmentable) <= mtu {
+		return []*Packet{p}, nil
+	}
+
+	protocol := p.Protocol
+	if split < len(p.ExtensionHeaders) {
+		protocol = p.ExtensionHeaders[split].Type
+	}
+
+	// Every fragment but the last has to carry a whole number of 8 byte blocks
+	room := (mtu - HeaderLength - len(unfragmentable) - fragmentHeaderLength) / fragmentBlockBytes * fragmentBlockBytes
+	if room <= 0 {
+		return nil, fmt.Errorf("MTU too small to fragment into: %d", mtu)
+	}
+
+	var fragments []*Packet
+
+	for offset := 0; offset < len(fragmentable); offset += room {
+		size := min(room, len(fragmentable)-offset)
+		more := offset+size < len(fragmentable)
+
+		fragment := *p
+		fragment.ExtensionHeaders = append(slices.Clone(p.ExtensionHeaders[:split]), NewFragmentHeader(uint16(offset/fragmentBlockBytes), more, identification))
+		fragment.Protocol = protocol
+		fragment.Payload = fragmentable[offset : offset+size]
+
+		fragments = append(fragments, &fragment)
+	}
+
+	return fragments, nil
+}
+
+// unfragmentableHeaders counts the extension headers at the front of the chain that have to be processed before
+// reassembly, up to and including the last Hop-by-Hop or Routing header (RFC 8200 4.5)
+func unfragmentableHeaders(headers []ExtensionHeader) int {
+	split := 0
+
+	for i, header := range headers {
+		if header.Type == NextHeaderHopByHop || header.Type == NextHeaderRouting {
+			split = i + 1
+		}
+	}
+
+	return split
+}
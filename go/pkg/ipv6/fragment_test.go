@@ -0,0 +1,128 @@
+package ipv6
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	testhelpers "networking/internal/test_helpers"
+)
+
+func Test_Fragment_SplitsOnBlockBoundaries(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 300)
+	packet := &Packet{
+		Source:      netip.MustParseAddr("2001:db8::1"),
+		Destination: netip.MustParseAddr("2001:db8::2"),
+		HopLimit:    DefaultHopLimit,
+		Protocol:    NextHeaderUDP,
+		Payload:     payload,
+	}
+
+	fragments, err := packet.Fragment(MinMTU, 0x1234)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(fragments) != 3 {
+		t.Fatalf("Expected 3 fragments, got %d", len(fragments))
+	}
+
+	var reassembled []byte
+
+	for i, fragment := range fragments {
+		raw, err := fragment.CreatePacket(context.TODO())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		if len(raw) > MinMTU {
+			t.Errorf("Fragment %d is %d bytes, over the MTU", i, len(raw))
+		}
+
+		parsed, err := ParseRawPacket(context.TODO(), raw)
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		header := parsed.FragmentHeader()
+		if header == nil || header.Identification != 0x1234 || int(header.FragmentOffset)*8 != len(reassembled) {
+			t.Fatalf("Unexpected fragment header on fragment %d: %+v", i, header)
+		}
+
+		if header.MoreFragments != (i < len(fragments)-1) {
+			t.Errorf("Expected more fragments %t on fragment %d", i < len(fragments)-1, i)
+		}
+
+		if parsed.Protocol != NextHeaderUDP {
+			t.Errorf("Expected UDP after the fragment header, got %d", parsed.Protocol)
+		}
+
+		reassembled = append(reassembled, parsed.Payload...)
+	}
+
+	if !bytes.Equal(reassembled, payload) {
+		t.Errorf("Fragments do not add up to the original payload")
+	}
+}
+
+func Test_Fragment_RepeatsOnlyUnfragmentableHeaders(t *testing.T) {
+	packet := &Packet{
+		Source:      netip.MustParseAddr("2001:db8::1"),
+		Destination: netip.MustParseAddr("2001:db8::2"),
+		ExtensionHeaders: []ExtensionHeader{
+			NewHopByHopHeader(Option{Type: OptionRouterAlert, Data: []byte{0, 0}}),
+			NewDestinationOptionsHeader(Option{Type: 0x1E, Data: []byte{1, 2, 3}}),
+		},
+		Protocol: NextHeaderUDP,
+		Payload:  make([]byte, 2000),
+	}
+
+	fragments, err := packet.Fragment(MinMTU, 7)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	for i, fragment := range fragments {
+		if len(fragment.ExtensionHeaders) != 2 || fragment.ExtensionHeaders[0].Type != NextHeaderHopByHop || fragment.ExtensionHeaders[1].Type != NextHeaderFragment {
+			t.Errorf("Expected Hop-by-Hop then Fragment on fragment %d, got %+v", i, fragment.ExtensionHeaders)
+		}
+
+		if fragment.Protocol != NextHeaderDestinationOptions {
+			t.Errorf("Expected the fragmentable part to start with Destination Options, got %d", fragment.Protocol)
+		}
+	}
+
+	raw, err := fragments[0].CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(parsed.ExtensionHeaders) != 3 || parsed.ExtensionHeaders[2].Type != NextHeaderDestinationOptions || parsed.Protocol != NextHeaderUDP {
+		t.Errorf("Expected the first fragment to carry the Destination Options header, got %+v", parsed.ExtensionHeaders)
+	}
+}
+
+func Test_Fragment_NoAtomicFragments(t *testing.T) {
+	packet := &Packet{
+		Source:      netip.MustParseAddr("2001:db8::1"),
+		Destination: netip.MustParseAddr("2001:db8::2"),
+		Protocol:    NextHeaderUDP,
+		Payload:     make([]byte, MinMTU-HeaderLength),
+	}
+
+	fragments, err := packet.Fragment(MinMTU, 1)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(fragments) != 1 || fragments[0] != packet {
+		t.Errorf("Expected a packet that fits to come back unchanged, got %d fragments", len(fragments))
+	}
+}
+
+func Test_Fragment_RejectsFragments(t *testing.T) {
+	packet := &Packet{
+		Source:           netip.MustParseAddr("2001:db8::1"),
+		Destination:      netip.MustParseAddr("2001:db8::2"),
+		ExtensionHeaders: []ExtensionHeader{NewFragmentHeader(0, true, 1)},
+		Protocol:         NextHeaderUDP,
+		Payload:          make([]byte, 2000),
+	}
+
+	if _, err := packet.Fragment(MinMTU, 2); !errors.Is(err, ErrAlreadyFragmented) {
+		t.Errorf("Expected ErrAlreadyFragmented, got %v", err)
+	}
+}
@@ -0,0 +1,59 @@
+package ipv6
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"net/netip"
+)
+
+// InterfaceIDBits is how much of a stateless autoconfigured address is the interface identifier. Only /64
+// prefixes can be autoconfigured (RFC 4291 2.5.1).
+const InterfaceIDBits = 64
+
+// InterfaceIDFromMAC returns the modified EUI-64 interface identifier for a 48 bit MAC: ff:fe in the middle, and
+// the universal/local bit flipped (RFC 4291 appendix A)
+func InterfaceIDFromMAC(mac [6]byte) [8]byte {
+	return [8]byte{mac[0] ^ 0x02, mac[1], mac[2], 0xFF, 0xFE, mac[3], mac[4], mac[5]}
+}
+
+// StablePrivacyInterfaceID returns an interface identifier that is stable for a prefix on an interface, but says
+// nothing about the hardware and changes from one network to the next (RFC 7217 5). It is the first 64 bits of
+// SHA-256 over the prefix, the interface name, dadCounter and secret. dadCounter starts at zero and goes up each
+// time duplicate address detection fails, to get a different identifier.
+func StablePrivacyInterfaceID(prefix netip.Prefix, iface string, dadCounter uint8, secret []byte) [8]byte {
+	bytes := prefix.Masked().Addr().As16()
+
+	for {
+		hash := sha256.New()
+		hash.Write(bytes[:8])
+		hash.Write([]byte(iface))
+		hash.Write([]byte{dadCounter})
+		hash.Write(secret)
+
+		id := [8]byte(hash.Sum(nil))
+		if !isReservedInterfaceID(id) {
+			return id
+		}
+
+		// RFC 7217 5: a reserved identifier is skipped as if it had failed duplicate address detection
+		dadCounter++
+	}
+}
+
+// isReservedInterfaceID checks for the identifiers no address may be formed with (RFC 5453): the subnet-router
+// anycast one, the proxy mobile IPv6 range, and the subnet anycast range at the top
+func isReservedInterfaceID(id [8]byte) bool {
+	value := binary.BigEndian.Uint64(id[:])
+
+	return value == 0 ||
+		(value >= 0x02005EFFFE000000 && value <= 0x02005EFFFE005212) ||
+		value >= 0xFDFFFFFFFFFFFF80
+}
+
+// AddressWithInterfaceID returns the address made of the first 64 bits of prefix and id
+func AddressWithInterfaceID(prefix netip.Prefix, id [8]byte) netip.Addr {
+	bytes := prefix.Masked().Addr().As16()
+	copy(bytes[8:], id[:])
+
+	return netip.AddrFrom16(bytes)
+}
@@ -0,0 +1,55 @@
+package ipv6
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func Test_InterfaceIDFromMAC(t *testing.T) {
+	id := InterfaceIDFromMAC([6]byte{0x52, 0x54, 0x00, 0x12, 0x34, 0x56})
+	actual := AddressWithInterfaceID(netip.MustParsePrefix("fe80::/64"), id)
+
+	if expected := netip.MustParseAddr("fe80::5054:ff:fe12:3456"); actual != expected {
+		t.Errorf("Expected %s, got %s", expected, actual)
+	}
+}
+
+func Test_StablePrivacyInterfaceID(t *testing.T) {
+	prefix := netip.MustParsePrefix("2001:db8:1:2::/64")
+	secret := []byte("a secret")
+	id := StablePrivacyInterfaceID(prefix, "eth0", 0, secret)
+
+	if again := StablePrivacyInterfaceID(netip.MustParsePrefix("2001:db8:1:2:aaaa::/64"), "eth0", 0, secret); again != id {
+		t.Errorf("Expected the same identifier for the same prefix, got %x and %x", id, again)
+	}
+
+	others := map[string][8]byte{
+		"prefix":      StablePrivacyInterfaceID(netip.MustParsePrefix("2001:db8:1:3::/64"), "eth0", 0, secret),
+		"interface":   StablePrivacyInterfaceID(prefix, "eth1", 0, secret),
+		"DAD counter": StablePrivacyInterfaceID(prefix, "eth0", 1, secret),
+		"secret":      StablePrivacyInterfaceID(prefix, "eth0", 0, []byte("another secret")),
+	}
+
+	for changed, other := range others {
+		if other == id {
+			t.Errorf("Expected a different identifier for a different %s", changed)
+		}
+	}
+}
+
+func Test_IsReservedInterfaceID(t *testing.T) {
+	cases := map[[8]byte]bool{
+		{}: true,
+		{0x02, 0x00, 0x5E, 0xFF, 0xFE, 0x00, 0x52, 0x12}: true,
+		{0x02, 0x00, 0x5E, 0xFF, 0xFE, 0x00, 0x52, 0x13}: false,
+		{0xFD, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x80}: true,
+		{0xFD, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0x7F}: false,
+		{0x50, 0x54, 0x00, 0xFF, 0xFE, 0x12, 0x34, 0x56}: false,
+	}
+
+	for id, expected := range cases {
+		if actual := isReservedInterfaceID(id); actual != expected {
+			t.Errorf("%x: expected %t, got %t", id, expected, actual)
+		}
+	}
+}
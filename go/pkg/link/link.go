@@ -0,0 +1,32 @@
+package link
+
+import (
+	"errors"
+
+	"networking/pkg/ethernet"
+)
+
+// Type is what a link carries, which decides whether the stack adds an Ethernet header
+type Type int
+
+const (
+	// Ethernet links carry whole Ethernet frames (TAP devices, the in-process pipe)
+	Ethernet Type = iota
+	// IP links carry bare IP packets (TUN devices)
+	IP
+)
+
+var ErrClosed = errors.New("link closed")
+
+// Link is a network device the stack can send and receive on
+type Link interface {
+	Type() Type
+	// MTU is the largest packet the link carries, not counting any Ethernet header
+	MTU() int
+	// HardwareAddress is the zero MAC for IP links
+	HardwareAddress() ethernet.MAC
+	// ReadPacket blocks until a packet arrives or the link is closed, in which case it returns ErrClosed
+	ReadPacket() ([]byte, error)
+	WritePacket(packet []byte) error
+	Close() error
+}
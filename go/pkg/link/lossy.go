@@ -0,0 +1,56 @@
+package link
+
+import (
+	"math/rand/v2"
+	"sync"
+	"sync/atomic"
+)
+
+// Lossy wraps a link, silently dropping the outgoing packets its drop function picks,
+// so recovery from loss can be tested without a real network misbehaving
+type Lossy struct {
+	Link
+
+	mu      sync.Mutex
+	drop    func(packet []byte) bool
+	dropped atomic.Uint64
+}
+
+func NewLossy(l Link, drop func(packet []byte) bool) *Lossy {
+	return &Lossy{Link: l, drop: drop}
+}
+
+// DropRandomly drops each packet with probability rate. The same seed always drops the same packets.
+func DropRandomly(rate float64, seed uint64) func(packet []byte) bool {
+	random := rand.New(rand.NewPCG(seed, seed))
+
+	return func(packet []byte) bool {
+		return random.Float64() < rate
+	}
+}
+
+// SetDrop replaces the drop function. Nil drops nothing.
+func (l *Lossy) SetDrop(drop func(packet []byte) bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.drop = drop
+}
+
+func (l *Lossy) WritePacket(packet []byte) error {
+	l.mu.Lock()
+	shouldDrop := l.drop != nil && l.drop(packet)
+	l.mu.Unlock()
+
+	if shouldDrop {
+		l.dropped.Add(1)
+		return nil
+	}
+
+	return l.Link.WritePacket(packet)
+}
+
+// Dropped is how many packets have been dropped so far
+func (l *Lossy) Dropped() uint64 {
+	return l.dropped.Load()
+}
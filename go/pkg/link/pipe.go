@@ -0,0 +1,110 @@
+package link
+
+import (
+	"crypto/rand"
+	"sync"
+
+	"networking/pkg/ethernet"
+)
+
+const pipeQueueLength = 256
+
+// Pipe is one end of an in-process link, so stacks can talk to each other without a kernel
+type Pipe struct {
+	linkType Type
+	mtu      int
+	mac      ethernet.MAC
+
+	inbound chan []byte
+	peer    *Pipe
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewPipe creates two links connected back to back. Whatever is written to one is read from the other.
+// Ethernet pipes get random locally administered MAC addresses.
+func NewPipe(linkType Type, mtu int) (*Pipe, *Pipe) {
+	a := newPipeEnd(linkType, mtu)
+	b := newPipeEnd(linkType, mtu)
+
+	a.peer = b
+	b.peer = a
+
+	return a, b
+}
+
+func newPipeEnd(linkType Type, mtu int) *Pipe {
+	pipe := &Pipe{
+		linkType: linkType,
+		mtu:      mtu,
+		inbound:  make(chan []byte, pipeQueueLength),
+		closed:   make(chan struct{}),
+	}
+
+	if linkType == Ethernet {
+		pipe.mac = randomMAC()
+	}
+
+	return pipe
+}
+
+func randomMAC() ethernet.MAC {
+	var mac ethernet.MAC
+	_, _ = rand.Read(mac[:])
+
+	// Locally administered, unicast
+	mac[0] = mac[0]&0xFC | 0x02
+
+	return mac
+}
+
+func (p *Pipe) Type() Type {
+	return p.linkType
+}
+
+func (p *Pipe) MTU() int {
+	return p.mtu
+}
+
+func (p *Pipe) HardwareAddress() ethernet.MAC {
+	return p.mac
+}
+
+func (p *Pipe) ReadPacket() ([]byte, error) {
+	select {
+	case packet := <-p.inbound:
+		return packet, nil
+	case <-p.closed:
+		return nil, ErrClosed
+	}
+}
+
+// WritePacket hands a copy of packet to the other end. Like a real wire, packets are silently lost
+// if the other end is closed or has fallen too far behind.
+func (p *Pipe) WritePacket(packet []byte) error {
+	select {
+	case <-p.closed:
+		return ErrClosed
+	default:
+	}
+
+	packetCopy := make([]byte, len(packet))
+	copy(packetCopy, packet)
+
+	select {
+	case p.peer.inbound <- packetCopy:
+	case <-p.peer.closed:
+	default:
+	}
+
+	return nil
+}
+
+func (p *Pipe) Close() error {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+	})
+
+	return nil
+}
@@ -0,0 +1,190 @@
+//go:build linux
+
+package link
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"unsafe"
+
+	"networking/pkg/ethernet"
+)
+
+// From linux/if_tun.h
+const (
+	tunSetIff = 0x400454CA
+	iffTun    = 0x0001
+	iffTap    = 0x0002
+	iffNoPi   = 0x1000
+)
+
+// ifreq is the part of struct ifreq the TUN and MTU ioctls use
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+type ifreqMTU struct {
+	name [syscall.IFNAMSIZ]byte
+	mtu  int32
+	_    [20]byte
+}
+
+// Device is a Linux TUN or TAP device. The kernel sees an ordinary interface, and the stack sees a Link.
+// Creating one needs CAP_NET_ADMIN, and the kernel side still has to be given an address and brought up, e.g.
+//
+//	ip addr add 10.0.0.1/24 dev tun0 && ip link set tun0 up
+type Device struct {
+	name     string
+	file     *os.File
+	linkType Type
+	mtu      int
+	mac      ethernet.MAC
+}
+
+// NewTUN opens (creating if needed) a TUN device, which carries bare IP packets
+func NewTUN(name string) (*Device, error) {
+	return openDevice(name, IP)
+}
+
+// NewTAP opens (creating if needed) a TAP device, which carries Ethernet frames.
+// The stack gets its own random MAC address, separate from the one the kernel uses on its side.
+func NewTAP(name string) (*Device, error) {
+	return openDevice(name, Ethernet)
+}
+
+func openDevice(name string, linkType Type) (*Device, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, fmt.Errorf("interface name too long: %s", name)
+	}
+
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open /dev/net/tun: %w", err)
+	}
+
+	request := ifreq{flags: iffNoPi}
+	if linkType == IP {
+		request.flags |= iffTun
+	} else {
+		request.flags |= iffTap
+	}
+	copy(request.name[:], name)
+
+	if err := ioctl(fd, tunSetIff, unsafe.Pointer(&request)); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("TUNSETIFF %s: %w", name, err)
+	}
+
+	// Non-blocking lets the runtime poller wake a blocked ReadPacket when the device is closed
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		_ = syscall.Close(fd)
+		return nil, fmt.Errorf("set non-blocking: %w", err)
+	}
+
+	deviceName := string(request.name[:clen(request.name[:])])
+
+	mtu, err := interfaceMTU(deviceName)
+	if err != nil {
+		_ = syscall.Close(fd)
+		return nil, err
+	}
+
+	device := &Device{
+		name:     deviceName,
+		file:     os.NewFile(uintptr(fd), "/dev/net/tun"),
+		linkType: linkType,
+		mtu:      mtu,
+	}
+
+	if linkType == Ethernet {
+		device.mac = randomMAC()
+	}
+
+	return device, nil
+}
+
+func interfaceMTU(name string) (int, error) {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return 0, fmt.Errorf("socket for SIOCGIFMTU: %w", err)
+	}
+	defer syscall.Close(fd)
+
+	request := ifreqMTU{}
+	copy(request.name[:], name)
+
+	if err := ioctl(fd, syscall.SIOCGIFMTU, unsafe.Pointer(&request)); err != nil {
+		return 0, fmt.Errorf("SIOCGIFMTU %s: %w", name, err)
+	}
+
+	return int(request.mtu), nil
+}
+
+func ioctl(fd int, request uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), request, uintptr(arg))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+func clen(b []byte) int {
+	for i, c := range b {
+		if c == 0 {
+			return i
+		}
+	}
+
+	return len(b)
+}
+
+// Name is the interface name the kernel gave the device, which matters when the requested name had a %d in it
+func (d *Device) Name() string {
+	return d.name
+}
+
+func (d *Device) Type() Type {
+	return d.linkType
+}
+
+func (d *Device) MTU() int {
+	return d.mtu
+}
+
+func (d *Device) HardwareAddress() ethernet.MAC {
+	return d.mac
+}
+
+func (d *Device) ReadPacket() ([]byte, error) {
+	// Room for the largest frame the kernel will hand us: the MTU plus an Ethernet header
+	buffer := make([]byte, d.mtu+ethernet.HeaderLength)
+
+	n, err := d.file.Read(buffer)
+	if errors.Is(err, os.ErrClosed) {
+		return nil, ErrClosed
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return buffer[:n], nil
+}
+
+func (d *Device) WritePacket(packet []byte) error {
+	_, err := d.file.Write(packet)
+	if errors.Is(err, os.ErrClosed) {
+		return ErrClosed
+	}
+
+	return err
+}
+
+func (d *Device) Close() error {
+	return d.file.Close()
+}
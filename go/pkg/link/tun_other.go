@@ -0,0 +1,30 @@
+//go:build !linux
+
+package link
+
+import (
+	"errors"
+
+	"networking/pkg/ethernet"
+)
+
+var errUnsupported = errors.New("TUN/TAP devices are only supported on Linux")
+
+// Device is a TUN or TAP device, which only exists on Linux for now
+type Device struct{}
+
+func NewTUN(name string) (*Device, error) {
+	return nil, errUnsupported
+}
+
+func NewTAP(name string) (*Device, error) {
+	return nil, errUnsupported
+}
+
+func (d *Device) Name() string                  { return "" }
+func (d *Device) Type() Type                    { return IP }
+func (d *Device) MTU() int                      { return 0 }
+func (d *Device) HardwareAddress() ethernet.MAC { return ethernet.MAC{} }
+func (d *Device) ReadPacket() ([]byte, error)   { return nil, errUnsupported }
+func (d *Device) WritePacket([]byte) error      { return errUnsupported }
+func (d *Device) Close() error                  { return nil }
@@ -0,0 +1,270 @@
+package metrics
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Counter is a monotonically increasing count, safe to bump from any goroutine
+type Counter struct {
+	value atomic.Uint64
+}
+
+func (c *Counter) Inc() {
+	c.value.Add(1)
+}
+
+func (c *Counter) Add(delta uint64) {
+	c.value.Add(delta)
+}
+
+func (c *Counter) Load() uint64 {
+	return c.value.Load()
+}
+
+// IPCounters are modelled on the ipSystemStats group of RFC 4293 (IP-MIB), which replaced MIB-II's ip group
+type IPCounters struct {
+	InReceives       Counter
+	InHdrErrors      Counter
+	InNoRoutes       Counter
+	InAddrErrors     Counter
+	InUnknownProtos  Counter
+	InForwDatagrams  Counter
+	ReasmReqds       Counter
+	ReasmOKs         Counter
+	ReasmFails       Counter
+	InDiscards       Counter
+	InDelivers       Counter
+	OutRequests      Counter
+	OutForwDatagrams Counter
+	OutDiscards      Counter
+	OutNoRoutes      Counter
+	OutFragReqds     Counter
+	OutFragOKs       Counter
+	OutFragFails     Counter
+	OutFragCreates   Counter
+}
+
+// ICMPCounters are modelled on the icmp group of MIB-II (RFC 1213)
+type ICMPCounters struct {
+	InMsgs          Counter
+	InErrors        Counter
+	InDestUnreachs  Counter
+	InTimeExcds     Counter
+	InRedirects     Counter
+	InEchos         Counter
+	InEchoReps      Counter
+	OutMsgs         Counter
+	OutErrors       Counter
+	OutDestUnreachs Counter
+	OutTimeExcds    Counter
+	OutRedirects    Counter
+	OutEchos        Counter
+	OutEchoReps     Counter
+}
+
+// ICMPv6Counters are modelled on the ipv6IfIcmp group of RFC 2466 (IPv6-ICMP-MIB), summed over interfaces
+type ICMPv6Counters struct {
+	InMsgs                    Counter
+	InErrors                  Counter
+	InDestUnreachs            Counter
+	InPktTooBigs              Counter
+	InTimeExcds               Counter
+	InParmProblems            Counter
+	InEchos                   Counter
+	InEchoReplies             Counter
+	InRouterSolicits          Counter
+	InRouterAdvertisements    Counter
+	InNeighborSolicits        Counter
+	InNeighborAdvertisements  Counter
+	InRedirects               Counter
+	OutMsgs                   Counter
+	OutErrors                 Counter
+	OutDestUnreachs           Counter
+	OutPktTooBigs             Counter
+	OutTimeExcds              Counter
+	OutParmProblems           Counter
+	OutEchos                  Counter
+	OutEchoReplies            Counter
+	OutRouterSolicits         Counter
+	OutNeighborSolicits       Counter
+	OutNeighborAdvertisements Counter
+}
+
+// UDPCounters are the scalar counters of RFC 4113 (UDP-MIB)
+type UDPCounters struct {
+	InDatagrams  Counter
+	NoPorts      Counter
+	InErrors     Counter
+	OutDatagrams Counter
+}
+
+// TCPCounters are the scalar counters of RFC 4022 (TCP-MIB). tcpCurrEstab is a gauge, so it is left out.
+type TCPCounters struct {
+	ActiveOpens  Counter
+	PassiveOpens Counter
+	AttemptFails Counter
+	EstabResets  Counter
+	InSegs       Counter
+	OutSegs      Counter
+	RetransSegs  Counter
+	InErrs       Counter
+	OutRsts      Counter
+}
+
+// Counters is everything one stack counts
+type Counters struct {
+	IP IPCounters
+	// IPv6 counts the same things as IP, which RFC 4293 keeps one row of per IP version
+	IPv6   IPCounters
+	ICMP   ICMPCounters
+	ICMPv6 ICMPv6Counters
+	UDP    UDPCounters
+	TCP    TCPCounters
+}
+
+// Sample is a single counter's value at the time of a snapshot
+type Sample struct {
+	// Group is the MIB group, e.g. "udp"
+	Group string
+	// Name is the MIB object name, e.g. "udpNoPorts"
+	Name string
+	// PrometheusName is the name the counter is exported under, e.g. "netstack_udp_no_ports_total"
+	PrometheusName string
+	Help           string
+	Value          uint64
+}
+
+// Snapshot is a point in time copy of every counter, in MIB order
+type Snapshot struct {
+	Taken   time.Time
+	Samples []Sample
+}
+
+// Get returns a counter's value by its MIB object name
+func (s Snapshot) Get(name string) (uint64, bool) {
+	for _, sample := range s.Samples {
+		if sample.Name == name {
+			return sample.Value, true
+		}
+	}
+
+	return 0, false
+}
+
+type descriptor struct {
+	group          string
+	name           string
+	prometheusName string
+	help           string
+	counter        *Counter
+}
+
+// Snapshot reads every counter. Counters are read one at a time, so a snapshot taken under load
+// may count a packet in one counter but not yet in the next.
+func (c *Counters) Snapshot() Snapshot {
+	descriptors := c.descriptors()
+	snapshot := Snapshot{
+		Taken:   time.Now(),
+		Samples: make([]Sample, len(descriptors)),
+	}
+
+	for i, d := range descriptors {
+		snapshot.Samples[i] = Sample{
+			Group:          d.group,
+			Name:           d.name,
+			PrometheusName: d.prometheusName,
+			Help:           d.help,
+			Value:          d.counter.Load(),
+		}
+	}
+
+	return snapshot
+}
+
+func (c *Counters) descriptors() []descriptor {
+	descriptors := ipDescriptors("ip", &c.IP)
+	descriptors = append(descriptors, ipDescriptors("ipv6", &c.IPv6)...)
+
+	return append(descriptors, []descriptor{
+		{"icmp", "icmpInMsgs", "netstack_icmp_in_msgs_total", "ICMP messages received, including those in error.", &c.ICMP.InMsgs},
+		{"icmp", "icmpInErrors", "netstack_icmp_in_errors_total", "ICMP messages received with ICMP-specific errors such as bad checksums.", &c.ICMP.InErrors},
+		{"icmp", "icmpInDestUnreachs", "netstack_icmp_in_dest_unreachs_total", "ICMP Destination Unreachable messages received.", &c.ICMP.InDestUnreachs},
+		{"icmp", "icmpInTimeExcds", "netstack_icmp_in_time_excds_total", "ICMP Time Exceeded messages received.", &c.ICMP.InTimeExcds},
+		{"icmp", "icmpInRedirects", "netstack_icmp_in_redirects_total", "ICMP Redirect messages received.", &c.ICMP.InRedirects},
+		{"icmp", "icmpInEchos", "netstack_icmp_in_echos_total", "ICMP Echo requests received.", &c.ICMP.InEchos},
+		{"icmp", "icmpInEchoReps", "netstack_icmp_in_echo_reps_total", "ICMP Echo replies received.", &c.ICMP.InEchoReps},
+		{"icmp", "icmpOutMsgs", "netstack_icmp_out_msgs_total", "ICMP messages this stack attempted to send, including those in error.", &c.ICMP.OutMsgs},
+		{"icmp", "icmpOutErrors", "netstack_icmp_out_errors_total", "ICMP messages not sent due to problems discovered within ICMP.", &c.ICMP.OutErrors},
+		{"icmp", "icmpOutDestUnreachs", "netstack_icmp_out_dest_unreachs_total", "ICMP Destination Unreachable messages sent.", &c.ICMP.OutDestUnreachs},
+		{"icmp", "icmpOutTimeExcds", "netstack_icmp_out_time_excds_total", "ICMP Time Exceeded messages sent.", &c.ICMP.OutTimeExcds},
+		{"icmp", "icmpOutRedirects", "netstack_icmp_out_redirects_total", "ICMP Redirect messages sent.", &c.ICMP.OutRedirects},
+		{"icmp", "icmpOutEchos", "netstack_icmp_out_echos_total", "ICMP Echo requests sent.", &c.ICMP.OutEchos},
+		{"icmp", "icmpOutEchoReps", "netstack_icmp_out_echo_reps_total", "ICMP Echo replies sent.", &c.ICMP.OutEchoReps},
+
+		{"icmpv6", "ipv6IfIcmpInMsgs", "netstack_icmpv6_in_msgs_total", "ICMPv6 messages received, including those in error.", &c.ICMPv6.InMsgs},
+		{"icmpv6", "ipv6IfIcmpInErrors", "netstack_icmpv6_in_errors_total", "ICMPv6 messages received with ICMP-specific errors such as bad checksums.", &c.ICMPv6.InErrors},
+		{"icmpv6", "ipv6IfIcmpInDestUnreachs", "netstack_icmpv6_in_dest_unreachs_total", "ICMPv6 Destination Unreachable messages received.", &c.ICMPv6.InDestUnreachs},
+		{"icmpv6", "ipv6IfIcmpInPktTooBigs", "netstack_icmpv6_in_pkt_too_bigs_total", "ICMPv6 Packet Too Big messages received.", &c.ICMPv6.InPktTooBigs},
+		{"icmpv6", "ipv6IfIcmpInTimeExcds", "netstack_icmpv6_in_time_excds_total", "ICMPv6 Time Exceeded messages received.", &c.ICMPv6.InTimeExcds},
+		{"icmpv6", "ipv6IfIcmpInParmProblems", "netstack_icmpv6_in_parm_problems_total", "ICMPv6 Parameter Problem messages received.", &c.ICMPv6.InParmProblems},
+		{"icmpv6", "ipv6IfIcmpInEchos", "netstack_icmpv6_in_echos_total", "ICMPv6 Echo requests received.", &c.ICMPv6.InEchos},
+		{"icmpv6", "ipv6IfIcmpInEchoReplies", "netstack_icmpv6_in_echo_replies_total", "ICMPv6 Echo replies received.", &c.ICMPv6.InEchoReplies},
+		{"icmpv6", "ipv6IfIcmpInRouterSolicits", "netstack_icmpv6_in_router_solicits_total", "ICMPv6 Router Solicitation messages received.", &c.ICMPv6.InRouterSolicits},
+		{"icmpv6", "ipv6IfIcmpInRouterAdvertisements", "netstack_icmpv6_in_router_advertisements_total", "ICMPv6 Router Advertisement messages received.", &c.ICMPv6.InRouterAdvertisements},
+		{"icmpv6", "ipv6IfIcmpInNeighborSolicits", "netstack_icmpv6_in_neighbor_solicits_total", "ICMPv6 Neighbor Solicitation messages received.", &c.ICMPv6.InNeighborSolicits},
+		{"icmpv6", "ipv6IfIcmpInNeighborAdvertisements", "netstack_icmpv6_in_neighbor_advertisements_total", "ICMPv6 Neighbor Advertisement messages received.", &c.ICMPv6.InNeighborAdvertisements},
+		{"icmpv6", "ipv6IfIcmpInRedirects", "netstack_icmpv6_in_redirects_total", "ICMPv6 Redirect messages received.", &c.ICMPv6.InRedirects},
+		{"icmpv6", "ipv6IfIcmpOutMsgs", "netstack_icmpv6_out_msgs_total", "ICMPv6 messages this stack attempted to send, including those in error.", &c.ICMPv6.OutMsgs},
+		{"icmpv6", "ipv6IfIcmpOutErrors", "netstack_icmpv6_out_errors_total", "ICMPv6 messages not sent due to problems discovered within ICMPv6.", &c.ICMPv6.OutErrors},
+		{"icmpv6", "ipv6IfIcmpOutDestUnreachs", "netstack_icmpv6_out_dest_unreachs_total", "ICMPv6 Destination Unreachable messages sent.", &c.ICMPv6.OutDestUnreachs},
+		{"icmpv6", "ipv6IfIcmpOutPktTooBigs", "netstack_icmpv6_out_pkt_too_bigs_total", "ICMPv6 Packet Too Big messages sent.", &c.ICMPv6.OutPktTooBigs},
+		{"icmpv6", "ipv6IfIcmpOutTimeExcds", "netstack_icmpv6_out_time_excds_total", "ICMPv6 Time Exceeded messages sent.", &c.ICMPv6.OutTimeExcds},
+		{"icmpv6", "ipv6IfIcmpOutParmProblems", "netstack_icmpv6_out_parm_problems_total", "ICMPv6 Parameter Problem messages sent.", &c.ICMPv6.OutParmProblems},
+		{"icmpv6", "ipv6IfIcmpOutEchos", "netstack_icmpv6_out_echos_total", "ICMPv6 Echo requests sent.", &c.ICMPv6.OutEchos},
+		{"icmpv6", "ipv6IfIcmpOutEchoReplies", "netstack_icmpv6_out_echo_replies_total", "ICMPv6 Echo replies sent.", &c.ICMPv6.OutEchoReplies},
+		{"icmpv6", "ipv6IfIcmpOutRouterSolicits", "netstack_icmpv6_out_router_solicits_total", "ICMPv6 Router Solicitation messages sent.", &c.ICMPv6.OutRouterSolicits},
+		{"icmpv6", "ipv6IfIcmpOutNeighborSolicits", "netstack_icmpv6_out_neighbor_solicits_total", "ICMPv6 Neighbor Solicitation messages sent.", &c.ICMPv6.OutNeighborSolicits},
+		{"icmpv6", "ipv6IfIcmpOutNeighborAdvertisements", "netstack_icmpv6_out_neighbor_advertisements_total", "ICMPv6 Neighbor Advertisement messages sent.", &c.ICMPv6.OutNeighborAdvertisements},
+
+		{"udp", "udpInDatagrams", "netstack_udp_in_datagrams_total", "UDP datagrams delivered to UDP users.", &c.UDP.InDatagrams},
+		{"udp", "udpNoPorts", "netstack_udp_no_ports_total", "Received UDP datagrams for which there was no application at the destination port.", &c.UDP.NoPorts},
+		{"udp", "udpInErrors", "netstack_udp_in_errors_total", "Received UDP datagrams that could not be delivered for reasons other than the lack of an application at the destination port.", &c.UDP.InErrors},
+		{"udp", "udpOutDatagrams", "netstack_udp_out_datagrams_total", "UDP datagrams sent from this entity.", &c.UDP.OutDatagrams},
+
+		{"tcp", "tcpActiveOpens", "netstack_tcp_active_opens_total", "Transitions to SYN-SENT from CLOSED.", &c.TCP.ActiveOpens},
+		{"tcp", "tcpPassiveOpens", "netstack_tcp_passive_opens_total", "Transitions to SYN-RECEIVED from LISTEN.", &c.TCP.PassiveOpens},
+		{"tcp", "tcpAttemptFails", "netstack_tcp_attempt_fails_total", "Transitions to CLOSED from SYN-SENT or SYN-RECEIVED, plus transitions to LISTEN from SYN-RECEIVED.", &c.TCP.AttemptFails},
+		{"tcp", "tcpEstabResets", "netstack_tcp_estab_resets_total", "Transitions to CLOSED from ESTABLISHED or CLOSE-WAIT.", &c.TCP.EstabResets},
+		{"tcp", "tcpInSegs", "netstack_tcp_in_segs_total", "Segments received, including those received in error.", &c.TCP.InSegs},
+		{"tcp", "tcpOutSegs", "netstack_tcp_out_segs_total", "Segments sent, excluding those containing only retransmitted octets.", &c.TCP.OutSegs},
+		{"tcp", "tcpRetransSegs", "netstack_tcp_retrans_segs_total", "Segments retransmitted.", &c.TCP.RetransSegs},
+		{"tcp", "tcpInErrs", "netstack_tcp_in_errs_total", "Segments received in error, such as bad checksums.", &c.TCP.InErrs},
+		{"tcp", "tcpOutRsts", "netstack_tcp_out_rsts_total", "Segments sent containing the RST flag.", &c.TCP.OutRsts},
+	}...)
+}
+
+// ipDescriptors describes one IP version's counters, named after the group they are in
+func ipDescriptors(group string, ip *IPCounters) []descriptor {
+	return []descriptor{
+		{group, group + "InReceives", "netstack_" + group + "_in_receives_total", "Input datagrams received from interfaces, including those received in error.", &ip.InReceives},
+		{group, group + "InHdrErrors", "netstack_" + group + "_in_hdr_errors_total", "Input datagrams discarded due to errors in their IP headers.", &ip.InHdrErrors},
+		{group, group + "InNoRoutes", "netstack_" + group + "_in_no_routes_total", "Input datagrams discarded because no route could be found to forward them.", &ip.InNoRoutes},
+		{group, group + "InAddrErrors", "netstack_" + group + "_in_addr_errors_total", "Input datagrams discarded because their destination address was not ours.", &ip.InAddrErrors},
+		{group, group + "InUnknownProtos", "netstack_" + group + "_in_unknown_protos_total", "Locally-addressed datagrams discarded because of an unknown or unsupported protocol.", &ip.InUnknownProtos},
+		{group, group + "InForwDatagrams", "netstack_" + group + "_in_forw_datagrams_total", "Input datagrams for which an attempt was made to forward them to their final destination.", &ip.InForwDatagrams},
+		{group, group + "ReasmReqds", "netstack_" + group + "_reasm_reqds_total", "Fragments received that needed reassembling.", &ip.ReasmReqds},
+		{group, group + "ReasmOKs", "netstack_" + group + "_reasm_oks_total", "Datagrams successfully reassembled.", &ip.ReasmOKs},
+		{group, group + "ReasmFails", "netstack_" + group + "_reasm_fails_total", "Failures detected by reassembly, such as timeouts and overlaps. Not a count of discarded fragments.", &ip.ReasmFails},
+		{group, group + "InDiscards", "netstack_" + group + "_in_discards_total", "Input datagrams discarded with no problem in the datagram itself.", &ip.InDiscards},
+		{group, group + "InDelivers", "netstack_" + group + "_in_delivers_total", "Input datagrams successfully delivered to IP user-protocols.", &ip.InDelivers},
+		{group, group + "OutRequests", "netstack_" + group + "_out_requests_total", "Datagrams local IP user-protocols supplied to IP for transmission.", &ip.OutRequests},
+		{group, group + "OutForwDatagrams", "netstack_" + group + "_out_forw_datagrams_total", "Datagrams successfully forwarded.", &ip.OutForwDatagrams},
+		{group, group + "OutDiscards", "netstack_" + group + "_out_discards_total", "Output datagrams discarded with no problem preventing their transmission.", &ip.OutDiscards},
+		{group, group + "OutNoRoutes", "netstack_" + group + "_out_no_routes_total", "Output datagrams discarded because no route could be found.", &ip.OutNoRoutes},
+		{group, group + "OutFragReqds", "netstack_" + group + "_out_frag_reqds_total", "Datagrams that needed fragmenting to be sent.", &ip.OutFragReqds},
+		{group, group + "OutFragOKs", "netstack_" + group + "_out_frag_oks_total", "Datagrams successfully fragmented.", &ip.OutFragOKs},
+		{group, group + "OutFragFails", "netstack_" + group + "_out_frag_fails_total", "Datagrams discarded because they needed fragmenting but could not be, such as for having DF set.", &ip.OutFragFails},
+		{group, group + "OutFragCreates", "netstack_" + group + "_out_frag_creates_total", "Fragments created by fragmenting datagrams.", &ip.OutFragCreates},
+	}
+}
@@ -0,0 +1,100 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func Test_Snapshot_ReadsCounters(t *testing.T) {
+	counters := &Counters{}
+	counters.UDP.InDatagrams.Add(3)
+	counters.UDP.NoPorts.Inc()
+
+	snapshot := counters.Snapshot()
+
+	expected := map[string]uint64{"udpInDatagrams": 3, "udpNoPorts": 1, "udpInErrors": 0, "udpOutDatagrams": 0}
+	for name, value := range expected {
+		actual, ok := snapshot.Get(name)
+		if !ok || actual != value {
+			t.Errorf("expected %s=%d, got %d (found: %v)", name, value, actual, ok)
+		}
+	}
+}
+
+func Test_Snapshot_IsACopy(t *testing.T) {
+	counters := &Counters{}
+	snapshot := counters.Snapshot()
+
+	counters.IP.InReceives.Inc()
+
+	if value, _ := snapshot.Get("ipInReceives"); value != 0 {
+		t.Errorf("expected snapshot to be unaffected by later increments, got %d", value)
+	}
+}
+
+func Test_Snapshot_KeepsIPVersionsApart(t *testing.T) {
+	counters := &Counters{}
+	counters.IP.InReceives.Add(2)
+	counters.IPv6.InReceives.Inc()
+	counters.ICMPv6.InNeighborSolicits.Inc()
+
+	snapshot := counters.Snapshot()
+
+	expected := map[string]uint64{"ipInReceives": 2, "ipv6InReceives": 1, "ipv6IfIcmpInNeighborSolicits": 1}
+	for name, value := range expected {
+		if actual, ok := snapshot.Get(name); !ok || actual != value {
+			t.Errorf("expected %s=%d, got %d (found: %v)", name, value, actual, ok)
+		}
+	}
+}
+
+func Test_Snapshot_UnknownName(t *testing.T) {
+	if _, ok := (&Counters{}).Snapshot().Get("sctpActiveEstabs"); ok {
+		t.Errorf("expected unknown counter to be missing")
+	}
+}
+
+func Test_WritePrometheus_Format(t *testing.T) {
+	counters := &Counters{}
+	counters.UDP.OutDatagrams.Add(7)
+
+	var out strings.Builder
+	if err := WritePrometheus(&out, counters.Snapshot()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := "# HELP netstack_udp_out_datagrams_total UDP datagrams sent from this entity.\n" +
+		"# TYPE netstack_udp_out_datagrams_total counter\n" +
+		"netstack_udp_out_datagrams_total 7\n"
+
+	if !strings.Contains(out.String(), expected) {
+		t.Errorf("expected output to contain:\n%s\ngot:\n%s", expected, out.String())
+	}
+}
+
+func Test_NewHandler_ServesMetrics(t *testing.T) {
+	counters := &Counters{}
+	counters.ICMP.InEchos.Inc()
+
+	recorder := httptest.NewRecorder()
+	NewHandler(counters).ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	if recorder.Code != http.StatusOK || !strings.HasPrefix(recorder.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected response: %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+
+	if !strings.Contains(recorder.Body.String(), "netstack_icmp_in_echos_total 1\n") {
+		t.Errorf("expected echo counter in body, got:\n%s", recorder.Body.String())
+	}
+}
+
+func Test_NewHandler_RejectsPost(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	NewHandler(&Counters{}).ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/metrics", nil))
+
+	if recorder.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405, got %d", recorder.Code)
+	}
+}
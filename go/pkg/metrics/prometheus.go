@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+)
+
+// Source is anything that can produce a snapshot, e.g. a stack's Counters
+type Source interface {
+	Snapshot() Snapshot
+}
+
+// WritePrometheus writes a snapshot in the Prometheus text exposition format
+func WritePrometheus(w io.Writer, snapshot Snapshot) error {
+	buffered := bufio.NewWriter(w)
+
+	for _, sample := range snapshot.Samples {
+		fmt.Fprintf(buffered, "# HELP %s %s\n", sample.PrometheusName, sample.Help)
+		fmt.Fprintf(buffered, "# TYPE %s counter\n", sample.PrometheusName)
+		fmt.Fprintf(buffered, "%s %d\n", sample.PrometheusName, sample.Value)
+	}
+
+	return buffered.Flush()
+}
+
+// NewHandler serves a fresh snapshot from source on every request
+func NewHandler(source Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		if r.Method == http.MethodHead {
+			return
+		}
+
+		_ = WritePrometheus(w, source.Snapshot())
+	})
+}
+
+// Serve serves source at /metrics on listener until it is closed.
+// The listener can be the host's, from net.Listen, or any other net.Listener such as one on the stack itself.
+func Serve(listener net.Listener, source Source) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", NewHandler(source))
+
+	return http.Serve(listener, mux)
+}
@@ -0,0 +1,478 @@
+package stack
+
+import (
+	"iter"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"networking/internal/clock"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+	"networking/pkg/tcp"
+)
+
+// Like Linux's nf_conntrack_max, new flows are dropped once the table is this full
+const conntrackMaxEntries = 65536
+
+// How often expired flows are cleared out of the table, rather than waiting for a lookup to trip over them
+const conntrackSweepInterval = 30 * time.Second
+
+// ConntrackTimeouts says how long a tracked flow can go without a packet before it is forgotten. Zero fields are
+// Linux's defaults.
+type ConntrackTimeouts struct {
+	// UDP is for a flow that has only been seen one way, and UDPStream once there has been a reply
+	UDP       time.Duration
+	UDPStream time.Duration
+	// ICMP is for echo requests and replies
+	ICMP time.Duration
+	// The TCP timeouts go with the state the connection looks to be in
+	TCPSynSent     time.Duration
+	TCPSynReceived time.Duration
+	TCPEstablished time.Duration
+	TCPFinWait     time.Duration
+	TCPTimeWait    time.Duration
+	TCPClose       time.Duration
+	// Generic is for every other protocol
+	Generic time.Duration
+}
+
+// withDefaults fills in Linux's nf_conntrack_*_timeout defaults for unset timeouts
+func (t ConntrackTimeouts) withDefaults() ConntrackTimeouts {
+	defaults := []struct {
+		timeout  *time.Duration
+		fallback time.Duration
+	}{
+		{&t.UDP, 30 * time.Second},
+		{&t.UDPStream, 120 * time.Second},
+		{&t.ICMP, 30 * time.Second},
+		{&t.TCPSynSent, 120 * time.Second},
+		{&t.TCPSynReceived, 60 * time.Second},
+		{&t.TCPEstablished, 5 * 24 * time.Hour},
+		{&t.TCPFinWait, 120 * time.Second},
+		{&t.TCPTimeWait, 120 * time.Second},
+		{&t.TCPClose, 10 * time.Second},
+		{&t.Generic, 600 * time.Second},
+	}
+
+	for _, d := range defaults {
+		if *d.timeout <= 0 {
+			*d.timeout = d.fallback
+		}
+	}
+
+	return t
+}
+
+// conntrackDirection says which way a packet is going relative to the first packet of its flow
+type conntrackDirection int
+
+const (
+	conntrackOriginal conntrackDirection = iota
+	conntrackReply
+)
+
+// conntrackTuple is what tells one flow from another going one way. For ICMP echoes, the identifier stands in for
+// the port of whichever end sent the request.
+type conntrackTuple struct {
+	protocol    uint8
+	source      netip.AddrPort
+	destination netip.AddrPort
+}
+
+// inverse is the tuple of a packet going back the other way
+func (t conntrackTuple) inverse() conntrackTuple {
+	return conntrackTuple{protocol: t.protocol, source: t.destination, destination: t.source}
+}
+
+// conntrackTCPState is a simplified TCP state, only as detailed as picking a timeout needs
+type conntrackTCPState uint8
+
+const (
+	conntrackTCPNone conntrackTCPState = iota
+	conntrackTCPSynSent
+	conntrackTCPSynReceived
+	conntrackTCPEstablished
+	conntrackTCPFinWait
+	conntrackTCPTimeWait
+	conntrackTCPClose
+)
+
+var conntrackTCPStateNames = map[conntrackTCPState]string{
+	conntrackTCPSynSent:     "SYN_SENT",
+	conntrackTCPSynReceived: "SYN_RECV",
+	conntrackTCPEstablished: "ESTABLISHED",
+	conntrackTCPFinWait:     "FIN_WAIT",
+	conntrackTCPTimeWait:    "TIME_WAIT",
+	conntrackTCPClose:       "CLOSE",
+}
+
+// conntrackEntry is one flow. Its reply tuple is its original tuple turned around, unless the flow is translated,
+// in which case the reply goes to the translated source.
+type conntrackEntry struct {
+	tuples [2]conntrackTuple
+
+	// Guarded by the table's lock
+	expires  time.Time
+	replied  bool
+	tcpState conntrackTCPState
+	finSeen  [2]bool
+}
+
+// translated checks if the flow's source is rewritten on the way out, and its replies on the way back in
+func (e *conntrackEntry) translated() bool {
+	return e.tuples[conntrackReply] != e.tuples[conntrackOriginal].inverse()
+}
+
+// conntrackFlow is the flow a packet belongs to, which way in it the packet is going, and the state that puts the
+// packet in. A new packet has no entry yet, and an ICMP error has the entry of the flow it is about.
+type conntrackFlow struct {
+	entry     *conntrackEntry
+	direction conntrackDirection
+	state     FlowState
+}
+
+// conntrackTable follows flows through the stack by both their original and reply tuples, forgetting them once they
+// have gone quiet for their protocol's timeout
+type conntrackTable struct {
+	clock    clock.Clock
+	timeouts ConntrackTimeouts
+
+	mu      sync.Mutex
+	entries map[conntrackTuple]*conntrackEntry
+	sweeper *wheelTimer
+}
+
+func newConntrackTable(c clock.Clock, timers *timerWheel, timeouts ConntrackTimeouts) *conntrackTable {
+	t := &conntrackTable{
+		clock:    c,
+		timeouts: timeouts.withDefaults(),
+		entries:  map[conntrackTuple]*conntrackEntry{},
+	}
+
+	t.sweeper = timers.newTimer(t.sweep)
+
+	return t
+}
+
+// lookup finds the flow a packet with tuple belongs to, and which way it is going
+func (t *conntrackTable) lookup(tuple conntrackTuple) (*conntrackEntry, conntrackDirection, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.isFree(tuple) {
+		return nil, 0, false
+	}
+
+	entry := t.entries[tuple]
+	if entry.tuples[conntrackOriginal] == tuple {
+		return entry, conntrackOriginal, true
+	}
+
+	return entry, conntrackReply, true
+}
+
+// add starts tracking a flow from its first packet, which has tuple original and TCP flags if it is TCP. The reply
+// tuple is the first of replies that no other flow is using, so a translated flow can be offered one port after
+// another. Returns false if the table is full or every reply tuple is taken.
+func (t *conntrackTable) add(original conntrackTuple, flags tcp.Flags, replies iter.Seq[conntrackTuple]) (*conntrackEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if !t.isFree(original) || len(t.entries) >= 2*conntrackMaxEntries {
+		return nil, false
+	}
+
+	for reply := range replies {
+		if !t.isFree(reply) {
+			continue
+		}
+
+		entry := &conntrackEntry{tuples: [2]conntrackTuple{original, reply}}
+		t.entries[original] = entry
+		t.entries[reply] = entry
+		t.refresh(entry, conntrackOriginal, flags)
+
+		if !t.sweeper.isPending() {
+			t.sweeper.reset(conntrackSweepInterval)
+		}
+
+		return entry, true
+	}
+
+	return nil, false
+}
+
+// isFree checks that no live flow has tuple, clearing out an expired one that does. The table's lock must be held.
+func (t *conntrackTable) isFree(tuple conntrackTuple) bool {
+	existing, ok := t.entries[tuple]
+	if !ok {
+		return true
+	}
+
+	if t.clock.Now().Before(existing.expires) {
+		return false
+	}
+
+	t.remove(existing)
+
+	return true
+}
+
+// remove forgets a flow. The table's lock must be held.
+func (t *conntrackTable) remove(entry *conntrackEntry) {
+	for _, tuple := range entry.tuples {
+		if t.entries[tuple] == entry {
+			delete(t.entries, tuple)
+		}
+	}
+}
+
+// sweep clears out every flow that has expired, and keeps sweeping while there are flows left
+func (t *conntrackTable) sweep() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+
+	for _, entry := range t.entries {
+		if !now.Before(entry.expires) {
+			t.remove(entry)
+		}
+	}
+
+	if len(t.entries) > 0 {
+		t.sweeper.reset(conntrackSweepInterval)
+	}
+}
+
+// update moves a flow on for a packet going in direction, with TCP flags if it is TCP, and puts off its expiry by
+// its timeout. Returns whether the flow has now been seen both ways.
+func (t *conntrackTable) update(entry *conntrackEntry, direction conntrackDirection, flags tcp.Flags) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.refresh(entry, direction, flags)
+
+	return entry.replied
+}
+
+// refresh is update with the table's lock held
+func (t *conntrackTable) refresh(entry *conntrackEntry, direction conntrackDirection, flags tcp.Flags) {
+	if direction == conntrackReply {
+		entry.replied = true
+	}
+
+	timeout := t.timeouts.Generic
+
+	switch entry.tuples[conntrackOriginal].protocol {
+	case ipv4.ProtocolUDP:
+		timeout = t.timeouts.UDP
+		if entry.replied {
+			timeout = t.timeouts.UDPStream
+		}
+	case ipv4.ProtocolICMP:
+		timeout = t.timeouts.ICMP
+	case ipv4.ProtocolTCP:
+		entry.updateTCPState(direction, flags)
+		timeout = t.tcpTimeout(entry.tcpState)
+	}
+
+	entry.expires = t.clock.Now().Add(timeout)
+}
+
+// updateTCPState follows the handshake and teardown by their flags alone, like a much looser nf_conntrack_proto_tcp.
+// A flow first seen partway through is taken to be established, as Linux's nf_conntrack_tcp_loose allows.
+func (e *conntrackEntry) updateTCPState(direction conntrackDirection, flags tcp.Flags) {
+	switch {
+	case flags&tcp.FlagRST != 0:
+		e.tcpState = conntrackTCPClose
+	case flags&tcp.FlagSYN != 0 && flags&tcp.FlagACK == 0:
+		if e.tcpState == conntrackTCPNone || e.tcpState == conntrackTCPClose || e.tcpState == conntrackTCPTimeWait {
+			e.tcpState = conntrackTCPSynSent
+			e.finSeen = [2]bool{}
+		}
+	case flags&tcp.FlagSYN != 0:
+		if e.tcpState == conntrackTCPSynSent && direction == conntrackReply {
+			e.tcpState = conntrackTCPSynReceived
+		}
+	case flags&tcp.FlagFIN != 0:
+		e.finSeen[direction] = true
+
+		if e.finSeen[conntrackOriginal] && e.finSeen[conntrackReply] {
+			e.tcpState = conntrackTCPTimeWait
+		} else {
+			e.tcpState = conntrackTCPFinWait
+		}
+	case e.tcpState == conntrackTCPNone || (e.tcpState == conntrackTCPSynReceived && direction == conntrackOriginal):
+		e.tcpState = conntrackTCPEstablished
+	}
+}
+
+func (t *conntrackTable) tcpTimeout(state conntrackTCPState) time.Duration {
+	switch state {
+	case conntrackTCPSynSent:
+		return t.timeouts.TCPSynSent
+	case conntrackTCPSynReceived:
+		return t.timeouts.TCPSynReceived
+	case conntrackTCPFinWait:
+		return t.timeouts.TCPFinWait
+	case conntrackTCPTimeWait:
+		return t.timeouts.TCPTimeWait
+	case conntrackTCPClose:
+		return t.timeouts.TCPClose
+	default:
+		return t.timeouts.TCPEstablished
+	}
+}
+
+// tracking checks if flows have to be followed, which they do for NAT and for the filter
+func (s *Stack) tracking() bool {
+	return s.nat.enabled.Load() || s.filter.active.Load()
+}
+
+// classify finds the flow a packet belongs to and the state that puts it in, moving the flow on. An ICMP error is
+// related to the flow of the packet it quotes, which comes back too. message is the packet's payload in whichever
+// buffer the quote is to be rewritten in. Fragments being forwarded are left untracked, with no state at all, since
+// only those addressed to the stack are reassembled to give the later ones a transport header.
+func (s *Stack) classify(packet *ipv4.Packet, message []byte) (conntrackFlow, packetView) {
+	if packet.IsFragment() {
+		return conntrackFlow{}, packetView{}
+	}
+
+	if related, quoted, ok := s.relatedFlow(packet, message); ok {
+		return related, quoted
+	}
+
+	tuple, ok := packetTuple(packet)
+	if !ok {
+		return conntrackFlow{state: FlowInvalid}, packetView{}
+	}
+
+	entry, direction, ok := s.conntrack.lookup(tuple)
+	if !ok {
+		return conntrackFlow{state: FlowNew}, packetView{}
+	}
+
+	flow := conntrackFlow{entry: entry, direction: direction, state: FlowNew}
+	if s.conntrack.update(entry, direction, tcpFlags(packet)) {
+		flow.state = FlowEstablished
+	}
+
+	return flow, packetView{}
+}
+
+// conntrackOutbound finds the flow a packet the stack is sending belongs to (Linux's OUTPUT)
+func (s *Stack) conntrackOutbound(packet *ipv4.Packet) conntrackFlow {
+	flow, _ := s.classify(packet, packet.Payload)
+
+	return flow
+}
+
+// conntrackConfirm starts following the flow of a new packet the stack is sending or has received, once the filter
+// has let it through. Forwarded flows start in conntrackForward instead, where they can be translated.
+func (s *Stack) conntrackConfirm(packet *ipv4.Packet, flow conntrackFlow) {
+	if flow.state != FlowNew || flow.entry != nil {
+		return
+	}
+
+	if tuple, ok := packetTuple(packet); ok {
+		s.conntrack.add(tuple, tcpFlags(packet), func(yield func(conntrackTuple) bool) { yield(tuple.inverse()) })
+	}
+}
+
+// TrackedFlow is a flow in the connection tracking table, as `conntrack -L` shows it
+type TrackedFlow struct {
+	Protocol uint8
+	// The flow's first packet, and replies to it, as they look on the wire. The reply destination differs from the
+	// original source when the flow is translated.
+	OriginalSource      netip.AddrPort
+	OriginalDestination netip.AddrPort
+	ReplySource         netip.AddrPort
+	ReplyDestination    netip.AddrPort
+	// Replied is set once a packet has been seen going back the other way
+	Replied bool
+	// State is the TCP state the flow looks to be in, and empty for other protocols
+	State string
+	// Expires is how long the flow has left without another packet
+	Expires time.Duration
+}
+
+// TrackedFlows returns every flow the stack is tracking, ordered by protocol and original source
+func (s *Stack) TrackedFlows() []TrackedFlow {
+	t := s.conntrack
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	var flows []TrackedFlow
+
+	for tuple, entry := range t.entries {
+		if tuple != entry.tuples[conntrackOriginal] || !now.Before(entry.expires) {
+			continue
+		}
+
+		original, reply := entry.tuples[conntrackOriginal], entry.tuples[conntrackReply]
+		flows = append(flows, TrackedFlow{
+			Protocol:            original.protocol,
+			OriginalSource:      original.source,
+			OriginalDestination: original.destination,
+			ReplySource:         reply.source,
+			ReplyDestination:    reply.destination,
+			Replied:             entry.replied,
+			State:               conntrackTCPStateNames[entry.tcpState],
+			Expires:             entry.expires.Sub(now),
+		})
+	}
+
+	slices.SortFunc(flows, func(a, b TrackedFlow) int {
+		if a.Protocol != b.Protocol {
+			return int(a.Protocol) - int(b.Protocol)
+		}
+
+		return a.OriginalSource.Compare(b.OriginalSource)
+	})
+
+	return flows
+}
+
+// packetTuple is the tuple of a packet's flow. ICMP errors, fragments and transport headers too short to rewrite
+// have no flow of their own.
+func packetTuple(packet *ipv4.Packet) (conntrackTuple, bool) {
+	if packet.IsFragment() {
+		return conntrackTuple{}, false
+	}
+
+	tuple := conntrackTuple{
+		protocol:    packet.Protocol,
+		source:      netip.AddrPortFrom(packet.Source, 0),
+		destination: netip.AddrPortFrom(packet.Destination, 0),
+	}
+
+	switch packet.Protocol {
+	case ipv4.ProtocolUDP, ipv4.ProtocolTCP:
+		if len(packet.Payload) < transportHeaderLength(packet.Protocol) {
+			return conntrackTuple{}, false
+		}
+
+		tuple.source = netip.AddrPortFrom(packet.Source, uint16(packet.Payload[0])<<8|uint16(packet.Payload[1]))
+		tuple.destination = netip.AddrPortFrom(packet.Destination, uint16(packet.Payload[2])<<8|uint16(packet.Payload[3]))
+	case ipv4.ProtocolICMP:
+		if len(packet.Payload) < icmp.HeaderLength || isICMPError(packet.Payload) {
+			return conntrackTuple{}, false
+		}
+
+		identifier := uint16(packet.Payload[4])<<8 | uint16(packet.Payload[5])
+
+		switch packet.Payload[0] {
+		case icmp.TypeEchoRequest:
+			tuple.source = netip.AddrPortFrom(packet.Source, identifier)
+		case icmp.TypeEchoReply:
+			tuple.destination = netip.AddrPortFrom(packet.Destination, identifier)
+		}
+	}
+
+	return tuple, true
+}
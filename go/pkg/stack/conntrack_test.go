@@ -0,0 +1,149 @@
+package stack
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	"networking/pkg/ipv4"
+	"networking/pkg/tcp"
+)
+
+func newTestConntrack(t *testing.T) (*conntrackTable, *clock.Fake) {
+	t.Helper()
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	wheel := newTimerWheel(clk)
+	t.Cleanup(wheel.close)
+
+	return newConntrackTable(clk, wheel, ConntrackTimeouts{}), clk
+}
+
+func testTuple(protocol uint8, source, destination string) conntrackTuple {
+	return conntrackTuple{
+		protocol:    protocol,
+		source:      netip.MustParseAddrPort(source),
+		destination: netip.MustParseAddrPort(destination),
+	}
+}
+
+func untranslated(tuple conntrackTuple) func(func(conntrackTuple) bool) {
+	return slices.Values([]conntrackTuple{tuple.inverse()})
+}
+
+func Test_Conntrack_UDPLastsLongerOnceReplied(t *testing.T) {
+	table, clk := newTestConntrack(t)
+	tuple := testTuple(ipv4.ProtocolUDP, "10.0.1.9:5000", "10.0.2.9:53")
+
+	table.add(tuple, 0, untranslated(tuple))
+	clk.Advance(29 * time.Second)
+
+	if _, _, ok := table.lookup(tuple); !ok {
+		t.Fatalf("expected the flow to still be tracked")
+	}
+
+	clk.Advance(2 * time.Second)
+
+	if _, _, ok := table.lookup(tuple); ok {
+		t.Fatalf("expected an unreplied flow to be forgotten after 30 seconds")
+	}
+
+	entry, _ := table.add(tuple, 0, untranslated(tuple))
+
+	entry, direction, ok := table.lookup(tuple.inverse())
+	if !ok || direction != conntrackReply {
+		t.Fatalf("expected the reply to be found going the other way")
+	}
+
+	table.update(entry, direction, 0)
+	clk.Advance(119 * time.Second)
+
+	if _, _, ok := table.lookup(tuple); !ok {
+		t.Fatalf("expected a replied flow to last 120 seconds")
+	}
+}
+
+func Test_Conntrack_FollowsTheTCPHandshakeAndTeardown(t *testing.T) {
+	table, _ := newTestConntrack(t)
+	tuple := testTuple(ipv4.ProtocolTCP, "10.0.1.9:40000", "10.0.2.9:80")
+
+	entry, _ := table.add(tuple, tcp.FlagSYN, untranslated(tuple))
+
+	steps := []struct {
+		direction conntrackDirection
+		flags     tcp.Flags
+		expected  conntrackTCPState
+		timeout   time.Duration
+	}{
+		{conntrackReply, tcp.FlagSYN | tcp.FlagACK, conntrackTCPSynReceived, 60 * time.Second},
+		{conntrackOriginal, tcp.FlagACK, conntrackTCPEstablished, 5 * 24 * time.Hour},
+		{conntrackOriginal, tcp.FlagFIN | tcp.FlagACK, conntrackTCPFinWait, 120 * time.Second},
+		{conntrackReply, tcp.FlagFIN | tcp.FlagACK, conntrackTCPTimeWait, 120 * time.Second},
+		{conntrackOriginal, tcp.FlagRST, conntrackTCPClose, 10 * time.Second},
+		{conntrackOriginal, tcp.FlagSYN, conntrackTCPSynSent, 120 * time.Second},
+	}
+
+	for i, step := range steps {
+		table.update(entry, step.direction, step.flags)
+
+		if entry.tcpState != step.expected || entry.expires.Sub(table.clock.Now()) != step.timeout {
+			t.Errorf("step %d: expected %s for %s, got %s for %s", i, conntrackTCPStateNames[step.expected], step.timeout,
+				conntrackTCPStateNames[entry.tcpState], entry.expires.Sub(table.clock.Now()))
+		}
+	}
+}
+
+func Test_Conntrack_PicksUpAConnectionPartwayThrough(t *testing.T) {
+	table, _ := newTestConntrack(t)
+	tuple := testTuple(ipv4.ProtocolTCP, "10.0.1.9:40000", "10.0.2.9:80")
+
+	entry, _ := table.add(tuple, tcp.FlagACK, untranslated(tuple))
+
+	if entry.tcpState != conntrackTCPEstablished {
+		t.Errorf("expected a flow first seen with a bare ACK to be established, got %s", conntrackTCPStateNames[entry.tcpState])
+	}
+}
+
+func Test_Conntrack_TakesTheFirstFreeReply(t *testing.T) {
+	table, _ := newTestConntrack(t)
+
+	first := testTuple(ipv4.ProtocolUDP, "10.0.1.9:5000", "10.0.2.9:53")
+	second := testTuple(ipv4.ProtocolUDP, "10.0.1.8:5000", "10.0.2.9:53")
+	candidates := func(original conntrackTuple) func(func(conntrackTuple) bool) {
+		return func(yield func(conntrackTuple) bool) {
+			for _, port := range []uint16{5000, 5001} {
+				reply := original.inverse()
+				reply.destination = netip.AddrPortFrom(netip.MustParseAddr("10.0.2.1"), port)
+
+				if !yield(reply) {
+					return
+				}
+			}
+		}
+	}
+
+	table.add(first, 0, candidates(first))
+	entry, ok := table.add(second, 0, candidates(second))
+
+	if !ok || entry.tuples[conntrackReply].destination.Port() != 5001 || !entry.translated() {
+		t.Fatalf("expected the second flow to be moved to the next port, got %+v", entry)
+	}
+
+	if _, ok := table.add(testTuple(ipv4.ProtocolUDP, "10.0.1.7:5000", "10.0.2.9:53"), 0, candidates(second)); ok {
+		t.Errorf("expected a flow to be refused once every reply is taken")
+	}
+}
+
+func Test_Conntrack_SweepsExpiredFlows(t *testing.T) {
+	table, clk := newTestConntrack(t)
+	tuple := testTuple(ipv4.ProtocolICMP, "10.0.1.9:7", "10.0.2.9:0")
+
+	table.add(tuple, 0, untranslated(tuple))
+	clk.Advance(conntrackSweepInterval)
+
+	if len(table.entries) != 0 || table.sweeper.isPending() {
+		t.Errorf("expected the expired flow swept away and the sweeper to stop, %d entries left", len(table.entries))
+	}
+}
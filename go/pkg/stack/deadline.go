@@ -0,0 +1,62 @@
+package stack
+
+import (
+	"sync"
+	"time"
+)
+
+// deadline implements the net.Conn deadline semantics: a channel that is closed once the deadline passes,
+// and that blocked operations select on. Setting a new deadline wakes nobody up unless it has already passed.
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+func newDeadline() *deadline {
+	return &deadline{
+		expired: make(chan struct{}),
+	}
+}
+
+// set moves the deadline. The zero time means no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The old timer already fired and closed the channel, so start a fresh one
+		d.expired = make(chan struct{})
+	}
+
+	d.timer = nil
+
+	select {
+	case <-d.expired:
+		d.expired = make(chan struct{})
+	default:
+	}
+
+	if t.IsZero() {
+		return
+	}
+
+	wait := time.Until(t)
+	if wait <= 0 {
+		close(d.expired)
+		return
+	}
+
+	expired := d.expired
+	d.timer = time.AfterFunc(wait, func() {
+		close(expired)
+	})
+}
+
+// wait returns a channel that is closed when the current deadline passes
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.expired
+}
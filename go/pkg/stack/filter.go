@@ -0,0 +1,508 @@
+package stack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"networking/internal/trace"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+	"networking/pkg/tcp"
+	"networking/pkg/udp"
+)
+
+// FilterChain is where in the stack a filter rule is checked, like iptables' chains of the same names
+type FilterChain uint8
+
+const (
+	// FilterInput is for packets addressed to the stack
+	FilterInput FilterChain = iota
+	// FilterOutput is for packets the stack sends
+	FilterOutput
+	// FilterForward is for packets the stack routes on to somewhere else
+	FilterForward
+
+	filterChains
+)
+
+var filterChainNames = [filterChains]string{"input", "output", "forward"}
+
+func (c FilterChain) String() string {
+	if c >= filterChains {
+		return fmt.Sprintf("chain(%d)", uint8(c))
+	}
+
+	return filterChainNames[c]
+}
+
+// FilterAction is what happens to a packet a filter rule matches
+type FilterAction uint8
+
+const (
+	FilterAccept FilterAction = iota
+	FilterDrop
+	// FilterReject drops the packet and tells its sender, as the rule's RejectWith says
+	FilterReject
+)
+
+var filterActionNames = []string{"accept", "drop", "reject"}
+
+func (a FilterAction) String() string {
+	if int(a) >= len(filterActionNames) {
+		return fmt.Sprintf("action(%d)", uint8(a))
+	}
+
+	return filterActionNames[a]
+}
+
+// FilterRejection is how a rejected packet's sender is told, named like iptables' --reject-with
+type FilterRejection uint8
+
+const (
+	RejectPortUnreachable FilterRejection = iota
+	RejectNetUnreachable
+	RejectHostUnreachable
+	RejectProtocolUnreachable
+	RejectAdministrativelyProhibited
+	// RejectTCPReset answers with a TCP reset, as if nothing were listening
+	RejectTCPReset
+)
+
+var filterRejections = []struct {
+	name string
+	code uint8
+}{
+	RejectPortUnreachable:            {"icmp-port-unreachable", icmp.CodePortUnreachable},
+	RejectNetUnreachable:             {"icmp-net-unreachable", icmp.CodeNetUnreachable},
+	RejectHostUnreachable:            {"icmp-host-unreachable", icmp.CodeHostUnreachable},
+	RejectProtocolUnreachable:        {"icmp-proto-unreachable", icmp.CodeProtocolUnreachable},
+	RejectAdministrativelyProhibited: {"icmp-admin-prohibited", icmp.CodeAdministrativelyProhibited},
+	RejectTCPReset:                   {"tcp-reset", 0},
+}
+
+func (r FilterRejection) String() string {
+	if int(r) >= len(filterRejections) {
+		return fmt.Sprintf("rejection(%d)", uint8(r))
+	}
+
+	return filterRejections[r].name
+}
+
+// FlowState is the connection tracking state of a packet, like iptables' --ctstate. Rules match any of a set of
+// them.
+type FlowState uint8
+
+const (
+	// FlowNew is a packet starting a flow, or going the original way in one that has had no reply yet
+	FlowNew FlowState = 1 << iota
+	// FlowEstablished is a packet in a flow that has been seen going both ways
+	FlowEstablished
+	// FlowRelated is an ICMP error about a tracked flow. These are let through without checking any rules.
+	FlowRelated
+	// FlowInvalid is a packet that cannot be tracked, like an ICMP error about no flow or a truncated header
+	FlowInvalid
+
+	flowStatesMask = FlowNew | FlowEstablished | FlowRelated | FlowInvalid
+)
+
+var flowStateNames = []struct {
+	state FlowState
+	name  string
+}{
+	{FlowNew, "new"},
+	{FlowEstablished, "established"},
+	{FlowRelated, "related"},
+	{FlowInvalid, "invalid"},
+}
+
+func (f FlowState) String() string {
+	names := []string{}
+
+	for _, stateName := range flowStateNames {
+		if f&stateName.state != 0 {
+			names = append(names, stateName.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, ",")
+}
+
+// PortRange is the ports from First to Last inclusive. The zero value matches every port.
+type PortRange struct {
+	First uint16
+	Last  uint16
+}
+
+func (r PortRange) isAny() bool {
+	return r == PortRange{}
+}
+
+func (r PortRange) contains(port uint16) bool {
+	return r.isAny() || (port >= r.First && port <= r.Last)
+}
+
+func (r PortRange) String() string {
+	if r.First == r.Last {
+		return fmt.Sprint(r.First)
+	}
+
+	return fmt.Sprintf("%d-%d", r.First, r.Last)
+}
+
+var (
+	ErrInvalidFilterRule = errors.New("invalid filter rule")
+	// ErrFiltered is returned for a packet the output chain would not let the stack send
+	ErrFiltered = errors.New("packet filtered")
+)
+
+// FilterRule matches packets by where they are going and what is in their headers. Unset fields match everything;
+// a packet has to match all the set ones.
+type FilterRule struct {
+	Chain FilterChain
+	// InInterface and OutInterface are the names of the interfaces the packet arrived on and is leaving by. Input
+	// packets have no out interface, and output packets no in interface.
+	InInterface  string
+	OutInterface string
+	Source       netip.Prefix
+	Destination  netip.Prefix
+	// Protocol is the IP protocol number, with zero matching any
+	Protocol uint8
+	// Ports and flags need Protocol to be UDP or TCP, and TCP for flags. They only match packets whose transport
+	// header is there to check, so never later fragments. Fragments addressed to the stack are reassembled before
+	// the input chain sees them.
+	SourcePorts      PortRange
+	DestinationPorts PortRange
+	// TCPFlags are the flags that have to be set out of the ones in TCPFlagsMask, so SYN out of SYN|ACK matches
+	// only the first segment of a connection
+	TCPFlags     tcp.Flags
+	TCPFlagsMask tcp.Flags
+	// States are the connection tracking states the packet can be in, with zero matching any. A fragment is in no
+	// state, so never matches a rule that has some.
+	States FlowState
+
+	Action     FilterAction
+	RejectWith FilterRejection
+}
+
+// validate checks the rule makes sense for its chain and protocol, as iptables does
+func (r FilterRule) validate() error {
+	switch {
+	case r.Chain >= filterChains:
+		return fmt.Errorf("%w: unknown chain %d", ErrInvalidFilterRule, r.Chain)
+	case r.Chain == FilterInput && r.OutInterface != "":
+		return fmt.Errorf("%w: input packets have no out interface", ErrInvalidFilterRule)
+	case r.Chain == FilterOutput && r.InInterface != "":
+		return fmt.Errorf("%w: output packets have no in interface", ErrInvalidFilterRule)
+	case (r.Source.IsValid() && !r.Source.Addr().Is4()) || (r.Destination.IsValid() && !r.Destination.Addr().Is4()):
+		return fmt.Errorf("%w: addresses must be IPv4", ErrInvalidFilterRule)
+	case (!r.SourcePorts.isAny() || !r.DestinationPorts.isAny()) && r.Protocol != ipv4.ProtocolUDP && r.Protocol != ipv4.ProtocolTCP:
+		return fmt.Errorf("%w: ports need the protocol to be udp or tcp", ErrInvalidFilterRule)
+	case r.SourcePorts.First > r.SourcePorts.Last || r.DestinationPorts.First > r.DestinationPorts.Last:
+		return fmt.Errorf("%w: port ranges must run from low to high", ErrInvalidFilterRule)
+	case r.TCPFlagsMask != 0 && r.Protocol != ipv4.ProtocolTCP:
+		return fmt.Errorf("%w: flags need the protocol to be tcp", ErrInvalidFilterRule)
+	case r.TCPFlags&^r.TCPFlagsMask != 0:
+		return fmt.Errorf("%w: flags %s are not in the mask %s", ErrInvalidFilterRule, r.TCPFlags, r.TCPFlagsMask)
+	case r.States&^flowStatesMask != 0:
+		return fmt.Errorf("%w: unknown state %#x", ErrInvalidFilterRule, uint8(r.States))
+	case int(r.Action) >= len(filterActionNames) || int(r.RejectWith) >= len(filterRejections):
+		return fmt.Errorf("%w: unknown action", ErrInvalidFilterRule)
+	case r.Action == FilterReject && r.RejectWith == RejectTCPReset && r.Protocol != ipv4.ProtocolTCP:
+		return fmt.Errorf("%w: only tcp can be rejected with a reset", ErrInvalidFilterRule)
+	}
+
+	return nil
+}
+
+// filterPacket is what rules match against
+type filterPacket struct {
+	*ipv4.Packet
+	in, out *Interface
+	state   FlowState
+
+	// Set if the transport header is there to match on
+	hasPorts        bool
+	sourcePort      uint16
+	destinationPort uint16
+	tcpFlags        tcp.Flags
+	hasTCPFlags     bool
+}
+
+func newFilterPacket(packet *ipv4.Packet, in, out *Interface, state FlowState) filterPacket {
+	p := filterPacket{Packet: packet, in: in, out: out, state: state}
+
+	if packet.FragmentOffset != 0 {
+		return p
+	}
+
+	switch {
+	case packet.Protocol == ipv4.ProtocolTCP && len(packet.Payload) >= tcp.MinHeaderLength:
+		p.tcpFlags = tcp.Flags(packet.Payload[tcpFlagsOffset])
+		p.hasTCPFlags = true
+
+		fallthrough
+	case packet.Protocol == ipv4.ProtocolUDP && len(packet.Payload) >= udp.HeaderLength:
+		p.sourcePort = binary.BigEndian.Uint16(packet.Payload[0:2])
+		p.destinationPort = binary.BigEndian.Uint16(packet.Payload[2:4])
+		p.hasPorts = true
+	}
+
+	return p
+}
+
+func interfaceName(nic *Interface) string {
+	if nic == nil {
+		return ""
+	}
+
+	return nic.Name
+}
+
+func (r *FilterRule) matches(p filterPacket) bool {
+	switch {
+	case r.InInterface != "" && r.InInterface != interfaceName(p.in):
+		return false
+	case r.OutInterface != "" && r.OutInterface != interfaceName(p.out):
+		return false
+	case r.Source.IsValid() && !r.Source.Contains(p.Source):
+		return false
+	case r.Destination.IsValid() && !r.Destination.Contains(p.Destination):
+		return false
+	case r.Protocol != 0 && r.Protocol != p.Protocol:
+		return false
+	}
+
+	if !r.SourcePorts.isAny() || !r.DestinationPorts.isAny() {
+		if !p.hasPorts || !r.SourcePorts.contains(p.sourcePort) || !r.DestinationPorts.contains(p.destinationPort) {
+			return false
+		}
+	}
+
+	if r.TCPFlagsMask != 0 && (!p.hasTCPFlags || p.tcpFlags&r.TCPFlagsMask != r.TCPFlags) {
+		return false
+	}
+
+	return r.States == 0 || r.States&p.state != 0
+}
+
+// filterRule is a rule with how much it has matched
+type filterRule struct {
+	FilterRule
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+type filterChain struct {
+	policy FilterAction
+	rules  []*filterRule
+
+	// Packets that matched no rule and got the policy
+	packets atomic.Uint64
+	bytes   atomic.Uint64
+}
+
+// filterTable is the packet filter's chains. A chain's rules are checked in order, and the first match decides.
+type filterTable struct {
+	mu     sync.RWMutex
+	chains [filterChains]*filterChain
+
+	// Set while there is anything to check, so an empty filter costs nothing
+	active atomic.Bool
+}
+
+func newFilterTable() *filterTable {
+	t := &filterTable{}
+	for i := range t.chains {
+		t.chains[i] = &filterChain{}
+	}
+
+	return t
+}
+
+// updateActive works out if any chain could turn a packet away. The table's lock must be held.
+func (t *filterTable) updateActive() {
+	active := false
+	for _, chain := range t.chains {
+		active = active || len(chain.rules) > 0 || chain.policy != FilterAccept
+	}
+
+	t.active.Store(active)
+}
+
+// verdict runs a packet through chain, counting it against whichever rule or policy decides it
+func (t *filterTable) verdict(chain FilterChain, p filterPacket) (FilterAction, *FilterRule) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	c := t.chains[chain]
+
+	for _, rule := range c.rules {
+		if rule.matches(p) {
+			rule.packets.Add(1)
+			rule.bytes.Add(uint64(p.TotalLength))
+
+			return rule.Action, &rule.FilterRule
+		}
+	}
+
+	c.packets.Add(1)
+	c.bytes.Add(uint64(p.TotalLength))
+
+	return c.policy, nil
+}
+
+// AddFilterRule adds a rule to the end of its chain
+func (s *Stack) AddFilterRule(rule FilterRule) error {
+	if err := rule.validate(); err != nil {
+		return err
+	}
+
+	s.filter.mu.Lock()
+	defer s.filter.mu.Unlock()
+
+	chain := s.filter.chains[rule.Chain]
+	chain.rules = append(chain.rules, &filterRule{FilterRule: rule})
+	s.filter.updateActive()
+
+	return nil
+}
+
+// SetFilterPolicy sets what happens to packets that match none of chain's rules. Only accept and drop make sense,
+// as for iptables.
+func (s *Stack) SetFilterPolicy(chain FilterChain, policy FilterAction) error {
+	if chain >= filterChains {
+		return fmt.Errorf("%w: unknown chain %d", ErrInvalidFilterRule, chain)
+	}
+
+	if policy != FilterAccept && policy != FilterDrop {
+		return fmt.Errorf("%w: a policy can only accept or drop", ErrInvalidFilterRule)
+	}
+
+	s.filter.mu.Lock()
+	defer s.filter.mu.Unlock()
+
+	s.filter.chains[chain].policy = policy
+	s.filter.updateActive()
+
+	return nil
+}
+
+// FlushFilterRules removes every rule from every chain, leaving the policies as they are
+func (s *Stack) FlushFilterRules() {
+	s.filter.mu.Lock()
+	defer s.filter.mu.Unlock()
+
+	for _, chain := range s.filter.chains {
+		chain.rules = nil
+	}
+
+	s.filter.updateActive()
+}
+
+// FilterRuleStats is a rule and how many packets and bytes it has matched
+type FilterRuleStats struct {
+	FilterRule
+	Packets uint64
+	Bytes   uint64
+}
+
+// FilterChainStats is a chain's policy and rules, with how many packets and bytes fell through to the policy
+type FilterChainStats struct {
+	Chain   FilterChain
+	Policy  FilterAction
+	Packets uint64
+	Bytes   uint64
+	Rules   []FilterRuleStats
+}
+
+// FilterChains returns every chain with its rules in order, like `iptables -L -v`
+func (s *Stack) FilterChains() []FilterChainStats {
+	s.filter.mu.RLock()
+	defer s.filter.mu.RUnlock()
+
+	chains := make([]FilterChainStats, filterChains)
+
+	for i, chain := range s.filter.chains {
+		chains[i] = FilterChainStats{
+			Chain:   FilterChain(i),
+			Policy:  chain.policy,
+			Packets: chain.packets.Load(),
+			Bytes:   chain.bytes.Load(),
+		}
+
+		for _, rule := range chain.rules {
+			chains[i].Rules = append(chains[i].Rules, FilterRuleStats{
+				FilterRule: rule.FilterRule,
+				Packets:    rule.packets.Load(),
+				Bytes:      rule.bytes.Load(),
+			})
+		}
+	}
+
+	return chains
+}
+
+// filterIPv4 runs a packet through chain, answering it if it is rejected. in is the interface it arrived on and
+// out the one it is leaving by, whichever the chain has, and state is its connection tracking state. Returns nil if
+// the packet can go on.
+func (s *Stack) filterIPv4(ctx context.Context, chain FilterChain, in, out *Interface, packet *ipv4.Packet, state FlowState) error {
+	// ICMP errors about flows the filter let through are let through too, so they can be told about problems
+	if !s.filter.active.Load() || state == FlowRelated {
+		return nil
+	}
+
+	action, rule := s.filter.verdict(chain, newFilterPacket(packet, in, out, state))
+	if action == FilterAccept {
+		return nil
+	}
+
+	matched := "policy"
+	if rule != nil {
+		matched = rule.String()
+	}
+
+	trace.Annotate(ctx, trace.Dropped, "packet filtered", "chain", chain.String(), "action", action.String(), "rule", matched,
+		"src_ip", packet.Source.String(), "dst_ip", packet.Destination.String(), "proto", packet.Protocol)
+
+	// The stack's own packets are turned back with an error rather than a message to itself
+	if action == FilterReject && chain != FilterOutput {
+		s.reject(ctx, in, packet, rule.RejectWith)
+	}
+
+	return fmt.Errorf("%w: %s by %s %s", ErrFiltered, action, chain, matched)
+}
+
+// reject tells the sender of a filtered packet it was turned away
+func (s *Stack) reject(ctx context.Context, in *Interface, packet *ipv4.Packet, rejection FilterRejection) {
+	if rejection != RejectTCPReset {
+		s.sendICMPError(ctx, in, packet, icmp.TypeDestinationUnreachable, filterRejections[rejection].code)
+		return
+	}
+
+	if packet.IsFragment() {
+		return
+	}
+
+	segment, err := tcp.ParseRawSegment(ctx, packet.Payload, packet.Source, packet.Destination)
+	if err != nil {
+		return
+	}
+
+	// The reset comes from where the packet was going, as if nothing were listening there
+	id := tcpConnectionID{
+		local:  netip.AddrPortFrom(packet.Destination, segment.DestinationPort),
+		remote: netip.AddrPortFrom(packet.Source, segment.SourcePort),
+	}
+
+	s.sendTCPReset(ctx, id, segment)
+}
@@ -0,0 +1,394 @@
+package stack
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+
+	"networking/pkg/ipv4"
+	"networking/pkg/tcp"
+)
+
+// The rule file has one rule or policy per line, with # starting a comment:
+//
+//	policy input drop
+//	input in eth0 proto tcp dport 22 accept
+//	input from 10.0.0.0/8 proto udp dport 1000-2000 reject with icmp-admin-prohibited
+//	forward out eth1 proto tcp flags SYN/SYN|ACK reject with tcp-reset
+//	output to 192.0.2.1 drop
+//	forward state established,related accept
+//
+// A rule is its chain, then any of in, out, from, to, proto, sport, dport, flags and state with their values, then
+// its action. Rules go on the end of their chain in the order they are in the file.
+
+var filterProtocolNames = map[uint8]string{
+	ipv4.ProtocolICMP: "icmp",
+	ipv4.ProtocolTCP:  "tcp",
+	ipv4.ProtocolUDP:  "udp",
+}
+
+// LoadFilterRules replaces every chain's rules and policy with the ones in a rule file. Chains without a policy line
+// accept. Nothing changes if the file has a mistake in it.
+func (s *Stack) LoadFilterRules(r io.Reader) error {
+	policies, rules, err := parseFilterRules(r)
+	if err != nil {
+		return err
+	}
+
+	s.filter.mu.Lock()
+	defer s.filter.mu.Unlock()
+
+	for i := range s.filter.chains {
+		s.filter.chains[i] = &filterChain{policy: policies[i]}
+	}
+
+	for _, rule := range rules {
+		chain := s.filter.chains[rule.Chain]
+		chain.rules = append(chain.rules, &filterRule{FilterRule: rule})
+	}
+
+	s.filter.updateActive()
+
+	return nil
+}
+
+func parseFilterRules(r io.Reader) ([filterChains]FilterAction, []FilterRule, error) {
+	var policies [filterChains]FilterAction
+	var rules []FilterRule
+
+	scanner := bufio.NewScanner(r)
+
+	for number := 1; scanner.Scan(); number++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		if fields[0] != "policy" {
+			rule, err := parseFilterRuleFields(fields)
+			if err != nil {
+				return policies, nil, fmt.Errorf("line %d: %w", number, err)
+			}
+
+			rules = append(rules, rule)
+
+			continue
+		}
+
+		chain, policy, err := parseFilterPolicy(fields[1:])
+		if err != nil {
+			return policies, nil, fmt.Errorf("line %d: %w", number, err)
+		}
+
+		policies[chain] = policy
+	}
+
+	if err := scanner.Err(); err != nil {
+		return policies, nil, err
+	}
+
+	return policies, rules, nil
+}
+
+func parseFilterPolicy(fields []string) (FilterChain, FilterAction, error) {
+	if len(fields) != 2 {
+		return 0, 0, fmt.Errorf("%w: expected policy <chain> accept|drop", ErrInvalidFilterRule)
+	}
+
+	chain, err := parseFilterChain(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	switch fields[1] {
+	case "accept":
+		return chain, FilterAccept, nil
+	case "drop":
+		return chain, FilterDrop, nil
+	default:
+		return 0, 0, fmt.Errorf("%w: a policy can only accept or drop, not %q", ErrInvalidFilterRule, fields[1])
+	}
+}
+
+// ParseFilterRule parses a rule as it would be written in a rule file
+func ParseFilterRule(line string) (FilterRule, error) {
+	return parseFilterRuleFields(strings.Fields(line))
+}
+
+func parseFilterRuleFields(fields []string) (FilterRule, error) {
+	var rule FilterRule
+
+	if len(fields) == 0 {
+		return rule, fmt.Errorf("%w: empty rule", ErrInvalidFilterRule)
+	}
+
+	chain, err := parseFilterChain(fields[0])
+	if err != nil {
+		return rule, err
+	}
+
+	rule.Chain = chain
+	fields = fields[1:]
+
+	for len(fields) > 0 {
+		keyword := fields[0]
+
+		switch keyword {
+		case "accept", "drop":
+			rule.Action = FilterAccept
+			if keyword == "drop" {
+				rule.Action = FilterDrop
+			}
+
+			fields = fields[1:]
+		case "reject":
+			rule.Action = FilterReject
+			fields = fields[1:]
+
+			if len(fields) >= 2 && fields[0] == "with" {
+				rejection, err := parseFilterRejection(fields[1])
+				if err != nil {
+					return rule, err
+				}
+
+				rule.RejectWith = rejection
+				fields = fields[2:]
+			}
+		default:
+			if len(fields) < 2 {
+				return rule, fmt.Errorf("%w: %q needs a value", ErrInvalidFilterRule, keyword)
+			}
+
+			if err := rule.setField(keyword, fields[1]); err != nil {
+				return rule, err
+			}
+
+			fields = fields[2:]
+
+			continue
+		}
+
+		// The action is last
+		if len(fields) > 0 {
+			return rule, fmt.Errorf("%w: unexpected %q after the action", ErrInvalidFilterRule, fields[0])
+		}
+
+		return rule, rule.validate()
+	}
+
+	return rule, fmt.Errorf("%w: no action", ErrInvalidFilterRule)
+}
+
+func parseFilterChain(name string) (FilterChain, error) {
+	i := slices.Index(filterChainNames[:], name)
+	if i < 0 {
+		return 0, fmt.Errorf("%w: unknown chain %q", ErrInvalidFilterRule, name)
+	}
+
+	return FilterChain(i), nil
+}
+
+func parseFilterRejection(name string) (FilterRejection, error) {
+	for i, rejection := range filterRejections {
+		if rejection.name == name {
+			return FilterRejection(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: unknown rejection %q", ErrInvalidFilterRule, name)
+}
+
+// setField sets the match that keyword names from its value
+func (r *FilterRule) setField(keyword, value string) error {
+	var err error
+
+	switch keyword {
+	case "in":
+		r.InInterface = value
+	case "out":
+		r.OutInterface = value
+	case "from":
+		r.Source, err = parseFilterPrefix(value)
+	case "to":
+		r.Destination, err = parseFilterPrefix(value)
+	case "proto":
+		r.Protocol, err = parseFilterProtocol(value)
+	case "sport":
+		r.SourcePorts, err = parsePortRange(value)
+	case "dport":
+		r.DestinationPorts, err = parsePortRange(value)
+	case "flags":
+		r.TCPFlags, r.TCPFlagsMask, err = parseFilterFlags(value)
+	case "state":
+		r.States, err = parseFilterStates(value)
+	default:
+		return fmt.Errorf("%w: unknown keyword %q", ErrInvalidFilterRule, keyword)
+	}
+
+	if err != nil {
+		return fmt.Errorf("%w: %s %s: %w", ErrInvalidFilterRule, keyword, value, err)
+	}
+
+	return nil
+}
+
+// parseFilterPrefix takes a prefix, or an address on its own for just that address
+func parseFilterPrefix(value string) (netip.Prefix, error) {
+	if !strings.Contains(value, "/") {
+		address, err := netip.ParseAddr(value)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+
+		return netip.PrefixFrom(address, address.BitLen()), nil
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+
+	return prefix.Masked(), err
+}
+
+func parseFilterProtocol(value string) (uint8, error) {
+	for protocol, name := range filterProtocolNames {
+		if name == value {
+			return protocol, nil
+		}
+	}
+
+	protocol, err := strconv.ParseUint(value, 10, 8)
+	if err == nil && protocol == 0 {
+		err = fmt.Errorf("protocol 0 is not a protocol")
+	}
+
+	return uint8(protocol), err
+}
+
+func parsePortRange(value string) (PortRange, error) {
+	first, last, isRange := strings.Cut(value, "-")
+
+	low, err := strconv.ParseUint(first, 10, 16)
+	if err != nil {
+		return PortRange{}, err
+	}
+
+	high := low
+	if isRange {
+		if high, err = strconv.ParseUint(last, 10, 16); err != nil {
+			return PortRange{}, err
+		}
+	}
+
+	if high == 0 {
+		return PortRange{}, fmt.Errorf("port 0 is not a port")
+	}
+
+	return PortRange{First: uint16(low), Last: uint16(high)}, nil
+}
+
+// parseFilterFlags takes flags/mask, like pf, or flags on their own to be their own mask
+func parseFilterFlags(value string) (tcp.Flags, tcp.Flags, error) {
+	set, of, hasMask := strings.Cut(value, "/")
+
+	flags, err := tcp.ParseFlags(set)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mask := flags
+	if hasMask {
+		if mask, err = tcp.ParseFlags(of); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if mask == 0 {
+		return 0, 0, fmt.Errorf("no flags to check")
+	}
+
+	return flags, mask, nil
+}
+
+// parseFilterStates takes state names joined by commas
+func parseFilterStates(value string) (FlowState, error) {
+	var states FlowState
+
+	for name := range strings.SplitSeq(value, ",") {
+		known := false
+
+		for _, stateName := range flowStateNames {
+			if stateName.name == name {
+				states |= stateName.state
+				known = true
+			}
+		}
+
+		if !known {
+			return 0, fmt.Errorf("unknown state %q", name)
+		}
+	}
+
+	return states, nil
+}
+
+// String writes the rule as it would be in a rule file
+func (r FilterRule) String() string {
+	fields := []string{r.Chain.String()}
+
+	add := func(keyword, value string) {
+		fields = append(fields, keyword, value)
+	}
+
+	if r.InInterface != "" {
+		add("in", r.InInterface)
+	}
+
+	if r.OutInterface != "" {
+		add("out", r.OutInterface)
+	}
+
+	for _, match := range []struct {
+		keyword string
+		prefix  netip.Prefix
+	}{{"from", r.Source}, {"to", r.Destination}} {
+		if match.prefix.IsSingleIP() {
+			add(match.keyword, match.prefix.Addr().String())
+		} else if match.prefix.IsValid() {
+			add(match.keyword, match.prefix.String())
+		}
+	}
+
+	if name, ok := filterProtocolNames[r.Protocol]; ok {
+		add("proto", name)
+	} else if r.Protocol != 0 {
+		add("proto", strconv.Itoa(int(r.Protocol)))
+	}
+
+	if !r.SourcePorts.isAny() {
+		add("sport", r.SourcePorts.String())
+	}
+
+	if !r.DestinationPorts.isAny() {
+		add("dport", r.DestinationPorts.String())
+	}
+
+	if r.TCPFlagsMask != 0 {
+		add("flags", r.TCPFlags.String()+"/"+r.TCPFlagsMask.String())
+	}
+
+	if r.States != 0 {
+		add("state", r.States.String())
+	}
+
+	fields = append(fields, r.Action.String())
+	if r.Action == FilterReject {
+		fields = append(fields, "with", r.RejectWith.String())
+	}
+
+	return strings.Join(fields, " ")
+}
@@ -0,0 +1,340 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+	"networking/pkg/link"
+	"networking/pkg/tcp"
+)
+
+func Test_ParseFilterRule_RoundTrips(t *testing.T) {
+	rules := []string{
+		"input accept",
+		"input in r0 proto tcp dport 22 accept",
+		"input from 10.0.0.0/8 proto udp sport 53 dport 1000-2000 reject with icmp-admin-prohibited",
+		"forward in r0 out r1 to 10.0.2.9 proto tcp flags SYN/ACK|SYN reject with tcp-reset",
+		"output to 192.0.2.0/24 proto 47 drop",
+		"forward proto icmp reject with icmp-port-unreachable",
+		"forward in r1 state established,related accept",
+		"input proto tcp dport 22 state new,invalid drop",
+	}
+
+	for _, line := range rules {
+		rule, err := ParseFilterRule(line)
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		again, err := ParseFilterRule(rule.String())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		if again != rule {
+			t.Errorf("%q came back as %q", line, rule.String())
+		}
+	}
+
+	rule, _ := ParseFilterRule("forward to 10.0.2.9 proto tcp flags SYN/SYN|ACK reject with tcp-reset")
+	if rule.Destination != netip.MustParsePrefix("10.0.2.9/32") || rule.TCPFlags != tcp.FlagSYN ||
+		rule.TCPFlagsMask != tcp.FlagSYN|tcp.FlagACK || rule.RejectWith != RejectTCPReset {
+		t.Errorf("unexpected rule %+v", rule)
+	}
+}
+
+func Test_ParseFilterRule_Mistakes(t *testing.T) {
+	mistakes := []string{
+		"",
+		"prerouting accept",
+		"input proto tcp dport 22",
+		"input dport 22 accept",
+		"input proto udp flags SYN drop",
+		"input proto tcp dport 2000-1000 drop",
+		"input proto tcp dport 0 drop",
+		"input proto tcp flags SYN/ACK drop",
+		"input out r1 drop",
+		"output in r0 drop",
+		"input proto udp reject with tcp-reset",
+		"input reject with icmp-sorry",
+		"input from 2001:db8::/32 drop",
+		"input from 10.0.0.0/33 drop",
+		"input drop proto tcp",
+		"input proto",
+		"input colour red drop",
+		"input state sleepy drop",
+	}
+
+	for _, line := range mistakes {
+		if _, err := ParseFilterRule(line); !errors.Is(err, ErrInvalidFilterRule) {
+			t.Errorf("expected %q to be rejected, got %v", line, err)
+		}
+	}
+}
+
+func Test_LoadFilterRules_ReplacesEverythingOrNothing(t *testing.T) {
+	router, _, _ := newRouter(t, 1500)
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddFilterRule(FilterRule{Chain: FilterOutput, Action: FilterDrop}))
+
+	file := `
+# Only ssh gets in
+policy input drop
+input proto tcp dport 22 accept   # from anywhere
+forward out r1 proto udp reject
+`
+	testhelpers.FailTestIfErrorIsPresent(t, router.LoadFilterRules(strings.NewReader(file)))
+
+	chains := router.FilterChains()
+	if chains[FilterInput].Policy != FilterDrop || len(chains[FilterInput].Rules) != 1 ||
+		len(chains[FilterOutput].Rules) != 0 || len(chains[FilterForward].Rules) != 1 {
+		t.Fatalf("expected the file's rules and nothing else, got %+v", chains)
+	}
+
+	err := router.LoadFilterRules(strings.NewReader("policy input accept\ninput proto tcp dport 99999 drop\n"))
+	if !errors.Is(err, ErrInvalidFilterRule) || !strings.HasPrefix(err.Error(), "line 2:") {
+		t.Errorf("expected the mistake on line 2 to be reported, got %v", err)
+	}
+
+	if router.FilterChains()[FilterInput].Policy != FilterDrop {
+		t.Errorf("expected a file with a mistake in it to change nothing")
+	}
+}
+
+func tcpSegment(t *testing.T, source, destination netip.AddrPort, flags tcp.Flags) *ipv4.Packet {
+	t.Helper()
+
+	segment := &tcp.Segment{SourcePort: source.Port(), DestinationPort: destination.Port(), SequenceNumber: 1000, Flags: flags, Window: 1024}
+	raw, err := segment.CreateSegment(context.TODO(), source.Addr(), destination.Addr())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return &ipv4.Packet{TTL: ipv4.DefaultTTL, Protocol: ipv4.ProtocolTCP, Source: source.Addr(), Destination: destination.Addr(), Payload: raw}
+}
+
+func Test_Filter_InputRejectsWithICMP(t *testing.T) {
+	router, left, _ := newRouter(t, 1500)
+	rule, _ := ParseFilterRule("input in r0 proto udp dport 53 reject with icmp-admin-prohibited")
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddFilterRule(rule))
+
+	sendRaw(t, left, udpPacket(t, netip.AddrPortFrom(leftHost, 5000), netip.MustParseAddrPort("10.0.1.1:53")))
+	readICMPError(t, left, icmp.TypeDestinationUnreachable, icmp.CodeAdministrativelyProhibited)
+
+	// Another port gets through to find nothing listening
+	sendRaw(t, left, udpPacket(t, netip.AddrPortFrom(leftHost, 5000), netip.MustParseAddrPort("10.0.1.1:54")))
+	readICMPError(t, left, icmp.TypeDestinationUnreachable, icmp.CodePortUnreachable)
+
+	stats := router.FilterChains()[FilterInput]
+	if len(stats.Rules) != 1 || stats.Rules[0].Packets != 1 || stats.Rules[0].Bytes != 33 || stats.Packets != 1 {
+		t.Errorf("expected one packet of 33 bytes against the rule and one against the policy, got %+v", stats)
+	}
+}
+
+func Test_Filter_ForwardRejectsWithAReset(t *testing.T) {
+	router, left, right := newRouter(t, 1500)
+	rule, _ := ParseFilterRule("forward out r1 proto tcp dport 80 reject with tcp-reset")
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddFilterRule(rule))
+
+	server := netip.AddrPortFrom(rightHost, 80)
+	sendRaw(t, left, tcpSegment(t, netip.AddrPortFrom(leftHost, 40000), server, tcp.FlagSYN))
+
+	packet := readRaw(t, left)
+
+	reset, err := tcp.ParseRawSegment(context.TODO(), packet.Payload, packet.Source, packet.Destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet.Source != rightHost || reset.SourcePort != 80 || reset.Flags != tcp.FlagRST|tcp.FlagACK || reset.AcknowledgmentNumber != 1001 {
+		t.Errorf("expected a reset from %s acknowledging the SYN, got %s from %s", server, reset.Flags, packet.Source)
+	}
+
+	// Other ports go on
+	sendRaw(t, left, tcpSegment(t, netip.AddrPortFrom(leftHost, 40000), netip.AddrPortFrom(rightHost, 81), tcp.FlagSYN))
+
+	if forwarded := readRaw(t, right); forwarded.Destination != rightHost {
+		t.Errorf("expected the SYN to port 81 forwarded, got %+v", forwarded)
+	}
+}
+
+func Test_Filter_MatchesTCPFlags(t *testing.T) {
+	router, left, right := newRouter(t, 1500)
+	rule, _ := ParseFilterRule("forward proto tcp flags SYN/SYN|ACK drop")
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddFilterRule(rule))
+
+	client, server := netip.AddrPortFrom(leftHost, 40000), netip.AddrPortFrom(rightHost, 80)
+
+	sendRaw(t, left, tcpSegment(t, client, server, tcp.FlagSYN))
+	sendRaw(t, left, tcpSegment(t, client, server, tcp.FlagACK))
+
+	packet := readRaw(t, right)
+
+	segment, err := tcp.ParseRawSegment(context.TODO(), packet.Payload, packet.Source, packet.Destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if segment.Flags != tcp.FlagACK {
+		t.Errorf("expected only the ACK forwarded, got %s", segment.Flags)
+	}
+
+	if stats := router.FilterChains()[FilterForward]; stats.Rules[0].Packets != 1 || stats.Packets != 1 {
+		t.Errorf("expected the SYN counted against the rule and the ACK against the policy, got %+v", stats)
+	}
+}
+
+func Test_Filter_PortsDoNotMatchLaterFragments(t *testing.T) {
+	router, left, right := newRouter(t, 1500)
+	testhelpers.FailTestIfErrorIsPresent(t, router.SetFilterPolicy(FilterForward, FilterDrop))
+	rule, _ := ParseFilterRule("forward proto udp dport 53 accept")
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddFilterRule(rule))
+
+	first := udpPacket(t, netip.AddrPortFrom(leftHost, 5000), netip.AddrPortFrom(rightHost, 53))
+	later := datagram(rightHost, 16)
+	later.FragmentOffset = 10
+
+	sendRaw(t, left, later)
+	sendRaw(t, left, first)
+
+	if forwarded := readRaw(t, right); forwarded.IsFragment() {
+		t.Errorf("expected the later fragment to fall through to the policy")
+	}
+
+	waitForCounter(t, router, "ipOutForwDatagrams", 1)
+}
+
+func Test_Filter_OutputRefusesToSend(t *testing.T) {
+	a, _, _ := newStackPair(t, link.IP)
+	testhelpers.FailTestIfErrorIsPresent(t, a.AddFilterRule(FilterRule{
+		Chain:            FilterOutput,
+		OutInterface:     "a0",
+		Protocol:         ipv4.ProtocolUDP,
+		DestinationPorts: PortRange{First: 9, Last: 9},
+		Action:           FilterReject,
+	}))
+
+	conn, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	defer conn.Close()
+
+	if _, err := conn.WriteToUDPAddrPort([]byte("discard"), netip.AddrPortFrom(addressB.Addr(), 9)); !errors.Is(err, ErrFiltered) {
+		t.Errorf("expected ErrFiltered, got %v", err)
+	}
+
+	if _, err := conn.WriteToUDPAddrPort([]byte("echo"), netip.AddrPortFrom(addressB.Addr(), 7)); err != nil {
+		t.Errorf("expected other ports to be sent to, got %v", err)
+	}
+}
+
+// newStatefulRouter is newRouter letting anything out from the left, and only replies back in from the right
+func newStatefulRouter(t *testing.T) (*Stack, *link.Pipe, *link.Pipe) {
+	t.Helper()
+
+	router, left, right := newRouter(t, 1500)
+	rules := `
+policy forward drop
+forward state established accept
+forward in r0 accept
+`
+	testhelpers.FailTestIfErrorIsPresent(t, router.LoadFilterRules(strings.NewReader(rules)))
+
+	return router, left, right
+}
+
+// waitForPolicy waits for a number of packets to have fallen through to a chain's policy
+func waitForPolicy(t *testing.T, s *Stack, chain FilterChain, packets uint64) {
+	t.Helper()
+
+	waitFor(t, fmt.Sprintf("%d packets to fall through to the %s policy", packets, chain), func() bool {
+		return s.FilterChains()[chain].Packets == packets
+	})
+}
+
+func Test_Filter_AllowsRepliesToEstablishedFlows(t *testing.T) {
+	router, left, right := newStatefulRouter(t)
+	client, server := netip.AddrPortFrom(leftHost, 5000), netip.AddrPortFrom(rightHost, 53)
+
+	// Nothing from the right gets in unasked
+	sendRaw(t, right, udpPacket(t, server, client))
+	waitForPolicy(t, router, FilterForward, 1)
+
+	sendRaw(t, left, udpPacket(t, client, server))
+	readUDP(t, right)
+
+	// Until it is a reply, and only from the port that was asked
+	sendRaw(t, right, udpPacket(t, netip.AddrPortFrom(rightHost, 54), client))
+	sendRaw(t, right, udpPacket(t, server, client))
+
+	if source, _ := readUDP(t, left); source != server {
+		t.Errorf("expected only the reply from %s back in, got one from %s", server, source)
+	}
+
+	stats := router.FilterChains()[FilterForward]
+	if stats.Packets != 2 || stats.Rules[0].Packets != 1 || stats.Rules[1].Packets != 1 {
+		t.Errorf("expected two packets dropped by the policy and one each through the rules, got %+v", stats)
+	}
+}
+
+func Test_Filter_AdmitsICMPErrorsAboutTrackedFlows(t *testing.T) {
+	router, left, right := newStatefulRouter(t)
+	client, server := netip.AddrPortFrom(leftHost, 5000), netip.AddrPortFrom(rightHost, 53)
+
+	unreachable := func(about *ipv4.Packet) *ipv4.Packet {
+		quoted, err := about.CreatePacket(context.TODO())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		message := &icmp.Message{Type: icmp.TypeDestinationUnreachable, Code: icmp.CodePortUnreachable, Data: quoted[:about.HeaderLength()+8]}
+		raw, err := message.CreateMessage(context.TODO())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		return &ipv4.Packet{TTL: ipv4.DefaultTTL, Protocol: ipv4.ProtocolICMP, Source: rightHost, Destination: leftHost, Payload: raw}
+	}
+
+	// An error about a flow there has never been is dropped
+	sendRaw(t, right, unreachable(udpPacket(t, client, server)))
+	waitForPolicy(t, router, FilterForward, 1)
+
+	sendRaw(t, left, udpPacket(t, client, server))
+	sent := readRaw(t, right)
+
+	sendRaw(t, right, unreachable(sent))
+	readICMPError(t, left, icmp.TypeDestinationUnreachable, icmp.CodePortUnreachable)
+
+	// Without going through any rule
+	if stats := router.FilterChains()[FilterForward]; stats.Rules[0].Packets != 0 || stats.Packets != 1 {
+		t.Errorf("expected the related error to skip the rules, got %+v", stats)
+	}
+}
+
+func Test_Filter_FollowsLocalTCPConnections(t *testing.T) {
+	a, b, _ := newStackPair(t, link.IP)
+	rules := `
+policy input drop
+input state established accept
+`
+	testhelpers.FailTestIfErrorIsPresent(t, a.LoadFilterRules(strings.NewReader(rules)))
+
+	for _, s := range []*Stack{a, b} {
+		listener, err := s.ListenTCP(netip.AddrPortFrom(netip.IPv4Unspecified(), 80))
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+		t.Cleanup(func() { _ = listener.Close() })
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	conn, err := a.DialTCP(ctx, netip.AddrPort{}, netip.AddrPortFrom(addressB.Addr(), 80))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	defer conn.Close()
+
+	flows := a.TrackedFlows()
+	if len(flows) != 1 || flows[0].State != "ESTABLISHED" || !flows[0].Replied {
+		t.Errorf("expected the connection tracked as established, got %+v", flows)
+	}
+
+	// The other way, a's SYN-ACK never gets a chance since b's SYN starts nothing a has asked for
+	ctx, cancel = context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	if _, err := b.DialTCP(ctx, netip.AddrPort{}, netip.AddrPortFrom(addressA.Addr(), 80)); err == nil {
+		t.Errorf("expected a connection to a to be filtered")
+	}
+}
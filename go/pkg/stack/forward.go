@@ -0,0 +1,148 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/netip"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/trace"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+)
+
+// SetForwarding turns forwarding on or off for packets arriving on the interface, like Linux's
+// net.ipv4.conf.<name>.forwarding. With it on, packets that arrive here for an address that is not ours are routed
+// on out of whichever interface the routing table picks, instead of being dropped.
+func (nic *Interface) SetForwarding(enabled bool) {
+	nic.forwarding.Store(enabled)
+}
+
+// Forwarding reports whether packets arriving on the interface are forwarded
+func (nic *Interface) Forwarding() bool {
+	return nic.forwarding.Load()
+}
+
+// forwardIPv4 sends on a packet that arrived on nic for somewhere else, as a router does (RFC 1812 5.2). data is
+// the packet as it arrived, which is sent on as it is apart from the TTL and any translation, unless it has to be
+// fragmented. flow is the tracked flow it was found to belong to on the way in.
+func (s *Stack) forwardIPv4(ctx context.Context, nic *Interface, packet *ipv4.Packet, data []byte, flow conntrackFlow) {
+	fields := []any{"src_ip", packet.Source.String(), "dst_ip", packet.Destination.String(), "proto", packet.Protocol}
+
+	// RFC 1812 5.3.7 and RFC 3927 2.7: nothing from or to a loopback, link-local, multicast or broadcast address
+	// goes past this link
+	if !packet.Source.IsGlobalUnicast() || !packet.Destination.IsGlobalUnicast() {
+		s.counters.IP.InAddrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "address cannot be forwarded", fields...)
+		return
+	}
+
+	if packet.TTL <= 1 {
+		s.counters.IP.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "TTL expired in transit", fields...)
+		s.sendICMPError(ctx, nic, packet, icmp.TypeTimeExceeded, icmp.CodeTTLExceeded)
+		return
+	}
+
+	s.counters.IP.InForwDatagrams.Inc()
+
+	out, nextHop, err := s.route(packet.Destination)
+	if err != nil {
+		s.counters.IP.InNoRoutes.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no route to forward on", fields...)
+		s.sendICMPError(ctx, nic, packet, icmp.TypeDestinationUnreachable, icmp.CodeNetUnreachable)
+		return
+	}
+
+	// Like Linux's default bc_forwarding, a broadcast to another of our subnets is not passed on (RFC 2644)
+	if packet.Destination == subnetBroadcast(out.Address) {
+		s.counters.IP.InAddrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "not forwarding a directed broadcast", fields...)
+		return
+	}
+
+	if err := s.filterIPv4(ctx, FilterForward, nic, out, packet, flow.state); err != nil {
+		return
+	}
+
+	// Going back out of the interface it came in on to a next hop the sender could have reached itself, the sender
+	// is told to use it directly next time (RFC 1812 5.2.7.2). The packet still goes on.
+	if out == nic && nic.Address.Contains(packet.Source) && nic.Address.Contains(nextHop) {
+		redirect := &icmp.Message{Type: icmp.TypeRedirect, Code: icmp.CodeRedirectHost, RestOfHeader: nextHop.As4()}
+		s.sendICMPErrorMessage(ctx, nic, packet, redirect)
+	}
+
+	raw := bytes.Clone(data[:packet.TotalLength])
+	forwarded := packet
+
+	if s.tracking() {
+		var ok bool
+		if forwarded, ok = s.conntrackForward(ctx, out, packet, raw, flow); !ok {
+			return
+		}
+	}
+
+	if int(packet.TotalLength) > out.Link.MTU() {
+		s.forwardFragmented(ctx, nic, out, nextHop, packet, forwarded)
+		return
+	}
+
+	ipv4.DecrementTTL(raw)
+
+	if err := out.writeIPv4(ctx, nextHop, raw); err != nil {
+		s.counters.IP.OutDiscards.Inc()
+		trace.Annotate(ctx, trace.Dropped, "link write failed", "error", err.Error())
+		return
+	}
+
+	s.counters.IP.OutForwDatagrams.Inc()
+	trace.Annotate(ctx, trace.Sent, "packet forwarded", append(fields, "iface", out.Name, "next_hop", nextHop.String())...)
+}
+
+// forwardFragmented forwards a packet too large for the interface it goes out of in fragments, or tells the sender
+// how large it can be when it has DF set (RFC 1191). original is the packet as it arrived, which the sender is told
+// about, and packet is it as it goes out.
+func (s *Stack) forwardFragmented(ctx context.Context, in, out *Interface, nextHop netip.Addr, original, packet *ipv4.Packet) {
+	s.counters.IP.OutFragReqds.Inc()
+
+	forwarded := *packet
+	forwarded.TTL--
+
+	fragments, err := forwarded.Fragment(out.Link.MTU())
+	if errors.Is(err, ipv4.ErrFragmentationNeeded) {
+		s.counters.IP.OutFragFails.Inc()
+		trace.Annotate(ctx, trace.Dropped, "packet too large with DF set", "len", packet.TotalLength, "mtu", out.Link.MTU())
+
+		tooBig := &icmp.Message{Type: icmp.TypeDestinationUnreachable, Code: icmp.CodeFragmentationNeeded}
+		copy(tooBig.RestOfHeader[2:4], bytehelpers.Uint16ToByteArray(uint16(out.Link.MTU())))
+		s.sendICMPErrorMessage(ctx, in, original, tooBig)
+
+		return
+	}
+
+	if err != nil {
+		s.counters.IP.OutFragFails.Inc()
+		trace.Annotate(ctx, trace.Dropped, "failed to fragment packet", "error", err.Error())
+		return
+	}
+
+	for _, fragment := range fragments {
+		raw, err := fragment.CreatePacket(ctx)
+		if err == nil {
+			err = out.writeIPv4(ctx, nextHop, raw)
+		}
+
+		if err != nil {
+			s.counters.IP.OutFragFails.Inc()
+			trace.Annotate(ctx, trace.Dropped, "failed to send fragment", "error", err.Error())
+			return
+		}
+
+		s.counters.IP.OutFragCreates.Inc()
+	}
+
+	s.counters.IP.OutFragOKs.Inc()
+	s.counters.IP.OutForwDatagrams.Inc()
+	trace.Annotate(ctx, trace.Sent, "packet forwarded in fragments", "iface", out.Name, "fragments", len(fragments))
+}
@@ -0,0 +1,385 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+	"networking/pkg/link"
+)
+
+var (
+	leftHost  = netip.MustParseAddr("10.0.1.9")
+	rightHost = netip.MustParseAddr("10.0.2.9")
+)
+
+// newRouter is a stack forwarding between 10.0.1.1/24 on r0 and 10.0.2.1/24 on r1, returning the far end of each
+// link for the test to drive. r1's link has the given MTU.
+func newRouter(t *testing.T, rightMTU int) (*Stack, *link.Pipe, *link.Pipe) {
+	t.Helper()
+
+	return newRouterWithOptions(t, rightMTU, Options{})
+}
+
+func newRouterWithOptions(t *testing.T, rightMTU int, options Options) (*Stack, *link.Pipe, *link.Pipe) {
+	t.Helper()
+
+	router := New(logger.NewMockLogger().WithLogger(context.Background()), options)
+	leftLink, left := link.NewPipe(link.IP, 1500)
+	rightLink, right := link.NewPipe(link.IP, rightMTU)
+
+	r0, err := router.AddInterface("r0", leftLink, netip.MustParsePrefix("10.0.1.1/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	r1, err := router.AddInterface("r1", rightLink, netip.MustParsePrefix("10.0.2.1/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	r0.SetForwarding(true)
+	r1.SetForwarding(true)
+
+	t.Cleanup(func() {
+		_ = router.Close()
+		_ = left.Close()
+		_ = right.Close()
+	})
+
+	return router, left, right
+}
+
+// datagram is a UDP-ish packet from the left host to destination
+func datagram(destination netip.Addr, payloadLength int) *ipv4.Packet {
+	return &ipv4.Packet{
+		Identification: 0xBEEF,
+		TTL:            ipv4.DefaultTTL,
+		Protocol:       ipv4.ProtocolUDP,
+		Source:         leftHost,
+		Destination:    destination,
+		Payload:        bytes.Repeat([]byte{0xAB}, payloadLength),
+	}
+}
+
+func sendRaw(t *testing.T, peer *link.Pipe, packet *ipv4.Packet) {
+	t.Helper()
+
+	raw, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	testhelpers.FailTestIfErrorIsPresent(t, peer.WritePacket(raw))
+}
+
+func readRaw(t *testing.T, peer *link.Pipe) *ipv4.Packet {
+	t.Helper()
+
+	raw, err := peer.ReadPacket()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	packet, err := ipv4.ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return packet
+}
+
+func readICMPError(t *testing.T, peer *link.Pipe, messageType, code uint8) (*ipv4.Packet, *icmp.Message) {
+	t.Helper()
+
+	packet := readRaw(t, peer)
+
+	message, err := icmp.ParseRawMessage(context.TODO(), packet.Payload)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet.Protocol != ipv4.ProtocolICMP || message.Type != messageType || message.Code != code {
+		t.Fatalf("expected ICMP type %d code %d, got protocol %d type %d code %d", messageType, code, packet.Protocol, message.Type, message.Code)
+	}
+
+	return packet, message
+}
+
+func Test_Forwarding_DecrementsTheTTL(t *testing.T) {
+	router, left, right := newRouter(t, 1500)
+
+	sendRaw(t, left, datagram(rightHost, 100))
+
+	// Parsing checks the checksum was kept right
+	forwarded := readRaw(t, right)
+
+	if forwarded.TTL != ipv4.DefaultTTL-1 || forwarded.Identification != 0xBEEF || forwarded.Source != leftHost || len(forwarded.Payload) != 100 {
+		t.Errorf("expected the packet forwarded as it was with one less TTL, got %+v", forwarded)
+	}
+
+	waitForCounter(t, router, "ipInForwDatagrams", 1)
+	waitForCounter(t, router, "ipOutForwDatagrams", 1)
+	waitForCounter(t, router, "ipInDelivers", 0)
+}
+
+func Test_Forwarding_IsPerInterface(t *testing.T) {
+	router, left, right := newRouter(t, 1500)
+	router.Interfaces()[0].SetForwarding(false)
+
+	sendRaw(t, left, datagram(rightHost, 10))
+	waitForCounter(t, router, "ipInAddrErrors", 1)
+	waitForCounter(t, router, "ipInForwDatagrams", 0)
+
+	// The other way still goes
+	back := datagram(leftHost, 10)
+	back.Source = rightHost
+	sendRaw(t, right, back)
+
+	if forwarded := readRaw(t, left); forwarded.Destination != leftHost {
+		t.Errorf("expected the packet forwarded to %s, got %+v", leftHost, forwarded)
+	}
+}
+
+func Test_Forwarding_TTLExpiryIsReported(t *testing.T) {
+	router, left, _ := newRouter(t, 1500)
+
+	expiring := datagram(rightHost, 10)
+	expiring.TTL = 1
+	sendRaw(t, left, expiring)
+
+	packet, message := readICMPError(t, left, icmp.TypeTimeExceeded, icmp.CodeTTLExceeded)
+
+	quoted, err := ipv4.ParseRawPacket(context.TODO(), message.Data)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet.Source != netip.MustParseAddr("10.0.1.1") || packet.Destination != leftHost || quoted.Destination != rightHost {
+		t.Errorf("expected the router to tell the sender about its packet to %s, got %+v quoting %+v", rightHost, packet, quoted)
+	}
+
+	waitForCounter(t, router, "icmpOutTimeExcds", 1)
+	waitForCounter(t, router, "ipOutForwDatagrams", 0)
+}
+
+func Test_Forwarding_NoRouteIsReported(t *testing.T) {
+	router, left, _ := newRouter(t, 1500)
+
+	sendRaw(t, left, datagram(netip.MustParseAddr("192.0.2.1"), 10))
+
+	readICMPError(t, left, icmp.TypeDestinationUnreachable, icmp.CodeNetUnreachable)
+	waitForCounter(t, router, "ipInNoRoutes", 1)
+}
+
+func Test_Forwarding_OnlyGlobalUnicastIsForwarded(t *testing.T) {
+	router, left, _ := newRouter(t, 1500)
+
+	for _, destination := range []string{"169.254.1.1", "127.0.0.1", "224.0.0.5", "10.0.2.255"} {
+		sendRaw(t, left, datagram(netip.MustParseAddr(destination), 10))
+	}
+
+	waitForCounter(t, router, "ipInAddrErrors", 4)
+	waitForCounter(t, router, "ipOutForwDatagrams", 0)
+}
+
+func Test_Forwarding_FragmentsForASmallerMTU(t *testing.T) {
+	router, left, right := newRouter(t, 576)
+
+	original := datagram(rightHost, 1000)
+	sendRaw(t, left, original)
+
+	var reassembled []byte
+
+	for {
+		fragment := readRaw(t, right)
+
+		if len(fragment.Payload)+fragment.HeaderLength() > 576 || fragment.TTL != ipv4.DefaultTTL-1 ||
+			fragment.Identification != 0xBEEF || int(fragment.FragmentOffset)*8 != len(reassembled) {
+			t.Fatalf("unexpected fragment %+v", fragment)
+		}
+
+		reassembled = append(reassembled, fragment.Payload...)
+
+		if fragment.Flags&ipv4.FlagMoreFragments == 0 {
+			break
+		}
+	}
+
+	if !bytes.Equal(reassembled, original.Payload) {
+		t.Errorf("expected the fragments to make up the original payload")
+	}
+
+	waitForCounter(t, router, "ipOutFragOKs", 1)
+	waitForCounter(t, router, "ipOutFragCreates", 2)
+	waitForCounter(t, router, "ipOutForwDatagrams", 1)
+}
+
+func Test_Forwarding_FragmentsAreReassembledBehindTheRouter(t *testing.T) {
+	ctx := logger.NewMockLogger().WithLogger(context.Background())
+
+	// client (10.0.1.9) - router - server (10.0.2.9), with a 576 byte MTU on the router's way to the server
+	client, router, server := New(ctx, Options{}), New(ctx, Options{}), New(ctx, Options{})
+
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = router.Close()
+		_ = server.Close()
+	})
+
+	clientLink, leftLink := link.NewPipe(link.IP, 1500)
+	rightLink, serverLink := link.NewPipe(link.IP, 576)
+
+	_, err := client.AddInterface("c0", clientLink, netip.MustParsePrefix("10.0.1.9/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	r0, err := router.AddInterface("r0", leftLink, netip.MustParsePrefix("10.0.1.1/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	r1, err := router.AddInterface("r1", rightLink, netip.MustParsePrefix("10.0.2.1/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	_, err = server.AddInterface("s0", serverLink, netip.MustParsePrefix("10.0.2.9/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	r0.SetForwarding(true)
+	r1.SetForwarding(true)
+
+	testhelpers.FailTestIfErrorIsPresent(t, client.AddRoute(Route{Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("10.0.1.1")}))
+	testhelpers.FailTestIfErrorIsPresent(t, server.AddRoute(Route{Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("10.0.2.1")}))
+
+	serverConn, err := server.ListenUDP(netip.MustParseAddrPort("0.0.0.0:7"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	clientConn, err := client.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	// Too big for the client's own link, so it leaves in fragments without DF rather than waiting to hear about
+	// the path, and the router splits the first of them again
+	sent := bytes.Repeat([]byte("fragmented on the way "), 90)
+	_, err = clientConn.WriteToUDPAddrPort(sent, netip.MustParseAddrPort("10.0.2.9:7"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	received, from := readWithTimeout(t, serverConn)
+
+	if !bytes.Equal(received, sent) || from.Addr() != netip.MustParseAddr("10.0.1.9") {
+		t.Errorf("expected the whole datagram from 10.0.1.9, got %d bytes from %s", len(received), from)
+	}
+
+	waitForCounter(t, client, "ipOutFragOKs", 1)
+	waitForCounter(t, router, "ipOutFragOKs", 1)
+	waitForCounter(t, server, "ipReasmReqds", 4)
+	waitForCounter(t, server, "ipReasmOKs", 1)
+}
+
+func Test_Forwarding_DontFragmentGetsTheNextHopMTU(t *testing.T) {
+	router, left, _ := newRouter(t, 576)
+
+	original := datagram(rightHost, 1000)
+	original.Flags = ipv4.FlagDontFragment
+	sendRaw(t, left, original)
+
+	_, message := readICMPError(t, left, icmp.TypeDestinationUnreachable, icmp.CodeFragmentationNeeded)
+
+	if message.NextHopMTU() != 576 {
+		t.Errorf("expected the next hop MTU of 576, got %d", message.NextHopMTU())
+	}
+
+	waitForCounter(t, router, "ipOutFragFails", 1)
+	waitForCounter(t, router, "icmpOutDestUnreachs", 1)
+}
+
+func Test_Forwarding_RedirectsToABetterFirstHop(t *testing.T) {
+	router, left, _ := newRouter(t, 1500)
+	gateway := netip.MustParseAddr("10.0.1.254")
+
+	err := router.AddRoute(Route{Destination: netip.MustParsePrefix("192.168.0.0/16"), Gateway: gateway})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sendRaw(t, left, datagram(netip.MustParseAddr("192.168.5.5"), 10))
+
+	_, redirect := readICMPError(t, left, icmp.TypeRedirect, icmp.CodeRedirectHost)
+	if redirect.Gateway() != gateway {
+		t.Errorf("expected a redirect to %s, got %s", gateway, redirect.Gateway())
+	}
+
+	// The packet itself still goes on, back out the way it came
+	if forwarded := readRaw(t, left); forwarded.Protocol != ipv4.ProtocolUDP || forwarded.TTL != ipv4.DefaultTTL-1 {
+		t.Errorf("expected the packet forwarded after the redirect, got %+v", forwarded)
+	}
+
+	waitForCounter(t, router, "icmpOutRedirects", 1)
+}
+
+func Test_Forwarding_ChainsStacksIntoRouters(t *testing.T) {
+	ctx := logger.NewMockLogger().WithLogger(context.Background())
+
+	// a (10.0.1.9) - r1 - 10.0.2.0/24 - r2 - b (10.0.3.9), all over Ethernet
+	type node struct {
+		stack      *Stack
+		interfaces int
+	}
+
+	newNode := func() *node {
+		s := New(ctx, Options{})
+		t.Cleanup(func() { _ = s.Close() })
+
+		return &node{stack: s}
+	}
+
+	a, r1, r2, b := newNode(), newNode(), newNode(), newNode()
+
+	connect := func(x *node, xAddress string, y *node, yAddress string) {
+		xLink, yLink := link.NewPipe(link.Ethernet, 1500)
+
+		xNIC, err := x.stack.AddInterface(fmt.Sprintf("eth%d", x.interfaces), xLink, netip.MustParsePrefix(xAddress))
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+		yNIC, err := y.stack.AddInterface(fmt.Sprintf("eth%d", y.interfaces), yLink, netip.MustParsePrefix(yAddress))
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		x.interfaces++
+		y.interfaces++
+
+		xNIC.SetForwarding(x == r1 || x == r2)
+		yNIC.SetForwarding(y == r1 || y == r2)
+	}
+
+	connect(a, "10.0.1.9/24", r1, "10.0.1.1/24")
+	connect(r1, "10.0.2.1/24", r2, "10.0.2.2/24")
+	connect(r2, "10.0.3.1/24", b, "10.0.3.9/24")
+
+	routes := map[*node]Route{
+		a:  {Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("10.0.1.1")},
+		r1: {Destination: netip.MustParsePrefix("10.0.3.0/24"), Gateway: netip.MustParseAddr("10.0.2.2")},
+		r2: {Destination: netip.MustParsePrefix("10.0.1.0/24"), Gateway: netip.MustParseAddr("10.0.2.1")},
+		b:  {Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("10.0.3.1")},
+	}
+
+	for n, route := range routes {
+		testhelpers.FailTestIfErrorIsPresent(t, n.stack.AddRoute(route))
+	}
+
+	listener, err := b.stack.ListenTCP(netip.MustParseAddrPort("10.0.3.9:80"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	}()
+
+	dialCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := a.stack.DialTCP(dialCtx, netip.AddrPort{}, netip.MustParseAddrPort("10.0.3.9:80"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sent := bytes.Repeat([]byte("across two routers "), 1000)
+	_, err = conn.Write(sent)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed := make([]byte, len(sent))
+	_, err = io.ReadFull(conn, echoed)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !bytes.Equal(echoed, sent) {
+		t.Errorf("expected the data echoed back across both routers")
+	}
+
+	if forwarded, _ := r2.stack.Metrics().Snapshot().Get("ipOutForwDatagrams"); forwarded == 0 {
+		t.Errorf("expected the second router to have forwarded the connection's packets")
+	}
+}
@@ -0,0 +1,179 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+
+	"networking/internal/trace"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+)
+
+// RFC 1812 4.3.2.3: an ICMP error should not make the reply datagram longer than 576 bytes
+const maxICMPErrorLength = 576
+
+func (s *Stack) handleICMP(ctx context.Context, nic *Interface, packet *ipv4.Packet) {
+	ctx, span := trace.StartSpan(ctx, "icmp")
+	defer span.Finish()
+
+	s.counters.ICMP.InMsgs.Inc()
+
+	message, err := icmp.ParseRawMessage(ctx, packet.Payload)
+	if errors.Is(err, icmp.ErrInvalidChecksum) {
+		s.counters.ICMP.InErrors.Inc()
+		trace.Annotate(ctx, trace.ChecksumFailed, "ICMP checksum failed")
+		return
+	}
+
+	if err != nil {
+		s.counters.ICMP.InErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid ICMP message", "error", err.Error())
+		return
+	}
+
+	fields := []any{"icmp_type", message.Type, "icmp_code", message.Code, "src_ip", packet.Source.String()}
+
+	switch message.Type {
+	case icmp.TypeEchoRequest:
+		s.counters.ICMP.InEchos.Inc()
+		s.replyToEcho(ctx, nic, packet, message)
+	case icmp.TypeEchoReply:
+		s.counters.ICMP.InEchoReps.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no one waiting for echo replies", fields...)
+	case icmp.TypeDestinationUnreachable:
+		s.counters.ICMP.InDestUnreachs.Inc()
+
+		if message.Code == icmp.CodeFragmentationNeeded {
+			s.fragmentationNeeded(ctx, message)
+			return
+		}
+
+		trace.Annotate(ctx, trace.Delivered, "destination unreachable received", fields...)
+	case icmp.TypeTimeExceeded:
+		s.counters.ICMP.InTimeExcds.Inc()
+		trace.Annotate(ctx, trace.Delivered, "time exceeded received", fields...)
+	case icmp.TypeRedirect:
+		s.counters.ICMP.InRedirects.Inc()
+		trace.Annotate(ctx, trace.Dropped, "redirects are not acted on", append(fields, "gateway", message.Gateway().String())...)
+	default:
+		trace.Annotate(ctx, trace.Dropped, "unsupported ICMP type", fields...)
+	}
+}
+
+func (s *Stack) replyToEcho(ctx context.Context, nic *Interface, packet *ipv4.Packet, request *icmp.Message) {
+	// Like Linux's default icmp_echo_ignore_broadcasts, broadcast pings go unanswered
+	if !s.hasAddress(packet.Destination) {
+		trace.Annotate(ctx, trace.Dropped, "ignoring broadcast echo request", "dst_ip", packet.Destination.String())
+		return
+	}
+
+	reply := icmp.NewEcho(icmp.TypeEchoReply, request.Identifier(), request.SequenceNumber(), request.Data)
+
+	if err := s.sendICMP(ctx, packet.Destination, packet.Source, reply); err != nil {
+		return
+	}
+
+	s.counters.ICMP.OutEchoReps.Inc()
+	trace.Annotate(ctx, trace.Delivered, "echo request answered", "src_ip", packet.Source.String(), "seq", request.SequenceNumber())
+}
+
+// sendICMPError reports a problem with original back to its sender, quoting as much of it as fits
+func (s *Stack) sendICMPError(ctx context.Context, nic *Interface, original *ipv4.Packet, messageType, code uint8) {
+	s.sendICMPErrorMessage(ctx, nic, original, &icmp.Message{Type: messageType, Code: code})
+}
+
+// sendICMPErrorMessage is sendICMPError for errors that need more than a type and code, like a redirect's gateway.
+// The quote of original goes in message's data.
+func (s *Stack) sendICMPErrorMessage(ctx context.Context, nic *Interface, original *ipv4.Packet, message *icmp.Message) {
+	if !s.shouldSendICMPError(ctx, nic, original) {
+		return
+	}
+
+	quoted := *original
+	quotedRaw, err := quoted.CreatePacket(ctx)
+	if err != nil {
+		s.counters.ICMP.OutErrors.Inc()
+		return
+	}
+
+	maxQuote := maxICMPErrorLength - ipv4.MinHeaderLength - icmp.HeaderLength
+	if len(quotedRaw) > maxQuote {
+		quotedRaw = quotedRaw[:maxQuote]
+	}
+
+	message.Data = quotedRaw
+
+	// Reply from the address the packet was sent to when it is one of ours, so the sender can match it up
+	source := original.Destination
+	if !s.hasAddress(source) {
+		source = nic.Address.Addr()
+	}
+
+	if err := s.sendICMP(ctx, source, original.Source, message); err != nil {
+		return
+	}
+
+	switch message.Type {
+	case icmp.TypeDestinationUnreachable:
+		s.counters.ICMP.OutDestUnreachs.Inc()
+	case icmp.TypeRedirect:
+		s.counters.ICMP.OutRedirects.Inc()
+	case icmp.TypeTimeExceeded:
+		s.counters.ICMP.OutTimeExcds.Inc()
+	}
+}
+
+// shouldSendICMPError applies the RFC 1122 3.2.2 rules for when an error must not be sent
+func (s *Stack) shouldSendICMPError(ctx context.Context, nic *Interface, original *ipv4.Packet) bool {
+	reason := ""
+
+	switch {
+	case original.Protocol == ipv4.ProtocolICMP && isICMPError(original.Payload):
+		reason = "original is an ICMP error"
+	case original.Destination == limitedBroadcast || original.Destination == subnetBroadcast(nic.Address) || original.Destination.IsMulticast():
+		reason = "original was broadcast or multicast"
+	case original.FragmentOffset != 0:
+		reason = "original is not the first fragment"
+	case !isUnicastSource(nic, original.Source):
+		reason = "original source is not a single host"
+	}
+
+	if reason != "" {
+		trace.Annotate(ctx, trace.Dropped, "not sending ICMP error", "reason", reason)
+		return false
+	}
+
+	return true
+}
+
+func isICMPError(payload []byte) bool {
+	if len(payload) == 0 {
+		return false
+	}
+
+	message := icmp.Message{Type: payload[0]}
+
+	return message.IsError()
+}
+
+func isUnicastSource(nic *Interface, source netip.Addr) bool {
+	return !source.IsUnspecified() && !source.IsMulticast() && source != limitedBroadcast && source != subnetBroadcast(nic.Address)
+}
+
+func (s *Stack) sendICMP(ctx context.Context, source, destination netip.Addr, message *icmp.Message) error {
+	s.counters.ICMP.OutMsgs.Inc()
+
+	raw, err := message.CreateMessage(ctx)
+	if err != nil {
+		s.counters.ICMP.OutErrors.Inc()
+		return err
+	}
+
+	return s.sendIPv4(ctx, &ipv4.Packet{
+		Protocol:    ipv4.ProtocolICMP,
+		Source:      source,
+		Destination: destination,
+		Payload:     raw,
+	}, pmtuDiscoveryDont)
+}
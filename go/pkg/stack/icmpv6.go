@@ -0,0 +1,162 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+
+	"networking/internal/trace"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+)
+
+func (s *Stack) handleICMPv6(ctx context.Context, nic *Interface, packet *ipv6.Packet, raw []byte) {
+	ctx, span := trace.StartSpan(ctx, "icmpv6")
+	defer span.Finish()
+
+	s.counters.ICMPv6.InMsgs.Inc()
+
+	message, err := icmpv6.ParseRawMessage(ctx, packet.Source, packet.Destination, packet.Payload)
+	if errors.Is(err, icmpv6.ErrInvalidChecksum) {
+		s.counters.ICMPv6.InErrors.Inc()
+		trace.Annotate(ctx, trace.ChecksumFailed, "ICMPv6 checksum failed")
+		return
+	}
+
+	if err != nil {
+		s.counters.ICMPv6.InErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid ICMPv6 message", "error", err.Error())
+		return
+	}
+
+	fields := []any{"icmp_type", message.Type, "icmp_code", message.Code, "src_ip", packet.Source.String()}
+
+	switch message.Type {
+	case icmpv6.TypeEchoRequest:
+		s.counters.ICMPv6.InEchos.Inc()
+		s.replyToEchoV6(ctx, nic, packet, message)
+	case icmpv6.TypeEchoReply:
+		s.counters.ICMPv6.InEchoReplies.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no one waiting for echo replies", fields...)
+	case icmpv6.TypeDestinationUnreachable:
+		s.counters.ICMPv6.InDestUnreachs.Inc()
+		trace.Annotate(ctx, trace.Delivered, "destination unreachable received", fields...)
+	case icmpv6.TypePacketTooBig:
+		s.counters.ICMPv6.InPktTooBigs.Inc()
+		s.packetTooBig(ctx, message)
+	case icmpv6.TypeTimeExceeded:
+		s.counters.ICMPv6.InTimeExcds.Inc()
+		trace.Annotate(ctx, trace.Delivered, "time exceeded received", fields...)
+	case icmpv6.TypeParameterProblem:
+		s.counters.ICMPv6.InParmProblems.Inc()
+		trace.Annotate(ctx, trace.Delivered, "parameter problem received", append(fields, "pointer", message.Pointer())...)
+	case icmpv6.TypeRouterSolicitation, icmpv6.TypeRouterAdvertisement, icmpv6.TypeNeighborSolicitation, icmpv6.TypeNeighborAdvertisement, icmpv6.TypeRedirect:
+		s.handleNDP(ctx, nic, packet, message)
+	default:
+		trace.Annotate(ctx, trace.Dropped, "unsupported ICMPv6 type", fields...)
+	}
+}
+
+func (s *Stack) replyToEchoV6(ctx context.Context, nic *Interface, packet *ipv6.Packet, request *icmpv6.Message) {
+	// Echo requests to a group are answered from one of our own addresses (RFC 4443 4.2)
+	source := packet.Destination
+	if source.IsMulticast() {
+		source = nic.ipv6Source(packet.Source)
+	}
+
+	reply := icmpv6.NewEcho(icmpv6.TypeEchoReply, request.Identifier(), request.SequenceNumber(), request.Data)
+
+	if err := s.sendICMPv6(ctx, nic, source, packet.Source, 0, reply); err != nil {
+		return
+	}
+
+	s.counters.ICMPv6.OutEchoReplies.Inc()
+	trace.Annotate(ctx, trace.Delivered, "echo request answered", "src_ip", packet.Source.String(), "seq", request.SequenceNumber())
+}
+
+// sendICMPv6Error reports a problem with original back to its sender, quoting as much of raw as fits in the
+// minimum MTU
+func (s *Stack) sendICMPv6Error(ctx context.Context, nic *Interface, original *ipv6.Packet, raw []byte, message *icmpv6.Message) {
+	if !s.shouldSendICMPv6Error(ctx, original, message) {
+		return
+	}
+
+	message.Data = raw[:min(len(raw), icmpv6.MaxErrorQuote)]
+
+	// Reply from the address the packet was sent to when it is one of ours, so the sender can match it up
+	source := original.Destination
+	if source.IsMulticast() || !s.hasIPv6Address(source) {
+		source = nic.ipv6Source(original.Source)
+	}
+
+	if err := s.sendICMPv6(ctx, nic, source, original.Source, 0, message); err != nil {
+		return
+	}
+
+	switch message.Type {
+	case icmpv6.TypeDestinationUnreachable:
+		s.counters.ICMPv6.OutDestUnreachs.Inc()
+	case icmpv6.TypePacketTooBig:
+		s.counters.ICMPv6.OutPktTooBigs.Inc()
+	case icmpv6.TypeTimeExceeded:
+		s.counters.ICMPv6.OutTimeExcds.Inc()
+	case icmpv6.TypeParameterProblem:
+		s.counters.ICMPv6.OutParmProblems.Inc()
+	}
+}
+
+// shouldSendICMPv6Error applies the RFC 4443 2.4 (e) rules for when an error must not be sent
+func (s *Stack) shouldSendICMPv6Error(ctx context.Context, original *ipv6.Packet, message *icmpv6.Message) bool {
+	reason := ""
+
+	// Packet too big, and unrecognized options that asked to be reported, are the exceptions that get answered
+	// even when sent to a group
+	reportsMulticast := message.Type == icmpv6.TypePacketTooBig ||
+		(message.Type == icmpv6.TypeParameterProblem && message.Code == icmpv6.CodeUnrecognizedOption)
+
+	switch {
+	case original.Protocol == ipv6.NextHeaderICMPv6 && len(original.Payload) > 0 && (&icmpv6.Message{Type: original.Payload[0]}).IsError():
+		reason = "original is an ICMPv6 error"
+	case original.Destination.IsMulticast() && !reportsMulticast:
+		reason = "original was multicast"
+	case original.Source.IsUnspecified() || original.Source.IsMulticast():
+		reason = "original source is not a single host"
+	}
+
+	if reason != "" {
+		trace.Annotate(ctx, trace.Dropped, "not sending ICMPv6 error", "reason", reason)
+		return false
+	}
+
+	return true
+}
+
+// sendICMPv6 sends a message out of nic. A hop limit of zero means the default.
+func (s *Stack) sendICMPv6(ctx context.Context, nic *Interface, source, destination netip.Addr, hopLimit uint8, message *icmpv6.Message) error {
+	s.counters.ICMPv6.OutMsgs.Inc()
+
+	// The checksum covers the source address, so it has to be picked before the message is made
+	if !source.IsValid() {
+		source = nic.ipv6Source(destination)
+	}
+
+	if !source.IsValid() {
+		s.counters.ICMPv6.OutErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no IPv6 source address", "iface", nic.Name, "dst_ip", destination.String())
+		return ErrNoSourceAddress
+	}
+
+	raw, err := message.CreateMessage(ctx, source, destination)
+	if err != nil {
+		s.counters.ICMPv6.OutErrors.Inc()
+		return err
+	}
+
+	return s.sendIPv6(ctx, nic, &ipv6.Packet{
+		HopLimit:    hopLimit,
+		Protocol:    ipv6.NextHeaderICMPv6,
+		Source:      source,
+		Destination: destination,
+		Payload:     raw,
+	}, pmtuDiscoveryDont)
+}
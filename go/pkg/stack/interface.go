@@ -0,0 +1,273 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"networking/internal/trace"
+	"networking/pkg/arp"
+	"networking/pkg/ethernet"
+	"networking/pkg/link"
+)
+
+// Interface is a link attached to the stack, along with the address the stack uses on it
+type Interface struct {
+	Name    string
+	Link    link.Link
+	Address netip.Prefix
+
+	stack     *Stack
+	neighbors *neighborCache
+	// Set when packets that arrive here for somewhere else are forwarded rather than dropped
+	forwarding atomic.Bool
+
+	// IPv6 addresses come and go, unlike the IPv4 one, as do the routers and prefixes autoconfiguration learns
+	ipv6Mu        sync.Mutex
+	ipv6Addresses []*ipv6Address
+	routers       []*defaultRouter
+	prefixes      []*onLinkPrefix
+	// Router solicitations still to send, until a router advertises
+	solicitationsLeft int
+	solicitTimer      *wheelTimer
+}
+
+// Neighbors returns the interface's neighbor cache, IPv4 and IPv6 alike
+func (nic *Interface) Neighbors() []Neighbor {
+	return nic.neighbors.all()
+}
+
+// readLoop feeds every packet from the link into the stack until the link is closed
+func (nic *Interface) readLoop() {
+	for {
+		packet, err := nic.Link.ReadPacket()
+		if errors.Is(err, link.ErrClosed) {
+			return
+		}
+
+		if err != nil {
+			nic.stack.logger().Error("failed to read from link", "iface", nic.Name, "error", err.Error())
+			continue
+		}
+
+		nic.handlePacket(packet)
+	}
+}
+
+// handlePacket is the start of every inbound packet's trace
+func (nic *Interface) handlePacket(packet []byte) {
+	ctx, tr := nic.stack.startTrace()
+	defer tr.Finish()
+
+	ctx, span := trace.StartSpan(ctx, "link")
+	defer span.Finish()
+
+	trace.Annotate(ctx, trace.Received, "packet received", "iface", nic.Name, "len", len(packet))
+
+	if nic.Link.Type() == link.IP {
+		nic.handleIPPacket(ctx, packet)
+		return
+	}
+
+	nic.handleFrame(ctx, packet)
+}
+
+// handleIPPacket dispatches a packet from an IP link, which has no EtherType, on its version
+func (nic *Interface) handleIPPacket(ctx context.Context, packet []byte) {
+	if len(packet) == 0 {
+		trace.Annotate(ctx, trace.Malformed, "empty packet")
+		return
+	}
+
+	switch version := packet[0] >> 4; version {
+	case 4:
+		nic.stack.handleIPv4(ctx, nic, packet)
+	case 6:
+		nic.stack.handleIPv6(ctx, nic, packet)
+	default:
+		trace.Annotate(ctx, trace.Dropped, "unsupported IP version", "version", version)
+	}
+}
+
+func (nic *Interface) handleFrame(ctx context.Context, data []byte) {
+	ctx, span := trace.StartSpan(ctx, "ethernet")
+	defer span.Finish()
+
+	frame, err := ethernet.ParseRawFrame(ctx, data)
+	if err != nil {
+		trace.Annotate(ctx, trace.Malformed, "invalid Ethernet frame", "error", err.Error())
+		return
+	}
+
+	ourMAC := nic.Link.HardwareAddress()
+	if frame.Destination != ourMAC && !frame.Destination.IsMulticast() {
+		trace.Annotate(ctx, trace.Dropped, "frame not addressed to us", "dst_mac", frame.Destination.String())
+		return
+	}
+
+	switch frame.EtherType {
+	case ethernet.EtherTypeIPv4:
+		nic.stack.handleIPv4(ctx, nic, frame.Payload)
+	case ethernet.EtherTypeIPv6:
+		nic.stack.handleIPv6(ctx, nic, frame.Payload)
+	case ethernet.EtherTypeARP:
+		nic.handleARP(ctx, frame.Payload)
+	default:
+		trace.Annotate(ctx, trace.Dropped, "unsupported EtherType", "ethertype", frame.EtherType)
+	}
+}
+
+func (nic *Interface) handleARP(ctx context.Context, data []byte) {
+	ctx, span := trace.StartSpan(ctx, "arp")
+	defer span.Finish()
+
+	packet, err := arp.ParseRawPacket(ctx, data)
+	if err != nil {
+		trace.Annotate(ctx, trace.Malformed, "invalid ARP packet", "error", err.Error())
+		return
+	}
+
+	// RFC 826: update an existing entry for the sender before even checking if we are the target
+	merged := nic.neighbors.update(packet.SenderIP, packet.SenderMAC, false)
+
+	if packet.TargetIP != nic.Address.Addr() {
+		trace.Annotate(ctx, trace.Dropped, "ARP not for our address", "target_ip", packet.TargetIP.String())
+		return
+	}
+
+	if !merged {
+		nic.neighbors.update(packet.SenderIP, packet.SenderMAC, true)
+	}
+
+	nic.flushPending(ctx, packet.SenderIP)
+
+	if packet.Operation != arp.OperationRequest {
+		trace.Annotate(ctx, trace.Delivered, "ARP reply learned", "sender_ip", packet.SenderIP.String())
+		return
+	}
+
+	reply := &arp.Packet{
+		Operation: arp.OperationReply,
+		SenderMAC: nic.Link.HardwareAddress(),
+		SenderIP:  nic.Address.Addr(),
+		TargetMAC: packet.SenderMAC,
+		TargetIP:  packet.SenderIP,
+	}
+
+	if err := nic.writeARP(ctx, reply, packet.SenderMAC); err != nil {
+		trace.Annotate(ctx, trace.Dropped, "failed to send ARP reply", "error", err.Error())
+		return
+	}
+
+	trace.Annotate(ctx, trace.Delivered, "ARP request answered", "sender_ip", packet.SenderIP.String())
+}
+
+func (nic *Interface) writeARP(ctx context.Context, packet *arp.Packet, destination ethernet.MAC) error {
+	payload, err := packet.CreatePacket(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nic.writeFrame(ctx, destination, ethernet.EtherTypeARP, payload)
+}
+
+func (nic *Interface) writeFrame(ctx context.Context, destination ethernet.MAC, etherType uint16, payload []byte) error {
+	frame := &ethernet.Frame{
+		Destination: destination,
+		Source:      nic.Link.HardwareAddress(),
+		EtherType:   etherType,
+		Payload:     payload,
+	}
+
+	raw, err := frame.CreateFrame(ctx)
+	if err != nil {
+		return err
+	}
+
+	return nic.Link.WritePacket(raw)
+}
+
+// writeIPv4 sends an IPv4 packet towards nextHop, resolving its hardware address first on Ethernet links.
+// Packets waiting on resolution are queued and sent once the ARP reply arrives.
+func (nic *Interface) writeIPv4(ctx context.Context, nextHop netip.Addr, packet []byte) error {
+	if nic.Link.Type() == link.IP {
+		return nic.Link.WritePacket(packet)
+	}
+
+	if nextHop == netip.AddrFrom4([4]byte{255, 255, 255, 255}) || nextHop == subnetBroadcast(nic.Address) {
+		return nic.writeFrame(ctx, ethernet.BroadcastMAC, ethernet.EtherTypeIPv4, packet)
+	}
+
+	mac, resolved, shouldRequest := nic.neighbors.resolve(nextHop, packet)
+	if resolved {
+		return nic.writeFrame(ctx, mac, ethernet.EtherTypeIPv4, packet)
+	}
+
+	trace.Annotate(ctx, trace.Queued, "waiting for ARP resolution", "next_hop", nextHop.String())
+
+	if !shouldRequest {
+		return nil
+	}
+
+	request := &arp.Packet{
+		Operation: arp.OperationRequest,
+		SenderMAC: nic.Link.HardwareAddress(),
+		SenderIP:  nic.Address.Addr(),
+		TargetIP:  nextHop,
+	}
+
+	return nic.writeARP(ctx, request, ethernet.BroadcastMAC)
+}
+
+// writeIPv6 sends an IPv6 packet towards nextHop. Multicast goes straight to the group's MAC; anything else is
+// resolved through the neighbor cache like writeIPv4 does, with neighbor solicitations in place of ARP requests.
+func (nic *Interface) writeIPv6(ctx context.Context, nextHop netip.Addr, packet []byte) error {
+	if nic.Link.Type() == link.IP {
+		return nic.Link.WritePacket(packet)
+	}
+
+	if nextHop.IsMulticast() {
+		return nic.writeFrame(ctx, ethernet.IPv6MulticastMAC(nextHop), ethernet.EtherTypeIPv6, packet)
+	}
+
+	mac, resolved, shouldRequest := nic.neighbors.resolve(nextHop, packet)
+	if resolved {
+		return nic.writeFrame(ctx, mac, ethernet.EtherTypeIPv6, packet)
+	}
+
+	trace.Annotate(ctx, trace.Queued, "waiting for neighbor resolution", "next_hop", nextHop.String())
+
+	if !shouldRequest {
+		return nil
+	}
+
+	return nic.stack.sendNeighborSolicitation(ctx, nic, nextHop)
+}
+
+func (nic *Interface) flushPending(ctx context.Context, addr netip.Addr) {
+	mac, pending := nic.neighbors.takePending(addr)
+
+	etherType := ethernet.EtherTypeIPv4
+	if addr.Is6() {
+		etherType = ethernet.EtherTypeIPv6
+	}
+
+	for _, packet := range pending {
+		if err := nic.writeFrame(ctx, mac, etherType, packet); err != nil {
+			trace.Annotate(ctx, trace.Dropped, "failed to send queued packet", "error", err.Error())
+		}
+	}
+}
+
+func subnetBroadcast(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().As4()
+	bits := prefix.Bits()
+
+	for i := bits; i < 32; i++ {
+		addr[i/8] |= 0x80 >> (i % 8)
+	}
+
+	return netip.AddrFrom4(addr)
+}
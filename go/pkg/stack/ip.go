@@ -0,0 +1,56 @@
+package stack
+
+import (
+	"context"
+	"net/netip"
+
+	"networking/internal/trace"
+	"networking/pkg/ipv4"
+	"networking/pkg/ipv6"
+	"networking/pkg/metrics"
+)
+
+// sendIP sends an upper-layer payload from source to destination, over whichever IP version they are. UDP and TCP
+// share protocol numbers between the two.
+func (s *Stack) sendIP(ctx context.Context, protocol uint8, source, destination netip.Addr, payload []byte, discovery pmtuDiscovery) error {
+	if destination.Is4() {
+		return s.sendIPv4(ctx, &ipv4.Packet{
+			Protocol:    protocol,
+			Source:      source,
+			Destination: destination,
+			Payload:     payload,
+		}, discovery)
+	}
+
+	nic, err := s.routeIPv6(destination)
+	if err != nil {
+		s.counters.IPv6.OutNoRoutes.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no route", "dst_ip", destination.String())
+		return err
+	}
+
+	return s.sendIPv6(ctx, nic, &ipv6.Packet{
+		Protocol:    protocol,
+		Source:      source,
+		Destination: destination,
+		Payload:     payload,
+	}, discovery)
+}
+
+// ipCounters are the counters for addr's IP version
+func (s *Stack) ipCounters(addr netip.Addr) *metrics.IPCounters {
+	if addr.Is6() {
+		return &s.counters.IPv6
+	}
+
+	return &s.counters.IP
+}
+
+// ipHeaderLength is the length of the IP header in front of a packet to addr, without options or extension headers
+func ipHeaderLength(addr netip.Addr) int {
+	if addr.Is6() {
+		return ipv6.HeaderLength
+	}
+
+	return ipv4.MinHeaderLength
+}
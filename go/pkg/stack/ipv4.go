@@ -0,0 +1,228 @@
+package stack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/trace"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+)
+
+// IP identification comes from this many counters, like Linux's ip_idents
+const ipIdentificationBuckets = 2048
+
+// Salts for ipHash
+const (
+	ipHashIdentificationBucket uint32 = iota
+	ipHashIdentificationOffset
+)
+
+var ErrNoRoute = errors.New("no route to host")
+
+var limitedBroadcast = netip.AddrFrom4([4]byte{255, 255, 255, 255})
+
+func (s *Stack) handleIPv4(ctx context.Context, nic *Interface, data []byte) {
+	ctx, span := trace.StartSpan(ctx, "ipv4")
+	defer span.Finish()
+
+	s.counters.IP.InReceives.Inc()
+
+	packet, err := ipv4.ParseRawPacket(ctx, data)
+	if errors.Is(err, ipv4.ErrInvalidChecksum) {
+		s.counters.IP.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.ChecksumFailed, "IPv4 header checksum failed")
+		return
+	}
+
+	if err != nil {
+		s.counters.IP.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid IPv4 packet", "error", err.Error())
+		return
+	}
+
+	if packet.IsFragment() && s.isLocalDestination(nic, packet.Destination) {
+		s.reassembleIPv4(ctx, nic, packet, data)
+		return
+	}
+
+	s.receiveIPv4(ctx, nic, packet, data)
+}
+
+// receiveIPv4 forwards a whole packet, or hands it to its protocol if it is addressed to us
+func (s *Stack) receiveIPv4(ctx context.Context, nic *Interface, packet *ipv4.Packet, data []byte) {
+	var flow conntrackFlow
+	if s.tracking() {
+		packet, flow = s.conntrackInbound(ctx, packet, data)
+	}
+
+	fields := []any{"src_ip", packet.Source.String(), "dst_ip", packet.Destination.String(), "proto", packet.Protocol}
+
+	if !s.isLocalDestination(nic, packet.Destination) {
+		if nic.forwarding.Load() {
+			s.forwardIPv4(ctx, nic, packet, data, flow)
+			return
+		}
+
+		s.counters.IP.InAddrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "packet not addressed to us", fields...)
+		return
+	}
+
+	if err := s.filterIPv4(ctx, FilterInput, nic, nil, packet, flow.state); err != nil {
+		return
+	}
+
+	s.conntrackConfirm(packet, flow)
+
+	switch packet.Protocol {
+	case ipv4.ProtocolUDP:
+		s.counters.IP.InDelivers.Inc()
+		if !s.handleUDP(ctx, nic, packet.Source, packet.Destination, packet.Payload) {
+			s.sendICMPError(ctx, nic, packet, icmp.TypeDestinationUnreachable, icmp.CodePortUnreachable)
+		}
+	case ipv4.ProtocolTCP:
+		s.counters.IP.InDelivers.Inc()
+		s.handleTCP(ctx, nic, packet.Source, packet.Destination, packet.Payload)
+	case ipv4.ProtocolICMP:
+		s.counters.IP.InDelivers.Inc()
+		s.handleICMP(ctx, nic, packet)
+	default:
+		s.counters.IP.InUnknownProtos.Inc()
+		trace.Annotate(ctx, trace.Dropped, "unsupported protocol", fields...)
+		s.sendICMPError(ctx, nic, packet, icmp.TypeDestinationUnreachable, icmp.CodeProtocolUnreachable)
+	}
+}
+
+func (s *Stack) isLocalDestination(nic *Interface, destination netip.Addr) bool {
+	return destination == limitedBroadcast || destination == subnetBroadcast(nic.Address) || s.hasAddress(destination)
+}
+
+// sendIPv4 routes and sends a packet, filling in the source address and identification if they are unset. discovery
+// decides whether it gets DF, and whether it is fragmented or fails if it is too big for the path MTU.
+func (s *Stack) sendIPv4(ctx context.Context, packet *ipv4.Packet, discovery pmtuDiscovery) error {
+	ctx, span := trace.StartSpan(ctx, "ipv4")
+	defer span.Finish()
+
+	s.counters.IP.OutRequests.Inc()
+
+	nic, nextHop, err := s.route(packet.Destination)
+	if err != nil {
+		s.counters.IP.OutNoRoutes.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no route", "dst_ip", packet.Destination.String())
+		return err
+	}
+
+	if !packet.Source.IsValid() {
+		packet.Source = nic.Address.Addr()
+	}
+
+	if packet.TTL == 0 {
+		packet.TTL = ipv4.DefaultTTL
+	}
+
+	packet.Identification = s.nextIPIdentification(packet.Source, packet.Destination, packet.Protocol)
+
+	mtu := s.pathMTU(nic, packet.Destination)
+	if discovery == pmtuDiscoveryDo || discovery == pmtuDiscoveryWant && packet.HeaderLength()+len(packet.Payload) <= mtu {
+		packet.Flags |= ipv4.FlagDontFragment
+	}
+
+	var flow conntrackFlow
+	if s.tracking() {
+		flow = s.conntrackOutbound(packet)
+	}
+
+	if err := s.filterIPv4(ctx, FilterOutput, nil, nic, packet, flow.state); err != nil {
+		return err
+	}
+
+	s.conntrackConfirm(packet, flow)
+
+	raw, err := packet.CreatePacket(ctx)
+	if err != nil {
+		s.counters.IP.OutDiscards.Inc()
+		trace.Annotate(ctx, trace.Dropped, "failed to create IPv4 packet", "error", err.Error())
+		return err
+	}
+
+	if len(raw) > mtu && packet.Flags&ipv4.FlagDontFragment != 0 {
+		s.counters.IP.OutDiscards.Inc()
+		trace.Annotate(ctx, trace.Dropped, "packet larger than the path MTU with DF set", "len", len(raw), "mtu", mtu)
+		return fmt.Errorf("%w: %d bytes to %s, path MTU %d", ErrMessageTooLong, len(raw), packet.Destination, mtu)
+	}
+
+	if len(raw) > mtu {
+		return s.fragmentIPv4(ctx, nic, nextHop, packet, mtu)
+	}
+
+	if err := nic.writeIPv4(ctx, nextHop, raw); err != nil {
+		s.counters.IP.OutDiscards.Inc()
+		trace.Annotate(ctx, trace.Dropped, "link write failed", "error", err.Error())
+		return err
+	}
+
+	trace.Annotate(ctx, trace.Sent, "packet sent", "iface", nic.Name, "next_hop", nextHop.String(), "len", len(raw))
+
+	return nil
+}
+
+// fragmentIPv4 sends a packet without DF that is too big for the path to its destination as fragments (RFC 791
+// 3.2). Every fragment keeps the identification the packet was given.
+func (s *Stack) fragmentIPv4(ctx context.Context, nic *Interface, nextHop netip.Addr, packet *ipv4.Packet, mtu int) error {
+	s.counters.IP.OutFragReqds.Inc()
+
+	fragments, err := packet.Fragment(mtu)
+	if err != nil {
+		s.counters.IP.OutFragFails.Inc()
+		trace.Annotate(ctx, trace.Dropped, "failed to fragment packet", "error", err.Error(), "mtu", mtu)
+		return err
+	}
+
+	for _, fragment := range fragments {
+		raw, err := fragment.CreatePacket(ctx)
+		if err == nil {
+			err = nic.writeIPv4(ctx, nextHop, raw)
+		}
+
+		if err != nil {
+			s.counters.IP.OutFragFails.Inc()
+			trace.Annotate(ctx, trace.Dropped, "failed to send fragment", "error", err.Error())
+			return err
+		}
+
+		s.counters.IP.OutFragCreates.Inc()
+	}
+
+	s.counters.IP.OutFragOKs.Inc()
+	trace.Annotate(ctx, trace.Sent, "packet sent in fragments", "iface", nic.Name, "next_hop", nextHop.String(), "fragments", len(fragments))
+
+	return nil
+}
+
+// nextIPIdentification picks a packet's identification (RFC 7739 5.3). Packets between the same addresses with the
+// same protocol share a counter, so their IDs do not repeat until it wraps, but the counter is picked and offset by
+// keyed hashes, so the IDs seen by one destination say nothing about the traffic to any other.
+func (s *Stack) nextIPIdentification(source, destination netip.Addr, protocol uint8) uint16 {
+	return uint16(s.nextIdentification(source, destination, protocol))
+}
+
+// nextIdentification is the counter behind both IP versions' identifications, IPv6 using all 32 bits of it
+func (s *Stack) nextIdentification(source, destination netip.Addr, protocol uint8) uint32 {
+	bucket := s.ipHash(source, destination, protocol, ipHashIdentificationBucket) % ipIdentificationBuckets
+	offset := s.ipHash(source, destination, protocol, ipHashIdentificationOffset)
+
+	return s.ipIdentifications[bucket].Add(1) + offset
+}
+
+// ipHash is a keyed hash of a packet's addresses and protocol
+func (s *Stack) ipHash(source, destination netip.Addr, protocol uint8, salt uint32) uint32 {
+	data := append(source.AsSlice(), destination.AsSlice()...)
+	data = append(data, protocol)
+	data = binary.BigEndian.AppendUint32(data, salt)
+
+	return s.keyedHash(data)
+}
@@ -0,0 +1,107 @@
+package stack
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+)
+
+// RFC 791 leaves how long to wait for the rest of a datagram to the receiver. This is Linux's ipfrag_time.
+const ipv4ReassemblyTimeout = 30 * time.Second
+
+// reassembleIPv4 collects a fragment addressed to us, and once every fragment of its datagram is in, puts the
+// datagram back together and processes it as if it had arrived whole (RFC 791 3.2)
+func (s *Stack) reassembleIPv4(ctx context.Context, nic *Interface, packet *ipv4.Packet, raw []byte) {
+	offset := int(packet.FragmentOffset) * 8
+	more := packet.Flags&ipv4.FlagMoreFragments != 0
+
+	fields := []any{
+		"src_ip", packet.Source.String(), "dst_ip", packet.Destination.String(), "id", packet.Identification,
+		"offset", offset, "len", len(packet.Payload), "more", more,
+	}
+
+	s.counters.IP.ReasmReqds.Inc()
+
+	// Every fragment but the last carries a whole number of 8 byte blocks
+	if more && len(packet.Payload)%8 != 0 {
+		s.counters.IP.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "fragment length not a multiple of 8", fields...)
+		return
+	}
+
+	if packet.HeaderLength()+offset+len(packet.Payload) > 0xFFFF {
+		s.counters.IP.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "fragment past the largest datagram", fields...)
+		return
+	}
+
+	key := reassemblyKey{
+		source:         packet.Source,
+		destination:    packet.Destination,
+		protocol:       packet.Protocol,
+		identification: uint32(packet.Identification),
+	}
+
+	var first []byte
+	if offset == 0 {
+		first = slices.Clone(raw)
+	}
+
+	piece := reassemblyPiece{offset: offset, data: slices.Clone(packet.Payload)}
+
+	datagram, reason := s.ipv4Fragments.add(key, nic, piece, more, first, packet.HeaderLength())
+	if reason != "" {
+		trace.Annotate(ctx, trace.Dropped, reason, fields...)
+		return
+	}
+
+	payload, ok := s.ipv4Fragments.complete(key, datagram)
+	if !ok {
+		trace.Annotate(ctx, trace.Delivered, "fragment queued for reassembly", fields...)
+		return
+	}
+
+	// The first fragment's header, options and all, becomes the datagram's
+	whole, err := ipv4.ParseRawPacket(ctx, datagram.first)
+	if err == nil {
+		whole.Flags &^= ipv4.FlagMoreFragments
+		whole.FragmentOffset = 0
+		whole.Payload = payload
+		raw, err = whole.CreatePacket(ctx)
+	}
+
+	if err != nil {
+		s.counters.IP.ReasmFails.Inc()
+		trace.Annotate(ctx, trace.Dropped, "failed to rebuild reassembled datagram", "error", err.Error())
+		return
+	}
+
+	s.counters.IP.ReasmOKs.Inc()
+	trace.Annotate(ctx, trace.Delivered, "datagram reassembled", "id", packet.Identification, "len", len(payload))
+
+	s.receiveIPv4(ctx, nic, whole, raw)
+}
+
+// ipv4ReassemblyTimedOut tells the sender of a datagram whose fragments did not all arrive in time, if its first
+// fragment did (RFC 792)
+func (s *Stack) ipv4ReassemblyTimedOut(key reassemblyKey, datagram *reassembly) {
+	ctx, tr := s.startTrace()
+	defer tr.Finish()
+
+	trace.Annotate(ctx, trace.Dropped, "fragment reassembly timed out", "src_ip", key.source.String(), "id", key.identification)
+
+	if datagram.first == nil {
+		return
+	}
+
+	packet, err := ipv4.ParseRawPacket(ctx, datagram.first)
+	if err != nil {
+		return
+	}
+
+	s.sendICMPError(ctx, datagram.nic, packet, icmp.TypeTimeExceeded, icmp.CodeFragmentReassemblyExceeded)
+}
@@ -0,0 +1,151 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+	"networking/internal/trace"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+	"networking/pkg/link"
+)
+
+// fragmentedUDPPacket is buildUDPPacket's datagram split into fragments of at most mtu bytes
+func fragmentedUDPPacket(t *testing.T, data []byte, identification uint16, mtu int) []*ipv4.Packet {
+	t.Helper()
+
+	packet, err := ipv4.ParseRawPacket(context.TODO(), buildUDPPacket(t, data, false))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	packet.Identification = identification
+
+	fragments, err := packet.Fragment(mtu)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return fragments
+}
+
+func Test_IPv4Reassembly_DeliversFragmentsInAnyOrder(t *testing.T) {
+	s, peer, _ := newStackWithRawPeer(t, link.IP)
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 4000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	data := bytes.Repeat([]byte("fragmented "), 110)
+	fragments := fragmentedUDPPacket(t, data, 42, 576)
+
+	for _, fragment := range slices.Backward(fragments) {
+		sendRaw(t, peer, fragment)
+	}
+
+	received, from := readWithTimeout(t, conn)
+
+	if !bytes.Equal(received, data) || from != netip.MustParseAddrPort("10.0.0.9:3000") {
+		t.Errorf("expected the whole datagram from 10.0.0.9:3000, got %d bytes from %s", len(received), from)
+	}
+
+	waitForCounter(t, s, "ipReasmReqds", uint64(len(fragments)))
+	waitForCounter(t, s, "ipReasmOKs", 1)
+	waitForCounter(t, s, "ipInDelivers", 1)
+}
+
+func Test_IPv4Reassembly_OverlapDropsTheDatagram(t *testing.T) {
+	s, peer, recorder := newStackWithRawPeer(t, link.IP)
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 4000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	fragments := fragmentedUDPPacket(t, make([]byte, 1000), 9, 576)
+
+	// A second fragment that starts 8 bytes early rewrites the end of the first
+	overlapping := *fragments[1]
+	overlapping.FragmentOffset--
+	overlapping.Payload = append(make([]byte, 8), fragments[1].Payload...)
+
+	sendRaw(t, peer, fragments[0])
+	sendRaw(t, peer, &overlapping)
+	waitForDecision(t, recorder, trace.Dropped, "overlapping fragments")
+
+	// Nothing is left for the real second fragment to complete
+	sendRaw(t, peer, fragments[1])
+	waitForDecision(t, recorder, trace.Delivered, "fragment queued for reassembly")
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := conn.ReadFromUDPAddrPort(make([]byte, 2048)); err == nil {
+		t.Errorf("expected nothing to be delivered")
+	}
+
+	waitForCounter(t, s, "ipReasmFails", 1)
+}
+
+func Test_IPv4Reassembly_TimesOutWithTimeExceeded(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	stackLink, peer := link.NewPipe(link.IP, 1500)
+	s := New(logger.NewMockLogger().WithLogger(context.Background()), Options{Clock: clk})
+
+	_, err := s.AddInterface("s0", stackLink, addressA)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = peer.Close()
+	})
+
+	sendRaw(t, peer, fragmentedUDPPacket(t, make([]byte, 1000), 11, 576)[0])
+	waitForCounter(t, s, "ipReasmReqds", 1)
+
+	clk.Advance(ipv4ReassemblyTimeout - time.Second)
+	waitForCounter(t, s, "ipReasmFails", 0)
+
+	clk.Advance(time.Second)
+
+	_, exceeded := readICMPError(t, peer, icmp.TypeTimeExceeded, icmp.CodeFragmentReassemblyExceeded)
+
+	// The quote is cut short, so only its header is looked at
+	quoted := exceeded.Data
+	if binary.BigEndian.Uint16(quoted[4:6]) != 11 || quoted[6]>>5&ipv4.FlagMoreFragments == 0 {
+		t.Errorf("expected the first fragment to be quoted, got %x", quoted[:ipv4.MinHeaderLength])
+	}
+
+	waitForCounter(t, s, "ipReasmFails", 1)
+	waitForCounter(t, s, "icmpOutTimeExcds", 1)
+}
+
+func Test_IPv4Reassembly_GivesUpOnTheOldestWhenFull(t *testing.T) {
+	s, peer, _ := newStackWithRawPeer(t, link.IP)
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 4000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	datagrams := make([][]*ipv4.Packet, maxReassemblies+1)
+	for i := range datagrams {
+		datagrams[i] = fragmentedUDPPacket(t, bytes.Repeat([]byte{byte(i)}, 1000), uint16(100+i), 576)
+		sendRaw(t, peer, datagrams[i][0])
+		waitForCounter(t, s, "ipReasmReqds", uint64(i+1))
+	}
+
+	waitForCounter(t, s, "ipReasmFails", 1)
+
+	// The first datagram's start is gone, so the rest of it completes nothing, but the last one still can
+	for _, datagram := range [][]*ipv4.Packet{datagrams[0], datagrams[maxReassemblies]} {
+		for _, fragment := range datagram[1:] {
+			sendRaw(t, peer, fragment)
+		}
+	}
+
+	received, _ := readWithTimeout(t, conn)
+
+	if !bytes.Equal(received, bytes.Repeat([]byte{maxReassemblies}, 1000)) {
+		t.Errorf("expected only the newest datagram to be delivered, got one of %d", received[0])
+	}
+
+	waitForCounter(t, s, "ipReasmOKs", 1)
+}
@@ -0,0 +1,275 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+
+	"networking/internal/trace"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+)
+
+var ErrNoSourceAddress = errors.New("no usable source address")
+
+func (s *Stack) handleIPv6(ctx context.Context, nic *Interface, data []byte) {
+	ctx, span := trace.StartSpan(ctx, "ipv6")
+	defer span.Finish()
+
+	s.counters.IPv6.InReceives.Inc()
+
+	packet, err := ipv6.ParseRawPacket(ctx, data)
+	if err != nil {
+		s.counters.IPv6.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid IPv6 packet", "error", err.Error())
+		return
+	}
+
+	raw := data[:ipv6.HeaderLength+int(packet.PayloadLength)]
+	fields := []any{"src_ip", packet.Source.String(), "dst_ip", packet.Destination.String(), "proto", packet.Protocol}
+
+	if !nic.acceptsIPv6(packet.Destination) {
+		s.counters.IPv6.InAddrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "packet not addressed to us", fields...)
+		return
+	}
+
+	if !s.processExtensionHeaders(ctx, nic, packet, raw) {
+		return
+	}
+
+	if packet.FragmentHeader() != nil {
+		s.reassembleIPv6(ctx, nic, packet, raw)
+		return
+	}
+
+	s.deliverIPv6(ctx, nic, packet, raw)
+}
+
+// deliverIPv6 hands a whole packet, its extension headers dealt with, to the upper-layer protocol
+func (s *Stack) deliverIPv6(ctx context.Context, nic *Interface, packet *ipv6.Packet, raw []byte) {
+	fields := []any{"src_ip", packet.Source.String(), "dst_ip", packet.Destination.String(), "proto", packet.Protocol}
+
+	switch packet.Protocol {
+	case ipv6.NextHeaderUDP:
+		s.counters.IPv6.InDelivers.Inc()
+		if !s.handleUDP(ctx, nic, packet.Source, packet.Destination, packet.Payload) {
+			s.sendICMPv6Error(ctx, nic, packet, raw, icmpv6.NewError(icmpv6.TypeDestinationUnreachable, icmpv6.CodePortUnreachable, 0))
+		}
+	case ipv6.NextHeaderTCP:
+		s.counters.IPv6.InDelivers.Inc()
+		s.handleTCP(ctx, nic, packet.Source, packet.Destination, packet.Payload)
+	case ipv6.NextHeaderICMPv6:
+		s.counters.IPv6.InDelivers.Inc()
+		s.handleICMPv6(ctx, nic, packet, raw)
+	case ipv6.NextHeaderNoNext:
+		s.counters.IPv6.InDelivers.Inc()
+		trace.Annotate(ctx, trace.Delivered, "nothing after the headers", fields...)
+	default:
+		s.counters.IPv6.InUnknownProtos.Inc()
+		trace.Annotate(ctx, trace.Dropped, "unsupported protocol", fields...)
+
+		offsets := extensionHeaderOffsets(packet, raw)
+		pointer := 6
+		if len(packet.ExtensionHeaders) > 0 {
+			pointer = offsets[len(offsets)-2]
+		}
+
+		s.sendICMPv6Error(ctx, nic, packet, raw, icmpv6.NewError(icmpv6.TypeParameterProblem, icmpv6.CodeUnrecognizedNextHeader, uint32(pointer)))
+	}
+}
+
+// processExtensionHeaders acts on the headers in front of the upper layer (RFC 8200 4), returning false if the
+// packet has to be dropped. Headers after a fragment header wait for reassembly.
+func (s *Stack) processExtensionHeaders(ctx context.Context, nic *Interface, packet *ipv6.Packet, raw []byte) bool {
+	offsets := extensionHeaderOffsets(packet, raw)
+
+	for i, header := range packet.ExtensionHeaders {
+		start, end := offsets[i], offsets[i+1]
+
+		switch header.Type {
+		case ipv6.NextHeaderHopByHop, ipv6.NextHeaderDestinationOptions:
+			if !s.processOptions(ctx, nic, packet, raw, header.Type, start, end) {
+				return false
+			}
+		case ipv6.NextHeaderRouting:
+			// We know no routing types, and are never an intermediate node (RFC 8200 4.4)
+			if header.SegmentsLeft != 0 {
+				s.counters.IPv6.InHdrErrors.Inc()
+				trace.Annotate(ctx, trace.Dropped, "unrecognized routing header", "routing_type", header.RoutingType)
+				s.sendICMPv6Error(ctx, nic, packet, raw, icmpv6.NewError(icmpv6.TypeParameterProblem, icmpv6.CodeErroneousHeaderField, uint32(start+2)))
+
+				return false
+			}
+		case ipv6.NextHeaderFragment:
+			return true
+		}
+	}
+
+	return true
+}
+
+// processOptions looks for options we do not recognise between start and end, the bounds of an options header,
+// and does what their types say (RFC 8200 4.2)
+func (s *Stack) processOptions(ctx context.Context, nic *Interface, packet *ipv6.Packet, raw []byte, headerType uint8, start, end int) bool {
+	for offset := start + 2; offset < end; {
+		optionType := raw[offset]
+
+		if optionType == ipv6.OptionPad1 {
+			offset++
+			continue
+		}
+
+		length := 2 + int(raw[offset+1])
+
+		if optionType == ipv6.OptionPadN || (optionType == ipv6.OptionRouterAlert && headerType == ipv6.NextHeaderHopByHop) {
+			offset += length
+			continue
+		}
+
+		action := ipv6.Option{Type: optionType}.UnrecognizedAction()
+		if action == ipv6.OptionSkip {
+			offset += length
+			continue
+		}
+
+		s.counters.IPv6.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "unrecognized option", "option_type", optionType)
+
+		if action == ipv6.OptionDiscardAndReport || (action == ipv6.OptionDiscardAndReportUnlessMulticast && !packet.Destination.IsMulticast()) {
+			s.sendICMPv6Error(ctx, nic, packet, raw, icmpv6.NewError(icmpv6.TypeParameterProblem, icmpv6.CodeUnrecognizedOption, uint32(offset)))
+		}
+
+		return false
+	}
+
+	return true
+}
+
+// extensionHeaderOffsets returns where each of the packet's extension headers starts in raw, followed by where
+// the upper layer does
+func extensionHeaderOffsets(packet *ipv6.Packet, raw []byte) []int {
+	offsets := make([]int, 0, len(packet.ExtensionHeaders)+1)
+	offset := ipv6.HeaderLength
+
+	for _, header := range packet.ExtensionHeaders {
+		offsets = append(offsets, offset)
+
+		if header.Type == ipv6.NextHeaderFragment {
+			offset += 8
+		} else {
+			offset += (int(raw[offset+1]) + 1) * 8
+		}
+	}
+
+	return append(offsets, offset)
+}
+
+// sendIPv6 sends a packet out of nic, to the destination if it is on the link or to a router otherwise, filling in
+// the source address and hop limit if they are unset. Packets too big for the path MTU go in fragments, unless
+// discovery says they must not.
+func (s *Stack) sendIPv6(ctx context.Context, nic *Interface, packet *ipv6.Packet, discovery pmtuDiscovery) error {
+	ctx, span := trace.StartSpan(ctx, "ipv6")
+	defer span.Finish()
+
+	s.counters.IPv6.OutRequests.Inc()
+
+	if !packet.Source.IsValid() {
+		packet.Source = nic.ipv6Source(packet.Destination)
+	}
+
+	if !packet.Source.IsValid() {
+		s.counters.IPv6.OutNoRoutes.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no IPv6 source address", "iface", nic.Name, "dst_ip", packet.Destination.String())
+		return fmt.Errorf("%w: for %s on %s", ErrNoSourceAddress, packet.Destination, nic.Name)
+	}
+
+	nextHop, ok := nic.ipv6NextHop(packet.Destination)
+	if !ok {
+		s.counters.IPv6.OutNoRoutes.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no IPv6 route", "iface", nic.Name, "dst_ip", packet.Destination.String())
+		return fmt.Errorf("%w: %s", ErrNoRoute, packet.Destination)
+	}
+
+	if packet.HopLimit == 0 {
+		packet.HopLimit = ipv6.DefaultHopLimit
+	}
+
+	raw, err := packet.CreatePacket(ctx)
+	if err != nil {
+		s.counters.IPv6.OutDiscards.Inc()
+		trace.Annotate(ctx, trace.Dropped, "failed to create IPv6 packet", "error", err.Error())
+		return err
+	}
+
+	if mtu := s.pathMTU(nic, packet.Destination); len(raw) > mtu {
+		// Like IPV6_DONTFRAG, the packet is refused rather than fragmented
+		if discovery == pmtuDiscoveryDo {
+			s.counters.IPv6.OutDiscards.Inc()
+			trace.Annotate(ctx, trace.Dropped, "packet larger than the path MTU", "len", len(raw), "mtu", mtu)
+			return fmt.Errorf("%w: %d bytes to %s, path MTU %d", ErrMessageTooLong, len(raw), packet.Destination, mtu)
+		}
+
+		return s.fragmentIPv6(ctx, nic, nextHop, packet, mtu)
+	}
+
+	return s.writeIPv6(ctx, nic, nextHop, packet.Destination, raw)
+}
+
+// fragmentIPv6 sends a packet that is too big for the path to its destination as fragments (RFC 8200 4.5). Only
+// the source fragments in IPv6, so routers on the way send back Packet Too Big instead.
+func (s *Stack) fragmentIPv6(ctx context.Context, nic *Interface, nextHop netip.Addr, packet *ipv6.Packet, mtu int) error {
+	s.counters.IPv6.OutFragReqds.Inc()
+
+	// Like IPv4, identifications come from counters shared between destinations by hash (RFC 7739)
+	identification := s.nextIdentification(packet.Source, packet.Destination, ipv6.NextHeaderFragment)
+
+	fragments, err := packet.Fragment(mtu, identification)
+	if err != nil {
+		s.counters.IPv6.OutFragFails.Inc()
+		trace.Annotate(ctx, trace.Dropped, "failed to fragment IPv6 packet", "error", err.Error(), "mtu", mtu)
+		return err
+	}
+
+	for _, fragment := range fragments {
+		raw, err := fragment.CreatePacket(ctx)
+		if err == nil {
+			err = s.writeIPv6(ctx, nic, nextHop, packet.Destination, raw)
+		}
+
+		if err != nil {
+			s.counters.IPv6.OutFragFails.Inc()
+			return err
+		}
+
+		s.counters.IPv6.OutFragCreates.Inc()
+	}
+
+	s.counters.IPv6.OutFragOKs.Inc()
+
+	return nil
+}
+
+func (s *Stack) writeIPv6(ctx context.Context, nic *Interface, nextHop, destination netip.Addr, raw []byte) error {
+	if err := nic.writeIPv6(ctx, nextHop, raw); err != nil {
+		s.counters.IPv6.OutDiscards.Inc()
+		trace.Annotate(ctx, trace.Dropped, "link write failed", "error", err.Error())
+		return err
+	}
+
+	trace.Annotate(ctx, trace.Sent, "packet sent", "iface", nic.Name, "dst_ip", destination.String(), "len", len(raw))
+
+	return nil
+}
+
+// hasIPv6Address checks if addr is a usable IPv6 address on one of the stack's interfaces
+func (s *Stack) hasIPv6Address(addr netip.Addr) bool {
+	for _, nic := range s.Interfaces() {
+		if state, ok := nic.ipv6AddressState(addr); ok && state.isUsable() {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,322 @@
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/ipv6"
+	"networking/pkg/link"
+)
+
+const (
+	// RFC 4862 5.1: DupAddrDetectTransmits defaults to one solicitation
+	dadTransmits = 1
+	// RFC 4861 10: RetransTimer, the wait after each solicitation
+	dadRetransTimer = time.Second
+)
+
+// AddressState is how far an IPv6 address has got through duplicate address detection (RFC 4862 5.4)
+type AddressState uint8
+
+const (
+	// AddressTentative is being checked for duplicates. Packets to it are dropped and it is never a source.
+	AddressTentative AddressState = iota
+	AddressPreferred
+	// AddressDeprecated has outlived its preferred lifetime. Packets to it are still accepted, but new traffic is
+	// sent from a preferred address when there is one (RFC 4862 5.5.4).
+	AddressDeprecated
+	// AddressDuplicate is in use by another node on the link, so it is never used
+	AddressDuplicate
+)
+
+var addressStateNames = [...]string{
+	AddressTentative:  "tentative",
+	AddressPreferred:  "preferred",
+	AddressDeprecated: "deprecated",
+	AddressDuplicate:  "duplicate",
+}
+
+func (s AddressState) String() string {
+	if int(s) < len(addressStateNames) {
+		return addressStateNames[s]
+	}
+
+	return "unknown"
+}
+
+func (s AddressState) isUsable() bool {
+	return s == AddressPreferred || s == AddressDeprecated
+}
+
+var ErrAddressExists = errors.New("address already on the interface")
+
+// InterfaceAddress is one of an interface's IPv6 addresses
+type InterfaceAddress struct {
+	Prefix netip.Prefix
+	State  AddressState
+	// Autoconfigured addresses were formed by the stack rather than added (RFC 4862 5.3, 5.5.3)
+	Autoconfigured bool
+	// When the address is deprecated, and when it is removed. Zero means never.
+	PreferredUntil time.Time
+	ValidUntil     time.Time
+}
+
+type ipv6Address struct {
+	InterfaceAddress
+
+	// Neighbor solicitations still to send before the address is known to be ours
+	probesLeft int
+	timer      *wheelTimer
+	// Times a stable-privacy address has been formed again after duplicate address detection failed (RFC 7217 6)
+	dadCounter uint8
+	// Fires at the next preferred or valid lifetime to run out
+	lifetime *wheelTimer
+}
+
+// AddIPv6Address adds an IPv6 address to the interface. On Ethernet links it stays tentative while duplicate
+// address detection runs (RFC 4862 5.4), unless the stack was created with DisableDAD.
+func (nic *Interface) AddIPv6Address(prefix netip.Prefix) error {
+	addr := prefix.Addr()
+
+	if !addr.Is6() || (!ipv6.IsLinkLocal(addr) && !ipv6.IsGlobal(addr)) {
+		return fmt.Errorf("interface address must be IPv6 unicast: %s", prefix)
+	}
+
+	return nic.addIPv6Address(&ipv6Address{InterfaceAddress: InterfaceAddress{Prefix: prefix}})
+}
+
+func (nic *Interface) addIPv6Address(address *ipv6Address) error {
+	addr := address.Prefix.Addr()
+
+	nic.ipv6Mu.Lock()
+
+	if slices.ContainsFunc(nic.ipv6Addresses, func(a *ipv6Address) bool { return a.Prefix.Addr() == addr }) {
+		nic.ipv6Mu.Unlock()
+		return fmt.Errorf("%w: %s on %s", ErrAddressExists, addr, nic.Name)
+	}
+
+	address.State = AddressTentative
+	address.probesLeft = dadTransmits
+	address.timer = nic.stack.timers.newTimer(func() { nic.probeAddress(address) })
+	address.lifetime = nic.stack.timers.newTimer(func() { nic.expireAddress(address) })
+	nic.ipv6Addresses = append(nic.ipv6Addresses, address)
+
+	// Point to point links have no one else on them to clash with
+	if nic.stack.options.DisableDAD || nic.Link.Type() == link.IP {
+		address.State = AddressPreferred
+		nic.checkLifetimes(address)
+		nic.ipv6Mu.Unlock()
+
+		nic.addressPreferred(address)
+
+		return nil
+	}
+
+	nic.checkLifetimes(address)
+	nic.ipv6Mu.Unlock()
+
+	nic.probeAddress(address)
+
+	return nil
+}
+
+// IPv6Addresses returns the interface's IPv6 addresses in the order they were added
+func (nic *Interface) IPv6Addresses() []InterfaceAddress {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	addresses := make([]InterfaceAddress, len(nic.ipv6Addresses))
+	for i, address := range nic.ipv6Addresses {
+		addresses[i] = address.InterfaceAddress
+	}
+
+	return addresses
+}
+
+// probeAddress sends the next duplicate address detection solicitation for a tentative address, or makes it
+// preferred once they have all gone unanswered
+func (nic *Interface) probeAddress(address *ipv6Address) {
+	nic.ipv6Mu.Lock()
+
+	if address.State != AddressTentative || !slices.Contains(nic.ipv6Addresses, address) {
+		nic.ipv6Mu.Unlock()
+		return
+	}
+
+	if address.probesLeft == 0 {
+		address.State = AddressPreferred
+		nic.checkLifetimes(address)
+		nic.ipv6Mu.Unlock()
+
+		nic.stack.logger().Info("IPv6 address preferred", "iface", nic.Name, "address", address.Prefix.String())
+		nic.addressPreferred(address)
+
+		return
+	}
+
+	address.probesLeft--
+	address.timer.reset(dadRetransTimer)
+	nic.ipv6Mu.Unlock()
+
+	ctx, tr := nic.stack.startTrace()
+	defer tr.Finish()
+
+	trace.Annotate(ctx, trace.Sent, "duplicate address detection probe", "iface", nic.Name, "target", address.Prefix.Addr().String())
+
+	_ = nic.stack.sendDADProbe(ctx, nic, address.Prefix.Addr())
+}
+
+// addressIsDuplicate gives up on a tentative address someone else turns out to have. A stable-privacy address is
+// formed again with the next DAD counter, a few times over (RFC 7217 6).
+func (nic *Interface) addressIsDuplicate(addr netip.Addr) {
+	nic.ipv6Mu.Lock()
+
+	i := slices.IndexFunc(nic.ipv6Addresses, func(a *ipv6Address) bool {
+		return a.Prefix.Addr() == addr && a.State == AddressTentative
+	})
+
+	if i < 0 {
+		nic.ipv6Mu.Unlock()
+		return
+	}
+
+	address := nic.ipv6Addresses[i]
+	address.State = AddressDuplicate
+	address.timer.stop()
+
+	nic.stack.logger().Error("duplicate IPv6 address detected", "iface", nic.Name, "address", addr.String())
+
+	retry := address.Autoconfigured && len(nic.stack.options.StableSecret) > 0 && address.dadCounter < idgenRetries
+	if retry {
+		nic.removeIPv6Address(address)
+	}
+
+	nic.ipv6Mu.Unlock()
+
+	if retry {
+		nic.autoconfigureAgain(address)
+	}
+}
+
+// expireAddress deprecates or removes an address whose lifetime has run out
+func (nic *Interface) expireAddress(address *ipv6Address) {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	if slices.Contains(nic.ipv6Addresses, address) {
+		nic.checkLifetimes(address)
+	}
+}
+
+// checkLifetimes deprecates an address past its preferred lifetime, or removes it past its valid lifetime
+// (RFC 4862 5.5.4), and sets its timer for the next one to run out. The caller holds ipv6Mu.
+func (nic *Interface) checkLifetimes(address *ipv6Address) {
+	now := nic.stack.clock.Now()
+
+	if !address.ValidUntil.IsZero() && !now.Before(address.ValidUntil) {
+		nic.removeIPv6Address(address)
+		nic.stack.logger().Info("IPv6 address expired", "iface", nic.Name, "address", address.Prefix.String())
+
+		return
+	}
+
+	preferred := address.PreferredUntil.IsZero() || now.Before(address.PreferredUntil)
+
+	switch {
+	case address.State == AddressPreferred && !preferred:
+		address.State = AddressDeprecated
+		nic.stack.logger().Info("IPv6 address deprecated", "iface", nic.Name, "address", address.Prefix.String())
+	case address.State == AddressDeprecated && preferred:
+		address.State = AddressPreferred
+	}
+
+	next := address.ValidUntil
+	if preferred && !address.PreferredUntil.IsZero() && (next.IsZero() || address.PreferredUntil.Before(next)) {
+		next = address.PreferredUntil
+	}
+
+	if next.IsZero() {
+		address.lifetime.stop()
+		return
+	}
+
+	address.lifetime.reset(next.Sub(now))
+}
+
+// removeIPv6Address takes an address off the interface. The caller holds ipv6Mu.
+func (nic *Interface) removeIPv6Address(address *ipv6Address) {
+	nic.ipv6Addresses = slices.DeleteFunc(nic.ipv6Addresses, func(a *ipv6Address) bool { return a == address })
+	address.timer.stop()
+	address.lifetime.stop()
+}
+
+// ipv6AddressState returns the state of addr if it is one of the interface's addresses
+func (nic *Interface) ipv6AddressState(addr netip.Addr) (AddressState, bool) {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	for _, address := range nic.ipv6Addresses {
+		if address.Prefix.Addr() == addr {
+			return address.State, true
+		}
+	}
+
+	return 0, false
+}
+
+// acceptsIPv6 checks if a packet to destination is for us: a usable address of ours, all nodes, or the
+// solicited-node group of any address on the interface, tentative ones included so their probes are heard
+func (nic *Interface) acceptsIPv6(destination netip.Addr) bool {
+	if destination == ipv6.AllNodes {
+		return true
+	}
+
+	if destination.IsMulticast() {
+		nic.ipv6Mu.Lock()
+		defer nic.ipv6Mu.Unlock()
+
+		return slices.ContainsFunc(nic.ipv6Addresses, func(a *ipv6Address) bool {
+			return a.State != AddressDuplicate && ipv6.SolicitedNodeMulticast(a.Prefix.Addr()) == destination
+		})
+	}
+
+	return nic.stack.hasIPv6Address(destination)
+}
+
+// ipv6Source picks the address to send to destination from: link-local for destinations on the link only, and a
+// wider one otherwise when there is one (RFC 6724 5, rule 2), then a preferred one over a deprecated one (rule 3)
+func (nic *Interface) ipv6Source(destination netip.Addr) netip.Addr {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	linkScope := ipv6.IsLinkLocal(destination) || (destination.IsMulticast() && ipv6.MulticastScope(destination) <= ipv6.ScopeLinkLocal)
+	var best netip.Addr
+	bestScore := -1
+
+	for _, address := range nic.ipv6Addresses {
+		if !address.State.isUsable() {
+			continue
+		}
+
+		addr := address.Prefix.Addr()
+		score := 0
+
+		if ipv6.IsLinkLocal(addr) == linkScope {
+			score += 2
+		}
+
+		if address.State == AddressPreferred {
+			score++
+		}
+
+		if score > bestScore {
+			best, bestScore = addr, score
+		}
+	}
+
+	return best
+}
@@ -0,0 +1,147 @@
+package stack
+
+import (
+	"context"
+	"encoding/binary"
+	"slices"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+)
+
+const (
+	// RFC 8200 4.5: reassembly is given up 60 seconds after the first fragment of a datagram arrives
+	ipv6ReassemblyTimeout = 60 * time.Second
+
+	// Where the payload length is in the fixed header, which a fragment of the wrong length is pointed at
+	ipv6PayloadLengthOffset = 4
+)
+
+// reassembleIPv6 collects a fragment, and once every fragment of its datagram is in, puts the datagram back together
+// and delivers it (RFC 8200 4.5). An atomic fragment is a whole datagram already, so it is processed on its own
+// rather than joining fragments that happen to share its identification (RFC 6946).
+func (s *Stack) reassembleIPv6(ctx context.Context, nic *Interface, packet *ipv6.Packet, raw []byte) {
+	index := slices.IndexFunc(packet.ExtensionHeaders, func(h ipv6.ExtensionHeader) bool { return h.Type == ipv6.NextHeaderFragment })
+	header := packet.ExtensionHeaders[index]
+	fragmentStart := extensionHeaderOffsets(packet, raw)[index]
+	data := raw[fragmentStart+8:]
+	offset := int(header.FragmentOffset) * 8
+
+	fields := []any{
+		"src_ip", packet.Source.String(), "dst_ip", packet.Destination.String(), "id", header.Identification,
+		"offset", offset, "len", len(data), "more", header.MoreFragments,
+	}
+
+	if offset == 0 && !header.MoreFragments {
+		trace.Annotate(ctx, trace.Delivered, "atomic fragment processed on its own", fields...)
+		s.deliverReassembledIPv6(ctx, nic, raw, fragmentStart, data)
+		return
+	}
+
+	s.counters.IPv6.ReasmReqds.Inc()
+
+	// Every fragment but the last carries a whole number of 8 byte blocks
+	if header.MoreFragments && len(data)%8 != 0 {
+		s.counters.IPv6.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "fragment length not a multiple of 8", fields...)
+		s.sendICMPv6Error(ctx, nic, packet, raw, icmpv6.NewError(icmpv6.TypeParameterProblem, icmpv6.CodeErroneousHeaderField, ipv6PayloadLengthOffset))
+
+		return
+	}
+
+	if offset+len(data) > 0xFFFF {
+		s.counters.IPv6.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "fragment past the largest datagram", fields...)
+		s.sendICMPv6Error(ctx, nic, packet, raw, icmpv6.NewError(icmpv6.TypeParameterProblem, icmpv6.CodeErroneousHeaderField, uint32(fragmentStart+2)))
+
+		return
+	}
+
+	key := reassemblyKey{source: packet.Source, destination: packet.Destination, identification: header.Identification}
+
+	var first []byte
+	if offset == 0 {
+		first = slices.Clone(raw)
+	}
+
+	datagram, reason := s.ipv6Fragments.add(key, nic, reassemblyPiece{offset: offset, data: slices.Clone(data)}, header.MoreFragments, first, fragmentStart)
+	if reason != "" {
+		trace.Annotate(ctx, trace.Dropped, reason, fields...)
+		return
+	}
+
+	fragmentable, ok := s.ipv6Fragments.complete(key, datagram)
+	if !ok {
+		trace.Annotate(ctx, trace.Delivered, "fragment queued for reassembly", fields...)
+		return
+	}
+
+	s.counters.IPv6.ReasmOKs.Inc()
+	trace.Annotate(ctx, trace.Delivered, "datagram reassembled", "id", header.Identification, "len", len(fragmentable))
+
+	s.deliverReassembledIPv6(ctx, nic, datagram.first, datagram.headerLength, fragmentable)
+}
+
+// ipv6ReassemblyTimedOut tells the sender of a datagram whose fragments did not all arrive in time, if its first
+// fragment did (RFC 8200 4.5)
+func (s *Stack) ipv6ReassemblyTimedOut(key reassemblyKey, datagram *reassembly) {
+	ctx, tr := s.startTrace()
+	defer tr.Finish()
+
+	trace.Annotate(ctx, trace.Dropped, "fragment reassembly timed out", "src_ip", key.source.String(), "id", key.identification)
+
+	if datagram.first == nil {
+		return
+	}
+
+	packet, err := ipv6.ParseRawPacket(ctx, datagram.first)
+	if err != nil {
+		return
+	}
+
+	s.sendICMPv6Error(ctx, datagram.nic, packet, datagram.first, icmpv6.NewError(icmpv6.TypeTimeExceeded, icmpv6.CodeFragmentReassemblyExceeded, 0))
+}
+
+// deliverReassembledIPv6 rebuilds a datagram from the first fragment's headers in front of its fragment header and the
+// fragmentable part, then processes it as if it had arrived whole
+func (s *Stack) deliverReassembledIPv6(ctx context.Context, nic *Interface, first []byte, fragmentStart int, fragmentable []byte) {
+	// The fragment header's next header value moves to whichever header named the fragment header
+	nextHeaderOffset := 6
+	for offset := ipv6.HeaderLength; offset < fragmentStart; offset += (int(first[offset+1]) + 1) * 8 {
+		nextHeaderOffset = offset
+	}
+
+	whole := make([]byte, 0, fragmentStart+len(fragmentable))
+	whole = append(whole, first[:fragmentStart]...)
+	whole = append(whole, fragmentable...)
+	whole[nextHeaderOffset] = first[fragmentStart]
+
+	if len(whole)-ipv6.HeaderLength > 0xFFFF {
+		s.counters.IPv6.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "reassembled datagram too long", "len", len(whole))
+		return
+	}
+
+	binary.BigEndian.PutUint16(whole[ipv6PayloadLengthOffset:], uint16(len(whole)-ipv6.HeaderLength))
+
+	packet, err := ipv6.ParseRawPacket(ctx, whole)
+	if err != nil {
+		s.counters.IPv6.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid reassembled IPv6 packet", "error", err.Error())
+		return
+	}
+
+	if !s.processExtensionHeaders(ctx, nic, packet, whole) {
+		return
+	}
+
+	if packet.FragmentHeader() != nil {
+		s.counters.IPv6.InHdrErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "fragment header inside a fragment", "src_ip", packet.Source.String())
+		return
+	}
+
+	s.deliverIPv6(ctx, nic, packet, whole)
+}
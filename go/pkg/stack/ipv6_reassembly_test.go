@@ -0,0 +1,166 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	testhelpers "networking/internal/test_helpers"
+	"networking/internal/trace"
+	"networking/pkg/ethernet"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+	"networking/pkg/link"
+	"networking/pkg/udp"
+)
+
+// udpIPv6Packet wraps data in a UDP datagram, checksummed for the addresses, inside an IPv6 packet
+func udpIPv6Packet(t *testing.T, source, destination netip.AddrPort, data []byte) *ipv6.Packet {
+	t.Helper()
+
+	datagram := &udp.UDPGram{SourcePort: source.Port(), DestinationPort: destination.Port(), Data: data}
+	raw, err := datagram.CreateUDPGramForAddresses(context.TODO(), source.Addr(), destination.Addr())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return &ipv6.Packet{
+		HopLimit:    64,
+		Source:      source.Addr(),
+		Destination: destination.Addr(),
+		Protocol:    ipv6.NextHeaderUDP,
+		Payload:     raw,
+	}
+}
+
+// fragmentsOf splits packet into fragments of at most mtu bytes
+func fragmentsOf(t *testing.T, packet *ipv6.Packet, mtu int, identification uint32) []*ipv6.Packet {
+	t.Helper()
+
+	fragments, err := packet.Fragment(mtu, identification)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return fragments
+}
+
+func Test_IPv6Reassembly_DeliversFragmentsInAnyOrder(t *testing.T) {
+	s, _, peer, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv6Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	data := bytes.Repeat([]byte("fragmented "), 180)
+	packet := udpIPv6Packet(t, netip.AddrPortFrom(peerLinkLocal, 9000), netip.AddrPortFrom(stackLinkLocal.Addr(), 7), data)
+	fragments := fragmentsOf(t, packet, ipv6.MinMTU, 42)
+
+	for _, fragment := range slices.Backward(fragments) {
+		sendIPv6Raw(t, peer, ethernet.MAC{}, fragment)
+	}
+
+	received, from := readWithTimeout(t, conn)
+
+	if !bytes.Equal(received, data) || from != netip.AddrPortFrom(peerLinkLocal, 9000) {
+		t.Errorf("expected the whole datagram from %s:9000, got %d bytes from %s", peerLinkLocal, len(received), from)
+	}
+
+	waitForCounter(t, s, "ipv6ReasmReqds", uint64(len(fragments)))
+	waitForCounter(t, s, "ipv6ReasmOKs", 1)
+}
+
+func Test_IPv6Reassembly_AtomicFragmentStandsAlone(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	// The start of some other datagram with the same identification, left waiting
+	unfinished := udpIPv6Packet(t, netip.AddrPortFrom(peerLinkLocal, 9000), netip.AddrPortFrom(stackLinkLocal.Addr(), 7), make([]byte, 2000))
+	sendIPv6Raw(t, peer, ethernet.MAC{}, fragmentsOf(t, unfinished, ipv6.MinMTU, 5)[0])
+	waitForDecision(t, recorder, trace.Delivered, "fragment queued for reassembly")
+
+	atomic := icmpv6Packet(t, peerLinkLocal, stackLinkLocal.Addr(), 64, icmpv6.NewEcho(icmpv6.TypeEchoRequest, 7, 1, []byte("atomic")))
+	atomic.ExtensionHeaders = []ipv6.ExtensionHeader{ipv6.NewFragmentHeader(0, false, 5)}
+	sendIPv6Raw(t, peer, ethernet.MAC{}, atomic)
+
+	_, _, reply := readICMPv6(t, peer)
+
+	if reply.Type != icmpv6.TypeEchoReply || string(reply.Data) != "atomic" {
+		t.Errorf("expected the atomic fragment to be answered, got type %d with %q", reply.Type, reply.Data)
+	}
+
+	waitForCounter(t, s, "ipv6ReasmReqds", 1)
+	waitForCounter(t, s, "ipv6ReasmFails", 0)
+}
+
+func Test_IPv6Reassembly_OverlapDropsTheDatagram(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv6Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	packet := udpIPv6Packet(t, netip.AddrPortFrom(peerLinkLocal, 9000), netip.AddrPortFrom(stackLinkLocal.Addr(), 7), make([]byte, 2000))
+	fragments := fragmentsOf(t, packet, ipv6.MinMTU, 9)
+
+	// A second fragment that starts 8 bytes early rewrites the end of the first
+	overlapping := *fragments[1]
+	overlapping.ExtensionHeaders = []ipv6.ExtensionHeader{ipv6.NewFragmentHeader(fragments[1].ExtensionHeaders[0].FragmentOffset-1, false, 9)}
+	overlapping.Payload = append(make([]byte, 8), fragments[1].Payload...)
+
+	sendIPv6Raw(t, peer, ethernet.MAC{}, fragments[0])
+	sendIPv6Raw(t, peer, ethernet.MAC{}, &overlapping)
+	waitForDecision(t, recorder, trace.Dropped, "overlapping fragments")
+
+	// Nothing is left for the real second fragment to complete
+	sendIPv6Raw(t, peer, ethernet.MAC{}, fragments[1])
+	waitForDecision(t, recorder, trace.Delivered, "fragment queued for reassembly")
+
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, _, err := conn.ReadFromUDPAddrPort(make([]byte, 4096)); err == nil {
+		t.Errorf("expected nothing to be delivered")
+	}
+
+	waitForCounter(t, s, "ipv6ReasmFails", 1)
+}
+
+func Test_IPv6Reassembly_TimesOutWithTimeExceeded(t *testing.T) {
+	s, _, peer, clk, _ := newIPv6Stack(t, link.IP, Options{})
+
+	packet := udpIPv6Packet(t, netip.AddrPortFrom(peerLinkLocal, 9000), netip.AddrPortFrom(stackLinkLocal.Addr(), 7), make([]byte, 2000))
+	sendIPv6Raw(t, peer, ethernet.MAC{}, fragmentsOf(t, packet, ipv6.MinMTU, 11)[0])
+	waitForCounter(t, s, "ipv6ReasmReqds", 1)
+
+	clk.Advance(ipv6ReassemblyTimeout - time.Second)
+	waitForCounter(t, s, "ipv6ReasmFails", 0)
+
+	clk.Advance(time.Second)
+
+	_, _, exceeded := readICMPv6(t, peer)
+
+	if exceeded.Type != icmpv6.TypeTimeExceeded || exceeded.Code != icmpv6.CodeFragmentReassemblyExceeded {
+		t.Fatalf("expected fragment reassembly time exceeded, got type %d code %d", exceeded.Type, exceeded.Code)
+	}
+
+	// The quote is cut short at the minimum MTU, so only its headers are looked at
+	quoted := exceeded.Data
+	if quoted[6] != ipv6.NextHeaderFragment || binary.BigEndian.Uint16(quoted[42:44]) != 1 || binary.BigEndian.Uint32(quoted[44:48]) != 11 {
+		t.Errorf("expected the first fragment to be quoted, got %x", quoted[:48])
+	}
+
+	waitForCounter(t, s, "ipv6ReasmFails", 1)
+}
+
+func Test_IPv6Reassembly_FragmentsOfTheWrongLengthAreReported(t *testing.T) {
+	s, _, peer, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	packet := udpIPv6Packet(t, netip.AddrPortFrom(peerLinkLocal, 9000), netip.AddrPortFrom(stackLinkLocal.Addr(), 7), make([]byte, 2000))
+	fragment := fragmentsOf(t, packet, ipv6.MinMTU, 13)[0]
+	fragment.Payload = fragment.Payload[:len(fragment.Payload)-3]
+	sendIPv6Raw(t, peer, ethernet.MAC{}, fragment)
+
+	_, _, problem := readICMPv6(t, peer)
+
+	if problem.Type != icmpv6.TypeParameterProblem || problem.Code != icmpv6.CodeErroneousHeaderField || problem.Pointer() != 4 {
+		t.Errorf("expected a problem pointing at the payload length, got type %d code %d pointer %d", problem.Type, problem.Code, problem.Pointer())
+	}
+
+	waitForCounter(t, s, "ipv6InHdrErrors", 1)
+}
@@ -0,0 +1,241 @@
+package stack
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+	"networking/internal/trace"
+	"networking/pkg/ethernet"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+	"networking/pkg/link"
+)
+
+var (
+	stackLinkLocal = netip.MustParsePrefix("fe80::1/64")
+	peerLinkLocal  = netip.MustParseAddr("fe80::9")
+)
+
+// newIPv6Stack is a stack on a fake clock with fe80::1 on s0, returning the far end of its link for the test to
+// drive. The address is tentative on Ethernet links until the clock is advanced past duplicate address detection.
+func newIPv6Stack(t *testing.T, linkType link.Type, options Options) (*Stack, *Interface, *link.Pipe, *clock.Fake, *trace.RingRecorder) {
+	t.Helper()
+
+	s, nic, peer, clk, recorder := newUnaddressedIPv6Stack(t, linkType, options)
+	testhelpers.FailTestIfErrorIsPresent(t, nic.AddIPv6Address(stackLinkLocal))
+
+	return s, nic, peer, clk, recorder
+}
+
+// newUnaddressedIPv6Stack is newIPv6Stack without fe80::1, for tests that leave the stack to pick its own addresses
+func newUnaddressedIPv6Stack(t *testing.T, linkType link.Type, options Options) (*Stack, *Interface, *link.Pipe, *clock.Fake, *trace.RingRecorder) {
+	t.Helper()
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	recorder := trace.NewRingRecorder(64)
+	options.Clock = clk
+	options.TraceRecorder = recorder
+
+	s := New(logger.NewMockLogger().WithLogger(context.Background()), options)
+	stackLink, peer := link.NewPipe(linkType, 1500)
+
+	nic, err := s.AddInterface("s0", stackLink, addressA)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = peer.Close()
+	})
+
+	return s, nic, peer, clk, recorder
+}
+
+// icmpv6Packet wraps message in an IPv6 packet between source and destination
+func icmpv6Packet(t *testing.T, source, destination netip.Addr, hopLimit uint8, message *icmpv6.Message) *ipv6.Packet {
+	t.Helper()
+
+	raw, err := message.CreateMessage(context.TODO(), source, destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return &ipv6.Packet{
+		HopLimit:    hopLimit,
+		Source:      source,
+		Destination: destination,
+		Protocol:    ipv6.NextHeaderICMPv6,
+		Payload:     raw,
+	}
+}
+
+// sendIPv6Raw writes packet from the peer, in a frame to destination on Ethernet links
+func sendIPv6Raw(t *testing.T, peer *link.Pipe, destination ethernet.MAC, packet *ipv6.Packet) {
+	t.Helper()
+
+	raw, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if peer.Type() == link.Ethernet {
+		frame := &ethernet.Frame{Destination: destination, Source: peer.HardwareAddress(), EtherType: ethernet.EtherTypeIPv6, Payload: raw}
+		raw, err = frame.CreateFrame(context.TODO())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+	}
+
+	testhelpers.FailTestIfErrorIsPresent(t, peer.WritePacket(raw))
+}
+
+// readICMPv6 reads the next ICMPv6 message the stack sends, and the MAC it was sent to on Ethernet links
+func readICMPv6(t *testing.T, peer *link.Pipe) (ethernet.MAC, *ipv6.Packet, *icmpv6.Message) {
+	t.Helper()
+
+	raw, err := peer.ReadPacket()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	var destination ethernet.MAC
+
+	if peer.Type() == link.Ethernet {
+		frame, err := ethernet.ParseRawFrame(context.TODO(), raw)
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		if frame.EtherType != ethernet.EtherTypeIPv6 {
+			t.Fatalf("expected an IPv6 frame, got EtherType %#04x", frame.EtherType)
+		}
+
+		destination, raw = frame.Destination, frame.Payload
+	}
+
+	packet, err := ipv6.ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet.Protocol != ipv6.NextHeaderICMPv6 {
+		t.Fatalf("expected ICMPv6, got protocol %d", packet.Protocol)
+	}
+
+	message, err := icmpv6.ParseRawMessage(context.TODO(), packet.Source, packet.Destination, packet.Payload)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return destination, packet, message
+}
+
+func Test_IPv6_AnswersEchoRequests(t *testing.T) {
+	s, _, peer, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	request := icmpv6.NewEcho(icmpv6.TypeEchoRequest, 7, 1, []byte("ping"))
+	sendIPv6Raw(t, peer, ethernet.MAC{}, icmpv6Packet(t, peerLinkLocal, stackLinkLocal.Addr(), 64, request))
+
+	_, packet, reply := readICMPv6(t, peer)
+
+	if reply.Type != icmpv6.TypeEchoReply || reply.Identifier() != 7 || reply.SequenceNumber() != 1 || string(reply.Data) != "ping" {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+
+	if packet.Source != stackLinkLocal.Addr() || packet.Destination != peerLinkLocal || packet.HopLimit != ipv6.DefaultHopLimit {
+		t.Errorf("unexpected reply header: %+v", packet)
+	}
+
+	waitForCounter(t, s, "ipv6IfIcmpOutEchoReplies", 1)
+	waitForCounter(t, s, "ipv6InDelivers", 1)
+}
+
+func Test_IPv6_AnswersEchoToAllNodesFromOurAddress(t *testing.T) {
+	_, _, peer, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	request := icmpv6.NewEcho(icmpv6.TypeEchoRequest, 7, 2, nil)
+	sendIPv6Raw(t, peer, ethernet.MAC{}, icmpv6Packet(t, peerLinkLocal, ipv6.AllNodes, 64, request))
+
+	_, packet, reply := readICMPv6(t, peer)
+
+	if reply.Type != icmpv6.TypeEchoReply || packet.Source != stackLinkLocal.Addr() {
+		t.Errorf("expected a reply from %s, got type %d from %s", stackLinkLocal.Addr(), reply.Type, packet.Source)
+	}
+}
+
+func Test_IPv6_UnrecognizedNextHeaderIsReported(t *testing.T) {
+	s, _, peer, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	sendIPv6Raw(t, peer, ethernet.MAC{}, &ipv6.Packet{
+		HopLimit:         64,
+		Source:           peerLinkLocal,
+		Destination:      stackLinkLocal.Addr(),
+		ExtensionHeaders: []ipv6.ExtensionHeader{ipv6.NewDestinationOptionsHeader()},
+		Protocol:         253,
+		Payload:          []byte("experimental"),
+	})
+
+	_, _, problem := readICMPv6(t, peer)
+
+	if problem.Type != icmpv6.TypeParameterProblem || problem.Code != icmpv6.CodeUnrecognizedNextHeader {
+		t.Fatalf("expected an unrecognized next header problem, got type %d code %d", problem.Type, problem.Code)
+	}
+
+	// The destination options header's next header field is the one at fault
+	if problem.Pointer() != ipv6.HeaderLength || problem.Data[ipv6.HeaderLength] != 253 {
+		t.Errorf("expected pointer %d, got %d", ipv6.HeaderLength, problem.Pointer())
+	}
+
+	waitForCounter(t, s, "ipv6InUnknownProtos", 1)
+	waitForCounter(t, s, "ipv6IfIcmpOutParmProblems", 1)
+}
+
+func Test_IPv6_UnrecognizedOptionsFollowTheirType(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	send := func(optionType uint8, destination netip.Addr, sequence uint16) {
+		packet := icmpv6Packet(t, peerLinkLocal, destination, 64, icmpv6.NewEcho(icmpv6.TypeEchoRequest, 1, sequence, nil))
+		packet.ExtensionHeaders = []ipv6.ExtensionHeader{ipv6.NewDestinationOptionsHeader(ipv6.Option{Type: optionType, Data: []byte{0, 0}})}
+		sendIPv6Raw(t, peer, ethernet.MAC{}, packet)
+	}
+
+	// Skippable, so the echo is answered
+	send(0x1e, stackLinkLocal.Addr(), 1)
+
+	if _, _, reply := readICMPv6(t, peer); reply.Type != icmpv6.TypeEchoReply || reply.SequenceNumber() != 1 {
+		t.Fatalf("expected echo reply 1, got type %d", reply.Type)
+	}
+
+	// Discard and report, pointing at the option
+	send(0x9e, stackLinkLocal.Addr(), 2)
+
+	_, _, problem := readICMPv6(t, peer)
+	if problem.Type != icmpv6.TypeParameterProblem || problem.Code != icmpv6.CodeUnrecognizedOption || problem.Pointer() != ipv6.HeaderLength+2 {
+		t.Fatalf("expected an unrecognized option problem at %d, got type %d code %d pointer %d", ipv6.HeaderLength+2, problem.Type, problem.Code, problem.Pointer())
+	}
+
+	// Report unless multicast, and this one is
+	send(0xde, ipv6.AllNodes, 3)
+	waitForCounter(t, s, "ipv6InHdrErrors", 2)
+
+	// Discard quietly
+	send(0x5e, stackLinkLocal.Addr(), 4)
+	waitForCounter(t, s, "ipv6InHdrErrors", 3)
+
+	waitForDecision(t, recorder, trace.Dropped, "unrecognized option")
+	waitForCounter(t, s, "ipv6IfIcmpOutParmProblems", 1)
+}
+
+func Test_IPv6_RoutingHeaderWithSegmentsLeftIsReported(t *testing.T) {
+	_, _, peer, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	packet := icmpv6Packet(t, peerLinkLocal, stackLinkLocal.Addr(), 64, icmpv6.NewEcho(icmpv6.TypeEchoRequest, 1, 1, nil))
+	packet.ExtensionHeaders = []ipv6.ExtensionHeader{ipv6.NewRoutingHeader(0, 1, make([]byte, 20))}
+	sendIPv6Raw(t, peer, ethernet.MAC{}, packet)
+
+	_, _, problem := readICMPv6(t, peer)
+
+	if problem.Type != icmpv6.TypeParameterProblem || problem.Code != icmpv6.CodeErroneousHeaderField || problem.Pointer() != ipv6.HeaderLength+2 {
+		t.Errorf("expected a problem with the routing type, got type %d code %d pointer %d", problem.Type, problem.Code, problem.Pointer())
+	}
+}
+
+func Test_IPv6_NotForUs(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	request := icmpv6.NewEcho(icmpv6.TypeEchoRequest, 7, 1, nil)
+	sendIPv6Raw(t, peer, ethernet.MAC{}, icmpv6Packet(t, peerLinkLocal, netip.MustParseAddr("fe80::2"), 64, request))
+
+	waitForDecision(t, recorder, trace.Dropped, "packet not addressed to us")
+	waitForCounter(t, s, "ipv6InAddrErrors", 1)
+}
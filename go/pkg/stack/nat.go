@@ -0,0 +1,502 @@
+package stack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"iter"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/trace"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+	"networking/pkg/tcp"
+	"networking/pkg/udp"
+)
+
+// Offsets of the fields translation rewrites, from the start of the IPv4 or transport header
+const (
+	ipChecksumOffset     = 10
+	ipSourceOffset       = 12
+	ipDestinationOffset  = 16
+	udpChecksumOffset    = 6
+	tcpFlagsOffset       = 13
+	tcpChecksumOffset    = 16
+	icmpChecksumOffset   = 2
+	icmpIdentifierOffset = 4
+)
+
+var ErrNoSuchNATRule = errors.New("no such NAT rule")
+
+// NATRule translates the source of packets forwarded out of Interface, so replies come back to this stack, which
+// hands them on to the host that sent the original. UDP and TCP source ports and ICMP echo identifiers are kept if
+// they are free, and swapped for free ones if not.
+type NATRule struct {
+	// Interface is the name of the interface the packets go out of
+	Interface string
+	// Source limits the rule to packets from this prefix. Left unset, it matches every source.
+	Source netip.Prefix
+	// To is the address sources are rewritten to. Left unset, it is the address of the interface at the time, which
+	// is masquerading.
+	To netip.Addr
+}
+
+// natTable holds the NAT rules, first match wins
+type natTable struct {
+	mu    sync.RWMutex
+	rules []natRule
+
+	// Set once there has been a rule, from when flows have to be tracked
+	enabled atomic.Bool
+}
+
+type natRule struct {
+	NATRule
+	nic *Interface
+}
+
+func newNATTable() *natTable {
+	return &natTable{}
+}
+
+// AddNATRule adds a source NAT rule after the existing ones
+func (s *Stack) AddNATRule(rule NATRule) error {
+	if rule.Source.IsValid() && !rule.Source.Addr().Is4() {
+		return fmt.Errorf("NAT source must be an IPv4 prefix: %s", rule.Source)
+	}
+
+	if rule.To.IsValid() && !rule.To.Is4() {
+		return fmt.Errorf("NAT address must be IPv4: %s", rule.To)
+	}
+
+	nic := s.interfaceByName(rule.Interface)
+	if nic == nil {
+		return fmt.Errorf("%w: %s", ErrNoSuchInterface, rule.Interface)
+	}
+
+	rule.Source = rule.Source.Masked()
+
+	s.nat.mu.Lock()
+	defer s.nat.mu.Unlock()
+
+	s.nat.rules = append(s.nat.rules, natRule{NATRule: rule, nic: nic})
+	s.nat.enabled.Store(true)
+
+	return nil
+}
+
+// DeleteNATRule removes the first rule equal to rule. Flows it has already translated carry on being translated
+// until they expire.
+func (s *Stack) DeleteNATRule(rule NATRule) error {
+	rule.Source = rule.Source.Masked()
+
+	s.nat.mu.Lock()
+	defer s.nat.mu.Unlock()
+
+	for i, existing := range s.nat.rules {
+		if existing.NATRule == rule {
+			s.nat.rules = append(s.nat.rules[:i:i], s.nat.rules[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w: %s from %s", ErrNoSuchNATRule, rule.Interface, rule.Source)
+}
+
+// NATRules returns the NAT rules in the order they are matched
+func (s *Stack) NATRules() []NATRule {
+	s.nat.mu.RLock()
+	defer s.nat.mu.RUnlock()
+
+	rules := make([]NATRule, len(s.nat.rules))
+	for i, rule := range s.nat.rules {
+		rules[i] = rule.NATRule
+	}
+
+	return rules
+}
+
+// match finds the address a packet from source going out of out is translated to, if any rule says it is
+func (t *natTable) match(out *Interface, source netip.Addr) (netip.Addr, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for _, rule := range t.rules {
+		if rule.nic != out || (rule.Source.IsValid() && !rule.Source.Contains(source)) {
+			continue
+		}
+
+		if rule.To.IsValid() {
+			return rule.To, true
+		}
+
+		return out.Address.Addr(), true
+	}
+
+	return netip.Addr{}, false
+}
+
+// conntrackInbound finds the flow an arriving packet belongs to, before the stack decides if it is for us (Linux's
+// PREROUTING), and undoes the translation of replies to translated flows so they go on to the host behind it.
+// Returns the packet as it now is, and its flow.
+func (s *Stack) conntrackInbound(ctx context.Context, packet *ipv4.Packet, data []byte) (*ipv4.Packet, conntrackFlow) {
+	flow, quoted := s.classify(packet, data[packet.HeaderLength():packet.TotalLength])
+	if flow.entry == nil || flow.direction != conntrackReply || !flow.entry.translated() {
+		return packet, flow
+	}
+
+	if flow.state == FlowRelated {
+		translateICMPError(packet, data, quoted, flow)
+	} else {
+		translate(newPacketView(data), flow)
+	}
+
+	return s.reparse(ctx, packet, data), flow
+}
+
+// conntrackForward tracks a packet being forwarded out of out (Linux's POSTROUTING), starting a flow for it if it is
+// the first, and translates its source if its flow is translated. raw is the packet to be sent, which is rewritten
+// in place. flow is the flow conntrackInbound found. Returns the packet as it now is, or false if it has to be
+// dropped.
+func (s *Stack) conntrackForward(ctx context.Context, out *Interface, packet *ipv4.Packet, raw []byte, flow conntrackFlow) (*ipv4.Packet, bool) {
+	fields := []any{"src_ip", packet.Source.String(), "dst_ip", packet.Destination.String(), "proto", packet.Protocol}
+
+	if flow.state == FlowRelated {
+		// Looked up again to get at the quote in the copy being sent
+		if related, quoted, ok := s.relatedFlow(packet, raw[packet.HeaderLength():packet.TotalLength]); ok &&
+			related.direction == conntrackOriginal && related.entry.translated() {
+			translateICMPError(packet, raw, quoted, related)
+			return s.reparse(ctx, packet, raw), true
+		}
+
+		return packet, true
+	}
+
+	if flow.entry == nil {
+		tuple, ok := packetTuple(packet)
+		to, translating := s.nat.match(out, packet.Source)
+
+		if !ok && translating {
+			s.counters.IP.InDiscards.Inc()
+			trace.Annotate(ctx, trace.Dropped, "cannot translate a packet with no flow of its own", fields...)
+			return nil, false
+		}
+
+		if !ok {
+			return packet, true
+		}
+
+		replies := func(yield func(conntrackTuple) bool) { yield(tuple.inverse()) }
+		if translating {
+			replies = s.natReplies(tuple, to)
+		}
+
+		entry, added := s.conntrack.add(tuple, tcpFlags(packet), replies)
+		if !added {
+			s.counters.IP.InDiscards.Inc()
+			trace.Annotate(ctx, trace.Dropped, "no room to track flow", fields...)
+			return nil, false
+		}
+
+		flow = conntrackFlow{entry: entry, direction: conntrackOriginal, state: FlowNew}
+
+		if translating {
+			trace.Annotate(ctx, trace.Queued, "flow translated", append(fields, "to", entry.tuples[conntrackReply].destination.String())...)
+		}
+	}
+
+	if flow.direction != conntrackOriginal || !flow.entry.translated() {
+		return packet, true
+	}
+
+	translate(newPacketView(raw), flow)
+
+	return s.reparse(ctx, packet, raw), true
+}
+
+// natReplies are the reply tuples a flow translated to the address to can have: its own port first, then every
+// other port in the same range, from a point picked by hash so flows do not all fight over the first few
+func (s *Stack) natReplies(original conntrackTuple, to netip.Addr) iter.Seq[conntrackTuple] {
+	return func(yield func(conntrackTuple) bool) {
+		reply := original.inverse()
+		port := original.source.Port()
+
+		// An echo's identifier, or an echo reply's lack of one, is only in the tuple when there is one to translate
+		if port == 0 {
+			reply.destination = netip.AddrPortFrom(to, 0)
+			yield(reply)
+
+			return
+		}
+
+		try := func(candidate uint16) bool {
+			reply.destination = netip.AddrPortFrom(to, candidate)
+			if s.isLocalPortInUse(original.protocol, reply.destination) {
+				return true
+			}
+
+			return yield(reply)
+		}
+
+		if !try(port) {
+			return
+		}
+
+		// Like Linux, privileged ports are only swapped for other privileged ports
+		low, high := uint32(1024), uint32(65535)
+		if original.protocol == ipv4.ProtocolICMP {
+			low = 1
+		} else if port < 1024 {
+			low, high = 1, 1023
+		}
+
+		span := high - low + 1
+		data := binary.BigEndian.AppendUint16(append(original.source.Addr().AsSlice(), original.destination.Addr().AsSlice()...), original.destination.Port())
+		start := s.keyedHash(append(data, original.protocol)) % span
+
+		for i := range span {
+			candidate := uint16(low + (start+i)%span)
+			if candidate != port && !try(candidate) {
+				return
+			}
+		}
+	}
+}
+
+// isLocalPortInUse checks if one of our own sockets has the address a translated flow would be given, so its
+// traffic is not taken for the flow's replies
+func (s *Stack) isLocalPortInUse(protocol uint8, local netip.AddrPort) bool {
+	switch protocol {
+	case ipv4.ProtocolUDP:
+		return s.udp.isPortInUse(local)
+	case ipv4.ProtocolTCP:
+		return s.tcp.isPortInUse(local.Port())
+	default:
+		return false
+	}
+}
+
+// reparse parses a packet again after it has been rewritten, which keeps its checksum right
+func (s *Stack) reparse(ctx context.Context, packet *ipv4.Packet, raw []byte) *ipv4.Packet {
+	rewritten, err := ipv4.ParseRawPacket(ctx, raw)
+	if err != nil {
+		return packet
+	}
+
+	return rewritten
+}
+
+// relatedFlow finds the flow an ICMP error is about from the header it quotes, and which way the error is going in
+// that flow. The quoted packet went the other way, so it is turned around for the lookup. message is the error in
+// whichever buffer the quote is to be rewritten in.
+func (s *Stack) relatedFlow(packet *ipv4.Packet, message []byte) (conntrackFlow, packetView, bool) {
+	if packet.Protocol != ipv4.ProtocolICMP || packet.IsFragment() || !isICMPError(packet.Payload) ||
+		len(packet.Payload) < icmp.HeaderLength+ipv4.MinHeaderLength {
+		return conntrackFlow{}, packetView{}, false
+	}
+
+	// The quote has to have the first 8 bytes of the transport header (RFC 792)
+	quoted := newPacketView(message[icmp.HeaderLength:])
+	if quoted.raw[0]>>4 != ipv4.Version || quoted.headerLength < ipv4.MinHeaderLength ||
+		len(quoted.raw) < quoted.headerLength+udp.HeaderLength {
+		return conntrackFlow{}, packetView{}, false
+	}
+
+	entry, direction, ok := s.conntrack.lookup(quoted.tuple().inverse())
+	if !ok {
+		return conntrackFlow{}, packetView{}, false
+	}
+
+	return conntrackFlow{entry: entry, direction: direction, state: FlowRelated}, quoted, true
+}
+
+// translateICMPError rewrites an ICMP error about a translated flow: the error's own address like any other packet
+// going its way, and the other end of the packet it quotes, which went the other way
+func translateICMPError(packet *ipv4.Packet, raw []byte, quoted packetView, flow conntrackFlow) {
+	outer := newPacketView(raw[:packet.TotalLength])
+
+	if flow.direction == conntrackOriginal {
+		to := flow.entry.tuples[conntrackReply].destination
+		outer.setAddress(ipSourceOffset, to.Addr())
+		quoted.setAddress(ipDestinationOffset, to.Addr())
+		quoted.setPort(false, to.Port())
+	} else {
+		to := flow.entry.tuples[conntrackOriginal].source
+		outer.setAddress(ipDestinationOffset, to.Addr())
+		quoted.setAddress(ipSourceOffset, to.Addr())
+		quoted.setPort(true, to.Port())
+	}
+
+	// The quote may be cut short anywhere, so the ICMP checksum is worked out again rather than updated
+	message := raw[packet.HeaderLength():packet.TotalLength]
+	message[icmpChecksumOffset], message[icmpChecksumOffset+1] = 0, 0
+	copy(message[icmpChecksumOffset:], bytehelpers.Uint16ToByteArray(bytehelpers.CreateOnesComplementChecksum(message)))
+}
+
+// translate rewrites a packet in a translated flow: the source of one going out, and the destination of a reply
+// coming back to what the original's source was
+func translate(view packetView, flow conntrackFlow) {
+	if flow.direction == conntrackOriginal {
+		to := flow.entry.tuples[conntrackReply].destination
+		view.setAddress(ipSourceOffset, to.Addr())
+		view.setPort(true, to.Port())
+
+		return
+	}
+
+	to := flow.entry.tuples[conntrackOriginal].source
+	view.setAddress(ipDestinationOffset, to.Addr())
+	view.setPort(false, to.Port())
+}
+
+func tcpFlags(packet *ipv4.Packet) tcp.Flags {
+	if packet.Protocol != ipv4.ProtocolTCP || len(packet.Payload) <= tcpFlagsOffset {
+		return 0
+	}
+
+	return tcp.Flags(packet.Payload[tcpFlagsOffset])
+}
+
+// transportHeaderLength is how much of a transport header translation needs, to get at its checksum
+func transportHeaderLength(protocol uint8) int {
+	if protocol == ipv4.ProtocolTCP {
+		return tcp.MinHeaderLength
+	}
+
+	return udp.HeaderLength
+}
+
+// packetView edits a raw IPv4 packet in place, updating its checksums as it goes (RFC 1624). The packet may be a
+// quote in an ICMP error that stops partway through, in which case whatever is past the end is left alone.
+type packetView struct {
+	raw          []byte
+	headerLength int
+	protocol     uint8
+}
+
+func newPacketView(raw []byte) packetView {
+	if len(raw) < ipv4.MinHeaderLength {
+		return packetView{raw: raw}
+	}
+
+	return packetView{raw: raw, headerLength: int(raw[0]&0x0F) * 4, protocol: raw[9]}
+}
+
+// tuple is the flow tuple of the packet, with only as much of the transport header as an ICMP error quotes
+func (v packetView) tuple() conntrackTuple {
+	tuple := conntrackTuple{
+		protocol:    v.protocol,
+		source:      netip.AddrPortFrom(netip.AddrFrom4([4]byte(v.raw[ipSourceOffset:])), 0),
+		destination: netip.AddrPortFrom(netip.AddrFrom4([4]byte(v.raw[ipDestinationOffset:])), 0),
+	}
+
+	transport := v.raw[v.headerLength:]
+
+	switch v.protocol {
+	case ipv4.ProtocolUDP, ipv4.ProtocolTCP:
+		tuple.source = netip.AddrPortFrom(tuple.source.Addr(), binary.BigEndian.Uint16(transport[0:2]))
+		tuple.destination = netip.AddrPortFrom(tuple.destination.Addr(), binary.BigEndian.Uint16(transport[2:4]))
+	case ipv4.ProtocolICMP:
+		identifier := binary.BigEndian.Uint16(transport[icmpIdentifierOffset:])
+
+		switch transport[0] {
+		case icmp.TypeEchoRequest:
+			tuple.source = netip.AddrPortFrom(tuple.source.Addr(), identifier)
+		case icmp.TypeEchoReply:
+			tuple.destination = netip.AddrPortFrom(tuple.destination.Addr(), identifier)
+		}
+	}
+
+	return tuple
+}
+
+// transportChecksum is the offset of the transport checksum, if the packet has one and it is there to update
+func (v packetView) transportChecksum() (int, bool) {
+	offset := v.headerLength
+
+	switch v.protocol {
+	case ipv4.ProtocolUDP:
+		offset += udpChecksumOffset
+	case ipv4.ProtocolTCP:
+		offset += tcpChecksumOffset
+	case ipv4.ProtocolICMP:
+		offset += icmpChecksumOffset
+	default:
+		return 0, false
+	}
+
+	if offset+2 > len(v.raw) {
+		return 0, false
+	}
+
+	// A UDP checksum of zero means there is none (RFC 768)
+	if v.protocol == ipv4.ProtocolUDP && binary.BigEndian.Uint16(v.raw[offset:]) == 0 {
+		return 0, false
+	}
+
+	return offset, true
+}
+
+// setWord writes a 16-bit word at offset, updating the IP header checksum if the word is in the header, and the
+// transport checksum if it covers the word
+func (v packetView) setWord(offset int, value uint16, coveredByTransport bool) {
+	if offset+2 > len(v.raw) {
+		return
+	}
+
+	before := binary.BigEndian.Uint16(v.raw[offset:])
+	binary.BigEndian.PutUint16(v.raw[offset:], value)
+
+	if offset < v.headerLength {
+		v.updateChecksum(ipChecksumOffset, before, value)
+	}
+
+	if at, ok := v.transportChecksum(); ok && coveredByTransport {
+		updated := v.updateChecksum(at, before, value)
+
+		// Nor can an updated one be left as zero, which is written as all ones instead
+		if v.protocol == ipv4.ProtocolUDP && updated == 0 {
+			binary.BigEndian.PutUint16(v.raw[at:], 0xFFFF)
+		}
+	}
+}
+
+func (v packetView) updateChecksum(at int, before, after uint16) uint16 {
+	updated := bytehelpers.UpdateChecksum(binary.BigEndian.Uint16(v.raw[at:]), before, after)
+	binary.BigEndian.PutUint16(v.raw[at:], updated)
+
+	return updated
+}
+
+// setAddress rewrites the address at offset, which UDP and TCP checksums cover through their pseudo-header
+func (v packetView) setAddress(offset int, address netip.Addr) {
+	bytes := address.As4()
+	covered := v.protocol == ipv4.ProtocolUDP || v.protocol == ipv4.ProtocolTCP
+
+	v.setWord(offset, binary.BigEndian.Uint16(bytes[0:2]), covered)
+	v.setWord(offset+2, binary.BigEndian.Uint16(bytes[2:4]), covered)
+}
+
+// setPort rewrites the source or destination port, or an ICMP echo's identifier, which stands in for either. A zero
+// port means the flow has none to rewrite.
+func (v packetView) setPort(source bool, port uint16) {
+	if port == 0 {
+		return
+	}
+
+	switch v.protocol {
+	case ipv4.ProtocolUDP, ipv4.ProtocolTCP:
+		offset := v.headerLength + 2
+		if source {
+			offset = v.headerLength
+		}
+
+		v.setWord(offset, port, true)
+	case ipv4.ProtocolICMP:
+		v.setWord(v.headerLength+icmpIdentifierOffset, port, true)
+	}
+}
@@ -0,0 +1,333 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/clock"
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+	"networking/pkg/link"
+	"networking/pkg/udp"
+)
+
+// routerAddress is the address newRouter's r1 masquerades as
+var routerAddress = netip.MustParseAddr("10.0.2.1")
+
+// newMasqueradingRouter is newRouter masquerading everything it forwards out of r1
+func newMasqueradingRouter(t *testing.T, options Options) (*Stack, *link.Pipe, *link.Pipe) {
+	t.Helper()
+
+	router, left, right := newRouterWithOptions(t, 1500, options)
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddNATRule(NATRule{Interface: "r1"}))
+
+	return router, left, right
+}
+
+func udpPacket(t *testing.T, source, destination netip.AddrPort) *ipv4.Packet {
+	t.Helper()
+
+	gram := &udp.UDPGram{SourcePort: source.Port(), DestinationPort: destination.Port(), Data: []byte("query")}
+	raw, err := gram.CreateUDPGramForAddresses(context.TODO(), source.Addr(), destination.Addr())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return &ipv4.Packet{TTL: ipv4.DefaultTTL, Protocol: ipv4.ProtocolUDP, Source: source.Addr(), Destination: destination.Addr(), Payload: raw}
+}
+
+// readUDP reads a UDP packet, checking its checksum still holds for the addresses it has now
+func readUDP(t *testing.T, peer *link.Pipe) (netip.AddrPort, netip.AddrPort) {
+	t.Helper()
+
+	packet := readRaw(t, peer)
+
+	gram, err := udp.ParseRawUDPGram(context.TODO(), packet.Payload)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet.Protocol != ipv4.ProtocolUDP || !gram.IsChecksumValid(packet.Source, packet.Destination) {
+		t.Fatalf("expected a UDP packet with a valid checksum, got protocol %d", packet.Protocol)
+	}
+
+	return netip.AddrPortFrom(packet.Source, gram.SourcePort), netip.AddrPortFrom(packet.Destination, gram.DestinationPort)
+}
+
+func Test_NAT_MasqueradesAndReversesReplies(t *testing.T) {
+	router, left, right := newMasqueradingRouter(t, Options{})
+	client := netip.AddrPortFrom(leftHost, 5000)
+	server := netip.AddrPortFrom(rightHost, 53)
+
+	sendRaw(t, left, udpPacket(t, client, server))
+
+	source, destination := readUDP(t, right)
+	if source != netip.AddrPortFrom(routerAddress, 5000) || destination != server {
+		t.Fatalf("expected %s to %s to go out from the router's address, got %s to %s", client, server, source, destination)
+	}
+
+	sendRaw(t, right, udpPacket(t, server, source))
+
+	source, destination = readUDP(t, left)
+	if source != server || destination != client {
+		t.Fatalf("expected the reply to go back to %s, got %s to %s", client, source, destination)
+	}
+
+	flows := router.TrackedFlows()
+	if len(flows) != 1 || !flows[0].Replied || flows[0].ReplyDestination != netip.AddrPortFrom(routerAddress, 5000) {
+		t.Errorf("expected one replied flow translated to the router's address, got %+v", flows)
+	}
+}
+
+func Test_NAT_MovesClashingPorts(t *testing.T) {
+	router, left, right := newMasqueradingRouter(t, Options{})
+	server := netip.AddrPortFrom(rightHost, 53)
+
+	// The router's own socket already has 6000
+	conn, err := router.ListenUDP(netip.AddrPortFrom(routerAddress, 6000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	defer conn.Close()
+
+	expectations := []struct {
+		client netip.AddrPort
+		moved  bool
+	}{
+		{netip.MustParseAddrPort("10.0.1.9:5000"), false},
+		{netip.MustParseAddrPort("10.0.1.8:5000"), true},
+		{netip.MustParseAddrPort("10.0.1.9:6000"), true},
+		{netip.MustParseAddrPort("10.0.1.9:53"), false},
+		{netip.MustParseAddrPort("10.0.1.8:53"), true},
+	}
+
+	for _, expected := range expectations {
+		sendRaw(t, left, udpPacket(t, expected.client, server))
+
+		source, _ := readUDP(t, right)
+		moved := source.Port() != expected.client.Port()
+		privileged := source.Port() < 1024
+
+		if moved != expected.moved || privileged != (expected.client.Port() < 1024) {
+			t.Errorf("%s went out as %s, expected it moved: %v, and privileged ports kept privileged", expected.client, source, expected.moved)
+		}
+	}
+}
+
+func Test_NAT_TranslatesEchoIdentifiers(t *testing.T) {
+	_, left, right := newMasqueradingRouter(t, Options{})
+
+	ping := func(source netip.Addr) *ipv4.Packet {
+		raw, err := icmp.NewEcho(icmp.TypeEchoRequest, 0x0101, 1, []byte("ping")).CreateMessage(context.TODO())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		return &ipv4.Packet{TTL: ipv4.DefaultTTL, Protocol: ipv4.ProtocolICMP, Source: source, Destination: rightHost, Payload: raw}
+	}
+
+	readEcho := func(peer *link.Pipe) (*ipv4.Packet, *icmp.Message) {
+		packet := readRaw(t, peer)
+
+		message, err := icmp.ParseRawMessage(context.TODO(), packet.Payload)
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		return packet, message
+	}
+
+	sendRaw(t, left, ping(leftHost))
+	_, first := readEcho(right)
+
+	sendRaw(t, left, ping(netip.MustParseAddr("10.0.1.8")))
+	_, second := readEcho(right)
+
+	if first.Identifier() != 0x0101 || second.Identifier() == 0x0101 {
+		t.Fatalf("expected the second host's identifier to be moved, got %#04x and %#04x", first.Identifier(), second.Identifier())
+	}
+
+	raw, err := icmp.NewEcho(icmp.TypeEchoReply, second.Identifier(), 1, []byte("ping")).CreateMessage(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	sendRaw(t, right, &ipv4.Packet{TTL: ipv4.DefaultTTL, Protocol: ipv4.ProtocolICMP, Source: rightHost, Destination: routerAddress, Payload: raw})
+
+	packet, reply := readEcho(left)
+	if packet.Destination != netip.MustParseAddr("10.0.1.8") || reply.Type != icmp.TypeEchoReply || reply.Identifier() != 0x0101 {
+		t.Errorf("expected the reply back at 10.0.1.8 with its own identifier, got %s with %#04x", packet.Destination, reply.Identifier())
+	}
+}
+
+func Test_NAT_RewritesTheHeaderQuotedInICMPErrors(t *testing.T) {
+	_, left, right := newMasqueradingRouter(t, Options{})
+	client := netip.AddrPortFrom(leftHost, 5000)
+
+	sendRaw(t, left, udpPacket(t, client, netip.AddrPortFrom(rightHost, 53)))
+	translated := readRaw(t, right)
+
+	quoted, err := translated.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	unreachable := &icmp.Message{Type: icmp.TypeDestinationUnreachable, Code: icmp.CodePortUnreachable, Data: quoted[:translated.HeaderLength()+8]}
+	raw, err := unreachable.CreateMessage(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	sendRaw(t, right, &ipv4.Packet{TTL: ipv4.DefaultTTL, Protocol: ipv4.ProtocolICMP, Source: rightHost, Destination: routerAddress, Payload: raw})
+
+	// Parsing checks the ICMP checksum
+	packet, message := readICMPError(t, left, icmp.TypeDestinationUnreachable, icmp.CodePortUnreachable)
+	header := message.Data[:translated.HeaderLength()]
+
+	if packet.Destination != leftHost || netip.AddrFrom4([4]byte(header[12:16])) != leftHost ||
+		bytehelpers.ByteArrayToUint16(message.Data[len(header):]) != client.Port() {
+		t.Fatalf("expected the error and the header it quotes to be back to %s, got %s and %x", client, packet.Destination, message.Data)
+	}
+
+	if bytehelpers.CreateOnesComplementChecksum(header) != 0 {
+		t.Errorf("expected the quoted header's checksum to be kept right")
+	}
+}
+
+func Test_NAT_FlowsExpire(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	router, left, right := newMasqueradingRouter(t, Options{Clock: clk})
+	server := netip.AddrPortFrom(rightHost, 53)
+
+	sendRaw(t, left, udpPacket(t, netip.MustParseAddrPort("10.0.1.9:5000"), server))
+	readUDP(t, right)
+
+	clk.Advance(31 * time.Second)
+
+	if flows := router.TrackedFlows(); len(flows) != 0 {
+		t.Fatalf("expected the unreplied flow to have expired, got %+v", flows)
+	}
+
+	// So its port is free for another host
+	sendRaw(t, left, udpPacket(t, netip.MustParseAddrPort("10.0.1.8:5000"), server))
+
+	if source, _ := readUDP(t, right); source.Port() != 5000 {
+		t.Errorf("expected the expired flow's port to be reused, got %s", source)
+	}
+}
+
+func Test_NAT_OnlyMatchingSourcesAreTranslated(t *testing.T) {
+	router, left, right := newRouter(t, 1500)
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddNATRule(NATRule{
+		Interface: "r1",
+		Source:    netip.MustParsePrefix("10.0.1.128/25"),
+		To:        netip.MustParseAddr("192.0.2.1"),
+	}))
+
+	expectations := map[netip.AddrPort]netip.Addr{
+		netip.MustParseAddrPort("10.0.1.9:5000"):   leftHost,
+		netip.MustParseAddrPort("10.0.1.200:5000"): netip.MustParseAddr("192.0.2.1"),
+	}
+
+	for client, expected := range expectations {
+		sendRaw(t, left, udpPacket(t, client, netip.AddrPortFrom(rightHost, 53)))
+
+		if source, _ := readUDP(t, right); source.Addr() != expected {
+			t.Errorf("expected %s to go out as %s, got %s", client, expected, source)
+		}
+	}
+}
+
+func Test_NAT_Rules(t *testing.T) {
+	router, _, _ := newRouter(t, 1500)
+
+	if err := router.AddNATRule(NATRule{Interface: "eth9"}); !errors.Is(err, ErrNoSuchInterface) {
+		t.Errorf("expected ErrNoSuchInterface, got %v", err)
+	}
+
+	if err := router.AddNATRule(NATRule{Interface: "r1", To: netip.MustParseAddr("2001:db8::1")}); err == nil {
+		t.Errorf("expected an IPv6 address to be rejected")
+	}
+
+	rule := NATRule{Interface: "r1", Source: netip.MustParsePrefix("10.0.1.0/24")}
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddNATRule(rule))
+
+	if rules := router.NATRules(); len(rules) != 1 || rules[0] != rule {
+		t.Errorf("expected the rule back, got %+v", rules)
+	}
+
+	testhelpers.FailTestIfErrorIsPresent(t, router.DeleteNATRule(rule))
+
+	if err := router.DeleteNATRule(rule); !errors.Is(err, ErrNoSuchNATRule) {
+		t.Errorf("expected ErrNoSuchNATRule, got %v", err)
+	}
+}
+
+func Test_NAT_CarriesTCPThroughARouter(t *testing.T) {
+	ctx := logger.NewMockLogger().WithLogger(context.Background())
+
+	newStack := func() *Stack {
+		s := New(ctx, Options{})
+		t.Cleanup(func() { _ = s.Close() })
+
+		return s
+	}
+
+	client, router, server := newStack(), newStack(), newStack()
+
+	clientLink, routerLeft := link.NewPipe(link.Ethernet, 1500)
+	routerRight, serverLink := link.NewPipe(link.Ethernet, 1500)
+
+	_, err := client.AddInterface("eth0", clientLink, netip.MustParsePrefix("192.168.1.10/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	inside, err := router.AddInterface("eth0", routerLeft, netip.MustParsePrefix("192.168.1.1/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	outside, err := router.AddInterface("eth1", routerRight, netip.MustParsePrefix("203.0.113.1/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	_, err = server.AddInterface("eth0", serverLink, netip.MustParsePrefix("203.0.113.80/24"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	inside.SetForwarding(true)
+	outside.SetForwarding(true)
+	testhelpers.FailTestIfErrorIsPresent(t, router.AddNATRule(NATRule{Interface: "eth1"}))
+
+	// The server has no route back to the inside network, so only translated packets can reach it
+	testhelpers.FailTestIfErrorIsPresent(t, client.AddRoute(Route{
+		Destination: netip.MustParsePrefix("0.0.0.0/0"),
+		Gateway:     netip.MustParseAddr("192.168.1.1"),
+	}))
+
+	listener, err := server.ListenTCP(netip.MustParseAddrPort("203.0.113.80:80"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	accepted := make(chan netip.AddrPort, 1)
+
+	go func() {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			return
+		}
+
+		accepted <- conn.RemoteAddrPort()
+		_, _ = io.Copy(conn, conn)
+		_ = conn.Close()
+	}()
+
+	dialCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := client.DialTCP(dialCtx, netip.AddrPort{}, netip.MustParseAddrPort("203.0.113.80:80"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sent := bytes.Repeat([]byte("through the NAT "), 1000)
+	_, err = conn.Write(sent)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	echoed := make([]byte, len(sent))
+	_, err = io.ReadFull(conn, echoed)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !bytes.Equal(echoed, sent) {
+		t.Errorf("expected the data echoed back through the NAT")
+	}
+
+	if remote := <-accepted; remote.Addr() != netip.MustParseAddr("203.0.113.1") {
+		t.Errorf("expected the server to see the router's address, got %s", remote)
+	}
+
+	flows := router.TrackedFlows()
+	if len(flows) != 1 || flows[0].State != "ESTABLISHED" {
+		t.Errorf("expected one established flow, got %+v", flows)
+	}
+}
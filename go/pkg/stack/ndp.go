@@ -0,0 +1,252 @@
+package stack
+
+import (
+	"context"
+	"net/netip"
+
+	"networking/internal/trace"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+)
+
+// RFC 4861 6.1, 7.1: Neighbor Discovery messages are sent with a hop limit of 255, and any that arrive with less
+// came from off the link
+const ndpHopLimit = 255
+
+// handleNDP checks the things every Neighbor Discovery message must get right, then hands it on by type
+func (s *Stack) handleNDP(ctx context.Context, nic *Interface, packet *ipv6.Packet, message *icmpv6.Message) {
+	fields := []any{"icmp_type", message.Type, "src_ip", packet.Source.String()}
+
+	switch message.Type {
+	case icmpv6.TypeRouterSolicitation:
+		s.counters.ICMPv6.InRouterSolicits.Inc()
+	case icmpv6.TypeRouterAdvertisement:
+		s.counters.ICMPv6.InRouterAdvertisements.Inc()
+	case icmpv6.TypeNeighborSolicitation:
+		s.counters.ICMPv6.InNeighborSolicits.Inc()
+	case icmpv6.TypeNeighborAdvertisement:
+		s.counters.ICMPv6.InNeighborAdvertisements.Inc()
+	case icmpv6.TypeRedirect:
+		s.counters.ICMPv6.InRedirects.Inc()
+	}
+
+	if packet.HopLimit != ndpHopLimit {
+		s.counters.ICMPv6.InErrors.Inc()
+		trace.Annotate(ctx, trace.Dropped, "neighbor discovery from off the link", append(fields, "hop_limit", packet.HopLimit)...)
+		return
+	}
+
+	var err error
+
+	switch message.Type {
+	case icmpv6.TypeNeighborSolicitation:
+		var solicitation *icmpv6.NeighborSolicitation
+		if solicitation, err = icmpv6.ParseNeighborSolicitation(message); err == nil {
+			s.handleNeighborSolicitation(ctx, nic, packet, solicitation)
+		}
+	case icmpv6.TypeNeighborAdvertisement:
+		var advertisement *icmpv6.NeighborAdvertisement
+		if advertisement, err = icmpv6.ParseNeighborAdvertisement(message); err == nil {
+			s.handleNeighborAdvertisement(ctx, nic, packet, advertisement)
+		}
+	case icmpv6.TypeRouterAdvertisement:
+		var advertisement *icmpv6.RouterAdvertisement
+		if advertisement, err = icmpv6.ParseRouterAdvertisement(message); err == nil {
+			s.handleRouterAdvertisement(ctx, nic, packet, advertisement)
+		}
+	case icmpv6.TypeRouterSolicitation:
+		// RFC 4861 6.2.6: only routers answer these
+		trace.Annotate(ctx, trace.Dropped, "router solicitation for a host", fields...)
+	case icmpv6.TypeRedirect:
+		trace.Annotate(ctx, trace.Dropped, "redirects are not acted on", fields...)
+	}
+
+	if err != nil {
+		s.counters.ICMPv6.InErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid neighbor discovery message", append(fields, "error", err.Error())...)
+	}
+}
+
+// handleNeighborSolicitation answers solicitations for our addresses (RFC 4861 7.2.3), and notices when someone
+// else is probing for an address we are still checking (RFC 4862 5.4.3)
+func (s *Stack) handleNeighborSolicitation(ctx context.Context, nic *Interface, packet *ipv6.Packet, solicitation *icmpv6.NeighborSolicitation) {
+	sourceMAC, hasSourceMAC := icmpv6.LinkLayerAddress(solicitation.Options, icmpv6.NDPOptionSourceLinkLayerAddress)
+	probe := packet.Source.IsUnspecified()
+
+	if solicitation.Target.IsMulticast() || (probe && (hasSourceMAC || packet.Destination != ipv6.SolicitedNodeMulticast(solicitation.Target))) {
+		s.counters.ICMPv6.InErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid neighbor solicitation", "target", solicitation.Target.String())
+		return
+	}
+
+	state, ours := nic.ipv6AddressState(solicitation.Target)
+	if !ours || state == AddressDuplicate {
+		trace.Annotate(ctx, trace.Dropped, "neighbor solicitation not for our address", "target", solicitation.Target.String())
+		return
+	}
+
+	if state == AddressTentative {
+		if probe {
+			nic.addressIsDuplicate(solicitation.Target)
+			trace.Annotate(ctx, trace.Delivered, "duplicate address detected", "target", solicitation.Target.String())
+			return
+		}
+
+		trace.Annotate(ctx, trace.Dropped, "neighbor solicitation for a tentative address", "target", solicitation.Target.String())
+		return
+	}
+
+	advertisement := &icmpv6.NeighborAdvertisement{
+		Solicited: !probe,
+		Override:  true,
+		Target:    solicitation.Target,
+		Options:   []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionTargetLinkLayerAddress, nic.Link.HardwareAddress())},
+	}
+
+	// Someone probing for an address we already have is told on all nodes, since it has no address to answer
+	destination := packet.Source
+	if probe {
+		destination = ipv6.AllNodes
+	}
+
+	if hasSourceMAC {
+		nic.neighbors.update(packet.Source, sourceMAC, true)
+		nic.flushPending(ctx, packet.Source)
+	}
+
+	message, err := advertisement.Message()
+	if err != nil {
+		return
+	}
+
+	if err := s.sendICMPv6(ctx, nic, solicitation.Target, destination, ndpHopLimit, message); err != nil {
+		return
+	}
+
+	s.counters.ICMPv6.OutNeighborAdvertisements.Inc()
+	trace.Annotate(ctx, trace.Delivered, "neighbor solicitation answered", "target", solicitation.Target.String(), "src_ip", packet.Source.String())
+}
+
+// handleNeighborAdvertisement updates the neighbor cache (RFC 4861 7.2.5), or gives up on a tentative address
+// someone else turns out to have
+func (s *Stack) handleNeighborAdvertisement(ctx context.Context, nic *Interface, packet *ipv6.Packet, advertisement *icmpv6.NeighborAdvertisement) {
+	target := advertisement.Target
+
+	if target.IsMulticast() || (packet.Destination.IsMulticast() && advertisement.Solicited) {
+		s.counters.ICMPv6.InErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid neighbor advertisement", "target", target.String())
+		return
+	}
+
+	if state, ours := nic.ipv6AddressState(target); ours {
+		if state == AddressTentative {
+			nic.addressIsDuplicate(target)
+			trace.Annotate(ctx, trace.Delivered, "duplicate address detected", "target", target.String())
+			return
+		}
+
+		s.logger().Warn("neighbor advertisement for our IPv6 address", "iface", nic.Name, "address", target.String(), "src_ip", packet.Source.String())
+		trace.Annotate(ctx, trace.Dropped, "neighbor advertisement for our address", "target", target.String())
+
+		return
+	}
+
+	mac, ok := icmpv6.LinkLayerAddress(advertisement.Options, icmpv6.NDPOptionTargetLinkLayerAddress)
+	if !ok {
+		trace.Annotate(ctx, trace.Dropped, "neighbor advertisement without a link-layer address", "target", target.String())
+		return
+	}
+
+	// Without the override flag, an advertisement only fills in an address we do not know yet
+	if known, resolved := nic.neighbors.lookup(target); resolved && !advertisement.Override && known != mac {
+		trace.Annotate(ctx, trace.Dropped, "neighbor advertisement would not override", "target", target.String())
+		return
+	}
+
+	if !nic.neighbors.update(target, mac, false) {
+		trace.Annotate(ctx, trace.Dropped, "unsolicited neighbor advertisement", "target", target.String())
+		return
+	}
+
+	nic.flushPending(ctx, target)
+	trace.Annotate(ctx, trace.Delivered, "neighbor advertisement learned", "target", target.String())
+}
+
+// handleRouterAdvertisement learns the router's link-layer address (RFC 4861 6.3.4), and with IPv6Autoconf, the
+// router itself and its prefixes
+func (s *Stack) handleRouterAdvertisement(ctx context.Context, nic *Interface, packet *ipv6.Packet, advertisement *icmpv6.RouterAdvertisement) {
+	// RFC 4861 6.1.2: routers advertise from their link-local address, so hosts can tell them apart
+	if !ipv6.IsLinkLocal(packet.Source) {
+		s.counters.ICMPv6.InErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "router advertisement not from a link-local address", "src_ip", packet.Source.String())
+		return
+	}
+
+	if mac, ok := icmpv6.LinkLayerAddress(advertisement.Options, icmpv6.NDPOptionSourceLinkLayerAddress); ok {
+		nic.neighbors.update(packet.Source, mac, true)
+		nic.flushPending(ctx, packet.Source)
+	}
+
+	if s.options.IPv6Autoconf {
+		nic.learnFromRouterAdvertisement(ctx, packet.Source, advertisement)
+	}
+
+	trace.Annotate(ctx, trace.Delivered, "router advertisement received", "src_ip", packet.Source.String(), "router_lifetime", advertisement.RouterLifetime)
+}
+
+// sendNeighborSolicitation asks for target's link-layer address on its solicited-node group (RFC 4861 7.2.2)
+func (s *Stack) sendNeighborSolicitation(ctx context.Context, nic *Interface, target netip.Addr) error {
+	solicitation := &icmpv6.NeighborSolicitation{
+		Target:  target,
+		Options: []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionSourceLinkLayerAddress, nic.Link.HardwareAddress())},
+	}
+
+	return s.sendSolicitation(ctx, nic, netip.Addr{}, solicitation)
+}
+
+// sendDADProbe checks no one else has target, from the unspecified address since target is not ours yet
+// (RFC 4862 5.4.2)
+func (s *Stack) sendDADProbe(ctx context.Context, nic *Interface, target netip.Addr) error {
+	return s.sendSolicitation(ctx, nic, netip.IPv6Unspecified(), &icmpv6.NeighborSolicitation{Target: target})
+}
+
+func (s *Stack) sendSolicitation(ctx context.Context, nic *Interface, source netip.Addr, solicitation *icmpv6.NeighborSolicitation) error {
+	message, err := solicitation.Message()
+	if err != nil {
+		return err
+	}
+
+	if err := s.sendICMPv6(ctx, nic, source, ipv6.SolicitedNodeMulticast(solicitation.Target), ndpHopLimit, message); err != nil {
+		return err
+	}
+
+	s.counters.ICMPv6.OutNeighborSolicits.Inc()
+
+	return nil
+}
+
+// sendRouterSolicitation asks the routers on the link to advertise (RFC 4861 6.3.7). Without a usable link-local
+// address it goes from the unspecified address, which must not carry a link-layer address (RFC 4861 4.1).
+func (s *Stack) sendRouterSolicitation(ctx context.Context, nic *Interface) error {
+	source := nic.ipv6Source(ipv6.AllRouters)
+	solicitation := &icmpv6.RouterSolicitation{}
+
+	if source.IsValid() {
+		solicitation.Options = []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionSourceLinkLayerAddress, nic.Link.HardwareAddress())}
+	} else {
+		source = netip.IPv6Unspecified()
+	}
+
+	message, err := solicitation.Message()
+	if err != nil {
+		return err
+	}
+
+	if err := s.sendICMPv6(ctx, nic, source, ipv6.AllRouters, ndpHopLimit, message); err != nil {
+		return err
+	}
+
+	s.counters.ICMPv6.OutRouterSolicits.Inc()
+
+	return nil
+}
@@ -0,0 +1,260 @@
+package stack
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	testhelpers "networking/internal/test_helpers"
+	"networking/internal/trace"
+	"networking/pkg/ethernet"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+	"networking/pkg/link"
+)
+
+func waitForAddressState(t *testing.T, nic *Interface, addr netip.Addr, expected AddressState) {
+	t.Helper()
+
+	waitFor(t, fmt.Sprintf("%s to be %s", addr, expected), func() bool {
+		actual, _ := nic.ipv6AddressState(addr)
+		return actual == expected
+	})
+}
+
+// readDADProbe reads a duplicate address detection solicitation for target
+func readDADProbe(t *testing.T, peer *link.Pipe, target netip.Addr) {
+	t.Helper()
+
+	destination, packet, message := readICMPv6(t, peer)
+
+	solicitation, err := icmpv6.ParseNeighborSolicitation(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	group := ipv6.SolicitedNodeMulticast(target)
+
+	if solicitation.Target != target || len(solicitation.Options) != 0 {
+		t.Errorf("expected a probe for %s without options, got %+v", target, solicitation)
+	}
+
+	if !packet.Source.IsUnspecified() || packet.Destination != group || destination != ethernet.IPv6MulticastMAC(group) || packet.HopLimit != 255 {
+		t.Errorf("expected a probe from :: to %s with hop limit 255, got %s -> %s (%s) hop limit %d", group, packet.Source, packet.Destination, destination, packet.HopLimit)
+	}
+}
+
+func Test_DAD_AddressBecomesPreferred(t *testing.T) {
+	s, nic, peer, clk, _ := newIPv6Stack(t, link.Ethernet, Options{})
+
+	if addresses := nic.IPv6Addresses(); len(addresses) != 1 || addresses[0].State != AddressTentative {
+		t.Fatalf("expected a tentative address, got %+v", addresses)
+	}
+
+	readDADProbe(t, peer, stackLinkLocal.Addr())
+
+	if source := nic.ipv6Source(peerLinkLocal); source.IsValid() {
+		t.Errorf("expected no source address while tentative, got %s", source)
+	}
+
+	clk.Advance(time.Second)
+
+	waitForAddressState(t, nic, stackLinkLocal.Addr(), AddressPreferred)
+	waitForCounter(t, s, "ipv6IfIcmpOutNeighborSolicits", 1)
+}
+
+func Test_DAD_AdvertisementMeansDuplicate(t *testing.T) {
+	_, nic, peer, clk, recorder := newIPv6Stack(t, link.Ethernet, Options{})
+
+	readDADProbe(t, peer, stackLinkLocal.Addr())
+
+	advertisement, err := (&icmpv6.NeighborAdvertisement{
+		Override: true,
+		Target:   stackLinkLocal.Addr(),
+		Options:  []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionTargetLinkLayerAddress, peer.HardwareAddress())},
+	}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(ipv6.AllNodes), icmpv6Packet(t, peerLinkLocal, ipv6.AllNodes, 255, advertisement))
+
+	waitForDecision(t, recorder, trace.Delivered, "duplicate address detected")
+	clk.Advance(time.Second)
+
+	waitForAddressState(t, nic, stackLinkLocal.Addr(), AddressDuplicate)
+}
+
+func Test_DAD_SimultaneousProbeMeansDuplicate(t *testing.T) {
+	_, nic, peer, _, _ := newIPv6Stack(t, link.Ethernet, Options{})
+
+	readDADProbe(t, peer, stackLinkLocal.Addr())
+
+	probe, err := (&icmpv6.NeighborSolicitation{Target: stackLinkLocal.Addr()}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	group := ipv6.SolicitedNodeMulticast(stackLinkLocal.Addr())
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(group), icmpv6Packet(t, netip.IPv6Unspecified(), group, 255, probe))
+
+	waitForAddressState(t, nic, stackLinkLocal.Addr(), AddressDuplicate)
+}
+
+func Test_DAD_DefendsPreferredAddress(t *testing.T) {
+	_, _, peer, _, _ := newIPv6Stack(t, link.Ethernet, Options{DisableDAD: true})
+
+	probe, err := (&icmpv6.NeighborSolicitation{Target: stackLinkLocal.Addr()}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	group := ipv6.SolicitedNodeMulticast(stackLinkLocal.Addr())
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(group), icmpv6Packet(t, netip.IPv6Unspecified(), group, 255, probe))
+
+	_, packet, message := readICMPv6(t, peer)
+
+	advertisement, err := icmpv6.ParseNeighborAdvertisement(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet.Destination != ipv6.AllNodes || advertisement.Solicited || !advertisement.Override || advertisement.Target != stackLinkLocal.Addr() {
+		t.Errorf("expected an unsolicited advertisement to all nodes, got %+v to %s", advertisement, packet.Destination)
+	}
+}
+
+func Test_NDP_AnswersSolicitationsAndLearnsTheSender(t *testing.T) {
+	s, nic, peer, _, _ := newIPv6Stack(t, link.Ethernet, Options{DisableDAD: true})
+
+	solicitation, err := (&icmpv6.NeighborSolicitation{
+		Target:  stackLinkLocal.Addr(),
+		Options: []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionSourceLinkLayerAddress, peer.HardwareAddress())},
+	}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	group := ipv6.SolicitedNodeMulticast(stackLinkLocal.Addr())
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(group), icmpv6Packet(t, peerLinkLocal, group, 255, solicitation))
+
+	destination, packet, message := readICMPv6(t, peer)
+
+	advertisement, err := icmpv6.ParseNeighborAdvertisement(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	mac, _ := icmpv6.LinkLayerAddress(advertisement.Options, icmpv6.NDPOptionTargetLinkLayerAddress)
+
+	if !advertisement.Solicited || !advertisement.Override || advertisement.Target != stackLinkLocal.Addr() || mac != nic.Link.HardwareAddress() {
+		t.Errorf("unexpected advertisement: %+v", advertisement)
+	}
+
+	if destination != peer.HardwareAddress() || packet.Destination != peerLinkLocal || packet.HopLimit != 255 {
+		t.Errorf("expected the answer sent straight to the peer, got %s (%s) hop limit %d", packet.Destination, destination, packet.HopLimit)
+	}
+
+	neighbors := nic.Neighbors()
+	if len(neighbors) != 1 || neighbors[0].Address != peerLinkLocal || neighbors[0].HardwareAddress != peer.HardwareAddress() || !neighbors[0].Resolved {
+		t.Errorf("expected the peer in the neighbor cache, got %+v", neighbors)
+	}
+
+	waitForCounter(t, s, "ipv6IfIcmpInNeighborSolicits", 1)
+	waitForCounter(t, s, "ipv6IfIcmpOutNeighborAdvertisements", 1)
+}
+
+func Test_NDP_ResolvesBeforeReplying(t *testing.T) {
+	_, nic, peer, _, _ := newIPv6Stack(t, link.Ethernet, Options{DisableDAD: true})
+
+	request := icmpv6.NewEcho(icmpv6.TypeEchoRequest, 7, 1, []byte("ping"))
+	sendIPv6Raw(t, peer, nic.Link.HardwareAddress(), icmpv6Packet(t, peerLinkLocal, stackLinkLocal.Addr(), 64, request))
+
+	// The reply waits while the stack asks who the peer is
+	destination, packet, message := readICMPv6(t, peer)
+
+	solicitation, err := icmpv6.ParseNeighborSolicitation(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	group := ipv6.SolicitedNodeMulticast(peerLinkLocal)
+	if solicitation.Target != peerLinkLocal || packet.Destination != group || destination != ethernet.IPv6MulticastMAC(group) || packet.Source != stackLinkLocal.Addr() {
+		t.Fatalf("expected a solicitation for %s to %s, got %+v to %s", peerLinkLocal, group, solicitation, packet.Destination)
+	}
+
+	if mac, ok := icmpv6.LinkLayerAddress(solicitation.Options, icmpv6.NDPOptionSourceLinkLayerAddress); !ok || mac != nic.Link.HardwareAddress() {
+		t.Errorf("expected our link-layer address in the solicitation, got %s", mac)
+	}
+
+	advertisement, err := (&icmpv6.NeighborAdvertisement{
+		Solicited: true,
+		Override:  true,
+		Target:    peerLinkLocal,
+		Options:   []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionTargetLinkLayerAddress, peer.HardwareAddress())},
+	}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sendIPv6Raw(t, peer, nic.Link.HardwareAddress(), icmpv6Packet(t, peerLinkLocal, stackLinkLocal.Addr(), 255, advertisement))
+
+	destination, _, reply := readICMPv6(t, peer)
+
+	if reply.Type != icmpv6.TypeEchoReply || string(reply.Data) != "ping" || destination != peer.HardwareAddress() {
+		t.Errorf("expected the queued echo reply sent to the peer, got type %d to %s", reply.Type, destination)
+	}
+}
+
+func Test_NDP_AdvertisementWithoutOverrideKeepsTheKnownAddress(t *testing.T) {
+	_, nic, peer, _, recorder := newIPv6Stack(t, link.Ethernet, Options{DisableDAD: true})
+
+	nic.neighbors.update(peerLinkLocal, peer.HardwareAddress(), true)
+
+	advertisement, err := (&icmpv6.NeighborAdvertisement{
+		Target:  peerLinkLocal,
+		Options: []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionTargetLinkLayerAddress, ethernet.MAC{0x02, 0, 0, 0, 0, 0x66})},
+	}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(ipv6.AllNodes), icmpv6Packet(t, peerLinkLocal, ipv6.AllNodes, 255, advertisement))
+
+	waitForDecision(t, recorder, trace.Dropped, "neighbor advertisement would not override")
+
+	if mac, _ := nic.neighbors.lookup(peerLinkLocal); mac != peer.HardwareAddress() {
+		t.Errorf("expected %s to stay at %s, got %s", peerLinkLocal, peer.HardwareAddress(), mac)
+	}
+}
+
+func Test_NDP_IgnoresMessagesFromOffTheLink(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.Ethernet, Options{DisableDAD: true})
+
+	solicitation, err := (&icmpv6.NeighborSolicitation{Target: stackLinkLocal.Addr()}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	group := ipv6.SolicitedNodeMulticast(stackLinkLocal.Addr())
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(group), icmpv6Packet(t, peerLinkLocal, group, 64, solicitation))
+
+	waitForDecision(t, recorder, trace.Dropped, "neighbor discovery from off the link")
+	waitForCounter(t, s, "ipv6IfIcmpOutNeighborAdvertisements", 0)
+}
+
+func Test_NDP_RouterAdvertisementTeachesTheRouterAddress(t *testing.T) {
+	s, nic, peer, _, recorder := newIPv6Stack(t, link.Ethernet, Options{DisableDAD: true})
+
+	advertisement, err := (&icmpv6.RouterAdvertisement{
+		RouterLifetime: 1800,
+		Options:        []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionSourceLinkLayerAddress, peer.HardwareAddress())},
+	}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(ipv6.AllNodes), icmpv6Packet(t, peerLinkLocal, ipv6.AllNodes, 255, advertisement))
+
+	waitForDecision(t, recorder, trace.Delivered, "router advertisement received")
+	waitForCounter(t, s, "ipv6IfIcmpInRouterAdvertisements", 1)
+
+	if mac, ok := nic.neighbors.lookup(peerLinkLocal); !ok || mac != peer.HardwareAddress() {
+		t.Errorf("expected the router's link-layer address learned, got %s", mac)
+	}
+}
+
+func Test_AddIPv6Address_Mistakes(t *testing.T) {
+	_, nic, _, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	for _, prefix := range []string{"ff02::1/128", "::/0", "::1/128", "10.0.0.5/24", "::ffff:10.0.0.5/128"} {
+		if err := nic.AddIPv6Address(netip.MustParsePrefix(prefix)); err == nil {
+			t.Errorf("expected %s to be refused", prefix)
+		}
+	}
+
+	if err := nic.AddIPv6Address(netip.MustParsePrefix("fe80::1/10")); err == nil {
+		t.Errorf("expected the same address twice to be refused")
+	}
+
+	if addresses := nic.IPv6Addresses(); len(addresses) != 1 || addresses[0].State != AddressPreferred {
+		t.Errorf("expected the one address preferred straight away on an IP link, got %+v", addresses)
+	}
+}
@@ -0,0 +1,157 @@
+package stack
+
+import (
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"networking/pkg/ethernet"
+)
+
+const (
+	neighborReachableTime = 30 * time.Second
+	neighborRetryInterval = time.Second
+	// Like Linux's unres_qlen, only a few packets wait on each unresolved neighbor
+	maxPendingPerNeighbor = 3
+)
+
+type neighborEntry struct {
+	mac         ethernet.MAC
+	resolved    bool
+	expires     time.Time
+	lastRequest time.Time
+	pending     [][]byte
+}
+
+// neighborCache maps addresses on a link to hardware addresses. IPv4 neighbors are learned through ARP and IPv6
+// ones through Neighbor Discovery (RFC 4861), but both resolve, queue and expire the same way.
+type neighborCache struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]*neighborEntry
+	now     func() time.Time
+}
+
+func newNeighborCache(now func() time.Time) *neighborCache {
+	return &neighborCache{
+		entries: map[netip.Addr]*neighborEntry{},
+		now:     now,
+	}
+}
+
+// Neighbor is an entry in an interface's neighbor cache
+type Neighbor struct {
+	Address         netip.Addr
+	HardwareAddress ethernet.MAC
+	// Resolved is false while the stack is still asking for the hardware address, and once it has gone stale
+	Resolved bool
+}
+
+// update records addr's hardware address. If create is false, only an existing entry is updated.
+// Returns whether an entry existed (or was created).
+func (c *neighborCache) update(addr netip.Addr, mac ethernet.MAC, create bool) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[addr]
+	if !ok {
+		if !create {
+			return false
+		}
+
+		entry = &neighborEntry{}
+		c.entries[addr] = entry
+	}
+
+	entry.mac = mac
+	entry.resolved = true
+	entry.expires = c.now().Add(neighborReachableTime)
+
+	return true
+}
+
+// lookup returns addr's hardware address, if it is known and has not gone stale
+func (c *neighborCache) lookup(addr netip.Addr) (ethernet.MAC, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[addr]
+	if !ok || !entry.resolved || !c.now().Before(entry.expires) {
+		return ethernet.MAC{}, false
+	}
+
+	return entry.mac, true
+}
+
+// resolve looks up addr. If it is not resolved yet, packet is queued for when it is,
+// and shouldRequest says whether it is time to send another ARP request or neighbor solicitation.
+func (c *neighborCache) resolve(addr netip.Addr, packet []byte) (mac ethernet.MAC, resolved bool, shouldRequest bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	entry, ok := c.entries[addr]
+
+	if ok && entry.resolved && now.Before(entry.expires) {
+		return entry.mac, true, false
+	}
+
+	if !ok {
+		entry = &neighborEntry{}
+		c.entries[addr] = entry
+	}
+
+	entry.resolved = false
+	entry.pending = append(entry.pending, packet)
+
+	if len(entry.pending) > maxPendingPerNeighbor {
+		entry.pending = entry.pending[len(entry.pending)-maxPendingPerNeighbor:]
+	}
+
+	if now.Sub(entry.lastRequest) < neighborRetryInterval {
+		return ethernet.MAC{}, false, false
+	}
+
+	entry.lastRequest = now
+
+	return ethernet.MAC{}, false, true
+}
+
+// takePending returns addr's hardware address and removes any packets queued waiting for it
+func (c *neighborCache) takePending(addr netip.Addr) (ethernet.MAC, [][]byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[addr]
+	if !ok || !entry.resolved {
+		return ethernet.MAC{}, nil
+	}
+
+	pending := entry.pending
+	entry.pending = nil
+
+	return entry.mac, pending
+}
+
+// all returns every entry, ordered by address
+func (c *neighborCache) all() []Neighbor {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	neighbors := make([]Neighbor, 0, len(c.entries))
+
+	for addr, entry := range c.entries {
+		neighbors = append(neighbors, Neighbor{
+			Address:         addr,
+			HardwareAddress: entry.mac,
+			Resolved:        entry.resolved && now.Before(entry.expires),
+		})
+	}
+
+	slices.SortFunc(neighbors, func(a, b Neighbor) int {
+		return a.Address.Compare(b.Address)
+	})
+
+	return neighbors
+}
@@ -0,0 +1,215 @@
+package stack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+	"sync"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/icmp"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv4"
+	"networking/pkg/ipv6"
+)
+
+const (
+	// How many destinations the path MTU cache remembers. Too-big messages are easy to forge, so this bounds what a
+	// flood of them for made-up destinations can cost.
+	maxPathMTUEntries = 1024
+	// RFC 1191 6.3 and RFC 8201 5.3: a path MTU that was lowered is forgotten after this long, in case the path has
+	// grown since. Ten minutes is what both suggest, and Linux's mtu_expires default.
+	pathMTUExpiry = 10 * time.Minute
+	// The least a Fragmentation Needed message can lower an IPv4 path MTU to, like Linux's min_pmtu. RFC 1191 allows
+	// down to 68, but a forged message asking for that would make every packet tiny.
+	minIPv4PathMTU = 552
+)
+
+// RFC 1191 7: the MTUs of common links, for guessing the next one down when a router does not say what it is
+var mtuPlateaus = []int{32000, 17914, 8166, 4352, 2002, 1492, 1006, 508, 296, 68}
+
+// ErrMessageTooLong is returned when a packet that must not be fragmented is larger than the path MTU, like
+// EMSGSIZE from the OS
+var ErrMessageTooLong = errors.New("message too long")
+
+// pmtuDiscovery is how a packet takes part in path MTU discovery, like Linux's IP_MTU_DISCOVER modes
+type pmtuDiscovery int
+
+const (
+	// Never set DF, fragmenting at the path MTU when needed (IP_PMTUDISC_DONT)
+	pmtuDiscoveryDont pmtuDiscovery = iota
+	// Set DF on packets that fit the path MTU, and fragment the rest at it (IP_PMTUDISC_WANT)
+	pmtuDiscoveryWant
+	// Always set DF, and fail packets larger than the path MTU with ErrMessageTooLong (IP_PMTUDISC_DO)
+	pmtuDiscoveryDo
+)
+
+// pathMTUCache remembers, per destination, the largest packet that routers on the way have said gets through
+// (RFC 1191, RFC 8201). Destinations it has heard nothing about go by the MTU of the link they are reached through.
+type pathMTUCache struct {
+	mu      sync.Mutex
+	now     func() time.Time
+	entries map[netip.Addr]pathMTUEntry
+}
+
+type pathMTUEntry struct {
+	mtu     int
+	expires time.Time
+}
+
+func newPathMTUCache(now func() time.Time) *pathMTUCache {
+	return &pathMTUCache{now: now, entries: map[netip.Addr]pathMTUEntry{}}
+}
+
+// lookup returns what is known about destination's path MTU, forgetting it once it has aged out
+func (c *pathMTUCache) lookup(destination netip.Addr) (int, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[destination]
+	if ok && !c.now().Before(entry.expires) {
+		delete(c.entries, destination)
+		return 0, false
+	}
+
+	return entry.mtu, ok
+}
+
+// lower records mtu for destination if it is less than what is known already, returning whether it was. A lower
+// path MTU starts aging afresh.
+func (c *pathMTUCache) lower(destination netip.Addr, mtu int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+
+	known, ok := c.entries[destination]
+	if ok && now.Before(known.expires) && known.mtu <= mtu {
+		return false
+	}
+
+	if !ok && len(c.entries) >= maxPathMTUEntries {
+		for evicted := range c.entries {
+			delete(c.entries, evicted)
+			break
+		}
+	}
+
+	c.entries[destination] = pathMTUEntry{mtu: mtu, expires: now.Add(pathMTUExpiry)}
+
+	return true
+}
+
+// pathMTU is the largest packet that reaches destination out of nic in one piece: the link's MTU, or less if a
+// router on the way has said so
+func (s *Stack) pathMTU(nic *Interface, destination netip.Addr) int {
+	mtu := nic.Link.MTU()
+
+	if known, ok := s.pmtu.lookup(destination); ok {
+		mtu = min(mtu, known)
+	}
+
+	return mtu
+}
+
+// packetTooBig learns a lower path MTU from an ICMPv6 Packet Too Big message (RFC 8201 4). The quoted packet has
+// to be one we could have sent, and the path MTU never goes below the IPv6 minimum, even when a router asks for
+// less: that would need atomic fragments, which RFC 8021 deprecates.
+func (s *Stack) packetTooBig(ctx context.Context, message *icmpv6.Message) {
+	if len(message.Data) < ipv6.HeaderLength {
+		trace.Annotate(ctx, trace.Malformed, "packet too big quotes too little", "len", len(message.Data))
+		return
+	}
+
+	source := netip.AddrFrom16([16]byte(message.Data[8:24]))
+	destination := netip.AddrFrom16([16]byte(message.Data[24:40]))
+	fields := []any{"dst_ip", destination.String(), "mtu", message.MTU()}
+
+	if !s.hasIPv6Address(source) {
+		trace.Annotate(ctx, trace.Dropped, "packet too big for a packet we did not send", append(fields, "src_ip", source.String())...)
+		return
+	}
+
+	mtu := int(max(message.MTU(), ipv6.MinMTU))
+
+	if s.pmtu.lower(destination, mtu) {
+		trace.Annotate(ctx, trace.Delivered, "path MTU lowered", append(fields, "path_mtu", mtu)...)
+	} else {
+		trace.Annotate(ctx, trace.Delivered, "packet too big changes nothing", fields...)
+	}
+
+	// The connection may still have segments in flight from before the path MTU went down, whichever message
+	// lowered it. Only a TCP header straight after the fixed header is looked for; extension headers are not walked
+	if message.Data[6] == ipv6.NextHeaderTCP {
+		s.tcpPathMTUDecreased(ctx, source, destination, message.Data[ipv6.HeaderLength:])
+	}
+}
+
+// fragmentationNeeded learns a lower path MTU from an ICMP Fragmentation Needed message, which a router sends back
+// for a packet with DF set that is too big for its next hop (RFC 1191 4). A router too old to say what the next hop
+// MTU is, or that claims the packet would have fit, gets a guess from the plateau table instead (RFC 1191 5).
+func (s *Stack) fragmentationNeeded(ctx context.Context, message *icmp.Message) {
+	quoted := newPacketView(message.Data)
+	if quoted.headerLength < ipv4.MinHeaderLength || quoted.raw[0]>>4 != ipv4.Version || len(quoted.raw) < quoted.headerLength {
+		trace.Annotate(ctx, trace.Malformed, "fragmentation needed quotes too little", "len", len(message.Data))
+		return
+	}
+
+	source := netip.AddrFrom4([4]byte(quoted.raw[ipSourceOffset:]))
+	destination := netip.AddrFrom4([4]byte(quoted.raw[ipDestinationOffset:]))
+	totalLength := int(binary.BigEndian.Uint16(quoted.raw[2:4]))
+	fields := []any{"dst_ip", destination.String(), "mtu", message.NextHopMTU()}
+
+	if !s.hasAddress(source) {
+		trace.Annotate(ctx, trace.Dropped, "fragmentation needed for a packet we did not send", append(fields, "src_ip", source.String())...)
+		return
+	}
+
+	mtu := int(message.NextHopMTU())
+	if mtu == 0 || mtu >= totalLength {
+		mtu = nextMTUPlateau(totalLength)
+	}
+
+	mtu = max(mtu, minIPv4PathMTU)
+
+	if s.pmtu.lower(destination, mtu) {
+		trace.Annotate(ctx, trace.Delivered, "path MTU lowered", append(fields, "path_mtu", mtu)...)
+	} else {
+		trace.Annotate(ctx, trace.Delivered, "fragmentation needed changes nothing", fields...)
+	}
+
+	if quoted.protocol == ipv4.ProtocolTCP {
+		s.tcpPathMTUDecreased(ctx, source, destination, quoted.raw[quoted.headerLength:])
+	}
+}
+
+// nextMTUPlateau is the largest plateau below a packet of length bytes
+func nextMTUPlateau(length int) int {
+	for _, plateau := range mtuPlateaus {
+		if plateau < length {
+			return plateau
+		}
+	}
+
+	return mtuPlateaus[len(mtuPlateaus)-1]
+}
+
+// tcpPathMTUDecreased tells the connection a too-big packet came from, if it was a TCP segment, so it resends what
+// no longer fits without waiting for its retransmission timer. transport is as much of the segment as was quoted,
+// which needs its ports and sequence number.
+func (s *Stack) tcpPathMTUDecreased(ctx context.Context, source, destination netip.Addr, transport []byte) {
+	if len(transport) < 8 {
+		return
+	}
+
+	id := tcpConnectionID{
+		local:  netip.AddrPortFrom(source, binary.BigEndian.Uint16(transport[0:2])),
+		remote: netip.AddrPortFrom(destination, binary.BigEndian.Uint16(transport[2:4])),
+	}
+
+	if conn := s.tcp.lookupConnection(id); conn != nil {
+		conn.pathMTUDecreased(ctx, binary.BigEndian.Uint32(transport[4:8]))
+	}
+}
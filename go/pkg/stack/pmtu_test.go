@@ -0,0 +1,424 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/clock"
+	testhelpers "networking/internal/test_helpers"
+	"networking/internal/trace"
+	"networking/pkg/ethernet"
+	"networking/pkg/icmp"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv4"
+	"networking/pkg/ipv6"
+	"networking/pkg/link"
+	"networking/pkg/tcp"
+)
+
+// readIPv6 reads the next packet the stack sends on an IP link
+func readIPv6(t *testing.T, peer *link.Pipe) (*ipv6.Packet, []byte) {
+	t.Helper()
+
+	raw, err := peer.ReadPacket()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	packet, err := ipv6.ParseRawPacket(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return packet, raw
+}
+
+// tooBig sends a Packet Too Big for a packet from source to destination, as a router between them would
+func tooBig(t *testing.T, peer *link.Pipe, source, destination netip.Addr, mtu uint32) {
+	t.Helper()
+
+	quoted, err := (&ipv6.Packet{HopLimit: 64, Source: source, Destination: destination, Protocol: ipv6.NextHeaderUDP, Payload: make([]byte, 100)}).CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	message := icmpv6.NewError(icmpv6.TypePacketTooBig, 0, mtu)
+	message.Data = quoted
+
+	sendIPv6Raw(t, peer, ethernet.MAC{}, icmpv6Packet(t, peerLinkLocal, stackLinkLocal.Addr(), 64, message))
+}
+
+// fragmentationNeeded sends what a router would for quoted, a packet that was too big for a next hop of mtu bytes
+func fragmentationNeeded(t *testing.T, peer *link.Pipe, quoted *ipv4.Packet, mtu uint16) {
+	t.Helper()
+
+	raw, err := quoted.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	message := &icmp.Message{Type: icmp.TypeDestinationUnreachable, Code: icmp.CodeFragmentationNeeded, Data: raw[:min(len(raw), 548)]}
+	copy(message.RestOfHeader[2:4], bytehelpers.Uint16ToByteArray(mtu))
+
+	data, err := message.CreateMessage(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sendRaw(t, peer, &ipv4.Packet{TTL: 64, Protocol: ipv4.ProtocolICMP, Source: netip.MustParseAddr("10.0.0.254"), Destination: quoted.Source, Payload: data})
+}
+
+func Test_IPv6_FragmentsWhatIsTooBigForTheLink(t *testing.T) {
+	s, _, peer, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv6Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	data := bytes.Repeat([]byte("0123456789"), 300)
+	_, err = conn.WriteToUDPAddrPort(data, netip.AddrPortFrom(peerLinkLocal, 9000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	var reassembled []byte
+	var identification uint32
+
+	for i := range 3 {
+		packet, raw := readIPv6(t, peer)
+
+		header := packet.FragmentHeader()
+		if header == nil || len(raw) > 1500 || int(header.FragmentOffset)*8 != len(reassembled) || header.MoreFragments != (i < 2) {
+			t.Fatalf("unexpected fragment %d of %d bytes: %+v", i, len(raw), header)
+		}
+
+		if i > 0 && header.Identification != identification {
+			t.Errorf("expected every fragment to have identification %#x, got %#x", identification, header.Identification)
+		}
+
+		identification = header.Identification
+		reassembled = append(reassembled, packet.Payload...)
+	}
+
+	if !bytes.Equal(reassembled[8:], data) {
+		t.Errorf("fragments do not add up to the datagram")
+	}
+
+	waitForCounter(t, s, "ipv6OutFragReqds", 1)
+	waitForCounter(t, s, "ipv6OutFragOKs", 1)
+	waitForCounter(t, s, "ipv6OutFragCreates", 3)
+}
+
+func Test_PMTU_PacketTooBigLowersThePathMTU(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv6Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	destination := netip.AddrPortFrom(peerLinkLocal, 9000)
+
+	_, err = conn.WriteToUDPAddrPort(make([]byte, 1400), destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet, _ := readIPv6(t, peer); packet.FragmentHeader() != nil {
+		t.Fatalf("expected a packet that fits the link to go whole")
+	}
+
+	tooBig(t, peer, stackLinkLocal.Addr(), peerLinkLocal, 1300)
+	waitForDecision(t, recorder, trace.Delivered, "path MTU lowered")
+
+	_, err = conn.WriteToUDPAddrPort(make([]byte, 1400), destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	for range 2 {
+		packet, raw := readIPv6(t, peer)
+
+		if packet.FragmentHeader() == nil || len(raw) > 1300 {
+			t.Errorf("expected fragments of at most 1300 bytes, got %d bytes", len(raw))
+		}
+	}
+
+	waitForCounter(t, s, "ipv6IfIcmpInPktTooBigs", 1)
+}
+
+func Test_PMTU_NeverBelowTheMinimumMTU(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv6Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	tooBig(t, peer, stackLinkLocal.Addr(), peerLinkLocal, 576)
+	waitForDecision(t, recorder, trace.Delivered, "path MTU lowered")
+
+	if mtu, _ := s.pmtu.lookup(peerLinkLocal); mtu != ipv6.MinMTU {
+		t.Errorf("expected the path MTU to stop at %d, got %d", ipv6.MinMTU, mtu)
+	}
+
+	// A packet that fits the minimum MTU goes without a fragment header: no atomic fragments (RFC 8021)
+	_, err = conn.WriteToUDPAddrPort(make([]byte, 1000), netip.AddrPortFrom(peerLinkLocal, 9000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if packet, _ := readIPv6(t, peer); packet.FragmentHeader() != nil {
+		t.Errorf("expected no fragment header, got %+v", packet.ExtensionHeaders)
+	}
+}
+
+func Test_PMTU_IgnoresPacketTooBigForOthersPackets(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	tooBig(t, peer, netip.MustParseAddr("fe80::99"), peerLinkLocal, 1300)
+	waitForDecision(t, recorder, trace.Dropped, "packet too big for a packet we did not send")
+
+	if _, ok := s.pmtu.lookup(peerLinkLocal); ok {
+		t.Errorf("expected the path MTU to be left alone")
+	}
+}
+
+func Test_UDP_IPv6PortUnreachable(t *testing.T) {
+	s, _, peer, _, _ := newIPv6Stack(t, link.IP, Options{})
+
+	sendIPv6Raw(t, peer, ethernet.MAC{}, udpIPv6Packet(t, netip.AddrPortFrom(peerLinkLocal, 9000), netip.AddrPortFrom(stackLinkLocal.Addr(), 7), []byte("anyone?")))
+
+	_, _, unreachable := readICMPv6(t, peer)
+
+	if unreachable.Type != icmpv6.TypeDestinationUnreachable || unreachable.Code != icmpv6.CodePortUnreachable {
+		t.Errorf("expected port unreachable, got type %d code %d", unreachable.Type, unreachable.Code)
+	}
+
+	waitForCounter(t, s, "udpNoPorts", 1)
+}
+
+func Test_TCP_OverIPv6SegmentsToThePathMTU(t *testing.T) {
+	a, b, _ := newStackPair(t, link.IP)
+	addressA6 := netip.MustParsePrefix("fe80::a/64")
+	addressB6 := netip.MustParsePrefix("fe80::b/64")
+
+	testhelpers.FailTestIfErrorIsPresent(t, a.Interfaces()[0].AddIPv6Address(addressA6))
+	testhelpers.FailTestIfErrorIsPresent(t, b.Interfaces()[0].AddIPv6Address(addressB6))
+
+	listener, err := b.ListenTCP(netip.AddrPortFrom(netip.IPv6Unspecified(), 8080))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	accepted := make(chan *TCPConn, 1)
+	go func() {
+		conn, err := listener.AcceptTCP()
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, err := a.DialTCP(ctx, netip.AddrPort{}, netip.AddrPortFrom(addressB6.Addr(), 8080))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	server := <-accepted
+
+	if client.id.local.Addr() != addressA6.Addr() || server.id.remote.Addr() != addressA6.Addr() {
+		t.Fatalf("expected the connection to be from %s, got %s", addressA6.Addr(), client.id.local)
+	}
+
+	a.pmtu.lower(addressB6.Addr(), ipv6.MinMTU)
+
+	client.mu.Lock()
+	segmentSize := client.segmentSize()
+	timestamps := client.timestamps
+	client.mu.Unlock()
+
+	expected := ipv6.MinMTU - ipv6.HeaderLength - tcp.MinHeaderLength
+	if timestamps {
+		expected -= tcpTimestampsOptionLength
+	}
+
+	if segmentSize != expected {
+		t.Errorf("expected segments of %d bytes for the path MTU, got %d", expected, segmentSize)
+	}
+
+	payload := bytes.Repeat([]byte("over IPv6 "), 2000)
+
+	go func() {
+		_, _ = client.Write(payload)
+		_ = client.Close()
+	}()
+
+	received, err := io.ReadAll(server)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !bytes.Equal(received, payload) {
+		t.Errorf("expected %d bytes, got %d", len(payload), len(received))
+	}
+
+	// Segments were made to fit, so nothing had to be fragmented
+	waitForCounter(t, a, "ipv6OutFragReqds", 0)
+}
+
+func Test_PMTU_FragmentationNeededLowersThePathMTU(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	destination := netip.AddrPortFrom(addressB.Addr(), 9000)
+
+	if mtu, err := conn.PathMTU(destination.Addr()); err != nil || mtu != 1500 {
+		t.Fatalf("expected the link's MTU to start with, got %d (%v)", mtu, err)
+	}
+
+	_, err = conn.WriteToUDPAddrPort(make([]byte, 1400), destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sent := readRaw(t, peer)
+	if sent.Flags&ipv4.FlagDontFragment == 0 {
+		t.Fatalf("expected DF on a datagram that fits the path")
+	}
+
+	fragmentationNeeded(t, peer, sent, 1200)
+	waitForDecision(t, recorder, trace.Delivered, "path MTU lowered")
+
+	if mtu, _ := conn.PathMTU(destination.Addr()); mtu != 1200 {
+		t.Errorf("expected the path MTU to be 1200, got %d", mtu)
+	}
+
+	// Too big for the path now, so it goes in fragments without DF
+	_, err = conn.WriteToUDPAddrPort(make([]byte, 1400), destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	for i := range 2 {
+		fragment := readRaw(t, peer)
+
+		if int(fragment.TotalLength) > 1200 || fragment.Flags&ipv4.FlagDontFragment != 0 || (fragment.Flags&ipv4.FlagMoreFragments != 0) != (i == 0) {
+			t.Errorf("unexpected fragment %d of %d bytes with flags %#x", i, fragment.TotalLength, fragment.Flags)
+		}
+	}
+
+	waitForCounter(t, s, "ipOutFragCreates", 2)
+
+	conn.SetDontFragment(true)
+
+	if _, err := conn.WriteToUDPAddrPort(make([]byte, 1400), destination); !errors.Is(err, ErrMessageTooLong) {
+		t.Errorf("expected %v with DF insisted on, got %v", ErrMessageTooLong, err)
+	}
+}
+
+func Test_PMTU_FragmentationNeededWithoutAnMTUGuessesAPlateau(t *testing.T) {
+	s, _, peer, _, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	quoted := &ipv4.Packet{TTL: 64, Protocol: ipv4.ProtocolUDP, Source: addressA.Addr(), Destination: addressB.Addr(), Payload: make([]byte, 1408)}
+
+	fragmentationNeeded(t, peer, quoted, 0)
+	waitForDecision(t, recorder, trace.Delivered, "path MTU lowered")
+
+	if mtu, _ := s.pmtu.lookup(addressB.Addr()); mtu != 1006 {
+		t.Errorf("expected the plateau below 1428 bytes, 1006, got %d", mtu)
+	}
+
+	// Nothing lower than Linux's min_pmtu is believed
+	fragmentationNeeded(t, peer, quoted, 68)
+	waitForCounter(t, s, "icmpInDestUnreachs", 2)
+
+	if mtu, _ := s.pmtu.lookup(addressB.Addr()); mtu != minIPv4PathMTU {
+		t.Errorf("expected the path MTU to stop at %d, got %d", minIPv4PathMTU, mtu)
+	}
+}
+
+func Test_PMTU_AgesOut(t *testing.T) {
+	s, _, peer, clk, recorder := newIPv6Stack(t, link.IP, Options{})
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	fragmentationNeeded(t, peer, &ipv4.Packet{TTL: 64, Protocol: ipv4.ProtocolUDP, Source: addressA.Addr(), Destination: addressB.Addr(), Payload: make([]byte, 1400)}, 1000)
+	waitForDecision(t, recorder, trace.Delivered, "path MTU lowered")
+
+	clk.Advance(pathMTUExpiry - time.Second)
+
+	if mtu, _ := conn.PathMTU(addressB.Addr()); mtu != 1000 {
+		t.Errorf("expected the path MTU to still be 1000, got %d", mtu)
+	}
+
+	clk.Advance(time.Second)
+
+	if mtu, _ := conn.PathMTU(addressB.Addr()); mtu != 1500 {
+		t.Errorf("expected the path MTU to go back to the link's, got %d", mtu)
+	}
+}
+
+func Test_TCP_FragmentationNeededResendsStraightAway(t *testing.T) {
+	p := newTCPPeerWithClock(t, clock.NewFake(time.Unix(0, 0)))
+	p.mss = 1460
+	conn := established(p)
+
+	_, err := conn.Write(bytes.Repeat([]byte("x"), 1400))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	sent := p.expect(tcp.FlagACK | tcp.FlagPSH)
+	sent.SourcePort, sent.DestinationPort = p.remote.Port(), p.local.Port()
+
+	quote := func(seq uint32) *ipv4.Packet {
+		segment := *sent
+		segment.SequenceNumber = seq
+
+		raw, err := segment.CreateSegment(context.TODO(), p.remote.Addr(), p.local.Addr())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		return &ipv4.Packet{TTL: 64, Flags: ipv4.FlagDontFragment, Protocol: ipv4.ProtocolTCP, Source: p.remote.Addr(), Destination: p.local.Addr(), Payload: raw}
+	}
+
+	// A sequence number that is not in flight could be anyone's guess
+	fragmentationNeeded(t, p.pipe, quote(sent.SequenceNumber+5000), 1200)
+	p.expectNothing()
+
+	fragmentationNeeded(t, p.pipe, quote(sent.SequenceNumber), 1000)
+
+	first := p.expect(tcp.FlagACK)
+	second := p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	if first.SequenceNumber != sent.SequenceNumber || len(first.Data) != 960 || second.SequenceNumber != sent.SequenceNumber+960 || len(second.Data) != 440 {
+		t.Errorf("expected the segment again in pieces of 960 and 440 bytes, got %d at %d and %d at %d",
+			len(first.Data), first.SequenceNumber, len(second.Data), second.SequenceNumber)
+	}
+
+	waitForCounter(t, p.stack, "tcpRetransSegs", 2)
+}
+
+func Test_TCP_BlackHoleShrinksSegments(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	p.mss = 1460
+	conn := established(p)
+
+	_, err := conn.Write(bytes.Repeat([]byte("x"), 1400))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	// Whole retransmissions until the timeouts have gone on long enough to suggest a black hole
+	for _, rto := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		clk.Advance(rto)
+
+		if retransmission := p.expect(tcp.FlagACK | tcp.FlagPSH); len(retransmission.Data) != 1400 {
+			t.Fatalf("expected the whole segment again, got %d bytes", len(retransmission.Data))
+		}
+	}
+
+	clk.Advance(8 * time.Second)
+
+	if shrunk := p.expect(tcp.FlagACK); len(shrunk.Data) != tcpBaseMSS {
+		t.Fatalf("expected a segment of the base MSS, got %d bytes", len(shrunk.Data))
+	}
+
+	p.send(tcp.FlagACK, "")
+
+	if rest := p.expect(tcp.FlagACK | tcp.FlagPSH); len(rest.Data) != 1400-tcpBaseMSS {
+		t.Errorf("expected the rest of the data, got %d bytes", len(rest.Data))
+	}
+}
+
+// Test_TCP_ProbesPastABlackHole sends over a link that silently drops packets larger than 1200 bytes, which the
+// sender only finds by its segments going unacknowledged
+func Test_TCP_ProbesPastABlackHole(t *testing.T) {
+	blackHole := func(packet []byte) bool { return len(packet) > 1200 }
+
+	var client *TCPConn
+	transferOverLossyLink(t, Options{}, blackHole, func([]byte) bool { return false }, func(conn *TCPConn) { client = conn })
+
+	client.mu.Lock()
+	probe := client.mtuProbe
+	client.mu.Unlock()
+
+	if !probe.enabled || probe.searchLow <= client.mssToMTU(tcpBaseMSS) || probe.searchLow > 1200 {
+		t.Errorf("expected probing to find a path MTU between %d and 1200, got %+v", client.mssToMTU(tcpBaseMSS), probe)
+	}
+}
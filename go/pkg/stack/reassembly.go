@@ -0,0 +1,208 @@
+package stack
+
+import (
+	"bytes"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"networking/internal/clock"
+	"networking/pkg/metrics"
+)
+
+// How many datagrams can be part way through reassembly at once. Fragments that never complete would otherwise hold
+// memory for the whole timeout, so past this many the oldest datagram is given up on, like Linux does when it runs
+// out of fragment memory.
+const maxReassemblies = 64
+
+// reassemblyKey identifies the fragments of one datagram. IPv4 tells datagrams apart by protocol too (RFC 791 3.2),
+// but IPv6 does not (RFC 8200 4.5), so its protocol is left zero.
+type reassemblyKey struct {
+	source         netip.Addr
+	destination    netip.Addr
+	protocol       uint8
+	identification uint32
+}
+
+// reassembly is a datagram whose fragments are still arriving
+type reassembly struct {
+	nic     *Interface
+	started time.Time
+	timer   *wheelTimer
+
+	// The first fragment once it has arrived, whose headers become the reassembled datagram's, and how many of its
+	// bytes those headers take up
+	first        []byte
+	headerLength int
+
+	// The payload's pieces so far, in order of offset
+	pieces []reassemblyPiece
+	// How long the payload is, once the last fragment has arrived to say. -1 until then.
+	length int
+}
+
+type reassemblyPiece struct {
+	offset int
+	data   []byte
+}
+
+// reassemblyTable holds the datagrams being reassembled
+type reassemblyTable struct {
+	clock   clock.Clock
+	timers  *timerWheel
+	timeout time.Duration
+	// Counts every datagram given up on, whatever the reason
+	fails *metrics.Counter
+	// Called once a datagram whose time ran out has been taken out of the table
+	timedOut func(key reassemblyKey, datagram *reassembly)
+
+	mu        sync.Mutex
+	datagrams map[reassemblyKey]*reassembly
+}
+
+func newReassemblyTable(c clock.Clock, timers *timerWheel, timeout time.Duration, fails *metrics.Counter, timedOut func(reassemblyKey, *reassembly)) *reassemblyTable {
+	return &reassemblyTable{
+		clock:     c,
+		timers:    timers,
+		timeout:   timeout,
+		fails:     fails,
+		timedOut:  timedOut,
+		datagrams: map[reassemblyKey]*reassembly{},
+	}
+}
+
+// add files a piece of the datagram under key, starting reassembly if it is the first to arrive. First is the whole
+// fragment when it is the one at offset zero. It returns why the datagram had to be given up on, if it did.
+func (t *reassemblyTable) add(key reassemblyKey, nic *Interface, piece reassemblyPiece, more bool, first []byte, headerLength int) (*reassembly, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	datagram, ok := t.datagrams[key]
+	if !ok {
+		if len(t.datagrams) >= maxReassemblies {
+			t.evictOldest()
+		}
+
+		datagram = &reassembly{nic: nic, started: t.clock.Now(), length: -1}
+		datagram.timer = t.timers.newTimer(func() { t.expire(key, datagram) })
+		datagram.timer.reset(t.timeout)
+		t.datagrams[key] = datagram
+	}
+
+	if reason := datagram.insert(piece.offset, piece.data, more); reason != "" {
+		datagram.timer.stop()
+		delete(t.datagrams, key)
+		t.fails.Inc()
+
+		return nil, reason
+	}
+
+	if first != nil {
+		datagram.first, datagram.headerLength = first, headerLength
+	}
+
+	return datagram, ""
+}
+
+// insert adds a piece of the payload in order. Any overlap gives the whole datagram up, since overlapping fragments
+// are how filters get evaded (RFC 1858, RFC 5722), but an exact duplicate is just dropped (RFC 8200 4.5).
+func (r *reassembly) insert(offset int, data []byte, more bool) string {
+	end := offset + len(data)
+
+	if !more {
+		if r.length >= 0 && r.length != end {
+			return "fragments disagree on the datagram's length"
+		}
+
+		r.length = end
+	}
+
+	if r.length >= 0 && end > r.length {
+		return "fragment past the end of the datagram"
+	}
+
+	if len(r.pieces) > 0 && r.length >= 0 {
+		last := r.pieces[len(r.pieces)-1]
+		if last.offset+len(last.data) > r.length {
+			return "fragment past the end of the datagram"
+		}
+	}
+
+	i, _ := slices.BinarySearchFunc(r.pieces, offset, func(p reassemblyPiece, offset int) int { return p.offset - offset })
+
+	if i < len(r.pieces) && r.pieces[i].offset == offset && bytes.Equal(r.pieces[i].data, data) {
+		return ""
+	}
+
+	if i > 0 && r.pieces[i-1].offset+len(r.pieces[i-1].data) > offset {
+		return "overlapping fragments"
+	}
+
+	if i < len(r.pieces) && end > r.pieces[i].offset {
+		return "overlapping fragments"
+	}
+
+	r.pieces = slices.Insert(r.pieces, i, reassemblyPiece{offset: offset, data: data})
+
+	return ""
+}
+
+// complete takes the datagram out of the table and returns its payload if every piece of it has arrived
+func (t *reassemblyTable) complete(key reassemblyKey, datagram *reassembly) ([]byte, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if datagram.first == nil || datagram.length < 0 || t.datagrams[key] != datagram {
+		return nil, false
+	}
+
+	payload := make([]byte, 0, datagram.length)
+	for _, piece := range datagram.pieces {
+		if piece.offset != len(payload) {
+			return nil, false
+		}
+
+		payload = append(payload, piece.data...)
+	}
+
+	if len(payload) != datagram.length {
+		return nil, false
+	}
+
+	datagram.timer.stop()
+	delete(t.datagrams, key)
+
+	return payload, true
+}
+
+// evictOldest gives up on the datagram that has been reassembling longest. The caller holds the table's lock.
+func (t *reassemblyTable) evictOldest() {
+	var oldestKey reassemblyKey
+	var oldest *reassembly
+
+	for key, datagram := range t.datagrams {
+		if oldest == nil || datagram.started.Before(oldest.started) {
+			oldestKey, oldest = key, datagram
+		}
+	}
+
+	oldest.timer.stop()
+	delete(t.datagrams, oldestKey)
+	t.fails.Inc()
+}
+
+// expire gives up on a datagram whose fragments did not all arrive in time
+func (t *reassemblyTable) expire(key reassemblyKey, datagram *reassembly) {
+	t.mu.Lock()
+	if t.datagrams[key] != datagram {
+		t.mu.Unlock()
+		return
+	}
+
+	delete(t.datagrams, key)
+	t.mu.Unlock()
+
+	t.fails.Inc()
+	t.timedOut(key, datagram)
+}
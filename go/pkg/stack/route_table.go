@@ -0,0 +1,247 @@
+package stack
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"net/netip"
+	"sync"
+)
+
+// routeTable finds the route for a destination by longest prefix match. Routes are kept in a binary Patricia
+// trie on the IPv4 address bits: every node is a prefix, and chains of nodes with only one child are collapsed,
+// so a lookup visits at most one node per distinct prefix length on the way down, however many routes there are.
+type routeTable struct {
+	mu   sync.RWMutex
+	root *routeNode
+	size int
+}
+
+// routeNode is a prefix in the trie. Nodes without routes are only there to branch.
+type routeNode struct {
+	key  uint32
+	bits int
+	// Every route for exactly this prefix, lowest metric first
+	routes   []*routeEntry
+	children [2]*routeNode
+}
+
+// routeEntry is a Route with the interface it goes out of
+type routeEntry struct {
+	Route
+	nic *Interface
+}
+
+func newRouteTable() *routeTable {
+	return &routeTable{}
+}
+
+func prefixKey(prefix netip.Prefix) (uint32, int) {
+	addr := prefix.Masked().Addr().As4()
+	return binary.BigEndian.Uint32(addr[:]), prefix.Bits()
+}
+
+func addrKey(addr netip.Addr) uint32 {
+	bytes := addr.As4()
+	return binary.BigEndian.Uint32(bytes[:])
+}
+
+// prefixMask has the top bits bits set
+func prefixMask(bits int) uint32 {
+	if bits == 0 {
+		return 0
+	}
+
+	return ^uint32(0) << (32 - bits)
+}
+
+// bitAt is bit i of key, counting from the most significant
+func bitAt(key uint32, i int) int {
+	return int(key>>(31-i)) & 1
+}
+
+// contains checks if key falls within the node's prefix
+func (n *routeNode) contains(key uint32) bool {
+	return (key^n.key)&prefixMask(n.bits) == 0
+}
+
+// commonBits is how many leading bits two prefixes share, up to the shorter of them
+func commonBits(a uint32, aBits int, b uint32, bBits int) int {
+	return min(bits.LeadingZeros32(a^b), aBits, bBits)
+}
+
+// add puts entry in the table. Returns false if the same route is already there.
+func (t *routeTable) add(entry *routeEntry) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key, bits := prefixKey(entry.Destination)
+	link := &t.root
+
+	for {
+		n := *link
+
+		if n == nil {
+			*link = &routeNode{key: key, bits: bits, routes: []*routeEntry{entry}}
+			t.size++
+
+			return true
+		}
+
+		common := commonBits(key, bits, n.key, n.bits)
+
+		switch {
+		case common == n.bits && common == bits:
+			// The same prefix: another route for it
+			for _, existing := range n.routes {
+				if existing.Route == entry.Route {
+					return false
+				}
+			}
+
+			n.routes = insertByMetric(n.routes, entry)
+			t.size++
+
+			return true
+		case common == n.bits:
+			// n is a shorter prefix of the new one, which goes somewhere below it
+			link = &n.children[bitAt(key, n.bits)]
+			continue
+		case common == bits:
+			// The new prefix is a shorter prefix of n, so goes in between n and its parent
+			added := &routeNode{key: key, bits: bits, routes: []*routeEntry{entry}}
+			added.children[bitAt(n.key, bits)] = n
+			*link = added
+		default:
+			// They part ways, so a node without routes branches to both
+			branch := &routeNode{key: key & prefixMask(common), bits: common}
+			branch.children[bitAt(key, common)] = &routeNode{key: key, bits: bits, routes: []*routeEntry{entry}}
+			branch.children[bitAt(n.key, common)] = n
+			*link = branch
+		}
+
+		t.size++
+
+		return true
+	}
+}
+
+// insertByMetric keeps routes ordered by metric, with a new one after the existing routes of its metric
+func insertByMetric(routes []*routeEntry, entry *routeEntry) []*routeEntry {
+	i := len(routes)
+	for i > 0 && routes[i-1].Metric > entry.Metric {
+		i--
+	}
+
+	routes = append(routes, nil)
+	copy(routes[i+1:], routes[i:])
+	routes[i] = entry
+
+	return routes
+}
+
+// remove deletes the first route for prefix that match accepts, tidying up any nodes that no longer need to be
+// there. Returns the route it deleted, if any.
+func (t *routeTable) remove(prefix netip.Prefix, match func(*routeEntry) bool) (*routeEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key, bits := prefixKey(prefix)
+
+	removed, ok := t.removeFrom(&t.root, key, bits, match)
+	if ok {
+		t.size--
+	}
+
+	return removed, ok
+}
+
+func (t *routeTable) removeFrom(link **routeNode, key uint32, bits int, match func(*routeEntry) bool) (*routeEntry, bool) {
+	n := *link
+	if n == nil || n.bits > bits || !n.contains(key) {
+		return nil, false
+	}
+
+	if n.bits < bits {
+		removed, ok := t.removeFrom(&n.children[bitAt(key, n.bits)], key, bits, match)
+		if ok {
+			compact(link)
+		}
+
+		return removed, ok
+	}
+
+	for i, entry := range n.routes {
+		if match(entry) {
+			n.routes = append(n.routes[:i:i], n.routes[i+1:]...)
+			compact(link)
+
+			return entry, true
+		}
+	}
+
+	return nil, false
+}
+
+// compact removes a node that has no routes and no longer branches
+func compact(link **routeNode) {
+	n := *link
+	if len(n.routes) > 0 {
+		return
+	}
+
+	switch {
+	case n.children[0] == nil:
+		*link = n.children[1]
+	case n.children[1] == nil:
+		*link = n.children[0]
+	}
+}
+
+// lookup finds the route for destination: the lowest metric route for the longest prefix that contains it
+func (t *routeTable) lookup(destination netip.Addr) (*routeEntry, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	key := addrKey(destination)
+	var best *routeEntry
+
+	for n := t.root; n != nil && n.contains(key); {
+		if len(n.routes) > 0 {
+			best = n.routes[0]
+		}
+
+		if n.bits == 32 {
+			break
+		}
+
+		n = n.children[bitAt(key, n.bits)]
+	}
+
+	return best, best != nil
+}
+
+// all returns every route, ordered by address and then by prefix length
+func (t *routeTable) all() []Route {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	routes := make([]Route, 0, t.size)
+
+	var walk func(n *routeNode)
+	walk = func(n *routeNode) {
+		if n == nil {
+			return
+		}
+
+		for _, entry := range n.routes {
+			routes = append(routes, entry.Route)
+		}
+
+		walk(n.children[0])
+		walk(n.children[1])
+	}
+
+	walk(t.root)
+
+	return routes
+}
@@ -0,0 +1,241 @@
+package stack
+
+import (
+	"math/rand/v2"
+	"net/netip"
+	"testing"
+)
+
+func tableWith(routes ...Route) *routeTable {
+	table := newRouteTable()
+
+	for _, route := range routes {
+		table.add(&routeEntry{Route: route})
+	}
+
+	return table
+}
+
+func lookupGateway(t *testing.T, table *routeTable, destination string) string {
+	t.Helper()
+
+	entry, ok := table.lookup(netip.MustParseAddr(destination))
+	if !ok {
+		return "none"
+	}
+
+	return entry.Gateway.String()
+}
+
+func Test_RouteTable_LongestPrefixWins(t *testing.T) {
+	table := tableWith(
+		Route{Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("192.0.2.0")},
+		Route{Destination: netip.MustParsePrefix("10.0.0.0/8"), Gateway: netip.MustParseAddr("192.0.2.8")},
+		Route{Destination: netip.MustParsePrefix("10.1.2.0/24"), Gateway: netip.MustParseAddr("192.0.2.24")},
+		Route{Destination: netip.MustParsePrefix("10.1.0.0/16"), Gateway: netip.MustParseAddr("192.0.2.16")},
+		Route{Destination: netip.MustParsePrefix("10.1.2.3/32"), Gateway: netip.MustParseAddr("192.0.2.32")},
+		Route{Destination: netip.MustParsePrefix("10.128.0.0/9"), Gateway: netip.MustParseAddr("192.0.2.9")},
+	)
+
+	cases := map[string]string{
+		"8.8.8.8":       "192.0.2.0",
+		"10.200.0.1":    "192.0.2.9",
+		"10.2.0.1":      "192.0.2.8",
+		"10.1.3.1":      "192.0.2.16",
+		"10.1.2.4":      "192.0.2.24",
+		"10.1.2.3":      "192.0.2.32",
+		"10.127.255.25": "192.0.2.8",
+	}
+
+	for destination, expected := range cases {
+		if got := lookupGateway(t, table, destination); got != expected {
+			t.Errorf("expected %s to go via %s, got %s", destination, expected, got)
+		}
+	}
+}
+
+func Test_RouteTable_NoMatch(t *testing.T) {
+	table := tableWith(Route{Destination: netip.MustParsePrefix("10.0.0.0/8"), Gateway: netip.MustParseAddr("192.0.2.8")})
+
+	if got := lookupGateway(t, table, "11.0.0.1"); got != "none" {
+		t.Errorf("expected no route, got one via %s", got)
+	}
+}
+
+func Test_RouteTable_LowestMetricWins(t *testing.T) {
+	prefix := netip.MustParsePrefix("10.0.0.0/8")
+	table := tableWith(
+		Route{Destination: prefix, Gateway: netip.MustParseAddr("192.0.2.20"), Metric: 20},
+		Route{Destination: prefix, Gateway: netip.MustParseAddr("192.0.2.10"), Metric: 10},
+		Route{Destination: prefix, Gateway: netip.MustParseAddr("192.0.2.30"), Metric: 30},
+	)
+
+	if got := lookupGateway(t, table, "10.0.0.1"); got != "192.0.2.10" {
+		t.Errorf("expected the metric 10 route, got %s", got)
+	}
+
+	table.remove(prefix, func(entry *routeEntry) bool { return entry.Metric == 10 })
+
+	if got := lookupGateway(t, table, "10.0.0.1"); got != "192.0.2.20" {
+		t.Errorf("expected the metric 20 route once the metric 10 one was gone, got %s", got)
+	}
+}
+
+func Test_RouteTable_DuplicatesAreRefused(t *testing.T) {
+	route := Route{Destination: netip.MustParsePrefix("10.0.0.0/8"), Gateway: netip.MustParseAddr("192.0.2.8")}
+	table := tableWith(route)
+
+	if table.add(&routeEntry{Route: route}) {
+		t.Errorf("expected the same route to be refused")
+	}
+}
+
+func Test_RouteTable_RemovingEverythingLeavesNoNodes(t *testing.T) {
+	prefixes := []string{"10.0.0.0/8", "10.1.0.0/16", "10.2.0.0/16", "10.1.1.0/24", "0.0.0.0/0", "192.168.0.0/16"}
+	table := newRouteTable()
+
+	for _, prefix := range prefixes {
+		table.add(&routeEntry{Route: Route{Destination: netip.MustParsePrefix(prefix)}})
+	}
+
+	for _, prefix := range prefixes {
+		if _, ok := table.remove(netip.MustParsePrefix(prefix), func(*routeEntry) bool { return true }); !ok {
+			t.Fatalf("expected to remove %s", prefix)
+		}
+	}
+
+	if table.root != nil || table.size != 0 || len(table.all()) != 0 {
+		t.Errorf("expected an empty trie, have %d routes", table.size)
+	}
+}
+
+// randomRoutes makes count routes with random prefixes, weighted towards the lengths a real table has most of
+func randomRoutes(r *rand.Rand, count int) []Route {
+	lengths := []int{8, 12, 16, 20, 22, 23, 24, 24, 24, 24, 28, 32}
+	routes := make([]Route, count)
+
+	for i := range routes {
+		addr := netip.AddrFrom4([4]byte{byte(r.Uint32()), byte(r.Uint32()), byte(r.Uint32()), byte(r.Uint32())})
+		prefix := netip.PrefixFrom(addr, lengths[r.IntN(len(lengths))]).Masked()
+		routes[i] = Route{Destination: prefix, Gateway: addr, Metric: r.IntN(4)}
+	}
+
+	return routes
+}
+
+func randomAddr(r *rand.Rand) netip.Addr {
+	return netip.AddrFrom4([4]byte{byte(r.Uint32()), byte(r.Uint32()), byte(r.Uint32()), byte(r.Uint32())})
+}
+
+// The trie has to agree with the obvious way of doing it: check every route
+func Test_RouteTable_MatchesALinearScan(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+	routes := randomRoutes(r, 5000)
+	table := newRouteTable()
+	added := []Route{}
+
+	for _, route := range routes {
+		if table.add(&routeEntry{Route: route}) {
+			added = append(added, route)
+		}
+	}
+
+	for range 20000 {
+		// Half the lookups are inside a route, so most of them match something more specific than nothing
+		destination := randomAddr(r)
+		if r.IntN(2) == 0 {
+			destination = added[r.IntN(len(added))].Destination.Addr().Next()
+		}
+
+		var best *Route
+		for i, route := range added {
+			if !route.Destination.Contains(destination) {
+				continue
+			}
+
+			if best == nil || route.Destination.Bits() > best.Destination.Bits() ||
+				(route.Destination.Bits() == best.Destination.Bits() && route.Metric < best.Metric) {
+				best = &added[i]
+			}
+		}
+
+		entry, ok := table.lookup(destination)
+
+		switch {
+		case best == nil && ok:
+			t.Fatalf("expected no route for %s, got %s", destination, entry.Destination)
+		case best != nil && !ok:
+			t.Fatalf("expected %s for %s, got nothing", best.Destination, destination)
+		case best != nil && (entry.Destination != best.Destination || entry.Metric != best.Metric):
+			t.Fatalf("expected %s metric %d for %s, got %s metric %d", best.Destination, best.Metric, destination, entry.Destination, entry.Metric)
+		}
+	}
+}
+
+func newBenchmarkTable(b *testing.B, count int) *routeTable {
+	b.Helper()
+
+	table := newRouteTable()
+
+	for _, route := range randomRoutes(rand.New(rand.NewPCG(1, 2)), count) {
+		table.add(&routeEntry{Route: route})
+	}
+
+	return table
+}
+
+func BenchmarkRouteTable_Add100k(b *testing.B) {
+	routes := randomRoutes(rand.New(rand.NewPCG(1, 2)), 100_000)
+
+	for b.Loop() {
+		table := newRouteTable()
+
+		for _, route := range routes {
+			table.add(&routeEntry{Route: route})
+		}
+	}
+}
+
+func BenchmarkRouteTable_Lookup100k(b *testing.B) {
+	table := newBenchmarkTable(b, 100_000)
+	r := rand.New(rand.NewPCG(3, 4))
+	destinations := make([]netip.Addr, 4096)
+
+	for i := range destinations {
+		destinations[i] = randomAddr(r)
+	}
+
+	i := 0
+	for b.Loop() {
+		table.lookup(destinations[i%len(destinations)])
+		i++
+	}
+}
+
+func BenchmarkRouteTable_Lookup1M(b *testing.B) {
+	table := newBenchmarkTable(b, 1_000_000)
+	r := rand.New(rand.NewPCG(3, 4))
+	destinations := make([]netip.Addr, 4096)
+
+	for i := range destinations {
+		destinations[i] = randomAddr(r)
+	}
+
+	i := 0
+	for b.Loop() {
+		table.lookup(destinations[i%len(destinations)])
+		i++
+	}
+}
+
+func BenchmarkRouteTable_LookupParallel100k(b *testing.B) {
+	table := newBenchmarkTable(b, 100_000)
+
+	b.RunParallel(func(pb *testing.PB) {
+		r := rand.New(rand.NewPCG(rand.Uint64(), 4))
+
+		for pb.Next() {
+			table.lookup(randomAddr(r))
+		}
+	})
+}
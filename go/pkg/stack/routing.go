@@ -0,0 +1,212 @@
+package stack
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+)
+
+var (
+	ErrNoSuchInterface    = errors.New("no such interface")
+	ErrRouteExists        = errors.New("route already exists")
+	ErrNoSuchRoute        = errors.New("no such route")
+	ErrGatewayUnreachable = errors.New("gateway is not on a directly connected network")
+)
+
+// Route says where packets for Destination go: straight to the destination out of Interface if Gateway is unset
+// (an on-link route), or to Gateway otherwise. A destination of 0.0.0.0/0 makes Gateway the default gateway.
+// Only IPv4 routes can be added; IPv6 ones come from interface addresses and router advertisements.
+// When several routes have the longest prefix that matches, the one with the lowest Metric is used.
+type Route struct {
+	Destination netip.Prefix
+	Gateway     netip.Addr
+	// The name of the interface. It can be left empty for a route with a gateway, which then goes out of the
+	// interface the gateway is reached through.
+	Interface string
+	Metric    int
+}
+
+// AddRoute adds a route to the routing table. Every interface already has an on-link route for its subnet.
+func (s *Stack) AddRoute(route Route) error {
+	if !route.Destination.IsValid() || !route.Destination.Addr().Is4() {
+		return fmt.Errorf("route destination must be an IPv4 prefix: %s", route.Destination)
+	}
+
+	if route.Gateway.IsValid() && !route.Gateway.Is4() {
+		return fmt.Errorf("route gateway must be IPv4: %s", route.Gateway)
+	}
+
+	if !route.Gateway.IsValid() && route.Interface == "" {
+		return fmt.Errorf("on-link route for %s needs an interface", route.Destination)
+	}
+
+	if route.Metric < 0 {
+		return fmt.Errorf("route metric cannot be negative: %d", route.Metric)
+	}
+
+	route.Destination = route.Destination.Masked()
+	entry := &routeEntry{Route: route}
+
+	if route.Interface != "" {
+		entry.nic = s.interfaceByName(route.Interface)
+		if entry.nic == nil {
+			return fmt.Errorf("%w: %s", ErrNoSuchInterface, route.Interface)
+		}
+	}
+
+	// Like Linux, a gateway has to be reachable without another gateway, which also stops routes looping
+	if route.Gateway.IsValid() {
+		onLink, ok := s.routes.lookup(route.Gateway)
+		if !ok || onLink.Gateway.IsValid() || (entry.nic != nil && onLink.nic != entry.nic) {
+			return fmt.Errorf("%w: %s", ErrGatewayUnreachable, route.Gateway)
+		}
+
+		entry.nic = onLink.nic
+		entry.Interface = onLink.Interface
+	}
+
+	if !s.routes.add(entry) {
+		return fmt.Errorf("%w: %s", ErrRouteExists, route.Destination)
+	}
+
+	return nil
+}
+
+// DeleteRoute removes the first route for route.Destination with the same metric, and the same gateway and
+// interface unless those are left unset
+func (s *Stack) DeleteRoute(route Route) error {
+	if !route.Destination.IsValid() || !route.Destination.Addr().Is4() {
+		return fmt.Errorf("route destination must be an IPv4 prefix: %s", route.Destination)
+	}
+
+	_, ok := s.routes.remove(route.Destination, func(entry *routeEntry) bool {
+		return entry.Metric == route.Metric &&
+			(!route.Gateway.IsValid() || entry.Gateway == route.Gateway) &&
+			(route.Interface == "" || entry.Interface == route.Interface)
+	})
+
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoSuchRoute, route.Destination)
+	}
+
+	return nil
+}
+
+// Routes returns every route in the table, ordered by destination, followed by the IPv6 routes the interfaces'
+// addresses and router advertisements make
+func (s *Stack) Routes() []Route {
+	ipv6Routes := []Route{}
+	for _, nic := range s.Interfaces() {
+		ipv6Routes = append(ipv6Routes, nic.ipv6Routes()...)
+	}
+
+	slices.SortStableFunc(ipv6Routes, compareRoutes)
+
+	return append(s.routes.all(), ipv6Routes...)
+}
+
+func (s *Stack) interfaceByName(name string) *Interface {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, nic := range s.interfaces {
+		if nic.Name == name {
+			return nic
+		}
+	}
+
+	return nil
+}
+
+// route picks the interface for destination, and the next hop to send it to on that interface
+func (s *Stack) route(destination netip.Addr) (*Interface, netip.Addr, error) {
+	// The limited broadcast is never routed, but is obvious with only one interface to send it out of
+	if destination == limitedBroadcast {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+
+		if len(s.interfaces) == 1 {
+			return s.interfaces[0], destination, nil
+		}
+	}
+
+	if !destination.Is4() || destination == limitedBroadcast {
+		return nil, netip.Addr{}, fmt.Errorf("%w: %s", ErrNoRoute, destination)
+	}
+
+	entry, ok := s.routes.lookup(destination)
+	if !ok {
+		return nil, netip.Addr{}, fmt.Errorf("%w: %s", ErrNoRoute, destination)
+	}
+
+	if entry.Gateway.IsValid() {
+		return entry.nic, entry.Gateway, nil
+	}
+
+	return entry.nic, destination, nil
+}
+
+// routeIPv6 picks the interface for an IPv6 destination: one with an address to send from that has destination on
+// its link, or failing that one with a default router. Link-local and multicast destinations are on every link,
+// so go out of the first interface that can send to them.
+func (s *Stack) routeIPv6(destination netip.Addr) (*Interface, error) {
+	var viaRouter *Interface
+
+	for _, nic := range s.Interfaces() {
+		if !nic.ipv6Source(destination).IsValid() {
+			continue
+		}
+
+		nextHop, ok := nic.ipv6NextHop(destination)
+		if !ok {
+			continue
+		}
+
+		if nextHop == destination {
+			return nic, nil
+		}
+
+		if viaRouter == nil {
+			viaRouter = nic
+		}
+	}
+
+	if viaRouter == nil {
+		return nil, fmt.Errorf("%w: %s", ErrNoRoute, destination)
+	}
+
+	return viaRouter, nil
+}
+
+// routeInterface picks the interface for destination, whichever IP version it is
+func (s *Stack) routeInterface(destination netip.Addr) (*Interface, error) {
+	if destination.Is6() {
+		return s.routeIPv6(destination)
+	}
+
+	nic, _, err := s.route(destination)
+
+	return nic, err
+}
+
+// localAddress picks the address to send to destination from: the interface's address for IPv4, or the best of
+// its IPv6 addresses (RFC 6724)
+func (s *Stack) localAddress(destination netip.Addr) (netip.Addr, error) {
+	nic, err := s.routeInterface(destination)
+	if err != nil {
+		s.ipCounters(destination).OutNoRoutes.Inc()
+		return netip.Addr{}, err
+	}
+
+	if destination.Is4() {
+		return nic.Address.Addr(), nil
+	}
+
+	source := nic.ipv6Source(destination)
+	if !source.IsValid() {
+		return netip.Addr{}, fmt.Errorf("%w: for %s on %s", ErrNoSourceAddress, destination, nic.Name)
+	}
+
+	return source, nil
+}
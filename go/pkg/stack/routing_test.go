@@ -0,0 +1,137 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/arp"
+	"networking/pkg/ethernet"
+	"networking/pkg/link"
+)
+
+func Test_Routing_InterfacesGetAnOnLinkRoute(t *testing.T) {
+	s, _, _ := newStackWithRawPeer(t, link.IP)
+
+	routes := s.Routes()
+	expected := Route{Destination: netip.MustParsePrefix("10.0.0.0/24"), Interface: "s0"}
+
+	if len(routes) != 1 || routes[0] != expected {
+		t.Errorf("expected only the on-link route %+v, got %+v", expected, routes)
+	}
+}
+
+func Test_Routing_DefaultGatewayIsTheNextHop(t *testing.T) {
+	s, peer, _ := newStackWithRawPeer(t, link.Ethernet)
+	gateway := netip.MustParseAddr("10.0.0.254")
+
+	err := s.AddRoute(Route{Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: gateway})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(addressA.Addr(), 5000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = conn.WriteToUDPAddrPort([]byte("far away"), netip.MustParseAddrPort("198.51.100.7:53"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	raw, err := peer.ReadPacket()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	frame, err := ethernet.ParseRawFrame(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	request, err := arp.ParseRawPacket(context.TODO(), frame.Payload)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if request.Operation != arp.OperationRequest || request.TargetIP != gateway {
+		t.Errorf("expected an ARP request for the gateway, got %+v", request)
+	}
+}
+
+func Test_Routing_MoreSpecificAndCheaperRoutesWin(t *testing.T) {
+	s, _, _ := newStackWithRawPeer(t, link.IP)
+
+	routes := []Route{
+		{Destination: netip.MustParsePrefix("0.0.0.0/0"), Gateway: netip.MustParseAddr("10.0.0.254")},
+		{Destination: netip.MustParsePrefix("192.168.0.0/16"), Gateway: netip.MustParseAddr("10.0.0.10"), Metric: 100},
+		{Destination: netip.MustParsePrefix("192.168.0.0/16"), Gateway: netip.MustParseAddr("10.0.0.20"), Metric: 50},
+		{Destination: netip.MustParsePrefix("192.168.7.0/24"), Gateway: netip.MustParseAddr("10.0.0.30"), Metric: 200},
+	}
+
+	for _, route := range routes {
+		testhelpers.FailTestIfErrorIsPresent(t, s.AddRoute(route))
+	}
+
+	cases := map[string]string{
+		"10.0.0.77":   "10.0.0.77",
+		"8.8.8.8":     "10.0.0.254",
+		"192.168.1.1": "10.0.0.20",
+		"192.168.7.1": "10.0.0.30",
+	}
+
+	for destination, expected := range cases {
+		nic, nextHop, err := s.route(netip.MustParseAddr(destination))
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		if nic.Name != "s0" || nextHop.String() != expected {
+			t.Errorf("expected %s to go to %s, got %s on %s", destination, expected, nextHop, nic.Name)
+		}
+	}
+
+	err := s.DeleteRoute(Route{Destination: netip.MustParsePrefix("192.168.0.0/16"), Metric: 50})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if _, nextHop, _ := s.route(netip.MustParseAddr("192.168.1.1")); nextHop.String() != "10.0.0.10" {
+		t.Errorf("expected the metric 100 route once the cheaper one was deleted, got %s", nextHop)
+	}
+}
+
+func Test_Routing_WithoutADefaultRouteOffLinkIsUnreachable(t *testing.T) {
+	s, _, _ := newStackWithRawPeer(t, link.IP)
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(addressA.Addr(), 5000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if _, err := conn.WriteToUDPAddrPort([]byte("x"), netip.MustParseAddrPort("198.51.100.7:53")); !errors.Is(err, ErrNoRoute) {
+		t.Errorf("expected no route, got %v", err)
+	}
+}
+
+func Test_Routing_BadRoutesAreRefused(t *testing.T) {
+	s, _, _ := newStackWithRawPeer(t, link.IP)
+	anywhere := netip.MustParsePrefix("0.0.0.0/0")
+
+	cases := map[string]struct {
+		route    Route
+		expected error
+	}{
+		"gateway off-link": {Route{Destination: anywhere, Gateway: netip.MustParseAddr("172.16.0.1")}, ErrGatewayUnreachable},
+		"no interface":     {Route{Destination: anywhere, Interface: "eth9"}, ErrNoSuchInterface},
+		"duplicate":        {Route{Destination: netip.MustParsePrefix("10.0.0.0/24"), Interface: "s0"}, ErrRouteExists},
+	}
+
+	for name, c := range cases {
+		if err := s.AddRoute(c.route); !errors.Is(err, c.expected) {
+			t.Errorf("%s: expected %v, got %v", name, c.expected, err)
+		}
+	}
+
+	// A gateway only reachable through another gateway is not on-link either
+	testhelpers.FailTestIfErrorIsPresent(t, s.AddRoute(Route{Destination: netip.MustParsePrefix("172.16.0.0/12"), Gateway: netip.MustParseAddr("10.0.0.1")}))
+
+	if err := s.AddRoute(Route{Destination: anywhere, Gateway: netip.MustParseAddr("172.16.0.1")}); !errors.Is(err, ErrGatewayUnreachable) {
+		t.Errorf("expected a gateway behind a gateway to be refused, got %v", err)
+	}
+
+	if err := s.DeleteRoute(Route{Destination: anywhere}); !errors.Is(err, ErrNoSuchRoute) {
+		t.Errorf("expected deleting a missing route to fail, got %v", err)
+	}
+
+	for _, destination := range []netip.Prefix{{}, netip.MustParsePrefix("2001:db8::/32")} {
+		if err := s.DeleteRoute(Route{Destination: destination}); err == nil || errors.Is(err, ErrNoSuchRoute) {
+			t.Errorf("expected deleting a route to %s to be refused, got %v", destination, err)
+		}
+	}
+}
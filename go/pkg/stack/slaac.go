@@ -0,0 +1,381 @@
+package stack
+
+import (
+	"cmp"
+	"context"
+	"math/rand/v2"
+	"net/netip"
+	"slices"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+	"networking/pkg/link"
+)
+
+const (
+	// RFC 4861 10: a host waits up to a second before its first router solicitation, then sends up to three
+	// four seconds apart
+	maxRtrSolicitationDelay = time.Second
+	rtrSolicitationInterval = 4 * time.Second
+	maxRtrSolicitations     = 3
+	// RFC 7217 7: how many times a stable-privacy address is formed again after duplicate address detection fails
+	idgenRetries = 3
+	// RFC 4862 5.5.3 e): an advertisement cannot cut an address's remaining valid lifetime below two hours, so a
+	// spoofed one cannot take the address away
+	minRemainingLifetime = 2 * time.Hour
+)
+
+var linkLocalSubnet = netip.MustParsePrefix("fe80::/64")
+
+// defaultRouter is a router that advertised itself, until its router lifetime runs out (RFC 4861 6.3.4)
+type defaultRouter struct {
+	address netip.Addr
+	timer   *wheelTimer
+}
+
+// onLinkPrefix is an advertised prefix whose addresses are reached directly rather than through a router
+// (RFC 4861 6.3.4), until its valid lifetime runs out
+type onLinkPrefix struct {
+	prefix netip.Prefix
+	timer  *wheelTimer
+}
+
+// lifetimeDeadline is when a lifetime in seconds from an advertisement runs out, or zero for the infinite one
+func lifetimeDeadline(now time.Time, seconds uint32) time.Time {
+	if seconds == icmpv6.InfiniteLifetime {
+		return time.Time{}
+	}
+
+	return now.Add(time.Duration(seconds) * time.Second)
+}
+
+// autoconfigureLinkLocal gives the interface its fe80::/64 address (RFC 4862 5.3). Router solicitations follow once
+// it has passed duplicate address detection.
+func (nic *Interface) autoconfigureLinkLocal() {
+	if err := nic.autoconfigureAddress(linkLocalSubnet, 0, time.Time{}, time.Time{}); err != nil {
+		nic.stack.logger().Error("failed to autoconfigure link-local address", "iface", nic.Name, "error", err.Error())
+	}
+}
+
+// autoconfigureAddress adds the address formed from a /64 prefix and the interface identifier
+func (nic *Interface) autoconfigureAddress(prefix netip.Prefix, dadCounter uint8, preferredUntil, validUntil time.Time) error {
+	var id [8]byte
+
+	if secret := nic.stack.options.StableSecret; len(secret) > 0 {
+		id = ipv6.StablePrivacyInterfaceID(prefix, nic.Name, dadCounter, secret)
+	} else {
+		id = ipv6.InterfaceIDFromMAC(nic.Link.HardwareAddress())
+	}
+
+	return nic.addIPv6Address(&ipv6Address{
+		InterfaceAddress: InterfaceAddress{
+			Prefix:         netip.PrefixFrom(ipv6.AddressWithInterfaceID(prefix, id), prefix.Bits()),
+			Autoconfigured: true,
+			PreferredUntil: preferredUntil,
+			ValidUntil:     validUntil,
+		},
+		dadCounter: dadCounter,
+	})
+}
+
+// autoconfigureAgain replaces a stable-privacy address that turned out to be a duplicate
+func (nic *Interface) autoconfigureAgain(duplicate *ipv6Address) {
+	prefix := duplicate.Prefix.Masked()
+
+	if err := nic.autoconfigureAddress(prefix, duplicate.dadCounter+1, duplicate.PreferredUntil, duplicate.ValidUntil); err != nil {
+		nic.stack.logger().Error("failed to autoconfigure address", "iface", nic.Name, "prefix", prefix.String(), "error", err.Error())
+	}
+}
+
+// addressPreferred is told each time an address passes duplicate address detection. Routers are only asked to
+// advertise once the link-local address they will answer is ours.
+func (nic *Interface) addressPreferred(address *ipv6Address) {
+	if address.Autoconfigured && ipv6.IsLinkLocal(address.Prefix.Addr()) {
+		nic.startRouterSolicitation()
+	}
+}
+
+// startRouterSolicitation asks routers to advertise rather than waiting for them to get round to it (RFC 4861 6.3.7)
+func (nic *Interface) startRouterSolicitation() {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	if nic.solicitTimer != nil {
+		return
+	}
+
+	nic.solicitationsLeft = maxRtrSolicitations
+	nic.solicitTimer = nic.stack.timers.newTimer(nic.solicitRouters)
+	// A random delay, so hosts that come up together do not all solicit at once
+	nic.solicitTimer.reset(rand.N(maxRtrSolicitationDelay))
+}
+
+func (nic *Interface) solicitRouters() {
+	nic.ipv6Mu.Lock()
+
+	if nic.solicitationsLeft == 0 {
+		nic.ipv6Mu.Unlock()
+		return
+	}
+
+	nic.solicitationsLeft--
+	if nic.solicitationsLeft > 0 {
+		nic.solicitTimer.reset(rtrSolicitationInterval)
+	}
+
+	nic.ipv6Mu.Unlock()
+
+	ctx, tr := nic.stack.startTrace()
+	defer tr.Finish()
+
+	trace.Annotate(ctx, trace.Sent, "router solicitation", "iface", nic.Name)
+
+	_ = nic.stack.sendRouterSolicitation(ctx, nic)
+}
+
+// stopRouterSolicitation stops asking once a router has advertised
+func (nic *Interface) stopRouterSolicitation() {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	nic.solicitationsLeft = 0
+
+	if nic.solicitTimer != nil {
+		nic.solicitTimer.stop()
+	}
+}
+
+// learnFromRouterAdvertisement updates the default router list and the prefix list (RFC 4861 6.3.4), and forms
+// addresses from the prefixes hosts may autoconfigure from (RFC 4862 5.5.3)
+func (nic *Interface) learnFromRouterAdvertisement(ctx context.Context, router netip.Addr, advertisement *icmpv6.RouterAdvertisement) {
+	nic.stopRouterSolicitation()
+	nic.updateRouter(router, time.Duration(advertisement.RouterLifetime)*time.Second)
+
+	for _, option := range advertisement.Options {
+		if option.Type != icmpv6.NDPOptionPrefixInformation {
+			continue
+		}
+
+		information := option.PrefixInformation
+
+		if ipv6.IsLinkLocal(information.Prefix.Addr()) {
+			trace.Annotate(ctx, trace.Dropped, "link-local prefix advertised", "prefix", information.Prefix.String())
+			continue
+		}
+
+		if information.OnLink {
+			nic.updatePrefix(information.Prefix.Masked(), information.ValidLifetime)
+		}
+
+		if information.Autonomous {
+			nic.autoconfigurePrefix(ctx, information)
+		}
+	}
+}
+
+// updateRouter adds or refreshes a default router, or removes it when its lifetime is zero
+func (nic *Interface) updateRouter(address netip.Addr, lifetime time.Duration) {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	i := slices.IndexFunc(nic.routers, func(r *defaultRouter) bool { return r.address == address })
+
+	if lifetime == 0 {
+		if i >= 0 {
+			nic.routers[i].timer.stop()
+			nic.routers = slices.Delete(nic.routers, i, i+1)
+		}
+
+		return
+	}
+
+	if i < 0 {
+		router := &defaultRouter{address: address}
+		router.timer = nic.stack.timers.newTimer(func() { nic.expireRouter(router) })
+		nic.routers = append(nic.routers, router)
+		i = len(nic.routers) - 1
+
+		nic.stack.logger().Info("IPv6 default router added", "iface", nic.Name, "router", address.String())
+	}
+
+	nic.routers[i].timer.reset(lifetime)
+}
+
+func (nic *Interface) expireRouter(router *defaultRouter) {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	nic.routers = slices.DeleteFunc(nic.routers, func(r *defaultRouter) bool { return r == router })
+	nic.stack.logger().Info("IPv6 default router expired", "iface", nic.Name, "router", router.address.String())
+}
+
+// updatePrefix adds or refreshes an on-link prefix, or removes it when its valid lifetime is zero
+func (nic *Interface) updatePrefix(prefix netip.Prefix, validLifetime uint32) {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	i := slices.IndexFunc(nic.prefixes, func(p *onLinkPrefix) bool { return p.prefix == prefix })
+
+	if validLifetime == 0 {
+		if i >= 0 {
+			nic.prefixes[i].timer.stop()
+			nic.prefixes = slices.Delete(nic.prefixes, i, i+1)
+		}
+
+		return
+	}
+
+	if i < 0 {
+		onLink := &onLinkPrefix{prefix: prefix}
+		onLink.timer = nic.stack.timers.newTimer(func() { nic.expirePrefix(onLink) })
+		nic.prefixes = append(nic.prefixes, onLink)
+		i = len(nic.prefixes) - 1
+	}
+
+	if validLifetime == icmpv6.InfiniteLifetime {
+		nic.prefixes[i].timer.stop()
+	} else {
+		nic.prefixes[i].timer.reset(time.Duration(validLifetime) * time.Second)
+	}
+}
+
+func (nic *Interface) expirePrefix(onLink *onLinkPrefix) {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	nic.prefixes = slices.DeleteFunc(nic.prefixes, func(p *onLinkPrefix) bool { return p == onLink })
+}
+
+// autoconfigurePrefix forms an address from an advertised prefix, or updates the lifetimes of the one already
+// formed from it (RFC 4862 5.5.3)
+func (nic *Interface) autoconfigurePrefix(ctx context.Context, information icmpv6.PrefixInformation) {
+	prefix := information.Prefix.Masked()
+	fields := []any{"prefix", prefix.String(), "preferred_lifetime", information.PreferredLifetime, "valid_lifetime", information.ValidLifetime}
+
+	if information.PreferredLifetime > information.ValidLifetime {
+		trace.Annotate(ctx, trace.Dropped, "preferred lifetime longer than valid lifetime", fields...)
+		return
+	}
+
+	now := nic.stack.clock.Now()
+	preferredUntil := lifetimeDeadline(now, information.PreferredLifetime)
+	validUntil := lifetimeDeadline(now, information.ValidLifetime)
+
+	nic.ipv6Mu.Lock()
+
+	i := slices.IndexFunc(nic.ipv6Addresses, func(a *ipv6Address) bool {
+		return a.Autoconfigured && a.State != AddressDuplicate && a.Prefix.Masked() == prefix
+	})
+
+	if i >= 0 {
+		address := nic.ipv6Addresses[i]
+		address.PreferredUntil = preferredUntil
+
+		remaining := address.ValidUntil.Sub(now)
+
+		switch {
+		case validUntil.IsZero() || time.Duration(information.ValidLifetime)*time.Second > minRemainingLifetime ||
+			(!address.ValidUntil.IsZero() && validUntil.After(address.ValidUntil)):
+			address.ValidUntil = validUntil
+		case address.ValidUntil.IsZero() || remaining > minRemainingLifetime:
+			address.ValidUntil = now.Add(minRemainingLifetime)
+		}
+
+		nic.checkLifetimes(address)
+		nic.ipv6Mu.Unlock()
+
+		trace.Annotate(ctx, trace.Delivered, "autoconfigured address refreshed", append(fields, "address", address.Prefix.Addr().String())...)
+
+		return
+	}
+
+	nic.ipv6Mu.Unlock()
+
+	if information.ValidLifetime == 0 {
+		return
+	}
+
+	if prefix.Bits() != ipv6.InterfaceIDBits {
+		trace.Annotate(ctx, trace.Dropped, "prefix length leaves no room for an interface identifier", fields...)
+		return
+	}
+
+	if err := nic.autoconfigureAddress(prefix, 0, preferredUntil, validUntil); err != nil {
+		trace.Annotate(ctx, trace.Dropped, "address not autoconfigured", append(fields, "error", err.Error())...)
+		return
+	}
+
+	trace.Annotate(ctx, trace.Delivered, "address autoconfigured", fields...)
+}
+
+// ipv6NextHop picks who to hand a packet for destination to (RFC 4861 5.2): destination itself if it is on the link,
+// or otherwise a default router, one that is known to be reachable when there is one (RFC 4861 6.3.6)
+func (nic *Interface) ipv6NextHop(destination netip.Addr) (netip.Addr, bool) {
+	if nic.Link.Type() == link.IP || destination.IsMulticast() || ipv6.IsLinkLocal(destination) {
+		return destination, true
+	}
+
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	if slices.ContainsFunc(nic.prefixes, func(p *onLinkPrefix) bool { return p.prefix.Contains(destination) }) {
+		return destination, true
+	}
+
+	// An added address brings its subnet with it, but an autoconfigured one says nothing about what is on the
+	// link (RFC 5942)
+	if slices.ContainsFunc(nic.ipv6Addresses, func(a *ipv6Address) bool {
+		return !a.Autoconfigured && a.Prefix.Contains(destination)
+	}) {
+		return destination, true
+	}
+
+	if len(nic.routers) == 0 {
+		return netip.Addr{}, false
+	}
+
+	for _, router := range nic.routers {
+		if _, ok := nic.neighbors.lookup(router.address); ok {
+			return router.address, true
+		}
+	}
+
+	return nic.routers[0].address, true
+}
+
+// ipv6Routes describes the interface's IPv6 next hop choices as routes: the subnets of its added addresses and
+// advertised prefixes on the link, and a default route through each router
+func (nic *Interface) ipv6Routes() []Route {
+	nic.ipv6Mu.Lock()
+	defer nic.ipv6Mu.Unlock()
+
+	routes := []Route{}
+	onLink := func(prefix netip.Prefix) {
+		route := Route{Destination: prefix.Masked(), Interface: nic.Name}
+		if !slices.Contains(routes, route) {
+			routes = append(routes, route)
+		}
+	}
+
+	for _, address := range nic.ipv6Addresses {
+		if !address.Autoconfigured && address.Prefix.Bits() < 128 {
+			onLink(address.Prefix)
+		}
+	}
+
+	for _, prefix := range nic.prefixes {
+		onLink(prefix.prefix)
+	}
+
+	for _, router := range nic.routers {
+		routes = append(routes, Route{Destination: netip.PrefixFrom(netip.IPv6Unspecified(), 0), Gateway: router.address, Interface: nic.Name})
+	}
+
+	return routes
+}
+
+func compareRoutes(a, b Route) int {
+	return cmp.Or(a.Destination.Addr().Compare(b.Destination.Addr()), cmp.Compare(a.Destination.Bits(), b.Destination.Bits()))
+}
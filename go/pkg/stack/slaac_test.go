@@ -0,0 +1,310 @@
+package stack
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	testhelpers "networking/internal/test_helpers"
+	"networking/internal/trace"
+	"networking/pkg/ethernet"
+	"networking/pkg/icmpv6"
+	"networking/pkg/ipv6"
+	"networking/pkg/link"
+)
+
+var (
+	advertisedPrefix = netip.MustParsePrefix("2001:db8:1::/64")
+	defaultRoute     = Route{Destination: netip.MustParsePrefix("::/0"), Gateway: peerLinkLocal, Interface: "s0"}
+)
+
+// newAutoconfStack is a stack on a fake clock that autoconfigures IPv6 on an Ethernet link, returning the far end
+// of the link for the test to play the router on
+func newAutoconfStack(t *testing.T, options Options) (*Stack, *Interface, *link.Pipe, *clock.Fake, *trace.RingRecorder) {
+	t.Helper()
+
+	options.IPv6Autoconf = true
+
+	return newUnaddressedIPv6Stack(t, link.Ethernet, options)
+}
+
+func eui64Address(prefix netip.Prefix, mac ethernet.MAC) netip.Addr {
+	return ipv6.AddressWithInterfaceID(prefix, ipv6.InterfaceIDFromMAC(mac))
+}
+
+// advertise sends a router advertisement from the peer, at fe80::9, and waits for the stack to take it in
+func advertise(t *testing.T, peer *link.Pipe, recorder *trace.RingRecorder, routerLifetime uint16, prefixes ...icmpv6.PrefixInformation) {
+	t.Helper()
+
+	advertisement := &icmpv6.RouterAdvertisement{
+		RouterLifetime: routerLifetime,
+		Options:        []icmpv6.NDPOption{icmpv6.NewLinkLayerAddressOption(icmpv6.NDPOptionSourceLinkLayerAddress, peer.HardwareAddress())},
+	}
+
+	for _, prefix := range prefixes {
+		advertisement.Options = append(advertisement.Options, icmpv6.NewPrefixInformationOption(prefix))
+	}
+
+	message, err := advertisement.Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	before := countDecisions(recorder, trace.Delivered, "router advertisement received")
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(ipv6.AllNodes), icmpv6Packet(t, peerLinkLocal, ipv6.AllNodes, 255, message))
+
+	waitFor(t, "the router advertisement to be received", func() bool {
+		return countDecisions(recorder, trace.Delivered, "router advertisement received") > before
+	})
+}
+
+func countDecisions(recorder *trace.RingRecorder, decision trace.Decision, reason string) int {
+	count := 0
+
+	for _, tr := range recorder.Recent() {
+		for _, event := range tr.Events() {
+			if event.Decision == decision && event.Reason == reason {
+				count++
+			}
+		}
+	}
+
+	return count
+}
+
+// autoconfiguredAddress returns the interface's address from prefix
+func autoconfiguredAddress(nic *Interface, prefix netip.Prefix) (InterfaceAddress, bool) {
+	for _, address := range nic.IPv6Addresses() {
+		if address.Autoconfigured && address.Prefix.Masked() == prefix {
+			return address, true
+		}
+	}
+
+	return InterfaceAddress{}, false
+}
+
+func Test_SLAAC_LinkLocalFromTheMACThenRouterSolicitations(t *testing.T) {
+	s, nic, peer, clk, recorder := newAutoconfStack(t, Options{})
+	linkLocal := eui64Address(linkLocalSubnet, nic.Link.HardwareAddress())
+
+	readDADProbe(t, peer, linkLocal)
+	clk.Advance(time.Second)
+	waitForAddressState(t, nic, linkLocal, AddressPreferred)
+
+	// The first solicitation waits a random time of up to a second
+	clk.Advance(time.Second)
+
+	destination, packet, message := readICMPv6(t, peer)
+
+	if message.Type != icmpv6.TypeRouterSolicitation || packet.Source != linkLocal || packet.Destination != ipv6.AllRouters || destination != ethernet.IPv6MulticastMAC(ipv6.AllRouters) {
+		t.Fatalf("expected a router solicitation from %s to all routers, got type %d from %s to %s", linkLocal, message.Type, packet.Source, packet.Destination)
+	}
+
+	solicitation, err := icmpv6.ParseRouterSolicitation(message)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if mac, ok := icmpv6.LinkLayerAddress(solicitation.Options, icmpv6.NDPOptionSourceLinkLayerAddress); !ok || mac != nic.Link.HardwareAddress() {
+		t.Errorf("expected our link-layer address in the solicitation, got %s", mac)
+	}
+
+	clk.Advance(rtrSolicitationInterval)
+	readICMPv6(t, peer)
+	waitForCounter(t, s, "ipv6IfIcmpOutRouterSolicits", 2)
+
+	// Once a router answers, no more are sent
+	advertise(t, peer, recorder, 1800)
+	clk.Advance(2 * rtrSolicitationInterval)
+	waitForCounter(t, s, "ipv6IfIcmpOutRouterSolicits", 2)
+}
+
+func Test_SLAAC_StablePrivacyLinkLocal(t *testing.T) {
+	secret := []byte("stable secret")
+	_, nic, _, _, _ := newAutoconfStack(t, Options{DisableDAD: true, StableSecret: secret})
+
+	expected := ipv6.AddressWithInterfaceID(linkLocalSubnet, ipv6.StablePrivacyInterfaceID(linkLocalSubnet, "s0", 0, secret))
+	addresses := nic.IPv6Addresses()
+
+	if len(addresses) != 1 || addresses[0].Prefix != netip.PrefixFrom(expected, 64) || addresses[0].State != AddressPreferred {
+		t.Errorf("expected %s/64, got %+v", expected, addresses)
+	}
+}
+
+func Test_SLAAC_StablePrivacyAddressIsFormedAgainWhenDuplicate(t *testing.T) {
+	secret := []byte("stable secret")
+	_, nic, peer, clk, _ := newAutoconfStack(t, Options{StableSecret: secret})
+
+	first := ipv6.AddressWithInterfaceID(linkLocalSubnet, ipv6.StablePrivacyInterfaceID(linkLocalSubnet, "s0", 0, secret))
+	second := ipv6.AddressWithInterfaceID(linkLocalSubnet, ipv6.StablePrivacyInterfaceID(linkLocalSubnet, "s0", 1, secret))
+
+	readDADProbe(t, peer, first)
+
+	probe, err := (&icmpv6.NeighborSolicitation{Target: first}).Message()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	group := ipv6.SolicitedNodeMulticast(first)
+	sendIPv6Raw(t, peer, ethernet.IPv6MulticastMAC(group), icmpv6Packet(t, netip.IPv6Unspecified(), group, 255, probe))
+
+	readDADProbe(t, peer, second)
+	clk.Advance(time.Second)
+	waitForAddressState(t, nic, second, AddressPreferred)
+
+	if _, ok := nic.ipv6AddressState(first); ok {
+		t.Errorf("expected the duplicate %s to be gone", first)
+	}
+}
+
+func Test_SLAAC_AddressAndDefaultRouteFromAdvertisement(t *testing.T) {
+	s, nic, peer, clk, recorder := newAutoconfStack(t, Options{DisableDAD: true})
+
+	advertise(t, peer, recorder, 1800, icmpv6.PrefixInformation{
+		Prefix:            advertisedPrefix,
+		OnLink:            true,
+		Autonomous:        true,
+		ValidLifetime:     7200,
+		PreferredLifetime: 3600,
+	})
+
+	address, ok := autoconfiguredAddress(nic, advertisedPrefix)
+	global := eui64Address(advertisedPrefix, nic.Link.HardwareAddress())
+
+	if !ok || address.Prefix != netip.PrefixFrom(global, 64) || address.State != AddressPreferred {
+		t.Fatalf("expected %s/64 preferred, got %+v", global, nic.IPv6Addresses())
+	}
+
+	if !address.PreferredUntil.Equal(clk.Now().Add(time.Hour)) || !address.ValidUntil.Equal(clk.Now().Add(2*time.Hour)) {
+		t.Errorf("expected lifetimes of an hour and two, got %s and %s", address.PreferredUntil, address.ValidUntil)
+	}
+
+	routes := s.Routes()
+	onLink := Route{Destination: advertisedPrefix, Interface: "s0"}
+
+	if !slices.Contains(routes, defaultRoute) || !slices.Contains(routes, onLink) {
+		t.Errorf("expected a default route through the router and the prefix on the link, got %+v", routes)
+	}
+
+	// A reply to somewhere off the link goes from the global address, through the router
+	remote := netip.MustParseAddr("2001:db8:2::5")
+	request := icmpv6.NewEcho(icmpv6.TypeEchoRequest, 7, 1, []byte("ping"))
+	sendIPv6Raw(t, peer, nic.Link.HardwareAddress(), icmpv6Packet(t, remote, global, 64, request))
+
+	destination, packet, reply := readICMPv6(t, peer)
+
+	if reply.Type != icmpv6.TypeEchoReply || packet.Source != global || packet.Destination != remote || destination != peer.HardwareAddress() {
+		t.Errorf("expected an echo reply from %s to %s via the router, got type %d from %s to %s via %s", global, remote, reply.Type, packet.Source, packet.Destination, destination)
+	}
+}
+
+func Test_SLAAC_LifetimesRunOut(t *testing.T) {
+	s, nic, peer, clk, recorder := newAutoconfStack(t, Options{DisableDAD: true})
+
+	advertise(t, peer, recorder, 30, icmpv6.PrefixInformation{
+		Prefix:            advertisedPrefix,
+		OnLink:            true,
+		Autonomous:        true,
+		ValidLifetime:     20,
+		PreferredLifetime: 10,
+	})
+
+	global := eui64Address(advertisedPrefix, nic.Link.HardwareAddress())
+
+	clk.Advance(10 * time.Second)
+	waitForAddressState(t, nic, global, AddressDeprecated)
+
+	if !s.hasIPv6Address(global) {
+		t.Errorf("expected a deprecated address to still be ours")
+	}
+
+	clk.Advance(10 * time.Second)
+
+	if _, ok := nic.ipv6AddressState(global); ok {
+		t.Errorf("expected %s to be removed once its valid lifetime ran out", global)
+	}
+
+	if slices.Contains(s.Routes(), Route{Destination: advertisedPrefix, Interface: "s0"}) {
+		t.Errorf("expected the prefix to be off the link once its valid lifetime ran out")
+	}
+
+	clk.Advance(10 * time.Second)
+
+	if slices.Contains(s.Routes(), defaultRoute) {
+		t.Errorf("expected the router to be gone once its lifetime ran out")
+	}
+
+	if _, ok := nic.ipv6NextHop(netip.MustParseAddr("2001:db8:2::5")); ok {
+		t.Errorf("expected no next hop off the link without a router")
+	}
+}
+
+func Test_SLAAC_AdvertisementsCannotCutTheValidLifetimeShort(t *testing.T) {
+	_, nic, peer, clk, recorder := newAutoconfStack(t, Options{DisableDAD: true})
+
+	information := icmpv6.PrefixInformation{Prefix: advertisedPrefix, Autonomous: true, ValidLifetime: 4 * 3600, PreferredLifetime: 3600}
+	advertise(t, peer, recorder, 0, information)
+
+	cases := []struct {
+		validLifetime uint32
+		expected      time.Duration
+	}{
+		// Shorter than two hours is raised to two hours
+		{60, 2 * time.Hour},
+		// Nothing can cut it below two hours once it is there
+		{0, 2 * time.Hour},
+		// Longer than two hours is taken as it is
+		{3 * 3600, 3 * time.Hour},
+		{icmpv6.InfiniteLifetime, 0},
+	}
+
+	for _, c := range cases {
+		information.ValidLifetime = c.validLifetime
+		information.PreferredLifetime = 0
+		advertise(t, peer, recorder, 0, information)
+
+		address, ok := autoconfiguredAddress(nic, advertisedPrefix)
+		if !ok {
+			t.Fatalf("expected an address from %s", advertisedPrefix)
+		}
+
+		expected := time.Time{}
+		if c.expected != 0 {
+			expected = clk.Now().Add(c.expected)
+		}
+
+		if !address.ValidUntil.Equal(expected) || address.State != AddressDeprecated {
+			t.Errorf("valid lifetime %d: expected a deprecated address valid until %s, got %s until %s", c.validLifetime, expected, address.State, address.ValidUntil)
+		}
+	}
+}
+
+func Test_SLAAC_IgnoresPrefixesItCannotUse(t *testing.T) {
+	_, nic, peer, _, recorder := newAutoconfStack(t, Options{DisableDAD: true})
+
+	advertise(t, peer, recorder, 0,
+		icmpv6.PrefixInformation{Prefix: netip.MustParsePrefix("2001:db8:2::/48"), Autonomous: true, ValidLifetime: 600, PreferredLifetime: 600},
+		icmpv6.PrefixInformation{Prefix: netip.MustParsePrefix("2001:db8:3::/64"), Autonomous: true, ValidLifetime: 600, PreferredLifetime: 1200},
+		icmpv6.PrefixInformation{Prefix: netip.MustParsePrefix("fe80::/64"), Autonomous: true, ValidLifetime: 600, PreferredLifetime: 600},
+	)
+
+	waitForDecision(t, recorder, trace.Dropped, "prefix length leaves no room for an interface identifier")
+	waitForDecision(t, recorder, trace.Dropped, "preferred lifetime longer than valid lifetime")
+	waitForDecision(t, recorder, trace.Dropped, "link-local prefix advertised")
+
+	if addresses := nic.IPv6Addresses(); len(addresses) != 1 {
+		t.Errorf("expected only the link-local address, got %+v", addresses)
+	}
+}
+
+func Test_SLAAC_RouterLifetimeZeroRemovesTheRouter(t *testing.T) {
+	s, _, peer, _, recorder := newAutoconfStack(t, Options{DisableDAD: true})
+
+	advertise(t, peer, recorder, 1800)
+
+	if !slices.Contains(s.Routes(), defaultRoute) {
+		t.Fatalf("expected a default route, got %+v", s.Routes())
+	}
+
+	advertise(t, peer, recorder, 0)
+
+	if slices.Contains(s.Routes(), defaultRoute) {
+		t.Errorf("expected the default route to be withdrawn, got %+v", s.Routes())
+	}
+}
@@ -0,0 +1,257 @@
+package stack
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+
+	"networking/internal/clock"
+	"networking/internal/logger"
+	"networking/internal/trace"
+	"networking/pkg/link"
+	"networking/pkg/metrics"
+)
+
+// Options configures a Stack
+type Options struct {
+	// Every packet's trace is handed to this once the stack is done with it.
+	// Nil means traces are only visible through the trace_id field in the logs.
+	TraceRecorder trace.Recorder
+	// Clock drives every timer in the stack. Nil means the wall clock.
+	Clock clock.Clock
+	// CongestionControl is the algorithm new TCP connections start with. Empty means NewReno.
+	CongestionControl CongestionControl
+	// DisableSACK stops TCP offering selective acknowledgments (RFC 2018), like Linux's tcp_sack sysctl
+	DisableSACK bool
+	// DisableSYNCookies drops SYNs when a listener's half-open queue is full, instead of answering them with
+	// SYN cookies (RFC 4987 3.6) like Linux's tcp_syncookies sysctl does by default
+	DisableSYNCookies bool
+	// ConntrackTimeouts are how long tracked flows last without traffic, by protocol and TCP state. Unset ones are
+	// Linux's defaults.
+	ConntrackTimeouts ConntrackTimeouts
+	// DisableDAD makes IPv6 addresses usable as soon as they are added, without checking that no one else on the
+	// link has them first, like Linux's accept_dad sysctl set to zero
+	DisableDAD bool
+	// DisableMTUProbing stops TCP searching for the path MTU itself (RFC 4821) when repeated timeouts suggest
+	// too-big messages are being black-holed, like Linux's default tcp_mtu_probing of zero. Left on, it is like
+	// tcp_mtu_probing set to one.
+	DisableMTUProbing bool
+	// IPv6Autoconf brings IPv6 up by itself on Ethernet interfaces: a link-local address as soon as one is added,
+	// then addresses and default routes from router advertisements (RFC 4862), like Linux's autoconf and accept_ra
+	// sysctls
+	IPv6Autoconf bool
+	// StableSecret makes autoconfigured addresses stable-privacy ones hashed with this secret (RFC 7217), rather
+	// than ones that embed the interface's MAC, like Linux's stable_secret sysctl
+	StableSecret []byte
+}
+
+// Stack is a user-space network stack. Interfaces feed it frames, and sockets read and write through it.
+type Stack struct {
+	// ctx carries the logger every packet's context is derived from
+	ctx     context.Context
+	options Options
+
+	mu         sync.RWMutex
+	interfaces []*Interface
+	closed     bool
+
+	routes *routeTable
+	pmtu   *pathMTUCache
+
+	// IPv4 and IPv6 datagrams whose fragments are still arriving
+	ipv4Fragments *reassemblyTable
+	ipv6Fragments *reassemblyTable
+
+	nat       *natTable
+	conntrack *conntrackTable
+	filter    *filterTable
+
+	udp *udpDemux
+	tcp *tcpDemux
+
+	// Counters for IP identification, which destinations share by hash
+	ipIdentifications [ipIdentificationBuckets]atomic.Uint32
+
+	// Key for the hashes that have to be unpredictable from outside, like ISNs and SYN cookies
+	secret [32]byte
+
+	clock  clock.Clock
+	timers *timerWheel
+
+	counters metrics.Counters
+
+	wg sync.WaitGroup
+}
+
+var ErrStackClosed = errors.New("stack closed")
+
+func New(ctx context.Context, options Options) *Stack {
+	if options.Clock == nil {
+		options.Clock = clock.Real{}
+	}
+
+	if options.CongestionControl == "" {
+		options.CongestionControl = NewReno
+	}
+
+	if _, err := newTCPCongestionAlgorithm(options.CongestionControl); err != nil {
+		logger.GetLoggerFromContext(ctx, nil).Error(err.Error(), "fallback", string(NewReno))
+		options.CongestionControl = NewReno
+	}
+
+	s := &Stack{
+		ctx:     ctx,
+		options: options,
+		udp:     newUDPDemux(),
+		tcp:     newTCPDemux(),
+		clock:   options.Clock,
+		timers:  newTimerWheel(options.Clock),
+		routes:  newRouteTable(),
+		pmtu:    newPathMTUCache(options.Clock.Now),
+		nat:     newNATTable(),
+		filter:  newFilterTable(),
+	}
+
+	s.ipv4Fragments = newReassemblyTable(s.clock, s.timers, ipv4ReassemblyTimeout, &s.counters.IP.ReasmFails, s.ipv4ReassemblyTimedOut)
+	s.ipv6Fragments = newReassemblyTable(s.clock, s.timers, ipv6ReassemblyTimeout, &s.counters.IPv6.ReasmFails, s.ipv6ReassemblyTimedOut)
+	s.conntrack = newConntrackTable(options.Clock, s.timers, options.ConntrackTimeouts)
+
+	_, _ = rand.Read(s.secret[:])
+
+	return s
+}
+
+// AddInterface attaches a link to the stack with a single address, and starts reading from it
+func (s *Stack) AddInterface(name string, l link.Link, address netip.Prefix) (*Interface, error) {
+	if !address.Addr().Is4() {
+		return nil, fmt.Errorf("interface address must be IPv4: %s", address)
+	}
+
+	nic, err := s.attachInterface(name, l, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only Ethernet links have routers advertising on them, and a MAC to build addresses from
+	if s.options.IPv6Autoconf && l.Type() == link.Ethernet {
+		nic.autoconfigureLinkLocal()
+	}
+
+	return nic, nil
+}
+
+func (s *Stack) attachInterface(name string, l link.Link, address netip.Prefix) (*Interface, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrStackClosed
+	}
+
+	for _, existing := range s.interfaces {
+		if existing.Name == name {
+			return nil, fmt.Errorf("interface %s already exists", name)
+		}
+	}
+
+	nic := &Interface{
+		Name:      name,
+		Link:      l,
+		Address:   address,
+		stack:     s,
+		neighbors: newNeighborCache(s.clock.Now),
+	}
+
+	s.interfaces = append(s.interfaces, nic)
+	s.routes.add(&routeEntry{Route: Route{Destination: address.Masked(), Interface: name}, nic: nic})
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		nic.readLoop()
+	}()
+
+	return nic, nil
+}
+
+// Interfaces returns the interfaces attached to the stack
+func (s *Stack) Interfaces() []*Interface {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]*Interface(nil), s.interfaces...)
+}
+
+// keyedHash hashes data with the stack's secret, for numbers that off-path attackers must not be able to predict
+// (RFC 6528 3)
+func (s *Stack) keyedHash(data []byte) uint32 {
+	keyed := make([]byte, 0, len(s.secret)+len(data))
+	keyed = append(keyed, s.secret[:]...)
+	keyed = append(keyed, data...)
+
+	sum := sha256.Sum256(keyed)
+
+	return binary.BigEndian.Uint32(sum[:4])
+}
+
+// Close closes every link and socket and waits for the stack to stop reading
+func (s *Stack) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+
+	s.closed = true
+	interfaces := s.interfaces
+	s.mu.Unlock()
+
+	for _, nic := range interfaces {
+		_ = nic.Link.Close()
+	}
+
+	s.udp.closeAll()
+	s.tcp.closeAll()
+	s.timers.close()
+	s.wg.Wait()
+
+	return nil
+}
+
+// Metrics returns the stack's counters. Take a Snapshot of them, or pass them to metrics.NewHandler.
+func (s *Stack) Metrics() *metrics.Counters {
+	return &s.counters
+}
+
+// hasAddress checks if addr belongs to one of the stack's interfaces
+func (s *Stack) hasAddress(addr netip.Addr) bool {
+	if addr.Is6() {
+		return s.hasIPv6Address(addr)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, nic := range s.interfaces {
+		if nic.Address.Addr() == addr {
+			return true
+		}
+	}
+
+	return false
+}
+
+// startTrace begins tracing a packet, in or out, on the stack's logger
+func (s *Stack) startTrace() (context.Context, *trace.Trace) {
+	return trace.Start(s.ctx, s.options.TraceRecorder)
+}
+
+func (s *Stack) logger() logger.LoggerInterface {
+	return logger.GetLoggerFromContext(s.ctx, nil)
+}
@@ -0,0 +1,523 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+	"networking/internal/trace"
+	"networking/pkg/ethernet"
+	"networking/pkg/icmp"
+	"networking/pkg/ipv4"
+	"networking/pkg/link"
+	"networking/pkg/udp"
+)
+
+var (
+	addressA = netip.MustParsePrefix("10.0.0.1/24")
+	addressB = netip.MustParsePrefix("10.0.0.2/24")
+)
+
+// newStackPair connects two stacks with an in-process link
+func newStackPair(t *testing.T, linkType link.Type) (*Stack, *Stack, *trace.RingRecorder) {
+	t.Helper()
+
+	recorder := trace.NewRingRecorder(64)
+	ctx := logger.NewMockLogger().WithLogger(context.Background())
+
+	linkA, linkB := link.NewPipe(linkType, 1500)
+	a := New(ctx, Options{TraceRecorder: recorder})
+	b := New(ctx, Options{TraceRecorder: recorder})
+
+	_, err := a.AddInterface("a0", linkA, addressA)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	_, err = b.AddInterface("b0", linkB, addressB)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+
+	return a, b, recorder
+}
+
+// newStackWithRawPeer attaches a stack to one end of a link, returning the other end for the test to drive
+func newStackWithRawPeer(t *testing.T, linkType link.Type) (*Stack, *link.Pipe, *trace.RingRecorder) {
+	t.Helper()
+
+	recorder := trace.NewRingRecorder(64)
+	ctx := logger.NewMockLogger().WithLogger(context.Background())
+
+	stackLink, peer := link.NewPipe(linkType, 1500)
+	s := New(ctx, Options{TraceRecorder: recorder})
+
+	_, err := s.AddInterface("s0", stackLink, addressA)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = peer.Close()
+	})
+
+	return s, peer, recorder
+}
+
+func readWithTimeout(t *testing.T, conn *UDPConn) ([]byte, netip.AddrPort) {
+	t.Helper()
+
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 2048)
+
+	n, from, err := conn.ReadFromUDPAddrPort(buffer)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return buffer[:n], from
+}
+
+// waitFor polls until done holds, since the stack works on its own goroutines and a test can only watch for what it
+// has sent to take effect
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForDecision waits until a trace records decision, since traces finish on the stack's goroutine
+func waitForDecision(t *testing.T, recorder *trace.RingRecorder, decision trace.Decision, reason string) trace.Event {
+	t.Helper()
+
+	var found trace.Event
+
+	waitFor(t, fmt.Sprintf("a trace to record %s: %s", decision, reason), func() bool {
+		for _, tr := range recorder.Recent() {
+			for _, event := range tr.Events() {
+				if event.Decision == decision && event.Reason == reason {
+					found = event
+					return true
+				}
+			}
+		}
+
+		return false
+	})
+
+	return found
+}
+
+func Test_UDP_EthernetRoundTrip(t *testing.T) {
+	a, b, recorder := newStackPair(t, link.Ethernet)
+
+	server, err := b.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 5353))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	client, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = client.WriteToUDPAddrPort([]byte("ping"), netip.AddrPortFrom(addressB.Addr(), 5353))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	data, from := readWithTimeout(t, server)
+	if string(data) != "ping" || from.Addr() != addressA.Addr() || from.Port() < firstEphemeralPort {
+		t.Errorf("unexpected datagram %q from %s", data, from)
+	}
+
+	_, err = server.WriteToUDPAddrPort([]byte("pong"), from)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	data, _ = readWithTimeout(t, client)
+	if string(data) != "pong" {
+		t.Errorf("expected pong, got %q", data)
+	}
+
+	event := waitForDecision(t, recorder, trace.Delivered, "datagram queued on socket")
+	if event.Layer != "socket" {
+		t.Errorf("expected delivery at the socket layer, got %s", event.Layer)
+	}
+}
+
+func Test_UDP_IPLinkRoundTrip(t *testing.T) {
+	a, b, _ := newStackPair(t, link.IP)
+
+	server, err := b.ListenUDP(netip.AddrPortFrom(addressB.Addr(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	client, err := a.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 7000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = client.WriteToUDPAddrPort([]byte("over ip"), netip.AddrPortFrom(addressB.Addr(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	data, from := readWithTimeout(t, server)
+	if string(data) != "over ip" || from != netip.AddrPortFrom(addressA.Addr(), 7000) {
+		t.Errorf("unexpected datagram %q from %s", data, from)
+	}
+}
+
+func Test_UDP_EmptyDatagramRoundTrip(t *testing.T) {
+	a, b, _ := newStackPair(t, link.Ethernet)
+
+	server, err := b.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	client, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	n, err := client.WriteToUDPAddrPort(nil, netip.AddrPortFrom(addressB.Addr(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	data, from := readWithTimeout(t, server)
+	if n != 0 || len(data) != 0 || from.Addr() != addressA.Addr() {
+		t.Errorf("expected an empty datagram from %s, got %d bytes from %s", addressA.Addr(), len(data), from)
+	}
+
+	_, err = server.WriteToUDPAddrPort([]byte{}, from)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if data, _ = readWithTimeout(t, client); len(data) != 0 {
+		t.Errorf("expected an empty reply, got %q", data)
+	}
+}
+
+func Test_UDP_DatagramTooLongIsRefused(t *testing.T) {
+	a, _, _ := newStackPair(t, link.Ethernet)
+
+	client, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	n, err := client.WriteToUDPAddrPort(make([]byte, udp.MaxDataLength+1), netip.AddrPortFrom(addressB.Addr(), 7))
+	if n != 0 || err == nil || !strings.Contains(err.Error(), "data too long for a UDP datagram") {
+		t.Errorf("expected the datagram to be refused as too long, got %d bytes written and %v", n, err)
+	}
+}
+
+func Test_UDP_DatagramLargerThanTheMTUIsReassembled(t *testing.T) {
+	a, b, _ := newStackPair(t, link.IP)
+
+	server, err := b.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	client, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	// Twice the link's MTU, so it has to leave in fragments and be put back together at the other end
+	data := []byte(strings.Repeat("larger than the link ", 150))
+
+	n, err := client.WriteToUDPAddrPort(data, netip.AddrPortFrom(addressB.Addr(), 7))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if n != len(data) {
+		t.Errorf("expected all %d bytes to be written, got %d", len(data), n)
+	}
+
+	_ = server.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buffer := make([]byte, 4096)
+
+	n, from, err := server.ReadFromUDPAddrPort(buffer)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if string(buffer[:n]) != string(data) || from.Addr() != addressA.Addr() {
+		t.Errorf("expected the whole %d byte datagram from %s, got %d bytes from %s", len(data), addressA.Addr(), n, from)
+	}
+
+	waitForCounter(t, a, "ipOutFragOKs", 1)
+	waitForCounter(t, b, "ipReasmOKs", 1)
+}
+
+func Test_Trace_NoListener(t *testing.T) {
+	a, _, recorder := newStackPair(t, link.Ethernet)
+
+	client, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = client.WriteToUDPAddrPort([]byte("anyone?"), netip.AddrPortFrom(addressB.Addr(), 9999))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	event := waitForDecision(t, recorder, trace.Dropped, "no listener on port")
+	if event.Layer != "udp" || event.Fields["dst_port"] != uint16(9999) {
+		t.Errorf("unexpected drop event: %+v", event)
+	}
+}
+
+func Test_Trace_FollowsPacketThroughEveryLayer(t *testing.T) {
+	s, peer, recorder := newStackWithRawPeer(t, link.IP)
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 4000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = peer.WritePacket(buildUDPPacket(t, []byte("traced"), false))
+	readWithTimeout(t, conn)
+
+	waitForDecision(t, recorder, trace.Delivered, "datagram queued on socket")
+
+	for _, tr := range recorder.Recent() {
+		if event, _ := tr.LastDecision(); event.Decision != trace.Delivered {
+			continue
+		}
+
+		layers := []string{}
+		for _, span := range tr.Spans() {
+			layers = append(layers, span.Layer)
+		}
+
+		expected := []string{"link", "ipv4", "udp", "socket"}
+		if len(layers) != len(expected) {
+			t.Fatalf("expected spans %v, got %v", expected, layers)
+		}
+
+		for i := range expected {
+			if layers[i] != expected[i] {
+				t.Errorf("expected spans %v, got %v", expected, layers)
+			}
+		}
+	}
+}
+
+func Test_Trace_UDPChecksumFailed(t *testing.T) {
+	s, peer, recorder := newStackWithRawPeer(t, link.IP)
+
+	_, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 4000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = peer.WritePacket(buildUDPPacket(t, []byte("corrupt"), true))
+
+	event := waitForDecision(t, recorder, trace.ChecksumFailed, "UDP checksum failed")
+	if event.Layer != "udp" {
+		t.Errorf("expected checksum failure at the udp layer, got %s", event.Layer)
+	}
+}
+
+func Test_Trace_IPv4ChecksumFailed(t *testing.T) {
+	_, peer, recorder := newStackWithRawPeer(t, link.IP)
+
+	packet := buildUDPPacket(t, []byte("bad header"), false)
+	packet[8]-- // Decrement the TTL without fixing the header checksum
+
+	_ = peer.WritePacket(packet)
+
+	waitForDecision(t, recorder, trace.ChecksumFailed, "IPv4 header checksum failed")
+}
+
+func Test_Trace_FrameForAnotherHost(t *testing.T) {
+	_, peer, recorder := newStackWithRawPeer(t, link.Ethernet)
+
+	frame := ethernet.Frame{
+		Destination: ethernet.MAC{0x02, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA},
+		Source:      peer.HardwareAddress(),
+		EtherType:   ethernet.EtherTypeIPv4,
+		Payload:     buildUDPPacket(t, []byte("not yours"), false),
+	}
+	raw, err := frame.CreateFrame(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = peer.WritePacket(raw)
+
+	event := waitForDecision(t, recorder, trace.Dropped, "frame not addressed to us")
+	if event.Layer != "ethernet" {
+		t.Errorf("expected drop at the ethernet layer, got %s", event.Layer)
+	}
+}
+
+func Test_ListenUDP_PortInUse(t *testing.T) {
+	s, _, _ := newStackWithRawPeer(t, link.IP)
+
+	_, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 4000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = s.ListenUDP(netip.AddrPortFrom(addressA.Addr(), 4000))
+	if err == nil {
+		t.Errorf("expected binding a specific address on a wildcard-bound port to fail")
+	}
+}
+
+func Test_UDPConn_ReadDeadline(t *testing.T) {
+	s, _, _ := newStackWithRawPeer(t, link.IP)
+
+	conn, err := s.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+
+	_, _, err = conn.ReadFrom(make([]byte, 10))
+	if err == nil {
+		t.Fatalf("expected read to time out")
+	}
+
+	if netErr, ok := err.(interface{ Timeout() bool }); !ok || !netErr.Timeout() {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+}
+
+// buildUDPPacket builds an IPv4 packet from 10.0.0.9:3000 to the stack's port 4000
+func buildUDPPacket(t *testing.T, data []byte, corruptChecksum bool) []byte {
+	t.Helper()
+
+	source := netip.MustParseAddr("10.0.0.9")
+
+	datagram := udp.UDPGram{SourcePort: 3000, DestinationPort: 4000, Data: data}
+	rawUDP, err := datagram.CreateUDPGramForAddresses(context.TODO(), source, addressA.Addr())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if corruptChecksum {
+		rawUDP[len(rawUDP)-1] ^= 0xFF
+	}
+
+	packet := ipv4.Packet{
+		TTL:         64,
+		Protocol:    ipv4.ProtocolUDP,
+		Source:      source,
+		Destination: addressA.Addr(),
+		Payload:     rawUDP,
+	}
+
+	raw, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	return raw
+}
+
+func waitForCounter(t *testing.T, s *Stack, name string, expected uint64) {
+	t.Helper()
+
+	waitFor(t, fmt.Sprintf("%s=%d", name, expected), func() bool {
+		actual, _ := s.Metrics().Snapshot().Get(name)
+		return actual == expected
+	})
+}
+
+func Test_Metrics_UDPRoundTrip(t *testing.T) {
+	a, b, _ := newStackPair(t, link.IP)
+
+	server, err := b.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 5353))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	client, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = client.WriteToUDPAddrPort([]byte("counted"), netip.AddrPortFrom(addressB.Addr(), 5353))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	readWithTimeout(t, server)
+
+	waitForCounter(t, a, "udpOutDatagrams", 1)
+	waitForCounter(t, a, "ipOutRequests", 1)
+	waitForCounter(t, b, "ipInReceives", 1)
+	waitForCounter(t, b, "ipInDelivers", 1)
+	waitForCounter(t, b, "udpInDatagrams", 1)
+}
+
+func Test_Metrics_NoPortsSendsPortUnreachable(t *testing.T) {
+	a, b, _ := newStackPair(t, link.Ethernet)
+
+	client, err := a.ListenUDP(netip.AddrPort{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = client.WriteToUDPAddrPort([]byte("anyone?"), netip.AddrPortFrom(addressB.Addr(), 9))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	waitForCounter(t, b, "udpNoPorts", 1)
+	waitForCounter(t, b, "icmpOutDestUnreachs", 1)
+	waitForCounter(t, a, "icmpInDestUnreachs", 1)
+}
+
+func Test_Metrics_UDPChecksumFailureIsAnInError(t *testing.T) {
+	s, peer, _ := newStackWithRawPeer(t, link.IP)
+
+	_, err := s.ListenUDP(netip.AddrPortFrom(netip.IPv4Unspecified(), 4000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = peer.WritePacket(buildUDPPacket(t, []byte("corrupt"), true))
+
+	waitForCounter(t, s, "udpInErrors", 1)
+	waitForCounter(t, s, "udpInDatagrams", 0)
+}
+
+func Test_ICMP_EchoRequestIsAnswered(t *testing.T) {
+	s, peer, _ := newStackWithRawPeer(t, link.IP)
+
+	request := icmp.NewEcho(icmp.TypeEchoRequest, 42, 1, []byte("ping data"))
+	rawRequest, err := request.CreateMessage(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	packet := ipv4.Packet{
+		TTL:         64,
+		Protocol:    ipv4.ProtocolICMP,
+		Source:      netip.MustParseAddr("10.0.0.9"),
+		Destination: addressA.Addr(),
+		Payload:     rawRequest,
+	}
+	rawPacket, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_ = peer.WritePacket(rawPacket)
+
+	rawReply, err := peer.ReadPacket()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	replyPacket, err := ipv4.ParseRawPacket(context.TODO(), rawReply)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	reply, err := icmp.ParseRawMessage(context.TODO(), replyPacket.Payload)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if reply.Type != icmp.TypeEchoReply || reply.Identifier() != 42 || reply.SequenceNumber() != 1 || string(reply.Data) != "ping data" {
+		t.Errorf("unexpected reply: %+v", reply)
+	}
+
+	waitForCounter(t, s, "icmpInEchos", 1)
+	waitForCounter(t, s, "icmpOutEchoReps", 1)
+}
+
+func Test_IPv4_IdentificationCountsPerDestination(t *testing.T) {
+	s, peer, _ := newStackWithRawPeer(t, link.IP)
+
+	conn, err := s.ListenUDP(netip.AddrPortFrom(addressA.Addr(), 5000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	first := netip.MustParseAddrPort("10.0.0.9:6000")
+	second := netip.MustParseAddrPort("10.0.0.10:6000")
+	ids := map[netip.Addr][]uint16{}
+
+	for _, destination := range []netip.AddrPort{first, second, first, second, first} {
+		_, err := conn.WriteToUDPAddrPort([]byte("id"), destination)
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		raw, err := peer.ReadPacket()
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		packet, err := ipv4.ParseRawPacket(context.TODO(), raw)
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		ids[packet.Destination] = append(ids[packet.Destination], packet.Identification)
+	}
+
+	// Each destination sees its own sequence, unaffected by what was sent to the other in between
+	for destination, sent := range ids {
+		for i := 1; i < len(sent); i++ {
+			if sent[i] != sent[i-1]+1 {
+				t.Errorf("expected IDs to %s to go up by one, got %v", destination, sent)
+			}
+		}
+	}
+
+	// The sequences start from points only the stack knows, which another stack does not share
+	other := New(logger.NewMockLogger().WithLogger(context.Background()), Options{})
+	t.Cleanup(func() { _ = other.Close() })
+
+	if other.nextIPIdentification(addressA.Addr(), first.Addr(), ipv4.ProtocolUDP) == ids[first.Addr()][2]+1 {
+		t.Errorf("expected another stack's IDs to start somewhere else")
+	}
+}
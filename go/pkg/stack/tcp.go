@@ -0,0 +1,579 @@
+package stack
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/ipv4"
+	"networking/pkg/tcp"
+)
+
+const (
+	tcpListenBacklog = 128
+
+	// Linux holds connections in TIME-WAIT for 60 seconds, which is 2*MSL for an MSL of 30 seconds
+	tcpMaximumSegmentLifetime = 30 * time.Second
+	tcpTimeWaitDuration       = 2 * tcpMaximumSegmentLifetime
+	// The ISN clock ticks every 4 microseconds (RFC 9293 3.4.1)
+	tcpISNClockTick = 4 * time.Microsecond
+)
+
+// Salts for tcpHash, so what one use of it gives away says nothing about another
+const (
+	tcpHashTimestampOffset uint32 = iota
+	tcpHashSYNCookieTuple
+	tcpHashSYNCookieCount
+	tcpHashISN
+)
+
+var (
+	ErrConnectionRefused = errors.New("connection refused")
+	ErrConnectionReset   = errors.New("connection reset by peer")
+	ErrConnectionClosing = errors.New("connection closing")
+)
+
+// tcpConnectionID is the 4-tuple that identifies a connection
+type tcpConnectionID struct {
+	local  netip.AddrPort
+	remote netip.AddrPort
+}
+
+// tcpDemux finds the connection, or failing that the listener, for a segment
+type tcpDemux struct {
+	mu          sync.RWMutex
+	listeners   map[netip.AddrPort]*TCPListener
+	connections map[tcpConnectionID]*TCPConn
+	next        uint16
+
+	// How long connections stay in TIME-WAIT
+	timeWait time.Duration
+}
+
+func newTCPDemux() *tcpDemux {
+	return &tcpDemux{
+		listeners:   map[netip.AddrPort]*TCPListener{},
+		connections: map[tcpConnectionID]*TCPConn{},
+		next:        firstEphemeralPort,
+		timeWait:    tcpTimeWaitDuration,
+	}
+}
+
+// listen binds a listener to local, which may be the wildcard address
+func (d *tcpDemux) listen(local netip.AddrPort, listener *TCPListener) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for bound := range d.listeners {
+		if bound.Port() != local.Port() {
+			continue
+		}
+
+		if addressesOverlap(bound.Addr(), local.Addr()) {
+			return fmt.Errorf("%w: %s", ErrPortInUse, local)
+		}
+	}
+
+	d.listeners[local] = listener
+
+	return nil
+}
+
+func (d *tcpDemux) unlisten(local netip.AddrPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.listeners, local)
+}
+
+// connect registers a connection, picking an ephemeral local port if id's local port is zero.
+// Returns the id the connection was registered under.
+func (d *tcpDemux) connect(id tcpConnectionID, conn *TCPConn) (tcpConnectionID, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if id.local.Port() != 0 {
+		if _, ok := d.connections[id]; ok {
+			return tcpConnectionID{}, fmt.Errorf("%w: %s to %s", ErrPortInUse, id.local, id.remote)
+		}
+
+		d.connections[id] = conn
+		return id, nil
+	}
+
+	for range lastEphemeralPort - firstEphemeralPort + 1 {
+		candidate := tcpConnectionID{local: netip.AddrPortFrom(id.local.Addr(), d.next), remote: id.remote}
+
+		d.next++
+		if d.next == 0 || d.next < firstEphemeralPort {
+			d.next = firstEphemeralPort
+		}
+
+		if !d.isPortTaken(candidate.local.Port()) {
+			d.connections[candidate] = conn
+			return candidate, nil
+		}
+	}
+
+	return tcpConnectionID{}, fmt.Errorf("%w: no ephemeral ports left", ErrPortInUse)
+}
+
+// isPortTaken checks if anything, listener or connection, is using port locally
+func (d *tcpDemux) isPortTaken(port uint16) bool {
+	for bound := range d.listeners {
+		if bound.Port() == port {
+			return true
+		}
+	}
+
+	for id := range d.connections {
+		if id.local.Port() == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isPortInUse is isPortTaken for callers not holding the lock
+func (d *tcpDemux) isPortInUse(port uint16) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.isPortTaken(port)
+}
+
+func (d *tcpDemux) disconnect(id tcpConnectionID) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.connections, id)
+}
+
+func (d *tcpDemux) lookupConnection(id tcpConnectionID) *TCPConn {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.connections[id]
+}
+
+// lookupListener prefers a listener bound to the exact address over one bound to the wildcard address
+func (d *tcpDemux) lookupListener(local netip.AddrPort) *TCPListener {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if listener, ok := d.listeners[local]; ok {
+		return listener
+	}
+
+	return d.listeners[netip.AddrPortFrom(wildcardFor(local.Addr()), local.Port())]
+}
+
+func (d *tcpDemux) closeAll() {
+	d.mu.RLock()
+	listeners := make([]*TCPListener, 0, len(d.listeners))
+	for _, listener := range d.listeners {
+		listeners = append(listeners, listener)
+	}
+
+	connections := make([]*TCPConn, 0, len(d.connections))
+	for _, conn := range d.connections {
+		connections = append(connections, conn)
+	}
+	d.mu.RUnlock()
+
+	for _, listener := range listeners {
+		_ = listener.Close()
+	}
+
+	for _, conn := range connections {
+		conn.destroy(ErrStackClosed)
+	}
+}
+
+// handleTCP passes a segment that arrived over either IP version to its connection or listener
+func (s *Stack) handleTCP(ctx context.Context, nic *Interface, source, destination netip.Addr, payload []byte) {
+	ctx, span := trace.StartSpan(ctx, "tcp")
+	defer span.Finish()
+
+	s.counters.TCP.InSegs.Inc()
+
+	segment, err := tcp.ParseRawSegment(ctx, payload, source, destination)
+	if errors.Is(err, tcp.ErrInvalidChecksum) {
+		s.counters.TCP.InErrs.Inc()
+		trace.Annotate(ctx, trace.ChecksumFailed, "TCP checksum failed")
+		return
+	}
+
+	if err != nil {
+		s.counters.TCP.InErrs.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid TCP segment", "error", err.Error())
+		return
+	}
+
+	fields := []any{"src_port", segment.SourcePort, "dst_port", segment.DestinationPort, "flags", segment.Flags.String()}
+
+	// TCP is unicast only (RFC 1122 4.2.3.10)
+	if !s.hasAddress(destination) || !isUnicastSource(nic, source) {
+		trace.Annotate(ctx, trace.Dropped, "TCP segment not unicast", fields...)
+		return
+	}
+
+	id := tcpConnectionID{
+		local:  netip.AddrPortFrom(destination, segment.DestinationPort),
+		remote: netip.AddrPortFrom(source, segment.SourcePort),
+	}
+
+	if conn := s.tcp.lookupConnection(id); conn != nil {
+		conn.segmentArrives(ctx, segment)
+		return
+	}
+
+	if listener := s.tcp.lookupListener(id.local); listener != nil {
+		listener.segmentArrives(ctx, id, segment)
+		return
+	}
+
+	trace.Annotate(ctx, trace.Dropped, "no listener on port", fields...)
+	s.sendTCPReset(ctx, id, segment)
+}
+
+// sendTCPReset answers a segment that has no connection to go to (RFC 9293 3.10.7.1)
+func (s *Stack) sendTCPReset(ctx context.Context, id tcpConnectionID, received *tcp.Segment) {
+	if received.Flags.Has(tcp.FlagRST) {
+		return
+	}
+
+	reset := &tcp.Segment{Flags: tcp.FlagRST}
+
+	if received.Flags.Has(tcp.FlagACK) {
+		reset.SequenceNumber = received.AcknowledgmentNumber
+	} else {
+		reset.Flags |= tcp.FlagACK
+		reset.AcknowledgmentNumber = received.SequenceNumber + received.SegmentLength()
+	}
+
+	_ = s.sendTCP(ctx, id, reset)
+}
+
+// sendTCP sends a new segment for the connection id
+func (s *Stack) sendTCP(ctx context.Context, id tcpConnectionID, segment *tcp.Segment) error {
+	s.counters.TCP.OutSegs.Inc()
+	if segment.Flags.Has(tcp.FlagRST) {
+		s.counters.TCP.OutRsts.Inc()
+	}
+
+	return s.transmitTCP(ctx, id, segment)
+}
+
+// transmitTCP fills in the ports and sends a segment, without counting it as a new one
+func (s *Stack) transmitTCP(ctx context.Context, id tcpConnectionID, segment *tcp.Segment) error {
+	ctx, span := trace.StartSpan(ctx, "tcp")
+	defer span.Finish()
+
+	segment.SourcePort = id.local.Port()
+	segment.DestinationPort = id.remote.Port()
+
+	raw, err := segment.CreateSegment(ctx, id.local.Addr(), id.remote.Addr())
+	if err != nil {
+		trace.Annotate(ctx, trace.Dropped, "failed to create TCP segment", "error", err.Error())
+		return err
+	}
+
+	// Segments are sized to fit the path MTU, so they always go with DF set. One that no longer fits is resent in
+	// smaller pieces rather than fragmented.
+	return s.sendIP(ctx, ipv4.ProtocolTCP, id.local.Addr(), id.remote.Addr(), raw, pmtuDiscoveryDo)
+}
+
+// tcpHash is a keyed hash of a connection's 4-tuple and extra, which nobody without the stack's secret can predict
+func (s *Stack) tcpHash(id tcpConnectionID, extra ...uint32) uint32 {
+	data := id.local.Addr().AsSlice()
+	data = append(data, id.remote.Addr().AsSlice()...)
+	data = binary.BigEndian.AppendUint16(data, id.local.Port())
+	data = binary.BigEndian.AppendUint16(data, id.remote.Port())
+
+	for _, value := range extra {
+		data = binary.BigEndian.AppendUint32(data, value)
+	}
+
+	return s.keyedHash(data)
+}
+
+// tcpTimestampOffset is where a connection's TSval clock starts (RFC 7323 5.4). It is a hash of the 4-tuple rather
+// than random, so a SYN cookie can know it before the connection exists.
+func (s *Stack) tcpTimestampOffset(id tcpConnectionID) uint32 {
+	return s.tcpHash(id, tcpHashTimestampOffset)
+}
+
+// tcpInitialSequenceNumber picks the ISS for a new connection (RFC 6528 3): a clock, offset by a keyed hash of the
+// 4-tuple. Each connection's sequence space is unguessable from outside, but a new incarnation of the same 4-tuple
+// still starts after where the old one's clock had got to.
+func (s *Stack) tcpInitialSequenceNumber(id tcpConnectionID) uint32 {
+	return uint32(s.clock.Now().UnixNano()/int64(tcpISNClockTick)) + s.tcpHash(id, tcpHashISN)
+}
+
+// tcpMSS is the largest segment we can receive from remote: the MTU of the interface it is reached through,
+// less the IP and TCP headers. Falls back to the RFC 9293 default of 536 when there is no route.
+func (s *Stack) tcpMSS(remote netip.Addr) int {
+	nic, err := s.routeInterface(remote)
+	if err != nil {
+		return tcpDefaultMSS
+	}
+
+	return nic.Link.MTU() - ipHeaderLength(remote) - tcp.MinHeaderLength
+}
+
+// ListenTCP opens a TCP listener. An unspecified address accepts connections on every interface.
+func (s *Stack) ListenTCP(local netip.AddrPort) (*TCPListener, error) {
+	return s.ListenTCPWithBacklog(local, tcpListenBacklog)
+}
+
+// ListenTCPWithBacklog is ListenTCP with the accept queue holding up to backlog established connections,
+// like the backlog of listen(2). SYNs are dropped while it is full, so the peer retries later.
+func (s *Stack) ListenTCPWithBacklog(local netip.AddrPort, backlog int) (*TCPListener, error) {
+	if backlog <= 0 {
+		return nil, fmt.Errorf("backlog must be larger than zero: %d", backlog)
+	}
+
+	if !local.Addr().IsValid() {
+		local = netip.AddrPortFrom(netip.IPv4Unspecified(), local.Port())
+	}
+
+	if local.Port() == 0 {
+		return nil, fmt.Errorf("cannot listen on %s: port must be set", local)
+	}
+
+	if !local.Addr().IsUnspecified() && !s.hasAddress(local.Addr()) {
+		return nil, fmt.Errorf("cannot bind to %s: address not on any interface", local.Addr())
+	}
+
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+
+	if closed {
+		return nil, ErrStackClosed
+	}
+
+	listener := &TCPListener{
+		stack:  s,
+		local:  local,
+		accept: make(chan *TCPConn, backlog),
+		// Like Linux, the backlog bounds the half-open queue as well as the accept queue
+		maxHalfOpen: backlog,
+		sources:     map[netip.Addr]*tcpTokenBucket{},
+		closed:      make(chan struct{}),
+	}
+
+	if err := s.tcp.listen(local, listener); err != nil {
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// DialTCP opens a connection to remote, returning once it is established. An invalid local address
+// picks the address of the interface remote is reached through, and port 0 picks an ephemeral port.
+// Cancelling ctx while the handshake is in progress aborts the connection.
+func (s *Stack) DialTCP(ctx context.Context, local, remote netip.AddrPort) (*TCPConn, error) {
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+
+	if closed {
+		return nil, ErrStackClosed
+	}
+
+	if !local.Addr().IsValid() || local.Addr().IsUnspecified() {
+		source, err := s.localAddress(remote.Addr())
+		if err != nil {
+			return nil, err
+		}
+
+		local = netip.AddrPortFrom(source, local.Port())
+	} else if local.Addr().Is4() != remote.Addr().Is4() {
+		return nil, fmt.Errorf("cannot dial %s from %s: different IP versions", remote, local)
+	} else if !s.hasAddress(local.Addr()) {
+		return nil, fmt.Errorf("cannot bind to %s: address not on any interface", local.Addr())
+	}
+
+	conn := newTCPConn(s, tcpConnectionID{local: local, remote: remote})
+
+	// Hold the connection from the moment it is registered, so no segment reaches it half set up
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	id, err := s.tcp.connect(conn.id, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	traceCtx, tr := s.startTrace()
+	defer tr.Finish()
+
+	conn.id = id
+	conn.openActive(traceCtx)
+
+	for {
+		switch {
+		case conn.err != nil:
+			return nil, conn.err
+		case conn.state == StateClosed:
+			return nil, net.ErrClosed
+		case conn.state.isSynchronized():
+			return conn, nil
+		}
+
+		changed := conn.changed
+		conn.mu.Unlock()
+
+		select {
+		case <-changed:
+			conn.mu.Lock()
+		case <-ctx.Done():
+			conn.mu.Lock()
+			conn.abort(traceCtx, ctx.Err())
+
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// TCPListener accepts connections on a TCP port. It implements net.Listener.
+type TCPListener struct {
+	stack *Stack
+	local netip.AddrPort
+
+	// Connections that have completed the handshake but not been accepted yet
+	accept chan *TCPConn
+
+	mu sync.Mutex
+	// How many connections are in SYN-RECEIVED, and how many can be before SYNs get cookies
+	halfOpen    int
+	maxHalfOpen int
+	// How fast each source is starting handshakes
+	sources map[netip.Addr]*tcpTokenBucket
+	// When a SYN was last answered with a cookie
+	lastCookieSent time.Time
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ net.Listener = (*TCPListener)(nil)
+
+// segmentArrives handles a segment for a port we are listening on, with no connection yet (RFC 9293 3.10.7.2)
+func (l *TCPListener) segmentArrives(ctx context.Context, id tcpConnectionID, segment *tcp.Segment) {
+	fields := []any{"local", id.local.String(), "remote", id.remote.String(), "flags", segment.Flags.String()}
+
+	switch {
+	case segment.Flags.Has(tcp.FlagRST):
+		trace.Annotate(ctx, trace.Dropped, "RST for a listener", fields...)
+	case segment.Flags.Has(tcp.FlagACK):
+		if l.synCookieACKArrives(ctx, id, segment) {
+			return
+		}
+
+		trace.Annotate(ctx, trace.Dropped, "ACK for a listener", fields...)
+		l.stack.sendTCPReset(ctx, id, segment)
+	case !segment.Flags.Has(tcp.FlagSYN):
+		trace.Annotate(ctx, trace.Dropped, "segment without SYN for a listener", fields...)
+	case len(l.accept) == cap(l.accept):
+		trace.Annotate(ctx, trace.Dropped, "accept queue full", fields...)
+	case !l.admitHalfOpen(ctx, id.remote.Addr()):
+		if !l.stack.options.DisableSYNCookies {
+			l.sendSYNCookie(ctx, id, segment)
+		}
+	default:
+		conn := newTCPConn(l.stack, id)
+		conn.listener = l
+		conn.halfOpen = true
+
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		if _, err := l.stack.tcp.connect(id, conn); err != nil {
+			trace.Annotate(ctx, trace.Dropped, "connection already exists", fields...)
+			conn.leaveHalfOpen()
+
+			return
+		}
+
+		conn.openPassive(ctx, segment)
+		trace.Annotate(ctx, trace.Delivered, "SYN received", fields...)
+	}
+}
+
+// enqueue hands an established connection to Accept. Returns false if the listener is closed or its queue is full.
+func (l *TCPListener) enqueue(conn *TCPConn) bool {
+	select {
+	case <-l.closed:
+		return false
+	default:
+	}
+
+	select {
+	case l.accept <- conn:
+		return true
+	default:
+		return false
+	}
+}
+
+// AcceptTCP waits for the next established connection
+func (l *TCPListener) AcceptTCP() (*TCPConn, error) {
+	select {
+	case conn := <-l.accept:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops listening, resetting any connections that were never accepted
+func (l *TCPListener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		l.stack.tcp.unlisten(l.local)
+
+		ctx, tr := l.stack.startTrace()
+		defer tr.Finish()
+
+		for {
+			select {
+			case conn := <-l.accept:
+				conn.mu.Lock()
+				conn.abort(ctx, net.ErrClosed)
+				conn.mu.Unlock()
+			default:
+				return
+			}
+		}
+	})
+
+	return nil
+}
+
+// Accept is AcceptTCP for net.Listener, so the listener can be handed to net/http.Server.Serve
+func (l *TCPListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+
+	return conn, nil
+}
+
+func (l *TCPListener) AddrPort() netip.AddrPort {
+	return l.local
+}
+
+func (l *TCPListener) Addr() net.Addr {
+	return net.TCPAddrFromAddrPort(l.local)
+}
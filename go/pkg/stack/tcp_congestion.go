@@ -0,0 +1,325 @@
+package stack
+
+import (
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/tcp"
+)
+
+// CongestionControl names an algorithm that decides how much data a connection can have in flight
+type CongestionControl string
+
+const (
+	// NewReno is standard TCP congestion control (RFC 5681) with NewReno fast recovery (RFC 6582)
+	NewReno CongestionControl = "newreno"
+	// CUBIC grows the window as a cubic function of the time since the last loss (RFC 9438)
+	CUBIC CongestionControl = "cubic"
+)
+
+// ssthresh starts out as large as possible, so slow start only ends at the first loss (RFC 5681 3.1)
+const tcpInfiniteSSThresh = math.MaxInt32
+
+var ErrUnknownCongestionControl = errors.New("unknown congestion control algorithm")
+
+// tcpCongestionAlgorithm grows and shrinks the congestion window. Loss detection and fast recovery are the
+// same whichever algorithm is used (RFC 9438 4.7 has CUBIC use the standard ones), so the connection runs those
+// and the algorithm only decides the window sizes, like Linux's tcp_congestion_ops.
+type tcpCongestionAlgorithm interface {
+	// onAck grows the window for acked bytes newly acknowledged outside of recovery
+	onAck(cc *tcpCongestion, acked int, now time.Time, srtt time.Duration)
+	// onCongestion sets ssthresh when a loss is detected, by three duplicate ACKs or a timeout
+	onCongestion(cc *tcpCongestion, flightSize int, now time.Time)
+}
+
+func newTCPCongestionAlgorithm(name CongestionControl) (tcpCongestionAlgorithm, error) {
+	switch name {
+	case NewReno:
+		return &tcpNewReno{}, nil
+	case CUBIC:
+		return &tcpCubic{}, nil
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCongestionControl, name)
+	}
+}
+
+// tcpCongestion is a connection's congestion state: the windows, and where it is in fast recovery
+type tcpCongestion struct {
+	name      CongestionControl
+	algorithm tcpCongestionAlgorithm
+
+	// In bytes
+	cwnd     int
+	ssthresh int
+	mss      int
+
+	duplicateACKs int
+	inRecovery    bool
+	// The highest sequence number sent when recovery started (RFC 6582 3.2)
+	recover uint32
+	// The end of the highest segment resent since recovery started (RFC 6675 2)
+	highRxt uint32
+
+	// Nil unless the application asked for a trace
+	trace *CongestionTrace
+}
+
+// start sets the initial window once the MSS is known (RFC 5681 3.1)
+func (cc *tcpCongestion) start(mss int, iss uint32, now time.Time) {
+	cc.mss = mss
+	cc.cwnd = min(4*mss, max(2*mss, 4380))
+	cc.ssthresh = tcpInfiniteSSThresh
+	// RFC 6582 starts recover at the ISS, but then the duplicate ACKs for a lost first segment, which only
+	// acknowledge the SYN, would not cover more than recover and could never start fast retransmit
+	cc.recover = iss - 1
+
+	cc.record(now, CongestionStarted)
+}
+
+func (cc *tcpCongestion) record(now time.Time, event CongestionEvent) {
+	if cc.trace != nil {
+		cc.trace.add(CongestionSample{Time: now, Event: event, Cwnd: cc.cwnd, SSThresh: cc.ssthresh})
+	}
+}
+
+// pipe estimates how much is in the network: everything sent and not acknowledged, less what is presumed lost
+// and not resent yet, and what the peer has SACKed (RFC 6675 4). SYN and FIN take up one byte each.
+func (c *TCPConn) pipe() int {
+	pipe := 0
+
+	for _, segment := range c.retransmitQueue {
+		if !segment.lost && !segment.sacked {
+			pipe += int(segment.end() - segment.seq)
+		}
+	}
+
+	return pipe
+}
+
+// isDuplicateACK checks if segment is a duplicate acknowledgment as RFC 5681 2 defines it. The window is compared
+// before it is updated from segment.
+func (c *TCPConn) isDuplicateACK(segment *tcp.Segment) bool {
+	return segment.AcknowledgmentNumber == c.sndUna &&
+		c.sndUna != c.sndNxt &&
+		len(segment.Data) == 0 &&
+		!segment.Flags.Has(tcp.FlagSYN) && !segment.Flags.Has(tcp.FlagFIN) &&
+		c.peerWindow(segment) == c.sndWnd
+}
+
+// newACKArrives updates the congestion state for acked bytes newly acknowledged, up to ack (RFC 6582 3.2 step 3)
+func (c *TCPConn) newACKArrives(ctx context.Context, ack uint32, acked int) {
+	cc := &c.congestion
+	now := c.stack.clock.Now()
+
+	cc.duplicateACKs = 0
+
+	if !cc.inRecovery {
+		cc.algorithm.onAck(cc, acked, now, c.rtt.srtt)
+		cc.record(now, CongestionACK)
+
+		return
+	}
+
+	if seqLEQ(cc.recover, ack) {
+		// Full acknowledgment: deflate the window, carefully so the flight that is left does not go out in a burst
+		cc.cwnd = min(cc.ssthresh, max(c.pipe(), cc.mss)+cc.mss)
+		cc.inRecovery = false
+		cc.record(now, CongestionRecovered)
+
+		trace.Annotate(ctx, trace.Delivered, "fast recovery complete", "cwnd", cc.cwnd)
+
+		return
+	}
+
+	// Partial acknowledgment: the next hole is lost too, so resend it straight away, and take back as much of
+	// the window as the hole before it made room for
+	c.retransmit(ctx)
+
+	cc.cwnd = max(cc.cwnd-acked, cc.mss)
+	if acked >= cc.mss {
+		cc.cwnd += cc.mss
+	}
+
+	cc.record(now, CongestionPartialACK)
+}
+
+// duplicateACKArrives counts duplicate ACKs, starting fast retransmit at the third (RFC 6582 3.2 steps 1 to 4)
+func (c *TCPConn) duplicateACKArrives(ctx context.Context, ack uint32) {
+	cc := &c.congestion
+	now := c.stack.clock.Now()
+
+	cc.duplicateACKs++
+
+	if cc.inRecovery {
+		// Each duplicate means a segment has left the network, so another can go in its place
+		cc.cwnd += cc.mss
+		cc.record(now, CongestionDuplicateACK)
+
+		return
+	}
+
+	// Only start recovery once everything from the previous one is acknowledged, so a single loss event
+	// is not answered twice
+	if cc.duplicateACKs != 3 || !seqGT(ack-1, cc.recover) {
+		return
+	}
+
+	trace.Annotate(ctx, trace.Delivered, "three duplicate ACKs, fast retransmit", "ack", ack)
+
+	cc.algorithm.onCongestion(cc, c.pipe(), now)
+	cc.recover = c.sndNxt
+	cc.inRecovery = true
+
+	c.retransmit(ctx)
+
+	cc.cwnd = cc.ssthresh + 3*cc.mss
+	cc.record(now, CongestionFastRetransmit)
+}
+
+// congestionTimeout shrinks the window to one segment after a retransmission timeout (RFC 5681 3.1). Only the
+// first timeout for a segment lowers ssthresh; later ones would just halve an already collapsed flight.
+func (c *TCPConn) congestionTimeout(flightSize int) {
+	cc := &c.congestion
+	now := c.stack.clock.Now()
+
+	if cc.mss == 0 {
+		// Still in the handshake, before there is a window
+		return
+	}
+
+	if c.retransmits == 1 {
+		cc.algorithm.onCongestion(cc, flightSize, now)
+	}
+
+	cc.cwnd = cc.mss
+	cc.duplicateACKs = 0
+	cc.inRecovery = false
+	// RFC 6582 4: duplicate ACKs for what was sent before the timeout must not start fast retransmit
+	cc.recover = c.sndNxt
+
+	cc.record(now, CongestionTimeout)
+}
+
+// SetCongestionControl switches the connection to another algorithm. The window carries over, so it can be
+// switched at any point, though it is most useful straight after the connection is set up.
+func (c *TCPConn) SetCongestionControl(name CongestionControl) error {
+	algorithm, err := newTCPCongestionAlgorithm(name)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.congestion.name = name
+	c.congestion.algorithm = algorithm
+
+	return nil
+}
+
+// CongestionControl is the algorithm the connection is using
+func (c *TCPConn) CongestionControl() CongestionControl {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.congestion.name
+}
+
+// TraceCongestion starts recording every change to the congestion window, and returns the trace it records to.
+// Calling it again returns the same trace.
+func (c *TCPConn) TraceCongestion() *CongestionTrace {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.congestion.trace == nil {
+		c.congestion.trace = &CongestionTrace{}
+		c.congestion.record(c.stack.clock.Now(), CongestionTraceStarted)
+	}
+
+	return c.congestion.trace
+}
+
+// CongestionEvent is what made the congestion window change
+type CongestionEvent string
+
+const (
+	CongestionTraceStarted   CongestionEvent = "trace started"
+	CongestionStarted        CongestionEvent = "started"
+	CongestionACK            CongestionEvent = "ack"
+	CongestionDuplicateACK   CongestionEvent = "duplicate ack"
+	CongestionFastRetransmit CongestionEvent = "fast retransmit"
+	CongestionPartialACK     CongestionEvent = "partial ack"
+	CongestionRecovered      CongestionEvent = "recovered"
+	CongestionTimeout        CongestionEvent = "timeout"
+)
+
+// CongestionSample is the state of the congestion window at one moment
+type CongestionSample struct {
+	Time  time.Time
+	Event CongestionEvent
+	// In bytes. SSThresh is math.MaxInt32 until the first loss.
+	Cwnd     int
+	SSThresh int
+}
+
+// CongestionTrace is a record of a connection's congestion window over time, for plotting how an algorithm behaves
+type CongestionTrace struct {
+	mu      sync.Mutex
+	samples []CongestionSample
+}
+
+func (t *CongestionTrace) add(sample CongestionSample) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.samples = append(t.samples, sample)
+}
+
+// Samples returns everything recorded so far, oldest first
+func (t *CongestionTrace) Samples() []CongestionSample {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]CongestionSample(nil), t.samples...)
+}
+
+// WriteCSV writes the trace with a header row, timed in seconds from the first sample. ssthresh is left
+// empty until the first loss sets it, so it does not flatten the plot.
+func (t *CongestionTrace) WriteCSV(w io.Writer) error {
+	samples := t.Samples()
+	out := csv.NewWriter(w)
+
+	if err := out.Write([]string{"seconds", "event", "cwnd", "ssthresh"}); err != nil {
+		return err
+	}
+
+	for _, sample := range samples {
+		ssthresh := ""
+		if sample.SSThresh != tcpInfiniteSSThresh {
+			ssthresh = strconv.Itoa(sample.SSThresh)
+		}
+
+		record := []string{
+			strconv.FormatFloat(sample.Time.Sub(samples[0].Time).Seconds(), 'f', 3, 64),
+			string(sample.Event),
+			strconv.Itoa(sample.Cwnd),
+			ssthresh,
+		}
+
+		if err := out.Write(record); err != nil {
+			return err
+		}
+	}
+
+	out.Flush()
+
+	return out.Error()
+}
@@ -0,0 +1,358 @@
+package stack
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/link"
+	"networking/pkg/tcp"
+)
+
+const testMSS = 1000
+
+func newTestCongestion(algorithm tcpCongestionAlgorithm) *tcpCongestion {
+	cc := &tcpCongestion{algorithm: algorithm}
+	cc.start(testMSS, 0, time.Unix(0, 0))
+
+	return cc
+}
+
+func Test_NewReno_InitialWindow(t *testing.T) {
+	tests := []struct {
+		mss      int
+		expected int
+	}{
+		{mss: 536, expected: 4 * 536},
+		{mss: 1460, expected: 4380},
+		{mss: 9000, expected: 2 * 9000},
+	}
+
+	for _, test := range tests {
+		cc := &tcpCongestion{}
+		cc.start(test.mss, 0, time.Unix(0, 0))
+
+		if cc.cwnd != test.expected {
+			t.Errorf("expected an initial window of %d for an MSS of %d, got %d", test.expected, test.mss, cc.cwnd)
+		}
+	}
+}
+
+func Test_NewReno_SlowStartDoublesEachRoundTrip(t *testing.T) {
+	cc := newTestCongestion(&tcpNewReno{})
+	now := time.Unix(0, 0)
+
+	start := cc.cwnd
+	for range start / testMSS {
+		cc.algorithm.onAck(cc, testMSS, now, 0)
+	}
+
+	if cc.cwnd != 2*start {
+		t.Errorf("expected a window's worth of ACKs to double the window to %d, got %d", 2*start, cc.cwnd)
+	}
+}
+
+func Test_NewReno_CongestionAvoidanceAddsOneSegmentPerWindow(t *testing.T) {
+	cc := newTestCongestion(&tcpNewReno{})
+	now := time.Unix(0, 0)
+	cc.cwnd = 10 * testMSS
+	cc.ssthresh = 10 * testMSS
+
+	for range 9 {
+		cc.algorithm.onAck(cc, testMSS, now, 0)
+	}
+
+	if cc.cwnd != 10*testMSS {
+		t.Fatalf("expected no growth before a whole window is acknowledged, got %d", cc.cwnd)
+	}
+
+	cc.algorithm.onAck(cc, testMSS, now, 0)
+
+	if cc.cwnd != 11*testMSS {
+		t.Errorf("expected one more segment after a whole window, got %d", cc.cwnd)
+	}
+}
+
+func Test_NewReno_LossHalvesTheFlight(t *testing.T) {
+	cc := newTestCongestion(&tcpNewReno{})
+
+	cc.algorithm.onCongestion(cc, 20*testMSS, time.Unix(0, 0))
+	if cc.ssthresh != 10*testMSS {
+		t.Errorf("expected ssthresh to be half the flight, got %d", cc.ssthresh)
+	}
+
+	cc.algorithm.onCongestion(cc, testMSS, time.Unix(0, 0))
+	if cc.ssthresh != 2*testMSS {
+		t.Errorf("expected ssthresh to be at least two segments, got %d", cc.ssthresh)
+	}
+}
+
+func Test_CUBIC_LossReducesByBeta(t *testing.T) {
+	cc := newTestCongestion(&tcpCubic{})
+	cubic := cc.algorithm.(*tcpCubic)
+	cc.cwnd = 100 * testMSS
+
+	cc.algorithm.onCongestion(cc, 100*testMSS, time.Unix(0, 0))
+
+	if cc.ssthresh != 70*testMSS || cubic.wMax != 100 {
+		t.Errorf("expected ssthresh of 70 segments and W_max of 100, got %d and %f", cc.ssthresh/testMSS, cubic.wMax)
+	}
+
+	// Losing again below the last maximum releases more (fast convergence)
+	cc.cwnd = 80 * testMSS
+	cc.algorithm.onCongestion(cc, 80*testMSS, time.Unix(0, 0))
+
+	if cubic.wMax != 80*(1+cubicBeta)/2 {
+		t.Errorf("expected fast convergence to lower W_max to %f, got %f", 80*(1+cubicBeta)/2, cubic.wMax)
+	}
+}
+
+// After a loss, CUBIC should be back at the old maximum K seconds later, whatever the round trip time
+func Test_CUBIC_ReturnsToWMaxAfterK(t *testing.T) {
+	cc := newTestCongestion(&tcpCubic{})
+	cc.cwnd = 100 * testMSS
+	cc.algorithm.onCongestion(cc, 100*testMSS, time.Unix(0, 0))
+	cc.cwnd = cc.ssthresh
+
+	k := math.Cbrt(100 * (1 - cubicBeta) / cubicC)
+	rtt := 100 * time.Millisecond
+	start := time.Unix(10, 0)
+	halfway := 0
+
+	for now := start; now.Sub(start).Seconds() < k; now = now.Add(rtt) {
+		// A window's worth of ACKs every round trip
+		for range cc.cwnd / testMSS {
+			cc.algorithm.onAck(cc, testMSS, now, rtt)
+		}
+
+		if halfway == 0 && now.Sub(start).Seconds() >= k/2 {
+			halfway = cc.cwnd
+		}
+	}
+
+	if cc.cwnd < 98*testMSS || cc.cwnd > 101*testMSS {
+		t.Errorf("expected the window to be back around 100 segments after K (%.2fs), got %d", k, cc.cwnd/testMSS)
+	}
+
+	// The curve is concave on the way up, so most of the climb happens in the first half
+	if halfway < 93*testMSS {
+		t.Errorf("expected most of the climb to happen in the first half, got %d segments halfway", halfway/testMSS)
+	}
+}
+
+func Test_CUBIC_IsRenoFriendlyOnShortRoundTrips(t *testing.T) {
+	cc := newTestCongestion(&tcpCubic{})
+	cc.cwnd = 10 * testMSS
+	cc.algorithm.onCongestion(cc, 10*testMSS, time.Unix(0, 0))
+	cc.cwnd = cc.ssthresh
+
+	// With a small window and a 1ms round trip, the cubic curve barely moves in 200 round trips, but Reno
+	// would have added a segment every few of them
+	now := time.Unix(10, 0)
+	for range 200 {
+		for range cc.cwnd / testMSS {
+			cc.algorithm.onAck(cc, testMSS, now, time.Millisecond)
+		}
+
+		now = now.Add(time.Millisecond)
+	}
+
+	if cc.cwnd < 20*testMSS {
+		t.Errorf("expected the Reno-friendly estimate to carry the window past 20 segments, got %d", cc.cwnd/testMSS)
+	}
+}
+
+func Test_TCP_FastRetransmitAndRecovery(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+	congestionTrace := conn.TraceCongestion()
+
+	// The peer sends no MSS option, so the stack uses 536 and starts with a window of four segments
+	_, err := conn.Write(bytes.Repeat([]byte("x"), 10*tcpDefaultMSS))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	first := p.expect(tcp.FlagACK)
+	for range 3 {
+		p.expect(tcp.FlagACK)
+	}
+
+	p.expectNothing()
+
+	// The first segment is lost, so every later one draws a duplicate ACK
+	for range 3 {
+		p.sendAt(tcp.FlagACK, p.seq, first.SequenceNumber, "")
+	}
+
+	retransmission := p.expect(tcp.FlagACK)
+	if retransmission.SequenceNumber != first.SequenceNumber {
+		t.Fatalf("expected the first segment to be resent, got seq %d", retransmission.SequenceNumber)
+	}
+
+	// ssthresh is half the four segments in flight, and the three duplicates inflate the window by three
+	// segments past it, leaving room for one new segment
+	p.expect(tcp.FlagACK)
+	p.expectNothing()
+
+	conn.mu.Lock()
+	cwnd, ssthresh, inRecovery := conn.congestion.cwnd, conn.congestion.ssthresh, conn.congestion.inRecovery
+	conn.mu.Unlock()
+
+	if !inRecovery || ssthresh != 2*tcpDefaultMSS || cwnd != 5*tcpDefaultMSS {
+		t.Errorf("expected fast recovery with ssthresh 2 and cwnd 5 segments, got %v, %d and %d", inRecovery, ssthresh/tcpDefaultMSS, cwnd/tcpDefaultMSS)
+	}
+
+	// Acknowledging the four segments sent before the loss ends recovery, with one segment still in flight
+	p.sendAt(tcp.FlagACK, p.seq, first.SequenceNumber+4*tcpDefaultMSS, "")
+	p.expect(tcp.FlagACK)
+
+	conn.mu.Lock()
+	cwnd, inRecovery = conn.congestion.cwnd, conn.congestion.inRecovery
+	conn.mu.Unlock()
+
+	if inRecovery || cwnd != 2*tcpDefaultMSS {
+		t.Errorf("expected recovery to end with cwnd at ssthresh, got %v and %d segments", inRecovery, cwnd/tcpDefaultMSS)
+	}
+
+	waitForCounter(t, p.stack, "tcpRetransSegs", 1)
+
+	events := []CongestionEvent{}
+	for _, sample := range congestionTrace.Samples() {
+		events = append(events, sample.Event)
+	}
+
+	expected := []CongestionEvent{CongestionTraceStarted, CongestionFastRetransmit, CongestionRecovered}
+	if !slices.Equal(events, expected) {
+		t.Errorf("expected events %v, got %v", expected, events)
+	}
+}
+
+func Test_TCP_PartialACKResendsTheNextHole(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	_, err := conn.Write(bytes.Repeat([]byte("x"), 10*tcpDefaultMSS))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	first := p.expect(tcp.FlagACK)
+	for range 3 {
+		p.expect(tcp.FlagACK)
+	}
+
+	for range 3 {
+		p.sendAt(tcp.FlagACK, p.seq, first.SequenceNumber, "")
+	}
+
+	p.expect(tcp.FlagACK)
+	p.expect(tcp.FlagACK)
+
+	// The second segment was lost as well
+	p.sendAt(tcp.FlagACK, p.seq, first.SequenceNumber+tcpDefaultMSS, "")
+
+	retransmission := p.expect(tcp.FlagACK)
+	if retransmission.SequenceNumber != first.SequenceNumber+tcpDefaultMSS {
+		t.Fatalf("expected the second segment to be resent, got seq %d", retransmission.SequenceNumber)
+	}
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if !conn.congestion.inRecovery {
+		t.Errorf("expected a partial ACK to stay in recovery")
+	}
+}
+
+func Test_TCP_TimeoutCollapsesTheWindow(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	_, err := conn.Write(bytes.Repeat([]byte("x"), 10*tcpDefaultMSS))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	first := p.expect(tcp.FlagACK)
+	for range 3 {
+		p.expect(tcp.FlagACK)
+	}
+
+	clk.Advance(tcpInitialRTO)
+
+	if retransmission := p.expect(tcp.FlagACK); retransmission.SequenceNumber != first.SequenceNumber {
+		t.Fatalf("expected the first segment to be resent, got seq %d", retransmission.SequenceNumber)
+	}
+
+	p.expectNothing()
+
+	conn.mu.Lock()
+	cwnd, ssthresh := conn.congestion.cwnd, conn.congestion.ssthresh
+	conn.mu.Unlock()
+
+	if cwnd != tcpDefaultMSS || ssthresh != 2*tcpDefaultMSS {
+		t.Fatalf("expected cwnd of one segment and ssthresh of two, got %d and %d bytes", cwnd, ssthresh)
+	}
+
+	// Slow start from one segment: acknowledging the first lets the next two go
+	p.sendAt(tcp.FlagACK, p.seq, first.SequenceNumber+tcpDefaultMSS, "")
+	p.expect(tcp.FlagACK)
+	p.expect(tcp.FlagACK)
+	p.expectNothing()
+}
+
+func Test_TCP_SetCongestionControl(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	if conn.CongestionControl() != NewReno {
+		t.Errorf("expected NewReno by default, got %s", conn.CongestionControl())
+	}
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetCongestionControl(CUBIC))
+
+	if conn.CongestionControl() != CUBIC {
+		t.Errorf("expected CUBIC, got %s", conn.CongestionControl())
+	}
+
+	if err := conn.SetCongestionControl("vegas"); !errors.Is(err, ErrUnknownCongestionControl) {
+		t.Errorf("expected ErrUnknownCongestionControl, got %v", err)
+	}
+}
+
+func Test_TCP_EveryCongestionControlSurvivesALossyLink(t *testing.T) {
+	for _, algorithm := range []CongestionControl{NewReno, CUBIC} {
+		t.Run(string(algorithm), func(t *testing.T) {
+			traces := make(chan *CongestionTrace, 1)
+
+			transferOverLossyLink(t, Options{}, link.DropRandomly(0.02, 1), link.DropRandomly(0.02, 2), func(conn *TCPConn) {
+				testhelpers.FailTestIfErrorIsPresent(t, conn.SetCongestionControl(algorithm))
+				traces <- conn.TraceCongestion()
+			})
+
+			var out strings.Builder
+			testhelpers.FailTestIfErrorIsPresent(t, (<-traces).WriteCSV(&out))
+
+			records, err := csv.NewReader(strings.NewReader(out.String())).ReadAll()
+			testhelpers.FailTestIfErrorIsPresent(t, err)
+
+			if len(records) < 10 || strings.Join(records[0], ",") != "seconds,event,cwnd,ssthresh" {
+				t.Fatalf("expected a header and a row per change to the window, got %d rows", len(records))
+			}
+
+			lost := false
+			for _, record := range records[1:] {
+				lost = lost || record[1] == string(CongestionFastRetransmit) || record[1] == string(CongestionTimeout)
+			}
+
+			if !lost {
+				t.Errorf("expected the trace to show the window reacting to loss")
+			}
+		})
+	}
+}
@@ -0,0 +1,1074 @@
+package stack
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/tcp"
+)
+
+const (
+	// RFC 9293 3.7.1: the MSS to assume when the peer does not send the option
+	tcpDefaultMSS = 536
+
+	// Large enough that window scaling is needed to advertise all of it
+	tcpReceiveBufferSize = 256 * 1024
+	tcpSendBufferSize    = 256 * 1024
+)
+
+// TCPState is where a connection is in its lifecycle (RFC 9293 3.3.2)
+type TCPState int
+
+const (
+	StateClosed TCPState = iota
+	StateListen
+	StateSynSent
+	StateSynReceived
+	StateEstablished
+	StateFinWait1
+	StateFinWait2
+	StateCloseWait
+	StateClosing
+	StateLastAck
+	StateTimeWait
+)
+
+var tcpStateNames = map[TCPState]string{
+	StateClosed:      "CLOSED",
+	StateListen:      "LISTEN",
+	StateSynSent:     "SYN-SENT",
+	StateSynReceived: "SYN-RECEIVED",
+	StateEstablished: "ESTABLISHED",
+	StateFinWait1:    "FIN-WAIT-1",
+	StateFinWait2:    "FIN-WAIT-2",
+	StateCloseWait:   "CLOSE-WAIT",
+	StateClosing:     "CLOSING",
+	StateLastAck:     "LAST-ACK",
+	StateTimeWait:    "TIME-WAIT",
+}
+
+func (s TCPState) String() string {
+	return tcpStateNames[s]
+}
+
+// isSynchronized checks if the handshake has completed, so both sides know each other's sequence numbers
+func (s TCPState) isSynchronized() bool {
+	return s >= StateEstablished
+}
+
+// Sequence numbers wrap, so they are compared by the sign of their difference (RFC 9293 3.4)
+func seqLT(a, b uint32) bool  { return int32(a-b) < 0 }
+func seqLEQ(a, b uint32) bool { return int32(a-b) <= 0 }
+func seqGT(a, b uint32) bool  { return int32(a-b) > 0 }
+
+// TCPConn is one TCP connection on the stack. Its fields are the transmission control block of RFC 9293 3.3.1.
+// It implements net.Conn, so code written against the OS's sockets, net/http included, can run on the stack unchanged.
+type TCPConn struct {
+	stack *Stack
+	id    tcpConnectionID
+	// The listener a passive open came in on, until the connection is established and handed to it
+	listener *TCPListener
+	// Taking up a place in the listener's half-open queue
+	halfOpen bool
+
+	mu    sync.Mutex
+	state TCPState
+	// Closed and replaced whenever anything a blocked caller might be waiting on changes
+	changed chan struct{}
+	// Why the connection ended, if it did not end cleanly
+	err error
+	// When blocked Reads and Writes give up, as net.Conn has it
+	readDeadline  *deadline
+	writeDeadline *deadline
+
+	// Send sequence variables
+	iss       uint32
+	sndUna    uint32
+	sndNxt    uint32
+	sndWnd    uint32
+	sndWl1    uint32
+	sndWl2    uint32
+	maxSndWnd uint32
+	sndMSS    int
+
+	// Receive sequence variables, with the right edge of the last window we advertised
+	irs    uint32
+	rcvNxt uint32
+	rcvAdv uint32
+
+	// Both sides sent SACK-permitted in their SYNs (RFC 2018 2)
+	sackPermitted bool
+	// Both sides sent window scale options (RFC 7323 2), and the shifts for the windows each way
+	windowScaling bool
+	sndWndShift   uint8
+	rcvWndShift   uint8
+	// Both sides sent timestamps in their SYNs (RFC 7323 3), with the state for echoing the peer's and
+	// checking them for PAWS. tsEcr is the latest of ours the peer echoed.
+	timestamps  bool
+	tsOffset    uint32
+	tsRecent    uint32
+	tsRecentAge time.Time
+	tsEcr       uint32
+	lastACKSent uint32
+
+	// Sizes of the send and receive buffers, and so of the windows
+	readBufferSize  int
+	writeBufferSize int
+	// Nagle's algorithm is off
+	noDelay bool
+
+	// Written by the application and not acknowledged yet, starting at SND.UNA
+	sendBuffer []byte
+	// Received in order and not read by the application yet
+	receiveBuffer []byte
+	// Received beyond a hole, in sequence order, and the sequence numbers of the latest of it, latest first
+	outOfOrder       []*tcpOutOfOrderSegment
+	recentlyReceived []uint32
+
+	// Segments sent and not fully acknowledged yet, oldest first
+	retransmitQueue []*tcpSentSegment
+	rtt             tcpRTTEstimator
+	retransmitTimer *wheelTimer
+	// Timeouts in a row without the peer acknowledging anything
+	retransmits int
+	congestion  tcpCongestion
+	// Searching for the path MTU ourselves, for paths where too-big messages never make it back (RFC 4821)
+	mtuProbe tcpMTUProbe
+
+	delayedACKTimer *wheelTimer
+	persistTimer    *wheelTimer
+	// The next interval between zero window probes, and when the window closed
+	persistBackoff  time.Duration
+	persistingSince time.Time
+
+	// Keepalive probing, and when the last acceptable segment arrived for it to measure idleness from
+	keepAlive         bool
+	keepAliveIdle     time.Duration
+	keepAliveInterval time.Duration
+	keepAliveCount    int
+	keepAliveProbes   int
+	keepAliveTimer    *wheelTimer
+	lastReceived      time.Time
+	// How long sent data can go unacknowledged, if not by the retransmission count (RFC 5482)
+	userTimeout time.Duration
+	// How long Close waits for the data to be acknowledged. Negative means it does not wait, and zero that it resets.
+	lingerTimeout time.Duration
+
+	finQueued     bool
+	finSent       bool
+	finReceived   bool
+	closedByUser  bool
+	timeWait      time.Duration
+	timeWaitTimer *wheelTimer
+}
+
+var _ net.Conn = (*TCPConn)(nil)
+
+func newTCPConn(s *Stack, id tcpConnectionID) *TCPConn {
+	c := &TCPConn{
+		stack:             s,
+		id:                id,
+		changed:           make(chan struct{}),
+		sndMSS:            tcpDefaultMSS,
+		rtt:               newTCPRTTEstimator(),
+		readDeadline:      newDeadline(),
+		writeDeadline:     newDeadline(),
+		rcvWndShift:       windowShiftFor(tcpReceiveBufferSize),
+		readBufferSize:    tcpReceiveBufferSize,
+		writeBufferSize:   tcpSendBufferSize,
+		keepAliveIdle:     tcpKeepAliveIdle,
+		keepAliveInterval: tcpKeepAliveInterval,
+		keepAliveCount:    tcpKeepAliveCount,
+		lingerTimeout:     -1,
+		timeWait:          s.tcp.timeWait,
+	}
+
+	c.congestion.name = s.options.CongestionControl
+	c.congestion.algorithm, _ = newTCPCongestionAlgorithm(s.options.CongestionControl)
+
+	c.retransmitTimer = s.timers.newTimer(c.retransmitTimeout)
+	c.timeWaitTimer = s.timers.newTimer(c.timeWaitExpired)
+	c.delayedACKTimer = s.timers.newTimer(c.delayedACKExpired)
+	c.persistTimer = s.timers.newTimer(c.persistTimeout)
+	c.keepAliveTimer = s.timers.newTimer(c.keepAliveTimeout)
+
+	return c
+}
+
+// notify wakes everyone waiting on the connection
+func (c *TCPConn) notify() {
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *TCPConn) setState(ctx context.Context, state TCPState) {
+	trace.Annotate(ctx, trace.Delivered, "TCP state changed", "from", c.state.String(), "to", state.String())
+
+	c.state = state
+	c.notify()
+}
+
+// openActive sends our SYN (RFC 9293 3.10.1)
+func (c *TCPConn) openActive(ctx context.Context) {
+	c.iss = c.stack.tcpInitialSequenceNumber(c.id)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.tsOffset = c.stack.tcpTimestampOffset(c.id)
+
+	c.setState(ctx, StateSynSent)
+	c.stack.counters.TCP.ActiveOpens.Inc()
+	c.transmit(ctx, tcp.FlagSYN, c.iss, nil)
+}
+
+// openPassive answers a SYN that arrived on a listener
+func (c *TCPConn) openPassive(ctx context.Context, syn *tcp.Segment) {
+	c.irs = syn.SequenceNumber
+	c.rcvNxt = syn.SequenceNumber + 1
+	c.iss = c.stack.tcpInitialSequenceNumber(c.id)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.tsOffset = c.stack.tcpTimestampOffset(c.id)
+	c.heardFromPeer()
+	c.applySYNOptions(syn)
+	c.updateSendWindow(syn)
+
+	c.setState(ctx, StateSynReceived)
+	c.stack.counters.TCP.PassiveOpens.Inc()
+	c.transmit(ctx, tcp.FlagSYN|tcp.FlagACK, c.iss, nil)
+}
+
+func (c *TCPConn) applySYNOptions(syn *tcp.Segment) {
+	if mss, ok := syn.MSS(); ok {
+		c.sndMSS = int(mss)
+	}
+
+	c.sndMSS = min(c.sndMSS, c.stack.tcpMSS(c.id.remote.Addr()))
+	c.sackPermitted = syn.SACKPermitted() && !c.stack.options.DisableSACK
+	c.negotiateOptions(syn)
+}
+
+// updateSendWindow takes the peer's window from segment, remembering which segment it came from
+func (c *TCPConn) updateSendWindow(segment *tcp.Segment) {
+	c.sndWnd = c.peerWindow(segment)
+	c.sndWl1 = segment.SequenceNumber
+	c.sndWl2 = segment.AcknowledgmentNumber
+	c.maxSndWnd = max(c.maxSndWnd, c.sndWnd)
+}
+
+// sendSegment sends a segment from the connection, acknowledging everything received so far if it has ACK set
+func (c *TCPConn) sendSegment(ctx context.Context, flags tcp.Flags, seq uint32, data []byte) {
+	_ = c.stack.sendTCP(ctx, c.id, c.buildSegment(flags, seq, data))
+}
+
+// resendSegment is sendSegment for retransmissions, which are counted separately
+func (c *TCPConn) resendSegment(ctx context.Context, flags tcp.Flags, seq uint32, data []byte) {
+	_ = c.stack.transmitTCP(ctx, c.id, c.buildSegment(flags, seq, data))
+}
+
+func (c *TCPConn) buildSegment(flags tcp.Flags, seq uint32, data []byte) *tcp.Segment {
+	segment := &tcp.Segment{
+		SequenceNumber: seq,
+		Flags:          flags,
+		Window:         c.advertiseWindow(flags.Has(tcp.FlagSYN)),
+		Data:           data,
+	}
+
+	if flags.Has(tcp.FlagACK) {
+		segment.AcknowledgmentNumber = c.rcvNxt
+
+		// Whatever the segment is for, it carries the ACK a delayed one would have
+		c.lastACKSent = c.rcvNxt
+		c.delayedACKTimer.stop()
+	}
+
+	switch {
+	case flags.Has(tcp.FlagSYN):
+		segment.Options = c.synOptions(flags.Has(tcp.FlagACK))
+	case flags.Has(tcp.FlagRST):
+	default:
+		if c.timestamps {
+			segment.Options = []tcp.Option{
+				tcp.NewNoOperationOption(), tcp.NewNoOperationOption(), tcp.NewTimestampsOption(c.timestampNow(), c.tsRecent),
+			}
+		}
+
+		// Blocks only go on segments without data, which leaves data segments their full size
+		if flags.Has(tcp.FlagACK) && c.sackPermitted && len(c.outOfOrder) > 0 && len(data) == 0 {
+			segment.Options = append(segment.Options,
+				tcp.NewNoOperationOption(), tcp.NewNoOperationOption(), tcp.NewSACKOption(c.sackBlocks()...))
+		}
+	}
+
+	return segment
+}
+
+func (c *TCPConn) sendACK(ctx context.Context) {
+	c.sendSegment(ctx, tcp.FlagACK, c.sndNxt, nil)
+}
+
+// unackedData is how many bytes of the send buffer have been sent, leaving out the SYN and FIN
+func (c *TCPConn) unackedData() int {
+	inFlight := int(c.sndNxt - c.sndUna)
+
+	if c.sndUna == c.iss {
+		inFlight--
+	}
+
+	if c.finSent {
+		inFlight--
+	}
+
+	return inFlight
+}
+
+// output resends what has been lost, then sends as much of the send buffer as the peer's window and the
+// congestion window allow, followed by our FIN once everything before it is sent
+func (c *TCPConn) output(ctx context.Context) {
+	if !c.state.isSynchronized() {
+		return
+	}
+
+	c.retransmitLost(ctx)
+
+	for !c.finSent {
+		sent := c.unackedData()
+		unsent := c.sendBuffer[sent:]
+
+		if len(unsent) == 0 {
+			if c.finQueued {
+				c.transmit(ctx, tcp.FlagFIN|tcp.FlagACK, c.sndNxt, nil)
+				c.sndNxt++
+				c.finSent = true
+			}
+
+			return
+		}
+
+		size := min(len(unsent), int(c.sndWnd)-sent, c.segmentSize())
+
+		// A probe goes only when there is enough data and window for the whole of it
+		probe := c.mtuProbeSize()
+		if probe > 0 && probe <= len(unsent) && probe <= int(c.sndWnd)-sent {
+			size = probe
+		} else {
+			probe = 0
+		}
+
+		if size <= 0 {
+			c.startPersisting()
+			return
+		}
+
+		if size < c.segmentSize() && !c.canSendPartialSegment(size, len(unsent)) {
+			c.startPersisting()
+			return
+		}
+
+		// Segments are not cut short to fit the congestion window, which always has room for one when empty
+		if pipe := c.pipe(); pipe > 0 && pipe+size > c.congestion.cwnd {
+			return
+		}
+
+		flags := tcp.FlagACK
+		if size == len(unsent) {
+			flags |= tcp.FlagPSH
+		}
+
+		if probe > 0 {
+			c.startMTUProbe(ctx, c.sndNxt, size)
+		}
+
+		c.stopPersisting()
+		c.transmit(ctx, flags, c.sndNxt, unsent[:size])
+		c.sndNxt += uint32(size)
+	}
+}
+
+// acknowledge drops everything up to ack from the send buffer and retransmission queue
+func (c *TCPConn) acknowledge(ack uint32) {
+	c.acknowledgeQueue(ack)
+	c.mtuProbeAcknowledged(ack)
+
+	acked := int(ack - c.sndUna)
+
+	if c.sndUna == c.iss {
+		acked--
+	}
+
+	if c.finSent && ack == c.sndNxt {
+		acked--
+	}
+
+	c.sendBuffer = c.sendBuffer[acked:]
+	c.sndUna = ack
+	c.notify()
+}
+
+func (c *TCPConn) isOurFINAcked() bool {
+	return c.finSent && c.sndUna == c.sndNxt
+}
+
+// isAcceptable is the receive window check of RFC 9293 3.10.7.4
+func (c *TCPConn) isAcceptable(segment *tcp.Segment) bool {
+	seq := segment.SequenceNumber
+	length := segment.SegmentLength()
+	window := c.receiveWindow()
+	inWindow := func(n uint32) bool {
+		return seqLEQ(c.rcvNxt, n) && seqLT(n, c.rcvNxt+window)
+	}
+
+	switch {
+	case length == 0 && window == 0:
+		return seq == c.rcvNxt
+	case length == 0:
+		return inWindow(seq)
+	case window == 0:
+		return false
+	default:
+		return inWindow(seq) || inWindow(seq+length-1)
+	}
+}
+
+// segmentArrives runs a segment through the state machine
+func (c *TCPConn) segmentArrives(ctx context.Context, segment *tcp.Segment) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ctx, span := trace.StartSpan(ctx, "tcp")
+	defer span.Finish()
+
+	switch c.state {
+	case StateClosed:
+		trace.Annotate(ctx, trace.Dropped, "connection closed")
+	case StateSynSent:
+		c.synSentSegmentArrives(ctx, segment)
+	default:
+		c.synchronizedSegmentArrives(ctx, segment)
+	}
+}
+
+// synSentSegmentArrives handles the reply to our SYN (RFC 9293 3.10.7.3)
+func (c *TCPConn) synSentSegmentArrives(ctx context.Context, segment *tcp.Segment) {
+	flags := segment.Flags
+	ack := segment.AcknowledgmentNumber
+
+	if flags.Has(tcp.FlagACK) && (seqLEQ(ack, c.iss) || seqGT(ack, c.sndNxt)) {
+		trace.Annotate(ctx, trace.Dropped, "unacceptable ACK in SYN-SENT", "ack", ack)
+
+		if !flags.Has(tcp.FlagRST) {
+			c.stack.sendTCPReset(ctx, c.id, segment)
+		}
+
+		return
+	}
+
+	if flags.Has(tcp.FlagRST) {
+		if !flags.Has(tcp.FlagACK) {
+			trace.Annotate(ctx, trace.Dropped, "RST without ACK in SYN-SENT")
+			return
+		}
+
+		c.stack.counters.TCP.AttemptFails.Inc()
+		c.terminate(ctx, ErrConnectionRefused)
+
+		return
+	}
+
+	if !flags.Has(tcp.FlagSYN) {
+		trace.Annotate(ctx, trace.Dropped, "segment without SYN in SYN-SENT")
+		return
+	}
+
+	c.irs = segment.SequenceNumber
+	c.rcvNxt = segment.SequenceNumber + 1
+	c.rcvAdv = c.rcvNxt
+	c.heardFromPeer()
+	c.applySYNOptions(segment)
+
+	if !flags.Has(tcp.FlagACK) {
+		// Simultaneous open: both SYNs crossed, so resend ours with an ACK of theirs
+		c.retransmitQueue[0].flags |= tcp.FlagACK
+		c.setState(ctx, StateSynReceived)
+		c.sendSegment(ctx, tcp.FlagSYN|tcp.FlagACK, c.iss, nil)
+
+		return
+	}
+
+	c.acknowledge(ack)
+	c.updateSendWindow(segment)
+	c.setState(ctx, StateEstablished)
+	c.congestion.start(c.segmentSize(), c.iss, c.stack.clock.Now())
+	c.sendACK(ctx)
+	c.output(ctx)
+}
+
+// synchronizedSegmentArrives handles a segment in any state from SYN-RECEIVED on (RFC 9293 3.10.7.4),
+// with the RST, SYN and ACK checks hardened as RFC 5961 recommends
+func (c *TCPConn) synchronizedSegmentArrives(ctx context.Context, segment *tcp.Segment) {
+	flags := segment.Flags
+
+	// First, check the sequence number, and the timestamp that guards it against wrapping
+	if c.pawsRejects(ctx, segment) {
+		return
+	}
+
+	if !c.isAcceptable(segment) {
+		if c.state == StateSynReceived && flags.Has(tcp.FlagSYN) && !flags.Has(tcp.FlagACK) && segment.SequenceNumber == c.irs {
+			trace.Annotate(ctx, trace.Delivered, "retransmitted SYN, resending SYN-ACK")
+			c.retransmit(ctx)
+
+			return
+		}
+
+		trace.Annotate(ctx, trace.Dropped, "segment outside receive window", "seq", segment.SequenceNumber, "rcv_nxt", c.rcvNxt)
+
+		if flags.Has(tcp.FlagRST) {
+			return
+		}
+
+		if c.state == StateTimeWait && flags.Has(tcp.FlagFIN) {
+			c.startTimeWait()
+		}
+
+		c.sendACK(ctx)
+
+		return
+	}
+
+	c.updateTSRecent(segment)
+	c.heardFromPeer()
+
+	// Second, check the RST bit. Only an RST exactly at RCV.NXT resets the connection; anything else in the
+	// window gets a challenge ACK, so a blind attacker has to guess the sequence number exactly.
+	if flags.Has(tcp.FlagRST) {
+		if segment.SequenceNumber != c.rcvNxt {
+			trace.Annotate(ctx, trace.Dropped, "RST not at RCV.NXT, sending challenge ACK")
+			c.sendACK(ctx)
+
+			return
+		}
+
+		c.resetArrives(ctx)
+
+		return
+	}
+
+	// Fourth, check the SYN bit (the third, security, is not supported)
+	if flags.Has(tcp.FlagSYN) {
+		if c.state == StateSynReceived && c.listener != nil {
+			trace.Annotate(ctx, trace.Dropped, "SYN in SYN-RECEIVED, returning to LISTEN")
+			c.stack.counters.TCP.AttemptFails.Inc()
+			c.terminate(ctx, ErrConnectionReset)
+
+			return
+		}
+
+		trace.Annotate(ctx, trace.Dropped, "SYN on a synchronized connection, sending challenge ACK")
+		c.sendACK(ctx)
+
+		return
+	}
+
+	// Fifth, check the ACK field
+	if !flags.Has(tcp.FlagACK) {
+		trace.Annotate(ctx, trace.Dropped, "segment without ACK")
+		return
+	}
+
+	if !c.ackArrives(ctx, segment) {
+		return
+	}
+
+	// Sixth, the URG bit is ignored, since urgent data is not supported.
+	// Seventh, process the segment text.
+	urgency := c.textArrives(ctx, segment)
+
+	// Eighth, check the FIN bit
+	if flags.Has(tcp.FlagFIN) && segment.SequenceNumber+uint32(len(segment.Data)) == c.rcvNxt && !c.finReceived {
+		c.finArrives(ctx)
+		urgency = tcpACKNow
+	}
+
+	if c.state != StateClosed {
+		c.acknowledgeData(ctx, urgency)
+	}
+}
+
+// resetArrives tears the connection down for an acceptable RST
+func (c *TCPConn) resetArrives(ctx context.Context) {
+	switch c.state {
+	case StateSynReceived:
+		c.stack.counters.TCP.AttemptFails.Inc()
+
+		if c.listener != nil {
+			// A passive open just goes back to the listener, which never handed it out
+			c.terminate(ctx, ErrConnectionReset)
+			return
+		}
+
+		c.terminate(ctx, ErrConnectionRefused)
+	case StateEstablished, StateCloseWait:
+		c.stack.counters.TCP.EstabResets.Inc()
+		c.terminate(ctx, ErrConnectionReset)
+	case StateFinWait1, StateFinWait2:
+		c.terminate(ctx, ErrConnectionReset)
+	default:
+		c.terminate(ctx, nil)
+	}
+}
+
+// ackArrives processes the ACK field. Returns false if the segment should be dropped.
+func (c *TCPConn) ackArrives(ctx context.Context, segment *tcp.Segment) bool {
+	ack := segment.AcknowledgmentNumber
+
+	if c.state == StateSynReceived {
+		if !seqLT(c.sndUna, ack) || !seqLEQ(ack, c.sndNxt) {
+			trace.Annotate(ctx, trace.Dropped, "unacceptable ACK in SYN-RECEIVED", "ack", ack)
+			c.stack.sendTCPReset(ctx, c.id, segment)
+
+			return false
+		}
+
+		c.acknowledge(ack)
+		c.updateSendWindow(segment)
+		c.setState(ctx, StateEstablished)
+		c.congestion.start(c.segmentSize(), c.iss, c.stack.clock.Now())
+
+		// Closed while the handshake was in progress, with data still to send ahead of the FIN
+		if c.finQueued {
+			c.setState(ctx, StateFinWait1)
+		}
+
+		if c.listener != nil {
+			c.leaveHalfOpen()
+
+			listener := c.listener
+			c.listener = nil
+
+			if !listener.enqueue(c) {
+				trace.Annotate(ctx, trace.Dropped, "listener closed or accept queue full")
+				c.abort(ctx, ErrConnectionReset)
+
+				return false
+			}
+		}
+	}
+
+	if seqGT(ack, c.sndNxt) {
+		trace.Annotate(ctx, trace.Dropped, "ACK for data not sent yet", "ack", ack, "snd_nxt", c.sndNxt)
+		c.sendACK(ctx)
+
+		return false
+	}
+
+	if seqLT(ack, c.sndUna-c.maxSndWnd) {
+		trace.Annotate(ctx, trace.Dropped, "ACK too old", "ack", ack, "snd_una", c.sndUna)
+		c.sendACK(ctx)
+
+		return false
+	}
+
+	acked := 0
+	if seqLT(c.sndUna, ack) {
+		acked = int(ack - c.sndUna)
+		c.acknowledge(ack)
+	}
+
+	switch {
+	case c.sackPermitted:
+		c.sackACKArrives(ctx, segment, acked)
+	case acked > 0:
+		c.newACKArrives(ctx, ack, acked)
+	case c.isDuplicateACK(segment):
+		c.duplicateACKArrives(ctx, ack)
+	}
+
+	if seqLT(c.sndWl1, segment.SequenceNumber) || (c.sndWl1 == segment.SequenceNumber && seqLEQ(c.sndWl2, ack)) {
+		c.updateSendWindow(segment)
+	}
+
+	switch c.state {
+	case StateFinWait1:
+		if c.isOurFINAcked() {
+			c.setState(ctx, StateFinWait2)
+		}
+	case StateClosing:
+		if c.isOurFINAcked() {
+			c.setState(ctx, StateTimeWait)
+			c.startTimeWait()
+		}
+	case StateLastAck:
+		if c.isOurFINAcked() {
+			c.terminate(ctx, nil)
+			return false
+		}
+	}
+
+	c.output(ctx)
+
+	return true
+}
+
+// textArrives queues data for the application, holding back anything beyond a hole until the hole is filled.
+// Returns how soon the data needs acknowledging.
+func (c *TCPConn) textArrives(ctx context.Context, segment *tcp.Segment) tcpACKUrgency {
+	if len(segment.Data) == 0 {
+		return tcpACKNotNeeded
+	}
+
+	switch c.state {
+	case StateEstablished, StateFinWait1, StateFinWait2:
+	default:
+		trace.Annotate(ctx, trace.Dropped, "data after FIN", "state", c.state.String())
+		return tcpACKNotNeeded
+	}
+
+	data := segment.Data
+	seq := segment.SequenceNumber
+
+	// Trim anything we already have off the front
+	if seqLT(seq, c.rcvNxt) {
+		data = data[c.rcvNxt-seq:]
+		seq = c.rcvNxt
+	}
+
+	// And anything that does not fit in the window off the back
+	data = data[:min(len(data), int(c.rcvNxt+c.receiveWindow()-seq))]
+
+	if seq != c.rcvNxt {
+		// RFC 5681 4.2: ACK at once, so the duplicate tells the sender about the hole
+		c.queueOutOfOrder(seq, data)
+		trace.Annotate(ctx, trace.Queued, "out of order data held back", "seq", seq, "rcv_nxt", c.rcvNxt, "len", len(data))
+
+		return tcpACKNow
+	}
+
+	c.receiveBuffer = append(c.receiveBuffer, data...)
+	c.rcvNxt += uint32(len(data))
+	filled := c.reassemble()
+	c.notify()
+
+	trace.Annotate(ctx, trace.Delivered, "data queued on connection", "len", len(data)+filled)
+
+	// RFC 5681 4.2: filling a hole is acknowledged at once, so the sender learns of it without delay
+	if filled > 0 {
+		return tcpACKNow
+	}
+
+	return tcpACKDelayed
+}
+
+// finArrives handles the peer's FIN, once all the data before it has arrived
+func (c *TCPConn) finArrives(ctx context.Context) {
+	c.rcvNxt++
+	c.finReceived = true
+	c.notify()
+
+	switch c.state {
+	case StateSynReceived, StateEstablished:
+		c.setState(ctx, StateCloseWait)
+	case StateFinWait1:
+		if c.isOurFINAcked() {
+			c.setState(ctx, StateTimeWait)
+			c.startTimeWait()
+		} else {
+			c.setState(ctx, StateClosing)
+		}
+	case StateFinWait2:
+		c.setState(ctx, StateTimeWait)
+		c.startTimeWait()
+	}
+}
+
+// startTimeWait (re)starts the 2*MSL timer, after which the connection is gone
+func (c *TCPConn) startTimeWait() {
+	c.timeWaitTimer.reset(c.timeWait)
+}
+
+func (c *TCPConn) timeWaitExpired() {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state == StateTimeWait && !c.timeWaitTimer.isPending() {
+		c.terminate(ctx, nil)
+	}
+}
+
+// terminate moves the connection to CLOSED and forgets it, reporting err to anyone still using it
+func (c *TCPConn) terminate(ctx context.Context, err error) {
+	if c.state == StateClosed {
+		return
+	}
+
+	if c.err == nil {
+		c.err = err
+	}
+
+	c.leaveHalfOpen()
+	c.timeWaitTimer.stop()
+	c.retransmitTimer.stop()
+	c.delayedACKTimer.stop()
+	c.persistTimer.stop()
+	c.keepAliveTimer.stop()
+	c.retransmitQueue = nil
+	c.outOfOrder = nil
+
+	c.setState(ctx, StateClosed)
+	c.stack.tcp.disconnect(c.id)
+}
+
+// abort resets the connection (RFC 9293 3.10.5)
+func (c *TCPConn) abort(ctx context.Context, err error) {
+	switch c.state {
+	case StateSynReceived, StateEstablished, StateFinWait1, StateFinWait2, StateCloseWait:
+		c.sendSegment(ctx, tcp.FlagRST, c.sndNxt, nil)
+	}
+
+	if c.state == StateEstablished || c.state == StateCloseWait {
+		c.stack.counters.TCP.EstabResets.Inc()
+	}
+
+	c.terminate(ctx, err)
+}
+
+// destroy drops the connection without telling the peer, for when the stack itself is going away
+func (c *TCPConn) destroy(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.terminate(c.stack.ctx, err)
+}
+
+// wait releases the connection until something about it changes, or expired is closed.
+// Returns false if it was the deadline.
+func (c *TCPConn) wait(expired <-chan struct{}) bool {
+	changed := c.changed
+
+	c.mu.Unlock()
+	defer c.mu.Lock()
+
+	select {
+	case <-changed:
+		return true
+	case <-expired:
+		return false
+	}
+}
+
+// Read reads data the peer has sent, returning io.EOF once the peer has closed its side and everything is read
+func (c *TCPConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		switch {
+		case c.closedByUser:
+			return 0, net.ErrClosed
+		case len(c.receiveBuffer) > 0:
+			return c.read(p), nil
+		case c.finReceived:
+			return 0, io.EOF
+		case c.err != nil:
+			return 0, c.err
+		case c.state == StateClosed:
+			return 0, net.ErrClosed
+		}
+
+		if !c.wait(c.readDeadline.wait()) {
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *TCPConn) read(p []byte) int {
+	n := copy(p, c.receiveBuffer)
+	c.receiveBuffer = c.receiveBuffer[n:]
+
+	// Like Linux, only send a window update once it at least doubles the window, which a closed window always does
+	if c.state.isSynchronized() && !c.finReceived && c.canOpenWindow() && c.receiveWindow() >= 2*c.currentWindow() {
+		ctx, tr := c.stack.startTrace()
+		defer tr.Finish()
+
+		c.sendACK(ctx)
+	}
+
+	return n
+}
+
+// Write queues p to be sent, blocking while the send buffer is full
+func (c *TCPConn) Write(p []byte) (int, error) {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	written := 0
+
+	for written < len(p) {
+		switch {
+		case c.closedByUser:
+			return written, net.ErrClosed
+		case c.err != nil:
+			return written, c.err
+		case c.finQueued:
+			return written, ErrConnectionClosing
+		}
+
+		switch c.state {
+		case StateSynSent, StateSynReceived, StateEstablished, StateCloseWait:
+		case StateClosed:
+			return written, net.ErrClosed
+		default:
+			return written, ErrConnectionClosing
+		}
+
+		space := c.writeBufferSize - len(c.sendBuffer)
+		if space <= 0 {
+			if !c.wait(c.writeDeadline.wait()) {
+				return written, os.ErrDeadlineExceeded
+			}
+
+			continue
+		}
+
+		n := min(space, len(p)-written)
+		c.sendBuffer = append(c.sendBuffer, p[written:written+n]...)
+		written += n
+
+		c.output(ctx)
+	}
+
+	return written, nil
+}
+
+// Close sends our FIN once everything written has been sent (RFC 9293 3.10.4). Unless SetLinger says otherwise,
+// it does not wait for the peer, which carries on in the background.
+func (c *TCPConn) Close() error {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closedByUser {
+		return net.ErrClosed
+	}
+
+	c.closedByUser = true
+
+	if c.lingerTimeout == 0 {
+		c.abortiveClose(ctx)
+		return nil
+	}
+
+	c.close(ctx)
+
+	if c.lingerTimeout > 0 {
+		c.linger()
+	}
+
+	return nil
+}
+
+// CloseWrite sends our FIN, once everything written has been sent, while still reading what the peer sends
+// until it closes its side too
+func (c *TCPConn) CloseWrite() error {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closedByUser {
+		return net.ErrClosed
+	}
+
+	c.close(ctx)
+
+	return nil
+}
+
+func (c *TCPConn) close(ctx context.Context) {
+	if c.finQueued {
+		return
+	}
+
+	switch c.state {
+	case StateSynSent:
+		c.terminate(ctx, nil)
+		return
+	case StateSynReceived:
+		c.finQueued = true
+
+		if len(c.sendBuffer) == 0 {
+			c.transmit(ctx, tcp.FlagFIN|tcp.FlagACK, c.sndNxt, nil)
+			c.sndNxt++
+			c.finSent = true
+			c.setState(ctx, StateFinWait1)
+		}
+	case StateEstablished:
+		c.finQueued = true
+		c.setState(ctx, StateFinWait1)
+	case StateCloseWait:
+		c.finQueued = true
+		c.setState(ctx, StateLastAck)
+	default:
+		return
+	}
+
+	c.output(ctx)
+}
+
+// State is where the connection is in the TCP state machine
+func (c *TCPConn) State() TCPState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.state
+}
+
+func (c *TCPConn) LocalAddrPort() netip.AddrPort {
+	return c.id.local
+}
+
+func (c *TCPConn) RemoteAddrPort() netip.AddrPort {
+	return c.id.remote
+}
+
+func (c *TCPConn) LocalAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.id.local)
+}
+
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return net.TCPAddrFromAddrPort(c.id.remote)
+}
+
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+
+	return nil
+}
+
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+
+	return nil
+}
+
+// SetWriteDeadline limits how long Write blocks for room in the send buffer. Data already queued is still sent.
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+
+	return nil
+}
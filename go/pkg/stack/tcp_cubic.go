@@ -0,0 +1,103 @@
+package stack
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	// RFC 9438 4.1 and 4.6
+	cubicC    = 0.4
+	cubicBeta = 0.7
+	// RFC 9438 4.3: with this additive increase, the Reno-friendly estimate keeps pace with Reno's average
+	// window, given CUBIC's gentler decrease
+	cubicAlpha = 3 * (1 - cubicBeta) / (1 + cubicBeta)
+)
+
+// tcpCubic is CUBIC (RFC 9438). After a loss the window climbs quickly back towards where the loss happened,
+// levels off around it, then probes past it, all as a function of time rather than of ACKs, so flows with
+// different round trip times share a link more fairly. Windows here are in segments, as the RFC has them.
+type tcpCubic struct {
+	// The window just before the last reduction
+	wMax float64
+	// How long the cubic function takes to climb back to origin
+	k float64
+	// Where the cubic function plateaus: wMax, or the window at the start of the epoch if that is bigger
+	origin float64
+	// When the current congestion avoidance stage started, or the zero time if it has not
+	epochStart time.Time
+	// The window Reno would have at this point (RFC 9438 4.3)
+	wEst float64
+}
+
+// window is W_cubic(t), the cubic function of the time since the epoch started (RFC 9438 equation 1)
+func (c *tcpCubic) window(t float64) float64 {
+	return cubicC*math.Pow(t-c.k, 3) + c.origin
+}
+
+func (c *tcpCubic) onAck(cc *tcpCongestion, acked int, now time.Time, srtt time.Duration) {
+	if cc.cwnd < cc.ssthresh {
+		// RFC 9438 4.10: CUBIC uses the standard slow start
+		cc.cwnd += min(acked, cc.mss)
+		return
+	}
+
+	mss := float64(cc.mss)
+	cwnd := float64(cc.cwnd) / mss
+	segmentsAcked := float64(acked) / mss
+
+	if c.epochStart.IsZero() {
+		c.epochStart = now
+		c.wEst = cwnd
+
+		if cwnd < c.wMax {
+			// RFC 9438 equation 2
+			c.k = math.Cbrt((c.wMax - cwnd) / cubicC)
+			c.origin = c.wMax
+		} else {
+			c.k = 0
+			c.origin = cwnd
+		}
+	}
+
+	t := now.Sub(c.epochStart).Seconds()
+
+	// RFC 9438 4.3
+	alpha := cubicAlpha
+	if c.wEst >= c.wMax {
+		alpha = 1
+	}
+
+	c.wEst += alpha * segmentsAcked / cwnd
+
+	var next float64
+
+	if c.window(t) < c.wEst {
+		// Reno-friendly region: Reno would be doing better here, so do what it would
+		next = c.wEst
+	} else {
+		// Concave and convex regions (RFC 9438 4.4 and 4.5), aiming one round trip ahead but never more than
+		// half the window again
+		target := min(max(c.window(t+srtt.Seconds()), cwnd), 1.5*cwnd)
+		next = cwnd + (target-cwnd)/cwnd*segmentsAcked
+	}
+
+	cc.cwnd = max(cc.cwnd, int(next*mss))
+}
+
+func (c *tcpCubic) onCongestion(cc *tcpCongestion, flightSize int, now time.Time) {
+	cwnd := float64(cc.cwnd) / float64(cc.mss)
+
+	// RFC 9438 4.7: fast convergence. Losing before reaching the last maximum suggests a new flow has joined,
+	// so release some bandwidth to it by settling lower.
+	if cwnd < c.wMax {
+		c.wMax = cwnd * (1 + cubicBeta) / 2
+	} else {
+		c.wMax = cwnd
+	}
+
+	c.epochStart = time.Time{}
+
+	// RFC 9438 4.6
+	cc.ssthresh = max(int(float64(cc.cwnd)*cubicBeta), 2*cc.mss)
+}
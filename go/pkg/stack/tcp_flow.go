@@ -0,0 +1,398 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/tcp"
+)
+
+const (
+	// RFC 1122 4.2.3.2 allows up to 500ms; Linux waits at most 200ms
+	tcpDelayedACKTimeout = 200 * time.Millisecond
+
+	// RFC 7323 5.5: a TS.Recent this old may have wrapped, so PAWS stops trusting it
+	tcpPAWSIdleLimit = 24 * 24 * time.Hour
+
+	// The timestamps option takes 10 bytes, and two NOPs keep what follows it aligned
+	tcpTimestampsOptionLength = 12
+)
+
+// tcpACKUrgency is how soon something that arrived has to be acknowledged
+type tcpACKUrgency int
+
+const (
+	tcpACKNotNeeded tcpACKUrgency = iota
+	tcpACKDelayed
+	tcpACKNow
+)
+
+// windowShiftFor is the smallest window scale that can advertise all of a buffer of size bytes (RFC 7323 2.3)
+func windowShiftFor(size int) uint8 {
+	shift := uint8(0)
+
+	for size>>shift > 0xFFFF && shift < tcp.MaxWindowScale {
+		shift++
+	}
+
+	return shift
+}
+
+// receiveWindow is how much room is left in the read buffer, which is as much as the window can ever be
+func (c *TCPConn) receiveWindow() uint32 {
+	free := max(c.readBufferSize-len(c.receiveBuffer), 0)
+
+	return uint32(min(free, 0xFFFF<<c.rcvWndShift))
+}
+
+// receiveMSS is the most data the peer can put in one segment, given the MSS we announced
+func (c *TCPConn) receiveMSS() int {
+	mss := c.stack.tcpMSS(c.id.remote.Addr())
+
+	if c.timestamps {
+		mss -= tcpTimestampsOptionLength
+	}
+
+	return mss
+}
+
+// segmentSize is the most data we can put in one segment: the peer's MSS, or less if the path MTU is smaller or
+// probing has found it to be, less the options every segment carries (RFC 6691)
+func (c *TCPConn) segmentSize() int {
+	mss := c.pathMSS()
+
+	if c.mtuProbe.enabled {
+		mss = min(mss, c.mtuToMSS(c.mtuProbe.searchLow))
+	}
+
+	return c.payloadSize(mss)
+}
+
+// pathMSS is the peer's MSS, or less if a router has said the path MTU is smaller
+func (c *TCPConn) pathMSS() int {
+	if mtu, ok := c.stack.pmtu.lookup(c.id.remote.Addr()); ok {
+		return min(c.sndMSS, c.mtuToMSS(mtu))
+	}
+
+	return c.sndMSS
+}
+
+// payloadSize is how much data fits in a segment of mss bytes alongside the options every segment carries
+func (c *TCPConn) payloadSize(mss int) int {
+	if c.timestamps {
+		return mss - tcpTimestampsOptionLength
+	}
+
+	return mss
+}
+
+func (c *TCPConn) mtuToMSS(mtu int) int {
+	return mtu - ipHeaderLength(c.id.remote.Addr()) - tcp.MinHeaderLength
+}
+
+func (c *TCPConn) mssToMTU(mss int) int {
+	return mss + ipHeaderLength(c.id.remote.Addr()) + tcp.MinHeaderLength
+}
+
+// currentWindow is how much of the last window advertised is still open
+func (c *TCPConn) currentWindow() uint32 {
+	if seqLT(c.rcvNxt, c.rcvAdv) {
+		return c.rcvAdv - c.rcvNxt
+	}
+
+	return 0
+}
+
+// canOpenWindow is receiver side SWS avoidance (RFC 9293 3.8.6.2.2): the window only opens once it can open
+// by a full segment, or half the buffer if that is smaller, so the peer is never invited to send slivers
+func (c *TCPConn) canOpenWindow() bool {
+	threshold := uint32(min(c.readBufferSize/2, c.receiveMSS()))
+
+	return c.receiveWindow() >= c.currentWindow()+threshold
+}
+
+// advertiseWindow is the window for an outgoing segment, already scaled. The right edge never moves back
+// (RFC 9293 3.8.6.2.1), and what the scaling rounds off is not counted as advertised.
+func (c *TCPConn) advertiseWindow(syn bool) uint16 {
+	if syn {
+		// RFC 7323 2.2: the window in a SYN is never scaled
+		window := min(c.receiveWindow(), 0xFFFF)
+		c.rcvAdv = c.rcvNxt + window
+
+		return uint16(window)
+	}
+
+	if c.canOpenWindow() {
+		window := c.receiveWindow() >> c.rcvWndShift << c.rcvWndShift
+		c.rcvAdv = c.rcvNxt + window
+	}
+
+	return uint16(c.currentWindow() >> c.rcvWndShift)
+}
+
+// peerWindow is the window in a segment from the peer, scaled unless it is in a SYN
+func (c *TCPConn) peerWindow(segment *tcp.Segment) uint32 {
+	if segment.Flags.Has(tcp.FlagSYN) {
+		return uint32(segment.Window)
+	}
+
+	return uint32(segment.Window) << c.sndWndShift
+}
+
+// timestampNow is our TSval clock: milliseconds, from a secret point for each connection (RFC 7323 5.4)
+func (c *TCPConn) timestampNow() uint32 {
+	return uint32(c.stack.clock.Now().UnixMilli()) + c.tsOffset
+}
+
+// synOptions are the options for our SYN or SYN-ACK. A SYN-ACK only carries the ones the peer offered.
+func (c *TCPConn) synOptions(synACK bool) []tcp.Option {
+	options := []tcp.Option{tcp.NewMSSOption(uint16(c.stack.tcpMSS(c.id.remote.Addr())))}
+
+	if !synACK || c.windowScaling {
+		options = append(options, tcp.NewWindowScaleOption(c.rcvWndShift))
+	}
+
+	if (!synACK && !c.stack.options.DisableSACK) || c.sackPermitted {
+		options = append(options, tcp.NewSACKPermittedOption())
+	}
+
+	if !synACK || c.timestamps {
+		options = append(options, tcp.NewTimestampsOption(c.timestampNow(), c.tsRecent))
+	}
+
+	return options
+}
+
+// negotiateOptions takes what the peer offered in its SYN. Window scaling and timestamps are only used
+// if both sides offer them (RFC 7323 2.2 and 3.2).
+func (c *TCPConn) negotiateOptions(syn *tcp.Segment) {
+	if shift, ok := syn.WindowScale(); ok {
+		c.windowScaling = true
+		c.sndWndShift = shift
+	} else {
+		c.rcvWndShift = 0
+	}
+
+	if tsVal, tsEcr, ok := syn.Timestamps(); ok {
+		c.timestamps = true
+		c.tsRecent = tsVal
+		c.tsRecentAge = c.stack.clock.Now()
+
+		if syn.Flags.Has(tcp.FlagACK) {
+			c.tsEcr = tsEcr
+		}
+	}
+}
+
+// pawsRejects checks a segment's timestamp (RFC 7323 5.3 R1 and 3.2). An old timestamp means the segment is
+// an old duplicate from before the sequence numbers wrapped, however acceptable its sequence number looks.
+func (c *TCPConn) pawsRejects(ctx context.Context, segment *tcp.Segment) bool {
+	if !c.timestamps || segment.Flags.Has(tcp.FlagRST) {
+		return false
+	}
+
+	tsVal, _, ok := segment.Timestamps()
+	if !ok {
+		trace.Annotate(ctx, trace.Dropped, "timestamps negotiated but missing")
+		return true
+	}
+
+	if seqLT(tsVal, c.tsRecent) && c.stack.clock.Now().Sub(c.tsRecentAge) < tcpPAWSIdleLimit {
+		trace.Annotate(ctx, trace.Dropped, "PAWS: timestamp older than TS.Recent", "ts_val", tsVal, "ts_recent", c.tsRecent)
+		c.sendACK(ctx)
+
+		return true
+	}
+
+	return false
+}
+
+// updateTSRecent remembers the timestamp to echo, from an acceptable segment that starts no later than
+// what we last acknowledged (RFC 7323 4.3)
+func (c *TCPConn) updateTSRecent(segment *tcp.Segment) {
+	tsVal, tsEcr, ok := segment.Timestamps()
+	if !c.timestamps || !ok {
+		return
+	}
+
+	if segment.Flags.Has(tcp.FlagACK) {
+		c.tsEcr = tsEcr
+	}
+
+	if seqLEQ(c.tsRecent, tsVal) && seqLEQ(segment.SequenceNumber, c.lastACKSent) {
+		c.tsRecent = tsVal
+		c.tsRecentAge = c.stack.clock.Now()
+	}
+}
+
+// timestampRTT is the round trip time measured from the timestamp the peer echoed (RFC 7323 4). Unlike timing
+// segments, it is unambiguous even for retransmissions.
+func (c *TCPConn) timestampRTT() (time.Duration, bool) {
+	if !c.timestamps || c.tsEcr == 0 {
+		return 0, false
+	}
+
+	return time.Duration(c.timestampNow()-c.tsEcr) * time.Millisecond, true
+}
+
+// acknowledgeData acknowledges received data as soon as urgency says
+func (c *TCPConn) acknowledgeData(ctx context.Context, urgency tcpACKUrgency) {
+	switch urgency {
+	case tcpACKNow:
+		c.sendACK(ctx)
+	case tcpACKDelayed:
+		// RFC 5681 4.2: at least every second full-sized segment, and never more than the timeout late
+		if c.rcvNxt-c.lastACKSent >= uint32(2*c.receiveMSS()) {
+			c.sendACK(ctx)
+		} else if !c.delayedACKTimer.isPending() {
+			c.delayedACKTimer.reset(tcpDelayedACKTimeout)
+		}
+	}
+}
+
+func (c *TCPConn) delayedACKExpired() {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.delayedACKTimer.isPending() && c.state.isSynchronized() && c.rcvNxt != c.lastACKSent {
+		c.sendACK(ctx)
+	}
+}
+
+// canSendPartialSegment is sender side SWS avoidance with Nagle's algorithm (RFC 9293 3.8.6.2.1 and 3.7.4).
+// size is what could be sent now, less than a full segment, and queued is everything waiting to be sent.
+func (c *TCPConn) canSendPartialSegment(size, queued int) bool {
+	// Nagle: while anything is unacknowledged, small segments wait for the ACK so they can be sent together
+	if len(c.retransmitQueue) > 0 && !c.noDelay {
+		return false
+	}
+
+	return size == queued || size >= int(c.maxSndWnd)/2
+}
+
+// startPersisting arms the persist timer, for when there is data to send but the window will not let it go,
+// and nothing is in flight to bring back an ACK that might open it (RFC 9293 3.8.6.1)
+func (c *TCPConn) startPersisting() {
+	if len(c.retransmitQueue) > 0 || c.persistTimer.isPending() {
+		return
+	}
+
+	if c.persistBackoff == 0 {
+		c.persistBackoff = c.rtt.rto
+		c.persistingSince = c.stack.clock.Now()
+	}
+
+	c.persistTimer.reset(c.persistBackoff)
+}
+
+// stopPersisting is for when data can go out again, so the next closed window is probed from the start
+func (c *TCPConn) stopPersisting() {
+	c.persistTimer.stop()
+	c.persistBackoff = 0
+}
+
+// persistTimeout probes a closed window, or sends what a window too small for SWS avoidance allows (the override
+// timeout of RFC 9293 3.8.6.2.1). Probes back off exponentially, and go on for as long as the peer answers them.
+func (c *TCPConn) persistTimeout() {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.persistTimer.isPending() || !c.state.isSynchronized() || len(c.retransmitQueue) > 0 {
+		return
+	}
+
+	sent := c.unackedData()
+	unsent := len(c.sendBuffer) - sent
+
+	if unsent == 0 {
+		return
+	}
+
+	if usable := int(c.sndWnd) - sent; usable > 0 {
+		size := min(usable, unsent, c.segmentSize())
+
+		flags := tcp.FlagACK
+		if size == unsent {
+			flags |= tcp.FlagPSH
+		}
+
+		c.stopPersisting()
+		c.transmit(ctx, flags, c.sndNxt, c.sendBuffer[sent:sent+size])
+		c.sndNxt += uint32(size)
+
+		return
+	}
+
+	// A window closed for longer than the user timeout counts as data going unacknowledged for that long
+	if c.userTimedOut(c.persistingSince) {
+		trace.Annotate(ctx, trace.Dropped, "window stayed closed past the user timeout")
+		c.terminate(ctx, ErrConnectionTimedOut)
+
+		return
+	}
+
+	// Like Linux, probe with an old sequence number rather than a byte of new data. The peer answers it with an
+	// ACK carrying its window, and there is nothing to retransmit if the window is still closed.
+	trace.Annotate(ctx, trace.Sent, "zero window probe", "backoff", c.persistBackoff.String())
+	c.sendSegment(ctx, tcp.FlagACK, c.sndUna-1, nil)
+
+	c.persistBackoff = min(2*c.persistBackoff, tcpMaxRTO)
+	c.persistTimer.reset(c.persistBackoff)
+}
+
+// SetNoDelay turns Nagle's algorithm off, so small writes go out at once instead of waiting for
+// everything before them to be acknowledged
+func (c *TCPConn) SetNoDelay(noDelay bool) error {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.noDelay = noDelay
+	c.output(ctx)
+
+	return nil
+}
+
+// SetReadBuffer sets how much received data can wait to be read, which is the most the window can ever be.
+// The window scale is fixed by the handshake, so growing the buffer after it may not grow the window as far.
+func (c *TCPConn) SetReadBuffer(bytes int) error {
+	if bytes <= 0 {
+		return fmt.Errorf("read buffer must be larger than zero: %d", bytes)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.readBufferSize = bytes
+
+	if c.state == StateClosed {
+		c.rcvWndShift = windowShiftFor(bytes)
+	}
+
+	return nil
+}
+
+// SetWriteBuffer sets how much written data can wait to be sent and acknowledged before Write blocks
+func (c *TCPConn) SetWriteBuffer(bytes int) error {
+	if bytes <= 0 {
+		return fmt.Errorf("write buffer must be larger than zero: %d", bytes)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.writeBufferSize = bytes
+	c.notify()
+
+	return nil
+}
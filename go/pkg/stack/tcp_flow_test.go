@@ -0,0 +1,362 @@
+package stack
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/tcp"
+)
+
+// waitForSendWindow waits for the stack to take a window update from the peer
+func waitForSendWindow(t *testing.T, conn *TCPConn, expected uint32) {
+	t.Helper()
+
+	waitFor(t, fmt.Sprintf("the send window to become %d", expected), func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		return conn.sndWnd == expected
+	})
+}
+
+func Test_TCP_DialOffersWindowScaleAndTimestamps(t *testing.T) {
+	p := newTCPPeer(t)
+
+	synSent(p)
+
+	conn := p.stack.tcp.lookupConnection(tcpConnectionID{local: p.remote, remote: p.local})
+	conn.mu.Lock()
+	syn := conn.buildSegment(tcp.FlagSYN, conn.iss, nil)
+	conn.mu.Unlock()
+
+	if shift, ok := syn.WindowScale(); !ok || shift != windowShiftFor(tcpReceiveBufferSize) {
+		t.Errorf("expected the SYN to offer a window scale of %d, got %d (%v)", windowShiftFor(tcpReceiveBufferSize), shift, ok)
+	}
+
+	if _, _, ok := syn.Timestamps(); !ok {
+		t.Errorf("expected the SYN to offer timestamps")
+	}
+}
+
+func Test_TCP_WindowScaleIsOnlyUsedIfBothSidesOfferIt(t *testing.T) {
+	tests := []struct {
+		name           string
+		peerOffers     bool
+		expectWindow   uint16
+		expectPeerWnd  uint32
+		expectSYNScale bool
+	}{
+		{name: "peer offers", peerOffers: true, expectWindow: 32767, expectPeerWnd: 8192 << 2, expectSYNScale: true},
+		// Two bytes short of the window in the SYN-ACK, which is not worth opening up again for
+		{name: "peer does not offer", peerOffers: false, expectWindow: 0xFFFF - 2, expectPeerWnd: 8192},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTCPPeer(t)
+			p.windowScale = test.peerOffers
+			p.windowShift = 2
+
+			_, err := p.stack.ListenTCP(p.remote)
+			testhelpers.FailTestIfErrorIsPresent(t, err)
+
+			p.send(tcp.FlagSYN, "")
+			synACK := p.expect(tcp.FlagSYN | tcp.FlagACK)
+
+			if _, ok := synACK.WindowScale(); ok != test.expectSYNScale {
+				t.Errorf("expected a window scale in the SYN-ACK %v, got %v", test.expectSYNScale, ok)
+			}
+
+			// The window in a SYN is never scaled
+			if synACK.Window != 0xFFFF {
+				t.Errorf("expected the SYN-ACK to advertise 65535, got %d", synACK.Window)
+			}
+
+			p.send(tcp.FlagACK, "")
+			p.send(tcp.FlagACK|tcp.FlagPSH, "hi")
+
+			// The whole 256KiB buffer, less the two bytes, rounded down to the scale of 8
+			if ack := p.expect(tcp.FlagACK); ack.Window != test.expectWindow {
+				t.Errorf("expected a window of %d, got %d", test.expectWindow, ack.Window)
+			}
+
+			conn := p.stack.tcp.lookupConnection(tcpConnectionID{local: p.remote, remote: p.local})
+			conn.mu.Lock()
+			defer conn.mu.Unlock()
+
+			if conn.sndWnd != test.expectPeerWnd {
+				t.Errorf("expected the peer's window to be %d, got %d", test.expectPeerWnd, conn.sndWnd)
+			}
+		})
+	}
+}
+
+func Test_TCP_TimestampsAreEchoedAndOldOnesRejected(t *testing.T) {
+	p := newTCPPeer(t)
+	p.timestamps = true
+	p.tsVal = 100
+
+	_, err := p.stack.ListenTCP(p.remote)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	p.send(tcp.FlagSYN, "")
+
+	if _, tsEcr, ok := p.expect(tcp.FlagSYN | tcp.FlagACK).Timestamps(); !ok || tsEcr != 100 {
+		t.Fatalf("expected the SYN-ACK to echo 100, got %d (%v)", tsEcr, ok)
+	}
+
+	p.send(tcp.FlagACK, "")
+	conn := p.stack.tcp.lookupConnection(tcpConnectionID{local: p.remote, remote: p.local})
+	waitForState(t, conn, StateEstablished)
+
+	p.tsVal = 200
+	p.send(tcp.FlagACK|tcp.FlagPSH, "hello")
+
+	if _, tsEcr, _ := p.expect(tcp.FlagACK).Timestamps(); tsEcr != 200 {
+		t.Errorf("expected the ACK to echo 200, got %d", tsEcr)
+	}
+
+	// An older timestamp is an old duplicate, which is dropped and answered with an ACK, however good its sequence number
+	p.tsVal = 150
+	p.sendAt(tcp.FlagACK|tcp.FlagPSH, p.seq, p.ack, "stale")
+
+	ack := p.expect(tcp.FlagACK)
+	if _, tsEcr, _ := ack.Timestamps(); ack.AcknowledgmentNumber != p.seq || tsEcr != 200 {
+		t.Errorf("expected the stale segment to be ACKed without taking it, got ack %d echoing %d", ack.AcknowledgmentNumber, tsEcr)
+	}
+
+	// Once negotiated, segments without timestamps are dropped silently
+	p.timestamps = false
+	p.sendAt(tcp.FlagACK|tcp.FlagPSH, p.seq, p.ack, "bare")
+	p.expectNothing()
+
+	data := make([]byte, 100)
+	n, err := conn.Read(data)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if string(data[:n]) != "hello" {
+		t.Errorf("expected only the segment with a good timestamp, got %q", data[:n])
+	}
+}
+
+// With timestamps the ACK of a retransmission is no longer ambiguous, so Karn's rule does not apply
+func Test_TCP_TimestampsTimeRetransmissions(t *testing.T) {
+	for _, timestamps := range []bool{true, false} {
+		t.Run(map[bool]string{true: "timestamps", false: "no timestamps"}[timestamps], func(t *testing.T) {
+			clk := clock.NewFake(time.Unix(0, 0))
+			p := newTCPPeerWithClock(t, clk)
+			p.timestamps = timestamps
+			conn := established(p)
+
+			conn.mu.Lock()
+			conn.rtt = newTCPRTTEstimator()
+			conn.mu.Unlock()
+
+			_, err := conn.Write([]byte("x"))
+			testhelpers.FailTestIfErrorIsPresent(t, err)
+
+			p.expect(tcp.FlagACK | tcp.FlagPSH)
+			clk.Advance(tcpInitialRTO)
+			p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+			clk.Advance(100 * time.Millisecond)
+			p.send(tcp.FlagACK, "")
+
+			var sampled bool
+			var srtt time.Duration
+
+			waitFor(t, "the retransmission to be acknowledged", func() bool {
+				conn.mu.Lock()
+				defer conn.mu.Unlock()
+
+				sampled, srtt = conn.rtt.sampled, conn.rtt.srtt
+				return len(conn.retransmitQueue) == 0
+			})
+
+			if sampled != timestamps {
+				t.Errorf("expected an RTT sample %v, got %v", timestamps, sampled)
+			}
+
+			if timestamps && srtt != 100*time.Millisecond {
+				t.Errorf("expected the RTT from the retransmission, 100ms, got %v", srtt)
+			}
+		})
+	}
+}
+
+func Test_TCP_NagleHoldsSmallSegmentsUntilTheACK(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	write := func(data string) {
+		_, err := conn.Write([]byte(data))
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+	}
+
+	write("a")
+	p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	write("b")
+	write("c")
+	p.expectNothing()
+
+	p.send(tcp.FlagACK, "")
+
+	if segment := p.expect(tcp.FlagACK | tcp.FlagPSH); string(segment.Data) != "bc" {
+		t.Errorf("expected the held back writes in one segment, got %q", segment.Data)
+	}
+
+	err := conn.SetNoDelay(true)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	for _, data := range []string{"d", "e"} {
+		write(data)
+
+		if segment := p.expect(tcp.FlagACK | tcp.FlagPSH); string(segment.Data) != data {
+			t.Errorf("expected %q to go at once with no delay, got %q", data, segment.Data)
+		}
+	}
+}
+
+func Test_TCP_SmallWindowIsOnlyFilledWhenThePersistTimerExpires(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	p.window = 300
+	p.send(tcp.FlagACK, "")
+	waitForSendWindow(t, conn, 300)
+
+	_, err := conn.Write([]byte(strings.Repeat("x", 800)))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	// 300 bytes is less than the 536 byte segment, and less than half the largest window the peer has offered
+	p.expectNothing()
+
+	clk.Advance(tcpInitialRTO)
+
+	if segment := p.expect(tcp.FlagACK); len(segment.Data) != 300 {
+		t.Errorf("expected the window to be filled after the override timeout, got %d bytes", len(segment.Data))
+	}
+
+	p.window = 8192
+	p.send(tcp.FlagACK, "")
+
+	if segment := p.expect(tcp.FlagACK | tcp.FlagPSH); len(segment.Data) != 500 {
+		t.Errorf("expected the rest once the window opened, got %d bytes", len(segment.Data))
+	}
+}
+
+func Test_TCP_ReceiverOnlyOpensTheWindowByUsefulAmounts(t *testing.T) {
+	p := newTCPPeer(t)
+	conn, _ := synSent(p)
+
+	err := conn.SetReadBuffer(2000)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	p.send(tcp.FlagSYN|tcp.FlagACK, "")
+
+	steps := []struct {
+		send         string
+		read         int
+		expectWindow uint16
+		expectUpdate bool
+	}{
+		{expectWindow: 2000, expectUpdate: true},
+		{send: strings.Repeat("a", 1400), expectWindow: 600, expectUpdate: true},
+		{send: strings.Repeat("b", 500), expectWindow: 100, expectUpdate: true},
+		// Opening by 100 bytes would only invite a silly segment
+		{read: 100},
+		// The buffer is half empty now, so the window can open
+		{read: 1000, expectWindow: 1200, expectUpdate: true},
+	}
+
+	for i, step := range steps {
+		if step.send != "" {
+			p.send(tcp.FlagACK, step.send)
+		}
+
+		if step.read > 0 {
+			n, err := conn.Read(make([]byte, step.read))
+			testhelpers.FailTestIfErrorIsPresent(t, err)
+
+			if n != step.read {
+				t.Fatalf("step %d: expected to read %d bytes, got %d", i, step.read, n)
+			}
+		}
+
+		if !step.expectUpdate {
+			p.expectNothing()
+			continue
+		}
+
+		if ack := p.expect(tcp.FlagACK); ack.Window != step.expectWindow {
+			t.Errorf("step %d: expected a window of %d, got %d", i, step.expectWindow, ack.Window)
+		}
+	}
+}
+
+func Test_TCP_ACKsAreDelayedUntilTheSecondFullSegment(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	established(p)
+
+	p.send(tcp.FlagACK|tcp.FlagPSH, "hello")
+	p.expectNothing()
+
+	clk.Advance(tcpDelayedACKTimeout)
+
+	if ack := p.expect(tcp.FlagACK); ack.AcknowledgmentNumber != p.seq {
+		t.Errorf("expected the delayed ACK to cover the data, got ack %d", ack.AcknowledgmentNumber)
+	}
+
+	mss := p.stack.tcpMSS(p.local.Addr())
+
+	p.send(tcp.FlagACK, strings.Repeat("a", mss))
+	p.expectNothing()
+
+	p.send(tcp.FlagACK, strings.Repeat("b", mss))
+
+	if ack := p.expect(tcp.FlagACK); ack.AcknowledgmentNumber != p.seq {
+		t.Errorf("expected the second full segment to be ACKed at once, got ack %d", ack.AcknowledgmentNumber)
+	}
+}
+
+func Test_TCP_ZeroWindowIsProbedWithBackoff(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	p.window = 0
+	p.send(tcp.FlagACK, "")
+	waitForSendWindow(t, conn, 0)
+
+	una := p.ack
+
+	_, err := conn.Write([]byte("hello"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	p.expectNothing()
+
+	// The first probe after an RTO, the second after twice that
+	for _, wait := range []time.Duration{tcpInitialRTO, 2 * tcpInitialRTO} {
+		clk.Advance(wait - tcpInitialRTO/2)
+		p.expectNothing()
+		clk.Advance(tcpInitialRTO / 2)
+
+		if probe := p.expect(tcp.FlagACK); probe.SequenceNumber != una-1 || len(probe.Data) != 0 {
+			t.Errorf("expected a probe at SND.UNA-1 without data, got seq %d and %d bytes", probe.SequenceNumber, len(probe.Data))
+		}
+	}
+
+	p.window = 8192
+	p.sendAt(tcp.FlagACK, p.seq, una, "")
+
+	if segment := p.expect(tcp.FlagACK | tcp.FlagPSH); string(segment.Data) != "hello" {
+		t.Errorf("expected the data once the window opened, got %q", segment.Data)
+	}
+}
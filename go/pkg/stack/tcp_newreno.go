@@ -0,0 +1,30 @@
+package stack
+
+import "time"
+
+// tcpNewReno is the standard window arithmetic of RFC 5681: exponential growth in slow start, one segment per
+// window in congestion avoidance, and halving on loss
+type tcpNewReno struct {
+	// Bytes acknowledged towards the next increase in congestion avoidance (RFC 5681 3.1, appropriate byte counting)
+	bytesAcked int
+}
+
+func (r *tcpNewReno) onAck(cc *tcpCongestion, acked int, now time.Time, srtt time.Duration) {
+	if cc.cwnd < cc.ssthresh {
+		// RFC 5681 equation 2
+		cc.cwnd += min(acked, cc.mss)
+		return
+	}
+
+	r.bytesAcked += acked
+	if r.bytesAcked >= cc.cwnd {
+		r.bytesAcked -= cc.cwnd
+		cc.cwnd += cc.mss
+	}
+}
+
+func (r *tcpNewReno) onCongestion(cc *tcpCongestion, flightSize int, now time.Time) {
+	// RFC 5681 equation 4
+	cc.ssthresh = max(flightSize/2, 2*cc.mss)
+	r.bytesAcked = 0
+}
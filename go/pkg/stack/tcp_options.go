@@ -0,0 +1,240 @@
+package stack
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/tcp"
+)
+
+// Linux's tcp_keepalive_time, tcp_keepalive_intvl and tcp_keepalive_probes, for when keepalives are turned on
+// without saying how often to send them
+const (
+	tcpKeepAliveIdle     = 2 * time.Hour
+	tcpKeepAliveInterval = 75 * time.Second
+	tcpKeepAliveCount    = 9
+)
+
+// heardFromPeer notes that an acceptable segment arrived, which is what keepalives wait for a lack of
+func (c *TCPConn) heardFromPeer() {
+	c.lastReceived = c.stack.clock.Now()
+	c.keepAliveProbes = 0
+}
+
+// keepAliveTimeout probes a connection that has been idle too long (RFC 9293 3.8.4), like Linux's
+// tcp_keepalive_timer. Only an idle connection needs probing; while data is in flight or waiting on the window,
+// the retransmission and persist timers find out if the peer has gone.
+func (c *TCPConn) keepAliveTimeout() {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.keepAliveTimer.isPending() || !c.keepAlive {
+		return
+	}
+
+	switch c.state {
+	case StateEstablished, StateCloseWait, StateFinWait2:
+	case StateClosed, StateTimeWait:
+		return
+	default:
+		c.keepAliveTimer.reset(c.keepAliveIdle)
+		return
+	}
+
+	if len(c.retransmitQueue) > 0 || len(c.sendBuffer) > c.unackedData() {
+		c.keepAliveTimer.reset(c.keepAliveIdle)
+		return
+	}
+
+	idle := c.stack.clock.Now().Sub(c.lastReceived)
+	if idle < c.keepAliveIdle {
+		c.keepAliveTimer.reset(c.keepAliveIdle - idle)
+		return
+	}
+
+	// With a user timeout, it decides how long the probes go unanswered for instead of their count (RFC 5482 3)
+	if (c.userTimeout > 0 && c.keepAliveProbes > 0 && idle >= c.userTimeout) ||
+		(c.userTimeout == 0 && c.keepAliveProbes >= c.keepAliveCount) {
+		trace.Annotate(ctx, trace.Dropped, "keepalive probes went unanswered", "probes", c.keepAliveProbes)
+		c.abort(ctx, ErrConnectionTimedOut)
+
+		return
+	}
+
+	// Like the zero window probe, an old sequence number the peer has to answer with an ACK
+	trace.Annotate(ctx, trace.Sent, "keepalive probe", "probes", c.keepAliveProbes, "idle", idle.String())
+	c.sendSegment(ctx, tcp.FlagACK, c.sndUna-1, nil)
+
+	c.keepAliveProbes++
+	c.keepAliveTimer.reset(c.keepAliveInterval)
+}
+
+// userTimedOut checks if data sent at sentAt has gone unacknowledged for longer than the user timeout allows
+func (c *TCPConn) userTimedOut(sentAt time.Time) bool {
+	return c.userTimeout > 0 && c.stack.clock.Now().Sub(sentAt) >= c.userTimeout
+}
+
+// clampToUserTimeout shortens a retransmission timeout that would fire after the user timeout, so the connection
+// is given up on when it expires rather than at the next backed off retransmission (Linux's
+// tcp_clamp_rto_to_user_timeout)
+func (c *TCPConn) clampToUserTimeout(rto time.Duration) time.Duration {
+	if c.userTimeout == 0 || len(c.retransmitQueue) == 0 {
+		return rto
+	}
+
+	remaining := c.userTimeout - c.stack.clock.Now().Sub(c.retransmitQueue[0].sentAt)
+
+	return max(min(rto, remaining), timerWheelGranularity)
+}
+
+// linger waits, after our FIN has been queued, for everything up to it to be acknowledged, giving up after the
+// linger timeout and leaving the connection to carry on in the background like Linux does
+func (c *TCPConn) linger() {
+	expired := make(chan struct{})
+	timer := c.stack.timers.newTimer(func() { close(expired) })
+
+	timer.reset(c.lingerTimeout)
+	defer timer.stop()
+
+	for c.state != StateClosed && !c.isOurFINAcked() {
+		if !c.wait(expired) {
+			return
+		}
+	}
+}
+
+// abortiveClose is Close with a zero linger timeout: everything unsent is thrown away, and the peer gets an RST
+// instead of a FIN, which also skips TIME-WAIT
+func (c *TCPConn) abortiveClose(ctx context.Context) {
+	trace.Annotate(ctx, trace.Dropped, "closed with zero linger, resetting", "unsent", len(c.sendBuffer))
+
+	c.sendBuffer = nil
+	c.abort(ctx, nil)
+}
+
+// SetKeepAlive turns keepalive probes on or off, like SO_KEEPALIVE. They start after two hours without hearing from
+// the peer, unless SetKeepAlivePeriod or SetKeepAliveConfig says otherwise.
+func (c *TCPConn) SetKeepAlive(keepAlive bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.setKeepAlive(keepAlive)
+
+	return nil
+}
+
+// SetKeepAlivePeriod sets how long the connection has to be idle before the first keepalive probe, like
+// TCP_KEEPIDLE. It does not turn keepalives on.
+func (c *TCPConn) SetKeepAlivePeriod(idle time.Duration) error {
+	if idle <= 0 {
+		return fmt.Errorf("keepalive idle time must be larger than zero: %s", idle)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.keepAliveIdle = idle
+	c.setKeepAlive(c.keepAlive)
+
+	return nil
+}
+
+// SetKeepAliveConfig sets every keepalive option at once, as net.TCPConn does. Zero fields are Linux's defaults,
+// and negative ones are left as they are.
+func (c *TCPConn) SetKeepAliveConfig(config net.KeepAliveConfig) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch {
+	case config.Idle == 0:
+		c.keepAliveIdle = tcpKeepAliveIdle
+	case config.Idle > 0:
+		c.keepAliveIdle = config.Idle
+	}
+
+	switch {
+	case config.Interval == 0:
+		c.keepAliveInterval = tcpKeepAliveInterval
+	case config.Interval > 0:
+		c.keepAliveInterval = config.Interval
+	}
+
+	switch {
+	case config.Count == 0:
+		c.keepAliveCount = tcpKeepAliveCount
+	case config.Count > 0:
+		c.keepAliveCount = config.Count
+	}
+
+	c.setKeepAlive(config.Enable)
+
+	return nil
+}
+
+// setKeepAlive (re)starts the keepalive timer for the current settings, or stops it
+func (c *TCPConn) setKeepAlive(keepAlive bool) {
+	c.keepAlive = keepAlive
+
+	if !keepAlive || c.state == StateClosed {
+		c.keepAliveTimer.stop()
+		return
+	}
+
+	c.keepAliveTimer.reset(max(c.keepAliveIdle-c.stack.clock.Now().Sub(c.lastReceived), 0))
+}
+
+// SetUserTimeout sets how long sent data can go unacknowledged before the connection is given up on, like
+// TCP_USER_TIMEOUT (RFC 5482). It replaces the retransmission limit, and bounds how long zero window and keepalive
+// probes go on for. Zero goes back to the limit.
+func (c *TCPConn) SetUserTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("user timeout cannot be negative: %s", timeout)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.userTimeout = timeout
+
+	return nil
+}
+
+// SetLinger sets what Close does with data still to be sent, like SO_LINGER. With sec < 0, the default, Close
+// returns at once and the data is sent in the background. With sec == 0, Close throws the data away and resets the
+// connection. With sec > 0, Close waits up to sec seconds for the data to be acknowledged before returning.
+func (c *TCPConn) SetLinger(sec int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lingerTimeout = time.Duration(sec) * time.Second
+	if sec < 0 {
+		c.lingerTimeout = -1
+	}
+
+	return nil
+}
+
+// SetTimeWait sets how long the connection stays in TIME-WAIT once it has closed. Less than 2*MSL risks segments
+// from this connection being taken for a later one between the same ports (RFC 9293 3.4.2), and zero skips it.
+func (c *TCPConn) SetTimeWait(timeWait time.Duration) error {
+	if timeWait < 0 {
+		return fmt.Errorf("TIME-WAIT duration cannot be negative: %s", timeWait)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timeWait = timeWait
+
+	if c.state == StateTimeWait {
+		c.startTimeWait()
+	}
+
+	return nil
+}
@@ -0,0 +1,265 @@
+package stack
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/tcp"
+)
+
+func expectKeepAliveProbe(p *tcpPeer, una uint32) {
+	p.t.Helper()
+
+	if probe := p.expect(tcp.FlagACK); probe.SequenceNumber != una-1 || len(probe.Data) != 0 {
+		p.t.Errorf("expected a keepalive probe at SND.UNA-1 without data, got seq %d and %d bytes", probe.SequenceNumber, len(probe.Data))
+	}
+}
+
+// waitForKeepAliveAnswer waits for the stack to take in the peer's answer to a probe
+func waitForKeepAliveAnswer(t *testing.T, conn *TCPConn) {
+	t.Helper()
+
+	waitFor(t, "the answer to the keepalive probe", func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		return conn.keepAliveProbes == 0
+	})
+}
+
+func Test_TCP_KeepAliveGivesUpOnASilentPeer(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+	una := p.ack
+
+	err := conn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: 10 * time.Second, Interval: 2 * time.Second, Count: 3})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	clk.Advance(9 * time.Second)
+	p.expectNothing()
+
+	clk.Advance(time.Second)
+	expectKeepAliveProbe(p, una)
+
+	for range 2 {
+		clk.Advance(2 * time.Second)
+		expectKeepAliveProbe(p, una)
+	}
+
+	// The third probe went unanswered too
+	clk.Advance(2 * time.Second)
+	p.expect(tcp.FlagRST)
+
+	if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, ErrConnectionTimedOut) {
+		t.Errorf("expected the read to time out, got %v", err)
+	}
+}
+
+func Test_TCP_KeepAliveAnswerPutsOffTheNextProbe(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+	una := p.ack
+
+	err := conn.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: 10 * time.Second, Interval: 2 * time.Second})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	clk.Advance(10 * time.Second)
+	expectKeepAliveProbe(p, una)
+	p.sendAt(tcp.FlagACK, p.seq, una, "")
+	waitForKeepAliveAnswer(t, conn)
+
+	// Answered, so the next probe waits for the connection to have been idle as long again, not just the interval
+	clk.Advance(2 * time.Second)
+	p.expectNothing()
+
+	clk.Advance(8 * time.Second)
+	expectKeepAliveProbe(p, una)
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetKeepAlive(false))
+
+	clk.Advance(time.Hour)
+	p.expectNothing()
+
+	if conn.State() != StateEstablished {
+		t.Errorf("expected the connection to stay up, it is %s", conn.State())
+	}
+}
+
+func Test_TCP_UserTimeoutReplacesTheRetransmissionLimit(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetUserTimeout(5*time.Second))
+
+	_, err := conn.Write([]byte("hello"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	// Retransmissions at 1s and 3s, then the one that would be at 7s is cut short to give up at 5s
+	clk.Advance(4900 * time.Millisecond)
+	p.drain()
+
+	if conn.State() != StateEstablished {
+		t.Fatalf("expected the connection to hold on until the user timeout, it is %s", conn.State())
+	}
+
+	clk.Advance(100 * time.Millisecond)
+
+	if _, err := conn.Write([]byte("more")); !errors.Is(err, ErrConnectionTimedOut) {
+		t.Errorf("expected the connection to time out, got %v", err)
+	}
+}
+
+func Test_TCP_UserTimeoutEndsZeroWindowProbing(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetUserTimeout(10*time.Second))
+
+	p.window = 0
+	p.send(tcp.FlagACK, "")
+	waitForSendWindow(t, conn, 0)
+
+	_, err := conn.Write([]byte("hello"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	// Probes at 1s, 3s and 7s are answered, but the window never opens
+	for range 15 {
+		clk.Advance(time.Second)
+		p.drain()
+		p.sendAt(tcp.FlagACK, p.seq, p.ack, "")
+	}
+
+	if conn.State() != StateClosed {
+		t.Errorf("expected the connection to be given up on, it is %s", conn.State())
+	}
+}
+
+func Test_TCP_ZeroLingerResetsOnClose(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	p.window = 0
+	p.send(tcp.FlagACK, "")
+	waitForSendWindow(t, conn, 0)
+
+	_, err := conn.Write([]byte("never sent"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetLinger(0))
+	testhelpers.FailTestIfErrorIsPresent(t, conn.Close())
+
+	if rst := p.expect(tcp.FlagRST); rst.SequenceNumber != p.ack {
+		t.Errorf("expected the RST at SND.NXT %d, got %d", p.ack, rst.SequenceNumber)
+	}
+
+	if conn.State() != StateClosed {
+		t.Errorf("expected the connection to skip TIME-WAIT, it is %s", conn.State())
+	}
+}
+
+func Test_TCP_LingerWaitsForTheDataToBeAcknowledged(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetLinger(5))
+
+	_, err := conn.Write([]byte("hello"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	closed := make(chan error, 1)
+
+	go func() {
+		closed <- conn.Close()
+	}()
+
+	p.expect(tcp.FlagFIN | tcp.FlagACK)
+
+	select {
+	case <-closed:
+		t.Fatalf("expected Close to wait for the FIN to be acknowledged")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	p.send(tcp.FlagACK, "")
+
+	select {
+	case err := <-closed:
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected Close to return once everything was acknowledged")
+	}
+}
+
+func Test_TCP_LingerGivesUpAfterItsTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetLinger(1))
+
+	closed := make(chan error, 1)
+
+	go func() {
+		closed <- conn.Close()
+	}()
+
+	p.expect(tcp.FlagFIN | tcp.FlagACK)
+	clk.Advance(time.Second)
+
+	select {
+	case err := <-closed:
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected Close to give up waiting after the linger timeout")
+	}
+
+	// The FIN carries on being retransmitted in the background
+	if conn.State() != StateFinWait1 {
+		t.Errorf("expected the connection to still be in FIN-WAIT-1, it is %s", conn.State())
+	}
+}
+
+func Test_TCP_TimeWaitDurationIsConfigurable(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetTimeWait(3*time.Second))
+	testhelpers.FailTestIfErrorIsPresent(t, conn.Close())
+
+	p.expect(tcp.FlagFIN | tcp.FlagACK)
+	p.send(tcp.FlagFIN|tcp.FlagACK, "")
+	p.expect(tcp.FlagACK)
+	waitForState(t, conn, StateTimeWait)
+
+	clk.Advance(2 * time.Second)
+
+	if conn.State() != StateTimeWait {
+		t.Fatalf("expected the connection to still be in TIME-WAIT, it is %s", conn.State())
+	}
+
+	clk.Advance(time.Second)
+	waitForState(t, conn, StateClosed)
+}
+
+func Test_TCP_OptionsRejectBadValues(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	testhelpers.FailTestIfErrorIsPresent(t, conn.SetKeepAlivePeriod(time.Minute))
+
+	if conn.SetKeepAlivePeriod(0) == nil || conn.SetUserTimeout(-time.Second) == nil || conn.SetTimeWait(-time.Second) == nil {
+		t.Errorf("expected negative and zero durations to be rejected")
+	}
+}
@@ -0,0 +1,211 @@
+package stack
+
+import (
+	"context"
+	"slices"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/tcp"
+)
+
+const (
+	// Like Linux's tcp_retries1: timeouts in a row after which the path is suspected of being a black hole for
+	// packets our size, rather than just losing them
+	tcpBlackHoleRetransmits = 3
+	// Like Linux's tcp_base_mss: where the search starts once a black hole is suspected. RFC 4821 7.2 suggests a
+	// starting point a little over 1000 bytes, which nearly every path carries.
+	tcpBaseMSS = 1024
+	// Like Linux's tcp_mtu_probe_floor: how far repeated black holes can shrink segments
+	tcpMinProbeMSS = 48
+	// Like Linux's tcp_probe_threshold: the search is over once what is known to get through and what is known
+	// not to are this close
+	tcpMTUProbeThreshold = 8
+	// Like Linux's tcp_probe_interval: how long after a search finishes the path is searched again, in case it
+	// has grown (RFC 4821 7.7)
+	tcpMTUProbeInterval = 10 * time.Minute
+)
+
+// tcpMTUProbe is packetization layer path MTU discovery (RFC 4821) for a connection. It starts once timeouts
+// suggest a black hole, where routers drop packets that are too big without saying so. Segments shrink to what is
+// likely to get through, then single larger segments probe for how large they can grow again.
+type tcpMTUProbe struct {
+	enabled bool
+	// The largest packet known to get through, and the largest that might (RFC 4821 7.2)
+	searchLow  int
+	searchHigh int
+	// When the last search finished
+	searched time.Time
+
+	// The probe in flight, if there is one: the sequence space it covers and the packet size it tests
+	inFlight bool
+	probeSeq uint32
+	probeEnd uint32
+	probeMTU int
+}
+
+// converged checks if the search is over
+func (p *tcpMTUProbe) converged() bool {
+	return p.searchHigh-p.searchLow < tcpMTUProbeThreshold
+}
+
+// pathMTUDecreased resends, without waiting for the retransmission timer, whatever in flight no longer fits the
+// path MTU a too-big message just lowered (RFC 1191 6.4). The message has to quote a sequence number that was
+// sent and not acknowledged yet, as one from the actual path would (RFC 5927 4.1). The segments are not taken as
+// lost to congestion, so the congestion window is left alone, like Linux's tcp_simple_retransmit.
+func (c *TCPConn) pathMTUDecreased(ctx context.Context, seq uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fields := []any{"local", c.id.local.String(), "remote", c.id.remote.String(), "seq", seq}
+
+	if !c.state.isSynchronized() || seqLT(seq, c.sndUna) || !seqLT(seq, c.sndNxt) {
+		trace.Annotate(ctx, trace.Dropped, "too big for a sequence number not in flight", fields...)
+		return
+	}
+
+	size := c.segmentSize()
+	resending := 0
+
+	for _, segment := range c.retransmitQueue {
+		if segment.length > size && !segment.sacked {
+			segment.lost = true
+			resending++
+		}
+	}
+
+	if resending == 0 {
+		return
+	}
+
+	trace.Annotate(ctx, trace.Delivered, "resending segments too big for the path MTU", append(fields, "segments", resending, "mss", size)...)
+
+	c.retransmitLost(ctx)
+}
+
+// resegment splits queued segments larger than segments can now be, so they are resent in pieces that fit. The
+// first piece stays the same entry, and the last keeps any FIN and PSH.
+func (c *TCPConn) resegment() {
+	size := c.segmentSize()
+
+	if !slices.ContainsFunc(c.retransmitQueue, func(s *tcpSentSegment) bool { return s.length > size }) {
+		return
+	}
+
+	queue := make([]*tcpSentSegment, 0, len(c.retransmitQueue))
+
+	for _, segment := range c.retransmitQueue {
+		queue = append(queue, segment)
+
+		for segment.length > size && !segment.flags.Has(tcp.FlagSYN) {
+			rest := *segment
+			rest.seq += uint32(size)
+			rest.length -= size
+
+			segment.length = size
+			segment.flags &^= tcp.FlagFIN | tcp.FlagPSH
+
+			segment = &rest
+			queue = append(queue, segment)
+		}
+	}
+
+	c.retransmitQueue = queue
+}
+
+// blackHoleSuspected shrinks segments after timeouts that went on long enough to suggest the path drops packets our
+// size without saying so (RFC 4821 7.6.3). The first time, they shrink to the base MSS, and each time after that to
+// half of what they were.
+func (c *TCPConn) blackHoleSuspected(ctx context.Context) {
+	p := &c.mtuProbe
+	mss := tcpBaseMSS
+
+	if p.enabled {
+		mss = max(min(tcpBaseMSS, c.mtuToMSS(p.searchLow)/2), tcpMinProbeMSS)
+	} else {
+		p.enabled = true
+		p.searchHigh = c.mssToMTU(c.pathMSS())
+	}
+
+	p.searchLow = c.mssToMTU(mss)
+	p.searched = c.stack.clock.Now()
+	p.inFlight = false
+
+	trace.Annotate(ctx, trace.Dropped, "timeouts suggest a path MTU black hole",
+		"remote", c.id.remote.String(), "retransmits", c.retransmits, "mss", c.segmentSize())
+}
+
+// mtuProbeSize is how much data the next segment should carry to probe for a larger path MTU, halfway between what
+// is known to get through and what might, or zero if no probe is due (RFC 4821 7.3). Once a search is over, the
+// next starts again from the path MTU after tcpMTUProbeInterval.
+func (c *TCPConn) mtuProbeSize() int {
+	p := &c.mtuProbe
+
+	if !p.enabled || p.inFlight || c.congestion.inRecovery {
+		return 0
+	}
+
+	if p.converged() && c.stack.clock.Now().Sub(p.searched) >= tcpMTUProbeInterval {
+		p.searchHigh = c.mssToMTU(c.pathMSS())
+		p.searched = c.stack.clock.Now()
+	}
+
+	// A router may have said the path is smaller since
+	p.searchHigh = min(p.searchHigh, c.mssToMTU(c.pathMSS()))
+
+	if p.converged() {
+		return 0
+	}
+
+	size := c.payloadSize(c.mtuToMSS((p.searchLow + p.searchHigh) / 2))
+	if size <= c.segmentSize() {
+		return 0
+	}
+
+	return size
+}
+
+// startMTUProbe records a probe of size bytes of data sent at seq
+func (c *TCPConn) startMTUProbe(ctx context.Context, seq uint32, size int) {
+	p := &c.mtuProbe
+
+	p.inFlight = true
+	p.probeSeq = seq
+	p.probeEnd = seq + uint32(size)
+	p.probeMTU = (p.searchLow + p.searchHigh) / 2
+
+	trace.Annotate(ctx, trace.Sent, "path MTU probe", "remote", c.id.remote.String(), "mtu", p.probeMTU, "len", size)
+}
+
+// mtuProbeAcknowledged grows segments to the size of a probe the peer has acknowledged (RFC 4821 7.6.1)
+func (c *TCPConn) mtuProbeAcknowledged(ack uint32) {
+	p := &c.mtuProbe
+
+	if !p.inFlight || seqLT(ack, p.probeEnd) {
+		return
+	}
+
+	p.inFlight = false
+	p.searchLow = p.probeMTU
+
+	if p.converged() {
+		p.searched = c.stack.clock.Now()
+	}
+}
+
+// mtuProbeLost stops the search going as high as a probe that had to be resent (RFC 4821 7.6.2). Segments go on at
+// the size already known to get through.
+func (c *TCPConn) mtuProbeLost(segment *tcpSentSegment) {
+	p := &c.mtuProbe
+
+	if !p.inFlight || seqLT(segment.seq, p.probeSeq) || !seqLT(segment.seq, p.probeEnd) {
+		return
+	}
+
+	p.inFlight = false
+	p.searchHigh = p.probeMTU - 1
+
+	if p.converged() {
+		p.searched = c.stack.clock.Now()
+	}
+}
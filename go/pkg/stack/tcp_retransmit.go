@@ -0,0 +1,292 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"networking/pkg/tcp"
+)
+
+const (
+	// RFC 6298 2.1 and 2.4
+	tcpInitialRTO = time.Second
+	tcpMinRTO     = time.Second
+	tcpMaxRTO     = 60 * time.Second
+	// RFC 6298 5.7: the RTO to start data transfer with when our SYN had to be retransmitted
+	tcpRTOAfterSYNTimeout = 3 * time.Second
+
+	// Like Linux's tcp_syn_retries and tcp_retries2
+	tcpMaxSYNRetransmits = 6
+	tcpMaxRetransmits    = 15
+)
+
+var ErrConnectionTimedOut = errors.New("connection timed out")
+
+// tcpRTTEstimator computes the retransmission timeout from round trip time samples (RFC 6298)
+type tcpRTTEstimator struct {
+	srtt    time.Duration
+	rttvar  time.Duration
+	rto     time.Duration
+	sampled bool
+}
+
+func newTCPRTTEstimator() tcpRTTEstimator {
+	return tcpRTTEstimator{rto: tcpInitialRTO}
+}
+
+// sample folds in a new measurement, which also undoes any backoff (RFC 6298 2.2 and 2.3)
+func (e *tcpRTTEstimator) sample(rtt time.Duration) {
+	if !e.sampled {
+		e.srtt = rtt
+		e.rttvar = rtt / 2
+		e.sampled = true
+	} else {
+		delta := e.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+
+		// alpha = 1/8, beta = 1/4
+		e.rttvar = (3*e.rttvar + delta) / 4
+		e.srtt = (7*e.srtt + rtt) / 8
+	}
+
+	e.rto = min(max(e.srtt+max(timerWheelGranularity, 4*e.rttvar), tcpMinRTO), tcpMaxRTO)
+}
+
+// backoff doubles the RTO after a timeout (RFC 6298 5.5)
+func (e *tcpRTTEstimator) backoff() {
+	e.rto = min(2*e.rto, tcpMaxRTO)
+}
+
+// tcpSentSegment is an entry in the retransmission queue: a segment that has been sent but not fully acknowledged.
+// Its data stays in the send buffer, so only where it starts and how long it is are kept.
+type tcpSentSegment struct {
+	seq    uint32
+	flags  tcp.Flags
+	length int
+	sentAt time.Time
+	// Karn's algorithm: the ACK for a retransmitted segment is ambiguous, so it is never used as an RTT sample
+	retransmitted bool
+	// Presumed lost and waiting to be resent
+	lost bool
+	// The peer has it, but something before it is missing (RFC 2018)
+	sacked bool
+}
+
+// end is the sequence number just after the segment, counting SYN and FIN
+func (s *tcpSentSegment) end() uint32 {
+	end := s.seq + uint32(s.length)
+
+	if s.flags.Has(tcp.FlagSYN) {
+		end++
+	}
+
+	if s.flags.Has(tcp.FlagFIN) {
+		end++
+	}
+
+	return end
+}
+
+// transmit sends a segment that takes up sequence space and puts it on the retransmission queue
+func (c *TCPConn) transmit(ctx context.Context, flags tcp.Flags, seq uint32, data []byte) {
+	c.retransmitQueue = append(c.retransmitQueue, &tcpSentSegment{
+		seq:    seq,
+		flags:  flags,
+		length: len(data),
+		sentAt: c.stack.clock.Now(),
+	})
+
+	c.sendSegment(ctx, flags, seq, data)
+
+	// RFC 6298 5.1
+	if !c.retransmitTimer.isPending() {
+		c.retransmitTimer.reset(c.rtt.rto)
+	}
+}
+
+// segmentData finds a queued segment's data in the send buffer
+func (c *TCPConn) segmentData(segment *tcpSentSegment) []byte {
+	if segment.length == 0 {
+		return nil
+	}
+
+	start := int(segment.seq - c.sendBufferSeq())
+
+	return c.sendBuffer[start : start+segment.length]
+}
+
+// sendBufferSeq is the sequence number of the first byte in the send buffer
+func (c *TCPConn) sendBufferSeq() uint32 {
+	if c.sndUna == c.iss {
+		return c.iss + 1
+	}
+
+	return c.sndUna
+}
+
+// retransmit resends the oldest unacknowledged segment
+func (c *TCPConn) retransmit(ctx context.Context) {
+	if len(c.retransmitQueue) == 0 {
+		return
+	}
+
+	c.resegment()
+
+	c.resend(ctx, c.retransmitQueue[0])
+}
+
+func (c *TCPConn) resend(ctx context.Context, segment *tcpSentSegment) {
+	c.mtuProbeLost(segment)
+
+	segment.retransmitted = true
+	segment.lost = false
+
+	c.stack.counters.TCP.RetransSegs.Inc()
+	c.resendSegment(ctx, segment.flags, segment.seq, c.segmentData(segment))
+}
+
+// retransmitLost resends segments presumed lost, oldest first, for as long as the congestion window has room
+func (c *TCPConn) retransmitLost(ctx context.Context) {
+	c.resegment()
+
+	pipe := c.pipe()
+
+	for _, segment := range c.retransmitQueue {
+		if !segment.lost || segment.sacked {
+			continue
+		}
+
+		size := int(segment.end() - segment.seq)
+		if pipe > 0 && pipe+size > c.congestion.cwnd {
+			return
+		}
+
+		c.resend(ctx, segment)
+		pipe += size
+
+		if seqLT(c.congestion.highRxt, segment.end()) {
+			c.congestion.highRxt = segment.end()
+		}
+	}
+}
+
+// acknowledgeQueue drops every segment ack covers from the retransmission queue, taking an RTT sample from the
+// echoed timestamp, or if there is none, from when the segments were sent if none of them were retransmitted.
+// Returns whether anything new was acknowledged.
+func (c *TCPConn) acknowledgeQueue(ack uint32) bool {
+	now := c.stack.clock.Now()
+	progress := false
+	ambiguous := false
+	var firstSentAt time.Time
+
+	for len(c.retransmitQueue) > 0 {
+		segment := c.retransmitQueue[0]
+
+		if seqLEQ(segment.end(), ack) {
+			c.retransmitQueue = c.retransmitQueue[1:]
+		} else if seqLT(segment.seq, ack) && segment.length > 0 {
+			// Partly acknowledged, which happens when the peer's window cut a segment short
+			trimmed := int(ack - segment.seq)
+			segment.seq = ack
+			segment.length -= trimmed
+		} else {
+			break
+		}
+
+		if !progress {
+			firstSentAt = segment.sentAt
+		}
+
+		progress = true
+		ambiguous = ambiguous || segment.retransmitted
+
+		if segment.flags.Has(tcp.FlagSYN) && segment.retransmitted && c.rtt.rto < tcpRTOAfterSYNTimeout {
+			c.rtt.rto = tcpRTOAfterSYNTimeout
+		}
+	}
+
+	if !progress {
+		return false
+	}
+
+	if rtt, ok := c.timestampRTT(); ok {
+		c.rtt.sample(rtt)
+	} else if !ambiguous {
+		c.rtt.sample(now.Sub(firstSentAt))
+	}
+
+	c.retransmits = 0
+
+	// RFC 6298 5.2 and 5.3
+	if len(c.retransmitQueue) == 0 {
+		c.retransmitTimer.stop()
+	} else {
+		c.retransmitTimer.reset(c.rtt.rto)
+	}
+
+	return true
+}
+
+// retransmitTimeout fires when the oldest segment has gone unacknowledged for a whole RTO (RFC 6298 5.4 to 5.6)
+func (c *TCPConn) retransmitTimeout() {
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Reset again since it fired, or everything was acknowledged in the meantime
+	if c.retransmitTimer.isPending() || len(c.retransmitQueue) == 0 || c.state == StateClosed {
+		return
+	}
+
+	limit := tcpMaxRetransmits
+	if !c.state.isSynchronized() {
+		limit = tcpMaxSYNRetransmits
+	}
+
+	c.retransmits++
+	if c.retransmitsTimedOut(limit) {
+		switch c.state {
+		case StateSynSent, StateSynReceived:
+			c.stack.counters.TCP.AttemptFails.Inc()
+		case StateEstablished, StateCloseWait:
+			c.stack.counters.TCP.EstabResets.Inc()
+		}
+
+		c.terminate(ctx, ErrConnectionTimedOut)
+
+		return
+	}
+
+	if c.retransmits > tcpBlackHoleRetransmits && c.state.isSynchronized() && !c.stack.options.DisableMTUProbing {
+		c.blackHoleSuspected(ctx)
+	}
+
+	c.congestionTimeout(c.pipe())
+
+	// Without SACK there is no telling what else got through, so everything after the oldest segment is presumed
+	// lost too (RFC 5681 3.1). Only the oldest goes now; the rest follow as the ACKs open the window again.
+	for _, segment := range c.retransmitQueue {
+		segment.lost = !segment.sacked
+	}
+
+	c.congestion.highRxt = c.sndUna
+
+	c.rtt.backoff()
+	c.retransmit(ctx)
+	c.retransmitTimer.reset(c.clampToUserTimeout(c.rtt.rto))
+}
+
+// retransmitsTimedOut checks if the connection should be given up on: once the oldest segment has gone
+// unacknowledged for the user timeout if there is one, or after limit retransmissions if not
+func (c *TCPConn) retransmitsTimedOut(limit int) bool {
+	if c.userTimeout > 0 {
+		return c.userTimedOut(c.retransmitQueue[0].sentAt)
+	}
+
+	return c.retransmits > limit
+}
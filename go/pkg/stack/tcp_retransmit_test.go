@@ -0,0 +1,239 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/link"
+	"networking/pkg/tcp"
+)
+
+func Test_RTTEstimator_FirstSample(t *testing.T) {
+	e := newTCPRTTEstimator()
+
+	e.sample(2 * time.Second)
+
+	// RTO = SRTT + 4 * RTTVAR = 2s + 4 * 1s
+	if e.srtt != 2*time.Second || e.rttvar != time.Second || e.rto != 6*time.Second {
+		t.Errorf("unexpected estimator after one sample: %+v", e)
+	}
+}
+
+func Test_RTTEstimator_LaterSamplesAreSmoothed(t *testing.T) {
+	e := newTCPRTTEstimator()
+
+	e.sample(800 * time.Millisecond)
+	e.sample(400 * time.Millisecond)
+
+	// RTTVAR = 3/4 * 400ms + 1/4 * |800ms - 400ms|, SRTT = 7/8 * 800ms + 1/8 * 400ms
+	if e.rttvar != 400*time.Millisecond || e.srtt != 750*time.Millisecond || e.rto != 2350*time.Millisecond {
+		t.Errorf("unexpected estimator after two samples: %+v", e)
+	}
+}
+
+func Test_RTTEstimator_RTOIsClamped(t *testing.T) {
+	e := newTCPRTTEstimator()
+
+	e.sample(time.Millisecond)
+	if e.rto != tcpMinRTO {
+		t.Errorf("expected the RTO to be rounded up to %s, got %s", tcpMinRTO, e.rto)
+	}
+
+	for range 10 {
+		e.backoff()
+	}
+
+	if e.rto != tcpMaxRTO {
+		t.Errorf("expected backoff to stop at %s, got %s", tcpMaxRTO, e.rto)
+	}
+}
+
+func Test_TCP_RetransmitsWithBackoffAndKarnsAlgorithm(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := established(p)
+
+	_, err := conn.Write([]byte("lost"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	original := p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	clk.Advance(900 * time.Millisecond)
+	p.expectNothing()
+
+	clk.Advance(100 * time.Millisecond)
+	first := p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	clk.Advance(1900 * time.Millisecond)
+	p.expectNothing()
+
+	clk.Advance(100 * time.Millisecond)
+	second := p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	for _, retransmission := range []*tcp.Segment{first, second} {
+		if retransmission.SequenceNumber != original.SequenceNumber || string(retransmission.Data) != "lost" {
+			t.Errorf("expected a copy of the original segment, got seq %d %q", retransmission.SequenceNumber, retransmission.Data)
+		}
+	}
+
+	conn.mu.Lock()
+	srttBefore := conn.rtt.srtt
+	conn.mu.Unlock()
+
+	clk.Advance(300 * time.Millisecond)
+	p.send(tcp.FlagACK, "")
+	waitForCounter(t, p.stack, "tcpRetransSegs", 2)
+
+	var srtt, rto time.Duration
+
+	waitFor(t, "the ACK to empty the retransmission queue", func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		srtt, rto = conn.rtt.srtt, conn.rtt.rto
+		return len(conn.retransmitQueue) == 0
+	})
+
+	if srtt != srttBefore || rto != 4*time.Second {
+		t.Errorf("expected no RTT sample from a retransmitted segment and the RTO to stay backed off, got srtt %s and rto %s", srtt, rto)
+	}
+}
+
+func Test_TCP_SYNRetransmitsThenTimesOut(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+
+	_, done := synSent(p)
+
+	for range tcpMaxSYNRetransmits {
+		clk.Advance(tcpMaxRTO)
+		p.expect(tcp.FlagSYN)
+	}
+
+	clk.Advance(tcpMaxRTO)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrConnectionTimedOut) {
+			t.Errorf("expected ErrConnectionTimedOut, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the dial to give up")
+	}
+
+	waitForCounter(t, p.stack, "tcpRetransSegs", tcpMaxSYNRetransmits)
+	waitForCounter(t, p.stack, "tcpAttemptFails", 1)
+}
+
+func Test_TCP_RTOIsThreeSecondsAfterSYNTimeout(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+
+	conn, _ := synSent(p)
+	clk.Advance(time.Second)
+	p.expect(tcp.FlagSYN)
+
+	p.send(tcp.FlagSYN|tcp.FlagACK, "")
+	p.expect(tcp.FlagACK)
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.rtt.rto != tcpRTOAfterSYNTimeout {
+		t.Errorf("expected the RTO to be reset to %s, got %s", tcpRTOAfterSYNTimeout, conn.rtt.rto)
+	}
+}
+
+// Test_TCP_BulkTransferOverLossyLink moves data between two stacks over a link that drops packets both ways,
+// with the clock driven by hand so every retransmission timeout is deterministic
+func Test_TCP_BulkTransferOverLossyLink(t *testing.T) {
+	a, _ := transferOverLossyLink(t, Options{}, link.DropRandomly(0.05, 1), link.DropRandomly(0.05, 2), func(*TCPConn) {})
+
+	if retransmitted, _ := a.Metrics().Snapshot().Get("tcpRetransSegs"); retransmitted == 0 {
+		t.Errorf("expected the sender to retransmit")
+	}
+}
+
+// transferOverLossyLink sends 100KB between two stacks made with options, over a link that drops what toB and toA
+// pick. configure gets the sending connection before anything is written. Returns both stacks once the data is through.
+func transferOverLossyLink(t *testing.T, options Options, toB, toA func(packet []byte) bool, configure func(*TCPConn)) (*Stack, *Stack) {
+	t.Helper()
+
+	clk := clock.NewFake(time.Unix(0, 0))
+	ctx := logger.NewMockLogger().WithLogger(context.Background())
+
+	pipeA, pipeB := link.NewPipe(link.IP, 1500)
+	lossyA := link.NewLossy(pipeA, toB)
+	lossyB := link.NewLossy(pipeB, toA)
+
+	options.Clock = clk
+	a := New(ctx, options)
+	b := New(ctx, options)
+	t.Cleanup(func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+
+	_, err := a.AddInterface("a0", lossyA, addressA)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	_, err = b.AddInterface("b0", lossyB, addressB)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	listener, err := b.ListenTCP(netip.AddrPortFrom(addressB.Addr(), 9000))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	payload := bytes.Repeat([]byte("lossy links lose packets "), 4000)
+	received := make(chan []byte, 1)
+
+	go func() {
+		server, err := listener.AcceptTCP()
+		if err != nil {
+			received <- nil
+			return
+		}
+
+		data, _ := io.ReadAll(server)
+		received <- data
+	}()
+
+	go func() {
+		client, err := a.DialTCP(context.Background(), netip.AddrPort{}, netip.AddrPortFrom(addressB.Addr(), 9000))
+		if err != nil {
+			return
+		}
+
+		configure(client)
+		_, _ = client.Write(payload)
+		_ = client.Close()
+	}()
+
+	for range 20000 {
+		select {
+		case data := <-received:
+			if !bytes.Equal(data, payload) {
+				t.Fatalf("expected %d bytes to arrive intact, got %d", len(payload), len(data))
+			}
+
+			if lossyA.Dropped()+lossyB.Dropped() == 0 {
+				t.Errorf("expected the link to drop something")
+			}
+
+			return a, b
+		default:
+		}
+
+		clk.Advance(50 * time.Millisecond)
+		time.Sleep(200 * time.Microsecond)
+	}
+
+	t.Fatalf("transfer did not complete")
+
+	return nil, nil
+}
@@ -0,0 +1,228 @@
+package stack
+
+import (
+	"context"
+
+	"networking/internal/trace"
+	"networking/pkg/tcp"
+)
+
+const (
+	// RFC 2018 3: four blocks fill the option space, or three once timestamps take their share
+	tcpMaxSACKBlocks = 4
+	// RFC 6675 2: how many segments have to be SACKed above a hole before it is presumed lost
+	tcpDupThresh = 3
+)
+
+// tcpOutOfOrderSegment is data that arrived ahead of RCV.NXT, held until the hole before it is filled
+type tcpOutOfOrderSegment struct {
+	seq  uint32
+	data []byte
+}
+
+func (s *tcpOutOfOrderSegment) end() uint32 {
+	return s.seq + uint32(len(s.data))
+}
+
+// queueOutOfOrder holds on to data beyond a hole, so only the hole has to be resent. seq is after RCV.NXT,
+// and data has already been trimmed to the window.
+func (c *TCPConn) queueOutOfOrder(seq uint32, data []byte) {
+	i := 0
+	for i < len(c.outOfOrder) && seqLT(c.outOfOrder[i].seq, seq) {
+		i++
+	}
+
+	// Copied, since the segment's buffer belongs to the link
+	segment := &tcpOutOfOrderSegment{seq: seq, data: append([]byte(nil), data...)}
+	c.outOfOrder = append(c.outOfOrder[:i], append([]*tcpOutOfOrderSegment{segment}, c.outOfOrder[i:]...)...)
+
+	// RFC 2018 4: the block with the latest segment in it is reported first
+	recent := []uint32{seq}
+	for _, other := range c.recentlyReceived {
+		if other != seq && len(recent) < 2*tcpMaxSACKBlocks {
+			recent = append(recent, other)
+		}
+	}
+
+	c.recentlyReceived = recent
+}
+
+// reassemble moves whatever the out of order queue has at RCV.NXT onto the receive buffer
+func (c *TCPConn) reassemble() int {
+	moved := 0
+
+	for len(c.outOfOrder) > 0 {
+		segment := c.outOfOrder[0]
+
+		if seqLT(c.rcvNxt, segment.seq) {
+			break
+		}
+
+		c.outOfOrder = c.outOfOrder[1:]
+
+		if seqLT(c.rcvNxt, segment.end()) {
+			data := segment.data[c.rcvNxt-segment.seq:]
+			c.receiveBuffer = append(c.receiveBuffer, data...)
+			c.rcvNxt += uint32(len(data))
+			moved += len(data)
+		}
+	}
+
+	return moved
+}
+
+// sackBlocks describes the out of order queue for an ACK, most recently changed block first (RFC 2018 4)
+func (c *TCPConn) sackBlocks() []tcp.SACKBlock {
+	all := []tcp.SACKBlock{}
+
+	for _, segment := range c.outOfOrder {
+		if last := len(all) - 1; last >= 0 && seqLEQ(segment.seq, all[last].Right) {
+			if seqGT(segment.end(), all[last].Right) {
+				all[last].Right = segment.end()
+			}
+
+			continue
+		}
+
+		all = append(all, tcp.SACKBlock{Left: segment.seq, Right: segment.end()})
+	}
+
+	limit := tcpMaxSACKBlocks
+	if c.timestamps {
+		limit--
+	}
+
+	blocks := []tcp.SACKBlock{}
+	reported := map[int]bool{}
+	report := func(i int) {
+		if !reported[i] && len(blocks) < limit {
+			reported[i] = true
+			blocks = append(blocks, all[i])
+		}
+	}
+
+	for _, seq := range c.recentlyReceived {
+		for i, block := range all {
+			if seqLEQ(block.Left, seq) && seqLT(seq, block.Right) {
+				report(i)
+			}
+		}
+	}
+
+	for i := range all {
+		report(i)
+	}
+
+	return blocks
+}
+
+// updateScoreboard marks the segments the peer says it has (RFC 6675 4 and 5). A segment only counts once
+// a block covers all of it. Returns whether anything was newly SACKed.
+func (c *TCPConn) updateScoreboard(blocks []tcp.SACKBlock) bool {
+	newlySACKed := false
+
+	for _, block := range blocks {
+		// Blocks that are not for data in flight are either stale or invalid (RFC 2883 and RFC 5961 5)
+		if !seqLT(block.Left, block.Right) || seqLT(block.Left, c.sndUna) || seqGT(block.Right, c.sndNxt) {
+			continue
+		}
+
+		for _, segment := range c.retransmitQueue {
+			if !segment.sacked && seqLEQ(block.Left, segment.seq) && seqLEQ(segment.end(), block.Right) {
+				segment.sacked = true
+				segment.lost = false
+				newlySACKed = true
+			}
+		}
+	}
+
+	return newlySACKed
+}
+
+// markLost runs IsLost over the scoreboard (RFC 6675 4): a hole is lost once DupThresh segments, or more than
+// (DupThresh - 1) * SMSS bytes, are SACKed above it. Holes already resent in this recovery are left alone.
+func (c *TCPConn) markLost() {
+	sackedSegments := 0
+	sackedBytes := 0
+
+	for i := len(c.retransmitQueue) - 1; i >= 0; i-- {
+		segment := c.retransmitQueue[i]
+
+		if segment.sacked {
+			sackedSegments++
+			sackedBytes += segment.length
+			continue
+		}
+
+		if seqLT(segment.seq, c.congestion.highRxt) {
+			continue
+		}
+
+		if sackedSegments >= tcpDupThresh || sackedBytes > (tcpDupThresh-1)*c.segmentSize() {
+			segment.lost = true
+		}
+	}
+}
+
+// sackACKArrives is loss recovery for connections that negotiated SACK (RFC 6675 5). Unlike NewReno, which can
+// only find one hole per round trip, the scoreboard shows every hole at once, and the pipe estimate decides
+// when to fill them. acked is how much the ACK newly acknowledged cumulatively.
+func (c *TCPConn) sackACKArrives(ctx context.Context, segment *tcp.Segment, acked int) {
+	cc := &c.congestion
+	now := c.stack.clock.Now()
+	ack := segment.AcknowledgmentNumber
+
+	newlySACKed := c.updateScoreboard(segment.SACKBlocks())
+
+	switch {
+	case acked > 0:
+		cc.duplicateACKs = 0
+	case newlySACKed:
+		// RFC 6675 2: with SACK, a duplicate is an ACK that brings news of data arriving out of order
+		cc.duplicateACKs++
+	}
+
+	c.markLost()
+
+	if cc.inRecovery {
+		if seqLEQ(cc.recover, ack) {
+			// RFC 6675 5 step 2: cwnd has been at ssthresh all along, so it stays where it is
+			cc.inRecovery = false
+			cc.record(now, CongestionRecovered)
+
+			trace.Annotate(ctx, trace.Delivered, "SACK recovery complete", "cwnd", cc.cwnd)
+		} else if acked > 0 {
+			cc.record(now, CongestionPartialACK)
+		}
+
+		return
+	}
+
+	if acked > 0 {
+		cc.algorithm.onAck(cc, acked, now, c.rtt.srtt)
+		cc.record(now, CongestionACK)
+	}
+
+	if len(c.retransmitQueue) == 0 || !seqGT(ack-1, cc.recover) {
+		return
+	}
+
+	head := c.retransmitQueue[0]
+	if cc.duplicateACKs < tcpDupThresh && !head.lost {
+		return
+	}
+
+	trace.Annotate(ctx, trace.Delivered, "SACK shows loss, starting recovery", "ack", ack)
+
+	// RFC 6675 5 step 4
+	cc.algorithm.onCongestion(cc, int(c.sndNxt-c.sndUna), now)
+	cc.cwnd = cc.ssthresh
+	cc.recover = c.sndNxt
+	cc.inRecovery = true
+	cc.highRxt = c.sndUna
+
+	c.retransmit(ctx)
+	cc.highRxt = head.end()
+
+	cc.record(now, CongestionFastRetransmit)
+}
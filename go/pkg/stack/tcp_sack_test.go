@@ -0,0 +1,281 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/ipv4"
+	"networking/pkg/tcp"
+)
+
+// establishedWithSACK completes a passive open with a peer that offers SACK
+func establishedWithSACK(p *tcpPeer) *TCPConn {
+	p.t.Helper()
+
+	p.sackPermitted = true
+	conn := established(p)
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if !conn.sackPermitted {
+		p.t.Fatalf("expected SACK to be negotiated")
+	}
+
+	return conn
+}
+
+func Test_TCP_SACKIsOnlyOfferedBackToPeersThatOfferIt(t *testing.T) {
+	tests := []struct {
+		name          string
+		peerOffers    bool
+		disableSACK   bool
+		expectOffered bool
+	}{
+		{name: "peer offers", peerOffers: true, expectOffered: true},
+		{name: "peer does not offer", peerOffers: false, expectOffered: false},
+		{name: "disabled on the stack", peerOffers: true, disableSACK: true, expectOffered: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTCPPeer(t)
+			p.sackPermitted = test.peerOffers
+			p.stack.options.DisableSACK = test.disableSACK
+
+			_, err := p.stack.ListenTCP(p.remote)
+			testhelpers.FailTestIfErrorIsPresent(t, err)
+
+			p.send(tcp.FlagSYN, "")
+			synACK := p.expect(tcp.FlagSYN | tcp.FlagACK)
+
+			if synACK.SACKPermitted() != test.expectOffered {
+				t.Errorf("expected SACK-permitted %v in the SYN-ACK, got %v", test.expectOffered, synACK.SACKPermitted())
+			}
+		})
+	}
+}
+
+func Test_TCP_DialOffersSACK(t *testing.T) {
+	p := newTCPPeer(t)
+
+	synSent(p)
+
+	conn := p.stack.tcp.lookupConnection(tcpConnectionID{local: p.remote, remote: p.local})
+	conn.mu.Lock()
+	syn := conn.buildSegment(tcp.FlagSYN, conn.iss, nil)
+	conn.mu.Unlock()
+
+	if !syn.SACKPermitted() {
+		t.Errorf("expected the SYN to offer SACK")
+	}
+}
+
+func Test_TCP_ReceiverReportsOutOfOrderBlocks(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := establishedWithSACK(p)
+	base := p.seq
+
+	block := func(from, to uint32) tcp.SACKBlock {
+		return tcp.SACKBlock{Left: base + from, Right: base + to}
+	}
+
+	steps := []struct {
+		offset   uint32
+		data     string
+		expected []tcp.SACKBlock
+	}{
+		{offset: 10, data: "bbbbb", expected: []tcp.SACKBlock{block(10, 15)}},
+		// The block with the latest segment always comes first
+		{offset: 20, data: "ddddd", expected: []tcp.SACKBlock{block(20, 25), block(10, 15)}},
+		{offset: 30, data: "fffff", expected: []tcp.SACKBlock{block(30, 35), block(20, 25), block(10, 15)}},
+		// Filling the gap between two blocks merges them
+		{offset: 15, data: "ccccc", expected: []tcp.SACKBlock{block(10, 25), block(30, 35)}},
+		// Filling the hole at the front moves everything up to the next hole in order
+		{offset: 0, data: "aaaaaaaaaa", expected: []tcp.SACKBlock{block(30, 35)}},
+		{offset: 25, data: "eeeee", expected: nil},
+	}
+
+	for _, step := range steps {
+		p.sendAt(tcp.FlagACK, base+step.offset, p.ack, step.data)
+		ack := p.expect(tcp.FlagACK)
+
+		if blocks := ack.SACKBlocks(); !slices.Equal(blocks, step.expected) {
+			t.Errorf("after the data at %d, expected SACK blocks %v, got %v", step.offset, step.expected, blocks)
+		}
+	}
+
+	data := make([]byte, 100)
+	n, err := conn.Read(data)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if string(data[:n]) != "aaaaaaaaaabbbbbcccccdddddeeeeefffff" {
+		t.Errorf("expected everything in order, got %q", data[:n])
+	}
+}
+
+func Test_TCP_SACKRecoveryResendsEveryHoleAtOnce(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := establishedWithSACK(p)
+	mss := uint32(tcpDefaultMSS)
+
+	_, err := conn.Write(bytes.Repeat([]byte("x"), 12*tcpDefaultMSS))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	// Acknowledging the initial window of four segments one by one doubles it, so the other eight go out
+	initial := []*tcp.Segment{}
+	for range 4 {
+		initial = append(initial, p.expect(tcp.FlagACK))
+	}
+
+	for _, segment := range initial {
+		p.sendAt(tcp.FlagACK, p.seq, segment.SequenceNumber+mss, "")
+	}
+
+	for range 7 {
+		p.expect(tcp.FlagACK)
+	}
+
+	p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	start := p.ack - 8*mss
+	at := func(i uint32) uint32 { return start + i*mss }
+
+	// The first and third of the eight are lost, and each of the others draws a duplicate ACK with SACK blocks
+	sacks := [][]tcp.SACKBlock{
+		{{Left: at(1), Right: at(2)}},
+		{{Left: at(3), Right: at(4)}, {Left: at(1), Right: at(2)}},
+		{{Left: at(3), Right: at(5)}, {Left: at(1), Right: at(2)}},
+		{{Left: at(3), Right: at(6)}, {Left: at(1), Right: at(2)}},
+	}
+
+	for _, blocks := range sacks {
+		p.sendWithOptions(tcp.FlagACK, p.seq, start, "", tcp.NewSACKOption(blocks...))
+	}
+
+	resent := []uint32{}
+	for range 2 {
+		resent = append(resent, p.expect(tcp.FlagACK).SequenceNumber)
+	}
+
+	p.expectNothing()
+
+	if !slices.Equal(resent, []uint32{at(0), at(2)}) {
+		t.Errorf("expected both holes to be resent without waiting for a timeout, got %v", resent)
+	}
+
+	waitForCounter(t, p.stack, "tcpRetransSegs", 2)
+
+	p.sendAt(tcp.FlagACK, p.seq, at(8), "")
+
+	var cwnd, ssthresh int
+
+	waitFor(t, "the cumulative ACK to end recovery", func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		cwnd, ssthresh = conn.congestion.cwnd, conn.congestion.ssthresh
+		return !conn.congestion.inRecovery
+	})
+
+	if cwnd != ssthresh || ssthresh != 4*tcpDefaultMSS {
+		t.Errorf("expected cwnd to finish at ssthresh of half the flight, got %d and %d", cwnd, ssthresh)
+	}
+}
+
+func Test_TCP_SACKedSegmentsAreNotResentAfterATimeout(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, clk)
+	conn := establishedWithSACK(p)
+	mss := uint32(tcpDefaultMSS)
+
+	_, err := conn.Write(bytes.Repeat([]byte("x"), 4*tcpDefaultMSS))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	first := p.expect(tcp.FlagACK)
+	p.expect(tcp.FlagACK)
+	p.expect(tcp.FlagACK)
+	p.expect(tcp.FlagACK | tcp.FlagPSH)
+
+	// Too few duplicates to start recovery, so it takes a timeout
+	p.sendWithOptions(tcp.FlagACK, p.seq, first.SequenceNumber, "", tcp.NewSACKOption(tcp.SACKBlock{
+		Left:  first.SequenceNumber + mss,
+		Right: first.SequenceNumber + 3*mss,
+	}))
+
+	clk.Advance(tcpInitialRTO)
+	p.expect(tcp.FlagACK)
+
+	// Once the first is through, only the fourth is still missing
+	p.sendWithOptions(tcp.FlagACK, p.seq, first.SequenceNumber+mss, "", tcp.NewSACKOption(tcp.SACKBlock{
+		Left:  first.SequenceNumber + mss,
+		Right: first.SequenceNumber + 3*mss,
+	}))
+
+	if resent := p.expect(tcp.FlagACK | tcp.FlagPSH); resent.SequenceNumber != first.SequenceNumber+3*mss {
+		t.Errorf("expected the unSACKed fourth segment next, got seq %d", resent.SequenceNumber)
+	}
+
+	p.expectNothing()
+	waitForCounter(t, p.stack, "tcpRetransSegs", 2)
+}
+
+// dropDataSegments drops the first transmission of the data segments numbered in which, counting from one
+func dropDataSegments(which ...int) func(packet []byte) bool {
+	seen := map[uint32]bool{}
+
+	return func(raw []byte) bool {
+		packet, err := ipv4.ParseRawPacket(context.TODO(), raw)
+		if err != nil || packet.Protocol != ipv4.ProtocolTCP {
+			return false
+		}
+
+		segment, err := tcp.ParseRawSegment(context.TODO(), packet.Payload, packet.Source, packet.Destination)
+		if err != nil || len(segment.Data) == 0 || seen[segment.SequenceNumber] {
+			return false
+		}
+
+		seen[segment.SequenceNumber] = true
+
+		return slices.Contains(which, len(seen))
+	}
+}
+
+// Several holes in one window should cost one fast retransmit and a resend of each hole, and nothing more. NewReno
+// finds the holes one partial ACK at a time; SACK marks each lost as soon as enough is SACKed above it.
+func Test_TCP_SeveralHolesInAWindowAreResentWithoutATimeout(t *testing.T) {
+	for _, disableSACK := range []bool{true, false} {
+		t.Run(fmt.Sprintf("SACK disabled %v", disableSACK), func(t *testing.T) {
+			traces := make(chan *CongestionTrace, 1)
+
+			a, _ := transferOverLossyLink(t, Options{DisableSACK: disableSACK}, dropDataSegments(20, 22, 24, 26), nil, func(conn *TCPConn) {
+				traces <- conn.TraceCongestion()
+			})
+
+			events := map[CongestionEvent]int{}
+			for _, sample := range (<-traces).Samples() {
+				events[sample.Event]++
+			}
+
+			if retransmitted, _ := a.Metrics().Snapshot().Get("tcpRetransSegs"); retransmitted != 4 {
+				t.Errorf("expected just the four holes to be resent, got %d retransmissions", retransmitted)
+			}
+
+			if events[CongestionFastRetransmit] != 1 || events[CongestionTimeout] != 0 {
+				t.Errorf("expected a single fast retransmit and no timeouts, got %v", events)
+			}
+
+			// NewReno resends each hole after the partial ACK for the one before
+			if disableSACK && events[CongestionPartialACK] != 3 {
+				t.Errorf("expected NewReno to need three partial ACKs, got %v", events)
+			}
+		})
+	}
+}
@@ -0,0 +1,297 @@
+package stack
+
+import (
+	"context"
+	"net/netip"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/tcp"
+)
+
+const (
+	// Like Linux, the top 8 bits of a cookie count minutes, and the low 24 carry a keyed hash plus the MSS
+	synCookieCountBits = 24
+	synCookieDataMask  = 1<<synCookieCountBits - 1
+	synCookieInterval  = time.Minute
+	// A cookie is good for the minute it was made in and the next, so it lasts at least a minute
+	synCookieMaxAge = 2
+
+	// With timestamps, the low bits of the TSval in a cookie SYN-ACK remember the peer's window scale and
+	// SACK-permitted, which the ISN has no room for (Linux's cookie_init_timestamp)
+	synCookieTSWindowScaleMask = 0x0F
+	synCookieTSNoWindowScale   = 0x0F
+	synCookieTSSACK            = 0x10
+	synCookieTSMask            = 0x3F
+
+	// Each source can start this many handshakes a second, in bursts of up to tcpHalfOpenBurst, before the
+	// rest of its SYNs only get cookies
+	tcpHalfOpenRate  = 16
+	tcpHalfOpenBurst = 32
+	// Past this many sources, buckets that have filled back up are forgotten
+	tcpHalfOpenMaxSources = 1024
+)
+
+// synCookieMSS are the MSS values a cookie can remember, from Linux's msstab. The peer's MSS is rounded
+// down to one of them.
+var synCookieMSS = []int{536, 1300, 1440, 1460}
+
+// synCookieCount is the minute counter a cookie made at now carries
+func synCookieCount(now time.Time) uint32 {
+	return uint32(now.Unix() / int64(synCookieInterval/time.Second))
+}
+
+// makeSYNCookie is the ISN for a SYN-ACK that keeps no state (RFC 4987 3.6). Only the stack can make one,
+// and it is tied to the connection and the peer's ISN, so an ACK that echoes it proves the peer got the SYN-ACK.
+func (s *Stack) makeSYNCookie(id tcpConnectionID, peerISN uint32, mssIndex int, now time.Time) uint32 {
+	count := synCookieCount(now)
+
+	return s.tcpHash(id, tcpHashSYNCookieTuple) + peerISN + count<<synCookieCountBits +
+		(s.tcpHash(id, tcpHashSYNCookieCount, count)+uint32(mssIndex))&synCookieDataMask
+}
+
+// checkSYNCookie finds the MSS a cookie was made with, if it is one of ours and has not expired
+func (s *Stack) checkSYNCookie(id tcpConnectionID, peerISN, cookie uint32, now time.Time) (int, bool) {
+	cookie -= s.tcpHash(id, tcpHashSYNCookieTuple) + peerISN
+
+	// The count only has 8 bits, so the age is taken modulo 256 minutes
+	count := synCookieCount(now)
+	age := (count - cookie>>synCookieCountBits) & (1<<(32-synCookieCountBits) - 1)
+
+	if age >= synCookieMaxAge {
+		return 0, false
+	}
+
+	mssIndex := int((cookie - s.tcpHash(id, tcpHashSYNCookieCount, count-age)) & synCookieDataMask)
+	if mssIndex >= len(synCookieMSS) {
+		return 0, false
+	}
+
+	return synCookieMSS[mssIndex], true
+}
+
+// synCookieTimestamp is the TSval for a cookie SYN-ACK: the connection's timestamp clock, with the low bits
+// replaced by the options to remember and moved back if that put it in the future
+func (s *Stack) synCookieTimestamp(id tcpConnectionID, syn *tcp.Segment, now time.Time) uint32 {
+	options := uint32(synCookieTSNoWindowScale)
+	if shift, ok := syn.WindowScale(); ok {
+		options = uint32(shift)
+	}
+
+	if syn.SACKPermitted() && !s.options.DisableSACK {
+		options |= synCookieTSSACK
+	}
+
+	clock := uint32(now.UnixMilli()) + s.tcpTimestampOffset(id)
+	ts := clock&^synCookieTSMask | options
+
+	if seqGT(ts, clock) {
+		ts -= synCookieTSMask + 1
+	}
+
+	return ts
+}
+
+// sendSYNCookie answers a SYN without keeping anything about it (RFC 4987 3.6). Without timestamps only the MSS
+// survives, so the SYN-ACK offers neither window scaling nor SACK.
+func (l *TCPListener) sendSYNCookie(ctx context.Context, id tcpConnectionID, syn *tcp.Segment) {
+	s := l.stack
+	now := s.clock.Now()
+
+	peerMSS := tcpDefaultMSS
+	if mss, ok := syn.MSS(); ok {
+		peerMSS = int(mss)
+	}
+
+	mssIndex := 0
+	for i, mss := range synCookieMSS {
+		if mss <= peerMSS {
+			mssIndex = i
+		}
+	}
+
+	segment := &tcp.Segment{
+		SequenceNumber:       s.makeSYNCookie(id, syn.SequenceNumber, mssIndex, now),
+		AcknowledgmentNumber: syn.SequenceNumber + 1,
+		Flags:                tcp.FlagSYN | tcp.FlagACK,
+		Window:               uint16(min(tcpReceiveBufferSize, 0xFFFF)),
+		Options:              []tcp.Option{tcp.NewMSSOption(uint16(s.tcpMSS(id.remote.Addr())))},
+	}
+
+	if tsVal, _, ok := syn.Timestamps(); ok {
+		if _, ok := syn.WindowScale(); ok {
+			segment.Options = append(segment.Options, tcp.NewWindowScaleOption(windowShiftFor(tcpReceiveBufferSize)))
+		}
+
+		if syn.SACKPermitted() && !s.options.DisableSACK {
+			segment.Options = append(segment.Options, tcp.NewSACKPermittedOption())
+		}
+
+		segment.Options = append(segment.Options, tcp.NewTimestampsOption(s.synCookieTimestamp(id, syn, now), tsVal))
+	}
+
+	l.mu.Lock()
+	l.lastCookieSent = now
+	l.mu.Unlock()
+
+	trace.Annotate(ctx, trace.Delivered, "half-open queue full, answering with a SYN cookie", "remote", id.remote.String())
+	_ = s.sendTCP(ctx, id, segment)
+}
+
+// synCookieACKArrives checks if an ACK with no connection completes a handshake we answered with a cookie, and
+// if it does, sets up the connection from it. Returns whether it did.
+func (l *TCPListener) synCookieACKArrives(ctx context.Context, id tcpConnectionID, segment *tcp.Segment) bool {
+	s := l.stack
+	now := s.clock.Now()
+
+	l.mu.Lock()
+	recent := now.Sub(l.lastCookieSent) < synCookieMaxAge*synCookieInterval && !l.lastCookieSent.IsZero()
+	l.mu.Unlock()
+
+	// Only during a flood, so ACKs guessing at cookies have a short window to guess in
+	if !recent || segment.Flags.Has(tcp.FlagSYN) {
+		return false
+	}
+
+	mss, ok := s.checkSYNCookie(id, segment.SequenceNumber-1, segment.AcknowledgmentNumber-1, now)
+	if !ok {
+		trace.Annotate(ctx, trace.Dropped, "ACK is not for a valid SYN cookie", "remote", id.remote.String())
+		return false
+	}
+
+	// Like Linux, a full accept queue drops the ACK rather than resetting, and the peer's next segment tries again
+	if len(l.accept) == cap(l.accept) {
+		trace.Annotate(ctx, trace.Dropped, "accept queue full", "remote", id.remote.String())
+		return true
+	}
+
+	conn := newTCPConn(s, id)
+	conn.listener = l
+
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if _, err := s.tcp.connect(id, conn); err != nil {
+		trace.Annotate(ctx, trace.Dropped, "connection already exists", "remote", id.remote.String())
+		return true
+	}
+
+	trace.Annotate(ctx, trace.Delivered, "SYN cookie accepted", "remote", id.remote.String(), "mss", mss)
+
+	conn.openFromSYNCookie(ctx, segment, mss)
+	conn.synchronizedSegmentArrives(ctx, segment)
+
+	return true
+}
+
+// openFromSYNCookie puts back what openPassive would have set up, from the ACK that returned a cookie.
+// The connection is left in SYN-RECEIVED, for the ACK to complete the handshake as usual.
+func (c *TCPConn) openFromSYNCookie(ctx context.Context, ack *tcp.Segment, mss int) {
+	c.irs = ack.SequenceNumber - 1
+	c.rcvNxt = ack.SequenceNumber
+	c.iss = ack.AcknowledgmentNumber - 1
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sndMSS = min(mss, c.stack.tcpMSS(c.id.remote.Addr()))
+	c.tsOffset = c.stack.tcpTimestampOffset(c.id)
+	c.rcvWndShift = 0
+
+	if tsVal, tsEcr, ok := ack.Timestamps(); ok {
+		c.timestamps = true
+		c.tsRecent = tsVal
+		c.tsRecentAge = c.stack.clock.Now()
+
+		if shift := tsEcr & synCookieTSWindowScaleMask; shift != synCookieTSNoWindowScale {
+			c.windowScaling = true
+			c.sndWndShift = min(uint8(shift), tcp.MaxWindowScale)
+			c.rcvWndShift = windowShiftFor(tcpReceiveBufferSize)
+		}
+
+		c.sackPermitted = tsEcr&synCookieTSSACK != 0
+	}
+
+	// As the SYN-ACK left it: advertising up to 64KiB, and sent only the once
+	c.rcvAdv = c.rcvNxt + min(c.receiveWindow(), 0xFFFF)
+	c.retransmitQueue = []*tcpSentSegment{{
+		seq:           c.iss,
+		flags:         tcp.FlagSYN | tcp.FlagACK,
+		sentAt:        c.stack.clock.Now(),
+		retransmitted: true,
+	}}
+
+	c.setState(ctx, StateSynReceived)
+	c.stack.counters.TCP.PassiveOpens.Inc()
+}
+
+// tcpTokenBucket limits how fast something can happen, allowing bursts up to its size
+type tcpTokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill tops the bucket up for the time since it was last used
+func (b *tcpTokenBucket) refill(now time.Time, rate, burst float64) {
+	b.tokens = min(b.tokens+now.Sub(b.updated).Seconds()*rate, burst)
+	b.updated = now
+}
+
+// admitHalfOpen decides if a SYN from source gets a connection of its own. It is refused once the half-open
+// queue is full, or once source has started more handshakes than its share.
+func (l *TCPListener) admitHalfOpen(ctx context.Context, source netip.Addr) bool {
+	now := l.stack.clock.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.halfOpen >= l.maxHalfOpen {
+		trace.Annotate(ctx, trace.Dropped, "half-open queue full", "half_open", l.halfOpen)
+		return false
+	}
+
+	bucket, ok := l.sources[source]
+	if !ok {
+		if len(l.sources) >= tcpHalfOpenMaxSources {
+			l.forgetIdleSources(now)
+		}
+
+		bucket = &tcpTokenBucket{tokens: tcpHalfOpenBurst, updated: now}
+		l.sources[source] = bucket
+	}
+
+	bucket.refill(now, tcpHalfOpenRate, tcpHalfOpenBurst)
+
+	if bucket.tokens < 1 {
+		trace.Annotate(ctx, trace.Dropped, "source is starting handshakes too fast", "source", source.String())
+		return false
+	}
+
+	bucket.tokens--
+	l.halfOpen++
+
+	return true
+}
+
+// forgetIdleSources drops the buckets that have filled back up, which are no different from new ones
+func (l *TCPListener) forgetIdleSources(now time.Time) {
+	for source, bucket := range l.sources {
+		if bucket.refill(now, tcpHalfOpenRate, tcpHalfOpenBurst); bucket.tokens >= tcpHalfOpenBurst {
+			delete(l.sources, source)
+		}
+	}
+}
+
+// releaseHalfOpen is for when a connection admitHalfOpen let in leaves SYN-RECEIVED
+func (l *TCPListener) releaseHalfOpen() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.halfOpen--
+}
+
+// leaveHalfOpen gives back the connection's place in its listener's half-open queue, if it has one
+func (c *TCPConn) leaveHalfOpen() {
+	if c.halfOpen {
+		c.halfOpen = false
+		c.listener.releaseHalfOpen()
+	}
+}
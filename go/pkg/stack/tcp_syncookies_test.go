@@ -0,0 +1,263 @@
+package stack
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/tcp"
+)
+
+// attacker is a copy of p sending from a spoofed address in the stack's subnet, so the SYN-ACKs go nowhere
+func attacker(p *tcpPeer, i int) *tcpPeer {
+	spoofed := *p
+	spoofed.local = netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(100 + i)}), 5000)
+	spoofed.seq = uint32(i) * 7919
+
+	return &spoofed
+}
+
+// flood has count spoofed sources send one SYN each, and returns how many SYN-ACKs came back
+func flood(p *tcpPeer, count int) int {
+	p.t.Helper()
+
+	synACKs := 0
+
+	for i := range count {
+		attacker(p, i).send(tcp.FlagSYN, "")
+
+		// Read as we go, so the peer's queue never fills and holds up the link
+		if i%16 == 15 {
+			synACKs += p.drain()[tcp.FlagSYN|tcp.FlagACK]
+		}
+	}
+
+	return synACKs + p.drain()[tcp.FlagSYN|tcp.FlagACK]
+}
+
+func halfOpen(l *TCPListener) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.halfOpen
+}
+
+func Test_TCP_SYNCookieRoundTrip(t *testing.T) {
+	p := newTCPPeer(t)
+	id := tcpConnectionID{local: p.remote, remote: p.local}
+	made := time.Unix(1_700_000_000, 0)
+
+	for i, mss := range synCookieMSS {
+		cookie := p.stack.makeSYNCookie(id, peerISS, i, made)
+
+		got, ok := p.stack.checkSYNCookie(id, peerISS, cookie, made.Add(90*time.Second))
+		if !ok || got != mss {
+			t.Errorf("expected the cookie to give back MSS %d, got %d (valid %t)", mss, got, ok)
+		}
+
+		if _, ok := p.stack.checkSYNCookie(id, peerISS, cookie, made.Add(3*time.Minute)); ok {
+			t.Errorf("expected the cookie to expire")
+		}
+
+		if _, ok := p.stack.checkSYNCookie(id, peerISS+1000, cookie, made); ok {
+			t.Errorf("expected the cookie to only be good for the peer's ISN")
+		}
+
+		other := tcpConnectionID{local: p.remote, remote: netip.AddrPortFrom(peerAddress, peerPort+1)}
+		if _, ok := p.stack.checkSYNCookie(other, peerISS, cookie, made); ok {
+			t.Errorf("expected the cookie to only be good for its connection")
+		}
+	}
+}
+
+func Test_TCP_SYNFloodIsAnsweredWithCookies(t *testing.T) {
+	p := newTCPPeerWithClock(t, clock.NewFake(time.Unix(0, 0)))
+
+	listener, err := p.stack.ListenTCPWithBacklog(p.remote, 4)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if synACKs := flood(p, 40); synACKs != 40 {
+		t.Fatalf("expected every SYN to be answered, got %d SYN-ACKs", synACKs)
+	}
+
+	if n := halfOpen(listener); n != 4 {
+		t.Fatalf("expected the half-open queue to stop at the backlog of 4, got %d", n)
+	}
+
+	// A real client still gets through, with its options kept in the cookie
+	p.mss = 1460
+	p.windowScale = true
+	p.windowShift = 2
+	p.sackPermitted = true
+	p.timestamps = true
+	p.tsVal = 500
+
+	p.send(tcp.FlagSYN, "")
+	synACK := p.expect(tcp.FlagSYN | tcp.FlagACK)
+
+	if _, ok := synACK.WindowScale(); !ok || !synACK.SACKPermitted() {
+		t.Errorf("expected the cookie SYN-ACK to offer window scaling and SACK alongside timestamps")
+	}
+
+	id := tcpConnectionID{local: p.remote, remote: p.local}
+	if p.stack.tcp.lookupConnection(id) != nil {
+		t.Fatalf("expected no state to be kept for a cookie SYN-ACK")
+	}
+
+	p.tsVal++
+	p.send(tcp.FlagACK|tcp.FlagPSH, "hello")
+
+	accepted, err := listener.AcceptTCP()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	buffer := make([]byte, 16)
+	n, err := accepted.Read(buffer)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !bytes.Equal(buffer[:n], []byte("hello")) {
+		t.Errorf("expected to read hello, got %q", buffer[:n])
+	}
+
+	accepted.mu.Lock()
+	defer accepted.mu.Unlock()
+
+	if accepted.sndMSS != 1460 || !accepted.windowScaling || accepted.sndWndShift != 2 || !accepted.sackPermitted || !accepted.timestamps {
+		t.Errorf("expected the options to come back from the cookie, got MSS %d, scaling %t by %d, SACK %t, timestamps %t",
+			accepted.sndMSS, accepted.windowScaling, accepted.sndWndShift, accepted.sackPermitted, accepted.timestamps)
+	}
+}
+
+func Test_TCP_SYNCookieWithoutTimestampsOnlyKeepsTheMSS(t *testing.T) {
+	p := newTCPPeer(t)
+
+	listener, err := p.stack.ListenTCPWithBacklog(p.remote, 1)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	flood(p, 2)
+
+	// 1400 rounds down to the nearest MSS a cookie can hold
+	p.mss = 1400
+	p.windowScale = true
+	p.sackPermitted = true
+
+	p.send(tcp.FlagSYN, "")
+	synACK := p.expect(tcp.FlagSYN | tcp.FlagACK)
+
+	if _, ok := synACK.WindowScale(); ok || synACK.SACKPermitted() {
+		t.Errorf("expected a cookie SYN-ACK without timestamps to offer nothing it cannot remember")
+	}
+
+	p.send(tcp.FlagACK, "")
+
+	accepted, err := listener.AcceptTCP()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	accepted.mu.Lock()
+	defer accepted.mu.Unlock()
+
+	if accepted.sndMSS != 1300 || accepted.windowScaling || accepted.sackPermitted {
+		t.Errorf("expected MSS 1300 and no options, got MSS %d, scaling %t, SACK %t", accepted.sndMSS, accepted.windowScaling, accepted.sackPermitted)
+	}
+}
+
+func Test_TCP_ForgedSYNCookieIsReset(t *testing.T) {
+	p := newTCPPeer(t)
+
+	_, err := p.stack.ListenTCPWithBacklog(p.remote, 1)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	flood(p, 2)
+
+	// An ACK guessing at a cookie, with no SYN before it
+	p.sendAt(tcp.FlagACK, peerISS+1, 123456, "")
+	p.expect(tcp.FlagRST)
+
+	if p.stack.tcp.lookupConnection(tcpConnectionID{local: p.remote, remote: p.local}) != nil {
+		t.Errorf("expected no connection from a forged cookie")
+	}
+}
+
+func Test_TCP_SYNCookieExpires(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, fake)
+
+	_, err := p.stack.ListenTCPWithBacklog(p.remote, 1)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	flood(p, 1)
+
+	p.send(tcp.FlagSYN, "")
+	p.expect(tcp.FlagSYN | tcp.FlagACK)
+
+	// Long enough for the cookie to be too old, and for the flood's half-open connection to give up
+	fake.Advance(3 * time.Minute)
+	p.drain()
+
+	p.send(tcp.FlagACK, "")
+	p.expect(tcp.FlagRST)
+}
+
+func Test_TCP_OneSourceCannotFillTheHalfOpenQueue(t *testing.T) {
+	// The clock stands still, so the source's bucket does not refill
+	p := newTCPPeerWithClock(t, clock.NewFake(time.Unix(0, 0)))
+
+	listener, err := p.stack.ListenTCPWithBacklog(p.remote, 128)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	for port := range uint16(tcpHalfOpenBurst + 8) {
+		source := *p
+		source.local = netip.AddrPortFrom(peerAddress, 10000+port)
+		source.send(tcp.FlagSYN, "")
+	}
+
+	synACKs := p.drain()[tcp.FlagSYN|tcp.FlagACK]
+
+	if synACKs != tcpHalfOpenBurst+8 {
+		t.Errorf("expected every SYN to be answered, got %d SYN-ACKs", synACKs)
+	}
+
+	if n := halfOpen(listener); n != tcpHalfOpenBurst {
+		t.Fatalf("expected the source to stop at %d half-open connections, got %d", tcpHalfOpenBurst, n)
+	}
+
+	// Another source still gets a connection of its own
+	other := attacker(p, 0)
+	other.send(tcp.FlagSYN, "")
+	other.expect(tcp.FlagSYN | tcp.FlagACK)
+
+	if n := halfOpen(listener); n != tcpHalfOpenBurst+1 {
+		t.Errorf("expected another source to be let in, got %d half-open connections", n)
+	}
+}
+
+func Test_TCP_HalfOpenConnectionsLeaveTheQueue(t *testing.T) {
+	p := newTCPPeer(t)
+	established(p)
+
+	listener := p.stack.tcp.listeners[p.remote]
+	if n := halfOpen(listener); n != 0 {
+		t.Errorf("expected the established connection to leave the half-open queue, got %d", n)
+	}
+}
+
+func Test_TCP_SYNFloodIsDroppedWithoutCookies(t *testing.T) {
+	p := newTCPPeerWithClock(t, clock.NewFake(time.Unix(0, 0)))
+	p.stack.options.DisableSYNCookies = true
+
+	listener, err := p.stack.ListenTCPWithBacklog(p.remote, 4)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if synACKs := flood(p, 20); synACKs != 4 {
+		t.Errorf("expected only the backlog to be answered, got %d SYN-ACKs", synACKs)
+	}
+
+	if n := halfOpen(listener); n != 4 {
+		t.Errorf("expected 4 half-open connections, got %d", n)
+	}
+
+	p.send(tcp.FlagSYN, "")
+	p.expectNothing()
+}
@@ -0,0 +1,973 @@
+package stack
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+	"networking/pkg/ipv4"
+	"networking/pkg/link"
+	"networking/pkg/tcp"
+)
+
+const (
+	peerISS    = 1000
+	listenPort = 4000
+	peerPort   = 3000
+)
+
+var peerAddress = netip.MustParseAddr("10.0.0.9")
+
+// tcpPeer drives the far end of a connection by hand, one segment at a time
+type tcpPeer struct {
+	t     *testing.T
+	stack *Stack
+	pipe  *link.Pipe
+	// Segments the stack sent, parsed
+	received chan *tcp.Segment
+
+	local  netip.AddrPort
+	remote netip.AddrPort
+	// The peer's next sequence number and what it has acknowledged of the stack's
+	seq uint32
+	ack uint32
+	// Whether the peer offers SACK in its SYN, and the MSS it announces there if not zero
+	sackPermitted bool
+	mss           uint16
+	// The window the peer advertises, unscaled, and the scale it offers in its SYN if windowScale is set
+	window      uint16
+	windowScale bool
+	windowShift uint8
+	// Whether the peer sends timestamps, with the TSval it sends and the stack's latest TSval it echoes
+	timestamps bool
+	tsVal      uint32
+	tsEcr      uint32
+}
+
+func newTCPPeer(t *testing.T) *tcpPeer {
+	t.Helper()
+
+	return newTCPPeerWithClock(t, clock.Real{})
+}
+
+// newTCPPeerWithClock is newTCPPeer with the stack's timers driven by c
+func newTCPPeerWithClock(t *testing.T, c clock.Clock) *tcpPeer {
+	t.Helper()
+
+	stackLink, pipe := link.NewPipe(link.IP, 1500)
+	s := New(logger.NewMockLogger().WithLogger(context.Background()), Options{Clock: c})
+	s.tcp.timeWait = 250 * time.Millisecond
+
+	_, err := s.AddInterface("s0", stackLink, addressA)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = pipe.Close()
+	})
+
+	peer := &tcpPeer{
+		t:        t,
+		stack:    s,
+		pipe:     pipe,
+		received: make(chan *tcp.Segment, 64),
+		local:    netip.AddrPortFrom(peerAddress, peerPort),
+		remote:   netip.AddrPortFrom(addressA.Addr(), listenPort),
+		seq:      peerISS,
+		window:   8192,
+	}
+
+	go func() {
+		for {
+			raw, err := pipe.ReadPacket()
+			if err != nil {
+				return
+			}
+
+			packet, err := ipv4.ParseRawPacket(context.TODO(), raw)
+			if err != nil || packet.Protocol != ipv4.ProtocolTCP {
+				continue
+			}
+
+			segment, err := tcp.ParseRawSegment(context.TODO(), packet.Payload, packet.Source, packet.Destination)
+			if err != nil {
+				continue
+			}
+
+			peer.received <- segment
+		}
+	}()
+
+	return peer
+}
+
+// send writes a segment from the peer, with the peer's current sequence and acknowledgment numbers
+func (p *tcpPeer) send(flags tcp.Flags, data string) {
+	p.sendAt(flags, p.seq, p.ack, data)
+
+	segment := tcp.Segment{Flags: flags, Data: []byte(data)}
+	p.seq += segment.SegmentLength()
+}
+
+func (p *tcpPeer) sendAt(flags tcp.Flags, seq, ack uint32, data string) {
+	p.t.Helper()
+
+	var options []tcp.Option
+	if flags.Has(tcp.FlagSYN) && p.mss != 0 {
+		options = append(options, tcp.NewMSSOption(p.mss))
+	}
+
+	if flags.Has(tcp.FlagSYN) && p.sackPermitted {
+		options = append(options, tcp.NewSACKPermittedOption())
+	}
+
+	if flags.Has(tcp.FlagSYN) && p.windowScale {
+		options = append(options, tcp.NewWindowScaleOption(p.windowShift))
+	}
+
+	if p.timestamps && !flags.Has(tcp.FlagRST) {
+		options = append(options, tcp.NewTimestampsOption(p.tsVal, p.tsEcr))
+	}
+
+	p.sendWithOptions(flags, seq, ack, data, options...)
+}
+
+func (p *tcpPeer) sendWithOptions(flags tcp.Flags, seq, ack uint32, data string, options ...tcp.Option) {
+	p.t.Helper()
+
+	segment := tcp.Segment{
+		SourcePort:           p.local.Port(),
+		DestinationPort:      p.remote.Port(),
+		SequenceNumber:       seq,
+		AcknowledgmentNumber: ack,
+		Flags:                flags,
+		Window:               p.window,
+		Options:              options,
+		Data:                 []byte(data),
+	}
+
+	raw, err := segment.CreateSegment(context.TODO(), p.local.Addr(), p.remote.Addr())
+	testhelpers.FailTestIfErrorIsPresent(p.t, err)
+
+	packet := ipv4.Packet{
+		TTL:         64,
+		Protocol:    ipv4.ProtocolTCP,
+		Source:      p.local.Addr(),
+		Destination: p.remote.Addr(),
+		Payload:     raw,
+	}
+
+	rawPacket, err := packet.CreatePacket(context.TODO())
+	testhelpers.FailTestIfErrorIsPresent(p.t, err)
+
+	_ = p.pipe.WritePacket(rawPacket)
+}
+
+// expect reads the next segment from the stack and checks its flags. ACKs are tracked, so the peer
+// acknowledges everything the stack sends from then on.
+func (p *tcpPeer) expect(flags tcp.Flags) *tcp.Segment {
+	p.t.Helper()
+
+	select {
+	case segment := <-p.received:
+		if segment.Flags != flags {
+			p.t.Fatalf("expected %s from the stack, got %s (seq %d, ack %d, len %d, win %d)", flags, segment.Flags, segment.SequenceNumber, segment.AcknowledgmentNumber, len(segment.Data), segment.Window)
+		}
+
+		p.ack = segment.SequenceNumber + segment.SegmentLength()
+
+		if tsVal, _, ok := segment.Timestamps(); ok && p.timestamps {
+			p.tsEcr = tsVal
+		}
+
+		return segment
+	case <-time.After(2 * time.Second):
+		p.t.Fatalf("expected %s from the stack, got nothing", flags)
+		return nil
+	}
+}
+
+func (p *tcpPeer) expectNothing() {
+	p.t.Helper()
+
+	select {
+	case segment := <-p.received:
+		p.t.Fatalf("expected nothing from the stack, got %s", segment.Flags)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// drain reads everything the stack sends until it goes quiet, returning how many of each set of flags it saw
+func (p *tcpPeer) drain() map[tcp.Flags]int {
+	seen := map[tcp.Flags]int{}
+
+	for {
+		select {
+		case segment := <-p.received:
+			seen[segment.Flags]++
+		case <-time.After(50 * time.Millisecond):
+			return seen
+		}
+	}
+}
+
+func waitForState(t *testing.T, conn *TCPConn, expected TCPState) {
+	t.Helper()
+
+	waitFor(t, fmt.Sprintf("the connection to reach %s", expected), func() bool { return conn.State() == expected })
+}
+
+// synReceived listens, and has the peer send a SYN
+func synReceived(p *tcpPeer) *TCPConn {
+	p.t.Helper()
+
+	_, err := p.stack.ListenTCP(p.remote)
+	testhelpers.FailTestIfErrorIsPresent(p.t, err)
+
+	p.send(tcp.FlagSYN, "")
+	p.expect(tcp.FlagSYN | tcp.FlagACK)
+
+	conn := p.stack.tcp.lookupConnection(tcpConnectionID{local: p.remote, remote: p.local})
+	if conn == nil {
+		p.t.Fatalf("expected a connection in SYN-RECEIVED")
+	}
+
+	return conn
+}
+
+// established completes a passive open
+func established(p *tcpPeer) *TCPConn {
+	p.t.Helper()
+
+	conn := synReceived(p)
+	p.send(tcp.FlagACK, "")
+	waitForState(p.t, conn, StateEstablished)
+
+	return conn
+}
+
+// synSent has the stack dial the peer, returning once the SYN is out
+func synSent(p *tcpPeer) (*TCPConn, chan error) {
+	p.t.Helper()
+
+	done := make(chan error, 1)
+
+	go func() {
+		_, err := p.stack.DialTCP(context.Background(), p.remote, p.local)
+		done <- err
+	}()
+
+	p.expect(tcp.FlagSYN)
+
+	conn := p.stack.tcp.lookupConnection(tcpConnectionID{local: p.remote, remote: p.local})
+	if conn == nil {
+		p.t.Fatalf("expected a connection in SYN-SENT")
+	}
+
+	return conn, done
+}
+
+func finWait1(p *tcpPeer) *TCPConn {
+	p.t.Helper()
+
+	conn := established(p)
+	_ = conn.Close()
+	p.expect(tcp.FlagFIN | tcp.FlagACK)
+
+	return conn
+}
+
+func closeWait(p *tcpPeer) *TCPConn {
+	p.t.Helper()
+
+	conn := established(p)
+	p.send(tcp.FlagFIN|tcp.FlagACK, "")
+	p.expect(tcp.FlagACK)
+
+	return conn
+}
+
+// Every transition in the RFC 9293 state diagram, plus the resets and challenge ACKs that keep it robust
+func Test_TCP_StateTransitions(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(p *tcpPeer) *TCPConn
+		event    func(p *tcpPeer, conn *TCPConn)
+		reply    tcp.Flags // Zero means the stack should stay quiet
+		expected TCPState
+	}{
+		{
+			name:     "LISTEN to SYN-RECEIVED on SYN",
+			setup:    synReceived,
+			event:    func(p *tcpPeer, conn *TCPConn) {},
+			expected: StateSynReceived,
+		},
+		{
+			name:     "SYN-RECEIVED to ESTABLISHED on ACK",
+			setup:    synReceived,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagACK, "") },
+			expected: StateEstablished,
+		},
+		{
+			name:     "SYN-RECEIVED back to LISTEN on RST",
+			setup:    synReceived,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagRST, "") },
+			expected: StateClosed,
+		},
+		{
+			name:     "SYN-RECEIVED resends SYN-ACK for a retransmitted SYN",
+			setup:    synReceived,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagSYN, peerISS, 0, "") },
+			reply:    tcp.FlagSYN | tcp.FlagACK,
+			expected: StateSynReceived,
+		},
+		{
+			name:     "SYN-RECEIVED resets an unacceptable ACK",
+			setup:    synReceived,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagACK, p.seq, p.ack+100, "") },
+			reply:    tcp.FlagRST,
+			expected: StateSynReceived,
+		},
+		{
+			name:     "SYN-RECEIVED to FIN-WAIT-1 on close",
+			setup:    synReceived,
+			event:    func(p *tcpPeer, conn *TCPConn) { _ = conn.Close() },
+			reply:    tcp.FlagFIN | tcp.FlagACK,
+			expected: StateFinWait1,
+		},
+		{
+			name: "SYN-SENT to ESTABLISHED on SYN-ACK",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn, _ := synSent(p)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagSYN|tcp.FlagACK, "") },
+			reply:    tcp.FlagACK,
+			expected: StateEstablished,
+		},
+		{
+			name: "SYN-SENT to SYN-RECEIVED on simultaneous open",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn, _ := synSent(p)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagSYN, "") },
+			reply:    tcp.FlagSYN | tcp.FlagACK,
+			expected: StateSynReceived,
+		},
+		{
+			name: "SYN-SENT to CLOSED on RST-ACK",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn, _ := synSent(p)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagRST|tcp.FlagACK, "") },
+			expected: StateClosed,
+		},
+		{
+			name: "SYN-SENT ignores RST without ACK",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn, _ := synSent(p)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagRST, peerISS, 0, "") },
+			expected: StateSynSent,
+		},
+		{
+			name: "SYN-SENT resets an ACK for something it never sent",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn, _ := synSent(p)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagSYN|tcp.FlagACK, peerISS, p.ack+5, "") },
+			reply:    tcp.FlagRST,
+			expected: StateSynSent,
+		},
+		{
+			name: "SYN-SENT to CLOSED on close",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn, _ := synSent(p)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { _ = conn.Close() },
+			expected: StateClosed,
+		},
+		{
+			name:     "ESTABLISHED to FIN-WAIT-1 on close",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { _ = conn.Close() },
+			reply:    tcp.FlagFIN | tcp.FlagACK,
+			expected: StateFinWait1,
+		},
+		{
+			name:     "ESTABLISHED to CLOSE-WAIT on FIN",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagFIN|tcp.FlagACK, "") },
+			reply:    tcp.FlagACK,
+			expected: StateCloseWait,
+		},
+		{
+			name:     "ESTABLISHED to CLOSED on RST at RCV.NXT",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagRST, "") },
+			expected: StateClosed,
+		},
+		{
+			name:     "ESTABLISHED sends a challenge ACK for an in-window RST",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagRST, p.seq+10, 0, "") },
+			reply:    tcp.FlagACK,
+			expected: StateEstablished,
+		},
+		{
+			name:     "ESTABLISHED ignores an RST outside the window",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagRST, p.seq+100000, 0, "") },
+			expected: StateEstablished,
+		},
+		{
+			name:     "ESTABLISHED sends a challenge ACK for a SYN",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagSYN, p.seq, 0, "") },
+			reply:    tcp.FlagACK,
+			expected: StateEstablished,
+		},
+		{
+			name:     "ESTABLISHED ACKs a segment outside the window",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagACK, p.seq-50, p.ack, "old") },
+			reply:    tcp.FlagACK,
+			expected: StateEstablished,
+		},
+		{
+			name:     "ESTABLISHED ACKs an ACK for data not sent yet",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagACK, p.seq, p.ack+10, "") },
+			reply:    tcp.FlagACK,
+			expected: StateEstablished,
+		},
+		{
+			name:     "ESTABLISHED ACKs data",
+			setup:    established,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagACK|tcp.FlagPSH, "hello") },
+			reply:    tcp.FlagACK,
+			expected: StateEstablished,
+		},
+		{
+			name:     "FIN-WAIT-1 to FIN-WAIT-2 on ACK of FIN",
+			setup:    finWait1,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagACK, "") },
+			expected: StateFinWait2,
+		},
+		{
+			name: "FIN-WAIT-1 to CLOSING on simultaneous close",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn := finWait1(p)
+				p.ack-- // The peer's FIN crossed ours, so it does not acknowledge it
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagFIN|tcp.FlagACK, "") },
+			reply:    tcp.FlagACK,
+			expected: StateClosing,
+		},
+		{
+			name:     "FIN-WAIT-1 to TIME-WAIT on FIN-ACK",
+			setup:    finWait1,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagFIN|tcp.FlagACK, "") },
+			reply:    tcp.FlagACK,
+			expected: StateTimeWait,
+		},
+		{
+			name: "FIN-WAIT-2 to TIME-WAIT on FIN",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn := finWait1(p)
+				p.send(tcp.FlagACK, "")
+				waitForState(p.t, conn, StateFinWait2)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagFIN|tcp.FlagACK, "") },
+			reply:    tcp.FlagACK,
+			expected: StateTimeWait,
+		},
+		{
+			name: "FIN-WAIT-2 still delivers data",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn := finWait1(p)
+				p.send(tcp.FlagACK, "")
+				waitForState(p.t, conn, StateFinWait2)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagACK|tcp.FlagPSH, "late") },
+			reply:    tcp.FlagACK,
+			expected: StateFinWait2,
+		},
+		{
+			name: "CLOSING to TIME-WAIT on ACK of FIN",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn := finWait1(p)
+				p.ack--
+				p.send(tcp.FlagFIN|tcp.FlagACK, "")
+				p.expect(tcp.FlagACK)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagACK, "") },
+			expected: StateTimeWait,
+		},
+		{
+			name: "TIME-WAIT to CLOSED after 2*MSL",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn := finWait1(p)
+				p.send(tcp.FlagFIN|tcp.FlagACK, "")
+				p.expect(tcp.FlagACK)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { time.Sleep(400 * time.Millisecond) },
+			expected: StateClosed,
+		},
+		{
+			name: "TIME-WAIT ACKs a retransmitted FIN",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn := finWait1(p)
+				p.send(tcp.FlagFIN|tcp.FlagACK, "")
+				p.expect(tcp.FlagACK)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.sendAt(tcp.FlagFIN|tcp.FlagACK, p.seq-1, p.ack, "") },
+			reply:    tcp.FlagACK,
+			expected: StateTimeWait,
+		},
+		{
+			name:     "CLOSE-WAIT to LAST-ACK on close",
+			setup:    closeWait,
+			event:    func(p *tcpPeer, conn *TCPConn) { _ = conn.Close() },
+			reply:    tcp.FlagFIN | tcp.FlagACK,
+			expected: StateLastAck,
+		},
+		{
+			name:     "CLOSE-WAIT to CLOSED on RST",
+			setup:    closeWait,
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagRST, "") },
+			expected: StateClosed,
+		},
+		{
+			name: "LAST-ACK to CLOSED on ACK of FIN",
+			setup: func(p *tcpPeer) *TCPConn {
+				conn := closeWait(p)
+				_ = conn.Close()
+				p.expect(tcp.FlagFIN | tcp.FlagACK)
+				return conn
+			},
+			event:    func(p *tcpPeer, conn *TCPConn) { p.send(tcp.FlagACK, "") },
+			expected: StateClosed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p := newTCPPeer(t)
+			conn := test.setup(p)
+
+			test.event(p, conn)
+
+			if test.reply == 0 {
+				p.expectNothing()
+			} else {
+				p.expect(test.reply)
+			}
+
+			waitForState(t, conn, test.expected)
+		})
+	}
+}
+
+func Test_TCP_SegmentForClosedPortIsReset(t *testing.T) {
+	p := newTCPPeer(t)
+
+	p.send(tcp.FlagSYN, "")
+	reset := p.expect(tcp.FlagRST | tcp.FlagACK)
+
+	if reset.SequenceNumber != 0 || reset.AcknowledgmentNumber != peerISS+1 {
+		t.Errorf("expected <SEQ=0><ACK=%d>, got <SEQ=%d><ACK=%d>", peerISS+1, reset.SequenceNumber, reset.AcknowledgmentNumber)
+	}
+
+	waitForCounter(t, p.stack, "tcpOutRsts", 1)
+}
+
+func Test_TCP_ACKForListenerIsReset(t *testing.T) {
+	p := newTCPPeer(t)
+
+	_, err := p.stack.ListenTCP(p.remote)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	p.sendAt(tcp.FlagACK, peerISS, 5555, "")
+	reset := p.expect(tcp.FlagRST)
+
+	if reset.SequenceNumber != 5555 {
+		t.Errorf("expected the reset to use the ACK as its sequence number, got %d", reset.SequenceNumber)
+	}
+}
+
+func Test_TCP_DialFailsWhenRefused(t *testing.T) {
+	p := newTCPPeer(t)
+
+	_, done := synSent(p)
+	p.send(tcp.FlagRST|tcp.FlagACK, "")
+
+	if err := <-done; !errors.Is(err, ErrConnectionRefused) {
+		t.Errorf("expected ErrConnectionRefused, got %v", err)
+	}
+
+	waitForCounter(t, p.stack, "tcpActiveOpens", 1)
+	waitForCounter(t, p.stack, "tcpAttemptFails", 1)
+}
+
+func Test_TCP_ReadAfterReset(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	p.send(tcp.FlagRST, "")
+
+	if _, err := conn.Read(make([]byte, 10)); !errors.Is(err, ErrConnectionReset) {
+		t.Errorf("expected ErrConnectionReset, got %v", err)
+	}
+
+	waitForCounter(t, p.stack, "tcpEstabResets", 1)
+}
+
+func Test_TCP_DataAndFINAreReadInOrder(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	p.send(tcp.FlagACK|tcp.FlagPSH, "hello ")
+	p.expect(tcp.FlagACK)
+	p.send(tcp.FlagACK|tcp.FlagPSH|tcp.FlagFIN, "world")
+	p.expect(tcp.FlagACK)
+
+	data, err := io.ReadAll(conn)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if string(data) != "hello world" {
+		t.Errorf("expected %q, got %q", "hello world", data)
+	}
+}
+
+func Test_TCP_OutOfOrderDataWaitsForTheHole(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	p.sendAt(tcp.FlagACK, p.seq+5, p.ack, "later")
+	ack := p.expect(tcp.FlagACK)
+
+	if ack.AcknowledgmentNumber != p.seq {
+		t.Errorf("expected a duplicate ACK of %d, got %d", p.seq, ack.AcknowledgmentNumber)
+	}
+
+	conn.mu.Lock()
+	buffered := string(conn.receiveBuffer)
+	conn.mu.Unlock()
+
+	if buffered != "" {
+		t.Fatalf("expected out of order data to be held back, got %q", buffered)
+	}
+
+	p.send(tcp.FlagACK, "first")
+	ack = p.expect(tcp.FlagACK)
+
+	if ack.AcknowledgmentNumber != p.seq+5 {
+		t.Errorf("expected the ACK to cover the held back data, got %d", ack.AcknowledgmentNumber)
+	}
+
+	data := make([]byte, 10)
+	n, err := conn.Read(data)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if string(data[:n]) != "firstlater" {
+		t.Errorf("expected the data in order, got %q", data[:n])
+	}
+}
+
+func Test_TCP_WriteIsSegmentedAndAcknowledged(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	_, err := conn.Write([]byte("from the stack"))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	segment := p.expect(tcp.FlagACK | tcp.FlagPSH)
+	if string(segment.Data) != "from the stack" {
+		t.Errorf("unexpected data %q", segment.Data)
+	}
+
+	p.send(tcp.FlagACK, "")
+
+	waitFor(t, "the send buffer to be emptied by the ACK", func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+
+		return len(conn.sendBuffer) == 0
+	})
+}
+
+func Test_TCP_StacksTalkOverEthernet(t *testing.T) {
+	a, b, _ := newStackPair(t, link.Ethernet)
+
+	listener, err := b.ListenTCP(netip.AddrPortFrom(netip.IPv4Unspecified(), 8080))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	accepted := make(chan *TCPConn, 1)
+	go func() {
+		conn, err := listener.AcceptTCP()
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+		accepted <- conn
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	client, err := a.DialTCP(ctx, netip.AddrPort{}, netip.AddrPortFrom(addressB.Addr(), 8080))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	server := <-accepted
+
+	payload := make([]byte, 20000)
+	for i := range payload {
+		payload[i] = byte(i)
+	}
+
+	go func() {
+		_, _ = client.Write(payload)
+		_ = client.Close()
+	}()
+
+	received, err := io.ReadAll(server)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(received) != len(payload) {
+		t.Fatalf("expected %d bytes, got %d", len(payload), len(received))
+	}
+
+	for i := range payload {
+		if received[i] != payload[i] {
+			t.Fatalf("data differs at byte %d", i)
+		}
+	}
+
+	_ = server.Close()
+
+	waitForState(t, server, StateClosed)
+	waitForState(t, client, StateTimeWait)
+}
+
+func Test_TCP_ReadDeadline(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	err := conn.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = conn.Read(make([]byte, 10))
+
+	var netErr net.Error
+	if !errors.Is(err, os.ErrDeadlineExceeded) || !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+
+	// Moving the deadline into the past wakes a blocked Read, which is how net/http cancels them
+	err = conn.SetReadDeadline(time.Time{})
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 10))
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	_ = conn.SetReadDeadline(time.Unix(1, 0))
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Errorf("expected the blocked Read to time out, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the blocked Read to wake up")
+	}
+
+	_ = conn.SetReadDeadline(time.Time{})
+	p.send(tcp.FlagACK|tcp.FlagPSH, "hello")
+
+	data := make([]byte, 10)
+	n, err := conn.Read(data)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if string(data[:n]) != "hello" {
+		t.Errorf("expected reads to work again without a deadline, got %q", data[:n])
+	}
+}
+
+func Test_TCP_WriteDeadline(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	err := conn.SetWriteBuffer(10)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	err = conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	// Nothing is acknowledged, so the buffer never empties
+	n, err := conn.Write([]byte("0123456789abcdefghij"))
+	if !errors.Is(err, os.ErrDeadlineExceeded) || n != 10 {
+		t.Errorf("expected to write the 10 bytes that fit and then time out, got %d and %v", n, err)
+	}
+}
+
+func Test_TCP_CloseWriteStillReads(t *testing.T) {
+	p := newTCPPeer(t)
+	conn := established(p)
+
+	err := conn.CloseWrite()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	p.expect(tcp.FlagFIN | tcp.FlagACK)
+	p.send(tcp.FlagACK|tcp.FlagPSH, "reply")
+	p.send(tcp.FlagFIN|tcp.FlagACK, "")
+
+	received, err := io.ReadAll(conn)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if string(received) != "reply" {
+		t.Errorf("expected to read the peer's data after CloseWrite, got %q", received)
+	}
+
+	if _, err := conn.Write([]byte("more")); !errors.Is(err, ErrConnectionClosing) {
+		t.Errorf("expected writing after CloseWrite to fail, got %v", err)
+	}
+}
+
+func Test_TCP_ListenerBacklogHoldsBackHandshakes(t *testing.T) {
+	p := newTCPPeer(t)
+
+	listener, err := p.stack.ListenTCPWithBacklog(p.remote, 1)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	p.send(tcp.FlagSYN, "")
+	p.expect(tcp.FlagSYN | tcp.FlagACK)
+	p.send(tcp.FlagACK, "")
+	waitForState(t, p.stack.tcp.lookupConnection(tcpConnectionID{local: p.remote, remote: p.local}), StateEstablished)
+
+	// The queue is full until the first connection is accepted, so a second SYN goes unanswered
+	second := *p
+	second.local = netip.AddrPortFrom(peerAddress, peerPort+1)
+	second.seq = peerISS
+
+	second.send(tcp.FlagSYN, "")
+	second.expectNothing()
+
+	conn, err := listener.Accept()
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if conn.RemoteAddr().String() != p.local.String() || listener.Addr().String() != p.remote.String() {
+		t.Errorf("unexpected addresses %s and %s", conn.RemoteAddr(), listener.Addr())
+	}
+
+	second.sendAt(tcp.FlagSYN, peerISS, 0, "")
+	second.expect(tcp.FlagSYN | tcp.FlagACK)
+}
+
+// The goal of the project: an HTTP server on the stack, with net/http none the wiser
+func Test_TCP_HTTPOverTheStack(t *testing.T) {
+	a, b, _ := newStackPair(t, link.IP)
+
+	listener, err := b.ListenTCP(netip.AddrPortFrom(netip.IPv4Unspecified(), 8080))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s from %s: %d bytes", r.Method, r.URL.Path, r.RemoteAddr, len(body))
+	})}
+
+	go func() {
+		_ = server.Serve(listener)
+	}()
+
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
+				remote, err := netip.ParseAddrPort(address)
+				if err != nil {
+					return nil, err
+				}
+
+				return a.DialTCP(ctx, netip.AddrPort{}, remote)
+			},
+		},
+	}
+
+	response, err := client.Post("http://10.0.0.2:8080/upload", "application/octet-stream", bytes.NewReader(make([]byte, 100000)))
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	body, err := io.ReadAll(response.Body)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	_ = response.Body.Close()
+
+	if !strings.HasPrefix(string(body), "POST /upload from 10.0.0.1:") || !strings.HasSuffix(string(body), ": 100000 bytes") {
+		t.Errorf("unexpected response %q", body)
+	}
+
+	// The connection is kept alive and reused
+	response, err = client.Get("http://10.0.0.2:8080/again")
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+	_ = response.Body.Close()
+
+	if opens, _ := a.Metrics().Snapshot().Get("tcpActiveOpens"); opens != 1 {
+		t.Errorf("expected one connection for both requests, got %d", opens)
+	}
+}
+
+func Test_TCP_ISNIsKeyedByConnectionAndFollowsTheClock(t *testing.T) {
+	fake := clock.NewFake(time.Unix(0, 0))
+	p := newTCPPeerWithClock(t, fake)
+
+	id := tcpConnectionID{local: p.remote, remote: p.local}
+	other := tcpConnectionID{local: p.remote, remote: netip.AddrPortFrom(peerAddress, peerPort+1)}
+
+	before := p.stack.tcpInitialSequenceNumber(id)
+	fake.Advance(time.Second)
+	after := p.stack.tcpInitialSequenceNumber(id)
+
+	// One tick every 4 microseconds
+	if after-before != 250_000 {
+		t.Errorf("expected the ISN to move on by 250000 in a second, it moved %d", after-before)
+	}
+
+	if p.stack.tcpInitialSequenceNumber(other) == after {
+		t.Errorf("expected another 4-tuple to get a different ISN")
+	}
+
+	// Without the secret, the ISN cannot be worked out from the 4-tuple and the time
+	stranger := New(logger.NewMockLogger().WithLogger(context.Background()), Options{Clock: fake})
+	t.Cleanup(func() { _ = stranger.Close() })
+
+	if stranger.tcpInitialSequenceNumber(id) == after {
+		t.Errorf("expected a stack with another secret to pick a different ISN")
+	}
+}
@@ -0,0 +1,118 @@
+package stack
+
+import (
+	"sync"
+	"time"
+
+	"networking/internal/clock"
+)
+
+const (
+	timerWheelGranularity = 10 * time.Millisecond
+	// With 10ms ticks, one trip around the wheel is a little over 5 seconds. Longer timers go round more than once.
+	timerWheelSlots = 512
+)
+
+// timerWheel runs every protocol timer in the stack off a single clock tick (Varghese and Lauck's hashed
+// timing wheel), so thousands of connections with timers cost one ticker, and a fake clock drives them all in tests
+type timerWheel struct {
+	stopTicking func()
+
+	mu    sync.Mutex
+	slots [timerWheelSlots]map[*wheelTimer]struct{}
+	tick  uint64
+}
+
+// wheelTimer calls f once it expires. It can be reset and reused as often as needed.
+type wheelTimer struct {
+	wheel *timerWheel
+	f     func()
+
+	// Guarded by the wheel's lock
+	pending bool
+	expiry  uint64
+}
+
+func newTimerWheel(c clock.Clock) *timerWheel {
+	w := &timerWheel{}
+
+	for i := range w.slots {
+		w.slots[i] = map[*wheelTimer]struct{}{}
+	}
+
+	w.stopTicking = c.Tick(timerWheelGranularity, w.advance)
+
+	return w
+}
+
+// advance moves the wheel on one tick, running every timer that has expired
+func (w *timerWheel) advance() {
+	w.mu.Lock()
+
+	w.tick++
+	slot := w.slots[w.tick%timerWheelSlots]
+	expired := []*wheelTimer{}
+
+	for timer := range slot {
+		if timer.expiry <= w.tick {
+			delete(slot, timer)
+			timer.pending = false
+			expired = append(expired, timer)
+		}
+	}
+
+	w.mu.Unlock()
+
+	// Timers take their owner's locks, and often reset themselves, so they run with the wheel unlocked
+	for _, timer := range expired {
+		timer.f()
+	}
+}
+
+func (w *timerWheel) close() {
+	w.stopTicking()
+}
+
+func (w *timerWheel) newTimer(f func()) *wheelTimer {
+	return &wheelTimer{wheel: w, f: f}
+}
+
+// reset (re)starts the timer to expire d from now, rounded up to the next tick
+func (t *wheelTimer) reset(d time.Duration) {
+	w := t.wheel
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if t.pending {
+		delete(w.slots[t.expiry%timerWheelSlots], t)
+	}
+
+	ticks := max(1, uint64((d+timerWheelGranularity-1)/timerWheelGranularity))
+	t.expiry = w.tick + ticks
+	t.pending = true
+	w.slots[t.expiry%timerWheelSlots][t] = struct{}{}
+}
+
+func (t *wheelTimer) stop() {
+	w := t.wheel
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if t.pending {
+		delete(w.slots[t.expiry%timerWheelSlots], t)
+		t.pending = false
+	}
+}
+
+// isPending checks if the timer is waiting to expire. A timer that has fired but been reset
+// before its function got to run is pending again, which is how that function can tell it is stale.
+func (t *wheelTimer) isPending() bool {
+	w := t.wheel
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return t.pending
+}
@@ -0,0 +1,72 @@
+package stack
+
+import (
+	"testing"
+	"time"
+
+	"networking/internal/clock"
+)
+
+func Test_TimerWheel_FiresOnceDue(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	wheel := newTimerWheel(clk)
+	defer wheel.close()
+
+	fired := 0
+	timer := wheel.newTimer(func() { fired++ })
+	timer.reset(95 * time.Millisecond)
+
+	clk.Advance(90 * time.Millisecond)
+	if fired != 0 || !timer.isPending() {
+		t.Fatalf("expected the timer to still be pending, fired %d times", fired)
+	}
+
+	clk.Advance(10 * time.Millisecond)
+	if fired != 1 || timer.isPending() {
+		t.Fatalf("expected the timer to fire once, fired %d times", fired)
+	}
+}
+
+func Test_TimerWheel_GoesRoundMoreThanOnce(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	wheel := newTimerWheel(clk)
+	defer wheel.close()
+
+	var firedAt time.Duration
+	timer := wheel.newTimer(func() { firedAt = clk.Now().Sub(time.Unix(0, 0)) })
+	timer.reset(12 * time.Second)
+
+	clk.Advance(20 * time.Second)
+
+	if firedAt != 12*time.Second {
+		t.Errorf("expected the timer to fire at 12s, fired at %s", firedAt)
+	}
+}
+
+func Test_TimerWheel_StopAndReset(t *testing.T) {
+	clk := clock.NewFake(time.Unix(0, 0))
+	wheel := newTimerWheel(clk)
+	defer wheel.close()
+
+	fired := 0
+	timer := wheel.newTimer(func() { fired++ })
+
+	timer.reset(50 * time.Millisecond)
+	timer.stop()
+	clk.Advance(100 * time.Millisecond)
+
+	timer.reset(50 * time.Millisecond)
+	clk.Advance(30 * time.Millisecond)
+	timer.reset(50 * time.Millisecond)
+	clk.Advance(30 * time.Millisecond)
+
+	if fired != 0 {
+		t.Fatalf("expected stopped and reset timers not to fire, fired %d times", fired)
+	}
+
+	clk.Advance(30 * time.Millisecond)
+
+	if fired != 1 {
+		t.Errorf("expected the reset timer to fire once, fired %d times", fired)
+	}
+}
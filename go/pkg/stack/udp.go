@@ -0,0 +1,408 @@
+package stack
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"networking/internal/trace"
+	"networking/pkg/ipv4"
+	"networking/pkg/udp"
+)
+
+const (
+	udpReceiveQueueLength = 64
+
+	// IANA dynamic port range (RFC 6335)
+	firstEphemeralPort = 49152
+	lastEphemeralPort  = 65535
+)
+
+var ErrPortInUse = errors.New("address already in use")
+
+// udpDemux finds the socket bound to a datagram's destination
+type udpDemux struct {
+	mu      sync.RWMutex
+	sockets map[netip.AddrPort]*UDPConn
+	next    uint16
+}
+
+func newUDPDemux() *udpDemux {
+	return &udpDemux{
+		sockets: map[netip.AddrPort]*UDPConn{},
+		next:    firstEphemeralPort,
+	}
+}
+
+// bind reserves local for conn, picking an ephemeral port if local's port is zero
+func (d *udpDemux) bind(local netip.AddrPort, conn *UDPConn) (netip.AddrPort, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if local.Port() != 0 {
+		if d.isPortTaken(local) {
+			return netip.AddrPort{}, fmt.Errorf("%w: %s", ErrPortInUse, local)
+		}
+
+		d.sockets[local] = conn
+		return local, nil
+	}
+
+	for range lastEphemeralPort - firstEphemeralPort + 1 {
+		candidate := netip.AddrPortFrom(local.Addr(), d.next)
+
+		d.next++
+		if d.next == 0 || d.next < firstEphemeralPort {
+			d.next = firstEphemeralPort
+		}
+
+		if !d.isPortTaken(candidate) {
+			d.sockets[candidate] = conn
+			return candidate, nil
+		}
+	}
+
+	return netip.AddrPort{}, fmt.Errorf("%w: no ephemeral ports left", ErrPortInUse)
+}
+
+// isPortTaken checks for a socket on the same port that overlaps with local's address
+func (d *udpDemux) isPortTaken(local netip.AddrPort) bool {
+	for bound := range d.sockets {
+		if bound.Port() != local.Port() {
+			continue
+		}
+
+		if addressesOverlap(bound.Addr(), local.Addr()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// addressesOverlap checks if sockets bound to a and b would both receive for some address. The two versions'
+// wildcard addresses are separate, like Linux with the bindv6only sysctl set.
+func addressesOverlap(a, b netip.Addr) bool {
+	if a.Is4() != b.Is4() {
+		return false
+	}
+
+	return a == b || a.IsUnspecified() || b.IsUnspecified()
+}
+
+// wildcardFor is the unspecified address of addr's IP version, which a socket binds to for every address of it
+func wildcardFor(addr netip.Addr) netip.Addr {
+	if addr.Is6() {
+		return netip.IPv6Unspecified()
+	}
+
+	return netip.IPv4Unspecified()
+}
+
+// isPortInUse is isPortTaken for callers not holding the lock
+func (d *udpDemux) isPortInUse(local netip.AddrPort) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	return d.isPortTaken(local)
+}
+
+func (d *udpDemux) unbind(local netip.AddrPort) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.sockets, local)
+}
+
+// lookup prefers a socket bound to the exact address over one bound to the wildcard address
+func (d *udpDemux) lookup(destination netip.AddrPort) *UDPConn {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	if conn, ok := d.sockets[destination]; ok {
+		return conn
+	}
+
+	return d.sockets[netip.AddrPortFrom(wildcardFor(destination.Addr()), destination.Port())]
+}
+
+func (d *udpDemux) closeAll() {
+	d.mu.RLock()
+	conns := make([]*UDPConn, 0, len(d.sockets))
+	for _, conn := range d.sockets {
+		conns = append(conns, conn)
+	}
+	d.mu.RUnlock()
+
+	for _, conn := range conns {
+		_ = conn.Close()
+	}
+}
+
+// handleUDP delivers a datagram that arrived over either IP version to its socket. It returns false if no socket is
+// bound to the destination port, for the caller to report with its own version of ICMP.
+func (s *Stack) handleUDP(ctx context.Context, nic *Interface, source, destination netip.Addr, payload []byte) bool {
+	ctx, span := trace.StartSpan(ctx, "udp")
+	defer span.Finish()
+
+	datagram, err := udp.ParseRawUDPGram(ctx, payload)
+	if err != nil {
+		s.counters.UDP.InErrors.Inc()
+		trace.Annotate(ctx, trace.Malformed, "invalid UDP datagram", "error", err.Error())
+		return true
+	}
+
+	fields := []any{"src_port", datagram.SourcePort, "dst_port", datagram.DestinationPort, "len", datagram.Length}
+
+	if !datagram.IsChecksumValid(source, destination) {
+		s.counters.UDP.InErrors.Inc()
+		trace.Annotate(ctx, trace.ChecksumFailed, "UDP checksum failed", fields...)
+		return true
+	}
+
+	conn := s.udp.lookup(netip.AddrPortFrom(destination, datagram.DestinationPort))
+
+	if conn == nil {
+		s.counters.UDP.NoPorts.Inc()
+		trace.Annotate(ctx, trace.Dropped, "no listener on port", fields...)
+		return false
+	}
+
+	if !conn.deliver(ctx, netip.AddrPortFrom(source, datagram.SourcePort), datagram.Data) {
+		s.counters.UDP.InErrors.Inc()
+		return true
+	}
+
+	s.counters.UDP.InDatagrams.Inc()
+
+	return true
+}
+
+func (s *Stack) sendUDP(ctx context.Context, source, destination netip.AddrPort, data []byte, discovery pmtuDiscovery) error {
+	ctx, span := trace.StartSpan(ctx, "udp")
+	defer span.Finish()
+
+	if source.Addr().Is4() != destination.Addr().Is4() {
+		return fmt.Errorf("cannot send from %s to %s: different IP versions", source, destination)
+	}
+
+	sourceAddr := source.Addr()
+	if sourceAddr.IsUnspecified() {
+		var err error
+		if sourceAddr, err = s.localAddress(destination.Addr()); err != nil {
+			trace.Annotate(ctx, trace.Dropped, "no route", "dst_ip", destination.Addr().String())
+			return err
+		}
+	}
+
+	datagram := &udp.UDPGram{
+		SourcePort:      source.Port(),
+		DestinationPort: destination.Port(),
+		Data:            data,
+	}
+
+	raw, err := datagram.CreateUDPGramForAddresses(ctx, sourceAddr, destination.Addr())
+	if err != nil {
+		trace.Annotate(ctx, trace.Dropped, "failed to create UDP datagram", "error", err.Error())
+		return err
+	}
+
+	s.counters.UDP.OutDatagrams.Inc()
+
+	return s.sendIP(ctx, ipv4.ProtocolUDP, sourceAddr, destination.Addr(), raw, discovery)
+}
+
+type udpDatagram struct {
+	from netip.AddrPort
+	data []byte
+}
+
+// UDPConn is a UDP socket on the stack. It implements net.PacketConn, so code written against
+// the OS's sockets can run on the stack unchanged.
+type UDPConn struct {
+	stack *Stack
+	local netip.AddrPort
+
+	queue        chan udpDatagram
+	readDeadline *deadline
+	dontFragment atomic.Bool
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ net.PacketConn = (*UDPConn)(nil)
+
+// ListenUDP opens a UDP socket. An unspecified address receives on every interface, and port 0 picks an ephemeral port.
+func (s *Stack) ListenUDP(local netip.AddrPort) (*UDPConn, error) {
+	if !local.Addr().IsValid() {
+		local = netip.AddrPortFrom(netip.IPv4Unspecified(), local.Port())
+	}
+
+	if !local.Addr().IsUnspecified() && !s.hasAddress(local.Addr()) {
+		return nil, fmt.Errorf("cannot bind to %s: address not on any interface", local.Addr())
+	}
+
+	s.mu.RLock()
+	closed := s.closed
+	s.mu.RUnlock()
+
+	if closed {
+		return nil, ErrStackClosed
+	}
+
+	conn := &UDPConn{
+		stack:        s,
+		queue:        make(chan udpDatagram, udpReceiveQueueLength),
+		readDeadline: newDeadline(),
+		closed:       make(chan struct{}),
+	}
+
+	bound, err := s.udp.bind(local, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.local = bound
+
+	return conn, nil
+}
+
+// deliver queues a datagram for the application, dropping it if the application has fallen behind.
+// Returns whether the datagram was queued.
+func (c *UDPConn) deliver(ctx context.Context, from netip.AddrPort, data []byte) bool {
+	ctx, span := trace.StartSpan(ctx, "socket")
+	defer span.Finish()
+
+	fields := []any{"local", c.local.String(), "remote", from.String()}
+
+	select {
+	case <-c.closed:
+		trace.Annotate(ctx, trace.Dropped, "socket closed", fields...)
+		return false
+	default:
+	}
+
+	select {
+	case c.queue <- udpDatagram{from: from, data: data}:
+		trace.Annotate(ctx, trace.Delivered, "datagram queued on socket", fields...)
+		return true
+	default:
+		trace.Annotate(ctx, trace.Dropped, "socket receive queue full", fields...)
+		return false
+	}
+}
+
+// ReadFromUDPAddrPort reads a datagram, returning the address it came from
+func (c *UDPConn) ReadFromUDPAddrPort(p []byte) (int, netip.AddrPort, error) {
+	select {
+	case datagram := <-c.queue:
+		// Like the OS, anything that does not fit in p is discarded
+		return copy(p, datagram.data), datagram.from, nil
+	case <-c.closed:
+		return 0, netip.AddrPort{}, net.ErrClosed
+	case <-c.readDeadline.wait():
+		return 0, netip.AddrPort{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *UDPConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, from, err := c.ReadFromUDPAddrPort(p)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return n, net.UDPAddrFromAddrPort(from), nil
+}
+
+// WriteToUDPAddrPort sends a datagram. Writes never block, so write deadlines have no effect.
+func (c *UDPConn) WriteToUDPAddrPort(p []byte, addr netip.AddrPort) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	ctx, tr := c.stack.startTrace()
+	defer tr.Finish()
+
+	// Like Linux, datagrams take part in path MTU discovery when they fit, and are fragmented when they do not
+	discovery := pmtuDiscoveryWant
+	if c.dontFragment.Load() {
+		discovery = pmtuDiscoveryDo
+	}
+
+	if err := c.stack.sendUDP(ctx, c.local, addr, p, discovery); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+func (c *UDPConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, fmt.Errorf("unsupported address type %T", addr)
+	}
+
+	addrPort := udpAddr.AddrPort()
+
+	return c.WriteToUDPAddrPort(p, netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()))
+}
+
+func (c *UDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.stack.udp.unbind(c.local)
+	})
+
+	return nil
+}
+
+func (c *UDPConn) LocalAddr() net.Addr {
+	return net.UDPAddrFromAddrPort(c.local)
+}
+
+// SetDontFragment makes datagrams larger than the path MTU fail with ErrMessageTooLong instead of going in
+// fragments, so the application can size them itself, like IP_PMTUDISC_DO or IPV6_DONTFRAG
+func (c *UDPConn) SetDontFragment(dontFragment bool) {
+	c.dontFragment.Store(dontFragment)
+}
+
+// PathMTU is the largest packet, IP header included, that currently reaches destination in one piece, like
+// getsockopt with IP_MTU or IPV6_MTU. It starts out as the MTU of the link destination is reached through, and
+// goes down as routers on the way say packets were too big.
+func (c *UDPConn) PathMTU(destination netip.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	nic, err := c.stack.routeInterface(destination)
+	if err != nil {
+		return 0, err
+	}
+
+	return c.stack.pathMTU(nic, destination), nil
+}
+
+func (c *UDPConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *UDPConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+
+	return nil
+}
+
+func (c *UDPConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
@@ -0,0 +1,310 @@
+package tcp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"networking/internal/byte_helpers"
+	"networking/internal/logger"
+	"networking/pkg/ipv4"
+	"networking/pkg/ipv6"
+)
+
+const (
+	MinHeaderLength  = 20
+	MaxHeaderLength  = 60
+	MaxOptionsLength = MaxHeaderLength - MinHeaderLength
+)
+
+// Flags are the control bits of a segment (RFC 9293 3.1, with CWR and ECE from RFC 3168)
+type Flags uint8
+
+const (
+	FlagFIN Flags = 1 << iota
+	FlagSYN
+	FlagRST
+	FlagPSH
+	FlagACK
+	FlagURG
+	FlagECE
+	FlagCWR
+)
+
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{FlagCWR, "CWR"},
+	{FlagECE, "ECE"},
+	{FlagURG, "URG"},
+	{FlagACK, "ACK"},
+	{FlagPSH, "PSH"},
+	{FlagRST, "RST"},
+	{FlagSYN, "SYN"},
+	{FlagFIN, "FIN"},
+}
+
+// Has checks that every flag in other is set
+func (f Flags) Has(other Flags) bool {
+	return f&other == other
+}
+
+func (f Flags) String() string {
+	names := []string{}
+
+	for _, flagName := range flagNames {
+		if f.Has(flagName.flag) {
+			names = append(names, flagName.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return "none"
+	}
+
+	return strings.Join(names, "|")
+}
+
+// ParseFlags is the reverse of String, taking flag names joined by "|" in any order and case
+func ParseFlags(s string) (Flags, error) {
+	if strings.EqualFold(s, "none") {
+		return 0, nil
+	}
+
+	var flags Flags
+
+	for name := range strings.SplitSeq(s, "|") {
+		known := false
+
+		for _, flagName := range flagNames {
+			if strings.EqualFold(flagName.name, name) {
+				flags |= flagName.flag
+				known = true
+			}
+		}
+
+		if !known {
+			return 0, fmt.Errorf("unknown TCP flag %q", name)
+		}
+	}
+
+	return flags, nil
+}
+
+// Errors returned, wrapped, by ParseRawSegment and CreateSegment
+var (
+	ErrSegmentTooShort         = errors.New("TCP segment too short")
+	ErrInvalidDataOffset       = errors.New("invalid TCP data offset")
+	ErrInvalidDestinationPort  = errors.New("invalid TCP destination port")
+	ErrInvalidChecksum         = errors.New("invalid TCP checksum")
+	ErrUnsupportedAddressTypes = errors.New("unsupported TCP address types")
+)
+
+// Segment represents a TCP segment (RFC 9293)
+type Segment struct {
+	SourcePort           uint16
+	DestinationPort      uint16
+	SequenceNumber       uint32
+	AcknowledgmentNumber uint32
+	DataOffset           uint8 // Header length in 32-bit words
+	Flags                Flags
+	Window               uint16
+	Checksum             uint16
+	UrgentPointer        uint16
+	Options              []Option
+	Data                 []byte
+}
+
+// SegmentLength is the amount of sequence space the segment takes up: its data plus one each for SYN and FIN
+func (s *Segment) SegmentLength() uint32 {
+	length := uint32(len(s.Data))
+
+	if s.Flags.Has(FlagSYN) {
+		length++
+	}
+
+	if s.Flags.Has(FlagFIN) {
+		length++
+	}
+
+	return length
+}
+
+// FindOption returns the first option of the given kind
+func (s *Segment) FindOption(kind OptionKind) (Option, bool) {
+	for _, option := range s.Options {
+		if option.Kind == kind {
+			return option, true
+		}
+	}
+
+	return Option{}, false
+}
+
+// MSS returns the maximum segment size option, which is only valid on SYNs
+func (s *Segment) MSS() (uint16, bool) {
+	option, ok := s.FindOption(OptionMSS)
+	return option.MSS, ok
+}
+
+// WindowScale returns the window scale shift count, clamped to 14 as RFC 7323 requires
+func (s *Segment) WindowScale() (uint8, bool) {
+	option, ok := s.FindOption(OptionWindowScale)
+	return min(option.WindowScale, MaxWindowScale), ok
+}
+
+func (s *Segment) SACKPermitted() bool {
+	_, ok := s.FindOption(OptionSACKPermitted)
+	return ok
+}
+
+func (s *Segment) SACKBlocks() []SACKBlock {
+	option, _ := s.FindOption(OptionSACK)
+	return option.SACKBlocks
+}
+
+func (s *Segment) Timestamps() (tsVal, tsEcr uint32, ok bool) {
+	option, ok := s.FindOption(OptionTimestamps)
+	return option.TSVal, option.TSEcr, ok
+}
+
+// CreateSegment Function to create a raw TCP segment from the Segment struct, with the checksum computed
+// over the pseudo-header for source and destination. DataOffset and Checksum are written back to the struct.
+func (s *Segment) CreateSegment(ctx context.Context, source, destination netip.Addr) ([]byte, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil).With(
+		"src_port", s.SourcePort,
+		"dst_port", s.DestinationPort,
+		"flags", s.Flags.String(),
+	)
+
+	if s.DestinationPort == 0 {
+		err := fmt.Errorf("%w: %d", ErrInvalidDestinationPort, s.DestinationPort)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	if !sameFamily(source, destination) {
+		err := fmt.Errorf("%w: %s and %s", ErrUnsupportedAddressTypes, source, destination)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	options, err := encodeOptions(s.Options)
+	if err != nil {
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	headerLength := MinHeaderLength + len(options)
+	s.DataOffset = uint8(headerLength / 4)
+
+	header := make([]byte, MinHeaderLength, headerLength)
+	copy(header[0:2], bytehelpers.Uint16ToByteArray(s.SourcePort))
+	copy(header[2:4], bytehelpers.Uint16ToByteArray(s.DestinationPort))
+	copy(header[4:8], bytehelpers.Uint32ToByteArray(s.SequenceNumber))
+	copy(header[8:12], bytehelpers.Uint32ToByteArray(s.AcknowledgmentNumber))
+	header[12] = s.DataOffset << 4
+	header[13] = byte(s.Flags)
+	copy(header[14:16], bytehelpers.Uint16ToByteArray(s.Window))
+	copy(header[18:20], bytehelpers.Uint16ToByteArray(s.UrgentPointer))
+	header = append(header, options...)
+
+	raw := bytehelpers.ConcatenateByteArrays(header, s.Data)
+
+	s.Checksum = pseudoHeaderSum(source, destination, len(raw)).Add(raw).Finalize()
+	copy(raw[16:18], bytehelpers.Uint16ToByteArray(s.Checksum))
+
+	return raw, nil
+}
+
+// ParseRawSegment Function to parse a raw TCP segment into a Segment struct.
+// TCP checksums are mandatory, so the segment is verified against the addresses it was sent between.
+func ParseRawSegment(ctx context.Context, data []byte, source, destination netip.Addr) (*Segment, error) {
+	logger := logger.GetLoggerFromContext(ctx, nil)
+
+	if len(data) < MinHeaderLength {
+		err := fmt.Errorf("%w: %d bytes", ErrSegmentTooShort, len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	segment := &Segment{
+		SourcePort:           bytehelpers.ByteArrayToUint16(data[0:2]),
+		DestinationPort:      bytehelpers.ByteArrayToUint16(data[2:4]),
+		SequenceNumber:       bytehelpers.ByteArrayToUint32(data[4:8]),
+		AcknowledgmentNumber: bytehelpers.ByteArrayToUint32(data[8:12]),
+		DataOffset:           data[12] >> 4,
+		Flags:                Flags(data[13]),
+		Window:               bytehelpers.ByteArrayToUint16(data[14:16]),
+		Checksum:             bytehelpers.ByteArrayToUint16(data[16:18]),
+		UrgentPointer:        bytehelpers.ByteArrayToUint16(data[18:20]),
+	}
+
+	logger = logger.With(
+		"src_port", segment.SourcePort,
+		"dst_port", segment.DestinationPort,
+		"flags", segment.Flags.String(),
+	)
+
+	headerLength := int(segment.DataOffset) * 4
+	if headerLength < MinHeaderLength || headerLength > len(data) {
+		err := fmt.Errorf("%w: %d words for a %d byte segment", ErrInvalidDataOffset, segment.DataOffset, len(data))
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	if segment.DestinationPort == 0 {
+		err := fmt.Errorf("%w: %d", ErrInvalidDestinationPort, segment.DestinationPort)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	if !sameFamily(source, destination) {
+		err := fmt.Errorf("%w: %s and %s", ErrUnsupportedAddressTypes, source, destination)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	if pseudoHeaderSum(source, destination, len(data)).Add(data).Fold() != 0xFFFF {
+		err := fmt.Errorf("%w: %#04x", ErrInvalidChecksum, segment.Checksum)
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	options, err := decodeOptions(data[MinHeaderLength:headerLength])
+	if err != nil {
+		logger.Error(err.Error())
+
+		return nil, err
+	}
+
+	segment.Options = options
+	segment.Data = data[headerLength:]
+
+	return segment, nil
+}
+
+// sameFamily checks that a segment is between two IPv4 or two IPv6 addresses, the only pairs that have a
+// pseudo-header
+func sameFamily(source, destination netip.Addr) bool {
+	return (source.Is4() && destination.Is4()) || (source.Is6() && destination.Is6())
+}
+
+func pseudoHeaderSum(source, destination netip.Addr, length int) bytehelpers.Sum {
+	if source.Is6() {
+		return ipv6.PseudoHeaderSum(source, destination, ipv6.NextHeaderTCP, length)
+	}
+
+	return ipv4.PseudoHeaderSum(source, destination, ipv4.ProtocolTCP, length)
+}
@@ -0,0 +1,239 @@
+package tcp
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"networking/internal/logger"
+	testhelpers "networking/internal/test_helpers"
+)
+
+// A SYN over loopback from 40000 to 8080, with the options Linux sends: MSS, SACK permitted, timestamps, NOP and window scale
+const linuxSYNSegment = "9c401f901234567800000000a002ffd7279d00000204ffd70402080a000003e80000000001030307"
+
+var loopback = netip.MustParseAddr("127.0.0.1")
+
+func Test_Parse_LinuxSYN(t *testing.T) {
+	input, _ := hex.DecodeString(linuxSYNSegment)
+
+	actual, err := ParseRawSegment(context.TODO(), input, loopback, loopback)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if actual.SourcePort != 40000 || actual.DestinationPort != 8080 || actual.SequenceNumber != 0x12345678 {
+		t.Errorf("Unexpected header fields: %+v", actual)
+	}
+
+	if actual.Flags != FlagSYN || actual.DataOffset != 10 || actual.Window != 65495 || actual.SegmentLength() != 1 {
+		t.Errorf("Unexpected header fields: %+v", actual)
+	}
+
+	if mss, ok := actual.MSS(); !ok || mss != 65495 {
+		t.Errorf("Expected MSS 65495, got %d (%v)", mss, ok)
+	}
+
+	if shift, ok := actual.WindowScale(); !ok || shift != 7 {
+		t.Errorf("Expected window scale 7, got %d (%v)", shift, ok)
+	}
+
+	if tsVal, tsEcr, ok := actual.Timestamps(); !ok || tsVal != 1000 || tsEcr != 0 {
+		t.Errorf("Expected timestamps 1000/0, got %d/%d (%v)", tsVal, tsEcr, ok)
+	}
+
+	if !actual.SACKPermitted() {
+		t.Errorf("Expected SACK to be permitted")
+	}
+}
+
+func Test_Parse_BadChecksum(t *testing.T) {
+	lctx := logger.PrepTest()
+	input, _ := hex.DecodeString(linuxSYNSegment)
+	input[15] ^= 0x01 // Change the window without fixing the checksum
+
+	_, err := ParseRawSegment(*lctx, input, loopback, loopback)
+
+	if !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("Expected ErrInvalidChecksum, got %v", err)
+	}
+}
+
+func Test_Parse_WrongPseudoHeader(t *testing.T) {
+	input, _ := hex.DecodeString(linuxSYNSegment)
+
+	_, err := ParseRawSegment(context.TODO(), input, loopback, netip.MustParseAddr("127.0.0.2"))
+
+	if !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("Expected ErrInvalidChecksum, got %v", err)
+	}
+}
+
+func Test_Parse_TooShort(t *testing.T) {
+	input, _ := hex.DecodeString(linuxSYNSegment)
+
+	_, err := ParseRawSegment(context.TODO(), input[:19], loopback, loopback)
+
+	if !errors.Is(err, ErrSegmentTooShort) {
+		t.Errorf("Expected ErrSegmentTooShort, got %v", err)
+	}
+}
+
+func Test_Parse_DataOffsetPastEnd(t *testing.T) {
+	input, _ := hex.DecodeString(linuxSYNSegment)
+
+	_, err := ParseRawSegment(context.TODO(), input[:24], loopback, loopback)
+
+	if !errors.Is(err, ErrInvalidDataOffset) {
+		t.Errorf("Expected ErrInvalidDataOffset, got %v", err)
+	}
+}
+
+func Test_Parse_DataOffsetTooSmall(t *testing.T) {
+	input, _ := hex.DecodeString(linuxSYNSegment)
+	input[12] = 0x40
+
+	_, err := ParseRawSegment(context.TODO(), input, loopback, loopback)
+
+	if !errors.Is(err, ErrInvalidDataOffset) {
+		t.Errorf("Expected ErrInvalidDataOffset, got %v", err)
+	}
+}
+
+func Test_Parse_MixedFamilies(t *testing.T) {
+	input, _ := hex.DecodeString(linuxSYNSegment)
+
+	_, err := ParseRawSegment(context.TODO(), input, loopback, netip.IPv6Loopback())
+
+	if !errors.Is(err, ErrUnsupportedAddressTypes) {
+		t.Errorf("Expected ErrUnsupportedAddressTypes, got %v", err)
+	}
+}
+
+func Test_CreateAndParse_IPv6PseudoHeader(t *testing.T) {
+	source := netip.MustParseAddr("2001:db8::1")
+	destination := netip.MustParseAddr("2001:db8::2")
+	segment := Segment{SourcePort: 1234, DestinationPort: 80, Flags: FlagACK, Window: 512, Data: []byte("over IPv6")}
+
+	raw, err := segment.CreateSegment(context.TODO(), source, destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	_, err = ParseRawSegment(context.TODO(), raw, source, destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if _, err := ParseRawSegment(context.TODO(), raw, source, netip.MustParseAddr("2001:db8::3")); !errors.Is(err, ErrInvalidChecksum) {
+		t.Errorf("Expected ErrInvalidChecksum against a different destination, got %v", err)
+	}
+}
+
+func Test_Create_MatchesLinuxSYN(t *testing.T) {
+	expected, _ := hex.DecodeString(linuxSYNSegment)
+	segment := Segment{
+		SourcePort:      40000,
+		DestinationPort: 8080,
+		SequenceNumber:  0x12345678,
+		Flags:           FlagSYN,
+		Window:          65495,
+		Options: []Option{
+			NewMSSOption(65495),
+			NewSACKPermittedOption(),
+			NewTimestampsOption(1000, 0),
+			NewNoOperationOption(),
+			NewWindowScaleOption(7),
+		},
+	}
+
+	actual, err := segment.CreateSegment(context.TODO(), loopback, loopback)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !bytes.Equal(actual, expected) {
+		t.Errorf("Created segment does not match.\nExpected: %x\nActual:   %x", expected, actual)
+	}
+
+	if segment.DataOffset != 10 || segment.Checksum != 0x279d {
+		t.Errorf("Expected DataOffset and Checksum to be written back, got %d and %#04x", segment.DataOffset, segment.Checksum)
+	}
+}
+
+func Test_CreateAndParse_RoundTrip(t *testing.T) {
+	source := netip.MustParseAddr("10.0.0.1")
+	destination := netip.MustParseAddr("10.0.0.2")
+	segment := Segment{
+		SourcePort:           1234,
+		DestinationPort:      80,
+		SequenceNumber:       1000,
+		AcknowledgmentNumber: 2000,
+		Flags:                FlagACK | FlagPSH | FlagECE | FlagCWR,
+		Window:               512,
+		UrgentPointer:        0,
+		Options: []Option{
+			NewNoOperationOption(),
+			NewNoOperationOption(),
+			NewSACKOption(SACKBlock{Left: 3000, Right: 4000}, SACKBlock{Left: 5000, Right: 6000}),
+		},
+		Data: []byte("odd length"),
+	}
+
+	raw, err := segment.CreateSegment(context.TODO(), source, destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	actual, err := ParseRawSegment(context.TODO(), raw, source, destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !reflect.DeepEqual(*actual, segment) {
+		t.Errorf("Parsed segment does not match.\nExpected: %+v\nActual:   %+v", segment, *actual)
+	}
+
+	if actual.Flags.String() != "CWR|ECE|ACK|PSH" {
+		t.Errorf("Unexpected flags string %q", actual.Flags.String())
+	}
+}
+
+func Test_Create_InvalidDestinationPort(t *testing.T) {
+	lctx := logger.PrepTest()
+	segment := Segment{SourcePort: 1234, Flags: FlagSYN}
+
+	_, err := segment.CreateSegment(*lctx, loopback, loopback)
+
+	if !errors.Is(err, ErrInvalidDestinationPort) {
+		t.Errorf("Expected ErrInvalidDestinationPort, got %v", err)
+	}
+}
+
+func Test_Create_OptionsTooLong(t *testing.T) {
+	segment := Segment{
+		SourcePort:      1234,
+		DestinationPort: 80,
+		Options: []Option{
+			NewTimestampsOption(1, 2),
+			NewSACKOption(SACKBlock{1, 2}, SACKBlock{3, 4}, SACKBlock{5, 6}, SACKBlock{7, 8}),
+		},
+	}
+
+	_, err := segment.CreateSegment(context.TODO(), loopback, loopback)
+
+	if !errors.Is(err, ErrInvalidOption) {
+		t.Errorf("Expected ErrInvalidOption, got %v", err)
+	}
+}
+
+func Test_ParseFlags_ReversesString(t *testing.T) {
+	for _, flags := range []Flags{0, FlagSYN, FlagSYN | FlagACK, FlagFIN | FlagPSH | FlagURG | FlagCWR} {
+		parsed, err := ParseFlags(flags.String())
+		testhelpers.FailTestIfErrorIsPresent(t, err)
+
+		if parsed != flags {
+			t.Errorf("expected %s back, got %s", flags, parsed)
+		}
+	}
+
+	if parsed, err := ParseFlags("syn|Ack"); err != nil || parsed != FlagSYN|FlagACK {
+		t.Errorf("expected names in any case, got %s and %v", parsed, err)
+	}
+
+	if _, err := ParseFlags("SYN|XMAS"); err == nil {
+		t.Errorf("expected an unknown flag to be rejected")
+	}
+}
@@ -0,0 +1,243 @@
+package tcp
+
+import (
+	"errors"
+	"fmt"
+
+	"networking/internal/byte_helpers"
+)
+
+// OptionKind is the first byte of every TCP option
+type OptionKind uint8
+
+const (
+	OptionEndOfList     OptionKind = 0 // RFC 9293
+	OptionNoOperation   OptionKind = 1 // RFC 9293
+	OptionMSS           OptionKind = 2 // RFC 9293
+	OptionWindowScale   OptionKind = 3 // RFC 7323
+	OptionSACKPermitted OptionKind = 4 // RFC 2018
+	OptionSACK          OptionKind = 5 // RFC 2018
+	OptionTimestamps    OptionKind = 8 // RFC 7323
+)
+
+// Fixed lengths of the options we understand, kind and length bytes included
+const (
+	mssOptionLength           = 4
+	windowScaleOptionLength   = 3
+	sackPermittedOptionLength = 2
+	timestampsOptionLength    = 10
+	sackBlockLength           = 8
+
+	// RFC 7323 2.3: shift counts above 14 are treated as 14
+	MaxWindowScale = 14
+)
+
+var ErrInvalidOption = errors.New("invalid TCP option")
+
+// OptionError says which option could not be decoded and why. It unwraps to ErrInvalidOption.
+type OptionError struct {
+	Kind   OptionKind
+	Offset int
+	Reason string
+}
+
+func (e *OptionError) Error() string {
+	return fmt.Sprintf("%s: kind %d at offset %d: %s", ErrInvalidOption, e.Kind, e.Offset, e.Reason)
+}
+
+func (e *OptionError) Unwrap() error {
+	return ErrInvalidOption
+}
+
+// SACKBlock is one contiguous block of data the receiver holds beyond the cumulative ACK (RFC 2018)
+type SACKBlock struct {
+	Left  uint32 // First sequence number of the block
+	Right uint32 // Sequence number just after the block
+}
+
+// Option is a single decoded TCP option. Only the fields for its Kind are set.
+// Options are kept in wire order, NOPs included, so a parsed segment encodes back to the same bytes.
+type Option struct {
+	Kind OptionKind
+
+	MSS         uint16
+	WindowScale uint8
+	SACKBlocks  []SACKBlock
+	TSVal       uint32
+	TSEcr       uint32
+
+	// The value bytes of an option kind we do not understand, after the kind and length bytes
+	Data []byte
+}
+
+func NewMSSOption(mss uint16) Option {
+	return Option{Kind: OptionMSS, MSS: mss}
+}
+
+func NewWindowScaleOption(shift uint8) Option {
+	return Option{Kind: OptionWindowScale, WindowScale: shift}
+}
+
+func NewSACKPermittedOption() Option {
+	return Option{Kind: OptionSACKPermitted}
+}
+
+func NewSACKOption(blocks ...SACKBlock) Option {
+	return Option{Kind: OptionSACK, SACKBlocks: blocks}
+}
+
+func NewTimestampsOption(tsVal, tsEcr uint32) Option {
+	return Option{Kind: OptionTimestamps, TSVal: tsVal, TSEcr: tsEcr}
+}
+
+func NewNoOperationOption() Option {
+	return Option{Kind: OptionNoOperation}
+}
+
+// encode appends the option's wire form to buffer
+func (o *Option) encode(buffer []byte) ([]byte, error) {
+	switch o.Kind {
+	case OptionEndOfList, OptionNoOperation:
+		return append(buffer, byte(o.Kind)), nil
+	case OptionMSS:
+		buffer = append(buffer, byte(o.Kind), mssOptionLength)
+		return append(buffer, bytehelpers.Uint16ToByteArray(o.MSS)...), nil
+	case OptionWindowScale:
+		return append(buffer, byte(o.Kind), windowScaleOptionLength, o.WindowScale), nil
+	case OptionSACKPermitted:
+		return append(buffer, byte(o.Kind), sackPermittedOptionLength), nil
+	case OptionSACK:
+		if len(o.SACKBlocks) == 0 || len(o.SACKBlocks) > 4 {
+			return nil, &OptionError{Kind: o.Kind, Offset: len(buffer), Reason: fmt.Sprintf("%d SACK blocks", len(o.SACKBlocks))}
+		}
+
+		buffer = append(buffer, byte(o.Kind), byte(2+sackBlockLength*len(o.SACKBlocks)))
+		for _, block := range o.SACKBlocks {
+			buffer = append(buffer, bytehelpers.Uint32ToByteArray(block.Left)...)
+			buffer = append(buffer, bytehelpers.Uint32ToByteArray(block.Right)...)
+		}
+
+		return buffer, nil
+	case OptionTimestamps:
+		buffer = append(buffer, byte(o.Kind), timestampsOptionLength)
+		buffer = append(buffer, bytehelpers.Uint32ToByteArray(o.TSVal)...)
+		return append(buffer, bytehelpers.Uint32ToByteArray(o.TSEcr)...), nil
+	default:
+		if len(o.Data) > 38 {
+			return nil, &OptionError{Kind: o.Kind, Offset: len(buffer), Reason: "value too long"}
+		}
+
+		buffer = append(buffer, byte(o.Kind), byte(2+len(o.Data)))
+		return append(buffer, o.Data...), nil
+	}
+}
+
+// encodeOptions returns the options padded with zeroes (end of list) to a 4 byte boundary
+func encodeOptions(options []Option) ([]byte, error) {
+	buffer := []byte{}
+
+	for i := range options {
+		var err error
+		if buffer, err = options[i].encode(buffer); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(buffer) > MaxOptionsLength {
+		return nil, &OptionError{Kind: options[len(options)-1].Kind, Offset: len(buffer), Reason: "options longer than 40 bytes"}
+	}
+
+	for len(buffer)%4 != 0 {
+		buffer = append(buffer, byte(OptionEndOfList))
+	}
+
+	return buffer, nil
+}
+
+// decodeOptions parses the options area of a header. Decoding stops at an end of list option;
+// whatever follows it is padding.
+func decodeOptions(data []byte) ([]Option, error) {
+	options := []Option{}
+
+	for offset := 0; offset < len(data); {
+		kind := OptionKind(data[offset])
+
+		if kind == OptionEndOfList {
+			options = append(options, Option{Kind: kind})
+			return options, nil
+		}
+
+		if kind == OptionNoOperation {
+			options = append(options, Option{Kind: kind})
+			offset++
+			continue
+		}
+
+		if offset+1 >= len(data) {
+			return nil, &OptionError{Kind: kind, Offset: offset, Reason: "missing length"}
+		}
+
+		length := int(data[offset+1])
+		if length < 2 || offset+length > len(data) {
+			return nil, &OptionError{Kind: kind, Offset: offset, Reason: fmt.Sprintf("invalid length %d", length)}
+		}
+
+		option, err := decodeOption(kind, data[offset+2:offset+length], offset)
+		if err != nil {
+			return nil, err
+		}
+
+		options = append(options, option)
+		offset += length
+	}
+
+	return options, nil
+}
+
+func decodeOption(kind OptionKind, value []byte, offset int) (Option, error) {
+	option := Option{Kind: kind}
+	wrongLength := func(expected int) error {
+		return &OptionError{Kind: kind, Offset: offset, Reason: fmt.Sprintf("length %d, expected %d", len(value)+2, expected)}
+	}
+
+	switch kind {
+	case OptionMSS:
+		if len(value)+2 != mssOptionLength {
+			return option, wrongLength(mssOptionLength)
+		}
+
+		option.MSS = bytehelpers.ByteArrayToUint16(value)
+	case OptionWindowScale:
+		if len(value)+2 != windowScaleOptionLength {
+			return option, wrongLength(windowScaleOptionLength)
+		}
+
+		option.WindowScale = value[0]
+	case OptionSACKPermitted:
+		if len(value)+2 != sackPermittedOptionLength {
+			return option, wrongLength(sackPermittedOptionLength)
+		}
+	case OptionSACK:
+		if len(value) == 0 || len(value)%sackBlockLength != 0 {
+			return option, &OptionError{Kind: kind, Offset: offset, Reason: fmt.Sprintf("length %d is not a whole number of blocks", len(value)+2)}
+		}
+
+		for i := 0; i < len(value); i += sackBlockLength {
+			option.SACKBlocks = append(option.SACKBlocks, SACKBlock{
+				Left:  bytehelpers.ByteArrayToUint32(value[i : i+4]),
+				Right: bytehelpers.ByteArrayToUint32(value[i+4 : i+8]),
+			})
+		}
+	case OptionTimestamps:
+		if len(value)+2 != timestampsOptionLength {
+			return option, wrongLength(timestampsOptionLength)
+		}
+
+		option.TSVal = bytehelpers.ByteArrayToUint32(value[0:4])
+		option.TSEcr = bytehelpers.ByteArrayToUint32(value[4:8])
+	default:
+		option.Data = value
+	}
+
+	return option, nil
+}
@@ -0,0 +1,66 @@
+package tcp
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	testhelpers "networking/internal/test_helpers"
+)
+
+func Test_DecodeOptions_StopsAtEndOfList(t *testing.T) {
+	input := []byte{0x01, 0x00, 0x02, 0x04}
+	expected := []Option{{Kind: OptionNoOperation}, {Kind: OptionEndOfList}}
+
+	actual, err := decodeOptions(input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("decodeOptions(%x) = %+v; want %+v", input, actual, expected)
+	}
+}
+
+func Test_DecodeOptions_KeepsUnknownOptions(t *testing.T) {
+	input := []byte{0x1E, 0x04, 0xAB, 0xCD}
+
+	actual, err := decodeOptions(input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(actual) != 1 || actual[0].Kind != 30 || !reflect.DeepEqual(actual[0].Data, []byte{0xAB, 0xCD}) {
+		t.Errorf("Expected unknown option 30 with its value, got %+v", actual)
+	}
+
+	encoded, err := encodeOptions(actual)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !reflect.DeepEqual(encoded, input) {
+		t.Errorf("Expected unknown option to encode back to %x, got %x", input, encoded)
+	}
+}
+
+func Test_DecodeOptions_WindowScaleIsClamped(t *testing.T) {
+	segment := Segment{Options: []Option{NewWindowScaleOption(20)}}
+
+	if shift, _ := segment.WindowScale(); shift != MaxWindowScale {
+		t.Errorf("Expected window scale to be clamped to %d, got %d", MaxWindowScale, shift)
+	}
+}
+
+func Test_DecodeOptions_Errors(t *testing.T) {
+	tests := map[string][]byte{
+		"missing length":     {0x02},
+		"length too short":   {0x02, 0x01, 0x00, 0x00},
+		"length past end":    {0x08, 0x0A, 0x00, 0x00},
+		"wrong MSS length":   {0x02, 0x03, 0x00, 0x00},
+		"partial SACK block": {0x05, 0x06, 0x00, 0x00, 0x00, 0x00},
+	}
+
+	for name, input := range tests {
+		_, err := decodeOptions(input)
+
+		var optionError *OptionError
+		if !errors.Is(err, ErrInvalidOption) || !errors.As(err, &optionError) {
+			t.Errorf("%s: expected an OptionError, got %v", name, err)
+		}
+	}
+}
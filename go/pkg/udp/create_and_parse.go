@@ -3,11 +3,20 @@ package udp
 import (
 	"context"
 	"fmt"
+	"net/netip"
 
 	"networking/internal/byte_helpers"
 	"networking/internal/logger"
+	"networking/pkg/ipv4"
+	"networking/pkg/ipv6"
 )
 
+const HeaderLength = 8
+
+// MaxDataLength is the most data a datagram can carry, since its 16 bit length field counts the header too. Over
+// IPv4, the IP header leaves less room than this.
+const MaxDataLength = 0xFFFF - HeaderLength
+
 // UDPGram represents a UDP datagram structure
 type UDPGram struct {
 	SourcePort      uint16
@@ -40,8 +49,8 @@ func (h *UDPGram) NewUDPGram(ctx *context.Context, sourcePort, destinationPort *
 		return nil, err
 	}
 
-	if len(*data) == 0 {
-		err := fmt.Errorf("data cannot be empty")
+	if len(*data) > MaxDataLength {
+		err := fmt.Errorf("data too long for a UDP datagram: %d bytes, at most %d", len(*data), MaxDataLength)
 		logger.Error(err.Error())
 
 		return nil, err
@@ -61,7 +70,11 @@ func (h *UDPGram) NewUDPGram(ctx *context.Context, sourcePort, destinationPort *
 
 // CreateUDPGram Function to create a raw UDP datagram byte array from the UDPGram struct
 func (h *UDPGram) CreateUDPGram(ctx *context.Context) ([]byte, error) {
-	logger := logger.GetLoggerFromContext(*ctx, nil)
+	logger := logger.GetLoggerFromContext(*ctx, nil).With(
+		"src_port", h.SourcePort,
+		"dst_port", h.DestinationPort,
+		"len", 8+len(h.Data),
+	)
 
 	if h.DestinationPort == 0 {
 		err := fmt.Errorf("invalid destination port value: %d", h.DestinationPort)
@@ -70,8 +83,10 @@ func (h *UDPGram) CreateUDPGram(ctx *context.Context) ([]byte, error) {
 		return nil, err
 	}
 
-	if len(h.Data) == 0 {
-		err := fmt.Errorf("data cannot be empty")
+	// Empty datagrams are allowed and carry nothing but the header (RFC 768). OS sockets send them, so the stack
+	// has to as well to interoperate.
+	if len(h.Data) > MaxDataLength {
+		err := fmt.Errorf("data too long for a UDP datagram: %d bytes, at most %d", len(h.Data), MaxDataLength)
 		logger.Error(err.Error())
 
 		return nil, err
@@ -96,18 +111,90 @@ func (h *UDPGram) CreateUDPGram(ctx *context.Context) ([]byte, error) {
 	return header, nil
 }
 
+// CreateUDPGramForAddresses Function to create a raw UDP datagram with the checksum computed over
+// the RFC 768 pseudo-header, or the RFC 8200 one for IPv6 addresses, which is what a receiving host will verify.
+// Length and Checksum are written back to the struct.
+func (h *UDPGram) CreateUDPGramForAddresses(ctx context.Context, source, destination netip.Addr) ([]byte, error) {
+	if source.Is4() != destination.Is4() {
+		err := fmt.Errorf("UDP addresses must be the same family: source %s, destination %s", source, destination)
+		logger.GetLoggerFromContext(ctx, nil).Error(err.Error())
+
+		return nil, err
+	}
+
+	raw, err := h.CreateUDPGram(&ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	raw[6], raw[7] = 0, 0
+	checksum := pseudoHeaderSum(source, destination, len(raw)).Add(raw).Finalize()
+
+	// A computed checksum of zero is sent as all ones, since zero on the wire means no checksum was computed
+	if checksum == 0 {
+		checksum = 0xFFFF
+	}
+
+	h.Length = uint16(len(raw))
+	h.Checksum = checksum
+	copy(raw[6:8], bytehelpers.Uint16ToByteArray(checksum))
+
+	return raw, nil
+}
+
+// IsChecksumValid Function to verify a parsed datagram's checksum against the addresses it was sent between.
+// A checksum of zero means the sender did not compute one, which is allowed over IPv4 but not over IPv6,
+// where the checksum is mandatory (RFC 8200 8.1).
+func (h *UDPGram) IsChecksumValid(source, destination netip.Addr) bool {
+	if source.Is4() != destination.Is4() {
+		return false
+	}
+
+	if h.Checksum == 0 {
+		return source.Is4()
+	}
+
+	header := bytehelpers.ConcatenateByteArrays(
+		bytehelpers.Uint16ToByteArray(h.SourcePort),
+		bytehelpers.Uint16ToByteArray(h.DestinationPort),
+		bytehelpers.Uint16ToByteArray(h.Length),
+		bytehelpers.Uint16ToByteArray(h.Checksum),
+	)
+
+	return pseudoHeaderSum(source, destination, int(h.Length)).Add(header).Add(h.Data).Fold() == 0xFFFF
+}
+
+func pseudoHeaderSum(source, destination netip.Addr, length int) bytehelpers.Sum {
+	if !source.Is4() {
+		return ipv6.PseudoHeaderSum(source, destination, ipv6.NextHeaderUDP, length)
+	}
+
+	return ipv4.PseudoHeaderSum(source, destination, ipv4.ProtocolUDP, length)
+}
+
 // ParseRawUDPGram Function to parse a raw UDP datagram byte array into a UDPGram struct
 func ParseRawUDPGram(ctx context.Context, data []byte) (*UDPGram, error) {
-	logger := logger.GetLoggerFromContext(ctx, nil)
+	if len(data) < HeaderLength {
+		err := fmt.Errorf("invalid UDP datagram length: %d", len(data))
+		logger.GetLoggerFromContext(ctx, nil).Error(err.Error())
+
+		return nil, err
+	}
 
 	sourcePort := bytehelpers.ByteArrayToUint16(data[0:2])
 	destinationPort := bytehelpers.ByteArrayToUint16(data[2:4])
 	length := bytehelpers.ByteArrayToUint16(data[4:6])
 	checksum := bytehelpers.ByteArrayToUint16(data[6:8])
 
+	logger := logger.GetLoggerFromContext(ctx, nil).With(
+		"src_port", sourcePort,
+		"dst_port", destinationPort,
+		"len", length,
+	)
+
 	if len(data) != int(length) {
 		err := fmt.Errorf("invalid UDP header length. Expected length (%d) does not match actual data length (%d)", length, len(data))
-		logger.Error(err.Error())
+		logger.Error(err.Error(), "actual_len", len(data))
 
 		return nil, err
 	}
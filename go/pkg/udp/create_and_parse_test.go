@@ -2,6 +2,7 @@ package udp
 
 import (
 	"context"
+	"net/netip"
 	"networking/internal/logger"
 	testhelpers "networking/internal/test_helpers"
 	"testing"
@@ -257,7 +258,30 @@ func Test_Create_NoData(t *testing.T) {
 		Data:            []byte{},
 	}
 
-	expected := "data cannot be empty"
+	expected := []byte{
+		0x1F, 0x90, // Source Port: 8080
+		0x00, 0x50, // Destination Port: 80
+		0x00, 0x08, // Length: 8 (header only)
+	}
+
+	actual, err := udpGram.CreateUDPGram(lctx)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if len(actual) != HeaderLength || string(actual[0:6]) != string(expected) {
+		t.Errorf("Created UDPGram does not match expected header.\nExpected: %+v\nActual: %+v", expected, actual)
+	}
+}
+
+func Test_Create_DataTooLong(t *testing.T) {
+	lctx := logger.PrepTest()
+
+	udpGram := UDPGram{
+		SourcePort:      8080,
+		DestinationPort: 80,
+		Data:            make([]byte, MaxDataLength+1),
+	}
+
+	expected := "data too long for a UDP datagram: 65528 bytes, at most 65527"
 
 	_, err := udpGram.CreateUDPGram(lctx)
 
@@ -338,3 +362,126 @@ func Test_Create_Then_Parse_Consistency(t *testing.T) {
 		t.Errorf("Data mismatch. Expected: %s, Got: %s", original.Data, parsed.Data)
 	}
 }
+
+func Test_Parse_LogsHeaderFields(t *testing.T) {
+	lctx := logger.PrepTest()
+
+	input := []byte{
+		0x00, 0x00, // Source Port: 0
+		0x00, 0x50, // Destination Port: 80
+		0x00, 0x0C, // Length: 12
+		0x1A, 0x2B, // Checksum
+	}
+	input = append(input, []byte("Test")...)
+
+	_, err := ParseRawUDPGram(*lctx, input)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	mockLogger := logger.GetLoggerFromContext(*lctx, nil).(*logger.MockLogger)
+	entry, ok := mockLogger.FindEntry("Source port is set to 0")
+	if !ok {
+		t.Fatalf("Expected warning not found in logs")
+	}
+
+	expected := map[string]any{"src_port": uint16(0), "dst_port": uint16(80), "len": uint16(12)}
+	for key, value := range expected {
+		if entry.Fields[key] != value {
+			t.Errorf("Expected field %s=%v, got %v", key, value, entry.Fields[key])
+		}
+	}
+}
+
+/**
+* Test cases for pseudo-header checksums
+ */
+
+func Test_CreateForAddresses_ValidatesAgainstPseudoHeader(t *testing.T) {
+	source := netip.MustParseAddr("10.0.0.1")
+	destination := netip.MustParseAddr("10.0.0.2")
+
+	original := UDPGram{
+		SourcePort:      40000,
+		DestinationPort: 40001,
+		Data:            []byte("hello from the stack"),
+	}
+
+	raw, err := original.CreateUDPGramForAddresses(context.TODO(), source, destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRawUDPGram(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !parsed.IsChecksumValid(source, destination) {
+		t.Errorf("Expected checksum to validate against the addresses it was created for")
+	}
+
+	if parsed.IsChecksumValid(source, netip.MustParseAddr("10.0.0.3")) {
+		t.Errorf("Expected checksum to fail against a different destination")
+	}
+
+	if parsed.Checksum != original.Checksum || parsed.Length != original.Length {
+		t.Errorf("Expected checksum and length to be written back to the struct")
+	}
+}
+
+func Test_IsChecksumValid_ZeroMeansNoChecksum(t *testing.T) {
+	datagram := UDPGram{SourcePort: 1, DestinationPort: 2, Length: 9, Checksum: 0, Data: []byte("x")}
+
+	if !datagram.IsChecksumValid(netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("10.0.0.2")) {
+		t.Errorf("Expected a zero checksum to be accepted over IPv4")
+	}
+}
+
+func Test_CreateForAddresses_IPv6PseudoHeader(t *testing.T) {
+	source := netip.MustParseAddr("2001:db8::1")
+	destination := netip.MustParseAddr("fe80::2")
+
+	original := UDPGram{
+		SourcePort:      40000,
+		DestinationPort: 40001,
+		Data:            []byte("hello from the stack"),
+	}
+
+	raw, err := original.CreateUDPGramForAddresses(context.TODO(), source, destination)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	parsed, err := ParseRawUDPGram(context.TODO(), raw)
+	testhelpers.FailTestIfErrorIsPresent(t, err)
+
+	if !parsed.IsChecksumValid(source, destination) {
+		t.Errorf("Expected checksum to validate against the IPv6 addresses it was created for")
+	}
+
+	if parsed.IsChecksumValid(source, netip.MustParseAddr("fe80::3")) {
+		t.Errorf("Expected checksum to fail against a different destination")
+	}
+}
+
+func Test_CreateForAddresses_MixedFamilies(t *testing.T) {
+	lctx := logger.PrepTest()
+	datagram := UDPGram{SourcePort: 1, DestinationPort: 2, Data: []byte("x")}
+
+	_, err := datagram.CreateUDPGramForAddresses(*lctx, netip.MustParseAddr("10.0.0.1"), netip.MustParseAddr("2001:db8::1"))
+
+	if err == nil {
+		t.Errorf("Expected an error for an IPv4 source and IPv6 destination")
+	}
+}
+
+func Test_IsChecksumValid_ZeroRejectedOverIPv6(t *testing.T) {
+	datagram := UDPGram{SourcePort: 1, DestinationPort: 2, Length: 9, Checksum: 0, Data: []byte("x")}
+
+	if datagram.IsChecksumValid(netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("2001:db8::2")) {
+		t.Errorf("Expected a zero checksum to be rejected over IPv6")
+	}
+}
+
+func Test_Parse_TooShort(t *testing.T) {
+	expected := "invalid UDP datagram length: 4"
+
+	_, err := ParseRawUDPGram(context.TODO(), []byte{0x1F, 0x90, 0x00, 0x50})
+
+	if err == nil || err.Error() != expected {
+		t.Errorf("Expected error '%s', but got '%v'", expected, err)
+	}
+}
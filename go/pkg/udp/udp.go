@@ -1,7 +0,0 @@
-package udp
-
-import "fmt"
-
-func Hello() {
-	fmt.Println("UDP package main function")
-}